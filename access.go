@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Access rules grant a single host access to a volume with its own access
+// mode and options. They're sub-resources of the volume, so integrations
+// managing grants (e.g. a Manila driver or Nomad host volumes) can add and
+// remove them one by one instead of diffing the volume's host list. A host is
+// either in the volume's hosts or in one of its rules, never both.
+
+var accessIDRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,63}$`)
+
+func validateAccessRule(req *api.AccessRuleRequest) error {
+	if req.Host == "" {
+		return &validationError{Field: "Host", Reason: "must provide a host"}
+	}
+	if err := validateHosts([]string{req.Host}); err != nil {
+		return err
+	}
+	switch req.Access {
+	case "":
+		req.Access = "rw"
+	case "rw", "ro":
+	default:
+		return &validationError{Field: "Access", Value: req.Access, Reason: "must be rw or ro"}
+	}
+	return validateOptions(req.Options)
+}
+
+// setAccessRule creates or replaces the rule with the id, it reports whether
+// the rule was created
+func setAccessRule(v *volume, id string, req api.AccessRuleRequest) (bool, error) {
+	for _, h := range v.Export.Hosts {
+		if h == req.Host {
+			return false, errAlreadyExists("the host is one of the volume's hosts")
+		}
+	}
+	existing := -1
+	for i, a := range v.Export.Access {
+		switch {
+		case a.ID == id:
+			existing = i
+		case a.Host == req.Host:
+			return false, errAlreadyExists("access rule " + a.ID + " is for the same host")
+		}
+	}
+
+	rule := api.AccessRule{ID: id, Host: req.Host, Access: req.Access, Options: req.Options}
+	if existing < 0 {
+		now := time.Now().UTC()
+		rule.CreatedAt = &now
+		v.Export.Access = append(v.Export.Access, rule)
+		return true, nil
+	}
+	rule.CreatedAt = v.Export.Access[existing].CreatedAt
+	if v.Export.Access[existing] == rule {
+		return false, errUnchanged
+	}
+	v.Export.Access[existing] = rule
+	return false, nil
+}
+
+// checkRuleHosts refuses hosts of the volume which also have an access rule
+func checkRuleHosts(v *volume) error {
+	for _, h := range v.Export.Hosts {
+		for _, a := range v.Export.Access {
+			if a.Host == h {
+				return &validationError{Field: "Hosts", Value: h, Reason: "has access rule " + a.ID + ", remove it first"}
+			}
+		}
+	}
+	return nil
+}
+
+func findAccessRule(v *volume, id string) (api.AccessRule, bool) {
+	for _, a := range v.Export.Access {
+		if a.ID == id {
+			return a, true
+		}
+	}
+	return api.AccessRule{}, false
+}
+
+func (g *gateway) listAccessRules(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	var v *volume
+	err := g.view(func(tx *bolt.Tx) error {
+		var err error
+		v, err = readVolume(tx, scopedName(r, name))
+		return err
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rules := v.Export.Access
+	if rules == nil {
+		rules = []api.AccessRule{}
+	}
+	writeAccessResponse(w, v, rules, http.StatusOK)
+}
+
+func (g *gateway) getAccessRule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, id := vars["name"], vars["id"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	var v *volume
+	err := g.view(func(tx *bolt.Tx) error {
+		var err error
+		v, err = readVolume(tx, scopedName(r, name))
+		return err
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rule, ok := findAccessRule(v, id)
+	if !ok {
+		writeError(w, errNotFound("access rule not found"))
+		return
+	}
+	writeAccessResponse(w, v, rule, http.StatusOK)
+}
+
+func (g *gateway) createAccessRule(w http.ResponseWriter, r *http.Request) {
+	id, err := newID()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	g.setAccess(w, r, id)
+}
+
+func (g *gateway) putAccessRule(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !accessIDRe.MatchString(id) {
+		writeError(w, &validationError{Field: "ID", Value: id, Reason: "must be 1-64 letters, digits, '_', '.' or '-'"})
+		return
+	}
+	g.setAccess(w, r, id)
+}
+
+func (g *gateway) setAccess(w http.ResponseWriter, r *http.Request, id string) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	var req api.AccessRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	if err := validateAccessRule(&req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var created bool
+	v, err := g.modifyVolume(r.Context(), scopedName(r, name), func(v *volume) error {
+		if err := checkIfMatch(r, v); err != nil {
+			return err
+		}
+		if v.Mirror {
+			return errMirror()
+		}
+		var err error
+		created, err = setAccessRule(v, id, req)
+		return err
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	rule, _ := findAccessRule(v, id)
+	writeAccessResponse(w, v, rule, status)
+}
+
+func (g *gateway) deleteAccessRule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, id := vars["name"], vars["id"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	v, err := g.modifyVolume(r.Context(), scopedName(r, name), func(v *volume) error {
+		if err := checkIfMatch(r, v); err != nil {
+			return err
+		}
+		if v.Mirror {
+			return errMirror()
+		}
+		for i, a := range v.Export.Access {
+			if a.ID == id {
+				v.Export.Access = append(v.Export.Access[:i], v.Export.Access[i+1:]...)
+				return nil
+			}
+		}
+		return errNotFound("access rule not found")
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := setETag(w, v); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeAccessResponse writes access rules of the volume along with its ETag
+func writeAccessResponse(w http.ResponseWriter, v *volume, resp interface{}, status int) {
+	if err := setETag(w, v); err != nil {
+		writeError(w, err)
+		return
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(b)
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// POSIX ACLs are kept by the kernel in the system.posix_acl_access and
+// system.posix_acl_default xattrs, a version header followed by entries of a
+// tag, permissions and id, all little endian.
+
+const (
+	aclXattrAccess  = "system.posix_acl_access"
+	aclXattrDefault = "system.posix_acl_default"
+	aclXattrVersion = 2
+	aclUndefinedID  = 0xffffffff
+	aclEntrySize    = 8
+)
+
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+)
+
+var aclTags = map[string]uint16{"user": aclUser, "group": aclGroup, "mask": aclMask, "other": aclOther}
+
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+func parsePerms(s string) (uint16, error) {
+	var perm uint16
+	for _, c := range s {
+		switch c {
+		case 'r':
+			perm |= 4
+		case 'w':
+			perm |= 2
+		case 'x':
+			perm |= 1
+		case '-':
+		default:
+			return 0, &validationError{Field: "Perms", Value: s, Reason: "must be made of r, w, x and -"}
+		}
+	}
+	return perm, nil
+}
+
+func formatPerms(perm uint16) string {
+	b := []byte("---")
+	for i, c := range "rwx" {
+		if perm&(4>>uint(i)) != 0 {
+			b[i] = byte(c)
+		}
+	}
+	return string(b)
+}
+
+// parseACL validates entries, adding the mask setfacl(1) would compute when
+// named users or groups are given without one
+func parseACL(entries []api.ACLEntry) ([]aclEntry, error) {
+	var acl []aclEntry
+	seen := make(map[aclEntry]bool)
+	var named, hasMask bool
+	for _, e := range entries {
+		tag, ok := aclTags[e.Tag]
+		if !ok {
+			return nil, &validationError{Field: "Tag", Value: e.Tag, Reason: "must be user, group, mask or other"}
+		}
+		perm, err := parsePerms(e.Perms)
+		if err != nil {
+			return nil, err
+		}
+		entry := aclEntry{tag: tag, perm: perm, id: aclUndefinedID}
+		switch {
+		case e.ID != nil && (tag == aclUser || tag == aclGroup):
+			entry.id = *e.ID
+			named = true
+		case e.ID != nil:
+			return nil, &validationError{Field: "ID", Value: e.Tag, Reason: "only user and group entries have an id"}
+		case tag == aclUser:
+			entry.tag = aclUserObj
+		case tag == aclGroup:
+			entry.tag = aclGroupObj
+		}
+		hasMask = hasMask || entry.tag == aclMask
+		key := aclEntry{tag: entry.tag, id: entry.id}
+		if seen[key] {
+			return nil, &validationError{Field: "Tag", Value: e.Tag, Reason: "listed more than once"}
+		}
+		seen[key] = true
+		acl = append(acl, entry)
+	}
+	for _, tag := range []uint16{aclUserObj, aclGroupObj, aclOther} {
+		if !seen[aclEntry{tag: tag, id: aclUndefinedID}] {
+			return nil, errInvalid("an ACL needs entries for the owning user, the owning group and other")
+		}
+	}
+	if named && !hasMask {
+		var mask uint16
+		for _, e := range acl {
+			if e.tag != aclUserObj && e.tag != aclOther {
+				mask |= e.perm
+			}
+		}
+		acl = append(acl, aclEntry{tag: aclMask, perm: mask, id: aclUndefinedID})
+	}
+	// the kernel only accepts entries ordered by tag and id
+	sort.Slice(acl, func(i, j int) bool {
+		if acl[i].tag != acl[j].tag {
+			return acl[i].tag < acl[j].tag
+		}
+		return acl[i].id < acl[j].id
+	})
+	return acl, nil
+}
+
+func encodeACL(acl []aclEntry) []byte {
+	b := make([]byte, 4+aclEntrySize*len(acl))
+	binary.LittleEndian.PutUint32(b, aclXattrVersion)
+	for i, e := range acl {
+		p := b[4+aclEntrySize*i:]
+		binary.LittleEndian.PutUint16(p, e.tag)
+		binary.LittleEndian.PutUint16(p[2:], e.perm)
+		binary.LittleEndian.PutUint32(p[4:], e.id)
+	}
+	return b
+}
+
+func decodeACL(b []byte) ([]api.ACLEntry, error) {
+	if len(b) < 4 || (len(b)-4)%aclEntrySize != 0 || binary.LittleEndian.Uint32(b) != aclXattrVersion {
+		return nil, errors.New("invalid ACL xattr")
+	}
+	entries := []api.ACLEntry{}
+	for p := b[4:]; len(p) > 0; p = p[aclEntrySize:] {
+		e := api.ACLEntry{Perms: formatPerms(binary.LittleEndian.Uint16(p[2:]))}
+		switch binary.LittleEndian.Uint16(p) {
+		case aclUserObj:
+			e.Tag = "user"
+		case aclGroupObj:
+			e.Tag = "group"
+		case aclUser:
+			e.Tag = "user"
+			e.ID = aclID(p)
+		case aclGroup:
+			e.Tag = "group"
+			e.ID = aclID(p)
+		case aclMask:
+			e.Tag = "mask"
+		case aclOther:
+			e.Tag = "other"
+		default:
+			return nil, errors.Errorf("unknown ACL tag %#x", binary.LittleEndian.Uint16(p))
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func aclID(entry []byte) *uint32 {
+	id := binary.LittleEndian.Uint32(entry[4:])
+	return &id
+}
+
+func getXattr(p, name string) ([]byte, error) {
+	for {
+		n, err := unix.Getxattr(p, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, n)
+		n, err = unix.Getxattr(p, name, b)
+		// the xattr grew in between, try again
+		if err == unix.ERANGE {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+
+// readACL returns the ACLs of p. Without an access ACL the one matching its
+// mode is returned, like getfacl(1) does.
+func readACL(p string) (*api.ACL, error) {
+	acl := &api.ACL{}
+	b, err := getXattr(p, aclXattrAccess)
+	switch err {
+	case nil:
+		if acl.Access, err = decodeACL(b); err != nil {
+			return nil, err
+		}
+	case unix.ENODATA, unix.ENOTSUP:
+		var st unix.Stat_t
+		if err := unix.Stat(p, &st); err != nil {
+			return nil, errors.Wrap(err, "error reading volume dir")
+		}
+		acl.Access = []api.ACLEntry{
+			{Tag: "user", Perms: formatPerms(uint16(st.Mode>>6) & 7)},
+			{Tag: "group", Perms: formatPerms(uint16(st.Mode>>3) & 7)},
+			{Tag: "other", Perms: formatPerms(uint16(st.Mode) & 7)},
+		}
+	default:
+		return nil, errors.Wrap(err, "error reading access ACL")
+	}
+
+	b, err = getXattr(p, aclXattrDefault)
+	switch err {
+	case nil:
+		if acl.Default, err = decodeACL(b); err != nil {
+			return nil, err
+		}
+	case unix.ENODATA, unix.ENOTSUP:
+	default:
+		return nil, errors.Wrap(err, "error reading default ACL")
+	}
+	return acl, nil
+}
+
+// writeACL replaces the ACLs of p, an empty default ACL removes it
+func writeACL(p string, access, def []aclEntry) error {
+	if err := unix.Setxattr(p, aclXattrAccess, encodeACL(access), 0); err != nil {
+		return aclError(err, "error setting access ACL")
+	}
+	if len(def) == 0 {
+		if err := unix.Removexattr(p, aclXattrDefault); err != nil && err != unix.ENODATA {
+			return aclError(err, "error removing default ACL")
+		}
+		return nil
+	}
+	if err := unix.Setxattr(p, aclXattrDefault, encodeACL(def), 0); err != nil {
+		return aclError(err, "error setting default ACL")
+	}
+	return nil
+}
+
+func aclError(err error, msg string) error {
+	if err == unix.ENOTSUP {
+		return errInvalid("the volume's filesystem doesn't support ACLs")
+	}
+	return errors.Wrap(err, msg)
+}
+
+func writeACLResponse(w http.ResponseWriter, acl *api.ACL) {
+	b, err := json.Marshal(acl)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+func (g *gateway) getACL(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	v, err := g.lookup(scopedName(r, name))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	acl, err := readACL(v.Export.Path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeACLResponse(w, acl)
+}
+
+// setACL replaces the ACLs of the volume's root directory
+func (g *gateway) setACL(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	name = scopedName(r, name)
+
+	var req api.ACL
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	access, err := parseACL(req.Access)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var def []aclEntry
+	if len(req.Default) > 0 {
+		if def, err = parseACL(req.Default); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	defer g.locks.lock(name)()
+	v, err := g.lookup(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if v.Mirror {
+		writeError(w, errMirror())
+		return
+	}
+	if err := writeACL(v.Export.Path, access, def); err != nil {
+		writeError(w, err)
+		return
+	}
+	acl, err := readACL(v.Export.Path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	volumeEvent(eventVolumeUpdated, name, nil)
+	writeACLResponse(w, acl)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/pkg/errors"
+)
+
+// Volumes created with AliasOf export the data of another volume of the same
+// tenant under their own name, hosts and options, e.g. a read-only alias for
+// analytics hosts. An alias bind mounts the volume's export path like a
+// Source would, so deleting it leaves the data alone. The volume itself
+// can't be deleted, renamed or migrated while it has aliases, and its lock is
+// held while an alias is created so it can't start being deleted meanwhile.
+// Scoped tokens may only alias volumes in their scope, and aliases of
+// read-only volumes and mirrors must be read-only themselves.
+
+func validateAlias(req *api.CreateRequest) error {
+	if err := validateName(req.AliasOf); err != nil {
+		return &validationError{Field: "AliasOf", Value: req.AliasOf, Reason: "must be a volume name"}
+	}
+	switch {
+	case req.Source != "":
+		return errInvalid("Source can't be used with AliasOf")
+	case req.SizeBytes > 0:
+		return errInvalid("SizeBytes can't be used with AliasOf")
+	case req.Uid != nil || req.Gid != nil || req.Mode != "":
+		return errInvalid("Uid, Gid and Mode can't be used with AliasOf")
+	case req.Pool != "":
+		return errInvalid("Pool can't be used with AliasOf, aliases are placed with their volume")
+	case req.Mirror:
+		return errInvalid("aliases can't be created as mirrors")
+	}
+	return nil
+}
+
+// aliasID returns the id of the volume the alias name of req exports
+func aliasID(name string, req api.CreateRequest) string {
+	return volumeID(volumeTenant(name), req.AliasOf)
+}
+
+// aliasTarget returns the volume the alias name of req exports, checking it
+// is within the scope of the binding of the request ctx belongs to
+func aliasTarget(ctx context.Context, tx *bolt.Tx, name string, req api.CreateRequest) (*volume, error) {
+	target, err := readVolume(tx, aliasID(name, req))
+	if errorCode(err) == api.ErrCodeNotFound {
+		return nil, &validationError{Field: "AliasOf", Value: req.AliasOf, Reason: "no such volume"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !contextBinding(ctx).allows(displayName(target.Name), target.Labels) {
+		return nil, errForbidden("the token may not manage volume " + displayName(target.Name))
+	}
+	switch status, _ := target.status(); {
+	case target.AliasOf != "":
+		return nil, &validationError{Field: "AliasOf", Value: req.AliasOf, Reason: "is an alias itself, use " + displayName(target.AliasOf)}
+	case target.Pending != "":
+		return nil, errInvalid("the aliased volume is still being populated")
+	case status != api.VolumeAvailable && status != api.VolumeDegraded:
+		return nil, newError(http.StatusConflict, api.ErrCodeInvalidRequest, "the aliased volume is "+status)
+	case target.Mirror && !req.ReadOnly:
+		return nil, errInvalid("aliases of a mirror must be ReadOnly")
+	case target.ReadOnly && !req.ReadOnly:
+		return nil, errInvalid("aliases of a read-only volume must be ReadOnly")
+	}
+	return target, nil
+}
+
+// aliasesOf returns the aliases of the volume
+func aliasesOf(tx *bolt.Tx, id string) ([]*volume, error) {
+	var aliases []*volume
+	err := forEachVolume(tx, func(data []byte) error {
+		var v volume
+		if err := json.Unmarshal(data, &v); err != nil {
+			return dbError(errors.Wrap(err, "error unmarshaling volume from database"))
+		}
+		if v.AliasOf == id {
+			aliases = append(aliases, &v)
+		}
+		return nil
+	})
+	return aliases, err
+}
+
+// aliasNames returns the display names of the volume's aliases
+func aliasNames(tx *bolt.Tx, id string) ([]string, error) {
+	aliases, err := aliasesOf(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, a := range aliases {
+		names = append(names, displayName(a.Name))
+	}
+	return names, nil
+}
+
+// checkNoAliases refuses to change the volume's data or path under its
+// aliases
+func checkNoAliases(tx *bolt.Tx, id string) error {
+	names, err := aliasNames(tx, id)
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		return newError(http.StatusConflict, api.ErrCodeInvalidRequest, "volume has aliases: "+strings.Join(names, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+// Package api holds the types shared between the gateway and its clients.
+package api
+
+// Error codes returned in the Code field of an ErrorResponse
+const (
+	ErrCodeInvalidRequest = "invalid_request"
+	ErrCodeUnauthorized   = "unauthorized"
+	// ErrCodeForbidden is returned when the token's role or scope doesn't
+	// allow the request
+	ErrCodeForbidden     = "forbidden"
+	ErrCodeNotFound      = "not_found"
+	ErrCodeAlreadyExists = "already_exists"
+	ErrCodeQuotaExceeded = "quota_exceeded"
+	ErrCodeExportFailed  = "exportfs_failed"
+	ErrCodeVolumeInUse   = "volume_in_use"
+	// ErrCodeVolumeIsMirror is returned when changing a read-only mirror
+	// which hasn't been promoted
+	ErrCodeVolumeIsMirror = "volume_is_mirror"
+	// ErrCodeReplicaUnsupported is returned when a replica can't be received
+	// with the method it was sent with, the sender falls back to rsync
+	ErrCodeReplicaUnsupported = "replica_method_unsupported"
+	// ErrCodeReplicaBaseMissing is returned when the snapshot an incremental
+	// replica is based on isn't on the receiver, the sender sends a full one
+	ErrCodeReplicaBaseMissing = "replica_base_missing"
+	// ErrCodeRateLimited is returned with a Retry-After header when a client
+	// sends requests faster than the gateway allows
+	ErrCodeRateLimited = "rate_limited"
+	// ErrCodeTimeout is returned when a request doesn't finish within its
+	// timeout, the change it asked for may still have been made
+	ErrCodeTimeout = "timeout"
+	// ErrCodeMaintenance is returned with a Retry-After header for changes
+	// requested while the gateway is in maintenance
+	ErrCodeMaintenance = "maintenance"
+	// ErrCodePreconditionFailed is returned when the volume's ETag doesn't
+	// match the request's If-Match header
+	ErrCodePreconditionFailed = "precondition_failed"
+	// ErrCodeUnsupportedVersion is returned when the API-Version header asks
+	// for a version the gateway doesn't serve
+	ErrCodeUnsupportedVersion = "unsupported_api_version"
+	// ErrCodeTooLarge is returned when an upload exceeds the gateway's
+	// size limit
+	ErrCodeTooLarge = "too_large"
+	ErrCodeDatabase = "database_error"
+	ErrCodeInternal = "internal_error"
+)
+
+// ErrorResponse is the body of every non-2xx response from the gateway
+type ErrorResponse struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (e *ErrorResponse) Error() string {
+	return e.Code + ": " + e.Message
+}
@@ -0,0 +1,5 @@
+// Package pb is the gRPC API served with -grpc, generated from volumes.proto
+// with protoc-gen-go v1.2.0.
+package pb
+
+//go:generate protoc --go_out=plugins=grpc:. volumes.proto
@@ -0,0 +1,465 @@
+package api
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type CreateRequest struct {
+	Hosts   []string
+	Options string
+	// SizeBytes, when set, limits the volume to this size, either with a loop
+	// mounted image or a project quota depending on the server's quota backend
+	SizeBytes int64
+	// FSType is the filesystem to format a loop image with, ext4 or xfs
+	FSType string
+	// Security lists the allowed security flavors: sys, krb5, krb5i or krb5p
+	Security []string
+	Labels   map[string]string
+	// ReadOnly exports the volume ro regardless of Options
+	ReadOnly bool
+	// Mirror creates the volume as a read-only mirror receiving replicas
+	// from another gateway. It is exported ro and refuses changes until it
+	// is promoted.
+	Mirror bool `json:",omitempty"`
+	// Source is an existing directory on the server to bind mount instead
+	// of provisioning storage. It must be inside one of the server's import
+	// paths and is left in place when the volume is deleted.
+	Source string `json:",omitempty"`
+	// Pool is the storage pool to place the volume in, the server's
+	// placement policy picks one when empty
+	Pool string `json:",omitempty"`
+	// Uid, Gid and Mode set the owner and permissions of the volume's root
+	// directory, so clients not running as root can write to it. Mode is
+	// octal, e.g. 0770.
+	Uid  *uint32 `json:",omitempty"`
+	Gid  *uint32 `json:",omitempty"`
+	Mode string  `json:",omitempty"`
+	// AnonUid and AnonGid are added to the export options as anonuid and
+	// anongid, the ids squashed users are mapped to
+	AnonUid *uint32 `json:",omitempty"`
+	AnonGid *uint32 `json:",omitempty"`
+	// SecurityLabel adds the security_label option, passing SELinux labels
+	// to NFSv4.2 clients
+	SecurityLabel bool `json:",omitempty"`
+	// Description is free-form text about the volume, up to 1024 bytes
+	Description string `json:",omitempty"`
+	// Protocols are the protocols the volume is shared with, nfs and
+	// optionally smb. It defaults to nfs only.
+	Protocols []string `json:",omitempty"`
+	// Template names the gateway's template to take the hosts, options,
+	// security flavors, size and filesystem type from, settings in the
+	// request override it
+	Template string `json:",omitempty"`
+	// TTL (e.g. "24h") or ExpiresAt make the gateway delete the volume once
+	// it expires, at most one of them may be set
+	TTL       string     `json:",omitempty"`
+	ExpiresAt *time.Time `json:",omitempty"`
+	// AliasOf names an existing volume to export the data of under this
+	// volume's name, with its own hosts and options. The volume can't be
+	// deleted while it has aliases.
+	AliasOf string `json:",omitempty"`
+}
+
+// ImportRequest adopts the existing directory at Path as a volume
+type ImportRequest struct {
+	Path     string
+	Hosts    []string
+	Options  string
+	Security []string
+	Labels   map[string]string
+	ReadOnly bool
+	// Description is free-form text about the volume, up to 1024 bytes
+	Description string `json:",omitempty"`
+}
+
+// CloneRequest creates the volume Name from a copy of another volume. The
+// source's export settings are used for anything not given.
+type CloneRequest struct {
+	Name     string
+	Hosts    []string
+	Options  string
+	Security []string
+	Labels   map[string]string
+}
+
+type RenameRequest struct {
+	// Name is the volume's new name
+	Name string
+}
+
+type CreateResponse struct {
+	Name string
+	Path string
+}
+
+// BatchCreateItem is one volume of a batch create
+type BatchCreateItem struct {
+	Name string
+	CreateRequest
+}
+
+type BatchCreateResponse struct {
+	// Results are in the order of the request's items
+	Results []BatchCreateResult
+}
+
+// BatchCreateResult is the outcome of one item, Error is set when the volume
+// wasn't created
+type BatchCreateResult struct {
+	Name  string
+	Path  string         `json:",omitempty"`
+	Error *ErrorResponse `json:",omitempty"`
+}
+
+type GetResponse struct {
+	Name        string
+	Path        string
+	Labels      map[string]string `json:",omitempty"`
+	ReadOnly    bool              `json:",omitempty"`
+	Mirror      bool              `json:",omitempty"`
+	Pool        string            `json:",omitempty"`
+	Replication *Replication      `json:",omitempty"`
+	Description string            `json:",omitempty"`
+	Protocols   []string          `json:",omitempty"`
+	// Template is the template the volume was created from
+	Template string `json:",omitempty"`
+	// ExpiresAt is when the gateway deletes the volume
+	ExpiresAt *time.Time `json:",omitempty"`
+	// AliasOf is the volume whose data this volume exports
+	AliasOf string `json:",omitempty"`
+	// Aliases are the volumes exporting this volume's data
+	Aliases []string `json:",omitempty"`
+	// Status is where the volume is in its lifecycle, StatusReason says
+	// why it's degraded or failed
+	Status       string
+	StatusReason string `json:",omitempty"`
+	// CreatedBy identifies who created the volume, e.g. "binding:ci" or
+	// "oidc:<subject>", it's empty for volumes created without auth
+	CreatedBy string     `json:",omitempty"`
+	CreatedAt *time.Time `json:",omitempty"`
+	// UpdatedAt is when the volume's record last changed
+	UpdatedAt *time.Time `json:",omitempty"`
+	// ETag changes with every change to the volume, updates and deletes
+	// sent with it in an If-Match header fail if the volume changed since
+	ETag string `json:",omitempty"`
+}
+
+// Volume statuses
+const (
+	// VolumeCreating volumes are still being populated
+	VolumeCreating  = "creating"
+	VolumeAvailable = "available"
+	// VolumeDegraded volumes exist but couldn't be exported
+	VolumeDegraded = "degraded"
+	VolumeDeleting = "deleting"
+	// VolumeError volumes failed to be deleted, repairing them makes them
+	// available again
+	VolumeError = "error"
+)
+
+// VolumeState is the complete state of a volume, as converged to by
+// PUT /volumes/{name}
+type VolumeState struct {
+	Name      string
+	Path      string
+	Hosts     []string
+	Options   string
+	Security  []string          `json:",omitempty"`
+	Labels    map[string]string `json:",omitempty"`
+	ReadOnly  bool              `json:",omitempty"`
+	Mirror    bool              `json:",omitempty"`
+	Pool      string            `json:",omitempty"`
+	SizeBytes int64             `json:",omitempty"`
+	// Access are the volume's access rules and Subexports its subexports,
+	// they aren't part of the spec
+	Access      []AccessRule `json:",omitempty"`
+	Subexports  []Subexport  `json:",omitempty"`
+	Description string       `json:",omitempty"`
+	Protocols   []string     `json:",omitempty"`
+	Template    string       `json:",omitempty"`
+	ExpiresAt   *time.Time   `json:",omitempty"`
+	AliasOf     string       `json:",omitempty"`
+	CreatedBy   string       `json:",omitempty"`
+	CreatedAt   *time.Time   `json:",omitempty"`
+	UpdatedAt   *time.Time   `json:",omitempty"`
+	ETag        string       `json:",omitempty"`
+}
+
+// ReplicateRequest configures replication of a volume to a volume on another
+// gateway, replacing any previous configuration. The remote volume must
+// already exist, its data is replaced by every sync.
+type ReplicateRequest struct {
+	// Peer is the base URL of the remote gateway's API
+	Peer string
+	// Token authenticates with the remote gateway
+	Token string `json:",omitempty"`
+	// RemoteVolume defaults to the volume's own name
+	RemoteVolume string `json:",omitempty"`
+	// Every is how often to sync, e.g. "15m", empty syncs continuously
+	Every string `json:",omitempty"`
+}
+
+// Replication is the replication state of a volume
+type Replication struct {
+	Peer         string
+	RemoteVolume string
+	Every        string `json:",omitempty"`
+	// Method is how data was last sent: zfs, btrfs or rsync
+	Method    string `json:",omitempty"`
+	Status    string
+	LastSync  *time.Time `json:",omitempty"`
+	LastError string     `json:",omitempty"`
+}
+
+// Replication statuses
+const (
+	ReplicationPending = "pending"
+	ReplicationRunning = "running"
+	ReplicationOK      = "ok"
+	ReplicationFailed  = "failed"
+)
+
+type UpdateRequest struct {
+	Hosts    *[]string
+	Options  *string
+	Security *[]string
+	// Labels replaces all of the volume's labels
+	Labels   *map[string]string
+	ReadOnly *bool
+	// SecurityLabel adds or removes the security_label option
+	SecurityLabel *bool
+	Description   *string
+	// Protocols replaces the protocols the volume is shared with
+	Protocols *[]string
+	// TTL renews the volume's expiry counting from now, ExpiresAt sets it.
+	// An empty TTL or a zero ExpiresAt removes it.
+	TTL       *string
+	ExpiresAt *time.Time
+}
+
+type UpdateResponse struct {
+	Name     string
+	Path     string
+	Hosts    []string
+	Options  string
+	Security []string          `json:",omitempty"`
+	Labels   map[string]string `json:",omitempty"`
+	ReadOnly bool              `json:",omitempty"`
+	Mirror   bool              `json:",omitempty"`
+	// Description is free-form text about the volume
+	Description string     `json:",omitempty"`
+	Protocols   []string   `json:",omitempty"`
+	ExpiresAt   *time.Time `json:",omitempty"`
+}
+
+// DataUploadResponse counts what was extracted from an upload to
+// PUT /volume/{name}/data
+type DataUploadResponse struct {
+	Entries int
+	// Bytes is the size of the extracted files
+	Bytes int64
+}
+
+// FileList is a file in a volume and, for directories, a page of their
+// entries sorted by name
+type FileList struct {
+	Path    string
+	File    FileInfo
+	Entries []FileInfo `json:",omitempty"`
+	// Next is set when there are more entries, pass it as after to get
+	// the next page
+	Next string `json:",omitempty"`
+}
+
+type FileInfo struct {
+	Name string
+	// Type is file, dir, symlink or other
+	Type string
+	Size int64
+	// Mode is the octal permission bits, e.g. 0644
+	Mode    string
+	Uid     uint32
+	Gid     uint32
+	ModTime time.Time
+	// Target is where a symlink points to, it isn't followed
+	Target string `json:",omitempty"`
+}
+
+// File types
+const (
+	FileTypeFile    = "file"
+	FileTypeDir     = "dir"
+	FileTypeSymlink = "symlink"
+	FileTypeOther   = "other"
+)
+
+// SMBShare is the Samba share of a volume shared over SMB
+type SMBShare struct {
+	Name     string
+	Path     string
+	ReadOnly bool `json:",omitempty"`
+	// HostsAllow are the hosts allowed to connect, all of them when empty
+	HostsAllow []string `json:",omitempty"`
+	// State is pending until the share is first applied, then active or
+	// failed
+	State     string
+	Error     string    `json:",omitempty"`
+	UpdatedAt time.Time `json:",omitempty"`
+}
+
+// SMB share states
+const (
+	SMBSharePending = "pending"
+	SMBShareActive  = "active"
+	SMBShareFailed  = "failed"
+)
+
+// AccessRule grants a single host access to a volume, next to the hosts the
+// volume is exported to
+type AccessRule struct {
+	ID string
+	// Host is a host, network, wildcard or @netgroup like the volume's hosts
+	Host string
+	// Access is rw or ro, read-only volumes are ro for every host
+	Access string
+	// Options are export options for this host, over the volume's options
+	Options   string     `json:",omitempty"`
+	CreatedAt *time.Time `json:",omitempty"`
+}
+
+// AccessRuleRequest creates or replaces an access rule
+type AccessRuleRequest struct {
+	Host string
+	// Access is rw or ro, rw by default
+	Access  string `json:",omitempty"`
+	Options string `json:",omitempty"`
+}
+
+// Subexport exports a subdirectory of a volume to its own hosts with its own
+// options
+type Subexport struct {
+	ID string
+	// Path is the directory relative to the volume's root
+	Path     string
+	Hosts    []string
+	Options  string   `json:",omitempty"`
+	Security []string `json:",omitempty"`
+	// FSID identifies the subexport to clients apart from the volume
+	FSID      string
+	CreatedAt *time.Time `json:",omitempty"`
+}
+
+// SubexportRequest creates a subexport
+type SubexportRequest struct {
+	Path     string
+	Hosts    []string
+	Options  string   `json:",omitempty"`
+	Security []string `json:",omitempty"`
+}
+
+// RepairResponse lists the steps of creating the volume POST
+// /volume/{name}/repair re-ran and what each found
+type RepairResponse struct {
+	Name  string
+	Steps []RepairStep
+	// Repaired is set when no step failed
+	Repaired bool
+}
+
+// RepairStep is one step of creating a volume re-run by a repair
+type RepairStep struct {
+	Step    string
+	Status  string
+	Message string `json:",omitempty"`
+}
+
+// Repair step statuses
+const (
+	RepairOK     = "ok"
+	RepairFixed  = "fixed"
+	RepairFailed = "failed"
+)
+
+// ACL is the POSIX ACL of a volume's root directory
+type ACL struct {
+	// Access is checked on access to the directory, it needs user, group
+	// and other entries without an ID
+	Access []ACLEntry
+	// Default is inherited by what is created in the directory, setting an
+	// empty one removes it
+	Default []ACLEntry `json:",omitempty"`
+}
+
+// ACLEntry is an entry of an ACL as getfacl(1) lists it
+type ACLEntry struct {
+	// Tag is user, group, mask or other
+	Tag string
+	// ID is the uid or gid of a named user or group entry, without one the
+	// entry is for the directory's owner or owning group
+	ID *uint32 `json:",omitempty"`
+	// Perms is a combination of r, w and x, e.g. "rwx" or "r-x"
+	Perms string
+}
+
+// VolumeClient is an NFS client which has a volume mounted
+type VolumeClient struct {
+	Address string
+	// Version is the NFS protocol version, e.g. "3" or "4.2"
+	Version string
+	// ClientID and Name identify NFSv4 clients
+	ClientID string `json:",omitempty"`
+	Name     string `json:",omitempty"`
+	// LastRenewed is when an NFSv4 client last renewed its lease
+	LastRenewed *time.Time `json:",omitempty"`
+}
+
+// VolumeStats are the bytes moved through a volume's exports since Since.
+// The kernel doesn't count operations per export.
+type VolumeStats struct {
+	Name             string
+	ReadBytes        uint64
+	WriteBytes       uint64
+	StaleFileHandles uint64
+	// Clients break the totals down by the client specs the volume is
+	// exported to, not by individual hosts
+	Clients []ExportClientStats
+	Since   time.Time
+	// Sampled is when the kernel's counters were last read
+	Sampled time.Time
+}
+
+type ExportClientStats struct {
+	Client     string
+	ReadBytes  uint64
+	WriteBytes uint64
+}
+
+type JobResponse struct {
+	JobID string
+}
+
+// Job is the state of an asynchronous operation as returned by GET /jobs/{id}
+type Job struct {
+	ID     string
+	Type   string
+	Volume string
+	// RequestID is the X-Request-ID of the request which submitted the job
+	RequestID string `json:",omitempty"`
+	Status    string
+	Progress  string `json:",omitempty"`
+	Error     string `json:",omitempty"`
+	// Result depends on the job type, clone-volume jobs return a CreateResponse
+	Result   json.RawMessage `json:",omitempty"`
+	Created  time.Time
+	Started  *time.Time `json:",omitempty"`
+	Finished *time.Time `json:",omitempty"`
+}
+
+// Job statuses
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
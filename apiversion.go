@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+)
+
+// The API is served under /v1. The unversioned paths it was served at before
+// still work as a deprecated alias of v1, their responses carry Deprecation
+// and Link headers pointing at the versioned path. Versioned requests are
+// served by the same routes with the prefix stripped, so everything keyed
+// by route works the same for both.
+
+const (
+	apiVersion        = "v1"
+	apiVersionPrefix  = "/" + apiVersion
+	apiVersionHeader  = "API-Version"
+	serverHeaderValue = "nfs-rest-gateway (API " + apiVersion + ")"
+)
+
+// supportedAPIVersions are the versions clients may ask for with the
+// API-Version header
+var supportedAPIVersions = map[string]bool{apiVersion: true}
+
+// isUnversionedPath reports whether the path isn't part of the versioned
+// API: probes, metrics and the docker plugin protocol keep their paths
+func isUnversionedPath(p string) bool {
+	switch p {
+	case "/healthz", "/readyz", "/metrics", "/openapi.json":
+		return true
+	}
+	return strings.HasPrefix(p, "/Plugin.") || strings.HasPrefix(p, "/VolumeDriver.")
+}
+
+func errUnsupportedVersion(v string) error {
+	return newError(http.StatusNotAcceptable, api.ErrCodeUnsupportedVersion, "API version "+v+" is not supported, this gateway serves "+apiVersion)
+}
+
+// versioned strips the version prefix from requests to the versioned API and
+// marks requests to the legacy paths as deprecated
+func versioned(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", serverHeaderValue)
+		w.Header().Set(apiVersionHeader, apiVersion)
+		if v := r.Header.Get(apiVersionHeader); v != "" && !supportedAPIVersions[v] {
+			writeError(w, errUnsupportedVersion(v))
+			return
+		}
+
+		p := r.URL.Path
+		switch {
+		case strings.HasPrefix(p, apiVersionPrefix+"/"):
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = strings.TrimPrefix(p, apiVersionPrefix)
+			r2.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, apiVersionPrefix)
+			r = r2
+		case !isUnversionedPath(p):
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Link", "<"+apiVersionPrefix+r.URL.EscapedPath()+`>; rel="successor-version"`)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
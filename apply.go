@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// PUT /volumes/{name} takes the complete desired spec of a volume, creates
+// the volume when it doesn't exist and converges it to the spec otherwise, so
+// declarative tools can send the same spec again and again. Settings left out
+// of the spec go back to their defaults. The pool, source, filesystem type
+// and mirroring of a volume are fixed when it's created, specs changing them
+// are refused. Uid, Gid and Mode only apply when the volume is created,
+// clients own the data from then on.
+
+func (g *gateway) applyVolume(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var req api.CreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	if err := checkScope(r, name, req.Labels); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	id := scopedName(r, name)
+	var exists bool
+	err := g.view(func(tx *bolt.Tx) error {
+		exists = getVolumeData(tx, id) != nil
+		return nil
+	})
+	if err != nil {
+		writeError(w, dbError(errors.Wrap(err, "error reading from database")))
+		return
+	}
+
+	status := http.StatusOK
+	var v *volume
+	if !exists {
+		if r.Header.Get(ifMatchHeader) != "" {
+			writeError(w, errPreconditionFailed("the volume doesn't exist"))
+			return
+		}
+		v, err = g.create(r.Context(), id, req)
+		status = http.StatusCreated
+		// created by a concurrent request in the meantime
+		if errorCode(err) == api.ErrCodeAlreadyExists {
+			exists = true
+			status = http.StatusOK
+		}
+	}
+	if exists {
+		v, err = g.converge(r, id, req)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeVolumeState(w, v, status)
+}
+
+// converge changes the volume to match the spec
+func (g *gateway) converge(r *http.Request, id string, req api.CreateRequest) (*volume, error) {
+	// the default is filled in by validation
+	fsType := req.FSType
+	// a TTL counts from when the volume was created, sending the spec again
+	// doesn't renew it
+	ttl := req.TTL
+	if err := g.validateCreate(id, &req); err != nil {
+		return nil, err
+	}
+	var aliasOf string
+	if req.AliasOf != "" {
+		aliasOf = aliasID(id, req)
+	}
+	options := mergeOptions(g.createOptions(req.Options), anonOptions(req))
+	if req.SecurityLabel {
+		options = setFlagOption(options, "security_label", true)
+	}
+
+	var resized bool
+	v, err := g.modifyVolumeTx(r.Context(), id, func(tx *bolt.Tx, u *undoLog, v *volume) error {
+		if err := checkIfMatch(r, v); err != nil {
+			return err
+		}
+		if v.Mirror {
+			return errMirror()
+		}
+		pool := v.Pool
+		if pool == "" {
+			pool = defaultPool
+		}
+		switch {
+		case req.Mirror:
+			return &validationError{Field: "Mirror", Value: "true", Reason: "only new volumes can be created as mirrors"}
+		case req.Pool != "" && req.Pool != pool:
+			return &validationError{Field: "Pool", Value: req.Pool, Reason: "the volume is in pool " + pool + ", migrate it to move it"}
+		case aliasOf != v.AliasOf:
+			return &validationError{Field: "AliasOf", Value: req.AliasOf, Reason: "can't be changed"}
+		case v.AliasOf == "" && req.Source != v.Source:
+			return &validationError{Field: "Source", Value: req.Source, Reason: "can't be changed"}
+		case fsType != "" && v.Loop != nil && fsType != v.Loop.FSType:
+			return &validationError{Field: "FSType", Value: fsType, Reason: "can't be changed"}
+		case req.SizeBytes > 0 && v.Imported:
+			return &validationError{Field: "SizeBytes", Reason: "imported volumes can't be limited"}
+		}
+
+		if size := v.sizeLimit(); req.SizeBytes != size {
+			rs, ok := g.storage.(resizer)
+			if !ok {
+				return errInvalid("resizing is not supported by this storage backend")
+			}
+			if err := g.checkResize(tx, v, req.SizeBytes); err != nil {
+				return err
+			}
+			// loop images can only grow, they keep the new size
+			if v.Loop == nil {
+				prev := *v
+				u.add("restore size", func() error {
+					// a volume which had no limit has the new one removed
+					restore := &prev
+					if size == 0 {
+						restore = v
+					}
+					return g.update(func(tx *bolt.Tx) error { return rs.resize(tx, restore, size) })
+				})
+			}
+			if err := rs.resize(tx, v, req.SizeBytes); err != nil {
+				return err
+			}
+			resized = true
+		}
+		before, err := json.Marshal(v)
+		if err != nil {
+			return errors.Wrap(err, "error marshaling volume data")
+		}
+		v.Export.Hosts = req.Hosts
+		v.Export.Options = options
+		v.Export.Security = req.Security
+		v.Labels = req.Labels
+		v.ReadOnly = req.ReadOnly
+		v.Description = req.Description
+		v.Protocols = req.Protocols
+		v.Template = req.Template
+		if ttl == "" || v.ExpiresAt == nil {
+			v.ExpiresAt = req.ExpiresAt
+		}
+		if err := checkRuleHosts(v); err != nil {
+			return err
+		}
+		// sending the same spec again leaves the volume and its ETag alone
+		if after, err := json.Marshal(v); err == nil && !resized && bytes.Equal(before, after) {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if tenant := volumeTenant(id); resized && tenant != "" {
+		err = g.update(func(tx *bolt.Tx) error {
+			_, err := g.updateQuota(tx, tenant)
+			return err
+		})
+	}
+	return v, err
+}
+
+func writeVolumeState(w http.ResponseWriter, v *volume, status int) {
+	etag, err := volumeETag(v)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := api.VolumeState{
+		Name:        displayName(v.Name),
+		Path:        v.Export.Path,
+		Hosts:       v.Export.Hosts,
+		Options:     v.Export.Options,
+		Security:    v.Export.Security,
+		Labels:      v.Labels,
+		ReadOnly:    v.ReadOnly,
+		Mirror:      v.Mirror,
+		Pool:        v.Pool,
+		SizeBytes:   v.sizeLimit(),
+		Access:      v.Export.Access,
+		Subexports:  v.Subexports,
+		Description: v.Description,
+		Protocols:   v.protocols(),
+		Template:    v.Template,
+		ExpiresAt:   v.ExpiresAt,
+		AliasOf:     displayName(v.AliasOf),
+		CreatedBy:   v.CreatedBy,
+		CreatedAt:   v.CreatedAt,
+		UpdatedAt:   v.UpdatedAt,
+		ETag:        etag,
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Header().Set(etagHeader, etag)
+	w.WriteHeader(status)
+	w.Write(b)
+}
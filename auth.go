@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/pkg/errors"
+)
+
+const authTokensEnv = "NFSG_AUTH_TOKENS"
+
+// unauthenticatedPaths can be reached without a token, for probes
+var unauthenticatedPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	// the spec is needed to generate clients before any token is issued
+	"/openapi.json": true,
+}
+
+type tokenAuth struct {
+	mu sync.RWMutex
+	// sums holds sha256 sums of the accepted tokens so comparisons are always
+	// done on equal length inputs.
+	sums    [][sha256.Size]byte
+	tenants []string
+	// oidc accepts JWTs besides the tokens, it is set before serving
+	oidc *oidcVerifier
+}
+
+// loadTokens collects tokens from a comma separated list, a file with one
+// token per line, and the NFSG_AUTH_TOKENS environment variable. A token may
+// be followed by whitespace and the tenant it belongs to.
+func loadTokens(list, file string) ([]string, error) {
+	tokens := splitTokens(list)
+	tokens = append(tokens, splitTokens(os.Getenv(authTokensEnv))...)
+
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "error opening token file")
+		}
+		defer f.Close()
+
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			line := strings.TrimSpace(s.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			tokens = append(tokens, line)
+		}
+		if err := s.Err(); err != nil {
+			return nil, errors.Wrap(err, "error reading token file")
+		}
+	}
+	return tokens, nil
+}
+
+func splitTokens(s string) []string {
+	var out []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func newTokenAuth(tokens []string) (*tokenAuth, error) {
+	a := &tokenAuth{}
+	return a, a.set(tokens)
+}
+
+// set replaces the accepted tokens
+func (a *tokenAuth) set(tokens []string) error {
+	sums := make([][sha256.Size]byte, 0, len(tokens))
+	tenants := make([]string, 0, len(tokens))
+	for _, t := range tokens {
+		var tenant string
+		if fields := strings.Fields(t); len(fields) == 2 {
+			t, tenant = fields[0], fields[1]
+		} else if len(fields) > 2 {
+			return errors.New("tokens must be followed by at most one tenant name")
+		}
+		if err := validateTenant(tenant); err != nil {
+			return err
+		}
+		sums = append(sums, sha256.Sum256([]byte(t)))
+		tenants = append(tenants, tenant)
+	}
+	a.mu.Lock()
+	a.sums = sums
+	a.tenants = tenants
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *tokenAuth) hasTenant(name string) bool {
+	if a == nil {
+		return false
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, t := range a.tenants {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *tokenAuth) enabled() bool {
+	if a == nil {
+		return false
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.sums) > 0 || a.oidc != nil
+}
+
+// valid checks the token and returns the tenant it belongs to
+func (a *tokenAuth) valid(token string) (string, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	sum := sha256.Sum256([]byte(token))
+	var ok int
+	var tenant string
+	// check every token so timing doesn't leak which one matched
+	for i, s := range a.sums {
+		match := subtle.ConstantTimeCompare(sum[:], s[:])
+		if match == 1 {
+			tenant = a.tenants[i]
+		}
+		ok |= match
+	}
+	return tenant, ok == 1
+}
+
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	const prefix = "bearer "
+	if len(h) <= len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(h[len(prefix):])
+}
+
+func (a *tokenAuth) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.enabled() || unauthenticatedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := bearerToken(r)
+		tenant, ok := a.valid(token)
+		principal := "token"
+		if tenant != "" {
+			principal = "tenant:" + tenant
+		}
+		if !ok && a.oidc != nil && isJWT(token) {
+			var role, subject string
+			var err error
+			if tenant, role, subject, err = a.oidc.verify(token); err != nil {
+				requestLog(r).WithError(err).Debug("rejected JWT")
+			} else {
+				ok = true
+				principal = "oidc:" + subject
+				r = withOIDCRole(r, role)
+			}
+		}
+		if token == "" || !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="nfs-rest-gateway"`)
+			writeError(w, newError(http.StatusUnauthorized, api.ErrCodeUnauthorized, "unauthorized"))
+			return
+		}
+		r = r.WithContext(withPrincipal(r.Context(), principal))
+		next.ServeHTTP(w, withTenant(r, tenant))
+	})
+}
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+var backupsBucket = []byte("backups")
+
+const (
+	jobBackupVolume  = "backup-volume"
+	jobRestoreBackup = "restore-backup"
+
+	compressNone = "none"
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+)
+
+var backupExtensions = map[string]string{
+	compressNone: ".tar",
+	compressGzip: ".tar.gz",
+	compressZstd: ".tar.zst",
+}
+
+type backup struct {
+	ID          string
+	Volume      string
+	Key         string
+	Compression string
+	Size        int64
+	Created     time.Time
+	Scheduled   bool `json:",omitempty"`
+}
+
+type BackupRequest struct {
+	// Compression is one of none, gzip or zstd, defaults to gzip
+	Compression string
+}
+
+type RestoreRequest struct {
+	// BackupID restores a backup recorded by the gateway
+	BackupID string `json:",omitempty"`
+	// Key restores an object from the volume's own prefix in the bucket,
+	// <volume>/<object>, Compression must then be set to match it.
+	Key         string `json:",omitempty"`
+	Compression string `json:",omitempty"`
+}
+
+type backupJobArgs struct {
+	ID          string
+	Compression string
+	Scheduled   bool `json:",omitempty"`
+}
+
+func (g *gateway) backupVolume(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	name = scopedName(r, name)
+	if g.s3 == nil {
+		writeError(w, errInvalid("backups are not configured, set -s3-endpoint and -s3-bucket"))
+		return
+	}
+
+	var req BackupRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+			return
+		}
+	}
+	if req.Compression == "" {
+		req.Compression = compressGzip
+	}
+	if _, ok := backupExtensions[req.Compression]; !ok {
+		writeError(w, &validationError{Field: "Compression", Value: req.Compression, Reason: "must be one of none, gzip, zstd"})
+		return
+	}
+
+	if _, err := g.lookup(name); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	id, err := newID()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	j, err := g.jobs.submit(requestID(r), jobBackupVolume, name, backupJobArgs{ID: id, Compression: req.Compression})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJob(w, j)
+}
+
+func (g *gateway) runBackup(j *job, progress func(string)) error {
+	var args backupJobArgs
+	if err := json.Unmarshal(j.Args, &args); err != nil {
+		return errors.Wrap(err, "error decoding job arguments")
+	}
+	if g.s3 == nil {
+		return errors.New("backups are not configured")
+	}
+	v, err := g.lookup(j.Volume)
+	if err != nil {
+		return err
+	}
+
+	b := &backup{
+		ID:          args.ID,
+		Volume:      v.Name,
+		Key:         v.Name + "/" + args.ID + backupExtensions[args.Compression],
+		Compression: args.Compression,
+		Scheduled:   args.Scheduled,
+	}
+	// the archive is streamed to S3 as it's written, nothing is kept on disk
+	progress("archiving")
+	pr, pw := io.Pipe()
+	archived := make(chan error, 1)
+	go func() {
+		err := writeArchive(v.Export.Path, pw, args.Compression, progress)
+		pw.CloseWithError(err)
+		archived <- err
+	}()
+	b.Size, err = g.s3.upload(b.Key, pr)
+	// a failed upload stops the archiving
+	pr.CloseWithError(errors.New("upload failed"))
+	if aerr := <-archived; err == nil {
+		err = aerr
+	}
+	if err != nil {
+		return err
+	}
+	b.Created = time.Now().UTC()
+	progress(fmt.Sprintf("uploaded %d bytes", b.Size))
+
+	data, err := json.Marshal(b)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling backup")
+	}
+	return g.update(func(tx *bolt.Tx) error {
+		bb, err := tx.Bucket(backupsBucket).CreateBucketIfNotExists([]byte(v.Name))
+		if err != nil {
+			return errors.Wrap(err, "error creating backups bucket")
+		}
+		return dbError(errors.Wrap(bb.Put([]byte(b.ID), data), "error writing backup to database"))
+	})
+}
+
+func (g *gateway) listBackups(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	name = scopedName(r, name)
+
+	backups := []backup{}
+	err := g.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(backupsBucket).Bucket([]byte(name))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var bk backup
+			if err := json.Unmarshal(v, &bk); err != nil {
+				return dbError(errors.Wrap(err, "error unmarshaling backup from database"))
+			}
+			backups = append(backups, bk)
+			return nil
+		})
+	})
+	if err != nil {
+		writeError(w, dbError(err))
+		return
+	}
+
+	b, err := json.Marshal(backups)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+func (g *gateway) restoreBackup(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	name = scopedName(r, name)
+	if g.s3 == nil {
+		writeError(w, errInvalid("backups are not configured, set -s3-endpoint and -s3-bucket"))
+		return
+	}
+
+	var req RestoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	switch {
+	case req.BackupID == "" && req.Key == "":
+		writeError(w, errInvalid("one of BackupID or Key must be set"))
+		return
+	case req.BackupID != "":
+		b, err := g.getBackup(name, req.BackupID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		req = RestoreRequest{Key: b.Key, Compression: b.Compression}
+	case !ownBackupKey(name, req.Key):
+		// keys of other volumes, or other tenants, would restore their data
+		writeError(w, &validationError{Field: "Key", Value: req.Key, Reason: "must be one of the volume's backups"})
+		return
+	}
+	if _, ok := backupExtensions[req.Compression]; !ok {
+		writeError(w, &validationError{Field: "Compression", Value: req.Compression, Reason: "must be one of none, gzip, zstd"})
+		return
+	}
+
+	v, err := g.lookup(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if v.Mirror {
+		writeError(w, errMirror())
+		return
+	}
+	j, err := g.jobs.submit(requestID(r), jobRestoreBackup, name, req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJob(w, j)
+}
+
+// ownBackupKey reports whether key is one of the volume's backups. Backups
+// are stored as <volume>/<id>, where the volume id includes its tenant, so
+// the object must be directly under that prefix.
+func ownBackupKey(name, key string) bool {
+	prefix := name + "/"
+	return strings.HasPrefix(key, prefix) && len(key) > len(prefix) && !strings.Contains(key[len(prefix):], "/")
+}
+
+func (g *gateway) getBackup(name, id string) (*backup, error) {
+	var b *backup
+	err := g.view(func(tx *bolt.Tx) error {
+		bb := tx.Bucket(backupsBucket).Bucket([]byte(name))
+		if bb == nil {
+			return errNotFound("backup not found")
+		}
+		data := bb.Get([]byte(id))
+		if data == nil {
+			return errNotFound("backup not found")
+		}
+		b = &backup{}
+		return errors.Wrap(json.Unmarshal(data, b), "error unmarshaling backup from database")
+	})
+	return b, dbError(err)
+}
+
+// runRestore replaces the contents of the volume with the backup
+func (g *gateway) runRestore(j *job, progress func(string)) error {
+	var req RestoreRequest
+	if err := json.Unmarshal(j.Args, &req); err != nil {
+		return errors.Wrap(err, "error decoding job arguments")
+	}
+	if g.s3 == nil {
+		return errors.New("backups are not configured")
+	}
+	v, err := g.lookup(j.Volume)
+	if err != nil {
+		return err
+	}
+
+	progress("downloading")
+	body, err := g.s3.get(req.Key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	defer g.locks.lock(j.Volume)()
+	// the volume may have been changed while the backup was downloaded
+	v, err = g.lookup(j.Volume)
+	if err != nil {
+		return err
+	}
+	progress("removing existing data")
+	if err := clearDir(v.Export.Path); err != nil {
+		return err
+	}
+	progress("extracting")
+	return readArchive(body, v.Export.Path, req.Compression, progress)
+}
+
+// clearDir removes everything inside dir but not dir itself, which may be
+// a mountpoint.
+func clearDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Wrap(err, "error reading volume dir")
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return errors.Wrap(err, "error removing volume data")
+		}
+	}
+	return nil
+}
+
+// progressWriter reports the number of bytes written every few seconds
+type progressWriter struct {
+	w        io.Writer
+	verb     string
+	n        int64
+	last     time.Time
+	progress func(string)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.n += int64(n)
+	if time.Since(p.last) > 5*time.Second {
+		p.last = time.Now()
+		p.progress(fmt.Sprintf("%s %d bytes", p.verb, p.n))
+	}
+	return n, err
+}
+
+// compressor wraps w with the named compression. zstd isn't in the standard
+// library so it is piped through the zstd binary.
+func compressor(w io.Writer, compression string) (io.WriteCloser, func() error, error) {
+	switch compression {
+	case compressGzip:
+		return gzip.NewWriter(w), func() error { return nil }, nil
+	case compressZstd:
+		c := exec.Command("zstd", "-q", "-c")
+		c.Stdout = w
+		stdin, err := c.StdinPipe()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "error starting zstd")
+		}
+		if err := c.Start(); err != nil {
+			return nil, nil, errors.Wrap(err, "error starting zstd")
+		}
+		return stdin, func() error { return errors.Wrap(c.Wait(), "error compressing backup") }, nil
+	}
+	return nopWriteCloser{w}, func() error { return nil }, nil
+}
+
+func decompressor(r io.Reader, compression string) (io.Reader, func() error, error) {
+	switch compression {
+	case compressGzip:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "error reading gzip stream")
+		}
+		return zr, func() error { return nil }, nil
+	case compressZstd:
+		c := exec.Command("zstd", "-q", "-d", "-c")
+		c.Stdin = r
+		stdout, err := c.StdoutPipe()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "error starting zstd")
+		}
+		if err := c.Start(); err != nil {
+			return nil, nil, errors.Wrap(err, "error starting zstd")
+		}
+		return stdout, func() error { return errors.Wrap(c.Wait(), "error decompressing backup") }, nil
+	}
+	return r, func() error { return nil }, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func writeArchive(dir string, w io.Writer, compression string, progress func(string)) error {
+	cw, wait, err := compressor(w, compression)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(&progressWriter{w: cw, verb: "archived", progress: progress, last: time.Now()})
+
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if cerr := cw.Close(); err == nil {
+		err = cerr
+	}
+	if werr := wait(); err == nil {
+		err = werr
+	}
+	return errors.Wrap(err, "error archiving volume data")
+}
+
+func readArchive(r io.Reader, dir, compression string, progress func(string)) error {
+	_, err := extractArchive(r, dir, compression, 0, progress)
+	return err
+}
+
+// errArchiveTooLarge is returned once an archive's contents exceed the limit
+// it's extracted with
+var errArchiveTooLarge = errors.New("archive exceeds the size limit")
+
+// archiveStats counts what was extracted from an archive
+type archiveStats struct {
+	entries int
+	bytes   int64
+}
+
+// limitedReader fails once more than n bytes were read
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(b []byte) (int, error) {
+	if int64(len(b)) > l.n+1 {
+		b = b[:l.n+1]
+	}
+	n, err := l.r.Read(b)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errArchiveTooLarge
+	}
+	return n, err
+}
+
+// extractArchive extracts the archive into dir. Entries are never written
+// through symlinks, whether they come from the archive or were already in
+// dir, so an archive can't reach outside of dir. limit bounds the size of
+// the uncompressed archive, headers included, 0 disables it.
+func extractArchive(r io.Reader, dir, compression string, limit int64, progress func(string)) (archiveStats, error) {
+	var stats archiveStats
+	dr, wait, err := decompressor(r, compression)
+	if err != nil {
+		return stats, err
+	}
+	if limit > 0 {
+		dr = &limitedReader{r: dr, n: limit}
+	}
+	tr := tar.NewReader(dr)
+
+	last := time.Now()
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == errArchiveTooLarge {
+			return stats, err
+		}
+		if err != nil {
+			return stats, errors.Wrap(err, "error reading archive")
+		}
+
+		target, err := archiveTarget(dir, hdr.Name)
+		if err != nil {
+			return stats, err
+		}
+		if target == dir {
+			continue
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = extractDir(target, mode)
+		case tar.TypeReg, tar.TypeRegA:
+			if err = replaceable(target); err == nil {
+				var f *os.File
+				f, err = os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|syscall.O_NOFOLLOW, mode)
+				if err == nil {
+					var copied int64
+					copied, err = io.Copy(f, tr)
+					stats.bytes += copied
+					f.Close()
+				}
+			}
+		case tar.TypeSymlink:
+			if err = replaceable(target); err == nil {
+				err = os.Symlink(hdr.Linkname, target)
+			}
+		case tar.TypeLink:
+			var source string
+			source, err = archiveTarget(dir, hdr.Linkname)
+			if err == nil {
+				if err = replaceable(target); err == nil {
+					err = os.Link(source, target)
+				}
+			}
+		default:
+			continue
+		}
+		if err == errArchiveTooLarge {
+			return stats, err
+		}
+		if err != nil {
+			return stats, errors.Wrapf(err, "error extracting %s", hdr.Name)
+		}
+		stats.entries++
+		os.Lchown(target, hdr.Uid, hdr.Gid)
+		// hard links may be links to symlinks, which Chtimes would follow
+		if hdr.Typeflag == tar.TypeDir || hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+			os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+		}
+
+		if time.Since(last) > 5*time.Second {
+			last = time.Now()
+			progress(fmt.Sprintf("extracted %d bytes", stats.bytes))
+		}
+	}
+	return stats, wait()
+}
+
+// archiveTarget returns where the archive entry goes in dir, creating its
+// parent directories. It fails when the entry is outside of dir or any of
+// its parents isn't a directory.
+func archiveTarget(dir, name string) (string, error) {
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	if target == dir {
+		return target, nil
+	}
+	if !strings.HasPrefix(target, dir+string(filepath.Separator)) {
+		return "", errors.Errorf("archive entry %q escapes the volume", name)
+	}
+	parent := dir
+	for _, elem := range strings.Split(filepath.Dir(target[len(dir)+1:]), string(filepath.Separator)) {
+		if elem == "." {
+			break
+		}
+		parent = filepath.Join(parent, elem)
+		fi, err := os.Lstat(parent)
+		switch {
+		case os.IsNotExist(err):
+			err = os.Mkdir(parent, 0755)
+		case err == nil && !fi.IsDir():
+			err = errors.Errorf("archive entry %q is beneath a file or symlink", name)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return target, nil
+}
+
+// extractDir creates the directory, replacing anything else in its place
+func extractDir(target string, mode os.FileMode) error {
+	fi, err := os.Lstat(target)
+	if err == nil && fi.IsDir() {
+		return os.Chmod(target, mode)
+	}
+	if err == nil {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+	return os.Mkdir(target, mode)
+}
+
+// replaceable removes whatever but a directory is at target, so files are
+// never written through an existing symlink
+func replaceable(target string) error {
+	fi, err := os.Lstat(target)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	case fi.IsDir():
+		return errors.New("a directory is in the way")
+	}
+	return os.Remove(target)
+}
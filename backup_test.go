@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestOwnBackupKey(t *testing.T) {
+	cases := []struct {
+		name, key string
+		want      bool
+	}{
+		{"v", "v/1234.tar.gz", true},
+		{"t/v", "t/v/1234.tar.gz", true},
+		{"v", "w/1234.tar.gz", false},
+		{"v", "vv/1234.tar.gz", false},
+		{"v", "v/", false},
+		{"v", "v", false},
+		// tenant t's volume v, not the untenanted volume t's backup
+		{"t", "t/v/1234.tar.gz", false},
+		{"t/v", "u/v/1234.tar.gz", false},
+	}
+	for _, tc := range cases {
+		if got := ownBackupKey(tc.name, tc.key); got != tc.want {
+			t.Errorf("%s, %s: got %v, want %v", tc.name, tc.key, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/pkg/errors"
+)
+
+// maxBatchSize limits how many volumes one batch may create
+const maxBatchSize = 500
+
+// createVolumes creates many volumes in one request. Every item is validated
+// before anything is created, one invalid item fails the whole batch. The
+// volumes are then provisioned one by one and exported together, so the
+// kernel backend applies all of them with a single exportfs run. Failures
+// from then on only fail their own item.
+func (g *gateway) createVolumes(w http.ResponseWriter, r *http.Request) {
+	var items []api.BatchCreateItem
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	if len(items) == 0 {
+		writeError(w, errInvalid("batch has no volumes"))
+		return
+	}
+	if len(items) > maxBatchSize {
+		writeError(w, errInvalid("batch has more than 500 volumes"))
+		return
+	}
+
+	results := make([]api.BatchCreateResult, len(items))
+	seen := make(map[string]bool, len(items))
+	var invalid bool
+	for i := range items {
+		name := scopedName(r, items[i].Name)
+		results[i].Name = items[i].Name
+		err := g.validateCreate(name, &items[i].CreateRequest)
+		if err == nil {
+			err = checkScope(r, items[i].Name, items[i].Labels)
+		}
+		if err == nil && seen[name] {
+			err = &validationError{Field: "Name", Value: items[i].Name, Reason: "used more than once in the batch"}
+		}
+		seen[name] = true
+		if err != nil {
+			results[i].Error = batchError(r, err)
+			invalid = true
+		}
+	}
+	if invalid {
+		writeError(w, &codedError{code: api.ErrCodeInvalidRequest, status: http.StatusBadRequest, err: errors.New("batch has invalid volumes"), details: results})
+		return
+	}
+
+	created := make([]*volume, len(items))
+	for i, item := range items {
+		v, err := g.addVolume(r.Context(), scopedName(r, item.Name), item.CreateRequest, "", false)
+		if err != nil {
+			results[i].Error = batchError(r, err)
+			continue
+		}
+		created[i] = v
+	}
+
+	// exported at once so the exports are synced together
+	exportErrs := make([]error, len(items))
+	var wg sync.WaitGroup
+	for i, v := range created {
+		if v == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, v *volume) {
+			defer wg.Done()
+			defer g.locks.lock(v.Name)()
+			// removed again on failure, export and all, so retrying the
+			// item can create it
+			u := &undoLog{}
+			u.add("discard", func() error { return g.discard(v) })
+			err := g.export(r.Context(), v)
+			if err == nil {
+				err = g.updateStatus(v.Name, (*volume).markExported)
+			}
+			if err != nil {
+				u.rollback(v.Name, err)
+			}
+			exportErrs[i] = err
+		}(i, v)
+	}
+	wg.Wait()
+
+	for i, v := range created {
+		if v == nil {
+			continue
+		}
+		if err := exportErrs[i]; err != nil {
+			results[i].Error = batchError(r, err)
+			continue
+		}
+		results[i].Path = v.Export.Path
+		volumeEvent(eventVolumeCreated, v.Name, nil)
+	}
+
+	b, err := json.Marshal(api.BatchCreateResponse{Results: results})
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+// batchError is the error reported for an item, logged like writeError
+// would when it's a server side failure
+func batchError(r *http.Request, err error) *api.ErrorResponse {
+	status, resp := toErrorResponse(err)
+	if status >= http.StatusInternalServerError {
+		requestLog(r).WithError(err).Error("error creating volume of batch")
+	}
+	return &resp
+}
@@ -0,0 +1,427 @@
+// Package client is a Go client for the nfs-rest-gateway API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/pkg/errors"
+)
+
+const (
+	unixScheme = "unix://"
+	// apiPrefix is the version of the API the client speaks
+	apiPrefix = "/v1"
+)
+
+// Client talks to a single gateway
+type Client struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+// New creates a client for the gateway at addr, which is either a URL
+// (http://host:port), host:port, or unix:///path/to/socket. token may be
+// empty when the gateway does not require authentication.
+func New(addr, token string) *Client {
+	c := &Client{token: token, http: &http.Client{}}
+	switch {
+	case strings.HasPrefix(addr, unixScheme):
+		sock := strings.TrimPrefix(addr, unixScheme)
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sock)
+			},
+		}
+		c.base = "http://nfsg"
+	case strings.Contains(addr, "://"):
+		c.base = strings.TrimSuffix(addr, "/")
+	default:
+		c.base = "http://" + addr
+	}
+	return c
+}
+
+// WithHTTPClient replaces the http client used for requests, for instance to
+// configure TLS. The transport set up for unix sockets is kept.
+func (c *Client) WithHTTPClient(hc *http.Client) *Client {
+	if hc.Transport == nil {
+		hc.Transport = c.http.Transport
+	}
+	c.http = hc
+	return c
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) (*http.Response, error) {
+	var r io.Reader
+	var contentType string
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, errors.Wrap(err, "error marshaling request")
+		}
+		r = bytes.NewReader(b)
+		contentType = "application/json"
+	}
+	resp, err := c.send(ctx, method, path, r, contentType)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading response")
+		}
+		// some endpoints respond without a body
+		if len(bytes.TrimSpace(data)) > 0 {
+			if err := json.Unmarshal(data, out); err != nil {
+				return nil, errors.Wrap(err, "error decoding response")
+			}
+		}
+	}
+	return resp, nil
+}
+
+// send sends the request, returning the response with its body still to be
+// read and closed when it's successful
+func (c *Client) send(ctx context.Context, method, path string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.base+apiPrefix+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if etag, _ := ctx.Value(ifMatchKey{}).(string); etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		apiErr := &api.ErrorResponse{}
+		if err := json.Unmarshal(data, apiErr); err != nil || apiErr.Code == "" {
+			return nil, errors.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+		}
+		return nil, apiErr
+	}
+	return resp, nil
+}
+
+// IsNotFound reports whether err is a not found error from the gateway
+func IsNotFound(err error) bool {
+	e, ok := errors.Cause(err).(*api.ErrorResponse)
+	return ok && e.Code == api.ErrCodeNotFound
+}
+
+// IsPreconditionFailed reports whether err is the gateway refusing a change
+// because the volume's ETag no longer matches
+func IsPreconditionFailed(err error) bool {
+	e, ok := errors.Cause(err).(*api.ErrorResponse)
+	return ok && e.Code == api.ErrCodePreconditionFailed
+}
+
+type ifMatchKey struct{}
+
+// WithIfMatch makes the changes requested with ctx conditional on the volume
+// still having the ETag returned with it, e.g. by GetVolume. They fail with
+// an error IsPreconditionFailed reports when it changed in the meantime.
+func WithIfMatch(ctx context.Context, etag string) context.Context {
+	return context.WithValue(ctx, ifMatchKey{}, etag)
+}
+
+func volumePath(name string, parts ...string) string {
+	return "/volume/" + url.PathEscape(name) + strings.Join(parts, "")
+}
+
+func (c *Client) CreateVolume(ctx context.Context, name string, req api.CreateRequest) (*api.CreateResponse, error) {
+	var resp api.CreateResponse
+	_, err := c.do(ctx, "POST", "/volume?name="+url.QueryEscape(name), req, &resp)
+	return &resp, err
+}
+
+// BatchCreateVolumes creates several volumes in one request. Nothing is
+// created when any item is invalid, otherwise each result reports whether
+// its volume was created.
+func (c *Client) BatchCreateVolumes(ctx context.Context, items []api.BatchCreateItem) (*api.BatchCreateResponse, error) {
+	var resp api.BatchCreateResponse
+	_, err := c.do(ctx, "POST", "/volumes/batch", items, &resp)
+	return &resp, err
+}
+
+// ImportVolume adopts an existing directory on the server as a volume
+func (c *Client) ImportVolume(ctx context.Context, name string, req api.ImportRequest) (*api.CreateResponse, error) {
+	var resp api.CreateResponse
+	_, err := c.do(ctx, "POST", volumePath(name, "/import"), req, &resp)
+	return &resp, err
+}
+
+// CloneVolume starts a job creating a new volume from a copy of the named
+// one. The job's result is the new volume's CreateResponse.
+func (c *Client) CloneVolume(ctx context.Context, name string, req api.CloneRequest) (*api.JobResponse, error) {
+	var resp api.JobResponse
+	_, err := c.do(ctx, "POST", volumePath(name, "/clone"), req, &resp)
+	return &resp, err
+}
+
+// RenameVolume gives the named volume a new name
+func (c *Client) RenameVolume(ctx context.Context, name, newName string) (*api.UpdateResponse, error) {
+	var resp api.UpdateResponse
+	_, err := c.do(ctx, "POST", volumePath(name, "/rename"), api.RenameRequest{Name: newName}, &resp)
+	return &resp, err
+}
+
+// ListVolumeClients lists the NFS clients which have the volume mounted
+func (c *Client) ListVolumeClients(ctx context.Context, name string) ([]api.VolumeClient, error) {
+	var resp []api.VolumeClient
+	_, err := c.do(ctx, "GET", volumePath(name, "/clients"), nil, &resp)
+	return resp, err
+}
+
+// GetVolumeStats returns the bytes read and written through the volume's
+// exports
+func (c *Client) GetVolumeStats(ctx context.Context, name string) (*api.VolumeStats, error) {
+	var resp api.VolumeStats
+	_, err := c.do(ctx, "GET", volumePath(name, "/stats"), nil, &resp)
+	return &resp, err
+}
+
+// GetVolumeACL returns the POSIX ACLs of the volume's root directory
+func (c *Client) GetVolumeACL(ctx context.Context, name string) (*api.ACL, error) {
+	var resp api.ACL
+	_, err := c.do(ctx, "GET", volumePath(name, "/acl"), nil, &resp)
+	return &resp, err
+}
+
+// SetVolumeACL replaces the POSIX ACLs of the volume's root directory
+func (c *Client) SetVolumeACL(ctx context.Context, name string, acl api.ACL) (*api.ACL, error) {
+	var resp api.ACL
+	_, err := c.do(ctx, "PUT", volumePath(name, "/acl"), acl, &resp)
+	return &resp, err
+}
+
+// ReplicateVolume configures replication of the volume to another gateway
+func (c *Client) ReplicateVolume(ctx context.Context, name string, req api.ReplicateRequest) (*api.Replication, error) {
+	var resp api.Replication
+	_, err := c.do(ctx, "POST", volumePath(name, "/replicate"), req, &resp)
+	return &resp, err
+}
+
+// PromoteVolume turns a read-only mirror into a read-write volume
+func (c *Client) PromoteVolume(ctx context.Context, name string) (*api.UpdateResponse, error) {
+	var resp api.UpdateResponse
+	_, err := c.do(ctx, "POST", volumePath(name, "/promote"), nil, &resp)
+	return &resp, err
+}
+
+// RepairVolume re-runs the steps of creating the volume, fixing whatever is
+// missing
+func (c *Client) RepairVolume(ctx context.Context, name string) (*api.RepairResponse, error) {
+	var resp api.RepairResponse
+	_, err := c.do(ctx, "POST", volumePath(name, "/repair"), nil, &resp)
+	return &resp, err
+}
+
+// StopReplication stops replicating the volume
+func (c *Client) StopReplication(ctx context.Context, name string) error {
+	_, err := c.do(ctx, "DELETE", volumePath(name, "/replicate"), nil, nil)
+	return err
+}
+
+func (c *Client) GetVolume(ctx context.Context, name string) (*api.GetResponse, error) {
+	var resp api.GetResponse
+	_, err := c.do(ctx, "GET", volumePath(name), nil, &resp)
+	return &resp, err
+}
+
+// ListVolumes lists volumes, optionally filtered by label selectors such as
+// "env=prod", "env!=dev" or "env".
+func (c *Client) ListVolumes(ctx context.Context, selectors ...string) ([]api.GetResponse, error) {
+	q := url.Values{}
+	for _, s := range selectors {
+		q.Add("label", s)
+	}
+	path := "/volumes"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	var resp []api.GetResponse
+	_, err := c.do(ctx, "GET", path, nil, &resp)
+	return resp, err
+}
+
+// ApplyVolume creates the volume or converges it to the complete spec given,
+// settings left out of it go back to their defaults
+func (c *Client) ApplyVolume(ctx context.Context, name string, spec api.CreateRequest) (*api.VolumeState, error) {
+	var resp api.VolumeState
+	_, err := c.do(ctx, "PUT", "/volumes/"+url.PathEscape(name), spec, &resp)
+	return &resp, err
+}
+
+// ListAccessRules returns the volume's access rules
+func (c *Client) ListAccessRules(ctx context.Context, name string) ([]api.AccessRule, error) {
+	var resp []api.AccessRule
+	_, err := c.do(ctx, "GET", volumePath(name, "/access"), nil, &resp)
+	return resp, err
+}
+
+// AddAccessRule grants a host access to the volume with a new rule
+func (c *Client) AddAccessRule(ctx context.Context, name string, req api.AccessRuleRequest) (*api.AccessRule, error) {
+	var resp api.AccessRule
+	_, err := c.do(ctx, "POST", volumePath(name, "/access"), req, &resp)
+	return &resp, err
+}
+
+// SetAccessRule creates or replaces the volume's access rule with the id
+func (c *Client) SetAccessRule(ctx context.Context, name, id string, req api.AccessRuleRequest) (*api.AccessRule, error) {
+	var resp api.AccessRule
+	_, err := c.do(ctx, "PUT", volumePath(name, "/access/", url.PathEscape(id)), req, &resp)
+	return &resp, err
+}
+
+func (c *Client) RemoveAccessRule(ctx context.Context, name, id string) error {
+	_, err := c.do(ctx, "DELETE", volumePath(name, "/access/", url.PathEscape(id)), nil, nil)
+	return err
+}
+
+// ListSubexports returns the exports of the volume's subdirectories
+func (c *Client) ListSubexports(ctx context.Context, name string) ([]api.Subexport, error) {
+	var resp []api.Subexport
+	_, err := c.do(ctx, "GET", volumePath(name, "/subexports"), nil, &resp)
+	return resp, err
+}
+
+// AddSubexport exports a subdirectory of the volume to its own hosts
+func (c *Client) AddSubexport(ctx context.Context, name string, req api.SubexportRequest) (*api.Subexport, error) {
+	var resp api.Subexport
+	_, err := c.do(ctx, "POST", volumePath(name, "/subexports"), req, &resp)
+	return &resp, err
+}
+
+func (c *Client) RemoveSubexport(ctx context.Context, name, id string) error {
+	_, err := c.do(ctx, "DELETE", volumePath(name, "/subexports/", url.PathEscape(id)), nil, nil)
+	return err
+}
+
+// GetSMBShare returns the state of the volume's SMB share
+func (c *Client) GetSMBShare(ctx context.Context, name string) (*api.SMBShare, error) {
+	var resp api.SMBShare
+	_, err := c.do(ctx, "GET", volumePath(name, "/smb"), nil, &resp)
+	return &resp, err
+}
+
+// DownloadData streams the volume's contents as a tar.gz, the caller must
+// close it
+func (c *Client) DownloadData(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := c.send(ctx, "GET", volumePath(name, "/data"), nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// UploadData extracts the tar.gz read from r into the volume, replace removes
+// the volume's existing data first
+func (c *Client) UploadData(ctx context.Context, name string, r io.Reader, replace bool) (*api.DataUploadResponse, error) {
+	path := volumePath(name, "/data")
+	if replace {
+		path += "?replace=true"
+	}
+	resp, err := c.send(ctx, "PUT", path, r, "application/gzip")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var out api.DataUploadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, errors.Wrap(err, "error decoding response")
+	}
+	return &out, nil
+}
+
+// ListFiles stats the file at p in the volume, listing up to limit of its
+// entries named after after when it's a directory. limit 0 uses the
+// gateway's default.
+func (c *Client) ListFiles(ctx context.Context, name, p, after string, limit int) (*api.FileList, error) {
+	q := url.Values{"path": {p}}
+	if after != "" {
+		q.Set("after", after)
+	}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var resp api.FileList
+	_, err := c.do(ctx, "GET", volumePath(name, "/files?", q.Encode()), nil, &resp)
+	return &resp, err
+}
+
+func (c *Client) UpdateVolume(ctx context.Context, name string, req api.UpdateRequest) (*api.UpdateResponse, error) {
+	var resp api.UpdateResponse
+	_, err := c.do(ctx, "PATCH", volumePath(name), req, &resp)
+	return &resp, err
+}
+
+// RemoveVolume starts deleting the volume and returns the id of the job
+// doing so. The id is empty when the volume did not exist.
+func (c *Client) RemoveVolume(ctx context.Context, name string) (string, error) {
+	var resp api.JobResponse
+	_, err := c.do(ctx, "DELETE", volumePath(name), nil, &resp)
+	return resp.JobID, err
+}
+
+// ForceRemoveVolume deletes the volume even if clients still have it
+// mounted, revoking their access.
+func (c *Client) ForceRemoveVolume(ctx context.Context, name string) (string, error) {
+	var resp api.JobResponse
+	_, err := c.do(ctx, "DELETE", volumePath(name)+"?force=true", nil, &resp)
+	return resp.JobID, err
+}
+
+func (c *Client) GetJob(ctx context.Context, id string) (*api.Job, error) {
+	var j api.Job
+	_, err := c.do(ctx, "GET", "/jobs/"+url.PathEscape(id), nil, &j)
+	return &j, err
+}
+
+// WaitJob polls the job until it finishes, returning an error if it failed
+func (c *Client) WaitJob(ctx context.Context, id string) (*api.Job, error) {
+	for {
+		j, err := c.GetJob(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		switch j.Status {
+		case api.JobSucceeded:
+			return j, nil
+		case api.JobFailed:
+			return j, errors.Errorf("job %s failed: %s", j.ID, j.Error)
+		}
+		select {
+		case <-ctx.Done():
+			return j, ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
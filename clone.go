@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os/exec"
+
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+const jobCloneVolume = "clone-volume"
+
+// cloneJobArgs are the arguments of a clone job, CreatedBy is the principal
+// which requested it
+type cloneJobArgs struct {
+	api.CloneRequest
+	CreatedBy string `json:",omitempty"`
+}
+
+func (g *gateway) cloneVolume(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var req api.CloneRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	if err := validateName(req.Name); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Security != nil {
+		if err := validateSecurity(req.Security); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	if err := validateOptions(req.Options); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := validateHosts(req.Hosts); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Labels != nil {
+		if err := validateLabels(req.Labels); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	src, dst := scopedName(r, name), scopedName(r, req.Name)
+	labels := req.Labels
+	err := g.view(func(tx *bolt.Tx) error {
+		data := getVolumeData(tx, src)
+		if data == nil {
+			return errNotFound("volume not found")
+		}
+		if labels == nil {
+			var v volume
+			if err := json.Unmarshal(data, &v); err != nil {
+				return dbError(errors.Wrap(err, "error unmarshaling volume data from database"))
+			}
+			labels = v.Labels
+		}
+		if err := checkScope(r, req.Name, labels); err != nil {
+			return err
+		}
+		if getVolumeData(tx, dst) != nil {
+			return errAlreadyExists("a volume with this name already exists")
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	j, err := g.jobs.submit(requestID(r), jobCloneVolume, src, cloneJobArgs{CloneRequest: req, CreatedBy: contextPrincipal(r.Context())})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJob(w, j)
+}
+
+// runClone clones the job's volume, natively when the storage backend
+// supports it and by copying the data otherwise. The new volume is the
+// job's result.
+func (g *gateway) runClone(j *job, progress func(string)) error {
+	var args cloneJobArgs
+	if err := json.Unmarshal(j.Args, &args); err != nil {
+		return errors.Wrap(err, "error decoding job arguments")
+	}
+	req := args.CloneRequest
+	ctx := withPrincipal(context.Background(), args.CreatedBy)
+	src, err := g.lookup(j.Volume)
+	if err != nil {
+		return err
+	}
+	dst := volumeID(volumeTenant(src.Name), req.Name)
+
+	var v *volume
+	if c, ok := g.storage.(cloner); ok && c.canClone(src) {
+		progress("cloning")
+		v, err = g.clone(ctx, src.Name, dst, req)
+	} else {
+		v, err = g.copyClone(ctx, j, src, dst, req, progress)
+	}
+	if err != nil {
+		return err
+	}
+
+	j.Result, err = json.Marshal(api.CreateResponse{Name: displayName(v.Name), Path: v.Export.Path})
+	return errors.Wrap(err, "error marshaling job result")
+}
+
+// cloneSettings applies the export settings of the clone request on top of
+// the ones copied from the source volume. Hosts given in the request replace
+// the source's access rules too.
+func cloneSettings(v *volume, req api.CloneRequest) {
+	if req.Hosts != nil {
+		v.Export.Hosts = req.Hosts
+		v.Export.Access = nil
+	}
+	if req.Options != "" {
+		v.Export.Options = req.Options
+	}
+	if req.Security != nil {
+		v.Export.Security = req.Security
+	}
+	if req.Labels != nil {
+		v.Labels = req.Labels
+	}
+}
+
+// clone creates the volume dst from a copy-on-write clone of src
+func (g *gateway) clone(ctx context.Context, src, dst string, req api.CloneRequest) (*volume, error) {
+	c, ok := g.storage.(cloner)
+	if !ok {
+		return nil, errInvalid("cloning is not supported by this storage backend")
+	}
+
+	defer g.locks.lock(dst)()
+	var v *volume
+	err := g.updateUndo(context.Background(), dst, func(tx *bolt.Tx, u *undoLog) error {
+		data := getVolumeData(tx, src)
+		if data == nil {
+			return errNotFound("volume not found")
+		}
+		var s volume
+		if err := json.Unmarshal(data, &s); err != nil {
+			return dbError(errors.Wrap(err, "error unmarshaling volume from database"))
+		}
+
+		if getVolumeData(tx, dst) != nil {
+			return errAlreadyExists("already exists")
+		}
+		if err := g.checkTenantConflict(tx, dst); err != nil {
+			return err
+		}
+		size := s.sizeLimit()
+		if u := g.usage.cached(s.Name); size == 0 && u != nil {
+			size = u.BytesUsed
+		}
+		if err := g.checkQuota(tx, volumeTenant(dst), size); err != nil {
+			return err
+		}
+
+		v = &volume{
+			Name:      dst,
+			Status:    api.VolumeAvailable,
+			Pool:      s.Pool,
+			Export:    s.Export,
+			Labels:    s.Labels,
+			SizeBytes: s.sizeLimit(),
+		}
+		v.Export.Path = g.nfsPath(v.Pool, dst)
+		cloneSettings(v, req)
+		setCreated(ctx, v)
+		fsid, err := newFSID()
+		if err != nil {
+			return err
+		}
+		v.FSID = fsid
+
+		if err := c.clone(tx, &s, v); err != nil {
+			return err
+		}
+		u.add("destroy storage", func() error { return g.storage.destroy(v) })
+
+		if err := putVolume(tx, v); err != nil {
+			return err
+		}
+		if tenant := volumeTenant(dst); tenant != "" {
+			if _, err := g.updateQuota(tx, tenant); err != nil {
+				return err
+			}
+		}
+		u.add("unexport", func() error { return g.unexport(context.Background(), v) })
+		return g.export(context.Background(), v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	volumeEvent(eventVolumeCreated, v.Name, nil)
+	return v, nil
+}
+
+// copyClone creates dst as an empty volume of the same size as src, copies
+// the data over and only then exports it. The volume is marked as pending on
+// the job until then, so an interrupted clone is discarded when the job is
+// run again.
+func (g *gateway) copyClone(ctx context.Context, j *job, src *volume, dst string, req api.CloneRequest, progress func(string)) (*volume, error) {
+	if existing, err := g.lookup(dst); err == nil {
+		if existing.Pending != j.ID {
+			return nil, errAlreadyExists("a volume with this name already exists")
+		}
+		progress("discarding interrupted clone")
+		if err := g.discardVolume(existing); err != nil {
+			return nil, err
+		}
+	}
+
+	progress("creating volume")
+	cr := api.CreateRequest{
+		Options:   src.Export.Options,
+		Security:  src.Export.Security,
+		Labels:    src.Labels,
+		SizeBytes: src.sizeLimit(),
+	}
+	if src.Loop != nil {
+		cr.FSType = src.Loop.FSType
+	}
+	if req.Options != "" {
+		cr.Options = req.Options
+	}
+	if req.Security != nil {
+		cr.Security = req.Security
+	}
+	if req.Labels != nil {
+		cr.Labels = req.Labels
+	}
+	// without hosts the volume isn't exported while its data is copied
+	v, err := g.provision(ctx, dst, cr, j.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	progress("copying data")
+	if err := copyData(src.Export.Path, v.Export.Path); err != nil {
+		if derr := g.discardVolume(v); derr != nil {
+			g.lockedStatus(v.Name, func(v *volume) bool { return v.setStatus(api.VolumeError, "clone failed: "+err.Error()) })
+			return nil, errors.Wrap(err, derr.Error())
+		}
+		return nil, err
+	}
+
+	progress("exporting")
+	hosts, access := src.Export.Hosts, src.Export.Access
+	if req.Hosts != nil {
+		hosts, access = req.Hosts, nil
+	}
+	return g.modifyVolume(context.Background(), dst, func(v *volume) error {
+		v.Export.Hosts = hosts
+		v.Export.Access = access
+		v.Pending = ""
+		return nil
+	})
+}
+
+// discardVolume removes a volume which was never handed out, skipping the
+// trash.
+func (g *gateway) discardVolume(v *volume) error {
+	defer g.locks.lock(v.Name)()
+	return g.discard(v)
+}
+
+// discard is discardVolume for callers holding the volume's lock
+func (g *gateway) discard(v *volume) error {
+	if err := g.unexport(context.Background(), v); err != nil {
+		return err
+	}
+	if err := g.storage.destroy(v); err != nil {
+		return err
+	}
+	return g.update(func(tx *bolt.Tx) error {
+		if err := deleteVolumeData(tx, v.Name); err != nil {
+			return err
+		}
+		if tenant := volumeTenant(v.Name); tenant != "" {
+			_, err := g.updateQuota(tx, tenant)
+			return err
+		}
+		return nil
+	})
+}
+
+// copyData copies the contents of src into dst, sharing extents with reflinks
+// where the filesystem supports them.
+func copyData(src, dst string) error {
+	if err := cmd("cp", "-a", "--reflink=always", src+"/.", dst); err == nil {
+		return nil
+	}
+	// reflinks aren't supported, rsync picks up whatever cp managed to copy
+	if _, err := exec.LookPath("rsync"); err == nil {
+		return errors.Wrap(cmd("rsync", "-aHAX", "--delete", src+"/", dst+"/"), "error copying volume data")
+	}
+	return errors.Wrap(cmd("cp", "-a", src+"/.", dst), "error copying volume data")
+}
@@ -0,0 +1,219 @@
+// nfsgctl is a command line client for nfs-rest-gateway.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/cpuguy83/nfs-rest-gateway/client"
+	"github.com/pkg/errors"
+)
+
+const usage = `usage: nfsgctl [flags] volume <command> [args]
+
+commands:
+  volume create [-hosts h1,h2] [-options opts] [-size bytes] [-fstype type] [-label k=v]... NAME
+  volume ls [-l selector]...
+  volume inspect NAME
+  volume rm [-wait] NAME
+
+flags:
+`
+
+type listFlag []string
+
+func (l *listFlag) String() string     { return strings.Join(*l, ",") }
+func (l *listFlag) Set(v string) error { *l = append(*l, v); return nil }
+
+type cli struct {
+	c      *client.Client
+	output string
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flHost := flag.String("H", envOr("NFSG_HOST", "127.0.0.1:80"), "gateway address, host:port, URL or unix:///path/to/socket, defaults to $NFSG_HOST")
+	flToken := flag.String("token", os.Getenv("NFSG_TOKEN"), "API token, defaults to $NFSG_TOKEN")
+	flOutput := flag.String("o", "table", "output format: table or json")
+	flag.Parse()
+
+	if *flOutput != "table" && *flOutput != "json" {
+		fatal(errors.Errorf("unknown output format %q", *flOutput))
+	}
+	args := flag.Args()
+	if len(args) < 2 || args[0] != "volume" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := &cli{c: client.New(*flHost, *flToken), output: *flOutput}
+	var err error
+	switch args[1] {
+	case "create":
+		err = c.create(args[2:])
+	case "ls", "list":
+		err = c.list(args[2:])
+	case "inspect":
+		err = c.inspect(args[2:])
+	case "rm", "remove":
+		err = c.remove(args[2:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "error:", err)
+	os.Exit(1)
+}
+
+func parseName(fs *flag.FlagSet, args []string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		return "", errors.New("expected exactly one volume name")
+	}
+	return fs.Arg(0), nil
+}
+
+func (c *cli) create(args []string) error {
+	fs := flag.NewFlagSet("volume create", flag.ExitOnError)
+	hosts := fs.String("hosts", "", "comma separated list of hosts allowed to mount the volume")
+	options := fs.String("options", "", "export options")
+	size := fs.Int64("size", 0, "size in bytes, backs the volume with a loop mounted image")
+	fsType := fs.String("fstype", "", "filesystem of the image, ext4 or xfs")
+	var labels listFlag
+	fs.Var(&labels, "label", "label to set as key=value, can be repeated")
+	name, err := parseName(fs, args)
+	if err != nil {
+		return err
+	}
+
+	req := api.CreateRequest{Options: *options, SizeBytes: *size, FSType: *fsType}
+	if *hosts != "" {
+		req.Hosts = strings.Split(*hosts, ",")
+	}
+	for _, l := range labels {
+		parts := strings.SplitN(l, "=", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("invalid label %q, must be key=value", l)
+		}
+		if req.Labels == nil {
+			req.Labels = make(map[string]string)
+		}
+		req.Labels[parts[0]] = parts[1]
+	}
+
+	resp, err := c.c.CreateVolume(context.Background(), name, req)
+	if err != nil {
+		return err
+	}
+	return c.print(resp, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "NAME\tPATH")
+		fmt.Fprintf(w, "%s\t%s\n", resp.Name, resp.Path)
+	})
+}
+
+func (c *cli) list(args []string) error {
+	fs := flag.NewFlagSet("volume ls", flag.ExitOnError)
+	var selectors listFlag
+	fs.Var(&selectors, "l", "label selector (key=value, key!=value or key), can be repeated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	vols, err := c.c.ListVolumes(context.Background(), selectors...)
+	if err != nil {
+		return err
+	}
+	return c.print(vols, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "NAME\tPATH\tLABELS")
+		for _, v := range vols {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", v.Name, v.Path, formatLabels(v.Labels))
+		}
+	})
+}
+
+func (c *cli) inspect(args []string) error {
+	fs := flag.NewFlagSet("volume inspect", flag.ExitOnError)
+	name, err := parseName(fs, args)
+	if err != nil {
+		return err
+	}
+	v, err := c.c.GetVolume(context.Background(), name)
+	if err != nil {
+		return err
+	}
+	return c.print(v, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "Name:\t%s\n", v.Name)
+		fmt.Fprintf(w, "Path:\t%s\n", v.Path)
+		fmt.Fprintf(w, "Labels:\t%s\n", formatLabels(v.Labels))
+	})
+}
+
+func (c *cli) remove(args []string) error {
+	fs := flag.NewFlagSet("volume rm", flag.ExitOnError)
+	wait := fs.Bool("wait", false, "wait for the volume to be removed")
+	name, err := parseName(fs, args)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	id, err := c.c.RemoveVolume(ctx, name)
+	if err != nil || id == "" {
+		return err
+	}
+	job := &api.Job{ID: id, Status: api.JobQueued}
+	if *wait {
+		if job, err = c.c.WaitJob(ctx, id); err != nil {
+			return err
+		}
+	}
+	return c.print(job, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "JOB\tSTATUS")
+		fmt.Fprintf(w, "%s\t%s\n", job.ID, job.Status)
+	})
+}
+
+func (c *cli) print(v interface{}, table func(*tabwriter.Writer)) error {
+	if c.output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
+
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Every external command the gateway runs to completion goes through
+// runCommand so failures carry the tool's output and recent runs can be
+// inspected at /admin/commands. Long running daemons are tracked by the
+// supervisor instead.
+
+// maxCommandOutput limits how much output is kept per command
+const maxCommandOutput = 4096
+
+// commands keeps the most recent command runs
+var commands = &commandLog{size: 256}
+
+// CommandRecord is one run of an external command
+type CommandRecord struct {
+	Command  string
+	Args     []string `json:",omitempty"`
+	ExitCode int
+	Error    string `json:",omitempty"`
+	// Output is the combined stdout and stderr, truncated
+	Output          string `json:",omitempty"`
+	Started         time.Time
+	DurationSeconds float64
+}
+
+// CommandFailedDetails are the error details of API errors caused by a
+// failed external command.
+type CommandFailedDetails struct {
+	Command  string
+	ExitCode int
+	Output   string
+}
+
+// commandError is returned when a command can't be run or exits non-zero
+type commandError struct {
+	record CommandRecord
+	err    error
+}
+
+func (e *commandError) Error() string {
+	// the output comes first to keep the message format of the errors this
+	// replaced, which is what clients have been matching on
+	return strings.TrimSpace(e.record.Output) + ": " + e.err.Error()
+}
+
+func (e *commandError) details() CommandFailedDetails {
+	return CommandFailedDetails{Command: e.record.Command, ExitCode: e.record.ExitCode, Output: e.record.Output}
+}
+
+type commandLog struct {
+	mu      sync.Mutex
+	size    int
+	records []CommandRecord
+	next    int
+}
+
+func (l *commandLog) add(r CommandRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.records) < l.size {
+		l.records = append(l.records, r)
+		return
+	}
+	l.records[l.next] = r
+	l.next = (l.next + 1) % l.size
+}
+
+// list returns the records, oldest first
+func (l *commandLog) list() []CommandRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]CommandRecord, 0, len(l.records))
+	out = append(out, l.records[l.next:]...)
+	return append(out, l.records[:l.next]...)
+}
+
+// lockedBuffer lets stdout and stderr be collected into the same buffer
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// runCommand runs bin, records the run and returns its stdout. On failure the
+// error is a *commandError holding the combined output.
+func runCommand(bin string, args ...string) ([]byte, error) {
+	return runCommandContext(context.Background(), bin, args...)
+}
+
+// runCommandContext is runCommand killing bin once ctx is done, in which case
+// the error is ctx's.
+func runCommandContext(ctx context.Context, bin string, args ...string) ([]byte, error) {
+	ctx, s := startSpan(ctx, "exec "+filepath.Base(bin), spanKindInternal)
+	s.set("command.args", strings.Join(args, " "))
+	var stdout bytes.Buffer
+	var combined lockedBuffer
+	c := exec.CommandContext(ctx, bin, args...)
+	c.Stdout = io.MultiWriter(&stdout, &combined)
+	c.Stderr = &combined
+
+	r := CommandRecord{Command: bin, Args: args, Started: time.Now().UTC()}
+	err := c.Run()
+	r.DurationSeconds = time.Since(r.Started).Seconds()
+	r.Output = combined.buf.String()
+	if len(r.Output) > maxCommandOutput {
+		r.Output = r.Output[:maxCommandOutput]
+	}
+	if err != nil {
+		r.ExitCode = -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				r.ExitCode = ws.ExitStatus()
+			}
+		}
+		r.Error = err.Error()
+	}
+	commands.add(r)
+	s.set("command.exit_code", r.ExitCode)
+	s.finish(err)
+
+	if err != nil && ctx.Err() != nil {
+		return stdout.Bytes(), errors.Wrapf(ctx.Err(), "%s was stopped", bin)
+	}
+	if err != nil {
+		return stdout.Bytes(), &commandError{record: r, err: err}
+	}
+	return stdout.Bytes(), nil
+}
+
+func cmd(bin string, args ...string) error {
+	_, err := runCommand(bin, args...)
+	return err
+}
+
+func cmdContext(ctx context.Context, bin string, args ...string) error {
+	_, err := runCommandContext(ctx, bin, args...)
+	return err
+}
+
+func (g *gateway) listCommands(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(commands.list())
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+)
+
+// configAliases maps friendlier config keys to their flag names
+var configAliases = map[string]string{
+	"listen": "H",
+}
+
+// reloadableSettings are the flags which are re-read from the config file on
+// SIGHUP or POST /admin/reload. Everything else requires a restart.
+var reloadableSettings = map[string]bool{
+	"auth-token":             true,
+	"auth-token-file":        true,
+	"admin-token":            true,
+	"default-export-options": true,
+	"merge-export-options":   true,
+	"tenant-quotas":          true,
+	"rbac":                   true,
+	"default-role":           true,
+}
+
+// configFile supplies flag values from a TOML file. Keys are the flag names
+// (e.g. `root = "/data"`), lists are joined with commas. Flags given on the
+// command line always take precedence over the file.
+type configFile struct {
+	path    string
+	fs      *flag.FlagSet
+	cmdline map[string]bool
+}
+
+func newConfigFile(path string, fs *flag.FlagSet) *configFile {
+	c := &configFile{path: path, fs: fs, cmdline: make(map[string]bool)}
+	fs.Visit(func(f *flag.Flag) {
+		c.cmdline[f.Name] = true
+	})
+	return c
+}
+
+// apply loads the file and sets flags from it. If only is non-nil, just
+// those flags are touched, and any of them missing from the file are reset to
+// their defaults.
+func (c *configFile) apply(only map[string]bool) error {
+	if c.path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return errors.Wrap(err, "error reading config file")
+	}
+	var values map[string]interface{}
+	if _, err := toml.Decode(string(data), &values); err != nil {
+		return errors.Wrap(err, "error parsing config file")
+	}
+
+	seen := make(map[string]bool)
+	for k, v := range values {
+		name := k
+		if alias, ok := configAliases[k]; ok {
+			name = alias
+		}
+		if c.fs.Lookup(name) == nil {
+			return errors.Errorf("unknown config setting: %s", k)
+		}
+		seen[name] = true
+		if c.cmdline[name] || (only != nil && !only[name]) {
+			continue
+		}
+		if err := c.fs.Set(name, configValue(v)); err != nil {
+			return errors.Wrapf(err, "invalid value for %s", k)
+		}
+	}
+
+	for name := range only {
+		if seen[name] || c.cmdline[name] {
+			continue
+		}
+		if f := c.fs.Lookup(name); f != nil {
+			c.fs.Set(name, f.DefValue)
+		}
+	}
+	return nil
+}
+
+func configValue(v interface{}) string {
+	switch v := v.(type) {
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, p := range v {
+			parts[i] = fmt.Sprint(p)
+		}
+		return strings.Join(parts, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
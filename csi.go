@@ -0,0 +1,416 @@
+package main
+
+import (
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CSI identity and controller services, so kubernetes can provision volumes
+// on this gateway through a CSI controller deployment. Volume ids are the
+// volume names, in the default tenant. StorageClass parameters are the same
+// options as the docker plugin's. New volumes aren't exported to anyone,
+// ControllerPublishVolume grants the node an access rule, using the node id
+// as the host, so node ids must be the nodes' addresses or hostnames.
+// Mounting is left to a node plugin for NFS, which gets the server and share
+// to mount from the volume context.
+
+const (
+	csiPluginName = "nfs-rest-gateway.cpuguy83.github.com"
+	// csiRulePrefix marks the access rules created by ControllerPublishVolume
+	csiRulePrefix = "csi-"
+	// csiParamPrefix is the prefix of the parameters the external
+	// provisioner adds about the claim, which are ignored
+	csiParamPrefix = "csi.storage.k8s.io/"
+)
+
+// csiReads are the methods still served during maintenance
+var csiReads = map[string]bool{
+	"/csi.v1.Controller/ValidateVolumeCapabilities": true,
+	"/csi.v1.Controller/ListVolumes":                true,
+	"/csi.v1.Controller/ControllerGetCapabilities":  true,
+}
+
+type csiServer struct {
+	g *gateway
+	// server is the NFS server address nodes mount from
+	server string
+}
+
+// serveCSI serves the CSI services on the unix socket, the returned function
+// stops them
+func serveCSI(addr, nfsServer string, g *gateway) (func(), error) {
+	if nfsServer == "" {
+		nfsServer = defaultNFSServer()
+	}
+	l, err := listen(unixScheme+strings.TrimPrefix(addr, unixScheme), 0660, "")
+	if err != nil {
+		return nil, err
+	}
+	srv := grpc.NewServer(grpc.UnaryInterceptor(g.csiInterceptor))
+	s := &csiServer{g: g, server: nfsServer}
+	csi.RegisterIdentityServer(srv, s)
+	csi.RegisterControllerServer(srv, s)
+	go func() {
+		if err := srv.Serve(l); err != nil {
+			logrus.WithError(err).Error("CSI listener stopped")
+		}
+	}()
+	return func() {
+		srv.GracefulStop()
+		os.Remove(strings.TrimPrefix(addr, unixScheme))
+	}, nil
+}
+
+// defaultNFSServer is the address nodes mount from unless -csi-nfs-server is
+// set, the HA floating IP or else the hostname
+func defaultNFSServer() string {
+	if ha.floatingIP != "" {
+		if ip, _, err := net.ParseCIDR(ha.floatingIP); err == nil {
+			return ip.String()
+		}
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return name
+}
+
+// csiInterceptor refuses changes during maintenance, acts for the "csi"
+// principal and turns errors into gRPC statuses
+func (g *gateway) csiInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if g.maintenance.active() && !csiReads[info.FullMethod] && !strings.HasPrefix(info.FullMethod, "/csi.v1.Identity/") {
+		return nil, status.Error(codes.Unavailable, "the gateway is in maintenance, only reads are served")
+	}
+	resp, err := handler(withPrincipal(ctx, "csi"), req)
+	if err != nil {
+		err = grpcError(err)
+		if status.Code(err) == codes.Internal {
+			logrus.WithField("method", info.FullMethod).WithError(err).Error("CSI request failed")
+		}
+	}
+	return resp, err
+}
+
+// grpcCodes maps API error codes to gRPC status codes
+var grpcCodes = map[string]codes.Code{
+	api.ErrCodeInvalidRequest:     codes.InvalidArgument,
+	api.ErrCodeUnauthorized:       codes.Unauthenticated,
+	api.ErrCodeForbidden:          codes.PermissionDenied,
+	api.ErrCodeNotFound:           codes.NotFound,
+	api.ErrCodeAlreadyExists:      codes.AlreadyExists,
+	api.ErrCodeQuotaExceeded:      codes.ResourceExhausted,
+	api.ErrCodeVolumeInUse:        codes.FailedPrecondition,
+	api.ErrCodeVolumeIsMirror:     codes.FailedPrecondition,
+	api.ErrCodePreconditionFailed: codes.FailedPrecondition,
+	api.ErrCodeRateLimited:        codes.ResourceExhausted,
+	api.ErrCodeTimeout:            codes.DeadlineExceeded,
+	api.ErrCodeMaintenance:        codes.Unavailable,
+	api.ErrCodeTooLarge:           codes.OutOfRange,
+}
+
+// grpcError turns errors other than gRPC statuses into one with the code
+// matching their API error code
+func grpcError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	c, ok := grpcCodes[errorCode(err)]
+	if !ok {
+		c = codes.Internal
+	}
+	return status.Error(c, err.Error())
+}
+
+func (s *csiServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	return &csi.GetPluginInfoResponse{Name: csiPluginName, VendorVersion: "1"}, nil
+}
+
+func (s *csiServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	return &csi.GetPluginCapabilitiesResponse{
+		Capabilities: []*csi.PluginCapability{{
+			Type: &csi.PluginCapability_Service_{Service: &csi.PluginCapability_Service{
+				Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+			}},
+		}},
+	}, nil
+}
+
+// Probe reports the plugin ready once the NFS server serves exports
+func (s *csiServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	err := s.g.checkPreflight()
+	if err == nil {
+		err = s.g.exporter.ready()
+	}
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil
+}
+
+func (s *csiServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	var resp csi.ControllerGetCapabilitiesResponse
+	for _, t := range []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_READONLY,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+	} {
+		resp.Capabilities = append(resp.Capabilities, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{Rpc: &csi.ControllerServiceCapability_RPC{Type: t}},
+		})
+	}
+	return &resp, nil
+}
+
+// checkCapabilities accepts filesystem access in any access mode, NFS can
+// be mounted by many nodes at once
+func checkCapabilities(caps []*csi.VolumeCapability) error {
+	if len(caps) == 0 {
+		return status.Error(codes.InvalidArgument, "volume capabilities must be set")
+	}
+	for _, c := range caps {
+		if c.GetBlock() != nil {
+			return status.Error(codes.InvalidArgument, "block access is not supported")
+		}
+		if c.GetAccessMode() == nil || c.GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_UNKNOWN {
+			return status.Error(codes.InvalidArgument, "access mode must be set")
+		}
+	}
+	return nil
+}
+
+// csiSize returns the size to create a volume with for the capacity range
+func csiSize(r *csi.CapacityRange) (int64, error) {
+	if r.GetRequiredBytes() < 0 || r.GetLimitBytes() < 0 {
+		return 0, status.Error(codes.InvalidArgument, "capacity must not be negative")
+	}
+	if r.GetLimitBytes() > 0 && r.GetRequiredBytes() > r.GetLimitBytes() {
+		return 0, status.Error(codes.OutOfRange, "required bytes exceed the limit")
+	}
+	if r.GetRequiredBytes() > 0 {
+		return r.GetRequiredBytes(), nil
+	}
+	return r.GetLimitBytes(), nil
+}
+
+func (s *csiServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "name must be set")
+	}
+	if err := checkCapabilities(req.VolumeCapabilities); err != nil {
+		return nil, err
+	}
+	if req.VolumeContentSource != nil {
+		return nil, status.Error(codes.InvalidArgument, "volume content sources are not supported")
+	}
+	opts := make(map[string]string, len(req.Parameters))
+	for k, v := range req.Parameters {
+		if !strings.HasPrefix(k, csiParamPrefix) {
+			opts[k] = v
+		}
+	}
+	cr, err := createOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if req.CapacityRange != nil {
+		if cr.SizeBytes, err = csiSize(req.CapacityRange); err != nil {
+			return nil, err
+		}
+	}
+
+	v, err := s.g.create(ctx, req.Name, cr)
+	if isAlreadyExists(err) {
+		// a retry of a create which succeeded
+		if v, err = s.g.lookup(req.Name); err == nil && v.sizeLimit() != cr.SizeBytes {
+			return nil, status.Error(codes.AlreadyExists, "the volume exists with a different size")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &csi.CreateVolumeResponse{Volume: s.csiVolume(v)}, nil
+}
+
+// isAlreadyExists reports whether err is an already_exists API error
+func isAlreadyExists(err error) bool {
+	if err == nil {
+		return false
+	}
+	_, resp := toErrorResponse(err)
+	return resp.Code == api.ErrCodeAlreadyExists
+}
+
+func (s *csiServer) csiVolume(v *volume) *csi.Volume {
+	share := v.Export.Path
+	// NFSv4 clients mount paths relative to the pseudo-root
+	if e, ok := s.g.exporter.(*v4Exporter); ok {
+		share = strings.TrimPrefix(e.pseudoPath(v.Name), e.root)
+	}
+	return &csi.Volume{
+		VolumeId:      v.Name,
+		CapacityBytes: v.sizeLimit(),
+		VolumeContext: map[string]string{"server": s.server, "share": share},
+	}
+}
+
+func (s *csiServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id must be set")
+	}
+	// removing a volume which is already gone succeeds
+	if err := s.g.removeVolume(req.VolumeId, false, func(string) {}); err != nil {
+		return nil, err
+	}
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// ControllerPublishVolume grants the node access to the volume with an
+// access rule for it
+func (s *csiServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	if req.VolumeId == "" || req.NodeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume and node id must be set")
+	}
+	if err := checkCapabilities([]*csi.VolumeCapability{req.VolumeCapability}); err != nil {
+		return nil, err
+	}
+	rule := api.AccessRuleRequest{Host: req.NodeId, Access: "rw"}
+	if req.Readonly {
+		rule.Access = "ro"
+	}
+	if err := validateAccessRule(&rule); err != nil {
+		return nil, err
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.g.modifyVolume(ctx, req.VolumeId, func(v *volume) error {
+		if v.Mirror {
+			return errMirror()
+		}
+		for _, h := range v.Export.Hosts {
+			if h == req.NodeId {
+				return errUnchanged
+			}
+		}
+		for _, a := range v.Export.Access {
+			if a.Host != req.NodeId {
+				continue
+			}
+			if a.Access != rule.Access {
+				return errAlreadyExists("the volume is published to the node " + a.Access)
+			}
+			return errUnchanged
+		}
+		_, err := setAccessRule(v, csiRulePrefix+id, rule)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &csi.ControllerPublishVolumeResponse{}, nil
+}
+
+// ControllerUnpublishVolume removes the access rules publish added for the
+// node, or for every node if none is given
+func (s *csiServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id must be set")
+	}
+	_, err := s.g.modifyVolume(ctx, req.VolumeId, func(v *volume) error {
+		var kept []api.AccessRule
+		for _, a := range v.Export.Access {
+			if strings.HasPrefix(a.ID, csiRulePrefix) && (req.NodeId == "" || a.Host == req.NodeId) {
+				continue
+			}
+			kept = append(kept, a)
+		}
+		if len(kept) == len(v.Export.Access) {
+			return errUnchanged
+		}
+		v.Export.Access = kept
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+func (s *csiServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id must be set")
+	}
+	if _, err := s.g.lookup(req.VolumeId); err != nil {
+		return nil, err
+	}
+	if err := checkCapabilities(req.VolumeCapabilities); err != nil {
+		if status.Code(err) == codes.InvalidArgument && len(req.VolumeCapabilities) > 0 {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: status.Convert(err).Message()}, nil
+		}
+		return nil, err
+	}
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.VolumeContext,
+			VolumeCapabilities: req.VolumeCapabilities,
+			Parameters:         req.Parameters,
+		},
+	}, nil
+}
+
+// ListVolumes lists the default tenant's volumes by name, the next token is
+// the last name returned
+func (s *csiServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if req.MaxEntries < 0 {
+		return nil, status.Error(codes.InvalidArgument, "max entries must not be negative")
+	}
+	vols, err := s.g.list()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(vols, func(i, j int) bool { return vols[i].Name < vols[j].Name })
+
+	var resp csi.ListVolumesResponse
+	for _, v := range vols {
+		if volumeTenant(v.Name) != "" || v.Name <= req.StartingToken {
+			continue
+		}
+		if req.MaxEntries > 0 && len(resp.Entries) == int(req.MaxEntries) {
+			resp.NextToken = resp.Entries[len(resp.Entries)-1].Volume.VolumeId
+			break
+		}
+		resp.Entries = append(resp.Entries, &csi.ListVolumesResponse_Entry{Volume: s.csiVolume(v)})
+	}
+	return &resp, nil
+}
+
+func (s *csiServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (s *csiServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (s *csiServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (s *csiServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
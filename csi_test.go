@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newTestCSI serves the CSI services of a test gateway and returns a client
+// connected to them
+func newTestCSI(t *testing.T) (*testGateway, csi.ControllerClient, func()) {
+	g, cleanup := newTestGateway(t)
+	sock := filepath.Join(g.root, "csi.sock")
+	stop, err := serveCSI(sock, "nfs.example.com", g.gateway)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	conn, err := grpc.Dial(sock, grpc.WithInsecure(), grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout("unix", addr, timeout)
+	}))
+	if err != nil {
+		stop()
+		cleanup()
+		t.Fatal(err)
+	}
+	return g, csi.NewControllerClient(conn), func() {
+		conn.Close()
+		stop()
+		cleanup()
+	}
+}
+
+var testCSICapability = &csi.VolumeCapability{
+	AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+	AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+}
+
+func TestCSIVolumeLifecycle(t *testing.T) {
+	g, c, cleanup := newTestCSI(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	create := &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		VolumeCapabilities: []*csi.VolumeCapability{testCSICapability},
+		Parameters:         map[string]string{"options": "rw,sync", "ttl": "24h", "csi.storage.k8s.io/pvc/name": "data"},
+	}
+	resp, err := c.CreateVolume(ctx, create)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := g.nfsPath("", "pvc-1")
+	want := map[string]string{"server": "nfs.example.com", "share": path}
+	if resp.Volume.VolumeId != "pvc-1" || !reflect.DeepEqual(resp.Volume.VolumeContext, want) {
+		t.Fatalf("created %+v", resp.Volume)
+	}
+	// retries of the create succeed
+	if _, err := c.CreateVolume(ctx, create); err != nil {
+		t.Fatalf("error retrying create: %v", err)
+	}
+	create.CapacityRange = &csi.CapacityRange{RequiredBytes: 1 << 30}
+	if _, err := c.CreateVolume(ctx, create); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("create with another size returned %v", err)
+	}
+
+	publish := &csi.ControllerPublishVolumeRequest{VolumeId: "pvc-1", NodeId: "10.0.0.1", VolumeCapability: testCSICapability}
+	for i := 0; i < 2; i++ {
+		if _, err := c.ControllerPublishVolume(ctx, publish); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v, err := g.lookup("pvc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.ExpiresAt == nil {
+		t.Fatal("created with a ttl parameter but doesn't expire")
+	}
+	if len(v.Export.Access) != 1 || v.Export.Access[0].Host != "10.0.0.1" || v.Export.Access[0].Access != "rw" {
+		t.Fatalf("published with access rules %+v", v.Export.Access)
+	}
+	publish.Readonly = true
+	if _, err := c.ControllerPublishVolume(ctx, publish); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("publishing read-only to a node with write access returned %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: "pvc-1", NodeId: "10.0.0.1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err = g.lookup("pvc-1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Export.Access) != 0 {
+		t.Fatalf("access rules %+v left after unpublish", v.Export.Access)
+	}
+
+	list, err := c.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Entries) != 1 || list.Entries[0].Volume.VolumeId != "pvc-1" {
+		t.Fatalf("listed %+v", list.Entries)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "pvc-1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if g.stored(t, "pvc-1") {
+		t.Fatal("volume left after delete")
+	}
+}
+
+func TestCSIErrors(t *testing.T) {
+	_, c, cleanup := newTestCSI(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	block := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: testCSICapability.AccessMode,
+	}
+	cases := []struct {
+		name string
+		call func() error
+		want codes.Code
+	}{
+		{"no name", func() error {
+			_, err := c.CreateVolume(ctx, &csi.CreateVolumeRequest{VolumeCapabilities: []*csi.VolumeCapability{testCSICapability}})
+			return err
+		}, codes.InvalidArgument},
+		{"block", func() error {
+			_, err := c.CreateVolume(ctx, &csi.CreateVolumeRequest{Name: "b", VolumeCapabilities: []*csi.VolumeCapability{block}})
+			return err
+		}, codes.InvalidArgument},
+		{"unknown parameter", func() error {
+			_, err := c.CreateVolume(ctx, &csi.CreateVolumeRequest{Name: "p", VolumeCapabilities: []*csi.VolumeCapability{testCSICapability}, Parameters: map[string]string{"bogus": "1"}})
+			return err
+		}, codes.InvalidArgument},
+		{"capacity range", func() error {
+			_, err := c.CreateVolume(ctx, &csi.CreateVolumeRequest{Name: "r", VolumeCapabilities: []*csi.VolumeCapability{testCSICapability}, CapacityRange: &csi.CapacityRange{RequiredBytes: 2, LimitBytes: 1}})
+			return err
+		}, codes.OutOfRange},
+		{"publish missing volume", func() error {
+			_, err := c.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: "missing", NodeId: "n", VolumeCapability: testCSICapability})
+			return err
+		}, codes.NotFound},
+		{"snapshots", func() error {
+			_, err := c.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{SourceVolumeId: "v", Name: "s"})
+			return err
+		}, codes.Unimplemented},
+	}
+	for _, tc := range cases {
+		if got := status.Code(tc.call()); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// GET and PUT /volume/{name}/data move a volume's contents as a tar.gz, so
+// seeding a volume or getting its data out doesn't need an NFS mount.
+
+// defaultMaxUploadSize limits uploads unless -max-upload-size is set
+const defaultMaxUploadSize = 10 << 30
+
+func errTooLarge(msg string) error {
+	return newError(http.StatusRequestEntityTooLarge, api.ErrCodeTooLarge, msg)
+}
+
+func (g *gateway) downloadData(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	v, err := g.lookup(scopedName(r, name))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if v.Pending != "" {
+		writeError(w, errInvalid("volume is still being populated"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename=`+strconv.Quote(name+".tar.gz"))
+	if err := writeArchive(v.Export.Path, w, compressGzip, func(string) {}); err != nil {
+		// too late to send an error, break the connection so the client
+		// doesn't take what it got for the whole archive
+		logrus.WithError(err).WithField("request_id", requestID(r)).Error("error streaming volume data")
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// uploadData extracts the uploaded tar.gz into the volume, on top of its
+// data unless replace=true is set, which removes the existing data first.
+// What was extracted before a failure is left in place.
+func (g *gateway) uploadData(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	replace := r.URL.Query().Get("replace") == "true"
+	id := scopedName(r, name)
+
+	defer g.locks.lock(id)()
+	v, err := g.lookup(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := checkIfMatch(r, v); err != nil {
+		writeError(w, err)
+		return
+	}
+	switch {
+	case v.Mirror:
+		err = errMirror()
+	case v.ReadOnly:
+		err = errInvalid("volume is read-only")
+	case v.Pending != "":
+		err = errInvalid("volume is still being populated")
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	limit := g.maxUploadSize
+	if size := v.sizeLimit(); size > 0 && size < limit {
+		limit = size
+	}
+	if replace {
+		if err := clearDir(v.Export.Path); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	stats, err := extractArchive(r.Body, v.Export.Path, compressGzip, limit, func(string) {})
+	if err != nil {
+		if err == errArchiveTooLarge {
+			err = errTooLarge("the archive is larger than " + strconv.FormatInt(limit, 10) + " bytes")
+		} else {
+			err = errInvalid(err.Error())
+		}
+		writeError(w, err)
+		return
+	}
+	requestLog(r).WithField("volume", id).WithField("entries", stats.entries).Info("volume data uploaded")
+
+	b, err := json.Marshal(api.DataUploadResponse{Entries: stats.entries, Bytes: stats.bytes})
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
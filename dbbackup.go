@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// maxDBRestoreSize limits uploaded database snapshots
+const maxDBRestoreSize = 1 << 30
+
+// dbBackupPrefix is where database backups are kept in the backup bucket,
+// volume names can't start with a dot so it can't clash with their backups.
+const dbBackupPrefix = ".nfsg/db/"
+
+// restoreKeepBuckets describe work in progress on this node or its disks
+// rather than volumes, a restore leaves them as they are.
+var restoreKeepBuckets = map[string]bool{string(jobsBucket): true, string(idempotencyBucket): true, string(poolsBucket): true}
+
+type DBRestoreResult struct {
+	Volumes int
+}
+
+// backupDB streams a consistent snapshot of the database
+func (g *gateway) backupDB(w http.ResponseWriter, r *http.Request) {
+	err := g.view(func(tx *bolt.Tx) error {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="volumes.db"`)
+		w.Header().Set("Content-Length", strconv.FormatInt(tx.Size(), 10))
+		_, err := tx.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		// too late to send an error, the client sees a short body
+		logrus.WithError(err).WithField("request_id", requestID(r)).Error("error streaming database backup")
+	}
+}
+
+// restoreDB replaces the database contents with an uploaded snapshot in a
+// single transaction, so a bad upload leaves the database untouched.
+func (g *gateway) restoreDB(w http.ResponseWriter, r *http.Request) {
+	tmpDir := filepath.Join(g.root, "tmp")
+	if err := os.MkdirAll(tmpDir, 0700); err != nil {
+		writeError(w, errors.Wrap(err, "error creating temp dir"))
+		return
+	}
+	f, err := ioutil.TempFile(tmpDir, "restore-")
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error creating snapshot file"))
+		return
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, http.MaxBytesReader(w, r.Body, maxDBRestoreSize))
+	f.Close()
+	if err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error reading snapshot").Error()))
+		return
+	}
+
+	snap, count, err := openSnapshot(f.Name())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer snap.Close()
+	if err := g.restoreFrom(snap); err != nil {
+		writeError(w, err)
+		return
+	}
+	logrus.WithField("volumes", count).WithField("request_id", requestID(r)).Info("database restored from snapshot")
+	g.refreshSettings()
+	if err := g.Reload(); err != nil {
+		writeError(w, errors.Wrap(err, "database restored but volumes could not be re-exported"))
+		return
+	}
+
+	b, err := json.Marshal(DBRestoreResult{Volumes: count})
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+// openSnapshot opens and checks a database snapshot, returning how many
+// volumes it has.
+func openSnapshot(p string) (*bolt.DB, int, error) {
+	snap, err := bolt.Open(p, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return nil, 0, errInvalid(errors.Wrap(err, "snapshot is not a valid database").Error())
+	}
+	var count int
+	err = snap.View(func(tx *bolt.Tx) error {
+		// Check stops only once every error has been read
+		var corrupt error
+		for err := range tx.Check() {
+			if corrupt == nil {
+				corrupt = err
+			}
+		}
+		if corrupt != nil {
+			return errInvalid(errors.Wrap(corrupt, "snapshot is corrupt").Error())
+		}
+		if tx.Bucket(volumesBucket) == nil {
+			return errInvalid("snapshot has no volumes bucket")
+		}
+		return tx.Bucket(volumesBucket).ForEach(func(k, v []byte) error {
+			var vol volume
+			if err := json.Unmarshal(v, &vol); err != nil {
+				return errInvalid(errors.Wrapf(err, "snapshot has invalid volume %s", k).Error())
+			}
+			count++
+			return nil
+		})
+	})
+	if err != nil {
+		snap.Close()
+		return nil, 0, err
+	}
+	return snap, count, nil
+}
+
+func (g *gateway) restoreFrom(snap *bolt.DB) error {
+	return g.update(func(tx *bolt.Tx) error {
+		return snap.View(func(stx *bolt.Tx) error {
+			for _, name := range dbBuckets {
+				if restoreKeepBuckets[string(name)] {
+					continue
+				}
+				if err := tx.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+					return dbError(errors.Wrapf(err, "error clearing %s bucket", name))
+				}
+				dst, err := tx.CreateBucket(name)
+				if err != nil {
+					return dbError(errors.Wrapf(err, "error creating %s bucket", name))
+				}
+				// snapshots from older versions may not have every bucket
+				if src := stx.Bucket(name); src != nil {
+					if err := copyBucket(dst, src); err != nil {
+						return dbError(errors.Wrapf(err, "error restoring %s bucket", name))
+					}
+				}
+			}
+			return nil
+		})
+	})
+}
+
+func copyBucket(dst, src *bolt.Bucket) error {
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			nested, err := dst.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			return copyBucket(nested, src.Bucket(k))
+		}
+		return dst.Put(k, v)
+	})
+}
+
+// refreshSettings reloads the settings cached in memory after the database
+// was changed behind the API's back.
+func (g *gateway) refreshSettings() {
+	if err := g.loadNetgroups(); err != nil {
+		logrus.WithError(err).Error("error reloading netgroups")
+	}
+	if d, err := loadExportDefaults(g.db); err != nil {
+		logrus.WithError(err).Error("error reloading export defaults")
+	} else if d != nil {
+		g.setExportDefaults(*d)
+	}
+}
+
+// runDBBackups writes a database snapshot to dir every interval, keeping the
+// newest keep of them, and uploads each to the backup bucket if upload is set.
+func (g *gateway) runDBBackups(interval time.Duration, dir string, keep int, upload bool) {
+	for {
+		time.Sleep(interval)
+		p, err := writeDBBackup(g.db, dir)
+		if err != nil {
+			logrus.WithError(err).Error("error backing up database")
+			continue
+		}
+		if upload && g.s3 != nil {
+			if err := g.uploadDBBackup(p); err != nil {
+				logrus.WithError(err).Error("error uploading database backup")
+			}
+		}
+		if err := pruneDBBackups(dir, keep); err != nil {
+			logrus.WithError(err).Warn("error removing old database backups")
+		}
+	}
+}
+
+func writeDBBackup(db *bolt.DB, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", errors.Wrap(err, "error creating database backup dir")
+	}
+	p := filepath.Join(dir, "volumes-"+time.Now().UTC().Format("20060102T150405Z")+".db")
+	// written under a temporary name so a partial backup is never picked up
+	tmp := p + ".tmp"
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(tmp, 0600)
+	})
+	if err != nil {
+		os.Remove(tmp)
+		return "", errors.Wrap(err, "error writing database backup")
+	}
+	return p, errors.Wrap(os.Rename(tmp, p), "error writing database backup")
+}
+
+func (g *gateway) uploadDBBackup(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return errors.Wrap(err, "error opening database backup")
+	}
+	defer f.Close()
+	_, err = g.s3.upload(dbBackupPrefix+filepath.Base(p), f)
+	return err
+}
+
+func pruneDBBackups(dir string, keep int) error {
+	matches, err := filepath.Glob(filepath.Join(dir, "volumes-*.db"))
+	if err != nil {
+		return err
+	}
+	if len(matches) <= keep {
+		return nil
+	}
+	// the timestamps sort chronologically
+	sort.Strings(matches)
+	for _, p := range matches[:len(matches)-keep] {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
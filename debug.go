@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+)
+
+// debugHandler serves the runtime profiles and expvars. Goroutine and heap
+// dumps are /debug/pprof/goroutine?debug=2 and /debug/pprof/heap.
+func debugHandler() http.Handler {
+	m := http.NewServeMux()
+	m.HandleFunc("/debug/pprof/", pprof.Index)
+	m.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	m.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	m.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	m.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	m.Handle("/debug/vars", expvar.Handler())
+	return m
+}
+
+// adminToken guards the debug endpoints, separately from the API tokens
+type adminToken struct {
+	mu  sync.RWMutex
+	sum *[sha256.Size]byte
+}
+
+func (a *adminToken) set(token string) {
+	var sum *[sha256.Size]byte
+	if token != "" {
+		s := sha256.Sum256([]byte(token))
+		sum = &s
+	}
+	a.mu.Lock()
+	a.sum = sum
+	a.mu.Unlock()
+}
+
+// require only lets requests with the admin token through. Without a token
+// configured the endpoints are hidden, unless open is set as it is for the
+// dedicated debug listener.
+func (a *adminToken) require(next http.Handler, open bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.mu.RLock()
+		sum := a.sum
+		a.mu.RUnlock()
+
+		if sum == nil {
+			if open {
+				next.ServeHTTP(w, r)
+				return
+			}
+			writeError(w, errNotFound("not found"))
+			return
+		}
+		got := sha256.Sum256([]byte(bearerToken(r)))
+		if subtle.ConstantTimeCompare(got[:], sum[:]) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="nfs-rest-gateway"`)
+			writeError(w, newError(http.StatusUnauthorized, api.ErrCodeUnauthorized, "unauthorized"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveDebug serves the debug endpoints on their own listener, e.g. one only
+// reachable from localhost.
+func serveDebug(addr string, admin *adminToken) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		err := http.Serve(l, withRequestID(admin.require(debugHandler(), true)))
+		logrus.WithError(err).Error("debug listener stopped")
+	}()
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Implementation of the docker volume plugin protocol so docker can manage
+// volumes on this gateway directly. Mountpoints are the export paths on the
+// gateway host, so this is meant for docker running alongside the gateway.
+
+const dockerPluginContentType = "application/vnd.docker.plugins.v1.1+json"
+
+type dockerRequest struct {
+	Name string
+	ID   string
+	Opts map[string]string
+
+	tenant string
+	ctx    context.Context
+}
+
+type dockerVolume struct {
+	Name       string
+	Mountpoint string `json:",omitempty"`
+}
+
+type dockerResponse struct {
+	Err          string
+	Mountpoint   string                  `json:",omitempty"`
+	Volume       *dockerVolume           `json:",omitempty"`
+	Volumes      []*dockerVolume         `json:",omitempty"`
+	Capabilities *struct{ Scope string } `json:",omitempty"`
+	Implements   []string                `json:",omitempty"`
+}
+
+func registerDockerPlugin(r *mux.Router, g *gateway) {
+	handle := func(path string, fn func(dockerRequest) dockerResponse) {
+		r.Methods("POST").Path(path).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req dockerRequest
+			// some calls are made without a body
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil && r.ContentLength > 0 {
+				writeDockerResponse(w, dockerResponse{Err: errors.Wrap(err, "error decoding request").Error()})
+				return
+			}
+			req.tenant = requestTenant(r)
+			req.ctx = r.Context()
+			if req.Name != "" {
+				req.Name = volumeID(req.tenant, req.Name)
+			}
+			writeDockerResponse(w, fn(req))
+		})
+	}
+
+	handle("/Plugin.Activate", func(dockerRequest) dockerResponse {
+		return dockerResponse{Implements: []string{"VolumeDriver"}}
+	})
+	handle("/VolumeDriver.Capabilities", func(dockerRequest) dockerResponse {
+		return dockerResponse{Capabilities: &struct{ Scope string }{Scope: "local"}}
+	})
+	handle("/VolumeDriver.Create", g.dockerCreate)
+	handle("/VolumeDriver.Remove", func(req dockerRequest) dockerResponse {
+		return dockerErr(g.removeVolume(req.Name, false, func(string) {}))
+	})
+	handle("/VolumeDriver.Mount", g.dockerPath)
+	handle("/VolumeDriver.Path", g.dockerPath)
+	handle("/VolumeDriver.Unmount", func(dockerRequest) dockerResponse {
+		return dockerResponse{}
+	})
+	handle("/VolumeDriver.Get", func(req dockerRequest) dockerResponse {
+		v, err := g.lookup(req.Name)
+		if err != nil {
+			return dockerErr(err)
+		}
+		return dockerResponse{Volume: &dockerVolume{Name: displayName(v.Name), Mountpoint: v.Export.Path}}
+	})
+	handle("/VolumeDriver.List", func(req dockerRequest) dockerResponse {
+		vols, err := g.list()
+		if err != nil {
+			return dockerErr(err)
+		}
+		resp := dockerResponse{Volumes: []*dockerVolume{}}
+		for _, v := range vols {
+			if volumeTenant(v.Name) != req.tenant {
+				continue
+			}
+			resp.Volumes = append(resp.Volumes, &dockerVolume{Name: displayName(v.Name), Mountpoint: v.Export.Path})
+		}
+		return resp
+	})
+}
+
+// dockerCreate creates the volume with the `docker volume create -o` options
+func (g *gateway) dockerCreate(req dockerRequest) dockerResponse {
+	cr, err := createOptions(req.Opts)
+	if err != nil {
+		return dockerErr(err)
+	}
+	_, err = g.create(req.ctx, req.Name, cr)
+	return dockerErr(err)
+}
+
+// createOptions maps key/value options onto a CreateRequest. Supported
+// options are hosts (comma separated), options, size, fstype, source, uid,
+// gid, anonuid, anongid, mode, ttl and expires_at (RFC 3339).
+func createOptions(opts map[string]string) (api.CreateRequest, error) {
+	var cr api.CreateRequest
+	for k, v := range opts {
+		switch k {
+		case "hosts":
+			cr.Hosts = splitTokens(v)
+		case "options":
+			cr.Options = v
+		case "size":
+			size, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return cr, errInvalid("invalid size: " + v)
+			}
+			cr.SizeBytes = size
+		case "fstype":
+			cr.FSType = v
+		case "source":
+			cr.Source = v
+		case "uid", "gid", "anonuid", "anongid":
+			n, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return cr, errInvalid("invalid " + k + ": " + v)
+			}
+			id := uint32(n)
+			switch k {
+			case "uid":
+				cr.Uid = &id
+			case "gid":
+				cr.Gid = &id
+			case "anonuid":
+				cr.AnonUid = &id
+			case "anongid":
+				cr.AnonGid = &id
+			}
+		case "mode":
+			cr.Mode = v
+		case "ttl":
+			cr.TTL = v
+		case "expires_at":
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return cr, errInvalid("invalid expires_at: " + v)
+			}
+			cr.ExpiresAt = &t
+		default:
+			return cr, errInvalid("unknown option: " + k)
+		}
+	}
+	return cr, nil
+}
+
+func (g *gateway) dockerPath(req dockerRequest) dockerResponse {
+	v, err := g.lookup(req.Name)
+	if err != nil {
+		return dockerErr(err)
+	}
+	return dockerResponse{Mountpoint: v.Export.Path}
+}
+
+func dockerErr(err error) dockerResponse {
+	if err == nil {
+		return dockerResponse{}
+	}
+	return dockerResponse{Err: strings.TrimSpace(err.Error())}
+}
+
+func writeDockerResponse(w http.ResponseWriter, resp dockerResponse) {
+	w.Header().Set("Content-Type", dockerPluginContentType)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// embeddedExporter serves volumes with the gateway's own NFSv3 server, so
+// the gateway runs without the kernel nfsd or nfs-utils, e.g. in unprivileged
+// containers. It's experimental: NFSv4, locking and Kerberos aren't
+// supported, file handles don't survive restarts and the NFS and MOUNT
+// programs share one TCP port without being registered with rpcbind, so
+// clients mount with
+//
+//	mount -o vers=3,proto=tcp,port=<port>,mountport=<port>,nolock server:/<volume> /mnt
+//
+// Without root the gateway can't act as the client's user, every client is
+// treated as the gateway's own user then.
+type embeddedExporter struct {
+	rpc     *rpcServer
+	handles handleTable
+	// verf tells clients whether unstable writes may have been lost, it
+	// changes with every start
+	verf [8]byte
+
+	mu sync.RWMutex
+	// exports are keyed by export id
+	exports map[uint64]*embeddedExport
+	// mounts are the paths clients mounted, keyed by client address, as
+	// listed by the MOUNT program's DUMP
+	mounts map[string]map[string]bool
+}
+
+// embeddedExport is a volume's export as served to clients
+type embeddedExport struct {
+	id   uint64
+	name string
+	path string
+	// clients are the access rules first, then the volume's hosts, the first
+	// one matching a client decides its access
+	clients []embeddedClient
+
+	// resolved caches the options decided for client addresses
+	mu       sync.Mutex
+	resolved map[string]*clientOptions
+}
+
+type embeddedClient struct {
+	host string
+	opts clientOptions
+}
+
+// clientOptions are the export options the embedded server honours
+type clientOptions struct {
+	readOnly   bool
+	rootSquash bool
+	allSquash  bool
+	anonUID    uint32
+	anonGID    uint32
+	// insecure accepts requests from unprivileged source ports
+	insecure bool
+	// noSys is set when the export requires security flavors other than
+	// AUTH_SYS
+	noSys bool
+}
+
+func newEmbeddedExporter(addr string) (*embeddedExporter, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "error listening for NFS clients")
+	}
+	e := &embeddedExporter{
+		exports: make(map[uint64]*embeddedExport),
+		mounts:  make(map[string]map[string]bool),
+	}
+	e.handles.paths = make(map[fileHandle]string)
+	binary.BigEndian.PutUint64(e.verf[:], uint64(time.Now().UnixNano()))
+	e.rpc = newRPCServer(l,
+		rpcProgram{prog: mountProgram, vers: 3, handler: e.serveMount},
+		rpcProgram{prog: nfsProgram, vers: 3, handler: e.serveNFS},
+	)
+	go e.rpc.serve()
+	logrus.WithField("addr", l.Addr().String()).Warn("serving volumes with the experimental embedded NFSv3 server")
+	return e, nil
+}
+
+// embeddedExportID identifies the volume's export in file handles and is reported
+// as its fsid
+func embeddedExportID(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return h.Sum64()
+}
+
+func (e *embeddedExporter) export(ctx context.Context, v *volume) error {
+	if !v.Export.hasClients() {
+		return e.unexport(ctx, v)
+	}
+	x := &embeddedExport{
+		id:       embeddedExportID(v.Name),
+		name:     v.Name,
+		path:     filepath.Clean(v.Export.Path),
+		resolved: make(map[string]*clientOptions),
+	}
+	for _, a := range v.Export.Access {
+		x.clients = append(x.clients, embeddedClient{host: a.Host, opts: parseClientOptions(accessOptions(v, a))})
+	}
+	opts := parseClientOptions(exportOptions(v))
+	for _, h := range v.Export.Hosts {
+		x.clients = append(x.clients, embeddedClient{host: h, opts: opts})
+	}
+	e.mu.Lock()
+	e.exports[x.id] = x
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *embeddedExporter) unexport(ctx context.Context, v *volume) error {
+	id := embeddedExportID(v.Name)
+	e.mu.Lock()
+	delete(e.exports, id)
+	e.mu.Unlock()
+	e.handles.forget(id)
+	return nil
+}
+
+func (e *embeddedExporter) reload(vols []*volume) error {
+	e.mu.Lock()
+	e.exports = make(map[uint64]*embeddedExport)
+	e.mu.Unlock()
+	for _, v := range vols {
+		if err := e.export(context.Background(), v); err != nil {
+			logrus.WithError(err).WithField("volume", v.Name).Error("error exporting volume on reload")
+		}
+	}
+	return nil
+}
+
+func (e *embeddedExporter) shutdown() error {
+	return e.rpc.close()
+}
+
+func (e *embeddedExporter) ready() error {
+	e.rpc.mu.Lock()
+	defer e.rpc.mu.Unlock()
+	if e.rpc.closed {
+		return errors.New("embedded NFS server is shut down")
+	}
+	return nil
+}
+
+func (e *embeddedExporter) exportedPaths() (map[string]bool, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	paths := make(map[string]bool, len(e.exports))
+	for _, x := range e.exports {
+		paths[x.path] = true
+	}
+	return paths, nil
+}
+
+func (e *embeddedExporter) getExport(id uint64) *embeddedExport {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.exports[id]
+}
+
+// findExport returns the export mounted at the path, which is either the
+// volume's path or /<volume>
+func (e *embeddedExporter) findExport(p string) *embeddedExport {
+	p = filepath.Clean("/" + p)
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, x := range e.exports {
+		if p == x.path || p == "/"+x.name {
+			return x
+		}
+	}
+	return nil
+}
+
+func parseClientOptions(opts string) clientOptions {
+	o := clientOptions{readOnly: true, rootSquash: true, anonUID: 65534, anonGID: 65534}
+	for _, opt := range strings.Split(opts, ",") {
+		kv := strings.SplitN(strings.TrimSpace(opt), "=", 2)
+		switch kv[0] {
+		case "rw":
+			o.readOnly = false
+		case "ro":
+			o.readOnly = true
+		case "root_squash":
+			o.rootSquash = true
+		case "no_root_squash":
+			o.rootSquash = false
+		case "all_squash":
+			o.allSquash = true
+		case "no_all_squash":
+			o.allSquash = false
+		case "insecure":
+			o.insecure = true
+		case "secure":
+			o.insecure = false
+		case "anonuid", "anongid":
+			if len(kv) != 2 {
+				continue
+			}
+			if id, err := strconv.ParseUint(kv[1], 10, 32); err == nil {
+				if kv[0] == "anonuid" {
+					o.anonUID = uint32(id)
+				} else {
+					o.anonGID = uint32(id)
+				}
+			}
+		case "sec":
+			if len(kv) == 2 {
+				o.noSys = true
+				for _, s := range strings.Split(kv[1], ":") {
+					if s == "sys" {
+						o.noSys = false
+					}
+				}
+			}
+		}
+	}
+	return o
+}
+
+// clientOptions returns the options the export grants the client, nil if it
+// isn't allowed to access it
+func (x *embeddedExport) clientOptions(addr *net.TCPAddr) *clientOptions {
+	if addr == nil {
+		return nil
+	}
+	key := addr.IP.String()
+	x.mu.Lock()
+	o, ok := x.resolved[key]
+	x.mu.Unlock()
+	if ok {
+		return o
+	}
+	for _, c := range x.clients {
+		if matchExportHost(c.host, addr.IP) {
+			opts := c.opts
+			o = &opts
+			break
+		}
+	}
+	x.mu.Lock()
+	x.resolved[key] = o
+	x.mu.Unlock()
+	return o
+}
+
+// matchExportHost reports whether the client address is one of the hosts an
+// export host stands for. Netgroups are expanded before volumes are
+// exported, the system's netgroups aren't supported.
+func matchExportHost(h string, ip net.IP) bool {
+	switch {
+	case h == "*":
+		return true
+	case strings.HasPrefix(h, "@"):
+		return false
+	case strings.Contains(h, "/"):
+		parts := strings.SplitN(h, "/", 2)
+		network := net.ParseIP(parts[0])
+		if network == nil {
+			return false
+		}
+		var mask net.IPMask
+		if n, err := strconv.Atoi(parts[1]); err == nil {
+			bits := 128
+			if network.To4() != nil {
+				network, bits = network.To4(), 32
+			}
+			mask = net.CIDRMask(n, bits)
+		} else if m := net.ParseIP(parts[1]).To4(); m != nil {
+			network, mask = network.To4(), net.IPMask(m)
+		}
+		n := &net.IPNet{IP: network.Mask(mask), Mask: mask}
+		return mask != nil && n.Contains(ip)
+	case net.ParseIP(h) != nil:
+		return net.ParseIP(h).Equal(ip)
+	case strings.ContainsAny(h, "*?["):
+		names, _ := net.LookupAddr(ip.String())
+		for _, n := range names {
+			if ok, _ := filepath.Match(strings.ToLower(h), strings.ToLower(strings.TrimSuffix(n, "."))); ok {
+				return true
+			}
+		}
+		return false
+	}
+	addrs, _ := net.LookupHost(h)
+	for _, a := range addrs {
+		if net.ParseIP(a).Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileHandle is an export id and inode number. The paths behind handles are
+// only known to the running server, handles are stale after a restart.
+type fileHandle [16]byte
+
+func makeHandle(export, ino uint64) fileHandle {
+	var fh fileHandle
+	binary.BigEndian.PutUint64(fh[:8], export)
+	binary.BigEndian.PutUint64(fh[8:], ino)
+	return fh
+}
+
+func (fh fileHandle) export() uint64 {
+	return binary.BigEndian.Uint64(fh[:8])
+}
+
+func (fh fileHandle) ino() uint64 {
+	return binary.BigEndian.Uint64(fh[8:])
+}
+
+// handleTable maps file handles to the paths they were handed out for
+type handleTable struct {
+	mu    sync.RWMutex
+	paths map[fileHandle]string
+}
+
+func (t *handleTable) put(fh fileHandle, p string) {
+	t.mu.Lock()
+	t.paths[fh] = p
+	t.mu.Unlock()
+}
+
+func (t *handleTable) get(fh fileHandle) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	p, ok := t.paths[fh]
+	return p, ok
+}
+
+func (t *handleTable) remove(fh fileHandle) {
+	t.mu.Lock()
+	delete(t.paths, fh)
+	t.mu.Unlock()
+}
+
+// rename moves the handles of the path and everything under it
+func (t *handleTable) rename(from, to string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for fh, p := range t.paths {
+		switch {
+		case p == from:
+			t.paths[fh] = to
+		case strings.HasPrefix(p, from+"/"):
+			t.paths[fh] = to + strings.TrimPrefix(p, from)
+		}
+	}
+}
+
+// forget drops the handles of an export
+func (t *handleTable) forget(export uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for fh := range t.paths {
+		if fh.export() == export {
+			delete(t.paths, fh)
+		}
+	}
+}
+
+// embeddedCred is who a call is made as, after squashing
+type embeddedCred struct {
+	uid, gid uint32
+	gids     []uint32
+}
+
+// gatewayCred is the gateway's own user, which every client acts as when
+// the gateway isn't root
+var gatewayCred = &embeddedCred{uid: uint32(os.Getuid()), gid: uint32(os.Getgid())}
+
+func (o *clientOptions) cred(c *rpcCred) *embeddedCred {
+	if os.Geteuid() != 0 {
+		return gatewayCred
+	}
+	anon := &embeddedCred{uid: o.anonUID, gid: o.anonGID}
+	switch {
+	case c == nil, o.allSquash:
+		return anon
+	case c.uid == 0 && o.rootSquash:
+		return anon
+	}
+	return &embeddedCred{uid: c.uid, gid: c.gid, gids: c.gids}
+}
+
+func (c *embeddedCred) inGroup(gid uint32) bool {
+	if c.gid == gid {
+		return true
+	}
+	for _, g := range c.gids {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	permRead  = 4
+	permWrite = 2
+	permExec  = 1
+)
+
+// may reports whether the caller has the permissions on the file. The owner
+// may always read and write regular files it has open, like with the kernel
+// nfsd, which the server can't tell apart from other calls.
+func (c *embeddedCred) may(st *syscall.Stat_t, want uint32, ownerOverride bool) bool {
+	if c.uid == 0 {
+		return want&permExec == 0 || st.Mode&0111 != 0 || st.Mode&syscall.S_IFMT == syscall.S_IFDIR
+	}
+	if ownerOverride && st.Uid == c.uid {
+		return true
+	}
+	var perm uint32
+	switch {
+	case st.Uid == c.uid:
+		perm = st.Mode >> 6
+	case c.inGroup(st.Gid):
+		perm = st.Mode >> 3
+	default:
+		perm = st.Mode
+	}
+	return perm&7&want == want
+}
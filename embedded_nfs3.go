@@ -0,0 +1,1305 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// The NFSv3 (RFC 1813) and MOUNT v3 programs of the embedded NFS server.
+// Files are worked on through their paths, handles map back to them through
+// the exporter's handle table.
+
+const (
+	mountProgram = 100005
+	nfsProgram   = 100003
+
+	// embeddedMaxIO is the largest read and write the server advertises
+	embeddedMaxIO = 1 << 20
+	nfs3FHSize    = 64
+	nfs3MaxPath   = 4096
+	nfs3MaxName   = 255
+
+	mnt3OK    = 0
+	mnt3NoEnt = 2
+	mnt3Acces = 13
+
+	nfs3OK          = 0
+	nfs3ErrPerm     = 1
+	nfs3ErrNoEnt    = 2
+	nfs3ErrIO       = 5
+	nfs3ErrAcces    = 13
+	nfs3ErrExist    = 17
+	nfs3ErrXDev     = 18
+	nfs3ErrNotDir   = 20
+	nfs3ErrIsDir    = 21
+	nfs3ErrInval    = 22
+	nfs3ErrFBig     = 27
+	nfs3ErrNoSpc    = 28
+	nfs3ErrROFS     = 30
+	nfs3ErrMLink    = 31
+	nfs3ErrNameLong = 63
+	nfs3ErrNotEmpty = 66
+	nfs3ErrDQuot    = 69
+	nfs3ErrStale    = 70
+	nfs3ErrBadFH    = 10001
+	nfs3ErrNotSync  = 10002
+	nfs3ErrNotSupp  = 10004
+	nfs3ErrTooSmall = 10005
+
+	nfs3Reg  = 1
+	nfs3Dir  = 2
+	nfs3Blk  = 3
+	nfs3Chr  = 4
+	nfs3Lnk  = 5
+	nfs3Sock = 6
+	nfs3FIFO = 7
+
+	access3Read    = 0x01
+	access3Lookup  = 0x02
+	access3Modify  = 0x04
+	access3Extend  = 0x08
+	access3Delete  = 0x10
+	access3Execute = 0x20
+
+	createUnchecked = 0
+	createGuarded   = 1
+	createExclusive = 2
+
+	stableUnstable = 0
+	stableFileSync = 2
+
+	timeDontChange = 0
+	timeServer     = 1
+	timeClient     = 2
+
+	utimeNow  = (1 << 30) - 1
+	utimeOmit = (1 << 30) - 2
+)
+
+// nfsCall is a call to the NFS program
+type nfsCall struct {
+	e   *embeddedExporter
+	req *rpcRequest
+	x   *embeddedExport
+	// opts are the export options for the client, cred who the call is made
+	// as
+	opts *clientOptions
+	cred *embeddedCred
+}
+
+// nfsFile is a file a handle resolved to
+type nfsFile struct {
+	fh   fileHandle
+	path string
+	st   *syscall.Stat_t
+}
+
+func (f *nfsFile) isDir() bool {
+	return f.st.Mode&syscall.S_IFMT == syscall.S_IFDIR
+}
+
+func (f *nfsFile) isRegular() bool {
+	return f.st.Mode&syscall.S_IFMT == syscall.S_IFREG
+}
+
+func lstat(p string) (*syscall.Stat_t, error) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(p, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// nfsStatus maps errors of file operations to NFS status codes
+func nfsStatus(err error) uint32 {
+	if err == nil {
+		return nfs3OK
+	}
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	errno, ok := err.(syscall.Errno)
+	if !ok {
+		return nfs3ErrIO
+	}
+	switch errno {
+	case syscall.EPERM:
+		return nfs3ErrPerm
+	case syscall.ENOENT:
+		return nfs3ErrNoEnt
+	case syscall.EACCES:
+		return nfs3ErrAcces
+	case syscall.EEXIST:
+		return nfs3ErrExist
+	case syscall.EXDEV:
+		return nfs3ErrXDev
+	case syscall.ENOTDIR:
+		return nfs3ErrNotDir
+	case syscall.EISDIR:
+		return nfs3ErrIsDir
+	case syscall.EINVAL:
+		return nfs3ErrInval
+	case syscall.EFBIG:
+		return nfs3ErrFBig
+	case syscall.ENOSPC:
+		return nfs3ErrNoSpc
+	case syscall.EROFS:
+		return nfs3ErrROFS
+	case syscall.EMLINK:
+		return nfs3ErrMLink
+	case syscall.ENAMETOOLONG:
+		return nfs3ErrNameLong
+	case syscall.ENOTEMPTY:
+		return nfs3ErrNotEmpty
+	case syscall.EDQUOT:
+		return nfs3ErrDQuot
+	case syscall.ESTALE:
+		return nfs3ErrStale
+	}
+	return nfs3ErrIO
+}
+
+// allowed reports whether the client may use the export with the call's
+// security: only AUTH_SYS is supported, and unless the export is insecure
+// only from privileged ports
+func (o *clientOptions) allowed(req *rpcRequest) bool {
+	return !o.noSys && (o.insecure || req.addr.Port < 1024)
+}
+
+// resolve finds the file behind a handle, checking the client may access its
+// export
+func (c *nfsCall) resolve(h []byte) (*nfsFile, uint32) {
+	if len(h) != len(fileHandle{}) {
+		return nil, nfs3ErrBadFH
+	}
+	var fh fileHandle
+	copy(fh[:], h)
+	x := c.e.getExport(fh.export())
+	if x == nil {
+		return nil, nfs3ErrStale
+	}
+	if c.x == nil {
+		opts := x.clientOptions(c.req.addr)
+		if opts == nil || !opts.allowed(c.req) {
+			return nil, nfs3ErrAcces
+		}
+		c.x, c.opts, c.cred = x, opts, opts.cred(c.req.cred)
+	} else if c.x != x {
+		return nil, nfs3ErrXDev
+	}
+	p, ok := c.e.handles.get(fh)
+	if !ok || (p != x.path && !strings.HasPrefix(p, x.path+"/")) {
+		return nil, nfs3ErrStale
+	}
+	st, err := lstat(p)
+	if err != nil || st.Ino != fh.ino() {
+		return nil, nfs3ErrStale
+	}
+	return &nfsFile{fh: fh, path: p, st: st}, nfs3OK
+}
+
+// child returns the file named in the directory, handing out its handle
+func (c *nfsCall) child(dir *nfsFile, name string) (*nfsFile, uint32) {
+	p := filepath.Join(dir.path, name)
+	switch name {
+	case ".":
+		p = dir.path
+	case "..":
+		if dir.path == c.x.path {
+			p = dir.path
+		}
+	}
+	st, err := lstat(p)
+	if err != nil {
+		return nil, nfsStatus(err)
+	}
+	f := &nfsFile{fh: makeHandle(c.x.id, st.Ino), path: p, st: st}
+	c.e.handles.put(f.fh, p)
+	return f, nfs3OK
+}
+
+func validName(name string) uint32 {
+	switch {
+	case len(name) > nfs3MaxName:
+		return nfs3ErrNameLong
+	case name == "", name == ".", name == "..", strings.ContainsAny(name, "/\x00"):
+		return nfs3ErrInval
+	}
+	return nfs3OK
+}
+
+func nfsTime(w *xdrWriter, t syscall.Timespec) {
+	w.uint32(uint32(t.Sec))
+	w.uint32(uint32(t.Nsec))
+}
+
+func writeFattr(w *xdrWriter, st *syscall.Stat_t, fsid uint64) {
+	var typ uint32
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		typ = nfs3Reg
+	case syscall.S_IFDIR:
+		typ = nfs3Dir
+	case syscall.S_IFBLK:
+		typ = nfs3Blk
+	case syscall.S_IFCHR:
+		typ = nfs3Chr
+	case syscall.S_IFLNK:
+		typ = nfs3Lnk
+	case syscall.S_IFSOCK:
+		typ = nfs3Sock
+	case syscall.S_IFIFO:
+		typ = nfs3FIFO
+	}
+	w.uint32(typ)
+	w.uint32(st.Mode & 07777)
+	w.uint32(uint32(st.Nlink))
+	w.uint32(st.Uid)
+	w.uint32(st.Gid)
+	w.uint64(uint64(st.Size))
+	w.uint64(uint64(st.Blocks) * 512)
+	w.uint32(unix.Major(uint64(st.Rdev)))
+	w.uint32(unix.Minor(uint64(st.Rdev)))
+	w.uint64(fsid)
+	w.uint64(st.Ino)
+	nfsTime(w, st.Atim)
+	nfsTime(w, st.Mtim)
+	nfsTime(w, st.Ctim)
+}
+
+// postOpAttr writes the current attributes of the file, if it still exists
+func (c *nfsCall) postOpAttr(w *xdrWriter, p string) {
+	st, err := lstat(p)
+	if err != nil {
+		w.bool(false)
+		return
+	}
+	w.bool(true)
+	writeFattr(w, st, c.x.id)
+}
+
+// wcc holds the attributes of a file before an operation changing it
+type wcc struct {
+	path string
+	st   *syscall.Stat_t
+}
+
+func (f *nfsFile) wcc() *wcc {
+	return &wcc{path: f.path, st: f.st}
+}
+
+// write writes the attributes before and after, or none if there's no file
+func (a *wcc) write(c *nfsCall, w *xdrWriter) {
+	if a == nil {
+		w.bool(false)
+		w.bool(false)
+		return
+	}
+	w.bool(true)
+	w.uint64(uint64(a.st.Size))
+	nfsTime(w, a.st.Mtim)
+	nfsTime(w, a.st.Ctim)
+	c.postOpAttr(w, a.path)
+}
+
+// sattr are the attributes a client sets
+type sattr struct {
+	mode, uid, gid *uint32
+	size           *uint64
+	atime, mtime   uint32
+	atimeVal       syscall.Timespec
+	mtimeVal       syscall.Timespec
+}
+
+func readSattr(r *xdrReader) *sattr {
+	s := &sattr{}
+	opt32 := func() *uint32 {
+		if !r.bool() {
+			return nil
+		}
+		v := r.uint32()
+		return &v
+	}
+	s.mode, s.uid, s.gid = opt32(), opt32(), opt32()
+	if r.bool() {
+		v := r.uint64()
+		s.size = &v
+	}
+	readTime := func() (uint32, syscall.Timespec) {
+		how := r.uint32()
+		if how == timeClient {
+			return how, syscall.Timespec{Sec: int64(r.uint32()), Nsec: int64(r.uint32())}
+		}
+		return how, syscall.Timespec{}
+	}
+	s.atime, s.atimeVal = readTime()
+	s.mtime, s.mtimeVal = readTime()
+	return s
+}
+
+// setattr applies the attributes as the caller, with the permission checks
+// the kernel makes
+func (c *nfsCall) setattr(f *nfsFile, s *sattr) uint32 {
+	owner := c.cred.uid == 0 || c.cred.uid == f.st.Uid
+	uid, gid := -1, -1
+	if s.uid != nil && *s.uid != f.st.Uid {
+		if c.cred.uid != 0 {
+			return nfs3ErrPerm
+		}
+		uid = int(*s.uid)
+	}
+	if s.gid != nil && *s.gid != f.st.Gid {
+		if !owner || (c.cred.uid != 0 && !c.cred.inGroup(*s.gid)) {
+			return nfs3ErrPerm
+		}
+		gid = int(*s.gid)
+	}
+	if s.mode != nil && !owner {
+		return nfs3ErrPerm
+	}
+	if s.size != nil {
+		switch {
+		case f.isDir():
+			return nfs3ErrIsDir
+		case !f.isRegular():
+			return nfs3ErrInval
+		case !c.cred.may(f.st, permWrite, true):
+			return nfs3ErrAcces
+		}
+	}
+	if (s.atime == timeClient || s.mtime == timeClient) && !owner {
+		return nfs3ErrPerm
+	}
+	if (s.atime == timeServer || s.mtime == timeServer) && !owner && !c.cred.may(f.st, permWrite, false) {
+		return nfs3ErrAcces
+	}
+
+	if uid >= 0 || gid >= 0 {
+		if err := os.Lchown(f.path, uid, gid); err != nil {
+			return nfsStatus(err)
+		}
+	}
+	if s.mode != nil && f.st.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		if err := syscall.Chmod(f.path, *s.mode&07777); err != nil {
+			return nfsStatus(err)
+		}
+	}
+	if s.size != nil {
+		if err := os.Truncate(f.path, int64(*s.size)); err != nil {
+			return nfsStatus(err)
+		}
+	}
+	if s.atime != timeDontChange || s.mtime != timeDontChange {
+		ts := []unix.Timespec{utimeSpec(s.atime, s.atimeVal), utimeSpec(s.mtime, s.mtimeVal)}
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, f.path, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return nfsStatus(err)
+		}
+	}
+	return nfs3OK
+}
+
+func utimeSpec(how uint32, t syscall.Timespec) unix.Timespec {
+	switch how {
+	case timeServer:
+		return unix.Timespec{Nsec: utimeNow}
+	case timeClient:
+		return unix.Timespec{Sec: t.Sec, Nsec: t.Nsec}
+	}
+	return unix.Timespec{Nsec: utimeOmit}
+}
+
+// owned gives a file the caller created to the caller, the group of a
+// setgid directory's files is the directory's
+func (c *nfsCall) owned(dir *nfsFile, p string) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	gid := c.cred.gid
+	if dir.st.Mode&syscall.S_ISGID != 0 {
+		gid = dir.st.Gid
+	}
+	return os.Lchown(p, int(c.cred.uid), int(gid))
+}
+
+func (e *embeddedExporter) serveNFS(req *rpcRequest, w *xdrWriter) uint32 {
+	c := &nfsCall{e: e, req: req}
+	r := req.args
+	switch req.proc {
+	case 0:
+		return rpcSuccess
+	case 1:
+		return c.getattr(r, w)
+	case 2:
+		return c.setattrProc(r, w)
+	case 3:
+		return c.lookup(r, w)
+	case 4:
+		return c.access(r, w)
+	case 5:
+		return c.readlink(r, w)
+	case 6:
+		return c.read(r, w)
+	case 7:
+		return c.write(r, w)
+	case 8:
+		return c.create(r, w)
+	case 9:
+		return c.mkdir(r, w)
+	case 10:
+		return c.symlink(r, w)
+	case 11:
+		return c.mknod(r, w)
+	case 12, 13:
+		return c.remove(r, w, req.proc == 13)
+	case 14:
+		return c.rename(r, w)
+	case 15:
+		return c.link(r, w)
+	case 16:
+		return c.readdir(r, w, false)
+	case 17:
+		return c.readdir(r, w, true)
+	case 18:
+		return c.fsstat(r, w)
+	case 19:
+		return c.fsinfo(r, w)
+	case 20:
+		return c.pathconf(r, w)
+	case 21:
+		return c.commit(r, w)
+	}
+	return rpcProcUnavail
+}
+
+func (c *nfsCall) getattr(r *xdrReader, w *xdrWriter) uint32 {
+	h := r.opaque(nfs3FHSize)
+	if r.err != nil {
+		return rpcGarbageArgs
+	}
+	f, stat := c.resolve(h)
+	w.uint32(stat)
+	if stat == nfs3OK {
+		writeFattr(w, f.st, c.x.id)
+	}
+	return rpcSuccess
+}
+
+func (c *nfsCall) setattrProc(r *xdrReader, w *xdrWriter) uint32 {
+	h := r.opaque(nfs3FHSize)
+	s := readSattr(r)
+	guard := r.bool()
+	var ctime syscall.Timespec
+	if guard {
+		ctime = syscall.Timespec{Sec: int64(r.uint32()), Nsec: int64(r.uint32())}
+	}
+	if r.err != nil {
+		return rpcGarbageArgs
+	}
+	f, stat := c.resolve(h)
+	if stat != nfs3OK {
+		w.uint32(stat)
+		(*wcc)(nil).write(c, w)
+		return rpcSuccess
+	}
+	switch {
+	case c.opts.readOnly:
+		stat = nfs3ErrROFS
+	case guard && (uint32(f.st.Ctim.Sec) != uint32(ctime.Sec) || uint32(f.st.Ctim.Nsec) != uint32(ctime.Nsec)):
+		stat = nfs3ErrNotSync
+	default:
+		stat = c.setattr(f, s)
+	}
+	w.uint32(stat)
+	f.wcc().write(c, w)
+	return rpcSuccess
+}
+
+func (c *nfsCall) lookup(r *xdrReader, w *xdrWriter) uint32 {
+	h, name := r.opaque(nfs3FHSize), r.string(nfs3MaxPath)
+	if r.err != nil {
+		return rpcGarbageArgs
+	}
+	dir, stat := c.resolve(h)
+	if stat != nfs3OK {
+		w.uint32(stat)
+		w.bool(false)
+		return rpcSuccess
+	}
+	var f *nfsFile
+	switch {
+	case !dir.isDir():
+		stat = nfs3ErrNotDir
+	case !c.cred.may(dir.st, permExec, false):
+		stat = nfs3ErrAcces
+	case len(name) > nfs3MaxName:
+		stat = nfs3ErrNameLong
+	case name == "" || strings.ContainsAny(name, "/\x00"):
+		stat = nfs3ErrNoEnt
+	default:
+		f, stat = c.child(dir, name)
+	}
+	w.uint32(stat)
+	if stat != nfs3OK {
+		c.postOpAttr(w, dir.path)
+		return rpcSuccess
+	}
+	w.opaque(f.fh[:])
+	w.bool(true)
+	writeFattr(w, f.st, c.x.id)
+	c.postOpAttr(w, dir.path)
+	return rpcSuccess
+}
+
+func (c *nfsCall) access(r *xdrReader, w *xdrWriter) uint32 {
+	h, want := r.opaque(nfs3FHSize), r.uint32()
+	if r.err != nil {
+		return rpcGarbageArgs
+	}
+	f, stat := c.resolve(h)
+	w.uint32(stat)
+	if stat != nfs3OK {
+		w.bool(false)
+		return rpcSuccess
+	}
+	var granted uint32
+	if c.cred.may(f.st, permRead, false) {
+		granted |= access3Read
+	}
+	if f.isDir() {
+		if c.cred.may(f.st, permExec, false) {
+			granted |= access3Lookup
+		}
+		if c.cred.may(f.st, permWrite, false) {
+			granted |= access3Modify | access3Extend | access3Delete
+		}
+	} else {
+		if c.cred.may(f.st, permWrite, false) {
+			granted |= access3Modify | access3Extend
+		}
+		if c.cred.may(f.st, permExec, false) {
+			granted |= access3Execute
+		}
+	}
+	if c.opts.readOnly {
+		granted &^= access3Modify | access3Extend | access3Delete
+	}
+	w.bool(true)
+	writeFattr(w, f.st, c.x.id)
+	w.uint32(granted & want)
+	return rpcSuccess
+}
+
+func (c *nfsCall) readlink(r *xdrReader, w *xdrWriter) uint32 {
+	h := r.opaque(nfs3FHSize)
+	if r.err != nil {
+		return rpcGarbageArgs
+	}
+	f, stat := c.resolve(h)
+	if stat != nfs3OK {
+		w.uint32(stat)
+		w.bool(false)
+		return rpcSuccess
+	}
+	target, err := os.Readlink(f.path)
+	switch {
+	case f.st.Mode&syscall.S_IFMT != syscall.S_IFLNK:
+		stat = nfs3ErrInval
+	case err != nil:
+		stat = nfsStatus(err)
+	}
+	w.uint32(stat)
+	w.bool(true)
+	writeFattr(w, f.st, c.x.id)
+	if stat == nfs3OK {
+		w.string(target)
+	}
+	return rpcSuccess
+}
+
+// openFile opens a regular file without following symlinks
+func openFile(f *nfsFile, flag int) (*os.File, uint32) {
+	switch {
+	case f.isDir():
+		return nil, nfs3ErrIsDir
+	case !f.isRegular():
+		return nil, nfs3ErrInval
+	}
+	fd, err := os.OpenFile(f.path, flag|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, nfsStatus(err)
+	}
+	return fd, nfs3OK
+}
+
+func (c *nfsCall) read(r *xdrReader, w *xdrWriter) uint32 {
+	h, offset, count := r.opaque(nfs3FHSize), r.uint64(), r.uint32()
+	if r.err != nil {
+		return rpcGarbageArgs
+	}
+	f, stat := c.resolve(h)
+	if stat != nfs3OK {
+		w.uint32(stat)
+		w.bool(false)
+		return rpcSuccess
+	}
+	if count > embeddedMaxIO {
+		count = embeddedMaxIO
+	}
+	var data []byte
+	eof := false
+	if !c.cred.may(f.st, permRead, true) {
+		stat = nfs3ErrAcces
+	} else if fd, s := openFile(f, os.O_RDONLY); s != nfs3OK {
+		stat = s
+	} else {
+		data = make([]byte, count)
+		n, err := fd.ReadAt(data, int64(offset))
+		fd.Close()
+		data = data[:n]
+		switch {
+		case err == io.EOF || offset+uint64(n) >= uint64(f.st.Size):
+			eof = true
+		case err != nil:
+			stat = nfsStatus(err)
+		}
+	}
+	w.uint32(stat)
+	c.postOpAttr(w, f.path)
+	if stat == nfs3OK {
+		w.uint32(uint32(len(data)))
+		w.bool(eof)
+		w.opaque(data)
+	}
+	return rpcSuccess
+}
+
+func (c *nfsCall) write(r *xdrReader, w *xdrWriter) uint32 {
+	h, offset, count, stable := r.opaque(nfs3FHSize), r.uint64(), r.uint32(), r.uint32()
+	data := r.opaque(embeddedMaxIO)
+	if r.err != nil {
+		return rpcGarbageArgs
+	}
+	if int(count) < len(data) {
+		data = data[:count]
+	}
+	f, stat := c.resolve(h)
+	if stat != nfs3OK {
+		w.uint32(stat)
+		(*wcc)(nil).write(c, w)
+		return rpcSuccess
+	}
+	committed := uint32(stableUnstable)
+	n := 0
+	switch {
+	case c.opts.readOnly:
+		stat = nfs3ErrROFS
+	case !c.cred.may(f.st, permWrite, true):
+		stat = nfs3ErrAcces
+	default:
+		fd, s := openFile(f, os.O_WRONLY)
+		if s != nfs3OK {
+			stat = s
+			break
+		}
+		var err error
+		n, err = fd.WriteAt(data, int64(offset))
+		if err == nil && stable != stableUnstable {
+			err = fd.Sync()
+			committed = stableFileSync
+		}
+		fd.Close()
+		if err != nil {
+			stat = nfsStatus(err)
+		}
+	}
+	w.uint32(stat)
+	f.wcc().write(c, w)
+	if stat == nfs3OK {
+		w.uint32(uint32(n))
+		w.uint32(committed)
+		w.fixed(c.e.verf[:])
+	}
+	return rpcSuccess
+}
+
+// startCreate resolves the directory a file is created in and checks the
+// caller may create it there
+func (c *nfsCall) startCreate(h []byte, name string) (*nfsFile, uint32) {
+	dir, stat := c.resolve(h)
+	if stat != nfs3OK {
+		return nil, stat
+	}
+	switch {
+	case c.opts.readOnly:
+		return dir, nfs3ErrROFS
+	case !dir.isDir():
+		return dir, nfs3ErrNotDir
+	case !c.cred.may(dir.st, permWrite|permExec, false):
+		return dir, nfs3ErrAcces
+	}
+	return dir, validName(name)
+}
+
+// writeCreated writes the result of creating a file
+func (c *nfsCall) writeCreated(w *xdrWriter, dir *nfsFile, pre *wcc, name string, stat uint32) {
+	var f *nfsFile
+	if stat == nfs3OK {
+		f, stat = c.child(dir, name)
+	}
+	w.uint32(stat)
+	if stat == nfs3OK {
+		w.bool(true)
+		w.opaque(f.fh[:])
+		w.bool(true)
+		writeFattr(w, f.st, c.x.id)
+	}
+	pre.write(c, w)
+}
+
+func (c *nfsCall) create(r *xdrReader, w *xdrWriter) uint32 {
+	h, name, how := r.opaque(nfs3FHSize), r.string(nfs3MaxPath), r.uint32()
+	var s *sattr
+	var verf []byte
+	switch how {
+	case createUnchecked, createGuarded:
+		s = readSattr(r)
+	case createExclusive:
+		verf = r.fixed(8)
+	default:
+		return rpcGarbageArgs
+	}
+	if r.err != nil {
+		return rpcGarbageArgs
+	}
+	dir, stat := c.startCreate(h, name)
+	var pre *wcc
+	if dir != nil {
+		pre = dir.wcc()
+	}
+	if stat == nfs3OK {
+		stat = c.createFile(dir, name, how, s, verf)
+	}
+	c.writeCreated(w, dir, pre, name, stat)
+	return rpcSuccess
+}
+
+func (c *nfsCall) createFile(dir *nfsFile, name string, how uint32, s *sattr, verf []byte) uint32 {
+	p := filepath.Join(dir.path, name)
+	mode := uint32(0644)
+	if s != nil && s.mode != nil {
+		mode = *s.mode & 07777
+	}
+	flag := os.O_WRONLY | os.O_CREATE | syscall.O_NOFOLLOW
+	if how != createUnchecked {
+		flag |= os.O_EXCL
+	}
+	existing, _ := lstat(p)
+	fd, err := os.OpenFile(p, flag, os.FileMode(mode))
+	if os.IsExist(err) && how == createExclusive {
+		// a retransmission of a create which succeeded
+		if existing != nil && uint32(existing.Atim.Sec) == binary.BigEndian.Uint32(verf[:4]) && uint32(existing.Mtim.Sec) == binary.BigEndian.Uint32(verf[4:]) {
+			return nfs3OK
+		}
+	}
+	if err != nil {
+		return nfsStatus(err)
+	}
+	fd.Close()
+	if existing != nil {
+		// an unchecked create of an existing file only sets its size
+		if s.size != nil {
+			return c.setattr(&nfsFile{path: p, st: existing}, &sattr{size: s.size})
+		}
+		return nfs3OK
+	}
+
+	if err := syscall.Chmod(p, mode); err != nil {
+		return nfsStatus(err)
+	}
+	if err := c.owned(dir, p); err != nil {
+		return nfsStatus(err)
+	}
+	if how == createExclusive {
+		// the verifier is kept in the times until the client sets them
+		ts := []unix.Timespec{{Sec: int64(binary.BigEndian.Uint32(verf[:4]))}, {Sec: int64(binary.BigEndian.Uint32(verf[4:]))}}
+		return nfsStatus(unix.UtimesNanoAt(unix.AT_FDCWD, p, ts, unix.AT_SYMLINK_NOFOLLOW))
+	}
+	return c.setCreated(p, s)
+}
+
+// setCreated applies the rest of the attributes a file was created with
+func (c *nfsCall) setCreated(p string, s *sattr) uint32 {
+	st, err := lstat(p)
+	if err != nil {
+		return nfsStatus(err)
+	}
+	rest := *s
+	rest.mode = nil
+	return c.setattr(&nfsFile{path: p, st: st}, &rest)
+}
+
+func (c *nfsCall) mkdir(r *xdrReader, w *xdrWriter) uint32 {
+	h, name := r.opaque(nfs3FHSize), r.string(nfs3MaxPath)
+	s := readSattr(r)
+	if r.err != nil {
+		return rpcGarbageArgs
+	}
+	dir, stat := c.startCreate(h, name)
+	var pre *wcc
+	if dir != nil {
+		pre = dir.wcc()
+	}
+	if stat == nfs3OK {
+		p := filepath.Join(dir.path, name)
+		mode := uint32(0755)
+		if s.mode != nil {
+			mode = *s.mode & 07777
+		}
+		if dir.st.Mode&syscall.S_ISGID != 0 {
+			mode |= syscall.S_ISGID
+		}
+		stat = nfsStatus(syscall.Mkdir(p, mode))
+		if stat == nfs3OK {
+			stat = nfsStatus(syscall.Chmod(p, mode))
+		}
+		if stat == nfs3OK {
+			stat = nfsStatus(c.owned(dir, p))
+		}
+		if stat == nfs3OK {
+			stat = c.setCreated(p, s)
+		}
+	}
+	c.writeCreated(w, dir, pre, name, stat)
+	return rpcSuccess
+}
+
+func (c *nfsCall) symlink(r *xdrReader, w *xdrWriter) uint32 {
+	h, name := r.opaque(nfs3FHSize), r.string(nfs3MaxPath)
+	s := readSattr(r)
+	target := r.string(nfs3MaxPath)
+	if r.err != nil {
+		return rpcGarbageArgs
+	}
+	dir, stat := c.startCreate(h, name)
+	var pre *wcc
+	if dir != nil {
+		pre = dir.wcc()
+	}
+	if stat == nfs3OK {
+		p := filepath.Join(dir.path, name)
+		stat = nfsStatus(os.Symlink(target, p))
+		if stat == nfs3OK {
+			stat = nfsStatus(c.owned(dir, p))
+		}
+		if stat == nfs3OK {
+			stat = c.setCreated(p, s)
+		}
+	}
+	c.writeCreated(w, dir, pre, name, stat)
+	return rpcSuccess
+}
+
+// mknod isn't supported, clients can't create devices, sockets or FIFOs
+func (c *nfsCall) mknod(r *xdrReader, w *xdrWriter) uint32 {
+	w.uint32(nfs3ErrNotSupp)
+	(*wcc)(nil).write(c, w)
+	return rpcSuccess
+}
+
+// mayDelete checks the caller may remove the file from the directory, only
+// owners may remove files from sticky directories
+func (c *nfsCall) mayDelete(dir *nfsFile, st *syscall.Stat_t) bool {
+	if !c.cred.may(dir.st, permWrite|permExec, false) {
+		return false
+	}
+	return dir.st.Mode&syscall.S_ISVTX == 0 || c.cred.uid == 0 || c.cred.uid == st.Uid || c.cred.uid == dir.st.Uid
+}
+
+func (c *nfsCall) remove(r *xdrReader, w *xdrWriter, rmdir bool) uint32 {
+	h, name := r.opaque(nfs3FHSize), r.string(nfs3MaxPath)
+	if r.err != nil {
+		return rpcGarbageArgs
+	}
+	dir, stat := c.startCreate(h, name)
+	var pre *wcc
+	if dir != nil {
+		pre = dir.wcc()
+	}
+	if stat == nfs3OK {
+		p := filepath.Join(dir.path, name)
+		st, err := lstat(p)
+		switch {
+		case err != nil:
+			stat = nfsStatus(err)
+		case !c.mayDelete(dir, st):
+			stat = nfs3ErrAcces
+		case rmdir:
+			stat = nfsStatus(syscall.Rmdir(p))
+		default:
+			stat = nfsStatus(syscall.Unlink(p))
+		}
+		if stat == nfs3OK {
+			c.e.handles.remove(makeHandle(c.x.id, st.Ino))
+		}
+	}
+	w.uint32(stat)
+	pre.write(c, w)
+	return rpcSuccess
+}
+
+func (c *nfsCall) rename(r *xdrReader, w *xdrWriter) uint32 {
+	fromH, fromName := r.opaque(nfs3FHSize), r.string(nfs3MaxPath)
+	toH, toName := r.opaque(nfs3FHSize), r.string(nfs3MaxPath)
+	if r.err != nil {
+		return rpcGarbageArgs
+	}
+	from, stat := c.startCreate(fromH, fromName)
+	var to *nfsFile
+	if stat == nfs3OK {
+		to, stat = c.startCreate(toH, toName)
+	}
+	var fromWcc, toWcc *wcc
+	if from != nil {
+		fromWcc = from.wcc()
+	}
+	if to != nil {
+		toWcc = to.wcc()
+	}
+	if stat == nfs3OK {
+		src, dst := filepath.Join(from.path, fromName), filepath.Join(to.path, toName)
+		st, err := lstat(src)
+		switch {
+		case err != nil:
+			stat = nfsStatus(err)
+		case !c.mayDelete(from, st):
+			stat = nfs3ErrAcces
+		default:
+			if existing, err := lstat(dst); err == nil && !c.mayDelete(to, existing) {
+				stat = nfs3ErrAcces
+				break
+			}
+			stat = nfsStatus(syscall.Rename(src, dst))
+		}
+		if stat == nfs3OK {
+			c.e.handles.rename(src, dst)
+		}
+	}
+	w.uint32(stat)
+	fromWcc.write(c, w)
+	toWcc.write(c, w)
+	return rpcSuccess
+}
+
+func (c *nfsCall) link(r *xdrReader, w *xdrWriter) uint32 {
+	h, dirH, name := r.opaque(nfs3FHSize), r.opaque(nfs3FHSize), r.string(nfs3MaxPath)
+	if r.err != nil {
+		return rpcGarbageArgs
+	}
+	f, stat := c.resolve(h)
+	if stat != nfs3OK {
+		w.uint32(stat)
+		w.bool(false)
+		(*wcc)(nil).write(c, w)
+		return rpcSuccess
+	}
+	dir, stat := c.startCreate(dirH, name)
+	var pre *wcc
+	if dir != nil {
+		pre = dir.wcc()
+	}
+	if stat == nfs3OK {
+		if f.isDir() {
+			stat = nfs3ErrIsDir
+		} else {
+			stat = nfsStatus(os.Link(f.path, filepath.Join(dir.path, name)))
+		}
+	}
+	w.uint32(stat)
+	c.postOpAttr(w, f.path)
+	pre.write(c, w)
+	return rpcSuccess
+}
+
+// readdir serves READDIR and READDIRPLUS. Cookies are positions in the
+// sorted directory listing, so entries created or removed between calls may
+// be skipped or listed twice.
+func (c *nfsCall) readdir(r *xdrReader, w *xdrWriter, plus bool) uint32 {
+	h, cookie := r.opaque(nfs3FHSize), r.uint64()
+	r.fixed(8)
+	dircount := r.uint32()
+	maxcount := dircount
+	if plus {
+		maxcount = r.uint32()
+	}
+	if r.err != nil {
+		return rpcGarbageArgs
+	}
+	start := len(w.b)
+	dir, stat := c.resolve(h)
+	if stat != nfs3OK {
+		w.uint32(stat)
+		w.bool(false)
+		return rpcSuccess
+	}
+	var names []string
+	switch {
+	case !dir.isDir():
+		stat = nfs3ErrNotDir
+	case !c.cred.may(dir.st, permRead, false):
+		stat = nfs3ErrAcces
+	default:
+		fd, err := os.Open(dir.path)
+		if err == nil {
+			names, err = fd.Readdirnames(-1)
+			fd.Close()
+		}
+		stat = nfsStatus(err)
+	}
+	w.uint32(stat)
+	c.postOpAttr(w, dir.path)
+	if stat != nfs3OK {
+		return rpcSuccess
+	}
+	sort.Strings(names)
+	w.fixed(make([]byte, 8))
+
+	// the results so far, the end of the list and eof
+	size := len(w.b) - start + 8
+	dirSize := 0
+	i := int(cookie)
+	if uint64(i) != cookie || i > len(names) {
+		i = len(names)
+	}
+	first := i
+	for ; i < len(names); i++ {
+		p := filepath.Join(dir.path, names[i])
+		st, err := lstat(p)
+		if err != nil {
+			continue
+		}
+		entry := &xdrWriter{}
+		entry.bool(true)
+		entry.uint64(st.Ino)
+		entry.string(names[i])
+		entry.uint64(uint64(i + 1))
+		dirSize += len(entry.b)
+		if plus {
+			fh := makeHandle(c.x.id, st.Ino)
+			entry.bool(true)
+			writeFattr(entry, st, c.x.id)
+			entry.bool(true)
+			entry.opaque(fh[:])
+			c.e.handles.put(fh, p)
+		}
+		if size+len(entry.b) > int(maxcount) || dirSize > int(dircount) {
+			break
+		}
+		size += len(entry.b)
+		w.b = append(w.b, entry.b...)
+	}
+	if i == first && i < len(names) {
+		// not even one entry fits, the results are replaced with an error
+		w.b = w.b[:start]
+		w.uint32(nfs3ErrTooSmall)
+		c.postOpAttr(w, dir.path)
+		return rpcSuccess
+	}
+	w.bool(false)
+	w.bool(i == len(names))
+	return rpcSuccess
+}
+
+func (c *nfsCall) fsstat(r *xdrReader, w *xdrWriter) uint32 {
+	h := r.opaque(nfs3FHSize)
+	if r.err != nil {
+		return rpcGarbageArgs
+	}
+	f, stat := c.resolve(h)
+	if stat != nfs3OK {
+		w.uint32(stat)
+		w.bool(false)
+		return rpcSuccess
+	}
+	var fs unix.Statfs_t
+	stat = nfsStatus(unix.Statfs(f.path, &fs))
+	w.uint32(stat)
+	w.bool(true)
+	writeFattr(w, f.st, c.x.id)
+	if stat == nfs3OK {
+		bsize := uint64(fs.Bsize)
+		w.uint64(fs.Blocks * bsize)
+		w.uint64(fs.Bfree * bsize)
+		w.uint64(fs.Bavail * bsize)
+		w.uint64(fs.Files)
+		w.uint64(fs.Ffree)
+		w.uint64(fs.Ffree)
+		w.uint32(0)
+	}
+	return rpcSuccess
+}
+
+func (c *nfsCall) fsinfo(r *xdrReader, w *xdrWriter) uint32 {
+	h := r.opaque(nfs3FHSize)
+	if r.err != nil {
+		return rpcGarbageArgs
+	}
+	f, stat := c.resolve(h)
+	w.uint32(stat)
+	if stat != nfs3OK {
+		w.bool(false)
+		return rpcSuccess
+	}
+	w.bool(true)
+	writeFattr(w, f.st, c.x.id)
+	for _, v := range []uint32{embeddedMaxIO, embeddedMaxIO, 4096, embeddedMaxIO, embeddedMaxIO, 4096, 64 << 10} {
+		w.uint32(v)
+	}
+	w.uint64(1<<63 - 1)
+	w.uint32(0)
+	w.uint32(1)
+	// links, symlinks, homogeneous, settable times
+	w.uint32(0x1 | 0x2 | 0x8 | 0x10)
+	return rpcSuccess
+}
+
+func (c *nfsCall) pathconf(r *xdrReader, w *xdrWriter) uint32 {
+	h := r.opaque(nfs3FHSize)
+	if r.err != nil {
+		return rpcGarbageArgs
+	}
+	f, stat := c.resolve(h)
+	w.uint32(stat)
+	if stat != nfs3OK {
+		w.bool(false)
+		return rpcSuccess
+	}
+	w.bool(true)
+	writeFattr(w, f.st, c.x.id)
+	w.uint32(32000)
+	w.uint32(nfs3MaxName)
+	// no_trunc, chown_restricted, case_insensitive, case_preserving
+	w.bool(true)
+	w.bool(true)
+	w.bool(false)
+	w.bool(true)
+	return rpcSuccess
+}
+
+func (c *nfsCall) commit(r *xdrReader, w *xdrWriter) uint32 {
+	h := r.opaque(nfs3FHSize)
+	r.uint64()
+	r.uint32()
+	if r.err != nil {
+		return rpcGarbageArgs
+	}
+	f, stat := c.resolve(h)
+	if stat != nfs3OK {
+		w.uint32(stat)
+		(*wcc)(nil).write(c, w)
+		return rpcSuccess
+	}
+	fd, stat := openFile(f, os.O_RDONLY)
+	if stat == nfs3OK {
+		stat = nfsStatus(fd.Sync())
+		fd.Close()
+	}
+	w.uint32(stat)
+	f.wcc().write(c, w)
+	if stat == nfs3OK {
+		w.fixed(c.e.verf[:])
+	}
+	return rpcSuccess
+}
+
+func (e *embeddedExporter) serveMount(req *rpcRequest, w *xdrWriter) uint32 {
+	r := req.args
+	client := req.addr.IP.String()
+	switch req.proc {
+	case 0:
+	case 1:
+		p := r.string(nfs3MaxPath)
+		if r.err != nil {
+			return rpcGarbageArgs
+		}
+		x := e.findExport(p)
+		if x == nil {
+			w.uint32(mnt3NoEnt)
+			return rpcSuccess
+		}
+		if opts := x.clientOptions(req.addr); opts == nil || !opts.allowed(req) {
+			w.uint32(mnt3Acces)
+			return rpcSuccess
+		}
+		st, err := lstat(x.path)
+		if err != nil {
+			w.uint32(nfsStatus(err))
+			return rpcSuccess
+		}
+		fh := makeHandle(x.id, st.Ino)
+		e.handles.put(fh, x.path)
+		e.mu.Lock()
+		if e.mounts[client] == nil {
+			e.mounts[client] = make(map[string]bool)
+		}
+		e.mounts[client][p] = true
+		e.mu.Unlock()
+		w.uint32(mnt3OK)
+		w.opaque(fh[:])
+		w.uint32(1)
+		w.uint32(authSys)
+	case 2:
+		e.mu.RLock()
+		for c, paths := range e.mounts {
+			for p := range paths {
+				w.bool(true)
+				w.string(c)
+				w.string(p)
+			}
+		}
+		e.mu.RUnlock()
+		w.bool(false)
+	case 3:
+		p := r.string(nfs3MaxPath)
+		if r.err != nil {
+			return rpcGarbageArgs
+		}
+		e.mu.Lock()
+		delete(e.mounts[client], p)
+		if len(e.mounts[client]) == 0 {
+			delete(e.mounts, client)
+		}
+		e.mu.Unlock()
+	case 4:
+		e.mu.Lock()
+		delete(e.mounts, client)
+		e.mu.Unlock()
+	case 5:
+		e.mu.RLock()
+		for _, x := range e.exports {
+			w.bool(true)
+			w.string(x.path)
+			for _, cl := range x.clients {
+				w.bool(true)
+				w.string(cl.host)
+			}
+			w.bool(false)
+		}
+		e.mu.RUnlock()
+		w.bool(false)
+	default:
+		return rpcProcUnavail
+	}
+	return rpcSuccess
+}
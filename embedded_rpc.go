@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// ONC RPC (RFC 5531) over TCP with XDR (RFC 4506) encoding, just enough of
+// it for the embedded NFS server: calls with AUTH_NONE or AUTH_SYS
+// credentials, served one at a time per connection.
+
+const (
+	rpcCall  = 0
+	rpcReply = 1
+
+	rpcMsgAccepted = 0
+	rpcMsgDenied   = 1
+
+	rpcSuccess      = 0
+	rpcProgUnavail  = 1
+	rpcProgMismatch = 2
+	rpcProcUnavail  = 3
+	rpcGarbageArgs  = 4
+
+	rpcMismatch  = 0
+	rpcAuthError = 1
+
+	authNone = 0
+	authSys  = 1
+
+	authBadCred = 1
+
+	// maxRPCRecord bounds the size of a call, large enough for the biggest
+	// write the server advertises
+	maxRPCRecord = embeddedMaxIO + 4096
+)
+
+var errXDR = errors.New("malformed XDR data")
+
+type xdrReader struct {
+	b   []byte
+	err error
+}
+
+func (r *xdrReader) fixed(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	padded := (n + 3) &^ 3
+	if n < 0 || padded > len(r.b) {
+		r.err = errXDR
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[padded:]
+	return b
+}
+
+func (r *xdrReader) uint32() uint32 {
+	b := r.fixed(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *xdrReader) uint64() uint64 {
+	b := r.fixed(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *xdrReader) bool() bool {
+	return r.uint32() != 0
+}
+
+// opaque reads variable length data of at most max bytes
+func (r *xdrReader) opaque(max int) []byte {
+	n := r.uint32()
+	if r.err == nil && n > uint32(max) {
+		r.err = errXDR
+	}
+	return r.fixed(int(n))
+}
+
+func (r *xdrReader) string(max int) string {
+	return string(r.opaque(max))
+}
+
+type xdrWriter struct {
+	b []byte
+}
+
+func (w *xdrWriter) uint32(v uint32) {
+	w.b = append(w.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (w *xdrWriter) uint64(v uint64) {
+	w.uint32(uint32(v >> 32))
+	w.uint32(uint32(v))
+}
+
+func (w *xdrWriter) bool(v bool) {
+	if v {
+		w.uint32(1)
+	} else {
+		w.uint32(0)
+	}
+}
+
+func (w *xdrWriter) fixed(b []byte) {
+	w.b = append(w.b, b...)
+	for i := len(b); i%4 != 0; i++ {
+		w.b = append(w.b, 0)
+	}
+}
+
+func (w *xdrWriter) opaque(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.fixed(b)
+}
+
+func (w *xdrWriter) string(s string) {
+	w.opaque([]byte(s))
+}
+
+// rpcCred is the caller's identity from its AUTH_SYS credentials
+type rpcCred struct {
+	uid, gid uint32
+	gids     []uint32
+}
+
+// rpcRequest is a decoded call
+type rpcRequest struct {
+	xid, prog, vers, proc uint32
+	// cred is nil for AUTH_NONE
+	cred *rpcCred
+	args *xdrReader
+	addr *net.TCPAddr
+}
+
+// rpcHandler serves a call, writing the results to w. It returns the accept
+// status, results are only sent with rpcSuccess.
+type rpcHandler func(req *rpcRequest, w *xdrWriter) uint32
+
+// rpcProgram is a version of an RPC program
+type rpcProgram struct {
+	prog, vers uint32
+	handler    rpcHandler
+}
+
+// rpcServer serves RPC programs over TCP
+type rpcServer struct {
+	programs []rpcProgram
+	l        net.Listener
+
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+func newRPCServer(l net.Listener, programs ...rpcProgram) *rpcServer {
+	return &rpcServer{l: l, programs: programs, conns: make(map[net.Conn]bool)}
+}
+
+func (s *rpcServer) serve() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		s.mu.Lock()
+		s.conns[c] = true
+		s.mu.Unlock()
+		go s.serveConn(c)
+	}
+}
+
+func (s *rpcServer) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	err := s.l.Close()
+	for c := range s.conns {
+		c.Close()
+	}
+	return err
+}
+
+func (s *rpcServer) serveConn(c net.Conn) {
+	defer func() {
+		c.Close()
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+	}()
+	addr, _ := c.RemoteAddr().(*net.TCPAddr)
+	br := bufio.NewReader(c)
+	for {
+		rec, err := readRecord(br)
+		if err != nil {
+			if err != io.EOF {
+				logrus.WithError(err).WithField("client", c.RemoteAddr().String()).Debug("error reading rpc call")
+			}
+			return
+		}
+		reply := s.handle(rec, addr)
+		if reply == nil {
+			continue
+		}
+		if _, err := c.Write(reply); err != nil {
+			return
+		}
+	}
+}
+
+// readRecord reads a record made of one or more fragments, each with a
+// header holding its length and whether it's the last one
+func readRecord(r io.Reader) ([]byte, error) {
+	var rec []byte
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, err
+		}
+		h := binary.BigEndian.Uint32(hdr[:])
+		n := int(h & 0x7fffffff)
+		if len(rec)+n > maxRPCRecord {
+			return nil, errors.New("rpc record too large")
+		}
+		frag := make([]byte, n)
+		if _, err := io.ReadFull(r, frag); err != nil {
+			return nil, err
+		}
+		rec = append(rec, frag...)
+		if h&0x80000000 != 0 {
+			return rec, nil
+		}
+	}
+}
+
+// handle decodes a call and returns the framed reply, nil when the record
+// isn't a call
+func (s *rpcServer) handle(rec []byte, addr *net.TCPAddr) []byte {
+	r := &xdrReader{b: rec}
+	req := &rpcRequest{xid: r.uint32(), addr: addr}
+	if r.uint32() != rpcCall || r.err != nil {
+		return nil
+	}
+
+	w := &xdrWriter{b: make([]byte, 4, 512)}
+	w.uint32(req.xid)
+	w.uint32(rpcReply)
+	if r.uint32() != 2 {
+		w.uint32(rpcMsgDenied)
+		w.uint32(rpcMismatch)
+		w.uint32(2)
+		w.uint32(2)
+		return frameRecord(w.b)
+	}
+	req.prog, req.vers, req.proc = r.uint32(), r.uint32(), r.uint32()
+	flavor, body := r.uint32(), r.opaque(400)
+	r.uint32()
+	r.opaque(400)
+	if r.err != nil {
+		return nil
+	}
+	switch flavor {
+	case authNone:
+	case authSys:
+		req.cred = parseAuthSys(body)
+	}
+	if flavor != authNone && req.cred == nil {
+		w.uint32(rpcMsgDenied)
+		w.uint32(rpcAuthError)
+		w.uint32(authBadCred)
+		return frameRecord(w.b)
+	}
+	req.args = r
+
+	w.uint32(rpcMsgAccepted)
+	w.uint32(authNone)
+	w.opaque(nil)
+	statAt := len(w.b)
+	w.uint32(rpcSuccess)
+
+	var low, high uint32
+	found := false
+	for _, p := range s.programs {
+		if p.prog != req.prog {
+			continue
+		}
+		if !found || p.vers < low {
+			low = p.vers
+		}
+		if !found || p.vers > high {
+			high = p.vers
+		}
+		found = true
+		if p.vers == req.vers {
+			stat := p.handler(req, w)
+			if stat != rpcSuccess {
+				w.b = w.b[:statAt]
+				w.uint32(stat)
+			}
+			return frameRecord(w.b)
+		}
+	}
+	w.b = w.b[:statAt]
+	if !found {
+		w.uint32(rpcProgUnavail)
+		return frameRecord(w.b)
+	}
+	w.uint32(rpcProgMismatch)
+	w.uint32(low)
+	w.uint32(high)
+	return frameRecord(w.b)
+}
+
+func parseAuthSys(body []byte) *rpcCred {
+	r := &xdrReader{b: body}
+	r.uint32()
+	r.string(255)
+	c := &rpcCred{uid: r.uint32(), gid: r.uint32()}
+	n := r.uint32()
+	if n > 16 {
+		return nil
+	}
+	for i := uint32(0); i < n; i++ {
+		c.gids = append(c.gids, r.uint32())
+	}
+	if r.err != nil {
+		return nil
+	}
+	return c
+}
+
+// frameRecord fills in the record marking header reserved at the start of
+// the reply, sending it as a single fragment
+func frameRecord(b []byte) []byte {
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4)|0x80000000)
+	return b
+}
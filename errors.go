@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/pkg/errors"
+)
+
+// codedError attaches an API error code and HTTP status to an error. It does
+// not implement causer so errors.Cause stops here even when wrapped.
+type codedError struct {
+	code    string
+	status  int
+	err     error
+	details interface{}
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func newError(status int, code, msg string) error {
+	return &codedError{code: code, status: status, err: errors.New(msg)}
+}
+
+func errInvalid(msg string) error {
+	return newError(http.StatusBadRequest, api.ErrCodeInvalidRequest, msg)
+}
+
+func errNotFound(msg string) error {
+	return newError(http.StatusNotFound, api.ErrCodeNotFound, msg)
+}
+
+func errAlreadyExists(msg string) error {
+	return newError(http.StatusConflict, api.ErrCodeAlreadyExists, msg)
+}
+
+func dbError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := errors.Cause(err).(*codedError); ok {
+		return err
+	}
+	return &codedError{code: api.ErrCodeDatabase, status: http.StatusInternalServerError, err: err}
+}
+
+// exportError marks a failure to apply exports. exportfs rejecting the
+// exports is reported as 422 along with its diagnostics.
+func exportError(err error) error {
+	if err == nil {
+		return nil
+	}
+	cause := errors.Cause(err)
+	if cause == context.DeadlineExceeded {
+		return errTimeout(err)
+	}
+	if c, ok := cause.(*commandError); ok {
+		return &codedError{code: api.ErrCodeExportFailed, status: http.StatusUnprocessableEntity, err: err, details: c.details()}
+	}
+	return &codedError{code: api.ErrCodeExportFailed, status: http.StatusInternalServerError, err: err}
+}
+
+// toErrorResponse maps an error to the status and body sent to clients
+func toErrorResponse(err error) (int, api.ErrorResponse) {
+	resp := api.ErrorResponse{Code: api.ErrCodeInternal, Message: err.Error()}
+	status := http.StatusInternalServerError
+
+	switch e := errors.Cause(err).(type) {
+	case *codedError:
+		resp.Code = e.code
+		resp.Details = e.details
+		status = e.status
+	case *validationError:
+		resp.Code = api.ErrCodeInvalidRequest
+		resp.Details = e
+		status = http.StatusBadRequest
+	}
+	if errors.Cause(err) == context.DeadlineExceeded {
+		resp.Code = api.ErrCodeTimeout
+		status = http.StatusGatewayTimeout
+	}
+	return status, resp
+}
+
+// errorCode returns the API error code of err, "" when it's nil
+func errorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	_, resp := toErrorResponse(err)
+	return resp.Code
+}
+
+// writeError sends the error to the client. Server side failures are logged
+// with the request id so they can be matched with what the client saw.
+func writeError(w http.ResponseWriter, err error) {
+	status, resp := toErrorResponse(err)
+	if status >= http.StatusInternalServerError {
+		logrus.WithField("request_id", w.Header().Get(requestIDHeader)).WithError(err).Error("request failed")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
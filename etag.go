@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/pkg/errors"
+)
+
+// A volume's ETag is a hash of its record, so it changes with every change
+// to the volume. Changes sent with If-Match are refused with 412 when the
+// volume changed since the client read it, so clients editing the same
+// volume don't overwrite each other's changes.
+
+const (
+	etagHeader    = "ETag"
+	ifMatchHeader = "If-Match"
+)
+
+func volumeETag(v *volume) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", errors.Wrap(err, "error marshaling volume data")
+	}
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`, nil
+}
+
+func errPreconditionFailed(msg string) error {
+	return newError(http.StatusPreconditionFailed, api.ErrCodePreconditionFailed, msg)
+}
+
+// checkIfMatch refuses the request when it has an If-Match header none of
+// whose ETags is the volume's. Weak ETags never match.
+func checkIfMatch(r *http.Request, v *volume) error {
+	return checkETag(r.Header.Get(ifMatchHeader), v)
+}
+
+// checkETag checks the volume against the ETags of an If-Match header
+func checkETag(h string, v *volume) error {
+	if h == "" {
+		return nil
+	}
+	etag, err := volumeETag(v)
+	if err != nil {
+		return err
+	}
+	for _, t := range strings.Split(h, ",") {
+		if t = strings.TrimSpace(t); t == "*" || t == etag {
+			return nil
+		}
+	}
+	return errPreconditionFailed("the volume changed since it was read, its ETag is now " + etag)
+}
+
+// setETag sets the ETag header of a response representing the volume
+func setETag(w http.ResponseWriter, v *volume) error {
+	etag, err := volumeETag(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set(etagHeader, etag)
+	return nil
+}
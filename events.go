@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	eventVolumeCreated   = "volume.created"
+	eventVolumeUpdated   = "volume.updated"
+	eventVolumeDeleted   = "volume.deleted"
+	eventVolumeRenamed   = "volume.renamed"
+	eventVolumeExpired   = "volume.expired"
+	eventSnapshotCreated = "snapshot.created"
+	eventIntegrityError  = "volume.integrity_error"
+	eventExportFailed    = "export.failed"
+	eventDaemonRestarted = "daemon.restarted"
+)
+
+// events fans out lifecycle events to everyone watching /events
+var events = &eventHub{subs: make(map[chan *Event]bool)}
+
+type Event struct {
+	Type    string
+	Volume  string `json:",omitempty"`
+	Time    time.Time
+	Message string      `json:",omitempty"`
+	Data    interface{} `json:",omitempty"`
+
+	// tenant limits who receives the event, volume events are only sent
+	// to the volume's tenant.
+	tenant string
+}
+
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan *Event]bool
+}
+
+func (h *eventHub) subscribe() chan *Event {
+	ch := make(chan *Event, 64)
+	h.mu.Lock()
+	h.subs[ch] = true
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan *Event) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+func (h *eventHub) publish(e *Event) {
+	e.Time = time.Now().UTC()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			// never let a slow client block the gateway
+			logrus.WithField("event", e.Type).Warn("event subscriber is not keeping up, dropping event")
+		}
+	}
+}
+
+// wanted reports whether a watcher of the tenant gets the event, types limit
+// the event types when set
+func (e *Event) wanted(tenant string, types map[string]bool) bool {
+	return e.tenant == tenant && (len(types) == 0 || types[e.Type])
+}
+
+// volumeEvent publishes an event about the volume with the given id
+func volumeEvent(typ, id string, data interface{}) {
+	events.publish(&Event{Type: typ, Volume: displayName(id), Data: data, tenant: volumeTenant(id)})
+}
+
+// watchEvents streams events as server-sent events. Clients can limit the
+// event types with a comma separated `type` parameter.
+func (g *gateway) watchEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, errInvalid("streaming is not supported on this connection"))
+		return
+	}
+	types := make(map[string]bool)
+	for _, t := range splitTokens(r.URL.Query().Get("type")) {
+		types[t] = true
+	}
+	tenant := requestTenant(r)
+
+	ch := events.subscribe()
+	defer events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case e := <-ch:
+			if !e.wanted(tenant, types) {
+				continue
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				logrus.WithError(err).Error("error marshaling event")
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, strings.TrimSpace(string(b)))
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// Volumes created with a TTL or ExpiresAt are deleted once they expire, like
+// a DELETE would, so their data goes to the trash when it's enabled. CI and
+// batch systems create lots of short-lived workspaces and don't always clean
+// up after themselves. Volumes still mounted by clients or with aliases are
+// left until those are gone.
+
+// expiry computes when a volume expires from a TTL or an ExpiresAt, at most
+// one of them may be set. It returns nil when neither is.
+func expiry(ttl string, expiresAt *time.Time, now time.Time) (*time.Time, error) {
+	switch {
+	case ttl != "" && expiresAt != nil:
+		return nil, errInvalid("only one of TTL and ExpiresAt may be set")
+	case ttl != "":
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return nil, &validationError{Field: "TTL", Value: ttl, Reason: "must be a positive duration, e.g. 24h"}
+		}
+		t := now.Add(d).UTC()
+		return &t, nil
+	case expiresAt != nil && !expiresAt.IsZero():
+		if !expiresAt.After(now) {
+			return nil, &validationError{Field: "ExpiresAt", Value: expiresAt.String(), Reason: "must be in the future"}
+		}
+		t := expiresAt.UTC()
+		return &t, nil
+	}
+	return nil, nil
+}
+
+type expiryReaper struct {
+	g *gateway
+	// deleting are the delete jobs submitted for expired volumes
+	deleting map[string]string
+}
+
+func (g *gateway) runExpiry(interval time.Duration) {
+	e := &expiryReaper{g: g, deleting: make(map[string]string)}
+	for {
+		if !g.maintenance.active() {
+			if err := e.reap(time.Now()); err != nil {
+				logrus.WithError(err).Error("error removing expired volumes")
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (e *expiryReaper) reap(now time.Time) error {
+	var expired []*volume
+	err := e.g.view(func(tx *bolt.Tx) error {
+		return forEachVolume(tx, func(data []byte) error {
+			var v volume
+			if err := json.Unmarshal(data, &v); err != nil {
+				return dbError(errors.Wrap(err, "error unmarshaling volume from database"))
+			}
+			if v.ExpiresAt != nil && !v.ExpiresAt.After(now) && v.Pending == "" {
+				expired = append(expired, &v)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, v := range expired {
+		log := logrus.WithField("volume", v.Name)
+		if id, ok := e.deleting[v.Name]; ok {
+			j, err := e.g.jobs.get(id)
+			if err == nil && j != nil && (j.Status == jobQueued || j.Status == jobRunning) {
+				continue
+			}
+			// finished jobs are pruned, a gone one is submitted again
+			if err == nil && j == nil {
+				delete(e.deleting, v.Name)
+			}
+		}
+		if err := e.g.checkInUse(v.Name); err != nil {
+			log.WithError(err).Debug("expired volume is still in use")
+			continue
+		}
+		if err := e.g.view(func(tx *bolt.Tx) error { return checkNoAliases(tx, v.Name) }); err != nil {
+			log.WithError(err).Debug("expired volume still has aliases")
+			continue
+		}
+		j, err := e.g.jobs.submit("", jobDeleteVolume, v.Name, deleteArgs{})
+		if err != nil {
+			log.WithError(err).Error("error deleting expired volume")
+			continue
+		}
+		e.deleting[v.Name] = j.ID
+		log.WithField("expired_at", v.ExpiresAt).Info("deleting expired volume")
+		volumeEvent(eventVolumeExpired, v.Name, map[string]interface{}{"ExpiresAt": v.ExpiresAt, "JobID": j.ID})
+	}
+	for name := range e.deleting {
+		found := false
+		for _, v := range expired {
+			found = found || v.Name == name
+		}
+		if !found {
+			delete(e.deleting, name)
+		}
+	}
+	return nil
+}
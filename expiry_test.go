@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// The delete job of a volume still waiting to be deleted may have been
+// pruned, which must submit a new one rather than crash the reaper.
+func TestReapPrunedJob(t *testing.T) {
+	g, cleanup := newTestGateway(t)
+	defer cleanup()
+	now := time.Now()
+	expired := now.Add(-time.Hour)
+	v := &volume{Name: "v", ExpiresAt: &expired}
+	if err := g.update(func(tx *bolt.Tx) error { return putVolume(tx, v) }); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &expiryReaper{g: g.gateway, deleting: map[string]string{"v": "pruned"}}
+	if err := e.reap(now); err != nil {
+		t.Fatal(err)
+	}
+	id := e.deleting["v"]
+	if id == "" || id == "pruned" {
+		t.Fatalf("no new delete job submitted, deleting %q", id)
+	}
+	if j, err := g.jobs.get(id); err != nil || j == nil || j.Type != jobDeleteVolume {
+		t.Fatalf("got job %+v, %v, want a delete job", j, err)
+	}
+}
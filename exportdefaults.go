@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+var exportDefaultsKey = []byte("export-defaults")
+
+// ExportDefaults are the export options every volume starts from. With Merge
+// set a volume's own options are layered over the defaults when it is
+// exported, otherwise the defaults are only copied to volumes created without
+// any options.
+type ExportDefaults struct {
+	Options string
+	Merge   bool
+}
+
+type ExportDefaultsUpdate struct {
+	Options *string
+	Merge   *bool
+}
+
+// optionGroups maps export options to the setting they control, so e.g. a
+// client's "ro" replaces a default "rw". Options with values are keyed by name.
+var optionGroups = map[string]string{
+	"rw":               "rw",
+	"ro":               "rw",
+	"sync":             "sync",
+	"async":            "sync",
+	"root_squash":      "root_squash",
+	"no_root_squash":   "root_squash",
+	"all_squash":       "all_squash",
+	"no_all_squash":    "all_squash",
+	"subtree_check":    "subtree_check",
+	"no_subtree_check": "subtree_check",
+	"secure":           "secure",
+	"insecure":         "secure",
+	"wdelay":           "wdelay",
+	"no_wdelay":        "wdelay",
+	"hide":             "hide",
+	"nohide":           "hide",
+	"crossmnt":         "crossmnt",
+	"nocrossmnt":       "crossmnt",
+	"acl":              "acl",
+	"no_acl":           "acl",
+	"secure_locks":     "secure_locks",
+	"insecure_locks":   "secure_locks",
+	"no_auth_nlm":      "secure_locks",
+	"auth_nlm":         "secure_locks",
+}
+
+func optionKey(o string) string {
+	if i := strings.Index(o, "="); i >= 0 {
+		return o[:i]
+	}
+	if k, ok := optionGroups[o]; ok {
+		return k
+	}
+	return o
+}
+
+// mergeOptions layers opts over defaults, options in opts replace any default
+// controlling the same setting.
+func mergeOptions(defaults, opts string) string {
+	set := make(map[string]bool)
+	var over []string
+	for _, o := range strings.Split(opts, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			set[optionKey(o)] = true
+			over = append(over, o)
+		}
+	}
+	var out []string
+	for _, o := range strings.Split(defaults, ",") {
+		if o = strings.TrimSpace(o); o != "" && !set[optionKey(o)] {
+			out = append(out, o)
+		}
+	}
+	return strings.Join(append(out, over...), ",")
+}
+
+func loadExportDefaults(db *bolt.DB) (*ExportDefaults, error) {
+	var d *ExportDefaults
+	err := db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(settingsBucket).Get(exportDefaultsKey)
+		if data == nil {
+			return nil
+		}
+		d = &ExportDefaults{}
+		return json.Unmarshal(data, d)
+	})
+	return d, dbError(errors.Wrap(err, "error reading export defaults"))
+}
+
+func (g *gateway) getExportDefaults() ExportDefaults {
+	g.settingsMu.RLock()
+	defer g.settingsMu.RUnlock()
+	return g.exportDefaults
+}
+
+func (g *gateway) setExportDefaults(d ExportDefaults) {
+	g.settingsMu.Lock()
+	g.exportDefaults = d
+	g.settingsMu.Unlock()
+}
+
+// createOptions are the options stored on a new volume
+func (g *gateway) createOptions(opts string) string {
+	if d := g.getExportDefaults(); opts == "" && !d.Merge {
+		return d.Options
+	}
+	return opts
+}
+
+// exportView returns the volume as it is handed to the exporter, with its
+// netgroups expanded and its options merged over the defaults when merging
+// is enabled.
+func (g *gateway) exportView(v *volume) *volume {
+	d := g.getExportDefaults()
+	merge := d.Merge && d.Options != ""
+	hosts, rules, expanded := g.expandHosts(v)
+	if !merge && !expanded {
+		return v
+	}
+	e := *v
+	e.Export.Hosts = hosts
+	e.Export.Access = rules
+	if merge {
+		e.Export.Options = mergeOptions(d.Options, v.Export.Options)
+	}
+	return &e
+}
+
+func (g *gateway) getExportDefaultsHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(g.getExportDefaults())
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+// updateExportDefaults stores new defaults, which take precedence over
+// -default-export-options from then on, and re-applies all exports with them.
+func (g *gateway) updateExportDefaults(w http.ResponseWriter, r *http.Request) {
+	var req ExportDefaultsUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	// the defaults are set by admins so the client option policy doesn't apply
+	if req.Options != nil {
+		if err := parseOptions(*req.Options); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	d := g.getExportDefaults()
+	if req.Options != nil {
+		d.Options = *req.Options
+	}
+	if req.Merge != nil {
+		d.Merge = *req.Merge
+	}
+	err := g.update(func(tx *bolt.Tx) error {
+		data, err := json.Marshal(d)
+		if err != nil {
+			return errors.Wrap(err, "error marshaling export defaults")
+		}
+		return dbError(errors.Wrap(tx.Bucket(settingsBucket).Put(exportDefaultsKey, data), "error writing export defaults"))
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	g.setExportDefaults(d)
+
+	if err := g.Reload(); err != nil {
+		writeError(w, err)
+		return
+	}
+	g.getExportDefaultsHandler(w, r)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/pkg/errors"
+)
+
+const exportsFilePrefix = "nfsg-"
+
+var exportsDir = "/etc/exports.d"
+
+// systemExportsFile holds the exports configured outside of the gateway
+var systemExportsFile = "/etc/exports"
+
+// exportSync applies the rendered export files to the kernel. Calls made in
+// quick succession are batched into a single `exportfs -ra`.
+var exportSync = &exportSyncer{delay: 100 * time.Millisecond, timeout: 2 * time.Minute}
+
+func exportsFile(name string) string {
+	return filepath.Join(exportsDir, exportsFilePrefix+fileSafeName(name)+".exports")
+}
+
+// renderExports renders the exports(5) entry for a volume. An empty result
+// means the volume should not be exported at all.
+func renderExports(v *volume) []byte {
+	if !v.Export.hasClients() {
+		return nil
+	}
+
+	opts := exportOptions(v)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# managed by nfs-rest-gateway, volume %q\n", v.Name)
+	buf.WriteString(quoteExportPath(v.Export.Path))
+	for _, h := range v.Export.Hosts {
+		buf.WriteByte(' ')
+		buf.WriteString(h)
+		if opts != "" {
+			buf.WriteString("(" + opts + ")")
+		}
+	}
+	for _, a := range v.Export.Access {
+		buf.WriteString(" " + a.Host + "(" + accessOptions(v, a) + ")")
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// accessOptions returns the options to export the volume to the host of an
+// access rule with, its options over the volume's
+func accessOptions(v *volume, a api.AccessRule) string {
+	opts := mergeOptions(exportOptions(v), a.Options)
+	if v.ReadOnly || v.Mirror {
+		return forceReadOnly(opts)
+	}
+	return withAccessMode(opts, a.Access)
+}
+
+// exportOptions returns the options to export the volume with, adding the
+// volume's fsid and security flavors unless the client supplied them.
+// Read-only volumes and mirrors are always exported ro.
+func exportOptions(v *volume) string {
+	opts := v.Export.Options
+	if v.ReadOnly || v.Mirror {
+		opts = forceReadOnly(opts)
+	}
+	if v.FSID != "" {
+		opts = addOption(opts, "fsid", v.FSID)
+	}
+	if len(v.Export.Security) > 0 {
+		opts = addOption(opts, "sec", strings.Join(v.Export.Security, ":"))
+	}
+	return opts
+}
+
+// addOption appends key=value to opts if key is not already set
+func addOption(opts, key, value string) string {
+	for _, o := range strings.Split(opts, ",") {
+		if strings.HasPrefix(strings.TrimSpace(o), key+"=") {
+			return opts
+		}
+	}
+	if opts != "" {
+		opts += ","
+	}
+	return opts + key + "=" + value
+}
+
+// forceReadOnly replaces any rw or ro option with ro
+func forceReadOnly(opts string) string {
+	return withAccessMode(opts, "ro")
+}
+
+// withAccessMode replaces any rw or ro option with mode
+func withAccessMode(opts, mode string) string {
+	var out []string
+	for _, o := range strings.Split(opts, ",") {
+		o = strings.TrimSpace(o)
+		if o == "" || o == "rw" || o == "ro" {
+			continue
+		}
+		out = append(out, o)
+	}
+	return strings.Join(append([]string{mode}, out...), ",")
+}
+
+func newFSID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "error generating fsid")
+	}
+	// random (version 4) uuid
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+func quoteExportPath(p string) string {
+	if strings.ContainsAny(p, " \t\"") {
+		return `"` + strings.Replace(p, `"`, `\"`, -1) + `"`
+	}
+	return p
+}
+
+func writeExports(v *volume) error {
+	data := renderExports(v)
+	if data == nil {
+		return removeExports(v.Name)
+	}
+
+	f := exportsFile(v.Name)
+	tmp := f + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrap(err, "error writing exports file")
+	}
+	if err := os.Rename(tmp, f); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "error writing exports file")
+	}
+	return nil
+}
+
+func removeExports(name string) error {
+	if err := os.Remove(exportsFile(name)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "error removing exports file")
+	}
+	return nil
+}
+
+// pruneExports removes managed export files for volumes not in known
+func pruneExports(known map[string]bool) error {
+	matches, err := filepath.Glob(filepath.Join(exportsDir, exportsFilePrefix+"*.exports"))
+	if err != nil {
+		return err
+	}
+	for _, m := range matches {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), exportsFilePrefix), ".exports")
+		if known[name] {
+			continue
+		}
+		if err := os.Remove(m); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "error removing stale exports file")
+		}
+	}
+	return nil
+}
+
+// exporter publishes volumes to NFS clients
+type exporter interface {
+	// export makes the current state of v visible to clients, giving up
+	// once ctx is done
+	export(ctx context.Context, v *volume) error
+	unexport(ctx context.Context, v *volume) error
+	// reload replaces all managed exports with the given volumes
+	reload(vols []*volume) error
+	shutdown() error
+	// ready checks that the nfs server is up and the exports are applied
+	ready() error
+}
+
+// kernelExporter drives the kernel nfsd through exportfs
+type kernelExporter struct{}
+
+// export renders the volume's exports and applies them, restoring the
+// previous file if exportfs rejects the new one.
+func (kernelExporter) export(ctx context.Context, v *volume) error {
+	prev, err := ioutil.ReadFile(exportsFile(v.Name))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "error reading exports file")
+	}
+
+	if err := writeExports(v); err != nil {
+		return err
+	}
+	if err := exportSync.sync(ctx); err != nil {
+		if prev != nil {
+			ioutil.WriteFile(exportsFile(v.Name), prev, 0644)
+		} else {
+			removeExports(v.Name)
+		}
+		// the request may be out of time, the previous exports are put back
+		// regardless
+		exportSync.sync(context.Background())
+		return errors.Wrap(err, "error making nfs export")
+	}
+	return nil
+}
+
+func (kernelExporter) unexport(ctx context.Context, v *volume) error {
+	if err := removeExports(v.Name); err != nil {
+		return err
+	}
+	return errors.Wrap(exportSync.sync(ctx), "error unexporting nfs dir")
+}
+
+func (kernelExporter) reload(vols []*volume) error {
+	known := make(map[string]bool, len(vols))
+	for _, v := range vols {
+		if err := writeExports(v); err != nil {
+			logrus.WithError(err).WithField("volume", v.Name).Error("error writing exports on reload")
+		}
+		known[fileSafeName(v.Name)] = true
+	}
+	if err := pruneExports(known); err != nil {
+		logrus.WithError(err).Error("error removing stale exports on reload")
+	}
+	return exportSync.sync(context.Background())
+}
+
+func (kernelExporter) shutdown() error {
+	ctx, cancel := exportSync.context()
+	defer cancel()
+	return runExportfs(ctx, "-ua")
+}
+
+func (kernelExporter) ready() error {
+	mounted, err := isMountpoint(nfsdProcDir)
+	if err != nil {
+		return errors.Wrap(err, "error checking nfsd filesystem")
+	}
+	if !mounted {
+		return errors.Errorf("nfsd filesystem is not mounted at %s", nfsdProcDir)
+	}
+	state, err := readNFSDState()
+	if err != nil {
+		return err
+	}
+	if state.Threads == 0 {
+		return errors.New("nfsd has no running threads")
+	}
+	if err := cmd("rpcinfo", "-t", "127.0.0.1", "mountd"); err != nil {
+		return errors.Wrap(err, "mountd is not answering")
+	}
+	return exportSync.status()
+}
+
+type exportSyncer struct {
+	delay time.Duration
+	// timeout is how long exportfs may run before it's killed, it's shared
+	// by all waiters so their own deadlines don't apply
+	timeout time.Duration
+
+	mu      sync.Mutex
+	pending []chan error
+	timer   *time.Timer
+
+	// runMu makes sure only one exportfs is running at a time
+	runMu sync.Mutex
+
+	applied bool
+	lastErr error
+}
+
+// sync schedules an `exportfs -ra` and waits for its result, or until ctx is
+// done
+func (s *exportSyncer) sync(ctx context.Context) error {
+	ch := make(chan error, 1)
+	s.mu.Lock()
+	s.pending = append(s.pending, ch)
+	if s.timer == nil {
+		s.timer = time.AfterFunc(s.delay, s.run)
+	}
+	s.mu.Unlock()
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "error waiting for exportfs")
+	}
+}
+
+func (s *exportSyncer) run() {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+
+	s.mu.Lock()
+	waiters := s.pending
+	s.pending = nil
+	s.timer = nil
+	s.mu.Unlock()
+
+	ctx, cancel := s.context()
+	err := runExportfs(ctx, "-ra")
+	cancel()
+	s.mu.Lock()
+	s.applied = true
+	s.lastErr = err
+	s.mu.Unlock()
+	for _, ch := range waiters {
+		ch <- err
+	}
+}
+
+// context bounds an exportfs run by the timeout
+func (s *exportSyncer) context() (context.Context, context.CancelFunc) {
+	if s.timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), s.timeout)
+}
+
+// status reports whether the last exportfs run applied the exports
+func (s *exportSyncer) status() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.applied {
+		return errors.New("exports have not been applied yet")
+	}
+	return errors.Wrap(s.lastErr, "last exportfs run failed")
+}
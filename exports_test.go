@@ -0,0 +1,165 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+)
+
+func TestRenderExports(t *testing.T) {
+	cases := []struct {
+		name string
+		v    volume
+		want string
+	}{
+		{
+			name: "no clients",
+			v:    volume{Name: "v", Export: nfsExport{Path: "/data/nfs/v", Options: "rw"}},
+		},
+		{
+			name: "hosts",
+			v: volume{Name: "v", FSID: "id", Export: nfsExport{
+				Path:    "/data/nfs/v",
+				Hosts:   []string{"10.0.0.1", "*.example.com"},
+				Options: "rw,sync",
+			}},
+			want: "# managed by nfs-rest-gateway, volume \"v\"\n" +
+				"/data/nfs/v 10.0.0.1(rw,sync,fsid=id) *.example.com(rw,sync,fsid=id)\n",
+		},
+		{
+			name: "hosts without options",
+			v:    volume{Name: "v", Export: nfsExport{Path: "/data/nfs/v", Hosts: []string{"h"}}},
+			want: "# managed by nfs-rest-gateway, volume \"v\"\n/data/nfs/v h\n",
+		},
+		{
+			name: "access rules",
+			v: volume{Name: "t/v", Export: nfsExport{
+				Path:    "/data/nfs/t/v",
+				Hosts:   []string{"h"},
+				Options: "rw",
+				Access: []api.AccessRule{
+					{Host: "@ro-hosts", Access: "ro"},
+					{Host: "10.0.0.0/8", Access: "rw", Options: "no_root_squash"},
+				},
+			}},
+			want: "# managed by nfs-rest-gateway, volume \"t/v\"\n" +
+				"/data/nfs/t/v h(rw) @ro-hosts(ro) 10.0.0.0/8(rw,no_root_squash)\n",
+		},
+		{
+			name: "read-only volume",
+			v: volume{Name: "v", ReadOnly: true, Export: nfsExport{
+				Path:    "/data/nfs/v",
+				Hosts:   []string{"h"},
+				Options: "rw",
+				Access:  []api.AccessRule{{Host: "a", Access: "rw"}},
+			}},
+			want: "# managed by nfs-rest-gateway, volume \"v\"\n/data/nfs/v h(ro) a(ro)\n",
+		},
+
+		{
+			name: "quoted path",
+			v:    volume{Name: "v", Export: nfsExport{Path: "/data/my vols/v", Hosts: []string{"h"}, Options: "ro"}},
+			want: "# managed by nfs-rest-gateway, volume \"v\"\n\"/data/my vols/v\" h(ro)\n",
+		},
+	}
+	for _, c := range cases {
+		if got := string(renderExports(&c.v)); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestExportOptions(t *testing.T) {
+	cases := []struct {
+		name string
+		v    volume
+		want string
+	}{
+		{name: "plain", v: volume{Export: nfsExport{Options: "rw,sync"}}, want: "rw,sync"},
+		{name: "fsid", v: volume{FSID: "id", Export: nfsExport{Options: "rw"}}, want: "rw,fsid=id"},
+		{name: "client fsid", v: volume{FSID: "id", Export: nfsExport{Options: "rw,fsid=1"}}, want: "rw,fsid=1"},
+		{name: "security", v: volume{Export: nfsExport{Options: "rw", Security: []string{"krb5", "krb5p"}}}, want: "rw,sec=krb5:krb5p"},
+		{name: "client security", v: volume{Export: nfsExport{Options: "sec=sys", Security: []string{"krb5"}}}, want: "sec=sys"},
+		{name: "read-only", v: volume{ReadOnly: true, Export: nfsExport{Options: "rw,sync"}}, want: "ro,sync"},
+		{name: "mirror", v: volume{Mirror: true, FSID: "id", Export: nfsExport{Options: "sync"}}, want: "ro,sync,fsid=id"},
+		{name: "empty", v: volume{}, want: ""},
+	}
+	for _, c := range cases {
+		if got := exportOptions(&c.v); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestAccessOptions(t *testing.T) {
+	cases := []struct {
+		name string
+		v    volume
+		rule api.AccessRule
+		want string
+	}{
+		{
+			name: "volume options",
+			v:    volume{Export: nfsExport{Options: "rw,sync"}},
+			rule: api.AccessRule{Access: "ro"},
+			want: "ro,sync",
+		},
+		{
+			name: "rule options win",
+			v:    volume{FSID: "id", Export: nfsExport{Options: "rw,root_squash"}},
+			rule: api.AccessRule{Access: "rw", Options: "no_root_squash"},
+			want: "rw,fsid=id,no_root_squash",
+		},
+		{
+			name: "read-only volume",
+			v:    volume{ReadOnly: true, Export: nfsExport{Options: "rw"}},
+			rule: api.AccessRule{Access: "rw", Options: "rw"},
+			want: "ro",
+		},
+		{
+			name: "mirror",
+			v:    volume{Mirror: true},
+			rule: api.AccessRule{Access: "rw"},
+			want: "ro",
+		},
+	}
+	for _, c := range cases {
+		if got := accessOptions(&c.v, c.rule); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestWithAccessMode(t *testing.T) {
+	cases := []struct {
+		opts, mode, want string
+	}{
+		{"", "rw", "rw"},
+		{"rw", "ro", "ro"},
+		{"ro,sync", "rw", "rw,sync"},
+		{"sync, rw ,no_subtree_check", "ro", "ro,sync,no_subtree_check"},
+		{"rw,ro", "ro", "ro"},
+		{",,sync,", "rw", "rw,sync"},
+	}
+	for _, c := range cases {
+		if got := withAccessMode(c.opts, c.mode); got != c.want {
+			t.Errorf("withAccessMode(%q, %q) = %q, want %q", c.opts, c.mode, got, c.want)
+		}
+	}
+}
+
+func TestQuoteExportPath(t *testing.T) {
+	cases := []struct {
+		path, want string
+	}{
+		{"/data/nfs/v", "/data/nfs/v"},
+		{"/data/my vol", `"/data/my vol"`},
+		{"/data/tab\tvol", "\"/data/tab\tvol\""},
+		{`/data/"q"`, `"/data/\"q\""`},
+	}
+	for _, c := range cases {
+		if got := quoteExportPath(c.path); got != c.want {
+			t.Errorf("quoteExportPath(%q) = %q, want %q", c.path, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// GET /volume/{name}/files lets dashboards look at a volume's contents
+// without mounting it. Paths are walked one directory at a time relative to
+// the previous one without following symlinks, so neither a symlink in the
+// volume nor one swapped in by a client meanwhile can lead outside of it.
+
+const (
+	defaultFilesLimit = 100
+	maxFilesLimit     = 1000
+)
+
+func (g *gateway) listFiles(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	q := r.URL.Query()
+	p := path.Clean("/" + q.Get("path"))
+	if strings.ContainsRune(p, 0) {
+		writeError(w, &validationError{Field: "path", Value: p, Reason: "must not contain NUL"})
+		return
+	}
+	limit := defaultFilesLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxFilesLimit {
+			writeError(w, &validationError{Field: "limit", Value: s, Reason: fmt.Sprintf("must be between 1 and %d", maxFilesLimit)})
+			return
+		}
+		limit = n
+	}
+
+	v, err := g.lookup(scopedName(r, name))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp, err := browse(v.Export.Path, p, q.Get("after"), limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+// browse stats p in the volume rooted at root, listing up to limit entries
+// named after after when it's a directory
+func browse(root, p, after string, limit int) (*api.FileList, error) {
+	dir, err := unix.Open(root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening volume dir")
+	}
+	defer unix.Close(dir)
+
+	base := "."
+	if p != "/" {
+		elems := strings.Split(p[1:], "/")
+		for _, elem := range elems[:len(elems)-1] {
+			fd, err := unix.Openat(dir, elem, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+			if err != nil {
+				return nil, browseError(p, err)
+			}
+			unix.Close(dir)
+			dir = fd
+		}
+		base = elems[len(elems)-1]
+	}
+
+	info, err := statAt(dir, base)
+	if err != nil {
+		return nil, browseError(p, err)
+	}
+	info.Name = path.Base(p)
+	resp := &api.FileList{Path: p, File: *info}
+	if info.Type != api.FileTypeDir {
+		return resp, nil
+	}
+
+	fd, err := unix.Openat(dir, base, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, browseError(p, err)
+	}
+	f := os.NewFile(uintptr(fd), p)
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading directory")
+	}
+	sort.Strings(names)
+	i := sort.SearchStrings(names, after)
+	if i < len(names) && names[i] == after {
+		i++
+	}
+	resp.Entries = []api.FileInfo{}
+	for ; i < len(names) && len(resp.Entries) < limit; i++ {
+		info, err := statAt(fd, names[i])
+		if err != nil {
+			// removed while listing
+			continue
+		}
+		info.Name = names[i]
+		resp.Entries = append(resp.Entries, *info)
+	}
+	if i < len(names) {
+		resp.Next = resp.Entries[len(resp.Entries)-1].Name
+	}
+	return resp, nil
+}
+
+// statAt stats the file in dir without following it if it's a symlink
+func statAt(dir int, name string) (*api.FileInfo, error) {
+	fd, err := unix.Openat(dir, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return nil, err
+	}
+	info := &api.FileInfo{
+		Size:    st.Size,
+		Mode:    fmt.Sprintf("%04o", st.Mode&07777),
+		Uid:     st.Uid,
+		Gid:     st.Gid,
+		ModTime: time.Unix(st.Mtim.Sec, st.Mtim.Nsec).UTC(),
+	}
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFREG:
+		info.Type = api.FileTypeFile
+	case unix.S_IFDIR:
+		info.Type = api.FileTypeDir
+	case unix.S_IFLNK:
+		info.Type = api.FileTypeSymlink
+		buf := make([]byte, unix.PathMax)
+		if n, err := unix.Readlinkat(fd, "", buf); err == nil {
+			info.Target = string(buf[:n])
+		}
+	default:
+		info.Type = api.FileTypeOther
+	}
+	return info, nil
+}
+
+func browseError(p string, err error) error {
+	switch err {
+	case unix.ENOENT:
+		return errNotFound("no such file or directory: " + p)
+	case unix.ENOTDIR, unix.ELOOP:
+		return &validationError{Field: "path", Value: p, Reason: "goes through a file or symlink"}
+	case unix.EACCES:
+		return errInvalid("permission denied: " + p)
+	}
+	return errors.Wrap(err, "error reading volume")
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	ganeshaDest        = "org.ganesha.nfsd"
+	ganeshaExportMgr   = "/org/ganesha/nfsd/ExportMgr"
+	ganeshaExportIface = "org.ganesha.nfsd.exportmgr."
+	// export ids 0 and 1 are used by ganesha for the pseudo root
+	ganeshaFirstExportID = 2
+)
+
+var exportIDRe = regexp.MustCompile(`Export_Id\s*=\s*(\d+)\s*;`)
+
+// ganeshaExporter manages NFS-Ganesha exports through its D-Bus interface.
+// Each volume gets its own config file holding a single EXPORT block.
+type ganeshaExporter struct {
+	configDir string
+	mu        sync.Mutex
+}
+
+func (e *ganeshaExporter) configFile(name string) string {
+	return filepath.Join(e.configDir, exportsFilePrefix+fileSafeName(name)+".conf")
+}
+
+func (e *ganeshaExporter) export(ctx context.Context, v *volume) error {
+	if !v.Export.hasClients() {
+		return e.unexport(ctx, v)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	id, existing, err := e.exportID(v.Name)
+	if err != nil {
+		return err
+	}
+	f := e.configFile(v.Name)
+	prev, _ := ioutil.ReadFile(f)
+	if err := ioutil.WriteFile(f, renderGaneshaExport(v, id), 0644); err != nil {
+		return errors.Wrap(err, "error writing ganesha export config")
+	}
+
+	method := "AddExport"
+	if existing {
+		method = "UpdateExport"
+	}
+	if err := ganeshaExportCall(ctx, method, "string:"+f, fmt.Sprintf("string:EXPORT(Export_Id=%d)", id)); err != nil {
+		if prev != nil {
+			ioutil.WriteFile(f, prev, 0644)
+		} else {
+			os.Remove(f)
+		}
+		return exportError(errors.Wrap(err, "error making nfs export"))
+	}
+	return nil
+}
+
+func (e *ganeshaExporter) unexport(ctx context.Context, v *volume) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.remove(ctx, e.configFile(v.Name))
+}
+
+func (e *ganeshaExporter) remove(ctx context.Context, f string) error {
+	id, ok, err := readExportID(f)
+	if err != nil || !ok {
+		return err
+	}
+	if err := ganeshaExportCall(ctx, "RemoveExport", fmt.Sprintf("uint16:%d", id)); err != nil {
+		return exportError(errors.Wrap(err, "error unexporting nfs dir"))
+	}
+	if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "error removing ganesha export config")
+	}
+	return nil
+}
+
+func (e *ganeshaExporter) reload(vols []*volume) error {
+	known := make(map[string]bool, len(vols))
+	for _, v := range vols {
+		known[e.configFile(v.Name)] = true
+		if err := e.export(context.Background(), v); err != nil {
+			logrus.WithError(err).WithField("volume", v.Name).Error("error exporting volume on reload")
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	files, err := e.managedFiles()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if known[f] {
+			continue
+		}
+		if err := e.remove(context.Background(), f); err != nil {
+			logrus.WithError(err).WithField("config", f).Error("error removing stale ganesha export")
+		}
+	}
+	return nil
+}
+
+func (e *ganeshaExporter) shutdown() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	files, err := e.managedFiles()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		id, ok, err := readExportID(f)
+		if err != nil || !ok {
+			continue
+		}
+		// leave the config in place so the export is restored on the next start
+		if err := ganeshaExportCall(context.Background(), "RemoveExport", fmt.Sprintf("uint16:%d", id)); err != nil {
+			logrus.WithError(err).WithField("config", f).Error("error removing ganesha export")
+		}
+	}
+	return nil
+}
+
+func (e *ganeshaExporter) ready() error {
+	return errors.Wrap(ganeshaExportCall(context.Background(), "ShowExports"), "ganesha is not answering")
+}
+
+func (e *ganeshaExporter) managedFiles() ([]string, error) {
+	return filepath.Glob(filepath.Join(e.configDir, exportsFilePrefix+"*.conf"))
+}
+
+// exportID returns the export id already assigned to the volume, or
+// allocates the lowest free one.
+func (e *ganeshaExporter) exportID(name string) (uint16, bool, error) {
+	id, ok, err := readExportID(e.configFile(name))
+	if err != nil || ok {
+		return id, ok, err
+	}
+
+	files, err := e.managedFiles()
+	if err != nil {
+		return 0, false, err
+	}
+	used := make(map[uint16]bool, len(files))
+	for _, f := range files {
+		if id, ok, _ := readExportID(f); ok {
+			used[id] = true
+		}
+	}
+	for id := uint16(ganeshaFirstExportID); id != 0; id++ {
+		if !used[id] {
+			return id, false, nil
+		}
+	}
+	return 0, false, errors.New("no free ganesha export ids")
+}
+
+func readExportID(f string) (uint16, bool, error) {
+	data, err := ioutil.ReadFile(f)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, false, nil
+		}
+		return 0, false, errors.Wrap(err, "error reading ganesha export config")
+	}
+	m := exportIDRe.FindSubmatch(data)
+	if m == nil {
+		return 0, false, nil
+	}
+	id, err := strconv.ParseUint(string(m[1]), 10, 16)
+	return uint16(id), err == nil, errors.Wrap(err, "invalid ganesha export id")
+}
+
+// renderGaneshaExport translates the volume's exports(5) style options into
+// a ganesha FSAL_VFS EXPORT block. Access rules get a CLIENT block each.
+func renderGaneshaExport(v *volume, id uint16) []byte {
+	access, squash, extra := ganeshaOptions(exportOptions(v))
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# managed by nfs-rest-gateway, volume %q\n", v.Name)
+	buf.WriteString("EXPORT {\n")
+	fmt.Fprintf(&buf, "\tExport_Id = %d;\n", id)
+	fmt.Fprintf(&buf, "\tPath = %q;\n", v.Export.Path)
+	fmt.Fprintf(&buf, "\tPseudo = %q;\n", "/"+v.Name)
+	buf.WriteString("\tAccess_Type = NONE;\n")
+	fmt.Fprintf(&buf, "\tSquash = %s;\n", squash)
+	for _, x := range extra {
+		buf.WriteString("\t" + x + "\n")
+	}
+	buf.WriteString("\tFSAL {\n\t\tName = VFS;\n\t}\n")
+	if len(v.Export.Hosts) > 0 {
+		buf.WriteString("\tCLIENT {\n")
+		fmt.Fprintf(&buf, "\t\tClients = %s;\n", strings.Join(v.Export.Hosts, ", "))
+		fmt.Fprintf(&buf, "\t\tAccess_Type = %s;\n", access)
+		buf.WriteString("\t}\n")
+	}
+	for _, a := range v.Export.Access {
+		access, squash, extra := ganeshaOptions(accessOptions(v, a))
+		buf.WriteString("\tCLIENT {\n")
+		fmt.Fprintf(&buf, "\t\tClients = %s;\n", a.Host)
+		fmt.Fprintf(&buf, "\t\tAccess_Type = %s;\n", access)
+		fmt.Fprintf(&buf, "\t\tSquash = %s;\n", squash)
+		for _, x := range extra {
+			buf.WriteString("\t\t" + x + "\n")
+		}
+		buf.WriteString("\t}\n")
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// ganeshaOptions translates exports(5) style options into a ganesha access
+// type, squash and any other settings
+func ganeshaOptions(opts string) (access, squash string, extra []string) {
+	access = "RO"
+	squash = "root_squash"
+	for _, opt := range strings.Split(opts, ",") {
+		kv := strings.SplitN(strings.TrimSpace(opt), "=", 2)
+		switch kv[0] {
+		case "rw":
+			access = "RW"
+		case "ro":
+			access = "RO"
+		case "root_squash", "no_root_squash", "all_squash":
+			squash = kv[0]
+		case "anonuid":
+			if len(kv) == 2 {
+				extra = append(extra, "Anonymous_uid = "+kv[1]+";")
+			}
+		case "anongid":
+			if len(kv) == 2 {
+				extra = append(extra, "Anonymous_gid = "+kv[1]+";")
+			}
+		case "sec":
+			if len(kv) == 2 {
+				extra = append(extra, "SecType = "+strings.Replace(kv[1], ":", ", ", -1)+";")
+			}
+		}
+	}
+	return access, squash, extra
+}
+
+func ganeshaExportCall(ctx context.Context, method string, args ...string) error {
+	dbusArgs := append([]string{
+		"--system", "--print-reply", "--dest=" + ganeshaDest,
+		ganeshaExportMgr, ganeshaExportIface + method,
+	}, args...)
+	return cmdContext(ctx, "dbus-send", dbusArgs...)
+}
+
+func setupGanesha(configFile, exportsDir string) error {
+	if err := os.MkdirAll(exportsDir, 0755); err != nil {
+		return errors.Wrap(err, "error creating ganesha exports dir")
+	}
+	if _, err := exec.LookPath("dbus-send"); err != nil {
+		return errors.Wrap(err, "could not find required binary 'dbus-send'")
+	}
+
+	ganesha, err := exec.LookPath("ganesha.nfsd")
+	if err != nil {
+		return errors.Wrap(err, "could not find required binary 'ganesha.nfsd'")
+	}
+	daemons.start("ganesha.nfsd", ganesha, "-F", "-f", configFile)
+	return nil
+}
@@ -1,264 +1,1118 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 )
 
 var volumesBucket = []byte("volumes")
 
+// dbBuckets are the top level buckets, created on startup
+var dbBuckets = [][]byte{volumesBucket, snapshotsBucket, jobsBucket, trashBucket, settingsBucket, backupsBucket, policiesBucket, tenantsBucket, quotasBucket, webhooksBucket, idempotencyBucket, netgroupsBucket, poolsBucket, integrityBucket, rbacBucket, smbSharesBucket, templatesBucket}
+
 type gateway struct {
 	root string
 	db   *bolt.DB
-	mu   sync.Mutex
+	auth *tokenAuth
+	// rbac holds the roles of the API tokens
+	rbac *rbac
+	// locks serializes changes to each volume, keyed by name, so the data
+	// and exports of a volume aren't worked on by two requests at once
+	locks keyedLocks
+	// admin guards the /debug endpoints
+	admin   adminToken
+	jobs    *jobManager
+	usage   *usageCollector
+	ioStats *ioStatsCollector
+
+	trashRetention time.Duration
+	// maxUploadSize limits the data extracted from uploads to a volume
+	maxUploadSize int64
+	// preserveExports leaves the volumes exported on shutdown unless the
+	// gateway is decommissioned, which closes decommission
+	preserveExports  bool
+	decommission     chan struct{}
+	decommissionOnce sync.Once
+
+	// reloadConfig re-reads the reloadable settings, see reloadableSettings
+	reloadConfig func() error
+
+	settingsMu     sync.RWMutex
+	exportDefaults ExportDefaults
+	// netgroups are the members of each netgroup by id
+	netgroups map[string][]string
+	// quotas are the storage limits of tenants in bytes
+	quotas map[string]int64
+
+	exporter exporter
+	storage  storage
+	// s3 stores volume backups, nil when backups aren't configured
+	s3 *s3Client
+	// grpcChain runs gRPC calls through the API's middleware, see grpc.go
+	grpcChain http.Handler
+	// importPaths are the directories existing data may be imported from
+	importPaths []string
+
+	reconciler reconciler
+	// mirror shares metadata with other gateways, nil with -metadata-store=bolt
+	mirror *storeMirror
+	// pools are the data roots volumes are placed in
+	pools *poolSet
+	// limits throttles API clients
+	limits *limiter
+	// timeouts bound how long API requests may take
+	timeouts *requestTimeouts
+	// maintenance makes the API read-only while it's active
+	maintenance maintenance
+	// smb shares volumes with Samba too, nil unless -smb is set
+	smb *smbSharer
+	// preflight is the result of the startup checks, see preflight.go
+	preflight *PreflightReport
 }
 
 type nfsExport struct {
-	Path    string
-	Hosts   []string
-	Options string
+	Path     string
+	Hosts    []string
+	Options  string
+	Security []string          `json:",omitempty"`
+	Labels   map[string]string `json:",omitempty"`
+	// Access are the rules granting single hosts access with their own
+	// options
+	Access []api.AccessRule `json:",omitempty"`
+}
+
+// hasClients reports whether the export is granted to any host, exports
+// without any aren't applied
+func (e *nfsExport) hasClients() bool {
+	return len(e.Hosts) > 0 || len(e.Access) > 0
 }
 
 type volume struct {
 	Name   string
 	Export nfsExport
-}
-
-type CreateRequest struct {
-	Hosts   []string
-	Options string
-}
-
-type CreateResponse struct {
-	Name string
-	Path string
+	// Pool is the pool the volume's data was placed in, "" for the default
+	Pool string      `json:",omitempty"`
+	Loop *loopDevice `json:",omitempty"`
+	// Project is set when the volume's size is enforced with a project quota
+	Project *projectQuota `json:",omitempty"`
+	// Dataset is the zfs dataset holding the volume's data
+	Dataset string `json:",omitempty"`
+	// Subvolume is set when the volume is a btrfs subvolume
+	Subvolume bool `json:",omitempty"`
+	// SizeBytes is the size limit enforced by the storage backend
+	SizeBytes int64 `json:",omitempty"`
+	// Pending is the id of the job still populating the volume's data
+	Pending string `json:",omitempty"`
+	// FSID is a stable uuid identifying the export to clients regardless
+	// of the underlying device
+	FSID   string            `json:",omitempty"`
+	Labels map[string]string `json:",omitempty"`
+	// Imported volumes export a pre-existing directory whose data is
+	// left in place when the volume is deleted
+	Imported bool `json:",omitempty"`
+	// Source is the directory bind mounted at the export path, its data is
+	// also left in place
+	Source string `json:",omitempty"`
+	// ReadOnly volumes are exported ro regardless of their options
+	ReadOnly bool `json:",omitempty"`
+	// Mirror volumes are read-only copies of a volume replicated from
+	// another gateway until they are promoted
+	Mirror bool `json:",omitempty"`
+	// Replication is set when the volume is replicated to another gateway
+	Replication *replication `json:",omitempty"`
+	Description string       `json:",omitempty"`
+	// Protocols are the protocols the volume is shared with, nil for NFS
+	// only
+	Protocols []string `json:",omitempty"`
+	// Template is the template the volume was created from
+	Template string `json:",omitempty"`
+	// ExpiresAt is when the volume is deleted, see expiry.go
+	ExpiresAt *time.Time `json:",omitempty"`
+	// Subexports export subdirectories of the volume, see subexports.go
+	Subexports []api.Subexport `json:",omitempty"`
+	// AliasOf is the id of the volume whose data the volume exports, its
+	// Source is that volume's export path, see alias.go
+	AliasOf string `json:",omitempty"`
+	// Status is the volume's lifecycle status, see status.go
+	Status       string `json:",omitempty"`
+	StatusReason string `json:",omitempty"`
+	// Uid, Gid and Mode are the owner and permissions the volume's root was
+	// created with, applied again when a repair recreates it
+	Uid  *uint32 `json:",omitempty"`
+	Gid  *uint32 `json:",omitempty"`
+	Mode string  `json:",omitempty"`
+	// CreatedBy is the principal which created the volume
+	CreatedBy string     `json:",omitempty"`
+	CreatedAt *time.Time `json:",omitempty"`
+	UpdatedAt *time.Time `json:",omitempty"`
 }
 
 func (g *gateway) createVolume(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, errInvalid(err.Error()))
 		return
 	}
 	name := r.URL.Query().Get("name")
 	if name == "" {
-		http.Error(w, "must supply a name parameter", http.StatusBadRequest)
+		writeError(w, errInvalid("must supply a name parameter"))
 		return
 	}
 
-	var req CreateRequest
+	var req api.CreateRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, errors.Wrap(err, "error decoding request").Error(), http.StatusBadRequest)
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
 		return
 	}
+	v, err := g.createScoped(r.Context(), name, req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := api.CreateResponse{
+		Name: displayName(v.Name),
+		Path: v.Export.Path,
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+// createScoped creates the volume for the request ctx belongs to, name is
+// the name in its tenant and must be in its token's scope
+func (g *gateway) createScoped(ctx context.Context, name string, req api.CreateRequest) (*volume, error) {
+	if err := checkContextScope(ctx, name, req.Labels); err != nil {
+		return nil, err
+	}
+	return g.create(ctx, volumeID(contextTenant(ctx), name), req)
+}
+
+// create provisions a new volume and exports it
+func (g *gateway) create(ctx context.Context, name string, req api.CreateRequest) (*volume, error) {
+	return g.provision(ctx, name, req, "")
+}
+
+// provision creates a volume, pending is the job still populating it if any
+func (g *gateway) provision(ctx context.Context, name string, req api.CreateRequest, pending string) (*volume, error) {
+	if err := g.validateCreate(name, &req); err != nil {
+		return nil, err
+	}
+	v, err := g.addVolume(ctx, name, req, pending, true)
+	if err != nil {
+		return nil, err
+	}
+	volumeEvent(eventVolumeCreated, v.Name, nil)
+	return v, nil
+}
+
+// validateCreate checks the request and fills in its defaults
+func (g *gateway) validateCreate(name string, req *api.CreateRequest) error {
+	if err := validateName(displayName(name)); err != nil {
+		return err
+	}
+	if err := validateTenant(volumeTenant(name)); err != nil {
+		return err
+	}
+	if err := g.applyTemplate(req); err != nil {
+		return err
+	}
+	if req.SizeBytes < 0 {
+		return errInvalid("SizeBytes must not be negative")
+	}
+	if req.SizeBytes > maxSizeBytes {
+		return errInvalid("SizeBytes must not be more than 1 EiB")
+	}
+	if req.FSType == "" {
+		req.FSType = defaultLoopFSType
+	}
+	if _, ok := mkfsArgs[req.FSType]; !ok {
+		return errInvalid("unsupported FSType: " + req.FSType)
+	}
+	if err := validateSecurity(req.Security); err != nil {
+		return err
+	}
+	if err := validateOptions(req.Options); err != nil {
+		return err
+	}
+	if err := validateHosts(req.Hosts); err != nil {
+		return err
+	}
+	if err := validateLabels(req.Labels); err != nil {
+		return err
+	}
+	if err := validateDescription(req.Description); err != nil {
+		return err
+	}
+	if err := g.validateProtocols(req.Protocols); err != nil {
+		return err
+	}
+	expiresAt, err := expiry(req.TTL, req.ExpiresAt, time.Now())
+	if err != nil {
+		return err
+	}
+	req.TTL, req.ExpiresAt = "", expiresAt
+	if req.Mode != "" {
+		if _, err := parseMode(req.Mode); err != nil {
+			return err
+		}
+	}
+	if req.AnonUid != nil && hasOption(req.Options, "anonuid") {
+		return &validationError{Field: "AnonUid", Reason: "conflicts with anonuid in Options"}
+	}
+	if req.AnonGid != nil && hasOption(req.Options, "anongid") {
+		return &validationError{Field: "AnonGid", Reason: "conflicts with anongid in Options"}
+	}
+	if err := validateOptions(anonOptions(*req)); err != nil {
+		return err
+	}
+	if req.SecurityLabel {
+		if err := validateOptions("security_label"); err != nil {
+			return err
+		}
+	}
+	if req.AliasOf != "" {
+		if err := validateAlias(req); err != nil {
+			return err
+		}
+	}
+	if req.Source != "" {
+		if req.SizeBytes > 0 {
+			return errInvalid("SizeBytes can't be used with Source")
+		}
+		// the directory is someone else's, it keeps its owner
+		if req.Uid != nil || req.Gid != nil || req.Mode != "" {
+			return errInvalid("Uid, Gid and Mode can't be used with Source")
+		}
+		p, err := g.resolveImportPath("Source", req.Source)
+		if err != nil {
+			return err
+		}
+		req.Source = p
+	}
+	if req.Pool != "" {
+		// a requested pool is only checked, nothing is placed yet
+		if _, err := g.pools.place(req.Pool); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// addVolume provisions the storage of a validated request and stores the
+// volume. It is only exported when export is set, otherwise that's left to
+// the caller.
+func (g *gateway) addVolume(ctx context.Context, name string, req api.CreateRequest, pending string, export bool) (*volume, error) {
+	pool, err := g.pools.place(req.Pool)
+	if err != nil {
+		return nil, err
+	}
+
+	locked := []string{name}
+	if req.AliasOf != "" {
+		locked = append(locked, aliasID(name, req))
+	}
+	defer g.locks.lock(locked...)()
 	var v *volume
-	err := g.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(volumesBucket)
-		data := b.Get([]byte(name))
-		if data != nil {
-			return nil
+	err = g.updateUndo(ctx, name, func(tx *bolt.Tx, u *undoLog) error {
+		if getVolumeData(tx, name) != nil {
+			return errAlreadyExists("already exists")
+		}
+		var aliasOf string
+		if req.AliasOf != "" {
+			target, err := aliasTarget(ctx, tx, name, req)
+			if err != nil {
+				return err
+			}
+			// the alias shares the volume's data, it doesn't conflict with it
+			aliasOf, pool, req.Source = target.Name, target.Pool, target.Export.Path
+		} else if req.Source != "" {
+			if err := checkPathConflict(tx, req.Source); err != nil {
+				return err
+			}
+		}
+		if err := g.checkTenantConflict(tx, name); err != nil {
+			return err
+		}
+		if err := g.checkQuota(tx, volumeTenant(name), req.SizeBytes); err != nil {
+			return err
 		}
 
+		status := api.VolumeAvailable
+		if pending != "" || !export {
+			status = api.VolumeCreating
+		}
 		v = &volume{
-			Name: name,
+			Name:   name,
+			Status: status,
+			Pool:   pool,
 			Export: nfsExport{
-				Hosts:   req.Hosts,
-				Path:    g.nfsPath(name),
-				Options: req.Options,
+				Hosts:    req.Hosts,
+				Path:     g.nfsPath(pool, name),
+				Options:  req.Options,
+				Security: req.Security,
 			},
+			Labels:      req.Labels,
+			ReadOnly:    req.ReadOnly,
+			Mirror:      req.Mirror,
+			SizeBytes:   req.SizeBytes,
+			Pending:     pending,
+			Description: req.Description,
+			Protocols:   req.Protocols,
+			Template:    req.Template,
+			ExpiresAt:   req.ExpiresAt,
+			AliasOf:     aliasOf,
+			Uid:         req.Uid,
+			Gid:         req.Gid,
+			Mode:        req.Mode,
 		}
+		setCreated(ctx, v)
+		v.Export.Options = mergeOptions(g.createOptions(v.Export.Options), anonOptions(req))
+		if req.SecurityLabel {
+			v.Export.Options = setFlagOption(v.Export.Options, "security_label", true)
+		}
+		fsid, err := newFSID()
+		if err != nil {
+			return err
+		}
+		v.FSID = fsid
 
-		vb, err := json.Marshal(v)
+		// create may fail part way, e.g. after making the volume dir
+		u.add("destroy storage", func() error { return g.storage.destroy(v) })
+		_, s := startSpan(ctx, "storage.create", spanKindInternal)
+		err = g.storage.create(tx, v, req)
+		s.finish(err)
 		if err != nil {
-			return errors.Wrap(err, "error marshaling volume data")
+			return err
 		}
-		if err := b.Put([]byte(name), vb); err != nil {
-			return errors.Wrap(err, "error writing volume to database")
+		if err := setOwnership(v.Export.Path, req); err != nil {
+			return err
 		}
-
-		if err := os.MkdirAll(v.Export.Path, 0755); err != nil {
-			return errors.Wrap(err, "error creating volume dir")
+		if req.Source == "" {
+			if err := labelVolume(v.Export.Path); err != nil {
+				return err
+			}
 		}
 
-		if err := exportfs(v); err != nil {
+		if err := putVolume(tx, v); err != nil {
 			return err
 		}
+		if tenant := volumeTenant(name); tenant != "" {
+			if _, err := g.updateQuota(tx, tenant); err != nil {
+				return err
+			}
+		}
 
-		return nil
+		if !export {
+			return nil
+		}
+		u.add("unexport", func() error { return g.unexport(context.Background(), v) })
+		_, s = startSpan(ctx, "export", spanKindInternal)
+		err = g.export(ctx, v)
+		s.finish(err)
+		return err
 	})
-
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+	return v, nil
+}
+
+// sizeLimit is the volume's size limit, 0 when it can use all free space
+func (v *volume) sizeLimit() int64 {
+	// volumes created before SizeBytes was recorded only have it on the image
+	if v.SizeBytes == 0 && v.Loop != nil {
+		return v.Loop.SizeBytes
+	}
+	return v.SizeBytes
+}
+
+func (g *gateway) nfsPath(pool, name string) string {
+	return filepath.Join(g.poolRoot(pool), "nfs", name)
+}
+
+func (g *gateway) getVolume(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, errInvalid(err.Error()))
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if name == "" {
+		writeError(w, errInvalid("name parameter must be set"))
+		return
+	}
+	if err := validateName(name); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	if v == nil {
-		http.Error(w, "already exists", http.StatusConflict)
+	vol, err := g.lookup(scopedName(r, name))
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	resp := CreateResponse{
-		Name: v.Name,
-		Path: v.Export.Path,
+	resp := api.GetResponse{
+		Name:        displayName(vol.Name),
+		Path:        vol.Export.Path,
+		Labels:      vol.Labels,
+		ReadOnly:    vol.ReadOnly,
+		Mirror:      vol.Mirror,
+		Pool:        vol.Pool,
+		Description: vol.Description,
+		Protocols:   vol.protocols(),
+		Template:    vol.Template,
+		ExpiresAt:   vol.ExpiresAt,
+		AliasOf:     displayName(vol.AliasOf),
+		CreatedBy:   vol.CreatedBy,
+		CreatedAt:   vol.CreatedAt,
+		UpdatedAt:   vol.UpdatedAt,
+	}
+	resp.Status, resp.StatusReason = vol.status()
+	if vol.Replication != nil {
+		resp.Replication = &vol.Replication.Replication
+	}
+	err = g.view(func(tx *bolt.Tx) (err error) {
+		resp.Aliases, err = aliasNames(tx, vol.Name)
+		return err
+	})
+	if err != nil {
+		writeError(w, err)
+		return
 	}
+	if resp.ETag, err = volumeETag(vol); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set(etagHeader, resp.ETag)
 	b, err := json.Marshal(resp)
 	if err != nil {
-		http.Error(w, errors.Wrap(err, "error marshaling response").Error(), http.StatusInternalServerError)
+		writeError(w, errors.Wrap(err, "error marshaling response"))
 		return
 	}
 	w.Write(b)
 }
 
-func (g *gateway) nfsPath(name string) string {
-	return filepath.Join(g.root, "nfs", name)
+// lookup returns the stored volume, or a not found error
+func (g *gateway) lookup(name string) (*volume, error) {
+	var vol *volume
+	err := g.view(func(tx *bolt.Tx) error {
+		data := getVolumeData(tx, name)
+		if data == nil {
+			return errNotFound("volume not found")
+		}
+		var v volume
+		if err := json.Unmarshal(data, &v); err != nil {
+			return dbError(errors.Wrap(err, "error unmarshaling volume data from database"))
+		}
+		vol = &v
+		return nil
+	})
+	if err != nil {
+		return nil, dbError(err)
+	}
+	return vol, nil
 }
 
-type GetResponse struct {
-	Name string
-	Path string
+// list returns all stored volumes of all tenants
+func (g *gateway) list() ([]*volume, error) {
+	var vols []*volume
+	err := g.view(func(tx *bolt.Tx) error {
+		return forEachVolume(tx, func(v []byte) error {
+			var vol volume
+			if err := json.Unmarshal(v, &vol); err != nil {
+				return dbError(errors.Wrap(err, "error unmarshaling volume from database"))
+			}
+			vols = append(vols, &vol)
+			return nil
+		})
+	})
+	return vols, dbError(err)
 }
 
-func (g *gateway) getVolume(w http.ResponseWriter, r *http.Request) {
+func (g *gateway) deleteVolume(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, errInvalid(err.Error()))
 		return
 	}
 	name := mux.Vars(r)["name"]
 	if name == "" {
-		http.Error(w, "name parameter must be set", http.StatusBadRequest)
+		writeError(w, errInvalid("must provide name parameter"))
+		return
+	}
+	if err := validateName(name); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	var vol *volume
-	err := g.db.View(func(tx *bolt.Tx) error {
-		data := tx.Bucket(volumesBucket).Get([]byte(name))
+	j, err := g.queueDelete(r.Context(), scopedName(r, name), r.Header.Get(ifMatchHeader), r.Form.Get("force") == "true")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if j != nil {
+		writeJob(w, j)
+	}
+}
+
+// queueDelete submits the job deleting the volume, ifMatch is the request's
+// If-Match header and force deletes it even while clients have it mounted.
+// There's no job when the volume doesn't exist.
+func (g *gateway) queueDelete(ctx context.Context, name, ifMatch string, force bool) (*job, error) {
+	var v *volume
+	err := g.view(func(tx *bolt.Tx) error {
+		data := getVolumeData(tx, name)
 		if data == nil {
 			return nil
 		}
-		var v volume
-		if err := json.Unmarshal(data, &v); err != nil {
-			return errors.Wrap(err, "error unmarshaling volume data from database")
+		v = &volume{}
+		return json.Unmarshal(data, v)
+	})
+	if err != nil {
+		return nil, dbError(errors.Wrap(err, "error reading from database"))
+	}
+	if v == nil {
+		if ifMatch != "" {
+			return nil, errPreconditionFailed("the volume doesn't exist")
+		}
+		return nil, nil
+	}
+	if err := checkETag(ifMatch, v); err != nil {
+		return nil, err
+	}
+	if err := g.view(func(tx *bolt.Tx) error { return checkNoAliases(tx, name) }); err != nil {
+		return nil, err
+	}
+	if !force {
+		if err := g.checkInUse(name); err != nil {
+			return nil, err
+		}
+	}
+
+	// the volume shows as deleting while the job is queued
+	status, reason := v.status()
+	if err := g.lockedStatus(name, func(v *volume) bool { return v.setStatus(api.VolumeDeleting, "") }); err != nil {
+		return nil, err
+	}
+	j, err := g.jobs.submit(contextRequestID(ctx), jobDeleteVolume, name, deleteArgs{Force: force})
+	if err != nil {
+		g.lockedStatus(name, func(v *volume) bool { return v.setStatus(status, reason) })
+		return nil, err
+	}
+	return j, nil
+}
+
+const jobDeleteVolume = "delete-volume"
+
+type deleteArgs struct {
+	// Force revokes the access of clients which still have the volume mounted
+	Force bool
+}
+
+// removeVolume tears down a volume. The export is removed first, then the
+// data, and only then the database record so a failed or interrupted delete
+// can simply be run again. The volume is deleting until then, or error when
+// the delete fails.
+func (g *gateway) removeVolume(name string, force bool, progress func(string)) (retErr error) {
+	defer g.locks.lock(name)()
+	if err := g.updateStatus(name, func(v *volume) bool { return v.setStatus(api.VolumeDeleting, "") }); err != nil {
+		return err
+	}
+	defer func() {
+		if retErr == nil {
+			return
+		}
+		err := g.updateStatus(name, func(v *volume) bool { return v.setStatus(api.VolumeError, "delete failed: "+retErr.Error()) })
+		if err != nil {
+			logrus.WithError(err).WithField("volume", name).Error("error recording failed delete")
+		}
+	}()
+
+	var v *volume
+	err := g.update(func(tx *bolt.Tx) error {
+		data := getVolumeData(tx, name)
+		if data == nil {
+			return nil
+		}
+		v = &volume{}
+		if err := json.Unmarshal(data, v); err != nil {
+			return dbError(errors.Wrap(err, "error unmarshaling volume from database"))
+		}
+		if err := checkNoAliases(tx, v.Name); err != nil {
+			return err
+		}
+
+		progress("unexporting")
+		if err := g.unexport(context.Background(), v); err != nil {
+			return err
+		}
+		if force {
+			progress("revoking client access")
+			g.revokeClients(v)
+		}
+		if err := tx.Bucket(policiesBucket).Delete([]byte(v.Name)); err != nil {
+			return dbError(errors.Wrap(err, "error deleting policy from database"))
+		}
+		if err := tx.Bucket(integrityBucket).Delete([]byte(v.Name)); err != nil {
+			return dbError(errors.Wrap(err, "error deleting integrity report from database"))
+		}
+		progress("removing snapshots")
+		return deleteSnapshots(tx, v.Name)
+	})
+	if err != nil || v == nil {
+		return err
+	}
+
+	var trashed *trashEntry
+	if v.Imported {
+		progress("leaving imported data in place")
+	} else if v.Source != "" {
+		progress("unmounting source")
+		if err := g.storage.destroy(v); err != nil {
+			return err
+		}
+	} else if g.trashRetention > 0 {
+		progress("moving data to trash")
+		trashed, err = g.moveToTrash(v)
+		if err != nil {
+			return err
+		}
+	} else {
+		progress("removing data")
+		if err := g.storage.destroy(v); err != nil {
+			return err
+		}
+	}
+	g.removeReplicationData(v)
+	if err := os.Remove(g.manifestPath(v.Name)); err != nil && !os.IsNotExist(err) {
+		logrus.WithError(err).WithField("volume", v.Name).Warn("error removing checksum manifest")
+	}
+
+	err = g.update(func(tx *bolt.Tx) error {
+		if trashed != nil {
+			if err := putTrashEntry(tx, trashed); err != nil {
+				return err
+			}
+		}
+		if err := deleteVolumeData(tx, v.Name); err != nil {
+			return err
+		}
+		if tenant := volumeTenant(v.Name); tenant != "" {
+			_, err := g.updateQuota(tx, tenant)
+			return err
 		}
-		vol = &v
 		return nil
 	})
-	if err != nil {
-		http.Error(w, errors.Wrap(err, "error reading from database").Error(), http.StatusInternalServerError)
-		return
+	if err == nil {
+		volumeEvent(eventVolumeDeleted, v.Name, nil)
 	}
+	return err
+}
 
-	if vol == nil {
-		http.Error(w, "volume not found", http.StatusNotFound)
+func (g *gateway) updateVolume(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, errInvalid(err.Error()))
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if name == "" {
+		writeError(w, errInvalid("must provide name parameter"))
+		return
+	}
+	if err := validateName(name); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	resp := GetResponse{
-		Name: vol.Name,
-		Path: vol.Export.Path,
+	var req api.UpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
 	}
-	b, err := json.Marshal(resp)
+
+	v, err := g.patchVolume(r.Context(), scopedName(r, name), r.Header.Get(ifMatchHeader), req)
 	if err != nil {
-		http.Error(w, errors.Wrap(err, "error marshaling response").Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
-	w.Write(b)
+
+	writeUpdateResponse(w, v)
 }
 
-func (g *gateway) deleteVolume(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+// patchVolume changes the fields of the volume set in the request, ifMatch
+// is the request's If-Match header
+func (g *gateway) patchVolume(ctx context.Context, name, ifMatch string, req api.UpdateRequest) (*volume, error) {
+	return g.modifyVolume(ctx, name, func(v *volume) error {
+		if err := checkETag(ifMatch, v); err != nil {
+			return err
+		}
+		if v.Mirror {
+			return errMirror()
+		}
+		if req.Hosts != nil {
+			if err := validateHosts(*req.Hosts); err != nil {
+				return err
+			}
+			v.Export.Hosts = *req.Hosts
+			if err := checkRuleHosts(v); err != nil {
+				return err
+			}
+		}
+		if req.Options != nil {
+			if err := validateOptions(*req.Options); err != nil {
+				return err
+			}
+			v.Export.Options = *req.Options
+		}
+		if req.SecurityLabel != nil {
+			if *req.SecurityLabel {
+				if err := validateOptions("security_label"); err != nil {
+					return err
+				}
+			}
+			v.Export.Options = setFlagOption(v.Export.Options, "security_label", *req.SecurityLabel)
+		}
+		if req.Security != nil {
+			if err := validateSecurity(*req.Security); err != nil {
+				return err
+			}
+			v.Export.Security = *req.Security
+		}
+		if req.Labels != nil {
+			if err := validateLabels(*req.Labels); err != nil {
+				return err
+			}
+			// a scoped token can't move a volume out of its scope
+			if err := checkContextScope(ctx, displayName(name), *req.Labels); err != nil {
+				return err
+			}
+			v.Labels = *req.Labels
+		}
+		if req.ReadOnly != nil {
+			v.ReadOnly = *req.ReadOnly
+		}
+		if req.Description != nil {
+			if err := validateDescription(*req.Description); err != nil {
+				return err
+			}
+			v.Description = *req.Description
+		}
+		if req.Protocols != nil {
+			if err := g.validateProtocols(*req.Protocols); err != nil {
+				return err
+			}
+			v.Protocols = *req.Protocols
+		}
+		if req.TTL != nil || req.ExpiresAt != nil {
+			var ttl string
+			if req.TTL != nil {
+				ttl = *req.TTL
+			}
+			expiresAt, err := expiry(ttl, req.ExpiresAt, time.Now())
+			if err != nil {
+				return err
+			}
+			v.ExpiresAt = expiresAt
+		}
+		return nil
+	})
+}
+
+func writeUpdateResponse(w http.ResponseWriter, v *volume) {
+	if err := setETag(w, v); err != nil {
+		writeError(w, err)
 		return
 	}
-	name := mux.Vars(r)["name"]
-	if name == "" {
-		http.Error(w, "must provide name parameter", http.StatusBadRequest)
+	resp := api.UpdateResponse{
+		Name:        displayName(v.Name),
+		Path:        v.Export.Path,
+		Hosts:       v.Export.Hosts,
+		Options:     v.Export.Options,
+		Security:    v.Export.Security,
+		Labels:      v.Labels,
+		ReadOnly:    v.ReadOnly,
+		Mirror:      v.Mirror,
+		Description: v.Description,
+		Protocols:   v.protocols(),
+		ExpiresAt:   v.ExpiresAt,
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
 		return
 	}
+	w.Write(b)
+}
 
-	err := g.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(volumesBucket)
-		data := b.Get([]byte(name))
+// modifyVolume applies fn to the stored volume, persists the result and
+// re-applies its export, all within a single transaction. The previous export
+// is restored when that fails.
+func (g *gateway) modifyVolume(ctx context.Context, name string, fn func(*volume) error) (*volume, error) {
+	return g.modifyVolumeTx(ctx, name, func(_ *bolt.Tx, _ *undoLog, v *volume) error {
+		return fn(v)
+	})
+}
+
+// errUnchanged is returned by modifyVolumeTx functions which left the
+// volume as it was, it's then neither stored nor exported again
+var errUnchanged = errors.New("volume unchanged")
+
+// modifyVolumeTx is modifyVolume for changes which need the transaction or
+// have side effects of their own to undo
+func (g *gateway) modifyVolumeTx(ctx context.Context, name string, fn func(*bolt.Tx, *undoLog, *volume) error) (*volume, error) {
+	defer g.locks.lock(name)()
+	var v *volume
+	changed := true
+	err := g.updateUndo(ctx, name, func(tx *bolt.Tx, u *undoLog) error {
+		data := getVolumeData(tx, name)
 		if data == nil {
-			return nil
+			return errNotFound("volume not found")
 		}
 
-		if err := b.Delete([]byte(name)); err != nil {
-			errors.Wrap(err, "error deleting entry from the database")
+		v = &volume{}
+		if err := json.Unmarshal(data, v); err != nil {
+			return dbError(errors.Wrap(err, "error unmarshaling volume from database"))
 		}
 
-		var v volume
-		if err := json.Unmarshal(data, &v); err != nil {
-			return errors.Wrap(err, "error unmarshaling volume from database")
+		if err := fn(tx, u, v); err == errUnchanged {
+			changed = false
+			return nil
+		} else if err != nil {
+			return err
 		}
+		// the change is only stored if the export is applied
+		v.markExported()
 
-		if err := unexport(&v); err != nil {
+		if err := putVolume(tx, v); err != nil {
 			return err
 		}
-		if err := os.RemoveAll(v.Export.Path); err != nil && !os.IsNotExist(err) {
-			return errors.Wrap(err, "error removing volume data")
-		}
-		return nil
+
+		// data is only valid during the transaction
+		prev := append([]byte(nil), data...)
+		u.add("restore export", func() error { return g.restoreExport(prev, v) })
+		return g.export(ctx, v)
 	})
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		volumeEvent(eventVolumeUpdated, v.Name, nil)
+	}
+	return v, nil
+}
 
+// restoreExport re-applies the export of the stored volume data prev after a
+// failed change to v, removing subexports v added
+func (g *gateway) restoreExport(prev []byte, v *volume) error {
+	old := &volume{}
+	if err := json.Unmarshal(prev, old); err != nil {
+		return errors.Wrap(err, "error unmarshaling volume")
+	}
+	for _, s := range v.Subexports {
+		if _, ok := findSubexport(old, s.ID); !ok {
+			if err := g.exporter.unexport(context.Background(), subexportView(v, s)); err != nil {
+				return err
+			}
+		}
+	}
+	return g.export(context.Background(), old)
+}
+
+// export applies the volume's export, publishing an event when that fails
+func (g *gateway) export(ctx context.Context, v *volume) error {
+	view := g.exportView(v)
+	err := g.exporter.export(ctx, view)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		events.publish(&Event{Type: eventExportFailed, Volume: displayName(v.Name), Message: err.Error(), tenant: volumeTenant(v.Name)})
+		return err
+	}
+	if g.smb != nil {
+		g.smb.share(view)
 	}
+	return g.exportSubexports(ctx, v)
 }
 
-func exportfs(v *volume) error {
-	var args []string
-	for _, h := range v.Export.Hosts {
-		if v.Export.Options != "" {
-			args = append(args, "-o", v.Export.Options)
+// unexport removes the volume's export and its SMB share
+func (g *gateway) unexport(ctx context.Context, v *volume) error {
+	for _, s := range v.Subexports {
+		if err := g.exporter.unexport(ctx, subexportView(v, s)); err != nil {
+			return err
 		}
-		args = append(args, h+":"+v.Export.Path)
 	}
-	return errors.Wrap(cmd(exportfsPath, args...), "error making nfs export")
+	if err := g.exporter.unexport(ctx, v); err != nil {
+		return err
+	}
+	if g.smb != nil {
+		g.smb.unshare(v)
+	}
+	return nil
 }
 
-func (*gateway) Shutdown() {
-	err := cmd(exportfsPath, "-ua")
+func (g *gateway) Shutdown() {
+	decommissioned := false
+	select {
+	case <-g.decommission:
+		decommissioned = true
+	default:
+	}
+	if g.preserveExports && !decommissioned {
+		logrus.Info("leaving the volumes exported for the next start")
+		return
+	}
+	err := g.exporter.shutdown()
 	if err != nil {
 		logrus.WithError(err).Error("error during shutdown")
 	}
+	if g.smb != nil {
+		if err := g.smb.shutdown(); err != nil {
+			logrus.WithError(err).Error("error removing samba shares during shutdown")
+		}
+	}
+}
+
+// adminDecommission stops the gateway for good, removing the exports even
+// with -preserve-exports-on-shutdown
+func (g *gateway) adminDecommission(w http.ResponseWriter, r *http.Request) {
+	requestLog(r).Warn("decommissioning, the volumes will be unexported")
+	g.decommissionOnce.Do(func() { close(g.decommission) })
+	w.WriteHeader(http.StatusAccepted)
 }
 
 func (g *gateway) Reload() error {
-	return g.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(volumesBucket)
-		return b.ForEach(func(k []byte, v []byte) error {
+	return g.update(func(tx *bolt.Tx) error {
+		var changed, exported, aliases, ready []*volume
+		degraded := func(vol *volume, err error) {
+			if vol.markDegraded(err.Error()) {
+				changed = append(changed, vol)
+			}
+		}
+		err := forEachVolume(tx, func(v []byte) error {
 			var vol *volume
 			if err := json.Unmarshal(v, &vol); err != nil {
-				return errors.Wrap(err, "error unmarshaling volume from database")
+				return dbError(errors.Wrap(err, "error unmarshaling volume from database"))
+			}
+			// volumes from before sidecars were written get one now
+			tx.OnCommit(func() { writeSidecar(vol.Name, v) })
+
+			if err := g.checkVolumePath(vol); err != nil {
+				logrus.WithError(err).WithField("volume", vol.Name).WithField("path", vol.Export.Path).Error("not exporting volume")
+				degraded(vol, err)
+				return nil
+			}
+
+			if vol.Loop != nil {
+				ok, err := reattachLoop(vol)
+				if err != nil {
+					logrus.WithError(err).WithField("volume", vol.Name).Error("error mounting volume image on reload")
+					degraded(vol, err)
+					return nil
+				}
+				if ok {
+					changed = append(changed, vol)
+				}
+			}
+
+			if vol.Source != "" && vol.AliasOf == "" {
+				if err := bindSource(vol); err != nil {
+					logrus.WithError(err).WithField("volume", vol.Name).Error("error mounting volume source on reload")
+					degraded(vol, err)
+					return nil
+				}
 			}
 
-			if err := exportfs(vol); err != nil {
-				logrus.WithError(err).WithField("volume", vol.Name).Error("error exporting volume on reload")
+			// volumes created before fsids were assigned get one now
+			if vol.FSID == "" {
+				id, err := newFSID()
+				if err != nil {
+					return err
+				}
+				vol.FSID = id
+				changed = append(changed, vol)
 			}
+
+			if vol.AliasOf != "" {
+				aliases = append(aliases, vol)
+				return nil
+			}
+			ready = append(ready, vol)
+			exported = append(exported, g.exportView(vol))
+			exported = append(exported, g.subexportViews(vol)...)
 			return nil
 		})
+		if err != nil {
+			return err
+		}
+		// aliases are mounted once the volumes they alias are
+		for _, vol := range aliases {
+			if err := bindSource(vol); err != nil {
+				logrus.WithError(err).WithField("volume", vol.Name).Error("error mounting aliased volume on reload")
+				degraded(vol, err)
+				continue
+			}
+			ready = append(ready, vol)
+			exported = append(exported, g.exportView(vol))
+			exported = append(exported, g.subexportViews(vol)...)
+		}
+
+		if err := g.exporter.reload(exported); err != nil {
+			logrus.WithError(err).Error("error applying exports on reload")
+		} else {
+			for _, vol := range ready {
+				if vol.markExported() {
+					changed = append(changed, vol)
+				}
+			}
+		}
+		if g.smb != nil {
+			g.smb.reload(exported)
+		}
+
+		// the bucket can't be modified while iterating, so persist changes
+		// here, they're only to the volumes' state and fsids so the volumes
+		// keep their modification times
+		for _, vol := range changed {
+			if err := putVolumeState(tx, vol); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 }
 
-func unexport(v *volume) error {
-	args := []string{"-u"}
-	for _, h := range v.Export.Hosts {
-		args = append(args, h+":"+v.Export.Path)
+// reattachLoop mounts the volume's image if it is not already mounted, for
+// instance after a reboot. It reports whether a new loop device was attached.
+func reattachLoop(v *volume) (bool, error) {
+	mounted, err := isMountpoint(v.Export.Path)
+	if err != nil {
+		return false, errors.Wrap(err, "error checking volume mount")
+	}
+	if mounted {
+		return false, nil
+	}
+	if err := v.Loop.mount(v.Export.Path); err != nil {
+		return false, err
 	}
-	return errors.Wrap(cmd(exportfsPath, args...), "error unexporting nfs dir")
+	return true, nil
 }
 
-func cmd(bin string, args ...string) error {
-	cmd := exec.Command(bin, args...)
-	out, err := cmd.CombinedOutput()
-	return errors.Wrap(err, string(out))
+func runExportfs(ctx context.Context, args ...string) error {
+	defer exportfsDuration.since(time.Now())
+	err := cmdContext(ctx, exportfsPath, args...)
+	if err != nil {
+		exportfsFailures.inc()
+	}
+	return exportError(err)
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/pkg/errors"
+)
+
+// testOps records the storage and export operations of a test gateway in
+// the order they were made
+type testOps struct {
+	mu  sync.Mutex
+	ops []string
+}
+
+func (o *testOps) add(op string) {
+	o.mu.Lock()
+	o.ops = append(o.ops, op)
+	o.mu.Unlock()
+}
+
+func (o *testOps) list() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]string(nil), o.ops...)
+}
+
+func (o *testOps) reset() {
+	o.mu.Lock()
+	o.ops = nil
+	o.mu.Unlock()
+}
+
+// testStorage keeps volumes as plain directories, failing creates while
+// failCreate is set. Every call takes at least delay, and calls made while
+// another one for the same volume is running are counted in overlaps.
+type testStorage struct {
+	dirStorage
+	ops        *testOps
+	failCreate error
+	delay      time.Duration
+
+	mu       sync.Mutex
+	busy     map[string]int
+	overlaps int
+}
+
+// enter marks the volume's storage busy until the returned function is called
+func (s *testStorage) enter(name string) func() {
+	s.mu.Lock()
+	if s.busy == nil {
+		s.busy = make(map[string]int)
+	}
+	if s.busy[name] > 0 {
+		s.overlaps++
+	}
+	s.busy[name]++
+	s.mu.Unlock()
+	time.Sleep(s.delay)
+	return func() {
+		s.mu.Lock()
+		s.busy[name]--
+		s.mu.Unlock()
+	}
+}
+
+func (s *testStorage) create(tx *bolt.Tx, v *volume, req api.CreateRequest) error {
+	defer s.enter(v.Name)()
+	s.ops.add("create")
+	if s.failCreate != nil {
+		return s.failCreate
+	}
+	return s.dirStorage.create(tx, v, req)
+}
+
+func (s *testStorage) destroy(v *volume) error {
+	defer s.enter(v.Name)()
+	s.ops.add("destroy")
+	return s.dirStorage.destroy(v)
+}
+
+// testExporter keeps the hosts each path is exported to in memory. The next
+// export fails with failNext when it's set, onExport is called after every
+// successful one.
+type testExporter struct {
+	ops      *testOps
+	mu       sync.Mutex
+	exported map[string][]string
+	failNext error
+	onExport func()
+}
+
+func (e *testExporter) export(ctx context.Context, v *volume) error {
+	e.ops.add("export")
+	e.mu.Lock()
+	if err := e.failNext; err != nil {
+		e.failNext = nil
+		e.mu.Unlock()
+		return err
+	}
+	e.exported[v.Export.Path] = v.Export.Hosts
+	e.mu.Unlock()
+	if e.onExport != nil {
+		e.onExport()
+	}
+	return nil
+}
+
+func (e *testExporter) unexport(ctx context.Context, v *volume) error {
+	e.ops.add("unexport")
+	e.mu.Lock()
+	delete(e.exported, v.Export.Path)
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *testExporter) isExported(p string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.exported[p]
+	return ok
+}
+
+// hosts returns the hosts the path is exported to
+func (e *testExporter) hosts(p string) []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.exported[p]
+}
+
+func (e *testExporter) reload(vols []*volume) error { return nil }
+func (e *testExporter) shutdown() error             { return nil }
+func (e *testExporter) ready() error                { return nil }
+
+type testGateway struct {
+	*gateway
+	ops      *testOps
+	storage  *testStorage
+	exporter *testExporter
+}
+
+// newTestGateway returns a gateway keeping its data and database in a temp
+// dir, and the function removing them again
+func newTestGateway(t *testing.T) (*testGateway, func()) {
+	root, err := ioutil.TempDir("", "nfsg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() { os.RemoveAll(root) }
+	if err := os.MkdirAll(filepath.Join(root, "nfs"), 0755); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(filepath.Join(root, "volumes.db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	cleanup = func() {
+		db.Close()
+		os.RemoveAll(root)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range dbBuckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return errors.Wrapf(err, "error creating %s bucket", bucket)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	pools, err := parsePools(root, "", placeMostFree)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	ops := &testOps{}
+	tg := &testGateway{ops: ops, exporter: &testExporter{ops: ops, exported: make(map[string][]string)}}
+	tg.gateway = &gateway{root: root, db: db, jobs: newJobManager(db), exporter: tg.exporter, pools: pools}
+	tg.gateway.usage = newUsageCollector(tg.gateway, time.Minute)
+	tg.storage = &testStorage{dirStorage: dirStorage{g: tg.gateway, quotaBackend: quotaBackendLoop}, ops: ops}
+	tg.gateway.storage = sourceStorage{storage: tg.storage, g: tg.gateway}
+	return tg, cleanup
+}
+
+// stored reports whether the volume has a database record
+func (g *testGateway) stored(t *testing.T, name string) bool {
+	var found bool
+	err := g.view(func(tx *bolt.Tx) error {
+		found = getVolumeData(tx, name) != nil
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func exists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
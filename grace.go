@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// nfsd starts in a grace period during which NFSv4 clients can reclaim the
+// state they held before a restart or failover, and no new opens or locks
+// are granted. The lease and grace times and the recovery directory, where
+// nfsd records which clients may reclaim, can only be changed while nfsd has
+// no threads running.
+
+var graceSettingsKey = []byte("grace")
+
+// GraceSettings are the persisted NFSv4 recovery settings, 0 and "" keep the
+// kernel defaults.
+type GraceSettings struct {
+	LeaseSeconds int
+	GraceSeconds int
+	RecoveryDir  string
+}
+
+type GraceUpdateRequest struct {
+	LeaseSeconds *int
+	GraceSeconds *int
+	RecoveryDir  *string
+}
+
+// GraceState is the effective state of nfsd
+type GraceState struct {
+	LeaseSeconds int
+	GraceSeconds int
+	RecoveryDir  string
+	// InGrace is unknown, and false, on kernels without v4_end_grace
+	InGrace bool
+}
+
+func loadGraceSettings(db *bolt.DB) (*GraceSettings, error) {
+	var s *GraceSettings
+	err := db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(settingsBucket).Get(graceSettingsKey)
+		if data == nil {
+			return nil
+		}
+		s = &GraceSettings{}
+		return json.Unmarshal(data, s)
+	})
+	return s, dbError(errors.Wrap(err, "error reading grace settings"))
+}
+
+// writeGraceSettings writes the settings to nfsd, which must not be running
+func writeGraceSettings(s *GraceSettings) error {
+	if s == nil {
+		return nil
+	}
+	if s.RecoveryDir != "" {
+		if err := os.MkdirAll(s.RecoveryDir, 0700); err != nil {
+			return errors.Wrap(err, "error creating recovery dir")
+		}
+		if err := writeNFSDFile("nfsv4recoverydir", s.RecoveryDir); err != nil {
+			return err
+		}
+	}
+	if s.LeaseSeconds > 0 {
+		if err := writeNFSDFile("nfsv4leasetime", strconv.Itoa(s.LeaseSeconds)); err != nil {
+			return err
+		}
+	}
+	if s.GraceSeconds > 0 {
+		return writeNFSDFile("nfsv4gracetime", strconv.Itoa(s.GraceSeconds))
+	}
+	return nil
+}
+
+func readNFSDInt(name string) (int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(nfsdProcDir, name))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error reading nfsd %s", name)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	return n, errors.Wrapf(err, "error parsing nfsd %s", name)
+}
+
+func readGraceState() (*GraceState, error) {
+	var s GraceState
+	var err error
+	if s.LeaseSeconds, err = readNFSDInt("nfsv4leasetime"); err != nil {
+		return nil, err
+	}
+	if s.GraceSeconds, err = readNFSDInt("nfsv4gracetime"); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(nfsdProcDir, "nfsv4recoverydir"))
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading nfsd recovery dir")
+	}
+	s.RecoveryDir = strings.TrimSpace(string(data))
+	// v4_end_grace reads Y once the grace period is over
+	if data, err := ioutil.ReadFile(filepath.Join(nfsdProcDir, "v4_end_grace")); err == nil {
+		s.InGrace = strings.TrimSpace(string(data)) == "N"
+	}
+	return &s, nil
+}
+
+// restartNFSD stops all nfsd threads, runs fn and starts them again, which
+// begins a new grace period.
+func restartNFSD(fn func() error) error {
+	cur, err := readNFSDState()
+	if err != nil {
+		return err
+	}
+	if cur.Threads == 0 {
+		return errors.New("nfsd is not running")
+	}
+	if err := writeNFSDFile("threads", "0"); err != nil {
+		return err
+	}
+	ferr := fn()
+	if err := writeNFSDFile("threads", strconv.Itoa(cur.Threads)); err != nil {
+		return err
+	}
+	return ferr
+}
+
+func endGrace() error {
+	return writeNFSDFile("v4_end_grace", "Y")
+}
+
+// endGraceOnStart ends the grace period nfsd starts in once its threads are
+// up, for nodes which never take over clients from another server.
+func endGraceOnStart() {
+	for i := 0; i < 60; i++ {
+		if s, err := readNFSDState(); err == nil && s.Threads > 0 {
+			if err := endGrace(); err != nil {
+				logrus.WithError(err).Warn("error ending grace period")
+			}
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	logrus.Warn("nfsd did not start, not ending grace period")
+}
+
+func (g *gateway) getGrace(w http.ResponseWriter, r *http.Request) {
+	if err := g.kernelNFS("the grace period is"); err != nil {
+		writeError(w, err)
+		return
+	}
+	s, err := readGraceState()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+// updateGrace persists the settings and restarts nfsd with them, which also
+// starts a grace period.
+func (g *gateway) updateGrace(w http.ResponseWriter, r *http.Request) {
+	if err := g.kernelNFS("the grace period is"); err != nil {
+		writeError(w, err)
+		return
+	}
+	var req GraceUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	if req.LeaseSeconds != nil && (*req.LeaseSeconds < 10 || *req.LeaseSeconds > 3600) {
+		writeError(w, errInvalid("LeaseSeconds must be between 10 and 3600"))
+		return
+	}
+	if req.GraceSeconds != nil && (*req.GraceSeconds < 10 || *req.GraceSeconds > 3600) {
+		writeError(w, errInvalid("GraceSeconds must be between 10 and 3600"))
+		return
+	}
+	if req.RecoveryDir != nil && !filepath.IsAbs(*req.RecoveryDir) {
+		writeError(w, &validationError{Field: "RecoveryDir", Value: *req.RecoveryDir, Reason: "must be absolute"})
+		return
+	}
+
+	err := g.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(settingsBucket)
+		s := &GraceSettings{}
+		if data := b.Get(graceSettingsKey); data != nil {
+			if err := json.Unmarshal(data, s); err != nil {
+				return dbError(errors.Wrap(err, "error unmarshaling grace settings"))
+			}
+		}
+		if req.LeaseSeconds != nil {
+			s.LeaseSeconds = *req.LeaseSeconds
+		}
+		if req.GraceSeconds != nil {
+			s.GraceSeconds = *req.GraceSeconds
+		}
+		if req.RecoveryDir != nil {
+			s.RecoveryDir = *req.RecoveryDir
+		}
+
+		data, err := json.Marshal(s)
+		if err != nil {
+			return errors.Wrap(err, "error marshaling grace settings")
+		}
+		if err := b.Put(graceSettingsKey, data); err != nil {
+			return dbError(errors.Wrap(err, "error writing grace settings"))
+		}
+		return restartNFSD(func() error { return writeGraceSettings(s) })
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	g.getGrace(w, r)
+}
+
+// adminStartGrace restarts nfsd so clients can reclaim their state, e.g. after
+// taking over from another server.
+func (g *gateway) adminStartGrace(w http.ResponseWriter, r *http.Request) {
+	if err := g.kernelNFS("the grace period is"); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := restartNFSD(func() error { return nil }); err != nil {
+		writeError(w, err)
+		return
+	}
+	g.getGrace(w, r)
+}
+
+func (g *gateway) adminEndGrace(w http.ResponseWriter, r *http.Request) {
+	if err := g.kernelNFS("the grace period is"); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := endGrace(); err != nil {
+		writeError(w, err)
+		return
+	}
+	g.getGrace(w, r)
+}
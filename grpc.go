@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/cpuguy83/nfs-rest-gateway/api/pb"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	netcontext "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcAPI serves the volume lifecycle of api/pb/volumes.proto. Calls run
+// through the same middleware as the REST route they match, so tokens and
+// tenants apply the same way.
+type grpcAPI struct {
+	mu sync.RWMutex
+	g  *gateway
+}
+
+// set makes the API available, a standby has no gateway until it takes over
+func (s *grpcAPI) set(g *gateway) {
+	s.mu.Lock()
+	s.g = g
+	s.mu.Unlock()
+}
+
+type grpcContextKey struct{}
+
+// grpcCall is the work of a call, run once the middleware accepted it
+type grpcCall struct {
+	fn func(ctx context.Context) error
+
+	mu  sync.Mutex
+	ran bool
+	err error
+}
+
+// grpcHandler ends the middleware chain of gRPC calls. Calls must match a
+// route, the middleware lets unknown routes through for the router's 404.
+func grpcHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := r.Context().Value(grpcContextKey{}).(*grpcCall)
+		var m mux.RouteMatch
+		err := errNotFound("no route matches the call")
+		if router.Match(r, &m) {
+			err = c.fn(r.Context())
+		}
+		c.mu.Lock()
+		c.ran, c.err = true, err
+		c.mu.Unlock()
+	})
+}
+
+// call runs fn as a request to the REST route method and path
+func (s *grpcAPI) call(ctx netcontext.Context, method, path string, fn func(ctx context.Context, g *gateway) error) error {
+	s.mu.RLock()
+	g := s.g
+	s.mu.RUnlock()
+	if g == nil {
+		return status.Error(codes.Unavailable, "the gateway is on standby")
+	}
+
+	r, err := http.NewRequest(method, path, nil)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, h := range []string{"Authorization", requestIDHeader, traceparentHeader} {
+			if v := md[strings.ToLower(h)]; len(v) > 0 {
+				r.Header.Set(h, v[0])
+			}
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+	c := &grpcCall{fn: func(ctx context.Context) error { return fn(ctx, g) }}
+	ctx = context.WithValue(ctx, grpcContextKey{}, c)
+	rec := &grpcRecorder{header: make(http.Header)}
+	g.grpcChain.ServeHTTP(rec, r.WithContext(ctx))
+
+	if rec.code >= http.StatusBadRequest {
+		var resp api.ErrorResponse
+		if err := json.Unmarshal(rec.body.Bytes(), &resp); err != nil {
+			return status.Error(codes.Internal, "error decoding middleware error")
+		}
+		code, ok := grpcCodes[resp.Code]
+		if !ok {
+			code = codes.Internal
+		}
+		return status.Error(code, resp.Message)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.ran {
+		return status.Error(codes.Internal, "the call was not run")
+	}
+	if c.err != nil {
+		return grpcError(c.err)
+	}
+	return nil
+}
+
+// grpcRecorder keeps the errors the middleware writes
+type grpcRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *grpcRecorder) Header() http.Header { return w.header }
+
+func (w *grpcRecorder) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *grpcRecorder) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+// volumePath is the REST path of the volume, the name is checked first so
+// it can't point the call at another route
+func volumePath(name string) (string, error) {
+	if err := validateName(name); err != nil {
+		return "", grpcError(err)
+	}
+	return "/volume/" + name, nil
+}
+
+func (s *grpcAPI) Create(ctx netcontext.Context, req *pb.CreateRequest) (*pb.Volume, error) {
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "must supply a name")
+	}
+	create := api.CreateRequest{
+		Hosts:       req.Hosts,
+		Options:     req.Options,
+		SizeBytes:   req.SizeBytes,
+		FSType:      req.FsType,
+		Security:    req.Security,
+		Labels:      req.Labels,
+		ReadOnly:    req.ReadOnly,
+		Pool:        req.Pool,
+		Description: req.Description,
+		Protocols:   req.Protocols,
+		Template:    req.Template,
+		TTL:         req.Ttl,
+	}
+	if req.ExpiresAt != nil {
+		t, err := ptypes.Timestamp(req.ExpiresAt)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		create.ExpiresAt = &t
+	}
+	var vol *pb.Volume
+	err := s.call(ctx, "POST", "/volume?name="+url.QueryEscape(req.Name), func(ctx context.Context, g *gateway) error {
+		v, err := g.createScoped(ctx, req.Name, create)
+		if err != nil {
+			return err
+		}
+		vol, err = pbVolume(v)
+		return err
+	})
+	return vol, err
+}
+
+func (s *grpcAPI) Get(ctx netcontext.Context, req *pb.GetRequest) (*pb.Volume, error) {
+	path, err := volumePath(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	var vol *pb.Volume
+	err = s.call(ctx, "GET", path, func(ctx context.Context, g *gateway) error {
+		v, err := g.lookup(volumeID(contextTenant(ctx), req.Name))
+		if err != nil {
+			return err
+		}
+		vol, err = pbVolume(v)
+		return err
+	})
+	return vol, err
+}
+
+func (s *grpcAPI) List(req *pb.ListRequest, stream pb.Volumes_ListServer) error {
+	selector, err := parseSelector(req.Labels)
+	if err != nil {
+		return grpcError(err)
+	}
+	return s.call(stream.Context(), "GET", "/volumes", func(ctx context.Context, g *gateway) error {
+		vols, err := g.listScoped(ctx, selector)
+		if err != nil {
+			return err
+		}
+		for _, v := range vols {
+			vol, err := pbVolume(v)
+			if err != nil {
+				return err
+			}
+			if err := stream.Send(vol); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *grpcAPI) Update(ctx netcontext.Context, req *pb.UpdateRequest) (*pb.Volume, error) {
+	path, err := volumePath(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	update, err := apiUpdateRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var vol *pb.Volume
+	err = s.call(ctx, "PATCH", path, func(ctx context.Context, g *gateway) error {
+		v, err := g.patchVolume(ctx, volumeID(contextTenant(ctx), req.Name), req.Etag, update)
+		if err != nil {
+			return err
+		}
+		vol, err = pbVolume(v)
+		return err
+	})
+	return vol, err
+}
+
+func (s *grpcAPI) Delete(ctx netcontext.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+	path, err := volumePath(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	resp := &pb.DeleteResponse{}
+	err = s.call(ctx, "DELETE", path, func(ctx context.Context, g *gateway) error {
+		j, err := g.queueDelete(ctx, volumeID(contextTenant(ctx), req.Name), req.Etag, req.Force)
+		if j != nil {
+			resp.JobId = j.ID
+		}
+		return err
+	})
+	return resp, err
+}
+
+func (s *grpcAPI) Watch(req *pb.WatchRequest, stream pb.Volumes_WatchServer) error {
+	types := make(map[string]bool)
+	for _, t := range req.Types {
+		types[t] = true
+	}
+	return s.call(stream.Context(), "GET", "/events", func(ctx context.Context, g *gateway) error {
+		tenant := contextTenant(ctx)
+		ch := events.subscribe()
+		defer events.unsubscribe(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case e := <-ch:
+				if !e.wanted(tenant, types) {
+					continue
+				}
+				ev := &pb.Event{Type: e.Type, Volume: e.Volume, Time: pbTime(&e.Time), Message: e.Message}
+				if e.Data != nil {
+					b, err := json.Marshal(e.Data)
+					if err != nil {
+						return errors.Wrap(err, "error marshaling event data")
+					}
+					ev.Data = string(b)
+				}
+				if err := stream.Send(ev); err != nil {
+					return err
+				}
+			}
+		}
+	})
+}
+
+func pbVolume(v *volume) (*pb.Volume, error) {
+	etag, err := volumeETag(v)
+	if err != nil {
+		return nil, err
+	}
+	vol := &pb.Volume{
+		Name:        displayName(v.Name),
+		Path:        v.Export.Path,
+		Hosts:       v.Export.Hosts,
+		Options:     v.Export.Options,
+		Security:    v.Export.Security,
+		Labels:      v.Labels,
+		ReadOnly:    v.ReadOnly,
+		Mirror:      v.Mirror,
+		Pool:        v.Pool,
+		Description: v.Description,
+		Protocols:   v.protocols(),
+		Template:    v.Template,
+		AliasOf:     displayName(v.AliasOf),
+		SizeBytes:   v.sizeLimit(),
+		CreatedBy:   v.CreatedBy,
+		CreatedAt:   pbTime(v.CreatedAt),
+		UpdatedAt:   pbTime(v.UpdatedAt),
+		ExpiresAt:   pbTime(v.ExpiresAt),
+		Etag:        etag,
+	}
+	vol.Status, vol.StatusReason = v.status()
+	return vol, nil
+}
+
+// pbTime converts the gateway's times, which are always in the range of a
+// protobuf timestamp
+func pbTime(t *time.Time) *timestamp.Timestamp {
+	if t == nil {
+		return nil
+	}
+	ts, _ := ptypes.TimestampProto(*t)
+	return ts
+}
+
+func apiUpdateRequest(req *pb.UpdateRequest) (api.UpdateRequest, error) {
+	var update api.UpdateRequest
+	if req.Hosts != nil {
+		update.Hosts = &req.Hosts.Values
+	}
+	if req.Options != nil {
+		update.Options = &req.Options.Value
+	}
+	if req.Security != nil {
+		update.Security = &req.Security.Values
+	}
+	if req.Labels != nil {
+		update.Labels = &req.Labels.Labels
+	}
+	if req.ReadOnly != nil {
+		update.ReadOnly = &req.ReadOnly.Value
+	}
+	if req.SecurityLabel != nil {
+		update.SecurityLabel = &req.SecurityLabel.Value
+	}
+	if req.Description != nil {
+		update.Description = &req.Description.Value
+	}
+	if req.Protocols != nil {
+		update.Protocols = &req.Protocols.Values
+	}
+	if req.Ttl != nil {
+		update.TTL = &req.Ttl.Value
+	}
+	if req.ExpiresAt != nil {
+		// the zero timestamp removes the expiry like a zero ExpiresAt
+		var t time.Time
+		if req.ExpiresAt.Seconds != 0 || req.ExpiresAt.Nanos != 0 {
+			var err error
+			if t, err = ptypes.Timestamp(req.ExpiresAt); err != nil {
+				return update, status.Error(codes.InvalidArgument, err.Error())
+			}
+		}
+		update.ExpiresAt = &t
+	}
+	return update, nil
+}
+
+// newGRPCServer returns the server of the gRPC API
+func newGRPCServer(s *grpcAPI) *grpc.Server {
+	srv := grpc.NewServer()
+	pb.RegisterVolumesServer(srv, s)
+	return srv
+}
+
+// stopGRPC waits for the calls in flight, up to the drain timeout, watches
+// don't end by themselves
+func stopGRPC(srv *grpc.Server, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		srv.Stop()
+	}
+}
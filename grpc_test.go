@@ -0,0 +1,215 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cpuguy83/nfs-rest-gateway/api/pb"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/soheilhy/cmux"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// newTestGRPC serves the REST and gRPC APIs of a test gateway on one
+// listener like -grpc does. The admin and reader tokens belong to the
+// default tenant, the other token to tenant "other".
+func newTestGRPC(t *testing.T) (*testGateway, pb.VolumesClient, string, func()) {
+	g, cleanup := newTestGateway(t)
+	var err error
+	if g.auth, err = newTokenAuth([]string{"admin", "other other", "reader"}); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	bindings, err := parseRoleBindings("reader=reader")
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	g.rbac = &rbac{}
+	if err := g.rbac.setStatic(bindings, roleAdmin); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	g.limits = newLimiter(0, 0, 0, 0, 0, 0)
+	g.timeouts = &requestTimeouts{}
+	handler := makeRouter(g.gateway)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	m := cmux.New(l)
+	grpcL := m.MatchWithWriters(cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"))
+	httpL := m.Match(cmux.Any())
+	grpcSrv := newGRPCServer(&grpcAPI{g: g.gateway})
+	srv := &http.Server{Handler: handler}
+	go grpcSrv.Serve(grpcL)
+	go srv.Serve(httpL)
+	go m.Serve()
+
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		l.Close()
+		cleanup()
+		t.Fatal(err)
+	}
+	return g, pb.NewVolumesClient(conn), l.Addr().String(), func() {
+		conn.Close()
+		grpcSrv.Stop()
+		srv.Close()
+		cleanup()
+	}
+}
+
+func withToken(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func TestGRPCVolumeLifecycle(t *testing.T) {
+	g, c, addr, cleanup := newTestGRPC(t)
+	defer cleanup()
+	ctx := withToken("admin")
+
+	vol, err := c.Create(ctx, &pb.CreateRequest{Name: "v1", Options: "rw,sync", Labels: map[string]string{"env": "prod"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.Name != "v1" || vol.Path != g.nfsPath("", "v1") || vol.Labels["env"] != "prod" || vol.Etag == "" || vol.CreatedAt == nil {
+		t.Fatalf("created %+v", vol)
+	}
+	if _, err := c.Create(ctx, &pb.CreateRequest{Name: "v1"}); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("creating an existing volume returned %v", err)
+	}
+
+	got, err := c.Get(ctx, &pb.GetRequest{Name: "v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Options != "rw,sync" {
+		t.Fatalf("got %+v", got)
+	}
+
+	v2, err := c.Create(ctx, &pb.CreateRequest{Name: "v2", Labels: map[string]string{"env": "dev"}, Ttl: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2.ExpiresAt == nil || v2.ExpiresAt.Seconds < time.Now().Add(59*time.Minute).Unix() {
+		t.Fatalf("created with a TTL, expires at %v", v2.ExpiresAt)
+	}
+	stream, err := c.List(ctx, &pb.ListRequest{Labels: []string{"env=prod"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for {
+		v, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, v.Name)
+	}
+	if len(names) != 1 || names[0] != "v1" {
+		t.Fatalf("listed %v", names)
+	}
+
+	desc := &wrappers.StringValue{Value: "scratch space"}
+	if _, err := c.Update(ctx, &pb.UpdateRequest{Name: "v1", Etag: `"stale"`, Description: desc}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("updating with a stale etag returned %v", err)
+	}
+	updated, err := c.Update(ctx, &pb.UpdateRequest{Name: "v1", Etag: vol.Etag, ReadOnly: &wrappers.BoolValue{Value: true}, Description: desc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated.ReadOnly || updated.Description != "scratch space" || updated.Options != "rw,sync" || updated.Labels["env"] != "prod" {
+		t.Fatalf("updated %+v", updated)
+	}
+
+	// REST is still served on the same listener
+	req, err := http.NewRequest("GET", "http://"+addr+"/volume/v1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer admin")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("REST get returned %d", resp.StatusCode)
+	}
+
+	del, err := c.Delete(ctx, &pb.DeleteRequest{Name: "v1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if del.JobId == "" {
+		t.Fatal("delete returned no job")
+	}
+	if del, err = c.Delete(ctx, &pb.DeleteRequest{Name: "missing"}); err != nil || del.JobId != "" {
+		t.Fatalf("deleting a missing volume returned %+v, %v", del, err)
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	_, c, _, cleanup := newTestGRPC(t)
+	defer cleanup()
+	if _, err := c.Create(withToken("admin"), &pb.CreateRequest{Name: "v"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		call func() error
+		want codes.Code
+	}{
+		{"no token", func() error {
+			_, err := c.Get(context.Background(), &pb.GetRequest{Name: "v"})
+			return err
+		}, codes.Unauthenticated},
+		{"bad token", func() error {
+			_, err := c.Get(withToken("bogus"), &pb.GetRequest{Name: "v"})
+			return err
+		}, codes.Unauthenticated},
+		{"other tenant", func() error {
+			_, err := c.Get(withToken("other"), &pb.GetRequest{Name: "v"})
+			return err
+		}, codes.NotFound},
+		{"reader creates", func() error {
+			_, err := c.Create(withToken("reader"), &pb.CreateRequest{Name: "r"})
+			return err
+		}, codes.PermissionDenied},
+		{"missing volume", func() error {
+			_, err := c.Get(withToken("admin"), &pb.GetRequest{Name: "missing"})
+			return err
+		}, codes.NotFound},
+		{"invalid name", func() error {
+			_, err := c.Get(withToken("admin"), &pb.GetRequest{Name: "../admin/nfsd"})
+			return err
+		}, codes.InvalidArgument},
+		{"no name", func() error {
+			_, err := c.Create(withToken("admin"), &pb.CreateRequest{})
+			return err
+		}, codes.InvalidArgument},
+		{"standby", func() error {
+			_, err := (&grpcAPI{}).Get(withToken("admin"), &pb.GetRequest{Name: "v"})
+			return err
+		}, codes.Unavailable},
+	}
+	for _, tc := range cases {
+		if got := status.Code(tc.call()); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
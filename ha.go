@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// In active-passive HA mode two gateways share a device holding the data
+// root, including volumes.db, and a floating IP clients mount from. Only the
+// active node has the device mounted and the IP assigned. A standby node
+// serves nothing but the HA endpoints until it is told to take over, then it
+// acquires both and starts up like a fresh active node: nfsd starts in its
+// grace period, every volume is re-exported and sm-notify tells the NFSv3
+// clients recorded in the shared statd directory to reclaim their locks.
+
+const (
+	haActive  = "active"
+	haStandby = "standby"
+)
+
+// HAStatus is the state of this node in an HA pair
+type HAStatus struct {
+	// Mode is the configured mode, "" when HA is disabled
+	Mode string
+	// Role is standby until the node takes over, then active
+	Role       string
+	Device     string     `json:",omitempty"`
+	FloatingIP string     `json:",omitempty"`
+	TookOver   *time.Time `json:",omitempty"`
+}
+
+type haSettings struct {
+	mode       string
+	root       string
+	device     string
+	fstype     string
+	floatingIP string
+	iface      string
+
+	mu       sync.Mutex
+	role     string
+	tookOver *time.Time
+}
+
+// ha is configured by the -ha-* flags
+var ha haSettings
+
+func (h *haSettings) enabled() bool {
+	return h.mode != ""
+}
+
+func (h *haSettings) validate() error {
+	switch h.mode {
+	case "":
+		return nil
+	case haActive, haStandby:
+	default:
+		return errors.Errorf("unknown HA mode %q", h.mode)
+	}
+	if h.floatingIP == "" || h.iface == "" {
+		return errors.New("-ha-floating-ip and -ha-interface are required in HA mode")
+	}
+	if _, _, err := net.ParseCIDR(h.floatingIP); err != nil {
+		return errors.Errorf("-ha-floating-ip must be an address with a prefix length, e.g. 10.0.0.10/24")
+	}
+	return nil
+}
+
+// addr is the floating IP without its prefix length
+func (h *haSettings) addr() string {
+	return strings.SplitN(h.floatingIP, "/", 2)[0]
+}
+
+// statdDir is where statd records the clients holding locks, it's on the
+// shared device so the node taking over knows who to notify.
+func (h *haSettings) statdDir() string {
+	return filepath.Join(h.root, "statd")
+}
+
+func (h *haSettings) statdArgs() []string {
+	if !h.enabled() {
+		return nil
+	}
+	return []string{"-P", h.statdDir(), "-n", h.addr()}
+}
+
+// smNotifyArgs forces notifications on every takeover, sm-notify otherwise
+// only runs once per boot.
+func (h *haSettings) smNotifyArgs() []string {
+	if !h.enabled() {
+		return nil
+	}
+	return []string{"-f", "-P", h.statdDir(), "-v", h.addr()}
+}
+
+// recoveryDir keeps the NFSv4 client records on the shared device
+func (h *haSettings) recoveryDir() string {
+	return filepath.Join(h.root, "v4recovery")
+}
+
+func (h *haSettings) status() HAStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return HAStatus{Mode: h.mode, Role: h.role, Device: h.device, FloatingIP: h.floatingIP, TookOver: h.tookOver}
+}
+
+// acquire mounts the shared device and assigns the floating IP
+func (h *haSettings) acquire() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.role == haActive {
+		return nil
+	}
+	if h.device != "" {
+		if err := os.MkdirAll(h.root, 0755); err != nil {
+			return errors.Wrap(err, "error making data root")
+		}
+		if m, err := mountPoint(h.root); err != nil || m != h.root {
+			if err := unix.Mount(h.device, h.root, h.fstype, 0, ""); err != nil {
+				return errors.Wrap(err, "error mounting shared device")
+			}
+		}
+	}
+	out, err := runCommand("ip", "addr", "add", h.floatingIP, "dev", h.iface)
+	if err != nil && !strings.Contains(string(out), "File exists") {
+		return errors.Wrap(err, "error adding floating IP")
+	}
+	// make neighbours forget the old owner of the address
+	cmd("arping", "-U", "-c", "3", "-I", h.iface, h.addr())
+
+	now := time.Now().UTC()
+	h.role = haActive
+	h.tookOver = &now
+	logrus.WithField("ip", h.floatingIP).Info("took over as the active node")
+	return nil
+}
+
+// release gives up the floating IP and the shared device on shutdown so the
+// standby can take over. nfsd is stopped first so nothing holds the device.
+func (h *haSettings) release() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.role != haActive {
+		return
+	}
+	if err := cmd("ip", "addr", "del", h.floatingIP, "dev", h.iface); err != nil {
+		logrus.WithError(err).Error("error removing floating IP")
+	}
+	if err := writeNFSDFile("threads", "0"); err != nil {
+		logrus.WithError(err).Warn("error stopping nfsd")
+	}
+	if h.device != "" {
+		if err := unix.Unmount(h.root, 0); err != nil {
+			logrus.WithError(err).Error("error unmounting shared device")
+		}
+	}
+	h.role = haStandby
+}
+
+// waitForTakeover serves the HA endpoints through h until a takeover is
+// requested and has acquired the shared resources.
+func waitForTakeover(h *handlerSwitch, auth *tokenAuth, served <-chan error) error {
+	done := make(chan struct{})
+	var once sync.Once
+	r := mux.NewRouter()
+	r.Methods("GET").Path("/admin/ha").HandlerFunc(getHA)
+	r.Methods("POST").Path("/admin/ha/takeover").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := ha.acquire(); err != nil {
+			writeError(w, err)
+			return
+		}
+		getHA(w, r)
+		once.Do(func() { close(done) })
+	})
+	r.Methods("GET").Path("/healthz").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, HealthResponse{Status: "standby"}, nil)
+	})
+	h.set(withRequestID(auth.middleware(r)))
+
+	logrus.Info("waiting for takeover as the standby node")
+	select {
+	case <-done:
+		return nil
+	case err := <-served:
+		return errors.Wrap(err, "error serving standby API")
+	}
+}
+
+// handlerSwitch lets the standby API be replaced by the full one once the
+// node takes over, without restarting the server.
+type handlerSwitch struct {
+	mu sync.RWMutex
+	h  http.Handler
+}
+
+func (s *handlerSwitch) set(h http.Handler) {
+	s.mu.Lock()
+	s.h = h
+	s.mu.Unlock()
+}
+
+func (s *handlerSwitch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	h := s.h
+	s.mu.RUnlock()
+	if h == nil {
+		http.NotFound(w, r)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+func getHA(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(ha.status())
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+// takeover is a no-op once the gateway is serving, it's only active then
+func (g *gateway) takeover(w http.ResponseWriter, r *http.Request) {
+	if !ha.enabled() {
+		writeError(w, errInvalid("HA mode is not enabled"))
+		return
+	}
+	writeError(w, newError(http.StatusConflict, api.ErrCodeInvalidRequest, "this node is already active"))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+type HealthResponse struct {
+	Status  string
+	Error   string         `json:",omitempty"`
+	Daemons []DaemonStatus `json:",omitempty"`
+}
+
+// healthz is a liveness check, it only fails when the process can't serve
+// requests at all.
+func (g *gateway) healthz(w http.ResponseWriter, r *http.Request) {
+	resp := HealthResponse{Status: "ok"}
+	err := g.view(func(tx *bolt.Tx) error {
+		if tx.Bucket(volumesBucket) == nil {
+			return errors.New("volumes bucket is missing")
+		}
+		return nil
+	})
+	writeHealth(w, resp, errors.Wrap(err, "database is not reachable"))
+}
+
+// readyz checks that the nfs server is actually serving exports.
+func (g *gateway) readyz(w http.ResponseWriter, r *http.Request) {
+	resp := HealthResponse{Status: "ok", Daemons: daemons.status()}
+	err := g.checkPreflight()
+	if err == nil {
+		err = g.exporter.ready()
+	}
+	if err == nil && !daemons.healthy() {
+		err = errors.New("not all nfs daemons are running")
+	}
+	// still ready, reads are served
+	if err == nil && g.maintenance.active() {
+		resp.Status = "maintenance"
+	}
+	writeHealth(w, resp, err)
+}
+
+func writeHealth(w http.ResponseWriter, resp HealthResponse, err error) {
+	status := http.StatusOK
+	if err != nil {
+		resp.Status = "unavailable"
+		resp.Error = err.Error()
+		status = http.StatusServiceUnavailable
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+type AddHostRequest struct {
+	Host string
+}
+
+func (g *gateway) addHost(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	name = scopedName(r, name)
+
+	var req AddHostRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	if req.Host == "" {
+		writeError(w, errInvalid("must provide a host"))
+		return
+	}
+	if err := validateHosts([]string{req.Host}); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	v, err := g.modifyVolume(r.Context(), name, func(v *volume) error {
+		if err := checkIfMatch(r, v); err != nil {
+			return err
+		}
+		if v.Mirror {
+			return errMirror()
+		}
+		for _, h := range v.Export.Hosts {
+			if h == req.Host {
+				return errUnchanged
+			}
+		}
+		v.Export.Hosts = append(v.Export.Hosts, req.Host)
+		return checkRuleHosts(v)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeUpdateResponse(w, v)
+}
+
+func (g *gateway) removeHost(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, host := vars["name"], vars["host"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	name = scopedName(r, name)
+
+	v, err := g.modifyVolume(r.Context(), name, func(v *volume) error {
+		if err := checkIfMatch(r, v); err != nil {
+			return err
+		}
+		if v.Mirror {
+			return errMirror()
+		}
+		for i, h := range v.Export.Hosts {
+			if h == host {
+				v.Export.Hosts = append(v.Export.Hosts[:i], v.Export.Hosts[i+1:]...)
+				return nil
+			}
+		}
+		return errNotFound("host not found")
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeUpdateResponse(w, v)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+)
+
+// Adding a host the volume is already exported to changes nothing, it's
+// neither exported again nor stored with a new UpdatedAt.
+func TestAddHostUnchanged(t *testing.T) {
+	g, cleanup := newTestGateway(t)
+	defer cleanup()
+	const name = "v"
+	if _, err := g.addVolume(context.Background(), name, api.CreateRequest{Hosts: []string{"h1"}}, "", true); err != nil {
+		t.Fatal(err)
+	}
+	r := mux.NewRouter()
+	r.Methods("POST").Path("/volume/{name}/hosts").HandlerFunc(g.addHost)
+	addHost := func(host string) {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest("POST", "/volume/"+name+"/hosts", strings.NewReader(`{"Host":"`+host+`"}`)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("adding %s returned %d: %s", host, rec.Code, rec.Body)
+		}
+	}
+	stored := func() *volume {
+		var v *volume
+		err := g.view(func(tx *bolt.Tx) error {
+			var err error
+			v, err = readVolume(tx, name)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	addHost("h2")
+	before := stored()
+	g.ops.reset()
+	addHost("h2")
+	if ops := g.ops.list(); len(ops) != 0 {
+		t.Fatalf("adding an existing host ran %v", ops)
+	}
+	after := stored()
+	if !reflect.DeepEqual(after.Export.Hosts, []string{"h1", "h2"}) {
+		t.Fatalf("hosts are %v", after.Export.Hosts)
+	}
+	if !reflect.DeepEqual(before.UpdatedAt, after.UpdatedAt) {
+		t.Fatalf("UpdatedAt changed from %v to %v", before.UpdatedAt, after.UpdatedAt)
+	}
+}
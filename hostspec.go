@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// Export hosts may be IPs, networks in CIDR or address/netmask form,
+// hostnames with optional * ? [] wildcards, or @netgroups.
+
+const (
+	resolveHostsOff    = "off"
+	resolveHostsWarn   = "warn"
+	resolveHostsReject = "reject"
+)
+
+var (
+	hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*\.?$`)
+	wildcardPattern = regexp.MustCompile(`^[a-zA-Z0-9*?\[\].-]+$`)
+	netgroupPattern = regexp.MustCompile(`^@[a-zA-Z0-9_.-]+$`)
+)
+
+// resolveHosts is whether hostnames are looked up when volumes are exported
+// to them, see -resolve-hosts.
+var resolveHosts = resolveHostsOff
+
+func setResolveHosts(mode string) error {
+	switch mode {
+	case resolveHostsOff, resolveHostsWarn, resolveHostsReject:
+		resolveHosts = mode
+		return nil
+	}
+	return errors.Errorf("unknown mode %q", mode)
+}
+
+// validateHost checks the syntax of a single export host
+func validateHost(h string) error {
+	invalid := func(reason string) error {
+		return &validationError{Field: "Hosts", Value: h, Reason: reason}
+	}
+	switch {
+	case h == "":
+		return invalid("must not be empty")
+	case strings.HasPrefix(h, "@"):
+		if !netgroupPattern.MatchString(h) {
+			return invalid("netgroup names may only contain letters, digits, _, . and -")
+		}
+		return nil
+	case strings.Contains(h, "/"):
+		return validateNetwork(h, invalid)
+	case net.ParseIP(h) != nil:
+		return nil
+	case strings.ContainsAny(h, "*?[]"):
+		if !wildcardPattern.MatchString(h) {
+			return invalid("wildcards may only contain hostname characters and * ? [ ]")
+		}
+		return nil
+	case !hostnamePattern.MatchString(h) || len(h) > 253:
+		return invalid("must be an IP address, network, hostname, wildcard or @netgroup")
+	}
+	return nil
+}
+
+// validateNetwork accepts address/prefix and address/netmask
+func validateNetwork(h string, invalid func(string) error) error {
+	parts := strings.SplitN(h, "/", 2)
+	ip := net.ParseIP(parts[0])
+	if ip == nil {
+		return invalid("network address must be an IP address")
+	}
+	bits := 128
+	if ip.To4() != nil {
+		bits = 32
+	}
+	if n, err := strconv.Atoi(parts[1]); err == nil {
+		if n < 0 || n > bits {
+			return invalid("prefix length out of range")
+		}
+		return nil
+	}
+	if mask := net.ParseIP(parts[1]); mask != nil && bits == 32 && mask.To4() != nil {
+		if _, maskBits := net.IPMask(mask.To4()).Size(); maskBits == 0 {
+			return invalid("netmask must be contiguous")
+		}
+		return nil
+	}
+	return invalid("must be a prefix length or netmask after /")
+}
+
+// validateHosts checks every host and, depending on -resolve-hosts, whether
+// hostnames resolve.
+func validateHosts(hosts []string) error {
+	for _, h := range hosts {
+		if err := validateHost(h); err != nil {
+			return err
+		}
+	}
+	if resolveHosts == resolveHostsOff {
+		return nil
+	}
+	for _, h := range hosts {
+		if !hostnamePattern.MatchString(h) || net.ParseIP(h) != nil {
+			continue
+		}
+		if _, err := net.LookupHost(h); err != nil {
+			if resolveHosts == resolveHostsReject {
+				return &validationError{Field: "Hosts", Value: h, Reason: "hostname does not resolve"}
+			}
+			logrus.WithField("host", h).WithError(err).Warn("export host does not resolve")
+		}
+	}
+	return nil
+}
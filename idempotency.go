@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+var idempotencyBucket = []byte("idempotency")
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	idempotencyTTL    = 24 * time.Hour
+	// maxRequestSize limits the JSON bodies of the requests wrapped by
+	// idempotent, which are read whole to be hashed. A full batch fits.
+	maxRequestSize = 8 << 20
+)
+
+// storedResponse is a response recorded for an idempotency key
+type storedResponse struct {
+	RequestHash string
+	Status      int
+	Header      http.Header
+	Body        []byte
+	Created     time.Time
+}
+
+// responseRecorder captures a response so it can be stored
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// keyLocks serializes requests sharing an idempotency key so a retry that
+// races the original waits for its result instead of running twice.
+var keyLocks keyedLocks
+
+func lockKey(key string) func() {
+	return keyLocks.lock(key)
+}
+
+// idempotent replays the stored response when a request is retried with the
+// same Idempotency-Key. Keys are scoped to the tenant, method and path, and
+// server errors are not stored so those can be retried for real. Bodies over
+// maxRequestSize are rejected whether or not a key is given.
+func (g *gateway) idempotent(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" {
+			r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+			h(w, r)
+			return
+		}
+
+		// one byte more than allowed tells an oversized body apart
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestSize+1))
+		if err != nil {
+			writeError(w, errInvalid(errors.Wrap(err, "error reading request").Error()))
+			return
+		}
+		if len(body) > maxRequestSize {
+			writeError(w, errTooLarge("the request is larger than "+strconv.Itoa(maxRequestSize)+" bytes"))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(append([]byte(r.URL.RawQuery+"\n"), body...))
+		reqHash := hex.EncodeToString(sum[:])
+
+		dbKey := []byte(requestTenant(r) + "\n" + r.Method + " " + r.URL.Path + "\n" + key)
+		unlock := lockKey(string(dbKey))
+		defer unlock()
+
+		var stored *storedResponse
+		err = g.view(func(tx *bolt.Tx) error {
+			data := tx.Bucket(idempotencyBucket).Get(dbKey)
+			if data == nil {
+				return nil
+			}
+			stored = &storedResponse{}
+			return errors.Wrap(json.Unmarshal(data, stored), "error unmarshaling stored response")
+		})
+		if err != nil {
+			writeError(w, dbError(err))
+			return
+		}
+		if stored != nil && time.Since(stored.Created) < idempotencyTTL {
+			if stored.RequestHash != reqHash {
+				writeError(w, errInvalid("Idempotency-Key was already used for a different request"))
+				return
+			}
+			for k, v := range stored.Header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r)
+		if rec.status >= 500 {
+			return
+		}
+
+		resp := storedResponse{
+			RequestHash: reqHash,
+			Status:      rec.status,
+			Header:      http.Header{},
+			Body:        rec.body.Bytes(),
+			Created:     time.Now().UTC(),
+		}
+		for _, k := range []string{"Content-Type", "Location"} {
+			if v := w.Header().Get(k); v != "" {
+				resp.Header.Set(k, v)
+			}
+		}
+		data, err := json.Marshal(resp)
+		if err == nil {
+			err = g.update(func(tx *bolt.Tx) error {
+				return tx.Bucket(idempotencyBucket).Put(dbKey, data)
+			})
+		}
+		if err != nil {
+			requestLog(r).WithError(err).Error("error storing idempotent response")
+		}
+	}
+}
+
+// reapIdempotencyKeys removes stored responses once they expire
+func (g *gateway) reapIdempotencyKeys() {
+	for {
+		err := g.update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(idempotencyBucket)
+			var expired [][]byte
+			err := b.ForEach(func(k, v []byte) error {
+				var s storedResponse
+				if err := json.Unmarshal(v, &s); err != nil || time.Since(s.Created) > idempotencyTTL {
+					expired = append(expired, k)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, k := range expired {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			logrus.WithError(err).Error("error removing expired idempotency keys")
+		}
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Oversized bodies are rejected before being read into memory whole.
+func TestIdempotentBodyLimit(t *testing.T) {
+	g, cleanup := newTestGateway(t)
+	defer cleanup()
+	var called bool
+	h := g.idempotent(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	body := bytes.Repeat([]byte(" "), maxRequestSize+1)
+	req := httptest.NewRequest("POST", "/volume", bytes.NewReader(body))
+	req.Header.Set(idempotencyHeader, "key")
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+	if called {
+		t.Fatal("handler called with an oversized body")
+	}
+}
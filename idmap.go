@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// NFSv4 sends owners as user@domain names rather than ids, which rpc.idmapd
+// maps to local ids. A client whose domain differs from the server's gets
+// everything mapped to nobody, so the domain is set explicitly here instead
+// of being left to whatever DNS domain the host happens to have.
+
+var idmapSettingsKey = []byte("idmap")
+
+const (
+	idmapMethodNsswitch = "nsswitch"
+	idmapMethodStatic   = "static"
+	// idmapDefaultDomain is what rpc.idmapd uses when the host has no DNS domain
+	idmapDefaultDomain = "localdomain"
+)
+
+var (
+	idmapCacheFlushFiles = []string{"/proc/net/rpc/nfs4.nametoid/flush", "/proc/net/rpc/nfs4.idtoname/flush"}
+	// nfsdDisableIDMapping makes the server send numeric ids to sec=sys clients
+	nfsdDisableIDMapping = "/sys/module/nfsd/parameters/nfs4_disable_idmapping"
+	domainPattern        = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+)
+
+// idmap is set up when rpc.idmapd is supervised by the gateway
+var idmap struct {
+	enabled bool
+	conf    string
+	// defaults apply until settings are stored through the API
+	defaults IDMapSettings
+}
+
+// IDMapSettings are the settings of rpc.idmapd
+type IDMapSettings struct {
+	// Domain is the NFSv4 domain, which clients must use too. Empty uses the
+	// host's DNS domain.
+	Domain string
+	// LocalRealms are the kerberos realms whose principals are local users
+	LocalRealms []string `json:",omitempty"`
+	// Method lists how names are translated, nsswitch and/or static
+	Method []string `json:",omitempty"`
+	// Static maps user@domain names to local users for the static method
+	Static map[string]string `json:",omitempty"`
+	// NobodyUser and NobodyGroup are what names that can't be mapped map to
+	NobodyUser  string `json:",omitempty"`
+	NobodyGroup string `json:",omitempty"`
+}
+
+// IDMapStatus is the id mapping in effect
+type IDMapStatus struct {
+	IDMapSettings
+	// EffectiveDomain is the domain rpc.idmapd uses
+	EffectiveDomain string
+	// NumericIDs is set when the kernel sends sec=sys clients numeric ids
+	// instead of names, the domain only matters for kerberos mounts then
+	NumericIDs bool
+	Daemon     *DaemonStatus `json:",omitempty"`
+	// Warnings point out settings likely to map owners to nobody
+	Warnings []string `json:",omitempty"`
+}
+
+func (s *IDMapSettings) validate() error {
+	if s.Domain != "" && !domainPattern.MatchString(s.Domain) {
+		return &validationError{Field: "Domain", Value: s.Domain, Reason: "must be a lowercase DNS domain, e.g. example.com"}
+	}
+	for _, m := range s.Method {
+		if m != idmapMethodNsswitch && m != idmapMethodStatic {
+			return &validationError{Field: "Method", Value: m, Reason: "must be nsswitch or static"}
+		}
+	}
+	for name, user := range s.Static {
+		if i := strings.Index(name, "@"); i <= 0 || i == len(name)-1 {
+			return &validationError{Field: "Static", Value: name, Reason: "must be a user@domain name"}
+		}
+		if user == "" || strings.ContainsAny(user+name, " \t\n=[]") {
+			return &validationError{Field: "Static", Value: name, Reason: "names must not contain whitespace, '=' or brackets"}
+		}
+	}
+	if len(s.Static) > 0 && !stringIn(idmapMethodStatic, s.Method) {
+		return &validationError{Field: "Static", Reason: "is only used with the static method"}
+	}
+	values := map[string][]string{"LocalRealms": s.LocalRealms, "NobodyUser": {s.NobodyUser}, "NobodyGroup": {s.NobodyGroup}}
+	for field, list := range values {
+		for _, v := range list {
+			if strings.ContainsAny(v, " \t\n=[],") {
+				return &validationError{Field: field, Value: v, Reason: "must not contain whitespace, '=', ',' or brackets"}
+			}
+		}
+	}
+	return nil
+}
+
+func stringIn(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// effectiveDomain returns the domain rpc.idmapd ends up with
+func (s *IDMapSettings) effectiveDomain() string {
+	if s.Domain != "" {
+		return s.Domain
+	}
+	if host, err := os.Hostname(); err == nil {
+		if i := strings.Index(host, "."); i >= 0 && i < len(host)-1 {
+			return strings.ToLower(host[i+1:])
+		}
+	}
+	return idmapDefaultDomain
+}
+
+func (s *IDMapSettings) warnings() []string {
+	var out []string
+	if s.Domain == "" {
+		out = append(out, "no Domain is set, clients must use "+s.effectiveDomain()+" which follows the host's DNS domain")
+	}
+	if stringIn(idmapMethodStatic, s.Method) && !stringIn(idmapMethodNsswitch, s.Method) {
+		out = append(out, "only static names are mapped, everyone else maps to nobody")
+	}
+	return out
+}
+
+// render returns the settings as idmapd.conf
+func (s *IDMapSettings) render() []byte {
+	var b bytes.Buffer
+	b.WriteString("# written by nfs-rest-gateway, changes are overwritten\n[General]\n")
+	if s.Domain != "" {
+		fmt.Fprintf(&b, "Domain = %s\n", s.Domain)
+	}
+	if len(s.LocalRealms) > 0 {
+		fmt.Fprintf(&b, "Local-Realms = %s\n", strings.Join(s.LocalRealms, ","))
+	}
+	if s.NobodyUser != "" || s.NobodyGroup != "" {
+		b.WriteString("\n[Mapping]\n")
+		if s.NobodyUser != "" {
+			fmt.Fprintf(&b, "Nobody-User = %s\n", s.NobodyUser)
+		}
+		if s.NobodyGroup != "" {
+			fmt.Fprintf(&b, "Nobody-Group = %s\n", s.NobodyGroup)
+		}
+	}
+	if len(s.Method) > 0 {
+		fmt.Fprintf(&b, "\n[Translation]\nMethod = %s\n", strings.Join(s.Method, ","))
+	}
+	if len(s.Static) > 0 {
+		b.WriteString("\n[Static]\n")
+		names := make([]string, 0, len(s.Static))
+		for name := range s.Static {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(&b, "%s = %s\n", name, s.Static[name])
+		}
+	}
+	return b.Bytes()
+}
+
+func loadIDMapSettings(db *bolt.DB) (*IDMapSettings, error) {
+	var s *IDMapSettings
+	err := db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(settingsBucket).Get(idmapSettingsKey)
+		if data == nil {
+			return nil
+		}
+		s = &IDMapSettings{}
+		return json.Unmarshal(data, s)
+	})
+	return s, dbError(errors.Wrap(err, "error reading idmap settings"))
+}
+
+func writeIDMapConf(s *IDMapSettings) error {
+	tmp := idmap.conf + ".tmp"
+	if err := ioutil.WriteFile(tmp, s.render(), 0644); err != nil {
+		return errors.Wrap(err, "error writing idmapd.conf")
+	}
+	return errors.Wrap(os.Rename(tmp, idmap.conf), "error writing idmapd.conf")
+}
+
+// setupIDMap writes idmapd.conf from the stored settings, or defaults if
+// there are none, and starts rpc.idmapd
+func setupIDMap(conf string, defaults IDMapSettings, s *IDMapSettings) error {
+	if err := defaults.validate(); err != nil {
+		return err
+	}
+	idmap.enabled = true
+	idmap.conf = conf
+	idmap.defaults = defaults
+	if s == nil {
+		s = &defaults
+	}
+	if err := writeIDMapConf(s); err != nil {
+		return err
+	}
+	for _, w := range s.warnings() {
+		logrus.Warn("idmap: " + w)
+	}
+	daemons.start("rpc.idmapd", "/usr/sbin/rpc.idmapd", "-f", "-c", conf)
+	return nil
+}
+
+// flushIDMapCache drops the kernel's cached mappings so changed settings
+// apply to names it has already seen
+func flushIDMapCache() error {
+	now := []byte(strconv.FormatInt(time.Now().Unix(), 10))
+	for _, f := range idmapCacheFlushFiles {
+		if err := ioutil.WriteFile(f, now, 0); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "error flushing idmap cache")
+		}
+	}
+	return nil
+}
+
+func (g *gateway) idmapStatus() (*IDMapStatus, error) {
+	s, err := loadIDMapSettings(g.db)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		s = &idmap.defaults
+	}
+	st := &IDMapStatus{IDMapSettings: *s, EffectiveDomain: s.effectiveDomain()}
+	if b, err := ioutil.ReadFile(nfsdDisableIDMapping); err == nil {
+		st.NumericIDs = strings.TrimSpace(string(b)) == "Y"
+	}
+	for _, d := range daemons.status() {
+		if d.Name == "rpc.idmapd" {
+			d := d
+			st.Daemon = &d
+		}
+	}
+	st.Warnings = s.warnings()
+	return st, nil
+}
+
+func (g *gateway) getIDMap(w http.ResponseWriter, r *http.Request) {
+	st, err := g.idmapStatus()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, err := json.Marshal(st)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+// updateIDMap replaces the idmap settings and restarts rpc.idmapd with them
+func (g *gateway) updateIDMap(w http.ResponseWriter, r *http.Request) {
+	if !idmap.enabled {
+		writeError(w, errInvalid("rpc.idmapd is not run by this gateway, start it with -idmapd"))
+		return
+	}
+	var req IDMapSettings
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err := g.update(func(tx *bolt.Tx) error {
+		data, err := json.Marshal(req)
+		if err != nil {
+			return errors.Wrap(err, "error marshaling idmap settings")
+		}
+		if err := tx.Bucket(settingsBucket).Put(idmapSettingsKey, data); err != nil {
+			return dbError(errors.Wrap(err, "error writing idmap settings"))
+		}
+		return writeIDMapConf(&req)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	daemons.restart("rpc.idmapd")
+	if err := flushIDMapCache(); err != nil {
+		requestLog(r).WithError(err).Warn("error flushing idmap cache")
+	}
+	g.getIDMap(w, r)
+}
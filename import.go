@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Imported volumes adopt an existing directory instead of creating one under
+// <root>/nfs. The gateway never removes their data: deleting an imported
+// volume only unexports it.
+
+// parseImportPaths parses the comma separated list of directories volumes may
+// be imported from.
+func parseImportPaths(s string) ([]string, error) {
+	var paths []string
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !filepath.IsAbs(p) {
+			return nil, errors.Errorf("import path must be absolute: %s", p)
+		}
+		paths = append(paths, filepath.Clean(p))
+	}
+	return paths, nil
+}
+
+// pathWithin reports whether p is dir or somewhere below it
+func pathWithin(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// importAllowed reports whether p is inside one of the allowed import paths
+func (g *gateway) importAllowed(p string) bool {
+	for _, dir := range g.importPaths {
+		if pathWithin(p, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkVolumePath makes sure a stored volume's path is one the gateway is
+// allowed to export.
+func (g *gateway) checkVolumePath(v *volume) error {
+	if v.Imported {
+		if !g.importAllowed(v.Export.Path) {
+			return errors.New("imported volume path is not in an allowed import path")
+		}
+		return nil
+	}
+	// aliases bind mount their volume's path, which is in its pool unless
+	// that volume was imported
+	aliasPath := v.AliasOf != "" && strings.HasPrefix(v.Source, filepath.Join(g.poolRoot(v.Pool), "nfs")+"/")
+	if v.Source != "" && !aliasPath && !g.importAllowed(v.Source) {
+		return errors.New("volume source is not in an allowed import path")
+	}
+	if v.Export.Path != g.nfsPath(v.Pool, v.Name) || !strings.HasPrefix(v.Export.Path, filepath.Join(g.poolRoot(v.Pool), "nfs")+"/") {
+		return errors.New("volume path is outside of its pool's data root")
+	}
+	return nil
+}
+
+// resolveImportPath validates the directory requested for import or as a
+// volume's source, returning its canonical path.
+func (g *gateway) resolveImportPath(field, p string) (string, error) {
+	if p == "" {
+		return "", errInvalid("must provide " + field)
+	}
+	if !filepath.IsAbs(p) {
+		return "", &validationError{Field: field, Value: p, Reason: "must be absolute"}
+	}
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", &validationError{Field: field, Value: p, Reason: "does not exist"}
+		}
+		return "", errors.Wrap(err, "error resolving import path")
+	}
+	fi, err := os.Stat(resolved)
+	if err != nil {
+		return "", errors.Wrap(err, "error resolving import path")
+	}
+	if !fi.IsDir() {
+		return "", &validationError{Field: field, Value: p, Reason: "must be a directory"}
+	}
+	if !g.importAllowed(resolved) {
+		return "", &validationError{Field: field, Value: p, Reason: "is not in an allowed import path"}
+	}
+	for _, pool := range g.pools.list() {
+		if pathWithin(pool.Path, resolved) {
+			return "", &validationError{Field: field, Value: p, Reason: "must not contain a data root"}
+		}
+	}
+	return resolved, nil
+}
+
+// checkPathConflict makes sure p doesn't overlap the data of another volume
+func checkPathConflict(tx *bolt.Tx, p string) error {
+	return forEachVolume(tx, func(data []byte) error {
+		var v volume
+		if err := json.Unmarshal(data, &v); err != nil {
+			return dbError(errors.Wrap(err, "error unmarshaling volume from database"))
+		}
+		if pathWithin(p, v.Export.Path) || pathWithin(v.Export.Path, p) {
+			return errAlreadyExists("path overlaps volume " + displayName(v.Name))
+		}
+		if v.Source != "" && (pathWithin(p, v.Source) || pathWithin(v.Source, p)) {
+			return errAlreadyExists("path overlaps the source of volume " + displayName(v.Name))
+		}
+		return nil
+	})
+}
+
+func (g *gateway) importVolume(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var req api.ImportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	if err := checkScope(r, name, req.Labels); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	v, err := g.adopt(r.Context(), scopedName(r, name), req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	b, err := json.Marshal(api.CreateResponse{Name: displayName(v.Name), Path: v.Export.Path})
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
+
+// adopt registers an existing directory as a volume and exports it
+func (g *gateway) adopt(ctx context.Context, name string, req api.ImportRequest) (*volume, error) {
+	if err := validateTenant(volumeTenant(name)); err != nil {
+		return nil, err
+	}
+	if err := validateSecurity(req.Security); err != nil {
+		return nil, err
+	}
+	if err := validateOptions(req.Options); err != nil {
+		return nil, err
+	}
+	if err := validateHosts(req.Hosts); err != nil {
+		return nil, err
+	}
+	if err := validateLabels(req.Labels); err != nil {
+		return nil, err
+	}
+	if err := validateDescription(req.Description); err != nil {
+		return nil, err
+	}
+	p, err := g.resolveImportPath("Path", req.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer g.locks.lock(name)()
+	var v *volume
+	err = g.updateUndo(ctx, name, func(tx *bolt.Tx, u *undoLog) error {
+		if getVolumeData(tx, name) != nil {
+			return errAlreadyExists("already exists")
+		}
+		if err := g.checkTenantConflict(tx, name); err != nil {
+			return err
+		}
+		if err := checkPathConflict(tx, p); err != nil {
+			return err
+		}
+
+		v = &volume{
+			Name: name,
+			Export: nfsExport{
+				Path:     p,
+				Hosts:    req.Hosts,
+				Options:  req.Options,
+				Security: req.Security,
+			},
+			Status:      api.VolumeAvailable,
+			Labels:      req.Labels,
+			Imported:    true,
+			ReadOnly:    req.ReadOnly,
+			Description: req.Description,
+		}
+		setCreated(ctx, v)
+		v.Export.Options = g.createOptions(v.Export.Options)
+		fsid, err := newFSID()
+		if err != nil {
+			return err
+		}
+		v.FSID = fsid
+		if err := g.checkQuota(tx, volumeTenant(name), v.sizeLimit()); err != nil {
+			return err
+		}
+
+		if err := putVolume(tx, v); err != nil {
+			return err
+		}
+		if tenant := volumeTenant(name); tenant != "" {
+			if _, err := g.updateQuota(tx, tenant); err != nil {
+				return err
+			}
+		}
+		u.add("unexport", func() error { return g.unexport(context.Background(), v) })
+		return g.export(ctx, v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	volumeEvent(eventVolumeCreated, v.Name, nil)
+	return v, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// nfsd counts the bytes read and written through each export, per client
+// spec, in /proc/fs/nfsd/export_stats. It doesn't count operations per export.
+// The counters belong to nfsd's export cache entries and start over whenever
+// an entry is replaced, which every exportfs run does, so they are sampled
+// and the deltas added up. Bytes moved between the last sample and an entry
+// being replaced aren't counted.
+
+func exportStatsFile() string {
+	return filepath.Join(nfsdProcDir, "export_stats")
+}
+
+type exportStatsKey struct {
+	path   string
+	client string
+}
+
+type exportCounters struct {
+	// start identifies the cache entry the counters belong to
+	start int64
+	read  uint64
+	write uint64
+	stale uint64
+}
+
+// parseExportStats reads entries of a path, client and start time line
+// followed by indented "name: value" counter lines
+func parseExportStats(data []byte) (map[exportStatsKey]*exportCounters, error) {
+	out := make(map[exportStatsKey]*exportCounters)
+	var cur *exportCounters
+	s := bufio.NewScanner(strings.NewReader(string(data)))
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if line[0] != '\t' && line[0] != ' ' {
+			if len(fields) < 3 {
+				return nil, errors.Errorf("invalid export stats entry %q", line)
+			}
+			start, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid export stats entry %q", line)
+			}
+			cur = &exportCounters{start: start}
+			out[exportStatsKey{path: unescapeExportPath(fields[0]), client: unescapeExportPath(fields[1])}] = cur
+			continue
+		}
+		if cur == nil || len(fields) != 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid export stats counter %q", line)
+		}
+		switch fields[0] {
+		case "io_read:":
+			cur.read = n
+		case "io_write:":
+			cur.write = n
+		case "fh_stale:":
+			cur.stale = n
+		}
+	}
+	return out, errors.Wrap(s.Err(), "error reading export stats")
+}
+
+// ioStatsCollector adds up the export counters since the gateway started
+type ioStatsCollector struct {
+	interval time.Duration
+	since    time.Time
+
+	mu        sync.Mutex
+	supported bool
+	sampled   time.Time
+	last      map[exportStatsKey]*exportCounters
+	// totals are by export path and client
+	totals map[string]map[string]*exportCounters
+}
+
+func newIOStatsCollector(interval time.Duration) *ioStatsCollector {
+	return &ioStatsCollector{
+		interval: interval,
+		since:    time.Now().UTC(),
+		last:     make(map[exportStatsKey]*exportCounters),
+		totals:   make(map[string]map[string]*exportCounters),
+	}
+}
+
+// sample adds the deltas since the last sample to the totals. The file is
+// read under the lock too, so samples are added in the order they're taken.
+func (c *ioStatsCollector) sample() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, err := ioutil.ReadFile(exportStatsFile())
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "error reading export stats")
+	}
+	c.supported = err == nil
+	if !c.supported {
+		return nil
+	}
+	current, err := parseExportStats(data)
+	if err != nil {
+		return err
+	}
+	for key, cur := range current {
+		delta := *cur
+		// counters of the same cache entry only grow, a new entry starts at 0
+		if prev := c.last[key]; prev != nil && prev.start == cur.start && cur.read >= prev.read && cur.write >= prev.write && cur.stale >= prev.stale {
+			delta.read -= prev.read
+			delta.write -= prev.write
+			delta.stale -= prev.stale
+		}
+		clients := c.totals[key.path]
+		if clients == nil {
+			clients = make(map[string]*exportCounters)
+			c.totals[key.path] = clients
+		}
+		t := clients[key.client]
+		if t == nil {
+			t = &exportCounters{}
+			clients[key.client] = t
+		}
+		t.read += delta.read
+		t.write += delta.write
+		t.stale += delta.stale
+	}
+	c.last = current
+	c.sampled = time.Now().UTC()
+	return nil
+}
+
+func (c *ioStatsCollector) run() {
+	for {
+		if err := c.sample(); err != nil {
+			logrus.WithError(err).Warn("error sampling export stats")
+		}
+		time.Sleep(c.interval)
+	}
+}
+
+// get returns the totals of an export path, nil when the kernel doesn't
+// count I/O per export
+func (c *ioStatsCollector) get(path string) *api.VolumeStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.supported {
+		return nil
+	}
+	st := &api.VolumeStats{Since: c.since, Sampled: c.sampled, Clients: []api.ExportClientStats{}}
+	clients := c.totals[path]
+	names := make([]string, 0, len(clients))
+	for name := range clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t := clients[name]
+		st.ReadBytes += t.read
+		st.WriteBytes += t.write
+		st.StaleFileHandles += t.stale
+		st.Clients = append(st.Clients, api.ExportClientStats{Client: name, ReadBytes: t.read, WriteBytes: t.write})
+	}
+	return st
+}
+
+func (g *gateway) getVolumeStats(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := g.kernelNFS("export statistics are"); err != nil {
+		writeError(w, err)
+		return
+	}
+	v, err := g.lookup(scopedName(r, name))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// sampled now so the totals are current, reading the file is cheap
+	if err := g.ioStats.sample(); err != nil {
+		writeError(w, err)
+		return
+	}
+	st := g.ioStats.get(v.Export.Path)
+	if st == nil {
+		writeError(w, errInvalid("the kernel doesn't count I/O per export, "+exportStatsFile()+" is missing"))
+		return
+	}
+	st.Name = displayName(v.Name)
+	b, err := json.Marshal(st)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+var jobsBucket = []byte("jobs")
+
+const (
+	jobQueued    = api.JobQueued
+	jobRunning   = api.JobRunning
+	jobSucceeded = api.JobSucceeded
+	jobFailed    = api.JobFailed
+)
+
+// finished jobs are kept around this long so clients can poll for the result,
+// they're pruned every jobPruneInterval
+const (
+	jobRetention     = 24 * time.Hour
+	jobPruneInterval = time.Hour
+)
+
+type job struct {
+	ID     string
+	Type   string
+	Volume string
+	Args   json.RawMessage `json:",omitempty"`
+	// RequestID is the id of the API request which submitted the job
+	RequestID string `json:",omitempty"`
+	Status    string
+	Progress  string `json:",omitempty"`
+	Error     string `json:",omitempty"`
+	// Result is set by runners whose job produces something, e.g. a volume
+	Result   json.RawMessage `json:",omitempty"`
+	Created  time.Time
+	Started  *time.Time `json:",omitempty"`
+	Finished *time.Time `json:",omitempty"`
+}
+
+// jobRunner executes a job. Runners must be safe to re-run from the start
+// since jobs interrupted by a restart are executed again.
+type jobRunner func(j *job, progress func(string)) error
+
+type jobManager struct {
+	db      *bolt.DB
+	queue   chan string
+	runners map[string]jobRunner
+}
+
+func newJobManager(db *bolt.DB) *jobManager {
+	return &jobManager{
+		db:      db,
+		queue:   make(chan string, 1024),
+		runners: make(map[string]jobRunner),
+	}
+}
+
+func (m *jobManager) register(typ string, fn jobRunner) {
+	m.runners[typ] = fn
+}
+
+// start launches the workers, re-queues any jobs which did not finish
+// before the last shutdown and prunes finished jobs from then on.
+func (m *jobManager) start(workers int) error {
+	if err := m.prune(time.Now().Add(-jobRetention)); err != nil {
+		return err
+	}
+	var pending []string
+	err := m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+			var j job
+			if err := json.Unmarshal(v, &j); err != nil {
+				return errors.Wrap(err, "error unmarshaling job from database")
+			}
+			if j.Status == jobQueued || j.Status == jobRunning {
+				pending = append(pending, j.ID)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < workers; i++ {
+		go m.worker()
+	}
+	for _, id := range pending {
+		m.enqueue(id)
+	}
+	go m.reap()
+	return nil
+}
+
+// reap prunes finished jobs older than the retention
+func (m *jobManager) reap() {
+	for {
+		time.Sleep(jobPruneInterval)
+		if err := m.prune(time.Now().Add(-jobRetention)); err != nil {
+			logrus.WithError(err).Error("error pruning jobs")
+		}
+	}
+}
+
+// prune deletes the jobs which finished before the given time
+func (m *jobManager) prune(before time.Time) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var j job
+			if err := json.Unmarshal(v, &j); err != nil {
+				return errors.Wrap(err, "error unmarshaling job from database")
+			}
+			if j.Finished != nil && j.Finished.Before(before) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return errors.Wrap(err, "error pruning jobs")
+			}
+		}
+		return nil
+	})
+}
+
+func (m *jobManager) enqueue(id string) {
+	select {
+	case m.queue <- id:
+	default:
+		go func() { m.queue <- id }()
+	}
+}
+
+// submit queues a job, requestID is empty for jobs the gateway starts itself
+func (m *jobManager) submit(requestID, typ, volume string, args interface{}) (*job, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	j := &job{
+		ID:        id,
+		Type:      typ,
+		Volume:    volume,
+		RequestID: requestID,
+		Status:    jobQueued,
+		Created:   time.Now().UTC(),
+	}
+	if args != nil {
+		j.Args, err = json.Marshal(args)
+		if err != nil {
+			return nil, errors.Wrap(err, "error marshaling job arguments")
+		}
+	}
+	if err := m.save(j); err != nil {
+		return nil, err
+	}
+	m.enqueue(j.ID)
+	return j, nil
+}
+
+func (m *jobManager) save(j *job) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling job")
+	}
+	return dbError(errors.Wrap(m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Put([]byte(j.ID), data)
+	}), "error writing job to database"))
+}
+
+func (m *jobManager) get(id string) (*job, error) {
+	var j *job
+	err := m.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(jobsBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		j = &job{}
+		return json.Unmarshal(data, j)
+	})
+	return j, dbError(errors.Wrap(err, "error reading job from database"))
+}
+
+func (m *jobManager) worker() {
+	for id := range m.queue {
+		j, err := m.get(id)
+		if err != nil || j == nil {
+			logrus.WithError(err).WithField("job", id).Error("error loading job")
+			continue
+		}
+		m.run(j)
+	}
+}
+
+func (m *jobManager) run(j *job) {
+	log := logrus.WithField("job", j.ID).WithField("type", j.Type)
+	if j.RequestID != "" {
+		log = log.WithField("request_id", j.RequestID)
+	}
+
+	now := time.Now().UTC()
+	j.Status = jobRunning
+	j.Started = &now
+	if err := m.save(j); err != nil {
+		log.WithError(err).Error("error updating job")
+	}
+
+	var err error
+	if fn, ok := m.runners[j.Type]; ok {
+		err = fn(j, func(p string) {
+			j.Progress = p
+			if err := m.save(j); err != nil {
+				log.WithError(err).Error("error updating job progress")
+			}
+		})
+	} else {
+		err = errors.Errorf("unknown job type: %s", j.Type)
+	}
+
+	finished := time.Now().UTC()
+	j.Finished = &finished
+	j.Status = jobSucceeded
+	if err != nil {
+		log.WithError(err).Error("job failed")
+		j.Status = jobFailed
+		j.Error = err.Error()
+	}
+	if err := m.save(j); err != nil {
+		log.WithError(err).Error("error updating job")
+	}
+}
+
+// writeJob responds with 202 and a pointer to the submitted job
+func writeJob(w http.ResponseWriter, j *job) {
+	b, err := json.Marshal(api.JobResponse{JobID: j.ID})
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Header().Set("Location", apiVersionPrefix+"/jobs/"+j.ID)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(b)
+}
+
+// jobInScope reports whether the job's volume is within the scope of the
+// request's token. Volumes which are gone, e.g. after a delete job, are only
+// checked by name since their labels aren't known anymore.
+func (g *gateway) jobInScope(r *http.Request, j *job) bool {
+	b := requestBinding(r)
+	if !b.scoped() {
+		return true
+	}
+	if j.Volume == "" {
+		return false
+	}
+	v, err := g.lookup(j.Volume)
+	if err != nil {
+		return len(b.selector) == 0 && b.allows(displayName(j.Volume), nil)
+	}
+	return b.allows(displayName(v.Name), v.Labels)
+}
+
+func (g *gateway) getJob(w http.ResponseWriter, r *http.Request) {
+	j, err := g.jobs.get(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if j == nil || volumeTenant(j.Volume) != requestTenant(r) || !g.jobInScope(r, j) {
+		writeError(w, errNotFound("job not found"))
+		return
+	}
+
+	b, err := json.Marshal(j)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
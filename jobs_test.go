@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+)
+
+// Tokens scoped to some volumes only see the jobs of those volumes, even
+// though GET /jobs/{id} has no volume in its path.
+func TestGetJobScope(t *testing.T) {
+	g, cleanup := newTestGateway(t)
+	defer cleanup()
+	jobs := make(map[string]string)
+	for _, name := range []string{"a", "b", "gone-a", "gone-b"} {
+		if _, err := g.addVolume(context.Background(), name, api.CreateRequest{}, "", true); err != nil {
+			t.Fatal(err)
+		}
+		j, err := g.jobs.submit("", jobDeleteVolume, name, deleteArgs{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs[name] = j.ID
+	}
+	for _, name := range []string{"gone-a", "gone-b"} {
+		if err := g.removeVolume(name, false, func(string) {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bindings, err := parseRoleBindings("tok=operator volume:a volume:gone-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	r.Methods("GET").Path("/jobs/{id}").HandlerFunc(g.getJob)
+	for name, want := range map[string]int{
+		"a":      http.StatusOK,
+		"b":      http.StatusNotFound,
+		"gone-a": http.StatusOK,
+		"gone-b": http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, withBinding(httptest.NewRequest("GET", "/jobs/"+jobs[name], nil), bindings[0]))
+		if rec.Code != want {
+			t.Errorf("job of %s: got %d, want %d", name, rec.Code, want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var securityFlavors = map[string]bool{
+	"sys":   true,
+	"krb5":  true,
+	"krb5i": true,
+	"krb5p": true,
+}
+
+// kerberos is set when the gss daemons were started and a keytab is present
+var kerberos struct {
+	enabled bool
+	keytab  string
+}
+
+// setupKerberos checks for a keytab and starts the gss daemons needed for
+// sec=krb5* exports.
+func setupKerberos(keytab string) error {
+	if _, err := os.Stat(keytab); err != nil {
+		return errors.Wrap(err, "kerberos keytab not available")
+	}
+	kerberos.enabled = true
+	kerberos.keytab = keytab
+
+	daemons.start("rpc.svcgssd", "/usr/sbin/rpc.svcgssd", "-f")
+	daemons.start("rpc.gssd", "/usr/sbin/rpc.gssd", "-f", "-k", keytab)
+	return nil
+}
+
+func validateSecurity(flavors []string) error {
+	for _, f := range flavors {
+		if !securityFlavors[f] {
+			return &validationError{Field: "Security", Value: f, Reason: "must be one of sys, krb5, krb5i, krb5p"}
+		}
+		if strings.HasPrefix(f, "krb5") {
+			if !kerberos.enabled {
+				return &validationError{Field: "Security", Value: f, Reason: "kerberos is not enabled on this gateway"}
+			}
+			// the keytab may have been removed since startup
+			if _, err := os.Stat(kerberos.keytab); err != nil {
+				return errors.Wrap(err, "kerberos keytab not available")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/pkg/errors"
+)
+
+const maxLabelLength = 253
+
+func validateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		switch {
+		case k == "":
+			return &validationError{Field: "Labels", Value: k, Reason: "label keys must not be empty"}
+		case len(k) > maxLabelLength || len(v) > maxLabelLength:
+			return &validationError{Field: "Labels", Value: k, Reason: "label keys and values must be at most 253 characters"}
+		case strings.ContainsAny(k, "=!,"):
+			return &validationError{Field: "Labels", Value: k, Reason: "label keys must not contain '=', '!' or ','"}
+		case strings.Contains(v, ","):
+			return &validationError{Field: "Labels", Value: v, Reason: "label values must not contain ','"}
+		}
+	}
+	return nil
+}
+
+// labelRequirement is a single term of a label selector: `key=value`,
+// `key!=value` or just `key` to require the label be set.
+type labelRequirement struct {
+	key    string
+	value  string
+	op     string
+	exists bool
+}
+
+func parseSelector(terms []string) ([]labelRequirement, error) {
+	var reqs []labelRequirement
+	for _, t := range terms {
+		for _, s := range strings.Split(t, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			var req labelRequirement
+			switch {
+			case strings.Contains(s, "!="):
+				parts := strings.SplitN(s, "!=", 2)
+				req = labelRequirement{key: parts[0], value: parts[1], op: "!="}
+			case strings.Contains(s, "="):
+				parts := strings.SplitN(s, "=", 2)
+				req = labelRequirement{key: parts[0], value: parts[1], op: "="}
+			default:
+				req = labelRequirement{key: s, exists: true}
+			}
+			if req.key == "" {
+				return nil, &validationError{Field: "label", Value: s, Reason: "selector must have a key"}
+			}
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs, nil
+}
+
+func matchLabels(labels map[string]string, reqs []labelRequirement) bool {
+	for _, req := range reqs {
+		v, ok := labels[req.key]
+		switch {
+		case req.exists && !ok:
+			return false
+		case req.op == "=" && (!ok || v != req.value):
+			return false
+		case req.op == "!=" && ok && v == req.value:
+			return false
+		}
+	}
+	return true
+}
+
+func (g *gateway) listVolumes(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, errInvalid(err.Error()))
+		return
+	}
+	selector, err := parseSelector(r.Form["label"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	vols, err := g.listScoped(r.Context(), selector)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := []api.GetResponse{}
+	for _, v := range vols {
+		etag, err := volumeETag(v)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		item := api.GetResponse{
+			Name:        displayName(v.Name),
+			Path:        v.Export.Path,
+			Labels:      v.Labels,
+			ReadOnly:    v.ReadOnly,
+			Mirror:      v.Mirror,
+			Description: v.Description,
+			Protocols:   v.protocols(),
+			Template:    v.Template,
+			ExpiresAt:   v.ExpiresAt,
+			AliasOf:     displayName(v.AliasOf),
+			CreatedBy:   v.CreatedBy,
+			CreatedAt:   v.CreatedAt,
+			UpdatedAt:   v.UpdatedAt,
+			ETag:        etag,
+		}
+		item.Status, item.StatusReason = v.status()
+		resp = append(resp, item)
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+// listScoped lists the volumes of the request ctx belongs to which match the
+// selector and are in its token's scope
+func (g *gateway) listScoped(ctx context.Context, selector []labelRequirement) ([]*volume, error) {
+	vols, err := g.list()
+	if err != nil {
+		return nil, err
+	}
+	tenant, binding := contextTenant(ctx), contextBinding(ctx)
+	var scoped []*volume
+	for _, v := range vols {
+		if volumeTenant(v.Name) == tenant && matchLabels(v.Labels, selector) && binding.allows(displayName(v.Name), v.Labels) {
+			scoped = append(scoped, v)
+		}
+	}
+	return scoped, nil
+}
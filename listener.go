@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const unixScheme = "unix://"
+
+// listen creates the API listener. Addresses prefixed with unix:// are
+// served on a unix socket with the given mode and owner, anything else is
+// treated as a TCP address.
+func listen(addr string, mode os.FileMode, owner string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixScheme) {
+		l, err := net.Listen("tcp", addr)
+		return l, errors.Wrap(err, "error setting up TCP listener")
+	}
+
+	p := strings.TrimPrefix(addr, unixScheme)
+	if p == "" {
+		return nil, errors.New("missing socket path")
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "error removing stale socket")
+	}
+
+	l, err := net.Listen("unix", p)
+	if err != nil {
+		return nil, errors.Wrap(err, "error setting up unix socket listener")
+	}
+	if err := os.Chmod(p, mode); err != nil {
+		l.Close()
+		return nil, errors.Wrap(err, "error setting socket mode")
+	}
+	if owner != "" {
+		uid, gid, err := lookupOwner(owner)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		if err := os.Chown(p, uid, gid); err != nil {
+			l.Close()
+			return nil, errors.Wrap(err, "error setting socket owner")
+		}
+	}
+	return l, nil
+}
+
+// lookupOwner parses an owner in the form user[:group], where each part is
+// either a name or a numeric id. An omitted group leaves the group unchanged.
+func lookupOwner(owner string) (int, int, error) {
+	parts := strings.SplitN(owner, ":", 2)
+	uid, err := lookupID(parts[0], func(n string) (string, error) {
+		u, err := user.Lookup(n)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	})
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "error looking up user %s", parts[0])
+	}
+
+	gid := -1
+	if len(parts) == 2 {
+		gid, err = lookupID(parts[1], func(n string) (string, error) {
+			g, err := user.LookupGroup(n)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "error looking up group %s", parts[1])
+		}
+	}
+	return uid, gid, nil
+}
+
+func lookupID(s string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, nil
+	}
+	id, err := lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
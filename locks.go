@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// keyedLocks hands out a mutex per key, which is dropped again once nobody
+// holds or waits for it. The zero value is ready to use.
+type keyedLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	// refs counts the holder and waiters
+	refs int
+}
+
+// lock locks every key and returns the function unlocking them. Keys are
+// locked in order so callers locking several can't deadlock each other.
+func (k *keyedLocks) lock(keys ...string) func() {
+	keys = append([]string(nil), keys...)
+	sort.Strings(keys)
+	uniq := keys[:0]
+	for i, key := range keys {
+		if i == 0 || key != keys[i-1] {
+			uniq = append(uniq, key)
+		}
+	}
+	keys = uniq
+
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	held := make([]*keyedLock, len(keys))
+	for i, key := range keys {
+		l, ok := k.locks[key]
+		if !ok {
+			l = &keyedLock{}
+			k.locks[key] = l
+		}
+		l.refs++
+		held[i] = l
+	}
+	k.mu.Unlock()
+
+	for _, l := range held {
+		l.Lock()
+	}
+	return func() {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		for i, l := range held {
+			l.Unlock()
+			if l.refs--; l.refs == 0 {
+				delete(k.locks, keys[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+)
+
+func TestKeyedLocksExclusive(t *testing.T) {
+	var k keyedLocks
+	var mu sync.Mutex
+	held := make(map[string]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		// every goroutine locks both keys, in either order
+		keys := []string{"a", "b"}
+		if i%2 == 1 {
+			keys = []string{"b", "a", "b"}
+		}
+		wg.Add(1)
+		go func(keys []string) {
+			defer wg.Done()
+			unlock := k.lock(keys...)
+			mu.Lock()
+			if held["a"] || held["b"] {
+				t.Error("keys locked twice at once")
+			}
+			held["a"], held["b"] = true, true
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			held["a"], held["b"] = false, false
+			mu.Unlock()
+			unlock()
+		}(keys)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlocked locking keys in different orders")
+	}
+	if len(k.locks) != 0 {
+		t.Fatalf("%d locks left after every key was unlocked", len(k.locks))
+	}
+}
+
+func TestKeyedLocksIndependent(t *testing.T) {
+	var k keyedLocks
+	unlock := k.lock("a")
+	defer unlock()
+	locked := make(chan struct{})
+	go func() {
+		k.lock("b")()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("locking b waited for a")
+	}
+}
+
+// Creates and deletes of the same volume racing each other must leave it
+// either fully there, stored, with its data and exported, or fully gone.
+func TestCreateDeleteRace(t *testing.T) {
+	g, cleanup := newTestGateway(t)
+	defer cleanup()
+	g.storage.delay = time.Millisecond
+
+	const name = "racy"
+	path := g.nfsPath("", name)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := g.create(context.Background(), name, api.CreateRequest{Hosts: []string{"h"}})
+			if err != nil {
+				if _, resp := toErrorResponse(err); resp.Code != api.ErrCodeAlreadyExists {
+					t.Errorf("error creating volume: %v", err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := g.removeVolume(name, false, func(string) {}); err != nil {
+				t.Errorf("error deleting volume: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if g.storage.overlaps > 0 {
+		t.Errorf("storage of the volume was worked on by %d calls at once", g.storage.overlaps)
+	}
+	stored := g.stored(t, name)
+	if exists(path) != stored {
+		t.Errorf("volume stored: %v, its data exists: %v", stored, exists(path))
+	}
+	if g.exporter.isExported(path) != stored {
+		t.Errorf("volume stored: %v, exported: %v", stored, g.exporter.isExported(path))
+	}
+
+	if stored {
+		if err := g.removeVolume(name, false, func(string) {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if g.stored(t, name) || exists(path) || g.exporter.isExported(path) {
+		t.Fatal("volume left behind after its final delete")
+	}
+}
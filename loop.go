@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const defaultLoopFSType = "ext4"
+
+var mkfsArgs = map[string][]string{
+	"ext4": {"-q", "-F"},
+	"xfs":  {"-q", "-f"},
+}
+
+type loopDevice struct {
+	Image     string
+	Device    string
+	FSType    string
+	SizeBytes int64
+}
+
+func (g *gateway) imagePath(pool, name string) string {
+	return filepath.Join(g.poolRoot(pool), "images", name+".img")
+}
+
+// createLoop allocates a sparse image file of the requested size and formats it.
+// The image is not attached to a loop device until mount is called.
+func createLoop(image, fsType string, size int64) (*loopDevice, error) {
+	args, ok := mkfsArgs[fsType]
+	if !ok {
+		return nil, errors.Errorf("unsupported filesystem type: %s", fsType)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(image), 0700); err != nil {
+		return nil, errors.Wrap(err, "error creating image dir")
+	}
+	f, err := os.OpenFile(image, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating volume image")
+	}
+	err = f.Truncate(size)
+	f.Close()
+	if err != nil {
+		os.Remove(image)
+		return nil, errors.Wrap(err, "error allocating volume image")
+	}
+
+	if err := cmd("mkfs."+fsType, append(args, image)...); err != nil {
+		os.Remove(image)
+		return nil, errors.Wrap(err, "error formatting volume image")
+	}
+
+	return &loopDevice{Image: image, FSType: fsType, SizeBytes: size}, nil
+}
+
+func (l *loopDevice) mount(target string) error {
+	out, err := runCommand("losetup", "--find", "--show", l.Image)
+	if err != nil {
+		return errors.Wrap(err, "error attaching loop device")
+	}
+	l.Device = strings.TrimSpace(string(out))
+
+	if err := unix.Mount(l.Device, target, l.FSType, 0, ""); err != nil {
+		cmd("losetup", "-d", l.Device)
+		return errors.Wrap(err, "error mounting volume image")
+	}
+	return nil
+}
+
+// grow enlarges the image and the filesystem on it while it's mounted at
+// target. Filesystems are only grown, neither ext4 nor xfs shrink online.
+func (l *loopDevice) grow(target string, size int64) error {
+	if l.Device == "" {
+		return errors.New("volume image is not attached to a loop device")
+	}
+	if err := os.Truncate(l.Image, size); err != nil {
+		return errors.Wrap(err, "error growing volume image")
+	}
+	if err := cmd("losetup", "-c", l.Device); err != nil {
+		return errors.Wrap(err, "error updating loop device capacity")
+	}
+	var err error
+	switch l.FSType {
+	case "xfs":
+		err = cmd("xfs_growfs", target)
+	default:
+		err = cmd("resize2fs", l.Device)
+	}
+	if err != nil {
+		return errors.Wrap(err, "error growing volume filesystem")
+	}
+	l.SizeBytes = size
+	return nil
+}
+
+func (l *loopDevice) unmount(target string) error {
+	if err := unix.Unmount(target, 0); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		return errors.Wrap(err, "error unmounting volume image")
+	}
+	if l.Device == "" {
+		return nil
+	}
+	// the kernel may have already released the device on unmount
+	cmd("losetup", "-d", l.Device)
+	l.Device = ""
+	return nil
+}
+
+func (l *loopDevice) destroy(target string) error {
+	if err := l.unmount(target); err != nil {
+		return err
+	}
+	if err := os.Remove(l.Image); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "error removing volume image")
+	}
+	return nil
+}
+
+// isMountpoint reports whether something is mounted at p by comparing its
+// device with the device of the parent dir.
+func isMountpoint(p string) (bool, error) {
+	var st, parent unix.Stat_t
+	if err := unix.Stat(p, &st); err != nil {
+		return false, err
+	}
+	if err := unix.Stat(filepath.Dir(p), &parent); err != nil {
+		return false, err
+	}
+	return st.Dev != parent.Dev, nil
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -11,29 +14,265 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/boltdb/bolt"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
-	"golang.org/x/sys/unix"
+	"github.com/soheilhy/cmux"
+	"google.golang.org/grpc"
 )
 
 var exportfsPath string
 
 func main() {
-	flListenAddr := flag.String("H", "127.0.0.1:80", "address to listen on")
+	flListenAddr := flag.String("H", "127.0.0.1:80", "address to listen on, either host:port or unix:///path/to/socket")
+	flSocketMode := flag.String("socket-mode", "0660", "file mode of the unix socket")
+	flSocketOwner := flag.String("socket-owner", "", "owner of the unix socket as user[:group]")
 	flDataRoot := flag.String("root", "/var/lib/nfsg", "location to store data")
+	flDrainTimeout := flag.Duration("drain-timeout", 30*time.Second, "how long to wait for in-flight requests on shutdown")
+	flPreserveExports := flag.Bool("preserve-exports-on-shutdown", false, "leave the volumes exported when the gateway stops so clients keep their mounts across restarts, POST /admin/decommission still removes them")
+	flJobWorkers := flag.Int("job-workers", 4, "number of workers executing async jobs")
+	flOrphanScanInterval := flag.Duration("orphan-scan-interval", 0, "how often to look for volume directories and exports without a volume and log them, 0 disables")
+	flUsageRefresh := flag.Duration("usage-refresh", 5*time.Minute, "how often volume disk usage is recalculated")
+	flIOStatsInterval := flag.Duration("io-stats-interval", time.Minute, "how often per-export I/O counters are sampled, bytes moved since the last sample are lost when exports are reloaded")
+	flMaxUploadSize := flag.String("max-upload-size", "10G", "largest archive, uncompressed, PUT /volume/{name}/data accepts, sizes may have a K, M, G or T suffix")
+	flTrashRetention := flag.Duration("trash-retention", 24*time.Hour, "how long deleted volumes can be restored, 0 deletes data immediately")
+	flNamePattern := flag.String("name-pattern", "", "regular expression volume names must match")
+	flNameMaxLen := flag.Int("name-max-length", 0, "maximum length of volume names")
+	flReservedNames := flag.String("reserved-names", "", "comma separated list of additional reserved volume names")
+	flBackend := flag.String("backend", "kernel", "NFS server to export volumes with: kernel, ganesha or embedded (experimental NFSv3 server built into the gateway)")
+	flGaneshaConfig := flag.String("ganesha-config", "/etc/ganesha/ganesha.conf", "ganesha.nfsd main config file")
+	flGaneshaExportsDir := flag.String("ganesha-exports-dir", "/etc/ganesha/nfsg.d", "directory to write ganesha export configs to")
+	flag.StringVar(&exportsDir, "exports-dir", exportsDir, "directory to write export files to")
+	flTLSCert := flag.String("tls-cert", "", "path to TLS certificate, enables TLS")
+	flTLSKey := flag.String("tls-key", "", "path to TLS key")
+	flTLSClientCA := flag.String("tls-client-ca", "", "path to CA bundle used to verify client certificates")
+	flAuthTokens := flag.String("auth-token", "", "comma separated list of accepted API bearer tokens")
+	flAuthTokenFile := flag.String("auth-token-file", "", "file containing accepted API bearer tokens, one per line")
+	flCSI := flag.String("csi", "", "unix socket to serve the CSI identity and controller services on, e.g. /csi/csi.sock, so kubernetes can provision volumes")
+	flCSINFSServer := flag.String("csi-nfs-server", "", "address CSI nodes mount volumes from, defaults to the HA floating IP or the hostname")
+	flOTLPEndpoint := flag.String("otlp-endpoint", "", "OTLP/HTTP collector to export trace spans of requests, database transactions and commands to, e.g. http://localhost:4318")
+	flGRPC := flag.Bool("grpc", false, "also serve the gRPC API of api/pb/volumes.proto on the API listener")
+	flAdminToken := flag.String("admin-token", "", "bearer token for the /debug endpoints, which are disabled on the API listener without one")
+	flDebugAddr := flag.String("debug-addr", "", "separate address to serve the /debug endpoints on, e.g. 127.0.0.1:6060")
+	flNFSPort := flag.Int("nfs-port", 2049, "port nfsd, or the embedded NFS server, listens on")
+	flSMB := flag.Bool("smb", false, "allow sharing volumes over SMB too, with the local Samba server")
+	flSMBSharesFile := flag.String("smb-shares-file", "/etc/samba/nfs-rest-gateway.conf", "file the SMB shares are written to, smb.conf must include it")
+	flMountdPort := flag.Int("mountd-port", 0, "port rpc.mountd listens on, 0 lets rpcbind pick one")
+	flStatdPort := flag.Int("statd-port", 0, "port rpc.statd listens on, 0 lets rpcbind pick one")
+	flStatdOutgoingPort := flag.Int("statd-outgoing-port", 0, "source port of rpc.statd reboot notifications, 0 lets rpcbind pick one")
+	flLockdPort := flag.Int("lockd-port", 0, "TCP and UDP port of the kernel lock manager, 0 lets rpcbind pick one")
+	flNFSv4Only := flag.Bool("nfsv4-only", false, "disable NFSv2 and v3 and export volumes through an NFSv4 pseudo-root, clients mount server:/volumes/<name>")
+	flNFSv4Root := flag.String("nfsv4-root", "/exports", "directory the NFSv4 pseudo-root is built in with -nfsv4-only")
+	flPreflight := flag.String("preflight", preflightStrict, "what to do when required NFS dependencies are missing: strict refuses to start, degraded serves the API without setting up NFS")
+	flDisableDaemons := flag.String("disable-daemons", "", "comma separated NFS daemons the gateway doesn't start, e.g. rpcbind,rpc.statd,sm-notify when the host runs them")
+	flGraceOnStart := flag.Bool("grace-on-start", true, "keep the NFSv4 grace period nfsd starts in so clients can reclaim state, disable on nodes which never take over clients from another server")
+	flag.StringVar(&ha.mode, "ha-mode", "", "active-passive HA role this node starts in: active, or standby to wait for POST /admin/ha/takeover")
+	flag.StringVar(&ha.device, "ha-device", "", "shared block device mounted at the data root by the active node, leave empty if the data root is shared some other way")
+	flag.StringVar(&ha.fstype, "ha-fstype", "ext4", "filesystem type of -ha-device")
+	flag.StringVar(&ha.floatingIP, "ha-floating-ip", "", "address with prefix length assigned to the active node, which clients mount from")
+	flag.StringVar(&ha.iface, "ha-interface", "", "network interface the floating IP is assigned to")
+	flKerberos := flag.Bool("kerberos", false, "start the gss daemons to allow sec=krb5* exports")
+	flKeytab := flag.String("keytab", "/etc/krb5.keytab", "kerberos keytab used by the gss daemons")
+	flSELinuxContext := flag.String("selinux-context", "", "SELinux context given to new volume directories and restored when reconciling, e.g. system_u:object_r:nfs_t:s0")
+	flIDMapd := flag.Bool("idmapd", false, "start rpc.idmapd to map NFSv4 owner names, configured through -idmap-domain or /admin/idmap")
+	flIDMapDomain := flag.String("idmap-domain", "", "NFSv4 domain of rpc.idmapd, which clients must use too, defaults to the host's DNS domain")
+	flIDMapdConf := flag.String("idmapd-conf", "/etc/idmapd.conf", "idmapd.conf written for rpc.idmapd")
+	flDefaultOptions := flag.String("default-export-options", "", "export options used when a volume is created without any")
+	flAllowOptions := flag.String("export-options-allow", "", "comma separated list of the only export options clients may set, e.g. rw,ro,sync,anonuid")
+	flDenyOptions := flag.String("export-options-deny", "", "comma separated list of export options clients may not set, e.g. no_root_squash,insecure")
+	flResolveHosts := flag.String("resolve-hosts", resolveHostsOff, "look up export hostnames when volumes are exported to them: off, warn (log unresolvable hosts) or reject")
+	flMergeOptions := flag.Bool("merge-export-options", false, "layer volume export options over -default-export-options instead of replacing them")
+	flS3Endpoint := flag.String("s3-endpoint", "", "S3 compatible endpoint to store backups in, e.g. https://s3.us-east-1.amazonaws.com")
+	flS3Region := flag.String("s3-region", "us-east-1", "region used to sign S3 requests")
+	flS3Bucket := flag.String("s3-bucket", "", "bucket to store backups in")
+	flS3AccessKey := flag.String("s3-access-key", "", "S3 access key, defaults to $AWS_ACCESS_KEY_ID")
+	flS3SecretKey := flag.String("s3-secret-key", "", "S3 secret key, defaults to $AWS_SECRET_ACCESS_KEY")
+	flTenantQuotas := flag.String("tenant-quotas", "", "comma separated tenant=size storage limits, sizes may have a K, M, G or T suffix")
+	flStorage := flag.String("storage", "dir", "how volume data is stored: dir (directories under the data root), zfs (a dataset per volume) or btrfs (a subvolume per volume)")
+	flQuotaBackend := flag.String("quota-backend", quotaBackendLoop, "how volume sizes are enforced with -storage=dir: loop (a loop mounted image per volume) or project (xfs/ext4 project quotas on the data root)")
+	flZFSParent := flag.String("zfs-parent", "", "dataset volumes are created under with -storage=zfs, e.g. tank/nfsg")
+	flZFSCompression := flag.String("zfs-compression", "", "compression property of new datasets, inherited from the parent by default")
+	flZFSReserve := flag.Bool("zfs-reserve", false, "reserve the full size of sized volumes in the pool")
+	flPools := flag.String("pools", "", "comma separated name=path storage pools volumes are placed in besides the data root, which is the default pool")
+	flPlacement := flag.String("placement", placeMostFree, "how new volumes are placed in pools: most-free (the pool with the most space available) or round-robin")
+	flImportPaths := flag.String("import-paths", "", "comma separated list of directories existing data may be imported from as volumes")
+	flExpireInterval := flag.Duration("expire-interval", time.Minute, "how often expired volumes are looked for and deleted, 0 disables")
+	flScrubInterval := flag.Duration("scrub-interval", 0, "how often volume data is verified against checksums or scrubbed with zfs/btrfs, 0 disables")
+	flReconcileInterval := flag.Duration("reconcile-interval", 5*time.Minute, "how often exports are checked against the database, 0 disables")
+	flMetadataStore := flag.String("metadata-store", "bolt", "where volume metadata is kept: bolt (only the local database) or consul (mirrored to consul so gateways can share it)")
+	flConsulAddr := flag.String("consul-addr", "http://127.0.0.1:8500", "address of the consul agent with -metadata-store=consul")
+	flConsulPrefix := flag.String("consul-prefix", "nfsg", "consul KV prefix metadata is kept under")
+	flConsulToken := flag.String("consul-token", "", "consul ACL token, defaults to $CONSUL_HTTP_TOKEN")
+	flDBBackupInterval := flag.Duration("db-backup-interval", 0, "how often a snapshot of the database is written to -db-backup-dir, 0 disables")
+	flDBBackupDir := flag.String("db-backup-dir", "", "directory database snapshots are written to, defaults to db-backups in the data root")
+	flDBBackupKeep := flag.Int("db-backup-keep", 7, "number of database snapshots to keep in -db-backup-dir")
+	flDBBackupS3 := flag.Bool("db-backup-s3", false, "also upload database snapshots to the -s3-bucket")
+	flSidecars := flag.Bool("volume-sidecars", true, "write each volume's record to a sidecar file next to it in the data root")
+	flRecoverVolumes := flag.Bool("recover-volumes", false, "add volumes found in sidecar files to the database on startup, to rebuild a lost database")
+	flRateLimit := flag.Float64("rate-limit", 0, "requests per second each API token, or client address without auth, may send, 0 disables")
+	flRateBurst := flag.Int("rate-burst", 0, "requests a client may send at once above -rate-limit, defaults to one second's worth")
+	flGlobalRateLimit := flag.Float64("global-rate-limit", 0, "requests per second accepted from all clients together, 0 disables")
+	flGlobalRateBurst := flag.Int("global-rate-burst", 0, "requests accepted at once above -global-rate-limit, defaults to one second's worth")
+	flMaxInflight := flag.Int("max-inflight", 0, "maximum number of mutating requests handled at once, 0 is unlimited")
+	flMaxClientInflight := flag.Int("max-inflight-per-client", 0, "maximum number of mutating requests handled at once per client, 0 is unlimited")
+	flRequestTimeout := flag.Duration("request-timeout", 5*time.Minute, "how long API requests may take before they fail with a 504, 0 disables")
+	flRouteTimeouts := flag.String("route-timeouts", "", "comma separated METHOD /path=duration timeouts of individual routes overriding -request-timeout, e.g. POST /volume=10m, paths as in /openapi.json")
+	flExportfsTimeout := flag.Duration("exportfs-timeout", 2*time.Minute, "how long exportfs may run before it's killed, 0 disables")
+	flRBAC := flag.String("rbac", "", "comma separated TOKEN=ROLE role bindings, roles being reader, operator or admin, optionally followed by volume:NAME and label:SELECTOR terms limiting the token to those volumes")
+	flDefaultRole := flag.String("default-role", roleAdmin, "role of API tokens without a role binding, tokens of a tenant are at most operators")
+	flOIDCIssuer := flag.String("oidc-issuer", "", "issuer URL of an OIDC provider whose JWTs are accepted as API tokens besides the static ones")
+	flOIDCAudience := flag.String("oidc-audience", "", "audience JWTs from -oidc-issuer must be issued for")
+	flOIDCTenantClaim := flag.String("oidc-tenant-claim", "", "JWT claim holding the token's tenant, dots separating nested claims, all JWTs belong to the default tenant if empty")
+	flOIDCRoleClaim := flag.String("oidc-role-claim", "", "JWT claim holding the token's roles or groups, dots separating nested claims, e.g. realm_access.roles, JWTs without a role have no access")
+	flOIDCRoleMap := flag.String("oidc-role-map", "", "comma separated VALUE=ROLE pairs mapping values of -oidc-role-claim to roles, values which are role names map to that role")
+	flOIDCKeysRefresh := flag.Duration("oidc-keys-refresh", time.Hour, "how long the signing keys of -oidc-issuer are cached")
+	flConfigFile := flag.String("config", "", "TOML file to read settings from, keys are flag names")
 	flag.Parse()
 
-	var err error
-	exportfsPath, err = exec.LookPath("exportfs")
-	exitOnError(err, "could not find required binary 'exportfs'")
+	config := newConfigFile(*flConfigFile, flag.CommandLine)
+	exitOnError(config.apply(nil), "error loading config")
+
+	err := setNamePolicy(*flNamePattern, *flNameMaxLen, *flReservedNames)
+	exitOnError(err, "invalid volume name policy")
+	err = setOptionPolicy(*flAllowOptions, *flDenyOptions)
+	exitOnError(err, "invalid export option policy")
+	if *flOTLPEndpoint != "" {
+		tracing = newTracer(*flOTLPEndpoint)
+		go tracing.run()
+	}
+	err = setResolveHosts(*flResolveHosts)
+	exitOnError(err, "invalid -resolve-hosts")
+	err = parseOptions(*flDefaultOptions)
+	exitOnError(err, "invalid -default-export-options")
+
+	ha.root = *flDataRoot
+	exitOnError(ha.validate(), "invalid HA settings")
+	if ha.enabled() && *flBackend != "kernel" {
+		exitOnError(errors.New("HA mode requires the kernel backend"), "invalid -backend")
+	}
+	// the shared device can't be released while it's exported
+	if ha.enabled() && *flPreserveExports {
+		exitOnError(errors.New("exports can't be preserved in HA mode"), "invalid -preserve-exports-on-shutdown")
+	}
+
+	if *flPreflight != preflightStrict && *flPreflight != preflightDegraded {
+		exitOnError(errors.Errorf("unknown mode %q", *flPreflight), "invalid -preflight")
+	}
+	exitOnError(daemons.disable(splitTokens(*flDisableDaemons)), "invalid -disable-daemons")
+	preflight := runPreflight(*flBackend, *flNFSv4Only)
+	nfsReady := logPreflight(preflight, *flPreflight)
+
+	var exp exporter
+	switch *flBackend {
+	case "kernel":
+		// the preflight checked it's there
+		exportfsPath, _ = exec.LookPath("exportfs")
+		err = os.MkdirAll(exportsDir, 0755)
+		exitOnError(err, "error making exports dir")
+		exp = kernelExporter{}
+		if *flNFSv4Only {
+			nfsv4Only = true
+			exp, err = newV4Exporter(*flNFSv4Root)
+			exitOnError(err, "error setting up nfsv4 root")
+		}
+	case "ganesha":
+		if *flNFSv4Only {
+			exitOnError(errors.New("-nfsv4-only requires the kernel backend"), "invalid -backend")
+		}
+		exp = &ganeshaExporter{configDir: *flGaneshaExportsDir}
+	case "embedded":
+		if *flNFSv4Only {
+			exitOnError(errors.New("-nfsv4-only requires the kernel backend"), "invalid -backend")
+		}
+		exp, err = newEmbeddedExporter(net.JoinHostPort("", strconv.Itoa(*flNFSPort)))
+		exitOnError(err, "error starting embedded NFS server")
+	default:
+		exitOnError(errors.Errorf("unknown backend %q", *flBackend), "invalid -backend")
+	}
+
+	tokens, err := loadTokens(*flAuthTokens, *flAuthTokenFile)
+	exitOnError(err, "error loading auth tokens")
+	if len(tokens) == 0 && *flOIDCIssuer == "" {
+		logrus.Warn("no API tokens configured, authentication is disabled")
+	}
+
+	auth, err := newTokenAuth(tokens)
+	exitOnError(err, "invalid auth tokens")
+	if *flOIDCIssuer != "" {
+		auth.oidc, err = newOIDCVerifier(*flOIDCIssuer, *flOIDCAudience, *flOIDCTenantClaim, *flOIDCRoleClaim, *flOIDCRoleMap, *flOIDCKeysRefresh)
+		exitOnError(err, "invalid OIDC settings")
+	}
+
+	socketMode, err := strconv.ParseUint(*flSocketMode, 8, 32)
+	exitOnError(err, "invalid socket mode")
+	l, err := listen(*flListenAddr, os.FileMode(socketMode), *flSocketOwner)
+	exitOnError(err, "error setting up listener")
+	defer l.Close()
+	if strings.HasPrefix(*flListenAddr, unixScheme) {
+		defer os.Remove(strings.TrimPrefix(*flListenAddr, unixScheme))
+	}
+
+	if *flTLSCert != "" || *flTLSKey != "" {
+		tlsConfig, err := makeTLSConfig(*flTLSCert, *flTLSKey, *flTLSClientCA)
+		exitOnError(err, "error setting up TLS")
+		l = tls.NewListener(l, tlsConfig)
+	} else if *flTLSClientCA != "" {
+		exitOnError(errors.New("-tls-client-ca requires -tls-cert and -tls-key"), "error setting up TLS")
+	}
+
+	// gRPC connections are told apart by their content type, the rest are
+	// served by the HTTP server
+	volumesAPI := &grpcAPI{}
+	var grpcSrv *grpc.Server
+	serveGRPC := func() {}
+	if *flGRPC {
+		grpcSrv = newGRPCServer(volumesAPI)
+		m := cmux.New(l)
+		grpcL := m.MatchWithWriters(cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"))
+		l = m.Match(cmux.Any())
+		serveGRPC = func() {
+			go grpcSrv.Serve(grpcL)
+			go m.Serve()
+		}
+	}
+
+	handler := &handlerSwitch{}
+	srv := &http.Server{Handler: handler}
+	served := make(chan error, 1)
+	var serveOnce sync.Once
+	serve := func() {
+		serveOnce.Do(func() {
+			go func() { served <- srv.Serve(l) }()
+			serveGRPC()
+		})
+	}
+
+	// a standby's data root is only available once it takes over
+	switch ha.mode {
+	case haActive:
+		exitOnError(ha.acquire(), "error taking over as the active node")
+	case haStandby:
+		serve()
+		exitOnError(waitForTakeover(handler, auth, served), "error waiting for takeover")
+	}
+	defer ha.release()
 
 	err = os.MkdirAll(filepath.Join(*flDataRoot, "nfs"), 0755)
 	exitOnError(err, "error making data root")
 
+	switch *flQuotaBackend {
+	case quotaBackendLoop, quotaBackendProject:
+	default:
+		exitOnError(errors.Errorf("unknown quota backend %q", *flQuotaBackend), "invalid -quota-backend")
+	}
+
 	db, err := bolt.Open(filepath.Join(*flDataRoot, "volumes.db"), 0600, &bolt.Options{
 		Timeout: 10 * time.Second,
 	})
@@ -41,33 +280,438 @@ func main() {
 	defer db.Close()
 
 	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(volumesBucket)
-		return err
+		for _, bucket := range dbBuckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return errors.Wrapf(err, "error creating %s bucket", bucket)
+			}
+		}
+		return nil
 	})
-	exitOnError(err, "error creating volume bucket in database")
+	exitOnError(err, "error creating buckets in database")
+
+	pools, err := parsePools(*flDataRoot, *flPools, *flPlacement)
+	exitOnError(err, "invalid -pools")
+	exitOnError(pools.load(db), "error loading pools")
+	for _, p := range pools.list() {
+		// pools are disks of their own, a missing one must not fill the root
+		_, err := os.Stat(p.Path)
+		exitOnError(err, "error checking pool "+p.Name)
+		exitOnError(os.MkdirAll(filepath.Join(p.Path, "nfs"), 0755), "error making pool "+p.Name)
+		if *flQuotaBackend == quotaBackendProject && *flStorage == "dir" {
+			exitOnError(checkProjectQuotas(filepath.Join(p.Path, "nfs")), "project quotas are not available in pool "+p.Name)
+		}
+	}
 
-	err = setupNFS()
+	if *flSidecars {
+		sidecarDir = filepath.Join(*flDataRoot, "nfs")
+	}
+	exitOnError(validateSELinuxContext(*flSELinuxContext), "invalid -selinux-context")
+	if *flSELinuxContext != "" && !selinuxEnabled() {
+		logrus.Warn("SELinux is not enabled, -selinux-context is only stored as an xattr")
+	}
+	selinuxContext = *flSELinuxContext
+
+	_, err = checkVolumeNames(db)
+	exitOnError(err, "error checking existing volume names")
+
+	switch {
+	case !nfsReady:
+		// degraded, the preflight failed
+	case *flBackend == "ganesha":
+		err = setupGanesha(*flGaneshaConfig, *flGaneshaExportsDir)
+	case *flBackend == "embedded":
+		// the server runs in the gateway, there's nothing to start
+	default:
+		var nfsd *NFSDSettings
+		nfsd, err = loadNFSDSettings(db)
+		exitOnError(err, "error loading nfsd settings")
+		var grace *GraceSettings
+		grace, err = loadGraceSettings(db)
+		exitOnError(err, "error loading grace settings")
+		if ha.enabled() && (grace == nil || grace.RecoveryDir == "") {
+			if grace == nil {
+				grace = &GraceSettings{}
+			}
+			grace.RecoveryDir = ha.recoveryDir()
+		}
+		nfsPorts = NFSPorts{NFS: *flNFSPort, Mountd: *flMountdPort, Statd: *flStatdPort, StatdOutgoing: *flStatdOutgoingPort, Lockd: *flLockdPort}
+		exitOnError(nfsPorts.validate(), "invalid NFS ports")
+		err = setupNFS(nfsd, grace, nfsPorts)
+		// a node taking over always gives clients their grace period
+		if err == nil && !*flGraceOnStart && !ha.enabled() {
+			go endGraceOnStart()
+		}
+		if err == nil && *flKerberos {
+			err = setupKerberos(*flKeytab)
+		}
+		if err == nil && *flIDMapd {
+			var stored *IDMapSettings
+			stored, err = loadIDMapSettings(db)
+			exitOnError(err, "error loading idmap settings")
+			err = setupIDMap(*flIDMapdConf, IDMapSettings{Domain: *flIDMapDomain}, stored)
+		}
+	}
 	exitOnError(err, "error preparing NFS")
 
-	g := &gateway{root: *flDataRoot, db: db}
-	go handleShutdown(g)
+	g := &gateway{root: *flDataRoot, db: db, auth: auth, jobs: newJobManager(db), exporter: exp, pools: pools, preflight: preflight}
+	switch *flMetadataStore {
+	case "bolt":
+	case "consul":
+		g.mirror = newStoreMirror(g, newConsulStore(*flConsulAddr, *flConsulToken, *flConsulPrefix))
+		exitOnError(g.mirror.start(), "error syncing metadata with consul")
+	default:
+		exitOnError(errors.Errorf("unknown metadata store %q", *flMetadataStore), "invalid -metadata-store")
+	}
+	g.usage = newUsageCollector(g, *flUsageRefresh)
+	g.ioStats = newIOStatsCollector(*flIOStatsInterval)
+	g.trashRetention = *flTrashRetention
+	g.maxUploadSize, err = parseSize(*flMaxUploadSize)
+	exitOnError(err, "invalid -max-upload-size")
+	g.preserveExports = *flPreserveExports
+	g.decommission = make(chan struct{})
+	routeTimeouts, err := parseRouteTimeouts(*flRouteTimeouts)
+	exitOnError(err, "invalid -route-timeouts")
+	g.timeouts = &requestTimeouts{def: *flRequestTimeout, routes: routeTimeouts}
+	exportSync.timeout = *flExportfsTimeout
+	g.limits = newLimiter(*flRateLimit, *flRateBurst, *flGlobalRateLimit, *flGlobalRateBurst, *flMaxInflight, *flMaxClientInflight)
+	// defaults changed through the API replace the flags
+	defaults, err := loadExportDefaults(db)
+	exitOnError(err, "error loading export defaults")
+	if defaults == nil {
+		defaults = &ExportDefaults{Options: *flDefaultOptions, Merge: *flMergeOptions}
+	}
+	g.setExportDefaults(*defaults)
+	exitOnError(g.loadNetgroups(), "error loading netgroups")
+	g.admin.set(*flAdminToken)
+	bindings, err := parseRoleBindings(*flRBAC)
+	exitOnError(err, "invalid -rbac")
+	g.rbac = &rbac{}
+	exitOnError(g.rbac.setStatic(bindings, *flDefaultRole), "invalid -rbac")
+	exitOnError(g.rbac.load(db), "error loading role bindings")
+	quotas, err := parseQuotas(*flTenantQuotas)
+	exitOnError(err, "invalid -tenant-quotas")
+	g.setQuotas(quotas)
+	dir := dirStorage{g: g, quotaBackend: *flQuotaBackend}
+	switch *flStorage {
+	case "dir":
+		g.storage = dir
+	case "zfs":
+		g.storage, err = newZFSStorage(dir, *flZFSParent, *flZFSCompression, *flZFSReserve)
+		exitOnError(err, "error setting up zfs storage")
+	case "btrfs":
+		for _, p := range g.pools.list() {
+			g.storage, err = newBtrfsStorage(dir, filepath.Join(p.Path, "nfs"))
+			exitOnError(err, "error setting up btrfs storage in pool "+p.Name)
+		}
+	default:
+		exitOnError(errors.Errorf("unknown storage %q", *flStorage), "invalid -storage")
+	}
+	g.storage = sourceStorage{storage: g.storage, g: g}
+	g.importPaths, err = parseImportPaths(*flImportPaths)
+	exitOnError(err, "invalid -import-paths")
+	if *flS3Endpoint != "" || *flS3Bucket != "" {
+		if *flS3Endpoint == "" || *flS3Bucket == "" {
+			exitOnError(errors.New("-s3-endpoint and -s3-bucket must be set together"), "invalid backup settings")
+		}
+		g.s3 = newS3Client(*flS3Endpoint, *flS3Region, *flS3Bucket, *flS3AccessKey, *flS3SecretKey)
+	}
+	if *flSMB {
+		g.smb, err = newSMBSharer(g, *flSMBSharesFile)
+		exitOnError(err, "error setting up samba")
+		go g.smb.run()
+	}
+	g.reloadConfig = func() error {
+		if err := config.apply(reloadableSettings); err != nil {
+			return err
+		}
+		tokens, err := loadTokens(*flAuthTokens, *flAuthTokenFile)
+		if err != nil {
+			return err
+		}
+		if err := g.auth.set(tokens); err != nil {
+			return err
+		}
+		if err := parseOptions(*flDefaultOptions); err != nil {
+			return err
+		}
+		stored, err := loadExportDefaults(g.db)
+		if err != nil {
+			return err
+		}
+		if stored == nil {
+			g.setExportDefaults(ExportDefaults{Options: *flDefaultOptions, Merge: *flMergeOptions})
+		}
+		g.admin.set(*flAdminToken)
+		bindings, err := parseRoleBindings(*flRBAC)
+		if err != nil {
+			return err
+		}
+		if err := g.rbac.setStatic(bindings, *flDefaultRole); err != nil {
+			return err
+		}
+		quotas, err := parseQuotas(*flTenantQuotas)
+		if err != nil {
+			return err
+		}
+		g.setQuotas(quotas)
+		logrus.Info("configuration reloaded")
+		return nil
+	}
+	go handleReload(g)
+	g.jobs.register(jobDeleteVolume, func(j *job, progress func(string)) error {
+		// jobs queued before deletes could be forced have no arguments
+		var args deleteArgs
+		if len(j.Args) > 0 {
+			if err := json.Unmarshal(j.Args, &args); err != nil {
+				return errors.Wrap(err, "error decoding job arguments")
+			}
+		}
+		return g.removeVolume(j.Volume, args.Force, progress)
+	})
+	g.jobs.register(jobBackupVolume, g.runBackup)
+	g.jobs.register(jobRestoreBackup, g.runRestore)
+	g.jobs.register(jobCloneVolume, g.runClone)
+	g.jobs.register(jobMigrateVolume, g.runMigrate)
+	handler.set(makeRouter(g))
+	volumesAPI.set(g)
+	drained := make(chan struct{})
+	go func() {
+		handleShutdown(srv, *flDrainTimeout, g.decommission)
+		close(drained)
+	}()
+
+	if *flRecoverVolumes {
+		if sidecarDir == "" {
+			exitOnError(errors.New("-recover-volumes requires -volume-sidecars"), "error recovering volumes")
+		}
+		n, err := g.recoverVolumes()
+		exitOnError(err, "error recovering volumes")
+		logrus.WithField("volumes", n).Info("recovered volumes from sidecars")
+	}
+
 	err = g.Reload()
 	exitOnError(err, "error on reload")
 
-	l, err := net.Listen("tcp", *flListenAddr)
-	exitOnError(err, "error setting up TCP listener")
-	defer l.Close()
+	exitOnError(g.loadMaintenance(), "error loading maintenance state")
+	err = g.jobs.start(*flJobWorkers)
+	exitOnError(err, "error starting job workers")
+	go g.usage.run()
+	if g.kernelNFS("export statistics are") == nil {
+		go g.ioStats.run()
+	}
+	if g.trashRetention > 0 {
+		go g.reapTrash()
+	}
+	go g.runPolicies(time.Minute)
+	go g.runReplication(30 * time.Second)
+	go g.runWebhooks()
+	go g.reapIdempotencyKeys()
+	if *flDBBackupInterval > 0 {
+		if *flDBBackupKeep < 1 {
+			exitOnError(errors.New("must keep at least one snapshot"), "invalid -db-backup-keep")
+		}
+		if *flDBBackupS3 && g.s3 == nil {
+			exitOnError(errors.New("-db-backup-s3 requires -s3-endpoint and -s3-bucket"), "invalid backup settings")
+		}
+		dir := *flDBBackupDir
+		if dir == "" {
+			dir = filepath.Join(*flDataRoot, "db-backups")
+		}
+		go g.runDBBackups(*flDBBackupInterval, dir, *flDBBackupKeep, *flDBBackupS3)
+	}
+	if *flScrubInterval > 0 {
+		go g.runScrub(*flScrubInterval)
+	}
+	if *flExpireInterval > 0 {
+		go g.runExpiry(*flExpireInterval)
+	}
+	if *flOrphanScanInterval > 0 {
+		go g.runOrphanScan(*flOrphanScanInterval)
+	}
+	if _, ok := g.exporter.(exportLister); ok && *flReconcileInterval > 0 {
+		go g.runReconcile(*flReconcileInterval)
+	}
+
+	if *flDebugAddr != "" {
+		exitOnError(serveDebug(*flDebugAddr, &g.admin), "error setting up debug listener")
+	}
 
-	router := makeRouter(g)
-	http.Serve(l, router)
+	stopCSI := func() {}
+	if *flCSI != "" {
+		stopCSI, err = serveCSI(*flCSI, *flCSINFSServer, g)
+		exitOnError(err, "error setting up CSI listener")
+	}
+
+	serve()
+	if err := <-served; err != http.ErrServerClosed {
+		exitOnError(err, "error serving API")
+	}
+	<-drained
+	if grpcSrv != nil {
+		stopGRPC(grpcSrv, *flDrainTimeout)
+	}
+	stopCSI()
+	g.Shutdown()
+	if tracing != nil {
+		tracing.stop()
+	}
+	// the shared device can't be unmounted with the database open
+	db.Close()
 }
 
-func makeRouter(g *gateway) *mux.Router {
+func makeRouter(g *gateway) http.Handler {
 	r := mux.NewRouter()
-	r.Methods("POST").Path("/volume").HandlerFunc(g.createVolume)
-	r.Methods("GET").Path("/volume/{name}").HandlerFunc(g.getVolume)
-	r.Methods("DELETE").Path("/volume/{name}").HandlerFunc(g.deleteVolume)
-	return r
+	r.Methods("GET").Path("/volumes").HandlerFunc(instrument("list", g.listVolumes))
+	r.Methods("POST").Path("/volume").HandlerFunc(instrument("create", g.idempotent(g.createVolume)))
+	r.Methods("POST").Path("/volumes/batch").HandlerFunc(instrument("create", g.idempotent(g.createVolumes)))
+	r.Methods("PUT").Path("/volumes/{name}").HandlerFunc(instrument("apply", g.applyVolume))
+	r.Methods("GET").Path("/volume/{name}").HandlerFunc(instrument("get", g.getVolume))
+	r.Methods("PATCH").Path("/volume/{name}").HandlerFunc(instrument("update", g.updateVolume))
+	r.Methods("DELETE").Path("/volume/{name}").HandlerFunc(instrument("delete", g.idempotent(g.deleteVolume)))
+	r.Methods("POST").Path("/volume/{name}/restore-trash").HandlerFunc(g.restoreTrash)
+	r.Methods("POST").Path("/volume/{name}/import").HandlerFunc(g.importVolume)
+	r.Methods("POST").Path("/volume/{name}/clone").HandlerFunc(g.cloneVolume)
+	r.Methods("POST").Path("/volume/{name}/rename").HandlerFunc(g.renameVolume)
+	r.Methods("GET").Path("/volume/{name}/usage").HandlerFunc(g.getUsage)
+	r.Methods("GET").Path("/volume/{name}/stats").HandlerFunc(g.getVolumeStats)
+	r.Methods("GET").Path("/volume/{name}/clients").HandlerFunc(g.listVolumeClients)
+	r.Methods("GET").Path("/volume/{name}/acl").HandlerFunc(g.getACL)
+	r.Methods("PUT").Path("/volume/{name}/acl").HandlerFunc(instrument("update", g.setACL))
+	r.Methods("POST").Path("/volume/{name}/hosts").HandlerFunc(instrument("update", g.addHost))
+	// hosts may be CIDRs, so allow slashes in the last segment
+	r.Methods("DELETE").Path("/volume/{name}/hosts/{host:.+}").HandlerFunc(instrument("update", g.removeHost))
+	r.Methods("GET").Path("/volume/{name}/access").HandlerFunc(g.listAccessRules)
+	r.Methods("POST").Path("/volume/{name}/access").HandlerFunc(instrument("update", g.createAccessRule))
+	r.Methods("GET").Path("/volume/{name}/access/{id}").HandlerFunc(g.getAccessRule)
+	r.Methods("PUT").Path("/volume/{name}/access/{id}").HandlerFunc(instrument("update", g.putAccessRule))
+	r.Methods("DELETE").Path("/volume/{name}/access/{id}").HandlerFunc(instrument("update", g.deleteAccessRule))
+	r.Methods("GET").Path("/volume/{name}/subexports").HandlerFunc(g.listSubexports)
+	r.Methods("POST").Path("/volume/{name}/subexports").HandlerFunc(instrument("update", g.createSubexport))
+	r.Methods("GET").Path("/volume/{name}/subexports/{id}").HandlerFunc(g.getSubexport)
+	r.Methods("DELETE").Path("/volume/{name}/subexports/{id}").HandlerFunc(instrument("update", g.deleteSubexport))
+	r.Methods("GET").Path("/volume/{name}/smb").HandlerFunc(g.getSMBShare)
+	r.Methods("POST").Path("/volume/{name}/snapshot").HandlerFunc(g.createSnapshot)
+	r.Methods("GET").Path("/volume/{name}/snapshots").HandlerFunc(g.listSnapshots)
+	r.Methods("DELETE").Path("/volume/{name}/snapshot/{id}").HandlerFunc(g.deleteSnapshot)
+	r.Methods("POST").Path("/volume/{name}/backup").HandlerFunc(g.backupVolume)
+	r.Methods("GET").Path("/volume/{name}/data").HandlerFunc(g.downloadData)
+	r.Methods("GET").Path("/volume/{name}/files").HandlerFunc(g.listFiles)
+	r.Methods("PUT").Path("/volume/{name}/data").HandlerFunc(instrument("update", g.uploadData))
+	r.Methods("GET").Path("/volume/{name}/backups").HandlerFunc(g.listBackups)
+	r.Methods("POST").Path("/volume/{name}/restore").HandlerFunc(g.restoreBackup)
+	r.Methods("GET").Path("/volume/{name}/policy").HandlerFunc(g.getPolicy)
+	r.Methods("PUT").Path("/volume/{name}/policy").HandlerFunc(g.setPolicy)
+	r.Methods("DELETE").Path("/volume/{name}/policy").HandlerFunc(g.deletePolicy)
+	r.Methods("POST").Path("/volume/{name}/replicate").HandlerFunc(g.replicateVolume)
+	r.Methods("DELETE").Path("/volume/{name}/replicate").HandlerFunc(g.stopReplication)
+	r.Methods("PUT").Path("/volume/{name}/replica").HandlerFunc(g.receiveReplica)
+	r.Methods("GET").Path("/volume/{name}/integrity").HandlerFunc(g.getIntegrity)
+	r.Methods("POST").Path("/volume/{name}/promote").HandlerFunc(instrument("update", g.promoteVolume))
+	r.Methods("POST").Path("/volume/{name}/repair").HandlerFunc(instrument("update", g.repairVolume))
+	r.Methods("GET").Path("/tenant/{id}/quota").HandlerFunc(g.getQuota)
+	r.Methods("GET").Path("/events").HandlerFunc(g.watchEvents)
+	r.Methods("POST").Path("/webhooks").HandlerFunc(g.createWebhook)
+	r.Methods("GET").Path("/webhooks").HandlerFunc(g.listWebhooks)
+	r.Methods("DELETE").Path("/webhooks/{id}").HandlerFunc(g.deleteWebhook)
+	r.Methods("GET").Path("/jobs/{id}").HandlerFunc(g.getJob)
+	r.Methods("POST").Path("/netgroup").HandlerFunc(g.createNetgroup)
+	r.Methods("GET").Path("/netgroups").HandlerFunc(g.listNetgroups)
+	r.Methods("GET").Path("/netgroup/{name}").HandlerFunc(g.getNetgroupHandler)
+	r.Methods("DELETE").Path("/netgroup/{name}").HandlerFunc(g.deleteNetgroup)
+	r.Methods("POST").Path("/netgroup/{name}/members").HandlerFunc(g.addNetgroupMember)
+	r.Methods("DELETE").Path("/netgroup/{name}/members/{host:.+}").HandlerFunc(g.removeNetgroupMember)
+	r.Methods("GET").Path("/admin/nfsd").HandlerFunc(g.getNFSD)
+	r.Methods("PUT").Path("/admin/nfsd").HandlerFunc(g.updateNFSD)
+	r.Methods("GET").Path("/admin/idmap").HandlerFunc(g.getIDMap)
+	r.Methods("PUT").Path("/admin/idmap").HandlerFunc(g.updateIDMap)
+	r.Methods("POST").Path("/admin/reload").HandlerFunc(g.adminReload)
+	r.Methods("GET").Path("/admin/export-defaults").HandlerFunc(g.getExportDefaultsHandler)
+	r.Methods("GET").Path("/admin/templates").HandlerFunc(g.listTemplates)
+	r.Methods("GET").Path("/admin/templates/{name}").HandlerFunc(g.getTemplateHandler)
+	r.Methods("PUT").Path("/admin/templates/{name}").HandlerFunc(g.putTemplate)
+	r.Methods("DELETE").Path("/admin/templates/{name}").HandlerFunc(g.deleteTemplate)
+	r.Methods("PUT").Path("/admin/export-defaults").HandlerFunc(g.updateExportDefaults)
+	r.Methods("GET").Path("/admin/reconcile").HandlerFunc(g.getReconcile)
+	r.Methods("GET").Path("/admin/ports").HandlerFunc(g.getPorts)
+	r.Methods("GET").Path("/admin/preflight").HandlerFunc(g.getPreflight)
+	r.Methods("GET").Path("/admin/rbac").HandlerFunc(g.listRoleBindings)
+	r.Methods("POST").Path("/admin/rbac").HandlerFunc(g.createRoleBinding)
+	r.Methods("DELETE").Path("/admin/rbac/{name}").HandlerFunc(g.deleteRoleBinding)
+	r.Methods("GET").Path("/whoami").HandlerFunc(g.whoAmI)
+	r.Methods("GET").Path("/admin/pools").HandlerFunc(g.listPools)
+	r.Methods("POST").Path("/admin/pools").HandlerFunc(g.createPool)
+	r.Methods("POST").Path("/admin/pools/{name}/drain").HandlerFunc(g.drainPool)
+	r.Methods("DELETE").Path("/admin/pools/{name}").HandlerFunc(g.deletePool)
+	r.Methods("GET").Path("/admin/db/backup").HandlerFunc(g.backupDB)
+	r.Methods("POST").Path("/admin/db/restore").HandlerFunc(g.restoreDB)
+	r.Methods("GET").Path("/admin/ha").HandlerFunc(getHA)
+	r.Methods("POST").Path("/admin/ha/takeover").HandlerFunc(g.takeover)
+	r.Methods("GET").Path("/admin/grace").HandlerFunc(g.getGrace)
+	r.Methods("PUT").Path("/admin/grace").HandlerFunc(g.updateGrace)
+	r.Methods("POST").Path("/admin/grace/start").HandlerFunc(g.adminStartGrace)
+	r.Methods("POST").Path("/admin/grace/end").HandlerFunc(g.adminEndGrace)
+	r.Methods("GET").Path("/admin/nfs/clients").HandlerFunc(g.listNFSClients)
+	r.Methods("POST").Path("/admin/nfs/clients/{id}/expire").HandlerFunc(g.expireNFSClient)
+	r.Methods("GET").Path("/admin/nfs/locks").HandlerFunc(g.listNFSLocks)
+	r.Methods("GET").Path("/admin/nfs/stats").HandlerFunc(g.getNFSStats)
+	r.Methods("GET").Path("/admin/maintenance").HandlerFunc(g.getMaintenance)
+	r.Methods("POST").Path("/admin/maintenance").HandlerFunc(g.enterMaintenance)
+	r.Methods("DELETE").Path("/admin/maintenance").HandlerFunc(g.exitMaintenance)
+	r.Methods("GET").Path("/admin/commands").HandlerFunc(g.listCommands)
+	r.Methods("GET").Path("/admin/daemons").HandlerFunc(g.listDaemons)
+	r.Methods("GET").Path("/admin/daemons/{name}/logs").HandlerFunc(g.getDaemonLogs)
+	r.Methods("POST").Path("/admin/reconcile").HandlerFunc(g.adminReconcile)
+	r.Methods("GET").Path("/admin/orphans").HandlerFunc(g.listOrphans)
+	r.Methods("POST").Path("/admin/orphans/adopt").HandlerFunc(g.adoptOrphan)
+	r.Methods("POST").Path("/admin/orphans/purge").HandlerFunc(g.purgeOrphan)
+	r.Methods("POST").Path("/admin/decommission").HandlerFunc(g.adminDecommission)
+	r.Methods("GET").Path("/healthz").HandlerFunc(g.healthz)
+	r.Methods("GET").Path("/readyz").HandlerFunc(g.readyz)
+	r.Methods("GET").Path("/metrics").HandlerFunc(g.metrics)
+	r.Methods("GET").Path("/openapi.json").HandlerFunc(openAPIHandler(r))
+	registerDockerPlugin(r, g)
+	// clients are throttled once authenticated and authorized, so bad tokens
+	// can't use up the budget of valid ones
+	g.timeouts.router = r
+	middleware := func(next http.Handler) http.Handler {
+		return traceRequests(r, g.auth.middleware(g.authorize(r, g.maintenanceGuard(r, g.limits.middleware(g.timeouts.middleware(next))))))
+	}
+	apiHandler := versioned(middleware(r))
+	g.grpcChain = withRequestID(middleware(grpcHandler(r)))
+	// the debug endpoints use the admin token instead of the API tokens
+	debug := g.admin.require(debugHandler(), false)
+	return withRequestID(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/debug/") {
+			debug.ServeHTTP(w, req)
+			return
+		}
+		apiHandler.ServeHTTP(w, req)
+	}))
+}
+
+func makeTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading TLS key pair")
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		data, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading client CA")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("no certificates found in %s", clientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
 }
 
 func exitOnError(err error, message string) {
@@ -78,58 +722,79 @@ func exitOnError(err error, message string) {
 	os.Exit(1)
 }
 
-func setupNFS() error {
-	fsData, err := ioutil.ReadFile("/proc/filesystems")
-	if err == nil {
-		if !bytes.Contains(fsData, []byte("nfsd")) {
-			// best effort
-			cmd("modprobe", "-q", "nfsd")
-		}
-	}
-
-	// mount -t nfsd -o nodev,noexec,nosuid nfsd /proc/fs/nfsd
-	if err := unix.Mount("nfsd", "/proc/fs/nfsd", "nfsd", unix.MS_NOEXEC|unix.MS_NODEV|unix.MS_NOSUID, ""); err != nil && err != unix.EBUSY {
-		return errors.Wrap(err, "error mounting nfsd")
-	}
+// setupNFS starts the kernel NFS server, the preflight loaded nfsd and mounted
+// its filesystem
+func setupNFS(nfsd *NFSDSettings, grace *GraceSettings, ports NFSPorts) error {
 	for _, dir := range []string{"rpc_pipefs", "v4recovery", "v4root"} {
 		if err := os.MkdirAll(filepath.Join("/var", "lib", "nfs", dir), 0755); err != nil {
 			return errors.Wrap(err, "error setting up nfs dirs")
 		}
 	}
 
-	cmd := exec.Command("/usr/sbin/rpc.mountd")
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Pdeathsig: syscall.SIGTERM,
-	}
-	if err := cmd.Start(); err == nil {
-		go cmd.Wait()
+	// nfsd only accepts these before it starts
+	if err := writeGraceSettings(grace); err != nil {
+		return err
 	}
 
-	cmd = exec.Command("/usr/sbin/rpc.nfsd")
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Pdeathsig: syscall.SIGTERM,
-	}
-	if err = cmd.Start(); err == nil {
-		go cmd.Wait()
+	// v4 has locking built in, statd and lockd are only needed for v3
+	if nfsv4Only {
+		daemons.start("rpcbind", "/sbin/rpcbind", "-f")
+		daemons.start("rpc.mountd", "/usr/sbin/rpc.mountd", append([]string{"-F", "-N", "2", "-N", "3"}, portArgs("-p", ports.Mountd)...)...)
+		daemons.once("rpc.nfsd", "/usr/sbin/rpc.nfsd", append(portArgs("-p", ports.NFS), nfsd.v4Only().rpcNFSDArgs()...)...)
+		return nil
 	}
 
-	cmd = exec.Command("/usr/bin/sm-notify")
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Pdeathsig: syscall.SIGTERM,
+	if err := setLockdPorts(ports.Lockd); err != nil {
+		return err
 	}
-	if err = cmd.Start(); err == nil {
-		go cmd.Wait()
+	if ha.enabled() {
+		if err := os.MkdirAll(ha.statdDir(), 0700); err != nil {
+			return errors.Wrap(err, "error making statd dir")
+		}
 	}
 
+	daemons.start("rpcbind", "/sbin/rpcbind", "-f")
+	daemons.start("rpc.mountd", "/usr/sbin/rpc.mountd", append([]string{"-F"}, portArgs("-p", ports.Mountd)...)...)
+	statdArgs := append([]string{"-F"}, portArgs("-p", ports.Statd)...)
+	statdArgs = append(statdArgs, portArgs("-o", ports.StatdOutgoing)...)
+	daemons.start("rpc.statd", "/usr/sbin/rpc.statd", append(statdArgs, ha.statdArgs()...)...)
+	daemons.once("rpc.nfsd", "/usr/sbin/rpc.nfsd", append(portArgs("-p", ports.NFS), nfsd.rpcNFSDArgs()...)...)
+	daemons.once("sm-notify", "/usr/bin/sm-notify", ha.smNotifyArgs()...)
+
 	return nil
 }
 
-func handleShutdown(g *gateway) {
-	ch := make(chan os.Signal)
+func handleReload(g *gateway) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if err := g.reloadConfig(); err != nil {
+			logrus.WithError(err).Error("error reloading configuration")
+		}
+	}
+}
+
+func (g *gateway) adminReload(w http.ResponseWriter, r *http.Request) {
+	if err := g.reloadConfig(); err != nil {
+		writeError(w, errInvalid(err.Error()))
+	}
+}
+
+// handleShutdown waits for a termination signal or a decommission and then
+// stops accepting new requests, giving in-flight ones up to timeout to
+// complete.
+func handleShutdown(srv *http.Server, timeout time.Duration, decommission <-chan struct{}) {
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case <-ch:
+	case <-decommission:
+	}
 
-	for range ch {
-		g.Shutdown()
-		os.Exit(0)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logrus.WithError(err).Warn("error draining API requests")
+		srv.Close()
 	}
 }
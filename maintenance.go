@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Maintenance mode makes the API read-only for host reboots and storage
+// work. It's stored, so it lasts across restarts until it's ended. Frozen
+// filesystems block writes, NFS clients retry them until they're thawed. The
+// filesystem holding the database is never frozen since that would freeze the
+// gateway too.
+
+var maintenanceKey = []byte("maintenance")
+
+const defaultMaintenanceRetry = time.Minute
+
+// maintenanceRoutes may still be used during maintenance besides reads
+var maintenanceRoutes = map[string]bool{
+	"POST /admin/maintenance":   true,
+	"DELETE /admin/maintenance": true,
+	"POST /admin/decommission":  true,
+}
+
+type MaintenanceRequest struct {
+	// Reason is returned to the requests refused during maintenance
+	Reason string
+	// RetryAfter is how long refused clients are told to wait, e.g. "5m",
+	// 1m by default
+	RetryAfter string
+	// Flush writes the volumes' cached data to disk
+	Flush bool
+	// Freeze blocks writes to the volumes' filesystems until maintenance
+	// ends, which flushes them too
+	Freeze bool
+}
+
+type MaintenanceStatus struct {
+	Active     bool
+	Reason     string     `json:",omitempty"`
+	Since      *time.Time `json:",omitempty"`
+	RetryAfter string     `json:",omitempty"`
+	// Frozen are the mountpoints thawed when maintenance ends
+	Frozen []string `json:",omitempty"`
+	// Warnings are the filesystems which couldn't be flushed, frozen or thawed
+	Warnings []string `json:",omitempty"`
+}
+
+type maintenance struct {
+	// changing serializes entering and leaving maintenance
+	changing sync.Mutex
+
+	mu     sync.RWMutex
+	status MaintenanceStatus
+	retry  time.Duration
+}
+
+func (m *maintenance) active() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status.Active
+}
+
+func (m *maintenance) get() MaintenanceStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status
+}
+
+func (m *maintenance) set(s MaintenanceStatus) {
+	retry, err := time.ParseDuration(s.RetryAfter)
+	if err != nil || retry <= 0 {
+		retry = defaultMaintenanceRetry
+	}
+	m.mu.Lock()
+	m.status = s
+	m.retry = retry
+	m.mu.Unlock()
+}
+
+// loadMaintenance restores maintenance mode after a restart
+func (g *gateway) loadMaintenance() error {
+	var s MaintenanceStatus
+	err := g.view(func(tx *bolt.Tx) error {
+		data := tx.Bucket(settingsBucket).Get(maintenanceKey)
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &s)
+	})
+	if err != nil {
+		return dbError(errors.Wrap(err, "error reading maintenance state"))
+	}
+	if s.Active {
+		logrus.WithField("reason", s.Reason).Warn("the gateway is in maintenance, the API is read-only until DELETE /admin/maintenance")
+	}
+	g.maintenance.set(s)
+	return nil
+}
+
+func (g *gateway) storeMaintenance(s MaintenanceStatus) error {
+	return g.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(settingsBucket)
+		if !s.Active {
+			return dbError(errors.Wrap(b.Delete(maintenanceKey), "error writing maintenance state"))
+		}
+		data, err := json.Marshal(s)
+		if err != nil {
+			return errors.Wrap(err, "error marshaling maintenance state")
+		}
+		return dbError(errors.Wrap(b.Put(maintenanceKey, data), "error writing maintenance state"))
+	})
+}
+
+// maintenanceGuard refuses changes during maintenance, it runs after
+// authorization so callers learn about missing permissions first
+func (g *gateway) maintenanceGuard(router *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !g.maintenance.active() || r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var m mux.RouteMatch
+		if !router.Match(r, &m) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tmpl, err := m.Route.GetPathTemplate()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		route := r.Method + " " + tmpl
+		if maintenanceRoutes[route] || requiredRole(r.Method, tmpl) == roleReader {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		g.maintenance.mu.RLock()
+		reason, retry := g.maintenance.status.Reason, g.maintenance.retry
+		g.maintenance.mu.RUnlock()
+		msg := "the gateway is in maintenance, only reads are served"
+		if reason != "" {
+			msg += ": " + reason
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())))
+		writeError(w, newError(http.StatusServiceUnavailable, api.ErrCodeMaintenance, msg))
+	})
+}
+
+// volumeFilesystems returns the mountpoints of the volumes' data. Source and
+// imported volumes are left out, their filesystems aren't the gateway's.
+func (g *gateway) volumeFilesystems() ([]string, error) {
+	vols, err := g.list()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var mounts []string
+	for _, v := range vols {
+		if v.Source != "" || v.Imported {
+			continue
+		}
+		m, err := mountPoint(v.Export.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[m] {
+			seen[m] = true
+			mounts = append(mounts, m)
+		}
+	}
+	sort.Strings(mounts)
+	return mounts, nil
+}
+
+func syncFilesystem(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return unix.Syncfs(int(f.Fd()))
+}
+
+func (g *gateway) getMaintenance(w http.ResponseWriter, r *http.Request) {
+	writeMaintenance(w, g.maintenance.get())
+}
+
+// enterMaintenance makes the API read-only, then flushes or freezes the
+// volumes' filesystems. Entering again updates the reason and freezes what
+// isn't frozen yet.
+func (g *gateway) enterMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req MaintenanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	if req.RetryAfter != "" {
+		if d, err := time.ParseDuration(req.RetryAfter); err != nil || d < time.Second {
+			writeError(w, &validationError{Field: "RetryAfter", Value: req.RetryAfter, Reason: "must be a duration of at least 1s, e.g. 5m"})
+			return
+		}
+	}
+
+	g.maintenance.changing.Lock()
+	defer g.maintenance.changing.Unlock()
+	s := g.maintenance.get()
+	if !s.Active {
+		now := time.Now().UTC()
+		s = MaintenanceStatus{Active: true, Since: &now}
+	}
+	s.Reason = req.Reason
+	s.RetryAfter = req.RetryAfter
+	if s.RetryAfter == "" {
+		s.RetryAfter = defaultMaintenanceRetry.String()
+	}
+	s.Warnings = nil
+	// refused from here on, before anything is flushed
+	if err := g.storeMaintenance(s); err != nil {
+		writeError(w, err)
+		return
+	}
+	g.maintenance.set(s)
+
+	if req.Flush || req.Freeze {
+		mounts, err := g.volumeFilesystems()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		dbMount, err := mountPoint(g.root)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		frozen := make(map[string]bool)
+		for _, m := range s.Frozen {
+			frozen[m] = true
+		}
+		for _, m := range mounts {
+			if !req.Freeze || m == dbMount || m == "/" {
+				if err := syncFilesystem(m); err != nil {
+					s.Warnings = append(s.Warnings, "error flushing "+m+": "+err.Error())
+				}
+				if req.Freeze {
+					s.Warnings = append(s.Warnings, m+" is the root filesystem or holds the gateway's database, it was only flushed")
+				}
+				continue
+			}
+			if frozen[m] {
+				continue
+			}
+			if err := cmd("fsfreeze", "--freeze", m); err != nil {
+				s.Warnings = append(s.Warnings, "error freezing "+m+": "+err.Error())
+				continue
+			}
+			s.Frozen = append(s.Frozen, m)
+		}
+	}
+
+	if err := g.storeMaintenance(s); err != nil {
+		writeError(w, err)
+		return
+	}
+	g.maintenance.set(s)
+	requestLog(r).WithField("reason", s.Reason).WithField("frozen", s.Frozen).Warn("entered maintenance, the API is read-only")
+	writeMaintenance(w, s)
+}
+
+// exitMaintenance thaws the frozen filesystems and makes the API writable.
+// Filesystems which fail to thaw are reported, e.g. after a reboot they
+// aren't frozen anymore.
+func (g *gateway) exitMaintenance(w http.ResponseWriter, r *http.Request) {
+	g.maintenance.changing.Lock()
+	defer g.maintenance.changing.Unlock()
+	s := g.maintenance.get()
+	if !s.Active {
+		writeError(w, errInvalid("the gateway is not in maintenance"))
+		return
+	}
+	var warnings []string
+	for _, m := range s.Frozen {
+		if err := cmd("fsfreeze", "--unfreeze", m); err != nil {
+			warnings = append(warnings, "error thawing "+m+": "+err.Error())
+		}
+	}
+	done := MaintenanceStatus{Warnings: warnings}
+	if err := g.storeMaintenance(done); err != nil {
+		writeError(w, err)
+		return
+	}
+	g.maintenance.set(done)
+	requestLog(r).Info("left maintenance")
+	writeMaintenance(w, done)
+}
+
+func writeMaintenance(w http.ResponseWriter, s MaintenanceStatus) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+	"unicode/utf8"
+)
+
+// Volumes record when they were created and last changed, who created them
+// and a free-form description. Records from before they had timestamps get
+// CreatedAt backfilled the next time they're written.
+
+const maxDescriptionLength = 1024
+
+func validateDescription(d string) error {
+	switch {
+	case len(d) > maxDescriptionLength:
+		return &validationError{Field: "Description", Reason: "must be at most 1024 bytes"}
+	case !utf8.ValidString(d):
+		return &validationError{Field: "Description", Reason: "must be valid UTF-8"}
+	}
+	return nil
+}
+
+type principalContextKey struct{}
+
+func withPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, principal)
+}
+
+// contextPrincipal identifies who made a request: the role binding of a
+// static token, "oidc:<subject>" for a JWT, otherwise "tenant:<tenant>" or
+// "token" for static tokens. It's empty when auth is disabled.
+func contextPrincipal(ctx context.Context) string {
+	if b, _ := ctx.Value(bindingContextKey{}).(*roleBinding); b != nil {
+		return "binding:" + b.Name
+	}
+	p, _ := ctx.Value(principalContextKey{}).(string)
+	return p
+}
+
+// setCreated stamps a new volume with its creation time and creator
+func setCreated(ctx context.Context, v *volume) {
+	now := time.Now().UTC()
+	v.CreatedAt = &now
+	v.CreatedBy = contextPrincipal(ctx)
+}
+
+// stampVolume updates the modification time of a volume being stored. A
+// record without a creation time predates them, the best guess left is the
+// modification time of its data's root directory, which is never earlier
+// than the volume's creation.
+func stampVolume(v *volume) {
+	now := time.Now().UTC()
+	if v.CreatedAt == nil {
+		created := now
+		if fi, err := os.Stat(v.Export.Path); err == nil && fi.ModTime().Before(now) {
+			created = fi.ModTime().UTC()
+		}
+		v.CreatedAt = &created
+	}
+	v.UpdatedAt = &now
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// This is a minimal implementation of the prometheus text exposition format,
+// just enough to cover the metrics the gateway exposes.
+
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.mu.Lock()
+	c.values[formatLabels(c.labels, labelValues)]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %v\n", c.name, k, c.values[k])
+	}
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: defaultBuckets, series: make(map[string]*histogramSeries)}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) since(start time.Time, labelValues ...string) {
+	h.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := h.series[k]
+		var lv []string
+		if len(h.labels) > 0 {
+			lv = strings.Split(k, "\xff")
+		}
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(append(h.labels, "le"), append(lv, fmt.Sprint(b))), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(append(h.labels, "le"), append(lv, "+Inf")), s.count)
+		fmt.Fprintf(w, "%s_sum%s %v\n", h.name, formatLabels(h.labels, lv), s.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, lv), s.count)
+	}
+}
+
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		var v string
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs[i] = fmt.Sprintf("%s=%q", n, v)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	volumeOps         = newCounterVec("nfsg_volume_operations_total", "Number of volume API operations by operation and status code.", "op", "code")
+	exportfsDuration  = newHistogramVec("nfsg_exportfs_duration_seconds", "Latency of exportfs invocations.")
+	exportfsFailures  = newCounterVec("nfsg_exportfs_failures_total", "Number of failed exportfs invocations.")
+	boltTxDuration    = newHistogramVec("nfsg_bolt_transaction_duration_seconds", "Duration of bolt transactions by type.", "type")
+	throttledRequests = newCounterVec("nfsg_throttled_requests_total", "Number of requests rejected by rate limits and concurrency caps by reason.", "reason")
+	collectedCounters = []*counterVec{volumeOps, exportfsFailures, throttledRequests}
+	collectedHistos   = []*histogramVec{exportfsDuration, boltTxDuration}
+)
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Flush keeps streaming responses like /events working
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrument counts calls to the handler by their response code
+func instrument(op string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h(rec, r)
+		volumeOps.inc(op, fmt.Sprint(rec.code))
+	}
+}
+
+func (g *gateway) update(fn func(*bolt.Tx) error) error {
+	return g.updateContext(context.Background(), fn)
+}
+
+// updateContext is update for requests, which gives up without running fn
+// when ctx is done by the time the write lock is held. The transaction is
+// recorded in the trace of ctx.
+func (g *gateway) updateContext(ctx context.Context, fn func(*bolt.Tx) error) error {
+	start := time.Now()
+	defer boltTxDuration.since(start, "update")
+	_, s := startSpan(ctx, "bolt.update", spanKindInternal)
+	update := func() error {
+		return g.db.Update(func(tx *bolt.Tx) error {
+			s.set("bolt.lock_wait_ms", time.Since(start).Nanoseconds()/int64(time.Millisecond))
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if g.mirror != nil {
+				tx.OnCommit(g.mirror.changed)
+			}
+			return fn(tx)
+		})
+	}
+	var err error
+	if g.mirror != nil {
+		// shared metadata is only changed holding the store's lock
+		err = g.mirror.write(update)
+	} else {
+		err = update()
+	}
+	s.finish(err)
+	return err
+}
+
+func (g *gateway) view(fn func(*bolt.Tx) error) error {
+	defer boltTxDuration.since(time.Now(), "view")
+	return g.db.View(fn)
+}
+
+func (g *gateway) metrics(w http.ResponseWriter, r *http.Request) {
+	vols, err := g.list()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	for _, c := range collectedCounters {
+		c.write(bw)
+	}
+	for _, h := range collectedHistos {
+		h.write(bw)
+	}
+
+	writeHeader(bw, "nfsg_volumes", "Number of volumes managed by the gateway.", "gauge")
+	fmt.Fprintf(bw, "nfsg_volumes %d\n", len(vols))
+
+	writeHeader(bw, "nfsg_volume_disk_usage_bytes", "Bytes used by each volume.", "gauge")
+	for _, v := range vols {
+		// only report cached values, scrapes should never trigger a walk
+		u := g.usage.cached(v.Name)
+		if u == nil {
+			continue
+		}
+		fmt.Fprintf(bw, "nfsg_volume_disk_usage_bytes%s %d\n", formatLabels([]string{"volume"}, []string{v.Name}), u.BytesUsed)
+	}
+
+	writeHeader(bw, "nfsg_volume_nfs_io_bytes_total", "Bytes read and written through each volume's exports since the gateway started.", "counter")
+	for _, v := range vols {
+		st := g.ioStats.get(v.Export.Path)
+		if st == nil {
+			break
+		}
+		fmt.Fprintf(bw, "nfsg_volume_nfs_io_bytes_total%s %d\n", formatLabels([]string{"volume", "direction"}, []string{v.Name, "read"}), st.ReadBytes)
+		fmt.Fprintf(bw, "nfsg_volume_nfs_io_bytes_total%s %d\n", formatLabels([]string{"volume", "direction"}, []string{v.Name, "write"}), st.WriteBytes)
+	}
+
+	st, err := readNFSStats()
+	if err != nil {
+		requestLog(r).WithError(err).Warn("error reading nfsd statistics")
+	}
+	if st != nil {
+		writeNFSMetrics(bw, st)
+	}
+}
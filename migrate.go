@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/pkg/errors"
+)
+
+const jobMigrateVolume = "migrate-volume"
+
+type migrateArgs struct {
+	// From is the pool being drained
+	From string
+}
+
+// runMigrate moves a volume out of a draining pool. It is a no-op once the
+// volume was moved, so an interrupted drain can simply be run again.
+func (g *gateway) runMigrate(j *job, progress func(string)) error {
+	var args migrateArgs
+	if err := json.Unmarshal(j.Args, &args); err != nil {
+		return errors.Wrap(err, "error decoding job arguments")
+	}
+	v, err := g.lookup(j.Volume)
+	if err != nil {
+		return err
+	}
+	if v.Pool != args.From {
+		return nil
+	}
+	if v.Pending != "" {
+		return errInvalid("volume is still being populated")
+	}
+	if v.Imported {
+		return errInvalid("imported volumes are not kept in a pool")
+	}
+	to, err := g.pools.place("")
+	if err != nil {
+		return err
+	}
+	progress("migrating to pool " + to)
+	return g.migrate(v, to, progress)
+}
+
+// migrate moves the volume's data to another pool. Data is copied while the
+// volume stays in use, then the volume is unexported, the changes since are
+// copied and the volume is switched over and re-exported from its new path
+// within a single transaction. zfs datasets and bind mounted sources only
+// have their mountpoint moved.
+func (g *gateway) migrate(v *volume, to string, progress func(string)) error {
+	if err := g.view(func(tx *bolt.Tx) error { return checkNoAliases(tx, v.Name) }); err != nil {
+		return err
+	}
+	dst := *v
+	dst.Pool = to
+	dst.Export.Path = g.nfsPath(to, v.Name)
+	copyData := v.Dataset == "" && v.Source == ""
+	if copyData {
+		dst.Loop, dst.Project, dst.Subvolume = nil, nil, false
+		req := api.CreateRequest{SizeBytes: v.SizeBytes}
+		if v.Loop != nil {
+			req.FSType = v.Loop.FSType
+		}
+		progress("provisioning")
+		err := g.update(func(tx *bolt.Tx) error {
+			return g.storage.create(tx, &dst, req)
+		})
+		if err != nil {
+			return err
+		}
+		progress("copying data")
+		if err := syncData(v.Export.Path, dst.Export.Path); err != nil {
+			g.storage.destroy(&dst)
+			return err
+		}
+	}
+
+	// the data is copied unlocked, the switch over isn't
+	unlock := g.locks.lock(v.Name)
+	var old volume
+	err := g.update(func(tx *bolt.Tx) (retErr error) {
+		cur, err := readVolume(tx, v.Name)
+		if err != nil {
+			return err
+		}
+		if cur.Pool != v.Pool || cur.Export.Path != v.Export.Path {
+			return errors.New("volume was changed while it was being migrated")
+		}
+		if err := checkNoAliases(tx, v.Name); err != nil {
+			return err
+		}
+		old = *cur
+		if err := g.unexport(context.Background(), cur); err != nil {
+			return err
+		}
+		defer func() {
+			if retErr != nil {
+				g.export(context.Background(), &old)
+			}
+		}()
+
+		next := *cur
+		next.Pool = to
+		next.Export.Path = dst.Export.Path
+		switch {
+		case copyData:
+			progress("copying changes")
+			if err := syncData(cur.Export.Path, dst.Export.Path); err != nil {
+				return err
+			}
+			next.Loop, next.Project, next.Dataset, next.Subvolume = dst.Loop, dst.Project, dst.Dataset, dst.Subvolume
+		case cur.Dataset != "":
+			if err := os.MkdirAll(filepath.Dir(next.Export.Path), 0755); err != nil {
+				return errors.Wrap(err, "error creating volume dir")
+			}
+			if err := cmd("zfs", "set", "mountpoint="+next.Export.Path, cur.Dataset); err != nil {
+				return errors.Wrap(err, "error moving zfs dataset")
+			}
+			defer func() {
+				if retErr != nil {
+					cmd("zfs", "set", "mountpoint="+old.Export.Path, old.Dataset)
+				}
+			}()
+		default:
+			if err := unbindSource(cur); err != nil {
+				return err
+			}
+			defer func() {
+				if retErr != nil {
+					unbindSource(&next)
+					bindSource(&old)
+				}
+			}()
+			if err := bindSource(&next); err != nil {
+				return err
+			}
+		}
+		if err := putVolume(tx, &next); err != nil {
+			return err
+		}
+		return g.export(context.Background(), &next)
+	})
+	unlock()
+	if err != nil {
+		if copyData {
+			g.storage.destroy(&dst)
+		}
+		return err
+	}
+	volumeEvent(eventVolumeUpdated, v.Name, nil)
+
+	progress("removing data from the old pool")
+	switch {
+	case copyData:
+		err = g.storage.destroy(&old)
+	case old.Dataset != "":
+		err = os.Remove(old.Export.Path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		// the volume was moved, leftovers don't fail the job
+		logrus.WithError(err).WithField("volume", v.Name).Warn("error removing migrated volume data")
+	}
+	return nil
+}
+
+// syncData makes dst an exact copy of src
+func syncData(src, dst string) error {
+	return errors.Wrap(cmd("rsync", "-aHAX", "--delete", src+"/", dst+"/"), "error copying volume data")
+}
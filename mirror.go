@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+)
+
+// Mirrors are created with CreateRequest.Mirror to receive the replicas of a
+// volume on another gateway. They are exported ro and every change other than
+// a received replica is refused until the mirror is promoted, e.g. when the
+// gateway it mirrors is lost.
+
+func errMirror() error {
+	return newError(http.StatusConflict, api.ErrCodeVolumeIsMirror, "volume is a read-only mirror, promote it first")
+}
+
+// promoteVolume turns a mirror into a normal volume exported with its own
+// options.
+func (g *gateway) promoteVolume(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	v, err := g.modifyVolume(r.Context(), scopedName(r, name), func(v *volume) error {
+		if !v.Mirror {
+			return errInvalid("volume is not a mirror")
+		}
+		v.Mirror = false
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeUpdateResponse(w, v)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Netgroups are named lists of hosts managed by the gateway. A volume
+// exported to @name is exported to the members of its tenant's netgroup of
+// that name, @names without a netgroup are left to the system's netgroups.
+
+var netgroupsBucket = []byte("netgroups")
+
+type Netgroup struct {
+	Name    string
+	Members []string
+}
+
+type AddMemberRequest struct {
+	Host string
+}
+
+func validateNetgroup(n *Netgroup) error {
+	if !netgroupPattern.MatchString("@" + n.Name) {
+		return &validationError{Field: "Name", Value: n.Name, Reason: "may only contain letters, digits, _, . and -"}
+	}
+	for _, h := range n.Members {
+		if strings.HasPrefix(h, "@") {
+			return &validationError{Field: "Members", Value: h, Reason: "netgroups can't be nested"}
+		}
+	}
+	return validateHosts(n.Members)
+}
+
+// loadNetgroups reads all netgroups into memory, exports are rendered from
+// there.
+func (g *gateway) loadNetgroups() error {
+	groups := make(map[string][]string)
+	err := g.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(netgroupsBucket).ForEach(func(k, v []byte) error {
+			var n Netgroup
+			if err := json.Unmarshal(v, &n); err != nil {
+				return dbError(errors.Wrap(err, "error unmarshaling netgroup from database"))
+			}
+			groups[string(k)] = n.Members
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	g.settingsMu.Lock()
+	g.netgroups = groups
+	g.settingsMu.Unlock()
+	return nil
+}
+
+func (g *gateway) setNetgroup(id string, members []string) {
+	g.settingsMu.Lock()
+	if members == nil {
+		delete(g.netgroups, id)
+	} else {
+		g.netgroups[id] = members
+	}
+	g.settingsMu.Unlock()
+}
+
+// expandHosts replaces references to the gateway's netgroups in the volume's
+// hosts and access rules with their members, a rule for a netgroup becomes a
+// rule for each member. It reports whether any were replaced.
+func (g *gateway) expandHosts(v *volume) ([]string, []api.AccessRule, bool) {
+	g.settingsMu.RLock()
+	defer g.settingsMu.RUnlock()
+
+	tenant := volumeTenant(v.Name)
+	var hosts []string
+	expanded := false
+	for _, h := range v.Export.Hosts {
+		members, ok := g.expandHost(tenant, h)
+		hosts = append(hosts, members...)
+		expanded = expanded || ok
+	}
+	var rules []api.AccessRule
+	for _, a := range v.Export.Access {
+		members, ok := g.expandHost(tenant, a.Host)
+		for _, m := range members {
+			a.Host = m
+			rules = append(rules, a)
+		}
+		expanded = expanded || ok
+	}
+	return hosts, rules, expanded
+}
+
+// expandHost returns the members of the host if it's one of the tenant's
+// netgroups, the host itself otherwise. The caller holds settingsMu.
+func (g *gateway) expandHost(tenant, h string) ([]string, bool) {
+	if !strings.HasPrefix(h, "@") {
+		return []string{h}, false
+	}
+	members, ok := g.netgroups[volumeID(tenant, h[1:])]
+	if !ok {
+		return []string{h}, false
+	}
+	return members, true
+}
+
+func getNetgroup(tx *bolt.Tx, id string) (*Netgroup, error) {
+	data := tx.Bucket(netgroupsBucket).Get([]byte(id))
+	if data == nil {
+		return nil, errNotFound("netgroup not found")
+	}
+	var n Netgroup
+	if err := json.Unmarshal(data, &n); err != nil {
+		return nil, dbError(errors.Wrap(err, "error unmarshaling netgroup from database"))
+	}
+	return &n, nil
+}
+
+// putNetgroup stores the netgroup and re-applies the exports of every volume
+// using it.
+func (g *gateway) putNetgroup(ctx context.Context, tx *bolt.Tx, id string, n *Netgroup) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling netgroup")
+	}
+	if err := tx.Bucket(netgroupsBucket).Put([]byte(id), data); err != nil {
+		return dbError(errors.Wrap(err, "error writing netgroup to database"))
+	}
+	members := n.Members
+	if members == nil {
+		members = []string{}
+	}
+	g.setNetgroup(id, members)
+
+	users, err := netgroupUsers(tx, id)
+	if err != nil {
+		return err
+	}
+	for _, v := range users {
+		if err := g.export(ctx, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// netgroupUsers returns the volumes exported to the netgroup
+func netgroupUsers(tx *bolt.Tx, id string) ([]*volume, error) {
+	tenant, name := splitVolumeID(id)
+	var users []*volume
+	err := forEachVolume(tx, func(data []byte) error {
+		var v volume
+		if err := json.Unmarshal(data, &v); err != nil {
+			return dbError(errors.Wrap(err, "error unmarshaling volume from database"))
+		}
+		if volumeTenant(v.Name) != tenant {
+			return nil
+		}
+		for _, h := range v.Export.Hosts {
+			if h == "@"+name {
+				users = append(users, &v)
+				return nil
+			}
+		}
+		for _, a := range v.Export.Access {
+			if a.Host == "@"+name {
+				users = append(users, &v)
+				return nil
+			}
+		}
+		return nil
+	})
+	return users, err
+}
+
+func writeNetgroup(w http.ResponseWriter, n *Netgroup) {
+	b, err := json.Marshal(n)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+func (g *gateway) createNetgroup(w http.ResponseWriter, r *http.Request) {
+	var n Netgroup
+	if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	if err := validateNetgroup(&n); err != nil {
+		writeError(w, err)
+		return
+	}
+	if n.Members == nil {
+		n.Members = []string{}
+	}
+
+	id := scopedName(r, n.Name)
+	err := g.updateContext(r.Context(), func(tx *bolt.Tx) error {
+		if tx.Bucket(netgroupsBucket).Get([]byte(id)) != nil {
+			return errAlreadyExists("a netgroup with this name already exists")
+		}
+		return g.putNetgroup(r.Context(), tx, id, &n)
+	})
+	if err != nil {
+		g.loadNetgroups()
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeNetgroup(w, &n)
+}
+
+func (g *gateway) listNetgroups(w http.ResponseWriter, r *http.Request) {
+	tenant := requestTenant(r)
+	groups := []Netgroup{}
+	err := g.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(netgroupsBucket).ForEach(func(k, v []byte) error {
+			if volumeTenant(string(k)) != tenant {
+				return nil
+			}
+			var n Netgroup
+			if err := json.Unmarshal(v, &n); err != nil {
+				return dbError(errors.Wrap(err, "error unmarshaling netgroup from database"))
+			}
+			groups = append(groups, n)
+			return nil
+		})
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+
+	b, err := json.Marshal(groups)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+func (g *gateway) getNetgroupHandler(w http.ResponseWriter, r *http.Request) {
+	var n *Netgroup
+	err := g.view(func(tx *bolt.Tx) (err error) {
+		n, err = getNetgroup(tx, scopedName(r, mux.Vars(r)["name"]))
+		return err
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeNetgroup(w, n)
+}
+
+// modifyNetgroup applies fn to the stored netgroup and re-applies the
+// exports using it
+func (g *gateway) modifyNetgroup(ctx context.Context, id string, fn func(*Netgroup) error) (*Netgroup, error) {
+	var n *Netgroup
+	err := g.updateContext(ctx, func(tx *bolt.Tx) (err error) {
+		n, err = getNetgroup(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := fn(n); err != nil {
+			return err
+		}
+		return g.putNetgroup(ctx, tx, id, n)
+	})
+	if err != nil {
+		// the transaction was rolled back, so was the netgroup
+		g.loadNetgroups()
+		return nil, err
+	}
+	return n, nil
+}
+
+func (g *gateway) addNetgroupMember(w http.ResponseWriter, r *http.Request) {
+	var req AddMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+
+	n, err := g.modifyNetgroup(r.Context(), scopedName(r, mux.Vars(r)["name"]), func(n *Netgroup) error {
+		for _, h := range n.Members {
+			if h == req.Host {
+				return nil
+			}
+		}
+		n.Members = append(n.Members, req.Host)
+		return validateNetgroup(n)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeNetgroup(w, n)
+}
+
+func (g *gateway) removeNetgroupMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	n, err := g.modifyNetgroup(r.Context(), scopedName(r, vars["name"]), func(n *Netgroup) error {
+		for i, h := range n.Members {
+			if h == vars["host"] {
+				n.Members = append(n.Members[:i], n.Members[i+1:]...)
+				return nil
+			}
+		}
+		return errNotFound("host not found")
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeNetgroup(w, n)
+}
+
+// deleteNetgroup refuses to delete netgroups still in use, their volumes
+// would otherwise silently fall back to a system netgroup of the same name.
+func (g *gateway) deleteNetgroup(w http.ResponseWriter, r *http.Request) {
+	id := scopedName(r, mux.Vars(r)["name"])
+	err := g.update(func(tx *bolt.Tx) error {
+		if _, err := getNetgroup(tx, id); err != nil {
+			return err
+		}
+		users, err := netgroupUsers(tx, id)
+		if err != nil {
+			return err
+		}
+		if len(users) > 0 {
+			var names []string
+			for _, v := range users {
+				names = append(names, displayName(v.Name))
+			}
+			return newError(http.StatusConflict, api.ErrCodeInvalidRequest, "netgroup is used by volumes: "+strings.Join(names, ", "))
+		}
+		return dbError(errors.Wrap(tx.Bucket(netgroupsBucket).Delete([]byte(id)), "error deleting netgroup from database"))
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	g.setNetgroup(id, nil)
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Active clients are found in mountd's rmtab for v2/v3 and in the per-client
+// state nfsd keeps under /proc/fs/nfsd/clients (Linux 5.3+) for v4. Neither
+// records when a client mounted. v4 clients are matched to volumes by the
+// filesystem they hold open files on, so volumes sharing the data root's
+// filesystem may list clients of the other volumes on it, and v4 clients
+// without open files aren't listed at all.
+
+var rmtabPath = "/var/lib/nfs/rmtab"
+
+// stateFieldPattern matches the key: value pairs of a states file entry
+var stateFieldPattern = regexp.MustCompile(`(\w+): ("(?:[^"\\]|\\.)*"|[^,}]*)`)
+
+type rmtabEntry struct {
+	host string
+	path string
+}
+
+// readRmtab returns the active v2/v3 mounts
+func readRmtab() ([]rmtabEntry, error) {
+	f, err := os.Open(rmtabPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "error reading rmtab")
+	}
+	defer f.Close()
+
+	var entries []rmtabEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// host:path:0x<mount count>, the path may contain colons itself
+		line := s.Text()
+		first, last := strings.Index(line, ":"), strings.LastIndex(line, ":")
+		if first < 0 || last <= first {
+			continue
+		}
+		count, err := strconv.ParseUint(strings.TrimPrefix(line[last+1:], "0x"), 16, 32)
+		if err != nil || count == 0 {
+			continue
+		}
+		entries = append(entries, rmtabEntry{host: line[:first], path: unescapeExportPath(line[first+1 : last])})
+	}
+	return entries, errors.Wrap(s.Err(), "error reading rmtab")
+}
+
+// nfsdClient is the state nfsd keeps for an NFSv4 client
+type nfsdClient struct {
+	// dir is the client's directory under /proc/fs/nfsd/clients
+	dir     string
+	id      string
+	address string
+	name    string
+	minor   int
+	renewed time.Time
+	status  string
+	states  []NFSState
+	// superblocks are the major:minor of the filesystems it has state on
+	superblocks map[string]bool
+}
+
+func nfsdClientsDir() string {
+	return filepath.Join(nfsdProcDir, "clients")
+}
+
+// readNFSDClients returns the NFSv4 clients known to nfsd
+func readNFSDClients() ([]*nfsdClient, error) {
+	dirs, err := ioutil.ReadDir(nfsdClientsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "error reading nfsd clients")
+	}
+	var clients []*nfsdClient
+	for _, d := range dirs {
+		c, err := readNFSDClient(d.Name())
+		if err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				// the client went away in the meantime
+				continue
+			}
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, nil
+}
+
+func readNFSDClient(dir string) (*nfsdClient, error) {
+	info, err := ioutil.ReadFile(filepath.Join(nfsdClientsDir(), dir, "info"))
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading nfsd client info")
+	}
+	c := &nfsdClient{dir: dir, id: dir, superblocks: make(map[string]bool)}
+	for _, line := range strings.Split(string(info), "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.Trim(strings.TrimSpace(kv[1]), `"`)
+		switch strings.TrimSpace(kv[0]) {
+		case "clientid":
+			c.id = value
+		case "address":
+			c.address = value
+			if host, _, err := net.SplitHostPort(value); err == nil {
+				c.address = host
+			}
+		case "name":
+			c.name = value
+		case "status":
+			c.status = value
+		case "minor version":
+			c.minor, _ = strconv.Atoi(value)
+		case "seconds from last renew":
+			if n, err := strconv.Atoi(value); err == nil {
+				c.renewed = time.Now().UTC().Add(-time.Duration(n) * time.Second)
+			}
+		}
+	}
+
+	states, err := ioutil.ReadFile(filepath.Join(nfsdClientsDir(), dir, "states"))
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading nfsd client states")
+	}
+	c.states = parseNFSDStates(c.dir, string(states))
+	for _, s := range c.states {
+		// superblocks are major:minor:inode
+		if i := strings.LastIndex(s.Superblock, ":"); i > 0 {
+			c.superblocks[s.Superblock[:i]] = true
+		}
+	}
+	return c, nil
+}
+
+// parseNFSDStates parses the entries of a client's states file, e.g.
+// - 0x...: { type: open, access: rw, deny: --, superblock: "fd:00:1234", filename: "f", owner: "..." }
+func parseNFSDStates(client, data string) []NFSState {
+	var states []NFSState
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "- ") {
+			continue
+		}
+		i := strings.Index(line, ": {")
+		if i < 0 {
+			continue
+		}
+		s := NFSState{Client: client, StateID: strings.TrimSpace(line[2:i])}
+		for _, m := range stateFieldPattern.FindAllStringSubmatch(line[i+3:], -1) {
+			value := strings.TrimSpace(m[2])
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				value = unquoted
+			}
+			switch m[1] {
+			case "type":
+				s.Type = value
+			case "access":
+				s.Access = value
+			case "deny":
+				s.Deny = value
+			case "superblock":
+				s.Superblock = value
+			case "filename":
+				s.Filename = value
+			case "owner":
+				s.Owner = value
+			}
+		}
+		states = append(states, s)
+	}
+	return states
+}
+
+// superblockID formats the device of p the way nfsd's states files do
+func superblockID(p string) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(p, &st); err != nil {
+		return "", errors.Wrap(err, "error getting volume device")
+	}
+	dev := uint64(st.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^uint64(0xfff)
+	minor := dev&0xff | (dev>>12)&^uint64(0xff)
+	return fmt.Sprintf("%02x:%02x", major, minor), nil
+}
+
+// volumeClients lists the clients which have the volume mounted
+func (g *gateway) volumeClients(v *volume) ([]api.VolumeClient, error) {
+	clients := []api.VolumeClient{}
+	exported := v.Export.Path
+	if e, ok := g.exporter.(*v4Exporter); ok {
+		exported = e.pseudoPath(v.Name)
+	}
+
+	mounts, err := readRmtab()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range mounts {
+		if m.path == exported {
+			clients = append(clients, api.VolumeClient{Address: m.host, Version: "3"})
+		}
+	}
+
+	v4, err := readNFSDClients()
+	if err != nil || len(v4) == 0 {
+		return clients, err
+	}
+	sb, err := superblockID(v.Export.Path)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range v4 {
+		if !c.superblocks[sb] {
+			continue
+		}
+		vc := api.VolumeClient{Address: c.address, Version: "4." + strconv.Itoa(c.minor), ClientID: c.id, Name: c.name}
+		if !c.renewed.IsZero() {
+			renewed := c.renewed
+			vc.LastRenewed = &renewed
+		}
+		clients = append(clients, vc)
+	}
+	return clients, nil
+}
+
+func (g *gateway) listVolumeClients(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := g.kernelNFS("clients are"); err != nil {
+		writeError(w, err)
+		return
+	}
+	v, err := g.lookup(scopedName(r, name))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	clients, err := g.volumeClients(v)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, err := json.Marshal(clients)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+// checkInUse refuses to delete volumes which clients still have mounted
+func (g *gateway) checkInUse(name string) error {
+	// other servers' clients aren't known
+	if g.kernelNFS("clients are") != nil {
+		return nil
+	}
+	v, err := g.lookup(name)
+	if err != nil {
+		return err
+	}
+	clients, err := g.volumeClients(v)
+	if err != nil {
+		return err
+	}
+	if len(clients) == 0 {
+		return nil
+	}
+	return &codedError{
+		code:    api.ErrCodeVolumeInUse,
+		status:  http.StatusConflict,
+		err:     errors.Errorf("volume is mounted by %d clients, delete with force=true to revoke their access", len(clients)),
+		details: clients,
+	}
+}
+
+// revokeClients releases the state clients hold on an unexported volume.
+// Expiring v4 clients and unlocking the filesystem affect everything on it,
+// so for volumes sharing a filesystem only the locks of its v3 clients are
+// released and v4 state is left to expire with the lease. Failures are
+// logged, the volume is gone from the clients' point of view regardless.
+func (g *gateway) revokeClients(v *volume) {
+	log := logrus.WithField("volume", v.Name)
+	if m, err := mountPoint(v.Export.Path); err == nil && m == v.Export.Path {
+		sb, err := superblockID(v.Export.Path)
+		if err != nil {
+			log.WithError(err).Warn("error revoking client state")
+			return
+		}
+		clients, err := readNFSDClients()
+		if err != nil {
+			log.WithError(err).Warn("error revoking client state")
+		}
+		for _, c := range clients {
+			if c.superblocks[sb] {
+				if err := expireNFSDClient(c.dir); err != nil {
+					log.WithError(err).WithField("client", c.address).Warn("error expiring nfsv4 client")
+				}
+			}
+		}
+		if err := writeNFSDFile("unlock_filesystem", v.Export.Path); err != nil {
+			log.WithError(err).Warn("error releasing locks")
+		}
+		return
+	}
+
+	mounts, err := readRmtab()
+	if err != nil {
+		log.WithError(err).Warn("error revoking client state")
+		return
+	}
+	exported := v.Export.Path
+	if e, ok := g.exporter.(*v4Exporter); ok {
+		exported = e.pseudoPath(v.Name)
+	}
+	for _, m := range mounts {
+		if m.path != exported || net.ParseIP(m.host) == nil {
+			continue
+		}
+		if err := writeNFSDFile("unlock_ip", m.host); err != nil {
+			log.WithError(err).WithField("client", m.host).Warn("error releasing locks")
+		}
+	}
+}
+
+func expireNFSDClient(dir string) error {
+	return errors.Wrap(ioutil.WriteFile(filepath.Join(nfsdClientsDir(), dir, "ctl"), []byte("expire\n"), 0200), "error expiring nfsd client")
+}
+
+// NFSClient is an NFSv4 client known to nfsd
+type NFSClient struct {
+	// ID identifies the client in /admin/nfs/clients/{id}
+	ID       string
+	ClientID string
+	Address  string
+	Name     string `json:",omitempty"`
+	Version  string
+	Status   string `json:",omitempty"`
+	// LastRenewed is when the client last renewed its lease
+	LastRenewed *time.Time `json:",omitempty"`
+	States      int
+}
+
+// NFSState is an open, lock, delegation or layout held by an NFSv4 client
+type NFSState struct {
+	// Client is the ID of the client holding the state
+	Client  string
+	StateID string
+	Type    string
+	Access  string `json:",omitempty"`
+	Deny    string `json:",omitempty"`
+	// Superblock is the major:minor:inode of the file
+	Superblock string `json:",omitempty"`
+	// Filename is the file's name without its directory
+	Filename string `json:",omitempty"`
+	Owner    string `json:",omitempty"`
+}
+
+func (g *gateway) listNFSClients(w http.ResponseWriter, r *http.Request) {
+	clients, err := readNFSDClients()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := []NFSClient{}
+	for _, c := range clients {
+		nc := NFSClient{ID: c.dir, ClientID: c.id, Address: c.address, Name: c.name, Version: "4." + strconv.Itoa(c.minor), Status: c.status, States: len(c.states)}
+		if !c.renewed.IsZero() {
+			renewed := c.renewed
+			nc.LastRenewed = &renewed
+		}
+		resp = append(resp, nc)
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+// listNFSLocks lists the state held by NFSv4 clients, optionally only of the
+// types in ?type=lock,open
+func (g *gateway) listNFSLocks(w http.ResponseWriter, r *http.Request) {
+	types := make(map[string]bool)
+	for _, t := range splitTokens(r.URL.Query().Get("type")) {
+		types[t] = true
+	}
+	clients, err := readNFSDClients()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := []NFSState{}
+	for _, c := range clients {
+		for _, s := range c.states {
+			if len(types) == 0 || types[s.Type] {
+				resp = append(resp, s)
+			}
+		}
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+// expireNFSClient drops all of a client's state, releasing its locks as if
+// its lease had run out
+func (g *gateway) expireNFSClient(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if id == "" || strings.ContainsAny(id, "/.") {
+		writeError(w, errInvalid("invalid client id"))
+		return
+	}
+	if _, err := os.Stat(filepath.Join(nfsdClientsDir(), id)); err != nil {
+		if os.IsNotExist(err) {
+			writeError(w, errNotFound("client not found"))
+			return
+		}
+		writeError(w, errors.Wrap(err, "error looking up nfsd client"))
+		return
+	}
+	if err := expireNFSDClient(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	logrus.WithField("client", id).WithField("request_id", requestID(r)).Info("expired nfsv4 client")
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+var (
+	settingsBucket  = []byte("settings")
+	nfsdSettingsKey = []byte("nfsd")
+)
+
+var nfsdProcDir = "/proc/fs/nfsd"
+
+// NFSDSettings are the kernel nfsd tunables managed through the API. Versions
+// maps a protocol version (e.g. "3", "4.1") to whether it is enabled.
+type NFSDSettings struct {
+	Threads  int
+	Versions map[string]bool
+}
+
+type NFSDUpdateRequest struct {
+	Threads  *int
+	Versions map[string]bool
+}
+
+func loadNFSDSettings(db *bolt.DB) (*NFSDSettings, error) {
+	var s *NFSDSettings
+	err := db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(settingsBucket).Get(nfsdSettingsKey)
+		if data == nil {
+			return nil
+		}
+		s = &NFSDSettings{}
+		return json.Unmarshal(data, s)
+	})
+	return s, dbError(errors.Wrap(err, "error reading nfsd settings"))
+}
+
+// rpcNFSDArgs translates the desired settings into rpc.nfsd arguments
+func (s *NFSDSettings) rpcNFSDArgs() []string {
+	if s == nil {
+		return nil
+	}
+	var args []string
+	for _, v := range sortedVersions(s.Versions) {
+		if s.Versions[v] {
+			args = append(args, "-V", v)
+		} else {
+			args = append(args, "-N", v)
+		}
+	}
+	if s.Threads > 0 {
+		args = append(args, strconv.Itoa(s.Threads))
+	}
+	return args
+}
+
+func sortedVersions(m map[string]bool) []string {
+	var out []string
+	for v := range m {
+		out = append(out, v)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func readNFSDState() (*NFSDSettings, error) {
+	data, err := ioutil.ReadFile(filepath.Join(nfsdProcDir, "threads"))
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading nfsd threads")
+	}
+	threads, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing nfsd threads")
+	}
+
+	data, err = ioutil.ReadFile(filepath.Join(nfsdProcDir, "versions"))
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading nfsd versions")
+	}
+	versions := make(map[string]bool)
+	for _, f := range strings.Fields(string(data)) {
+		if len(f) < 2 {
+			continue
+		}
+		versions[f[1:]] = f[0] == '+'
+	}
+	return &NFSDSettings{Threads: threads, Versions: versions}, nil
+}
+
+func writeNFSDFile(name, value string) error {
+	return errors.Wrapf(ioutil.WriteFile(filepath.Join(nfsdProcDir, name), []byte(value+"\n"), 0644), "error writing nfsd %s", name)
+}
+
+// applyNFSDSettings pushes the settings to the running nfsd. The kernel
+// only accepts version changes while no threads are running, so nfsd is
+// briefly stopped when versions change.
+func applyNFSDSettings(s *NFSDSettings) error {
+	cur, err := readNFSDState()
+	if err != nil {
+		return err
+	}
+
+	threads := cur.Threads
+	if s.Threads > 0 {
+		threads = s.Threads
+	}
+
+	var changes []string
+	for _, v := range sortedVersions(s.Versions) {
+		if enabled, ok := cur.Versions[v]; ok && enabled == s.Versions[v] {
+			continue
+		}
+		sign := "-"
+		if s.Versions[v] {
+			sign = "+"
+		}
+		changes = append(changes, sign+v)
+	}
+
+	if len(changes) > 0 {
+		if err := writeNFSDFile("threads", "0"); err != nil {
+			return err
+		}
+		if err := writeNFSDFile("versions", strings.Join(changes, " ")); err != nil {
+			// try to bring the server back with the previous versions
+			writeNFSDFile("threads", strconv.Itoa(cur.Threads))
+			return err
+		}
+	}
+	if len(changes) > 0 || threads != cur.Threads {
+		return writeNFSDFile("threads", strconv.Itoa(threads))
+	}
+	return nil
+}
+
+func (g *gateway) getNFSD(w http.ResponseWriter, r *http.Request) {
+	s, err := readNFSDState()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+func (g *gateway) updateNFSD(w http.ResponseWriter, r *http.Request) {
+	var req NFSDUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	if req.Threads != nil && *req.Threads < 1 {
+		writeError(w, errInvalid("Threads must be at least 1"))
+		return
+	}
+	if nfsv4Only && (req.Versions["2"] || req.Versions["3"]) {
+		writeError(w, errInvalid("NFSv2 and v3 can't be enabled with -nfsv4-only"))
+		return
+	}
+
+	err := g.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(settingsBucket)
+		s := &NFSDSettings{Versions: make(map[string]bool)}
+		if data := b.Get(nfsdSettingsKey); data != nil {
+			if err := json.Unmarshal(data, s); err != nil {
+				return dbError(errors.Wrap(err, "error unmarshaling nfsd settings"))
+			}
+			if s.Versions == nil {
+				s.Versions = make(map[string]bool)
+			}
+		}
+		if req.Threads != nil {
+			s.Threads = *req.Threads
+		}
+		for v, enabled := range req.Versions {
+			s.Versions[v] = enabled
+		}
+
+		data, err := json.Marshal(s)
+		if err != nil {
+			return errors.Wrap(err, "error marshaling nfsd settings")
+		}
+		if err := b.Put(nfsdSettingsKey, data); err != nil {
+			return dbError(errors.Wrap(err, "error writing nfsd settings"))
+		}
+		return applyNFSDSettings(s)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	g.getNFSD(w, r)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// nfsd keeps its RPC statistics in /proc/net/rpc/nfsd, counters since the
+// module was loaded. The busy-thread histogram of the th line is always zero
+// on current kernels, so how busy the threads are is taken from the pool
+// statistics instead: a socket is enqueued whenever a request arrives while
+// no thread is free to take it.
+
+var nfsdStatsFile = "/proc/net/rpc/nfsd"
+
+var (
+	nfsProcNames = map[string][]string{
+		"2": {"null", "getattr", "setattr", "root", "lookup", "readlink", "read", "wrcache", "write", "create", "remove", "rename", "link", "symlink", "mkdir", "rmdir", "readdir", "fsstat"},
+		"3": {"null", "getattr", "setattr", "lookup", "access", "readlink", "read", "write", "create", "mkdir", "symlink", "mknod", "remove", "rmdir", "rename", "link", "readdir", "readdirplus", "fsstat", "fsinfo", "pathconf", "commit"},
+		"4": {"null", "compound"},
+	}
+	// nfs4OpNames are indexed by operation number, 0-2 aren't used
+	nfs4OpNames = []string{
+		"", "", "", "access", "close", "commit", "create", "delegpurge", "delegreturn", "getattr",
+		"getfh", "link", "lock", "lockt", "locku", "lookup", "lookupp", "nverify", "open", "openattr",
+		"open_confirm", "open_downgrade", "putfh", "putpubfh", "putrootfh", "read", "readdir", "readlink", "remove", "rename",
+		"renew", "restorefh", "savefh", "secinfo", "setattr", "setclientid", "setclientid_confirm", "verify", "write", "release_lockowner",
+		"backchannel_ctl", "bind_conn_to_session", "exchange_id", "create_session", "destroy_session", "free_stateid", "get_dir_delegation", "getdeviceinfo", "getdevicelist", "layoutcommit",
+		"layoutget", "layoutreturn", "secinfo_no_name", "sequence", "set_ssv", "test_stateid", "want_delegation", "destroy_clientid", "reclaim_complete", "allocate",
+		"copy", "copy_notify", "deallocate", "io_advise", "layouterror", "layoutstats", "offload_cancel", "offload_status", "read_plus", "seek",
+		"write_same", "clone", "getxattr", "setxattr", "listxattrs", "removexattr",
+	}
+)
+
+// NFSStats are nfsd's counters since it was loaded
+type NFSStats struct {
+	ReplyCache NFSReplyCacheStats
+	// ReadBytes and WriteBytes are the bytes read from and written to disk
+	ReadBytes  uint64
+	WriteBytes uint64
+	Threads    int
+	RPC        NFSRPCStats
+	Network    NFSNetworkStats
+	// Procedures are the calls per version and procedure, procedures never
+	// called are left out
+	Procedures map[string]map[string]uint64
+	// Operations are the NFSv4 operations sent in COMPOUND calls
+	Operations map[string]uint64
+	Pools      *NFSPoolStats `json:",omitempty"`
+}
+
+// NFSReplyCacheStats count lookups in the duplicate request cache
+type NFSReplyCacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	NoCache uint64
+}
+
+type NFSRPCStats struct {
+	Calls     uint64
+	BadCalls  uint64
+	BadFormat uint64
+	BadAuth   uint64
+	BadClient uint64
+}
+
+type NFSNetworkStats struct {
+	Packets        uint64
+	UDPPackets     uint64
+	TCPPackets     uint64
+	TCPConnections uint64
+}
+
+// NFSPoolStats are summed over nfsd's thread pools
+type NFSPoolStats struct {
+	PacketsArrived uint64
+	// SocketsEnqueued counts requests which had to wait for a free thread
+	SocketsEnqueued uint64
+	ThreadsWoken    uint64
+	ThreadsTimedOut uint64
+}
+
+func parseCounters(fields []string) ([]uint64, error) {
+	out := make([]uint64, len(fields))
+	for i, f := range fields {
+		n, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid counter %q", f)
+		}
+		out[i] = n
+	}
+	return out, nil
+}
+
+// counterAt returns c[i], or 0 for counters older kernels don't have
+func counterAt(c []uint64, i int) uint64 {
+	if i < len(c) {
+		return c[i]
+	}
+	return 0
+}
+
+// procCounters returns the counts of a procN line, which are preceded by how
+// many there are
+func procCounters(fields []string) ([]uint64, error) {
+	c, err := parseCounters(fields)
+	if err != nil {
+		return nil, err
+	}
+	if len(c) == 0 {
+		return nil, errors.New("missing procedure count")
+	}
+	if n := int(c[0]); n < len(c)-1 {
+		return c[1 : n+1], nil
+	}
+	return c[1:], nil
+}
+
+func namedCounters(names []string, counts []uint64) map[string]uint64 {
+	m := make(map[string]uint64)
+	for i, n := range counts {
+		if n == 0 {
+			continue
+		}
+		name := "op" + strconv.Itoa(i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		m[name] = n
+	}
+	return m
+}
+
+func parseNFSDStats(data []byte) (*NFSStats, error) {
+	st := &NFSStats{Procedures: make(map[string]map[string]uint64), Operations: make(map[string]uint64)}
+	s := bufio.NewScanner(strings.NewReader(string(data)))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		key := fields[0]
+		if key == "th" {
+			// only the thread count, the rest is the obsolete histogram
+			n, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid thread count")
+			}
+			st.Threads = n
+			continue
+		}
+		if strings.HasPrefix(key, "proc") {
+			c, err := procCounters(fields[1:])
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid %s line", key)
+			}
+			if key == "proc4ops" {
+				st.Operations = namedCounters(nfs4OpNames, c)
+				continue
+			}
+			version := strings.TrimPrefix(key, "proc")
+			st.Procedures[version] = namedCounters(nfsProcNames[version], c)
+			continue
+		}
+		c, err := parseCounters(fields[1:])
+		if err != nil {
+			// lines added by newer kernels may not be plain counters
+			continue
+		}
+		switch key {
+		case "rc":
+			st.ReplyCache = NFSReplyCacheStats{Hits: counterAt(c, 0), Misses: counterAt(c, 1), NoCache: counterAt(c, 2)}
+		case "io":
+			st.ReadBytes, st.WriteBytes = counterAt(c, 0), counterAt(c, 1)
+		case "net":
+			st.Network = NFSNetworkStats{Packets: counterAt(c, 0), UDPPackets: counterAt(c, 1), TCPPackets: counterAt(c, 2), TCPConnections: counterAt(c, 3)}
+		case "rpc":
+			st.RPC = NFSRPCStats{Calls: counterAt(c, 0), BadCalls: counterAt(c, 1), BadFormat: counterAt(c, 2), BadAuth: counterAt(c, 3), BadClient: counterAt(c, 4)}
+		}
+	}
+	return st, errors.Wrap(s.Err(), "error reading nfsd statistics")
+}
+
+// parsePoolStats sums the pool_stats lines, one per pool after a header
+func parsePoolStats(data []byte) (*NFSPoolStats, error) {
+	p := &NFSPoolStats{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		c, err := parseCounters(fields[1:5])
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid nfsd pool statistics")
+		}
+		p.PacketsArrived += c[0]
+		p.SocketsEnqueued += c[1]
+		p.ThreadsWoken += c[2]
+		p.ThreadsTimedOut += c[3]
+	}
+	return p, nil
+}
+
+// readNFSStats returns nil when nfsd isn't loaded, e.g. with ganesha
+func readNFSStats() (*NFSStats, error) {
+	data, err := ioutil.ReadFile(nfsdStatsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "error reading nfsd statistics")
+	}
+	st, err := parseNFSDStats(data)
+	if err != nil {
+		return nil, err
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(nfsdProcDir, "pool_stats")); err == nil {
+		if st.Pools, err = parsePoolStats(data); err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+func (g *gateway) getNFSStats(w http.ResponseWriter, r *http.Request) {
+	st, err := readNFSStats()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if st == nil {
+		writeError(w, errNotFound("nfsd statistics are not available, is the kernel NFS server running?"))
+		return
+	}
+	b, err := json.Marshal(st)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+// writeNFSMetrics adds the nfsd counters to a metrics scrape
+func writeNFSMetrics(bw *bufio.Writer, st *NFSStats) {
+	writeHeader(bw, "nfsg_nfsd_threads", "Number of nfsd threads.", "gauge")
+	fmt.Fprintf(bw, "nfsg_nfsd_threads %d\n", st.Threads)
+
+	writeHeader(bw, "nfsg_nfsd_io_bytes_total", "Bytes read and written by nfsd.", "counter")
+	fmt.Fprintf(bw, "nfsg_nfsd_io_bytes_total%s %d\n", formatLabels([]string{"direction"}, []string{"read"}), st.ReadBytes)
+	fmt.Fprintf(bw, "nfsg_nfsd_io_bytes_total%s %d\n", formatLabels([]string{"direction"}, []string{"write"}), st.WriteBytes)
+
+	writeHeader(bw, "nfsg_nfsd_reply_cache_total", "Lookups in nfsd's duplicate request cache.", "counter")
+	for _, c := range []struct {
+		result string
+		n      uint64
+	}{{"hit", st.ReplyCache.Hits}, {"miss", st.ReplyCache.Misses}, {"nocache", st.ReplyCache.NoCache}} {
+		fmt.Fprintf(bw, "nfsg_nfsd_reply_cache_total%s %d\n", formatLabels([]string{"result"}, []string{c.result}), c.n)
+	}
+
+	writeHeader(bw, "nfsg_nfsd_rpc_calls_total", "RPC calls received by nfsd.", "counter")
+	fmt.Fprintf(bw, "nfsg_nfsd_rpc_calls_total %d\n", st.RPC.Calls)
+	writeHeader(bw, "nfsg_nfsd_rpc_errors_total", "RPC calls rejected by nfsd.", "counter")
+	for _, c := range []struct {
+		reason string
+		n      uint64
+	}{{"format", st.RPC.BadFormat}, {"auth", st.RPC.BadAuth}, {"client", st.RPC.BadClient}} {
+		fmt.Fprintf(bw, "nfsg_nfsd_rpc_errors_total%s %d\n", formatLabels([]string{"reason"}, []string{c.reason}), c.n)
+	}
+
+	writeHeader(bw, "nfsg_nfsd_procedures_total", "NFS procedures called, by protocol version.", "counter")
+	var versions []string
+	for v := range st.Procedures {
+		versions = append(versions, v)
+	}
+	sort.Strings(versions)
+	for _, v := range versions {
+		for _, p := range sortedCounterKeys(st.Procedures[v]) {
+			fmt.Fprintf(bw, "nfsg_nfsd_procedures_total%s %d\n", formatLabels([]string{"version", "procedure"}, []string{v, p}), st.Procedures[v][p])
+		}
+	}
+
+	writeHeader(bw, "nfsg_nfsd_v4_operations_total", "NFSv4 operations sent in COMPOUND calls.", "counter")
+	for _, op := range sortedCounterKeys(st.Operations) {
+		fmt.Fprintf(bw, "nfsg_nfsd_v4_operations_total%s %d\n", formatLabels([]string{"operation"}, []string{op}), st.Operations[op])
+	}
+
+	if st.Pools != nil {
+		writeHeader(bw, "nfsg_nfsd_packets_arrived_total", "Requests which arrived at nfsd's thread pools.", "counter")
+		fmt.Fprintf(bw, "nfsg_nfsd_packets_arrived_total %d\n", st.Pools.PacketsArrived)
+		writeHeader(bw, "nfsg_nfsd_sockets_enqueued_total", "Requests which had to wait for a free nfsd thread.", "counter")
+		fmt.Fprintf(bw, "nfsg_nfsd_sockets_enqueued_total %d\n", st.Pools.SocketsEnqueued)
+	}
+}
+
+func sortedCounterKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
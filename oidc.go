@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// JWTs issued by an OIDC provider are accepted as API tokens besides the
+// static ones. Their signing keys are found through the provider's discovery
+// document and cached, and refetched when they are older than the refresh
+// interval or a token is signed with an unknown key, at most once a minute.
+// The tenant and role of a JWT come from its claims, a role binding can't be
+// made for one since the token changes with every login. -default-role is
+// for static tokens only, a JWT whose claims give it no role has no access.
+
+const (
+	// oidcLeeway allows for clock skew between the gateway and the provider
+	oidcLeeway = time.Minute
+	// oidcFetchInterval is how often the signing keys may be fetched
+	oidcFetchInterval = time.Minute
+	oidcFetchTimeout  = 10 * time.Second
+)
+
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"PS256": crypto.SHA256,
+	"PS384": crypto.SHA384,
+	"PS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// ecBitSizes are the curves each ES algorithm is used with
+var ecBitSizes = map[crypto.Hash]int{crypto.SHA256: 256, crypto.SHA384: 384, crypto.SHA512: 521}
+
+type oidcVerifier struct {
+	issuer   string
+	audience string
+	// tenantClaim and roleClaim name the claims holding the tenant and the
+	// roles, dots separate the names of nested claims
+	tenantClaim string
+	roleClaim   string
+	// roleMap maps values of the role claim to roles
+	roleMap map[string]string
+	refresh time.Duration
+	client  *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetched   time.Time
+	attempted time.Time
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// parseRoleMap parses comma separated VALUE=ROLE pairs
+func parseRoleMap(s string) (map[string]string, error) {
+	roles := make(map[string]string)
+	for _, t := range splitTokens(s) {
+		i := strings.LastIndex(t, "=")
+		if i <= 0 {
+			return nil, errors.Errorf("invalid role mapping %q, must be VALUE=ROLE", t)
+		}
+		role := strings.TrimSpace(t[i+1:])
+		if err := validateRole(role); err != nil {
+			return nil, errors.Wrapf(err, "invalid role mapping %q", t)
+		}
+		roles[strings.TrimSpace(t[:i])] = role
+	}
+	return roles, nil
+}
+
+func newOIDCVerifier(issuer, audience, tenantClaim, roleClaim, roleMap string, refresh time.Duration) (*oidcVerifier, error) {
+	if !strings.HasPrefix(issuer, "https://") && !strings.HasPrefix(issuer, "http://") {
+		return nil, errors.Errorf("invalid issuer %q, must be a URL", issuer)
+	}
+	if audience == "" {
+		return nil, errors.New("an audience is required")
+	}
+	roles, err := parseRoleMap(roleMap)
+	if err != nil {
+		return nil, err
+	}
+	return &oidcVerifier{
+		issuer:      issuer,
+		audience:    audience,
+		tenantClaim: tenantClaim,
+		roleClaim:   roleClaim,
+		roleMap:     roles,
+		refresh:     refresh,
+		client:      &http.Client{Timeout: oidcFetchTimeout},
+	}, nil
+}
+
+// isJWT reports whether the token looks like a JWT rather than a static token
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2 && strings.HasPrefix(token, "eyJ")
+}
+
+// verify checks the JWT and returns the tenant, role and subject its claims
+// give it, the role being empty when they give none
+func (o *oidcVerifier) verify(token string) (tenant, role, subject string, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", "", "", errors.New("malformed token")
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", "", "", errors.Wrap(err, "invalid token header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", "", "", errors.Wrap(err, "invalid token signature")
+	}
+	key, err := o.key(header.Kid)
+	if err != nil {
+		return "", "", "", err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return "", "", "", err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", "", "", errors.Wrap(err, "invalid token claims")
+	}
+	if err := o.checkClaims(claims, time.Now()); err != nil {
+		return "", "", "", err
+	}
+
+	if o.tenantClaim != "" {
+		var ok bool
+		if tenant, ok = lookupClaim(claims, o.tenantClaim).(string); !ok {
+			return "", "", "", errors.Errorf("token has no %s claim", o.tenantClaim)
+		}
+		if err := validateTenant(tenant); err != nil {
+			return "", "", "", err
+		}
+	}
+	subject, _ = claims["sub"].(string)
+	return tenant, o.role(claims), subject, nil
+}
+
+func (o *oidcVerifier) checkClaims(claims map[string]interface{}, now time.Time) error {
+	if iss, _ := claims["iss"].(string); iss != o.issuer {
+		return errors.Errorf("token issued by %q", iss)
+	}
+	var audiences []interface{}
+	switch aud := claims["aud"].(type) {
+	case string:
+		audiences = []interface{}{aud}
+	case []interface{}:
+		audiences = aud
+	}
+	var ok bool
+	for _, aud := range audiences {
+		ok = ok || aud == o.audience
+	}
+	if !ok {
+		return errors.New("token not issued for this audience")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.Add(-oidcLeeway).After(time.Unix(int64(exp), 0)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(oidcLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not valid yet")
+	}
+	return nil
+}
+
+// role returns the highest role the role claim maps to
+func (o *oidcVerifier) role(claims map[string]interface{}) string {
+	if o.roleClaim == "" {
+		return ""
+	}
+	var values []interface{}
+	switch v := lookupClaim(claims, o.roleClaim).(type) {
+	case string:
+		values = []interface{}{v}
+	case []interface{}:
+		values = v
+	}
+	var role string
+	for _, v := range values {
+		s, _ := v.(string)
+		r, ok := o.roleMap[s]
+		if !ok && roleLevels[s] > 0 {
+			r = s
+		}
+		if roleLevels[r] > roleLevels[role] {
+			role = r
+		}
+	}
+	return role
+}
+
+func lookupClaim(claims map[string]interface{}, name string) interface{} {
+	var v interface{} = claims
+	for _, part := range strings.Split(name, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[part]
+	}
+	return v
+}
+
+func decodeSegment(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// key returns the signing key, tokens without a key id may only be signed
+// by a provider with a single key
+func (o *oidcVerifier) key(kid string) (crypto.PublicKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	k, ok := o.findKey(kid)
+	if ok && time.Since(o.fetched) < o.refresh {
+		return k, nil
+	}
+	if time.Since(o.attempted) >= oidcFetchInterval {
+		o.attempted = time.Now()
+		if err := o.fetchKeys(); err != nil {
+			// keep using the keys we have while the provider is unreachable
+			logrus.WithError(err).Warn("error fetching OIDC signing keys")
+		} else {
+			k, ok = o.findKey(kid)
+		}
+	}
+	if !ok {
+		return nil, errors.Errorf("unknown signing key %q", kid)
+	}
+	return k, nil
+}
+
+func (o *oidcVerifier) findKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(o.keys) == 1 {
+		for _, k := range o.keys {
+			return k, true
+		}
+	}
+	k, ok := o.keys[kid]
+	return k, ok
+}
+
+func (o *oidcVerifier) getJSON(url string, v interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), oidcFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := o.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "error fetching %s", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("error fetching %s: %s", url, resp.Status)
+	}
+	return errors.Wrapf(json.NewDecoder(resp.Body).Decode(v), "error decoding %s", url)
+}
+
+// fetchKeys replaces the keys with those the provider currently publishes
+func (o *oidcVerifier) fetchKeys() error {
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := o.getJSON(strings.TrimSuffix(o.issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return err
+	}
+	if discovery.Issuer != o.issuer {
+		return errors.Errorf("discovery document is for issuer %q", discovery.Issuer)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := o.getJSON(discovery.JWKSURI, &set); err != nil {
+		return err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		k, err := jwk.publicKey()
+		if err != nil {
+			logrus.WithError(err).WithField("kid", jwk.Kid).Warn("ignoring OIDC signing key")
+			continue
+		}
+		keys[jwk.Kid] = k
+	}
+	o.keys = keys
+	o.fetched = time.Now()
+	return nil
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, errors.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// verifySignature checks an RS, PS or ES signature, the algorithms a token
+// may be signed with. HS and none are never accepted.
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	hash, ok := jwtAlgorithms[alg]
+	if !ok {
+		return errors.Errorf("unsupported signing algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	invalid := errors.New("invalid token signature")
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			if rsa.VerifyPKCS1v15(k, hash, digest, sig) != nil {
+				return invalid
+			}
+		case "PS":
+			if rsa.VerifyPSS(k, hash, digest, sig, nil) != nil {
+				return invalid
+			}
+		default:
+			return errors.Errorf("signing algorithm %q doesn't match the RSA key", alg)
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || k.Curve.Params().BitSize != ecBitSizes[hash] {
+			return errors.Errorf("signing algorithm %q doesn't match the EC key", alg)
+		}
+		if len(sig) != 2*size {
+			return invalid
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return invalid
+		}
+	default:
+		return errors.New("unsupported signing key")
+	}
+	return nil
+}
+
+type oidcRoleContextKey struct{}
+
+func withOIDCRole(r *http.Request, role string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), oidcRoleContextKey{}, role))
+}
+
+// requestOIDCRole returns the role the claims of the request's JWT give it,
+// which is empty when they give it none, and whether the request has a JWT
+func requestOIDCRole(r *http.Request) (string, bool) {
+	role, ok := r.Context().Value(oidcRoleContextKey{}).(string)
+	return role, ok
+}
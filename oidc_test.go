@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testProvider is an OIDC provider serving a discovery document and the
+// public keys of its signers, which can be swapped to rotate them
+type testProvider struct {
+	*httptest.Server
+	mu   sync.Mutex
+	keys []jsonWebKey
+}
+
+func newTestProvider() *testProvider {
+	p := &testProvider{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": p.URL, "jwks_uri": p.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string][]jsonWebKey{"keys": p.keys})
+	})
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+func (p *testProvider) publish(signers ...*testSigner) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = nil
+	for _, s := range signers {
+		p.keys = append(p.keys, s.jwk())
+	}
+}
+
+// testSigner signs tokens with an RSA or EC key
+type testSigner struct {
+	kid string
+	key crypto.Signer
+}
+
+// newTestSigner generates a key for the algorithm, RSA unless it's ES
+func newTestSigner(t *testing.T, kid, alg string) *testSigner {
+	var key crypto.Signer
+	var err error
+	switch alg {
+	case "ES256":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ES384":
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	default:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{kid: kid, key: key}
+}
+
+// padded returns the big-endian bytes of i, zero padded to size
+func padded(i *big.Int, size int) []byte {
+	b := i.Bytes()
+	if len(b) < size {
+		b = append(make([]byte, size-len(b)), b...)
+	}
+	return b
+}
+
+func encodeInt(i *big.Int, size int) string {
+	return base64.RawURLEncoding.EncodeToString(padded(i, size))
+}
+
+func (s *testSigner) jwk() jsonWebKey {
+	switch k := s.key.Public().(type) {
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return jsonWebKey{Kty: "EC", Kid: s.kid, Crv: k.Curve.Params().Name, X: encodeInt(k.X, size), Y: encodeInt(k.Y, size)}
+	case *rsa.PublicKey:
+		return jsonWebKey{Kty: "RSA", Kid: s.kid, Use: "sig", N: encodeInt(k.N, 0), E: encodeInt(big.NewInt(int64(k.E)), 0)}
+	}
+	return jsonWebKey{}
+}
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// sign returns a token with the claims, signed with alg which may differ
+// from the signer's own algorithm
+func (s *testSigner) sign(t *testing.T, alg string, claims map[string]interface{}) string {
+	signed := encodeSegment(t, jwtHeader{Alg: alg, Kid: s.kid}) + "." + encodeSegment(t, claims)
+	hash := jwtAlgorithms[alg]
+	if hash == 0 {
+		hash = crypto.SHA256
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	var err error
+	switch k := s.key.(type) {
+	case *ecdsa.PrivateKey:
+		var r, ss *big.Int
+		if r, ss, err = ecdsa.Sign(rand.Reader, k, digest); err == nil {
+			size := (k.Curve.Params().BitSize + 7) / 8
+			sig = append(padded(r, size), padded(ss, size)...)
+		}
+	case *rsa.PrivateKey:
+		if strings.HasPrefix(alg, "PS") {
+			sig, err = rsa.SignPSS(rand.Reader, k, hash, digest, nil)
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alg == "none" {
+		sig = nil
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func testClaims(issuer string, now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":    issuer,
+		"aud":    "gateway",
+		"sub":    "alice",
+		"exp":    now.Add(time.Hour).Unix(),
+		"tenant": "team-a",
+		"groups": []string{"devs"},
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+	p := newTestProvider()
+	defer p.Close()
+	signers := map[string]*testSigner{
+		"rs": newTestSigner(t, "rs", "RS256"),
+		"ps": newTestSigner(t, "ps", "PS384"),
+		"es": newTestSigner(t, "es", "ES256"),
+	}
+	p.publish(signers["rs"], signers["ps"], signers["es"])
+	o, err := newOIDCVerifier(p.URL, "gateway", "tenant", "groups", "devs=operator,ops=admin", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	cases := []struct {
+		name   string
+		signer string
+		alg    string
+		// claims changes the valid claims
+		claims func(c map[string]interface{})
+		role   string
+		ok     bool
+	}{
+		{name: "RS256", signer: "rs", alg: "RS256", role: roleOperator, ok: true},
+		{name: "RS512", signer: "rs", alg: "RS512", role: roleOperator, ok: true},
+		{name: "PS384", signer: "ps", alg: "PS384", role: roleOperator, ok: true},
+		{name: "ES256", signer: "es", alg: "ES256", role: roleOperator, ok: true},
+		{name: "none", signer: "rs", alg: "none"},
+		{name: "HS256", signer: "rs", alg: "HS256"},
+		{name: "RS with an EC key", signer: "es", alg: "RS256"},
+		{name: "ES with an RSA key", signer: "rs", alg: "ES256"},
+		{name: "ES384 with a P-256 key", signer: "es", alg: "ES384"},
+		{name: "expired", signer: "rs", alg: "RS256", claims: func(c map[string]interface{}) {
+			c["exp"] = now.Add(-2 * oidcLeeway).Unix()
+		}},
+		{name: "expired within the leeway", signer: "rs", alg: "RS256", role: roleOperator, ok: true, claims: func(c map[string]interface{}) {
+			c["exp"] = now.Add(-oidcLeeway / 2).Unix()
+		}},
+		{name: "no expiry", signer: "rs", alg: "RS256", claims: func(c map[string]interface{}) {
+			delete(c, "exp")
+		}},
+		{name: "not yet valid", signer: "rs", alg: "RS256", claims: func(c map[string]interface{}) {
+			c["nbf"] = now.Add(2 * oidcLeeway).Unix()
+		}},
+		{name: "wrong audience", signer: "rs", alg: "RS256", claims: func(c map[string]interface{}) {
+			c["aud"] = "other"
+		}},
+		{name: "one of several audiences", signer: "rs", alg: "RS256", role: roleOperator, ok: true, claims: func(c map[string]interface{}) {
+			c["aud"] = []string{"other", "gateway"}
+		}},
+		{name: "wrong issuer", signer: "rs", alg: "RS256", claims: func(c map[string]interface{}) {
+			c["iss"] = "https://evil.example.com"
+		}},
+		{name: "no tenant", signer: "rs", alg: "RS256", claims: func(c map[string]interface{}) {
+			delete(c, "tenant")
+		}},
+		{name: "highest mapped role", signer: "rs", alg: "RS256", role: roleAdmin, ok: true, claims: func(c map[string]interface{}) {
+			c["groups"] = []string{"devs", "ops", "others"}
+		}},
+		{name: "role name as is", signer: "rs", alg: "RS256", role: roleReader, ok: true, claims: func(c map[string]interface{}) {
+			c["groups"] = "reader"
+		}},
+		{name: "no role", signer: "rs", alg: "RS256", role: "", ok: true, claims: func(c map[string]interface{}) {
+			c["groups"] = []string{"others"}
+		}},
+	}
+	for _, tc := range cases {
+		claims := testClaims(p.URL, now)
+		if tc.claims != nil {
+			tc.claims(claims)
+		}
+		tenant, role, subject, err := o.verify(signers[tc.signer].sign(t, tc.alg, claims))
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got error %v, want ok %v", tc.name, err, tc.ok)
+			continue
+		}
+		if tc.ok && (tenant != "team-a" || role != tc.role || subject != "alice") {
+			t.Errorf("%s: got tenant %q, role %q, subject %q, want role %q", tc.name, tenant, role, subject, tc.role)
+		}
+	}
+
+	// a tampered token keeps its signature but changes its claims
+	token := signers["rs"].sign(t, "RS256", testClaims(p.URL, now))
+	parts := strings.Split(token, ".")
+	claims := testClaims(p.URL, now)
+	claims["tenant"] = "team-b"
+	if _, _, _, err := o.verify(parts[0] + "." + encodeSegment(t, claims) + "." + parts[2]); err == nil {
+		t.Error("tampered token accepted")
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	p := newTestProvider()
+	defer p.Close()
+	old, rotated := newTestSigner(t, "old", "RS256"), newTestSigner(t, "new", "ES256")
+	p.publish(old)
+	o, err := newOIDCVerifier(p.URL, "gateway", "", "", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if _, _, _, err := o.verify(old.sign(t, "RS256", testClaims(p.URL, now))); err != nil {
+		t.Fatal(err)
+	}
+
+	// an unknown key is refetched at most once per fetch interval
+	p.publish(rotated)
+	if _, _, _, err := o.verify(rotated.sign(t, "ES256", testClaims(p.URL, now))); err == nil {
+		t.Fatal("token signed with an unknown key accepted before the keys were refetched")
+	}
+	o.mu.Lock()
+	o.attempted = time.Now().Add(-oidcFetchInterval)
+	o.mu.Unlock()
+	if _, _, _, err := o.verify(rotated.sign(t, "ES256", testClaims(p.URL, now))); err != nil {
+		t.Fatalf("token signed with the rotated key: %v", err)
+	}
+	if _, _, _, err := o.verify(old.sign(t, "RS256", testClaims(p.URL, now))); err == nil {
+		t.Fatal("token signed with the retired key accepted")
+	}
+	// the only key signs tokens without a key id
+	rotated.kid = ""
+	if _, _, _, err := o.verify(rotated.sign(t, "ES256", testClaims(p.URL, now))); err != nil {
+		t.Fatalf("token without a key id: %v", err)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// The OpenAPI document is built from the registered routes and the Go types
+// they exchange, so it can't drift from what the gateway actually serves.
+
+type routeDoc struct {
+	summary  string
+	request  interface{}
+	response interface{}
+	status   int
+	// idempotent routes accept an Idempotency-Key header
+	idempotent bool
+	// conditional routes accept an If-Match header with the volume's ETag
+	conditional bool
+}
+
+var routeDocs = map[string]routeDoc{
+	"GET /volumes":                           {summary: "List volumes, filtered by repeated `label` selectors", response: []api.GetResponse{}},
+	"POST /volume":                           {summary: "Create a volume named by the `name` query parameter", request: api.CreateRequest{}, response: api.CreateResponse{}, idempotent: true},
+	"POST /volumes/batch":                    {summary: "Create several volumes, nothing is created unless all of them are valid", request: []api.BatchCreateItem{}, response: api.BatchCreateResponse{}, idempotent: true},
+	"PUT /volumes/{name}":                    {summary: "Create the volume or converge it to the complete spec given, 201 when it was created", request: api.CreateRequest{}, response: api.VolumeState{}, conditional: true},
+	"GET /volume/{name}":                     {summary: "Get a volume", response: api.GetResponse{}},
+	"PATCH /volume/{name}":                   {summary: "Update a volume's export", request: api.UpdateRequest{}, response: api.UpdateResponse{}, conditional: true},
+	"DELETE /volume/{name}":                  {summary: "Delete a volume asynchronously, refused while clients have it mounted unless `force=true`", response: api.JobResponse{}, status: http.StatusAccepted, idempotent: true, conditional: true},
+	"POST /volume/{name}/restore-trash":      {summary: "Restore the most recently deleted volume with this name", response: api.GetResponse{}},
+	"POST /volume/{name}/import":             {summary: "Adopt an existing directory as a volume", request: api.ImportRequest{}, response: api.CreateResponse{}, status: http.StatusCreated},
+	"POST /volume/{name}/clone":              {summary: "Create a new volume from a copy of this one asynchronously", request: api.CloneRequest{}, response: api.JobResponse{}, status: http.StatusAccepted},
+	"POST /volume/{name}/rename":             {summary: "Rename a volume, moving its data and export", request: api.RenameRequest{}, response: api.UpdateResponse{}},
+	"GET /volume/{name}/clients":             {summary: "List the NFS clients which have the volume mounted", response: []api.VolumeClient{}},
+	"GET /volume/{name}/acl":                 {summary: "Get the POSIX ACLs of the volume's root directory", response: api.ACL{}},
+	"PUT /volume/{name}/acl":                 {summary: "Replace the POSIX ACLs of the volume's root directory", request: api.ACL{}, response: api.ACL{}},
+	"GET /volume/{name}/usage":               {summary: "Get the disk usage of a volume", response: UsageResponse{}},
+	"GET /volume/{name}/stats":               {summary: "Get the bytes read and written through a volume's exports", response: api.VolumeStats{}},
+	"POST /volume/{name}/hosts":              {summary: "Allow a host to mount the volume", request: AddHostRequest{}, response: api.UpdateResponse{}, conditional: true},
+	"DELETE /volume/{name}/hosts/{host}":     {summary: "Revoke a host's access to the volume", response: api.UpdateResponse{}, conditional: true},
+	"GET /volume/{name}/access":              {summary: "List the volume's access rules", response: []api.AccessRule{}},
+	"POST /volume/{name}/access":             {summary: "Grant a host access to the volume with a new access rule", request: api.AccessRuleRequest{}, response: api.AccessRule{}, status: http.StatusCreated, conditional: true},
+	"GET /volume/{name}/access/{id}":         {summary: "Get an access rule", response: api.AccessRule{}},
+	"PUT /volume/{name}/access/{id}":         {summary: "Create or replace the access rule with this id, 201 when it was created", request: api.AccessRuleRequest{}, response: api.AccessRule{}, conditional: true},
+	"DELETE /volume/{name}/access/{id}":      {summary: "Revoke an access rule", status: http.StatusNoContent, conditional: true},
+	"GET /volume/{name}/subexports":          {summary: "List the exports of the volume's subdirectories", response: []api.Subexport{}},
+	"POST /volume/{name}/subexports":         {summary: "Export a subdirectory of the volume to its own hosts", request: api.SubexportRequest{}, response: api.Subexport{}, status: http.StatusCreated, conditional: true},
+	"GET /volume/{name}/subexports/{id}":     {summary: "Get a subexport", response: api.Subexport{}},
+	"DELETE /volume/{name}/subexports/{id}":  {summary: "Remove a subexport", status: http.StatusNoContent, conditional: true},
+	"GET /volume/{name}/smb":                 {summary: "Get the state of the volume's SMB share", response: api.SMBShare{}},
+	"POST /volume/{name}/snapshot":           {summary: "Take a snapshot", response: snapshot{}, status: http.StatusCreated},
+	"GET /volume/{name}/snapshots":           {summary: "List snapshots", response: []snapshot{}},
+	"DELETE /volume/{name}/snapshot/{id}":    {summary: "Delete a snapshot"},
+	"GET /volume/{name}/data":                {summary: "Download the volume's contents as a tar.gz"},
+	"PUT /volume/{name}/data":                {summary: "Extract an uploaded tar.gz into the volume, replace=true removes the existing data first", response: api.DataUploadResponse{}, conditional: true},
+	"GET /volume/{name}/files":               {summary: "Stat a file in the volume and list a page of its entries if it's a directory, see path, after and limit", response: api.FileList{}},
+	"POST /volume/{name}/backup":             {summary: "Back up the volume to S3", request: BackupRequest{}, response: api.JobResponse{}, status: http.StatusAccepted},
+	"GET /volume/{name}/backups":             {summary: "List backups", response: []backup{}},
+	"POST /volume/{name}/restore":            {summary: "Replace the volume's data with a backup", request: RestoreRequest{}, response: api.JobResponse{}, status: http.StatusAccepted},
+	"GET /volume/{name}/policy":              {summary: "Get the snapshot and backup policy", response: Policy{}},
+	"PUT /volume/{name}/policy":              {summary: "Set the snapshot and backup policy", request: Policy{}, response: Policy{}},
+	"DELETE /volume/{name}/policy":           {summary: "Remove the snapshot and backup policy"},
+	"POST /volume/{name}/replicate":          {summary: "Replicate the volume to a mirror on another gateway", request: api.ReplicateRequest{}, response: api.Replication{}},
+	"DELETE /volume/{name}/replicate":        {summary: "Stop replicating the volume"},
+	"PUT /volume/{name}/replica":             {summary: "Replace the data of a mirror with a replica streamed by another gateway"},
+	"GET /volume/{name}/integrity":           {summary: "Get the outcome of the volume's last integrity scrub", response: IntegrityReport{}},
+	"POST /volume/{name}/promote":            {summary: "Promote a read-only mirror to a read-write volume", response: api.UpdateResponse{}},
+	"POST /volume/{name}/repair":             {summary: "Re-run the steps of creating the volume against its stored record, fixing its data, mounts and export where they're missing", response: api.RepairResponse{}},
+	"GET /tenant/{id}/quota":                 {summary: "Get the caller's tenant quota", response: TenantQuota{}},
+	"GET /events":                            {summary: "Stream lifecycle events as server-sent events", response: Event{}},
+	"POST /webhooks":                         {summary: "Register a webhook", request: Webhook{}, response: Webhook{}, status: http.StatusCreated},
+	"GET /webhooks":                          {summary: "List webhooks", response: []Webhook{}},
+	"DELETE /webhooks/{id}":                  {summary: "Remove a webhook"},
+	"GET /jobs/{id}":                         {summary: "Get the status of an asynchronous job", response: api.Job{}},
+	"POST /netgroup":                         {summary: "Create a netgroup volumes can be exported to as @name", request: Netgroup{}, response: Netgroup{}, status: http.StatusCreated},
+	"GET /netgroups":                         {summary: "List netgroups", response: []Netgroup{}},
+	"GET /netgroup/{name}":                   {summary: "Get a netgroup", response: Netgroup{}},
+	"DELETE /netgroup/{name}":                {summary: "Delete a netgroup which no volume is exported to"},
+	"POST /netgroup/{name}/members":          {summary: "Add a host to a netgroup and re-apply the exports using it", request: AddMemberRequest{}, response: Netgroup{}},
+	"DELETE /netgroup/{name}/members/{host}": {summary: "Remove a host from a netgroup and re-apply the exports using it", response: Netgroup{}},
+	"GET /admin/nfsd":                        {summary: "Get nfsd threads and protocol versions", response: NFSDSettings{}},
+	"GET /admin/idmap":                       {summary: "Get the NFSv4 id mapping settings and the state of rpc.idmapd", response: IDMapStatus{}},
+	"PUT /admin/idmap":                       {summary: "Replace the NFSv4 id mapping settings and restart rpc.idmapd", request: IDMapSettings{}, response: IDMapStatus{}},
+	"PUT /admin/nfsd":                        {summary: "Change nfsd threads and protocol versions", request: NFSDUpdateRequest{}, response: NFSDSettings{}},
+	"POST /admin/reload":                     {summary: "Reload the config file"},
+	"GET /admin/export-defaults":             {summary: "Get the default export options", response: ExportDefaults{}},
+	"PUT /admin/export-defaults":             {summary: "Change the default export options and re-apply all exports", request: ExportDefaultsUpdate{}, response: ExportDefaults{}},
+	"GET /admin/templates":                   {summary: "List the templates new volumes can be created from", response: []Template{}},
+	"GET /admin/templates/{name}":            {summary: "Get a template", response: Template{}},
+	"PUT /admin/templates/{name}":            {summary: "Create or replace a template, 201 when it was created", request: Template{}, response: Template{}},
+	"DELETE /admin/templates/{name}":         {summary: "Delete a template, volumes created from it are left alone", status: http.StatusNoContent},
+	"GET /admin/nfs/clients":                 {summary: "List the NFSv4 clients known to nfsd", response: []NFSClient{}},
+	"POST /admin/nfs/clients/{id}/expire":    {summary: "Expire an NFSv4 client, dropping its opens and locks"},
+	"GET /admin/nfs/locks":                   {summary: "List the opens, locks and delegations of NFSv4 clients, filtered by the `type` query parameter", response: []NFSState{}},
+	"GET /admin/maintenance":                 {summary: "Get whether the gateway is in maintenance", response: MaintenanceStatus{}},
+	"POST /admin/maintenance":                {summary: "Enter maintenance: refuse changes with 503 and optionally flush or freeze the volumes' filesystems", request: MaintenanceRequest{}, response: MaintenanceStatus{}},
+	"DELETE /admin/maintenance":              {summary: "Leave maintenance, thawing frozen filesystems", response: MaintenanceStatus{}},
+	"GET /admin/nfs/stats":                   {summary: "Get nfsd's RPC, I/O, reply cache and thread pool statistics", response: NFSStats{}},
+	"GET /admin/ha":                          {summary: "Get the HA mode and role of this node", response: HAStatus{}},
+	"POST /admin/ha/takeover":                {summary: "Take over as the active node: mount the shared device, assign the floating IP and start serving, only on a standby", response: HAStatus{}},
+	"GET /admin/grace":                       {summary: "Get the NFSv4 lease and grace times, recovery dir and whether nfsd is in its grace period", response: GraceState{}},
+	"PUT /admin/grace":                       {summary: "Change the NFSv4 lease and grace times or recovery dir, restarting nfsd", request: GraceUpdateRequest{}, response: GraceState{}},
+	"POST /admin/grace/start":                {summary: "Restart nfsd to start a grace period, e.g. after a failover", response: GraceState{}},
+	"POST /admin/grace/end":                  {summary: "End the grace period early", response: GraceState{}},
+	"GET /admin/pools":                       {summary: "List storage pools with their utilization", response: []PoolStatus{}},
+	"POST /admin/pools":                      {summary: "Add a storage pool", request: PoolRequest{}, response: PoolStatus{}},
+	"POST /admin/pools/{name}/drain":         {summary: "Stop placing volumes in the pool and migrate its volumes to other pools", response: PoolDrainResponse{}, status: http.StatusAccepted},
+	"DELETE /admin/pools/{name}":             {summary: "Remove an empty storage pool"},
+	"GET /admin/rbac":                        {summary: "List the role bindings of the API tokens", response: RBACResponse{}},
+	"POST /admin/rbac":                       {summary: "Give an API token a role, optionally limited to some volumes", request: RoleBindingRequest{}, response: RoleBinding{}, status: http.StatusCreated},
+	"DELETE /admin/rbac/{name}":              {summary: "Remove a role binding, the token gets the default role"},
+	"GET /whoami":                            {summary: "Get the role of the calling token", response: WhoAmIResponse{}},
+	"GET /admin/ports":                       {summary: "Get the configured NFS ports and the services registered with rpcbind", response: PortMap{}},
+	"GET /admin/preflight":                   {summary: "Get the results of the startup dependency checks with remedies for failed ones", response: PreflightReport{}},
+	"GET /admin/db/backup":                   {summary: "Download a consistent snapshot of the database"},
+	"POST /admin/db/restore":                 {summary: "Replace the database with an uploaded snapshot, sent as the raw request body, and re-export every volume", response: DBRestoreResult{}},
+	"GET /admin/reconcile":                   {summary: "Get the result of the last export reconciliation", response: ReconcileReport{}},
+	"POST /admin/decommission":               {summary: "Shut the gateway down and unexport all volumes, even with -preserve-exports-on-shutdown", status: http.StatusAccepted},
+	"GET /admin/orphans":                     {summary: "Scan for volume directories and exports without a volume", response: OrphanReport{}},
+	"POST /admin/orphans/adopt":              {summary: "Make an orphaned directory a volume again, from its sidecar if it has one", request: api.ImportRequest{}, response: api.CreateResponse{}, status: http.StatusCreated},
+	"POST /admin/orphans/purge":              {summary: "Delete an orphaned directory or remove an orphaned export", request: OrphanPurgeRequest{}},
+	"POST /admin/reconcile":                  {summary: "Reconcile exports with the database now", response: ReconcileReport{}},
+	"GET /admin/commands":                    {summary: "List the most recent external commands run by the gateway", response: []CommandRecord{}},
+	"GET /admin/daemons":                     {summary: "List the supervised NFS daemons and their state", response: []DaemonStatus{}},
+	"GET /admin/daemons/{name}/logs":         {summary: "Get the most recent output lines of a daemon, the lines query parameter limits how many", response: []DaemonLogLine{}},
+	"GET /healthz":                           {summary: "Liveness probe", response: HealthResponse{}},
+	"GET /readyz":                            {summary: "Readiness probe", response: HealthResponse{}},
+	"GET /metrics":                           {summary: "Prometheus metrics"},
+	"GET /openapi.json":                      {summary: "This document"},
+}
+
+var errorCodes = []string{
+	api.ErrCodeInvalidRequest,
+	api.ErrCodeUnauthorized,
+	api.ErrCodeForbidden,
+	api.ErrCodeNotFound,
+	api.ErrCodeAlreadyExists,
+	api.ErrCodeQuotaExceeded,
+	api.ErrCodeExportFailed,
+	api.ErrCodeVolumeIsMirror,
+	api.ErrCodeReplicaUnsupported,
+	api.ErrCodeReplicaBaseMissing,
+	api.ErrCodeRateLimited,
+	api.ErrCodeTimeout,
+	api.ErrCodeMaintenance,
+	api.ErrCodePreconditionFailed,
+	api.ErrCodeUnsupportedVersion,
+	api.ErrCodeDatabase,
+	api.ErrCodeInternal,
+}
+
+// route variables may carry a pattern, e.g. {host:.+}
+var pathVarPattern = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+type openAPIBuilder struct {
+	schemas map[string]interface{}
+}
+
+func openAPIHandler(r *mux.Router) http.HandlerFunc {
+	var (
+		once sync.Once
+		doc  []byte
+		err  error
+	)
+	return func(w http.ResponseWriter, req *http.Request) {
+		once.Do(func() {
+			doc, err = json.Marshal(buildOpenAPI(r))
+		})
+		if err != nil {
+			writeError(w, errors.Wrap(err, "error marshaling openapi document"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc)
+	}
+}
+
+func buildOpenAPI(r *mux.Router) map[string]interface{} {
+	b := &openAPIBuilder{schemas: make(map[string]interface{})}
+	b.schemas["Error"] = map[string]interface{}{
+		"type":     "object",
+		"required": []string{"code", "message"},
+		"properties": map[string]interface{}{
+			"code":    map[string]interface{}{"type": "string", "enum": errorCodes},
+			"message": map[string]interface{}{"type": "string"},
+			"details": map[string]interface{}{},
+		},
+	}
+
+	paths := make(map[string]map[string]interface{})
+	r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		path := pathVarPattern.ReplaceAllString(tmpl, "{$1}")
+		// the docker plugin protocol is documented by docker
+		if strings.HasPrefix(path, "/Plugin.") || strings.HasPrefix(path, "/VolumeDriver.") {
+			return nil
+		}
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		for _, m := range methods {
+			paths[path][strings.ToLower(m)] = b.operation(m, path)
+		}
+		return nil
+	})
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   "nfs-rest-gateway",
+			"version": "1",
+		},
+		// the unversioned paths are a deprecated alias
+		"servers": []interface{}{map[string]interface{}{"url": apiVersionPrefix}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": b.schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{"bearer": []string{}}},
+	}
+}
+
+func (b *openAPIBuilder) operation(method, path string) map[string]interface{} {
+	doc := routeDocs[method+" "+path]
+	op := map[string]interface{}{}
+	if doc.summary != "" {
+		op["summary"] = doc.summary
+	}
+
+	var params []interface{}
+	for _, m := range pathVarPattern.FindAllStringSubmatch(path, -1) {
+		params = append(params, map[string]interface{}{
+			"name": m[1], "in": "path", "required": true,
+			"schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	if method == "POST" && path == "/volume" {
+		params = append(params, map[string]interface{}{
+			"name": "name", "in": "query", "required": true,
+			"schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	if doc.idempotent {
+		params = append(params, map[string]interface{}{
+			"name": idempotencyHeader, "in": "header",
+			"schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	if doc.conditional {
+		params = append(params, map[string]interface{}{
+			"name": ifMatchHeader, "in": "header",
+			"schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	if doc.request != nil {
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": b.schema(reflect.TypeOf(doc.request))},
+			},
+		}
+	}
+
+	status := doc.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	if doc.response != nil {
+		success["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": b.schema(reflect.TypeOf(doc.response))},
+		}
+	}
+	op["responses"] = map[string]interface{}{
+		strconv.Itoa(status): success,
+		"default": map[string]interface{}{
+			"description": "Error",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"}},
+			},
+		},
+	}
+	return op
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schema returns the JSON schema of t as encoding/json would marshal it.
+// Named structs are added to the components and referenced.
+func (b *openAPIBuilder) schema(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return b.schema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		name := strings.Title(t.Name())
+		if name == "" {
+			return b.structSchema(t)
+		}
+		if _, ok := b.schemas[name]; !ok {
+			// reserve the name first in case the type is recursive
+			b.schemas[name] = nil
+			b.schemas[name] = b.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+func (b *openAPIBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if i := strings.Index(tag, ","); i >= 0 {
+			name, opts = tag[:i], tag[i:]
+		}
+		if f.Anonymous && name == "" {
+			// embedded structs are flattened by encoding/json
+			if s := b.structSchema(f.Type); s["properties"] != nil {
+				for k, v := range s["properties"].(map[string]interface{}) {
+					if _, ok := props[k]; !ok {
+						props[k] = v
+					}
+				}
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = b.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Ptr {
+			required = append(required, name)
+		}
+	}
+	s := map[string]interface{}{"type": "object", "properties": props}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+)
+
+// flagOptions are the exports(5) options without a value which aren't in
+// optionGroups.
+var flagOptions = map[string]bool{
+	"mp":             true,
+	"mountpoint":     true,
+	"nordirplus":     true,
+	"pnfs":           true,
+	"no_pnfs":        true,
+	"security_label": true,
+}
+
+// valueOptions are the exports(5) options taking a value, mapped to a check
+// of the value.
+var valueOptions = map[string]func(string) string{
+	"anonuid":    checkID,
+	"anongid":    checkID,
+	"fsid":       checkFSID,
+	"sec":        checkSec,
+	"refer":      checkNonEmpty,
+	"replicas":   checkNonEmpty,
+	"mp":         checkNonEmpty,
+	"mountpoint": checkNonEmpty,
+}
+
+func checkID(v string) string {
+	if _, err := strconv.ParseUint(v, 10, 32); err != nil {
+		return "must be a numeric id"
+	}
+	return ""
+}
+
+func checkFSID(v string) string {
+	if v == "root" || checkID(v) == "" {
+		return ""
+	}
+	if len(strings.Replace(v, "-", "", -1)) == 32 {
+		return ""
+	}
+	return "must be a number, root or a uuid"
+}
+
+func checkSec(v string) string {
+	for _, f := range strings.Split(v, ":") {
+		if !securityFlavors[f] {
+			return "flavors must be colon separated sys, krb5, krb5i or krb5p"
+		}
+	}
+	return ""
+}
+
+func checkNonEmpty(v string) string {
+	if v == "" {
+		return "must have a value"
+	}
+	return ""
+}
+
+// optionPolicy limits the export options clients may set. With allow set
+// only the listed options are accepted, deny rejects options outright.
+// Options are matched by name, e.g. "anonuid" covers anonuid=1000.
+type optionPolicy struct {
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+var exportOptionPolicy optionPolicy
+
+// setOptionPolicy sets the policy from command line settings
+func setOptionPolicy(allow, deny string) error {
+	p := optionPolicy{allow: make(map[string]bool), deny: make(map[string]bool)}
+	for _, o := range splitTokens(allow) {
+		if err := checkOptionName(o); err != nil {
+			return err
+		}
+		p.allow[o] = true
+	}
+	for _, o := range splitTokens(deny) {
+		if err := checkOptionName(o); err != nil {
+			return err
+		}
+		p.deny[o] = true
+	}
+	exportOptionPolicy = p
+	return nil
+}
+
+func checkOptionName(o string) error {
+	if _, ok := optionGroups[o]; ok || flagOptions[o] || valueOptions[o] != nil {
+		return nil
+	}
+	return &validationError{Field: "option", Value: o, Reason: "unknown export option"}
+}
+
+// parseOptions checks the syntax of an exports(5) option list
+func parseOptions(opts string) error {
+	if opts == "" {
+		return nil
+	}
+	for _, o := range strings.Split(opts, ",") {
+		o = strings.TrimSpace(o)
+		name, value := o, ""
+		hasValue := false
+		if i := strings.Index(o, "="); i >= 0 {
+			name, value, hasValue = o[:i], o[i+1:], true
+		}
+		switch {
+		case o == "":
+			return &validationError{Field: "Options", Value: opts, Reason: "must not contain empty options"}
+		case strings.ContainsAny(o, " \t\n()\"#"):
+			return &validationError{Field: "Options", Value: o, Reason: "must not contain whitespace, parentheses, quotes or #"}
+		case checkOptionName(name) != nil:
+			return &validationError{Field: "Options", Value: o, Reason: "unknown export option"}
+		case hasValue && valueOptions[name] == nil:
+			return &validationError{Field: "Options", Value: o, Reason: "option does not take a value"}
+		case !hasValue && !flagOptions[name] && optionGroups[name] == "":
+			return &validationError{Field: "Options", Value: o, Reason: "option requires a value"}
+		}
+		if hasValue {
+			if reason := valueOptions[name](value); reason != "" {
+				return &validationError{Field: "Options", Value: o, Reason: reason}
+			}
+		}
+	}
+	return nil
+}
+
+// anonOptions returns the anonuid and anongid options a create request asks
+// for with AnonUid and AnonGid
+func anonOptions(req api.CreateRequest) string {
+	var opts []string
+	if req.AnonUid != nil {
+		opts = append(opts, "anonuid="+strconv.FormatUint(uint64(*req.AnonUid), 10))
+	}
+	if req.AnonGid != nil {
+		opts = append(opts, "anongid="+strconv.FormatUint(uint64(*req.AnonGid), 10))
+	}
+	return strings.Join(opts, ",")
+}
+
+// setFlagOption adds or removes an option without a value
+func setFlagOption(opts, name string, on bool) string {
+	var out []string
+	for _, o := range strings.Split(opts, ",") {
+		if o = strings.TrimSpace(o); o != "" && o != name {
+			out = append(out, o)
+		}
+	}
+	if on {
+		out = append(out, name)
+	}
+	return strings.Join(out, ",")
+}
+
+func hasOption(opts, key string) bool {
+	for _, o := range strings.Split(opts, ",") {
+		if optionKey(strings.TrimSpace(o)) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// validateOptions checks client supplied options against the syntax and the
+// configured policy.
+func validateOptions(opts string) error {
+	if err := parseOptions(opts); err != nil {
+		return err
+	}
+	p := exportOptionPolicy
+	for _, o := range strings.Split(opts, ",") {
+		name := strings.TrimSpace(o)
+		if name == "" {
+			continue
+		}
+		if i := strings.Index(name, "="); i >= 0 {
+			name = name[:i]
+		}
+		if p.deny[name] || (len(p.allow) > 0 && !p.allow[name]) {
+			return &validationError{Field: "Options", Value: strings.TrimSpace(o), Reason: "option is not permitted on this gateway"}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/pkg/errors"
+)
+
+// Orphans are left behind when a volume's record and its data or exports get
+// out of step, e.g. a crash between creating a directory and storing the
+// record, or a database restored from an older backup. Directories under
+// <pool>/nfs without a volume can be adopted as volumes or purged. Exports of
+// paths without a volume can be purged, unless they come from exports files
+// the gateway doesn't manage, where the next exportfs run would bring them
+// back anyway.
+
+// orphanMinAge keeps directories of volumes still being created out of scans
+const orphanMinAge = 10 * time.Minute
+
+type OrphanReport struct {
+	Directories []OrphanDirectory
+	Exports     []OrphanExport
+	Scanned     time.Time
+}
+
+type OrphanDirectory struct {
+	Path string
+	Pool string
+	// Tenant and Name are what the directory is adopted as
+	Tenant string `json:",omitempty"`
+	Name   string
+	// Sidecar is set when the volume's record can be restored from its
+	// sidecar on adoption
+	Sidecar  bool `json:",omitempty"`
+	Modified time.Time
+}
+
+type OrphanExport struct {
+	Path    string
+	Clients []string
+	// Managed is set when the export comes from an exports file the gateway
+	// wrote. Exports from other exports files can't be purged.
+	Managed bool
+}
+
+// OrphanPurgeRequest names the orphaned directory or export to remove
+type OrphanPurgeRequest struct {
+	Path string
+}
+
+// orphanDirs lists the directories under the pools which no volume uses
+func (g *gateway) orphanDirs(now time.Time) ([]OrphanDirectory, error) {
+	known := make(map[string]bool)
+	tenants := make(map[string]bool)
+	err := g.view(func(tx *bolt.Tx) error {
+		err := forEachVolume(tx, func(data []byte) error {
+			var v volume
+			if err := json.Unmarshal(data, &v); err != nil {
+				return dbError(errors.Wrap(err, "error unmarshaling volume from database"))
+			}
+			known[v.Export.Path] = true
+			if t := volumeTenant(v.Name); t != "" {
+				tenants[t] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(tenantsBucket).ForEach(func(tenant, _ []byte) error {
+			tenants[string(tenant)] = true
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := []OrphanDirectory{}
+	for _, p := range g.pools.list() {
+		root := filepath.Join(p.Path, "nfs")
+		entries, err := ioutil.ReadDir(root)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading pool "+p.Name)
+		}
+		for _, e := range entries {
+			if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			if tenants[e.Name()] || g.auth.hasTenant(e.Name()) {
+				sub, err := ioutil.ReadDir(filepath.Join(root, e.Name()))
+				if err != nil {
+					return nil, errors.Wrap(err, "error reading tenant directory")
+				}
+				for _, s := range sub {
+					if d, ok := orphanDir(root, p.Name, e.Name(), s, known, now); ok {
+						orphans = append(orphans, d)
+					}
+				}
+				continue
+			}
+			if d, ok := orphanDir(root, p.Name, "", e, known, now); ok {
+				orphans = append(orphans, d)
+			}
+		}
+	}
+	return orphans, nil
+}
+
+func orphanDir(root, pool, tenant string, fi os.FileInfo, known map[string]bool, now time.Time) (OrphanDirectory, bool) {
+	p := filepath.Join(root, tenant, fi.Name())
+	if !fi.IsDir() || strings.HasPrefix(fi.Name(), ".") || known[p] || now.Sub(fi.ModTime()) < orphanMinAge {
+		return OrphanDirectory{}, false
+	}
+	d := OrphanDirectory{Path: p, Pool: pool, Tenant: tenant, Name: fi.Name(), Modified: fi.ModTime().UTC()}
+	d.Sidecar = readSidecar(volumeID(tenant, fi.Name()), p) != nil
+	return d, true
+}
+
+// readSidecar returns the volume recorded in id's sidecar if it has the
+// data at p
+func readSidecar(id, p string) *volume {
+	if sidecarDir == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(sidecarPath(id))
+	if err != nil {
+		return nil
+	}
+	var v volume
+	if err := json.Unmarshal(data, &v); err != nil || v.Name != id || v.Export.Path != p {
+		return nil
+	}
+	return &v
+}
+
+// orphanExports lists the exports of paths no volume has
+func (g *gateway) orphanExports() ([]OrphanExport, error) {
+	orphans := []OrphanExport{}
+	if _, ok := g.exporter.(exportLister); !ok {
+		return orphans, nil
+	}
+	clients, err := readEtabClients()
+	if err != nil {
+		return nil, err
+	}
+	vols, err := g.list()
+	if err != nil {
+		return nil, err
+	}
+	managed := make(map[string]bool, len(vols))
+	for _, v := range vols {
+		managed[v.Export.Path] = true
+	}
+	// the pseudo-root and the bind mounts in it are exported for the volumes
+	if e, ok := g.exporter.(*v4Exporter); ok {
+		managed[e.root] = true
+		e.mu.Lock()
+		for p := range e.paths {
+			managed[p] = true
+		}
+		e.mu.Unlock()
+	}
+	files, err := exportFilePaths(true)
+	if err != nil {
+		return nil, err
+	}
+	for p, c := range clients {
+		if managed[p] {
+			continue
+		}
+		sort.Strings(c)
+		orphans = append(orphans, OrphanExport{Path: p, Clients: c, Managed: files[p] != ""})
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].Path < orphans[j].Path })
+	return orphans, nil
+}
+
+// readEtabClients returns the clients each path is exported to
+func readEtabClients() (map[string][]string, error) {
+	f, err := os.Open(etabPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading export table")
+	}
+	defer f.Close()
+
+	clients := make(map[string][]string)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		p := unescapeExportPath(fields[0])
+		client := fields[1]
+		if i := strings.Index(client, "("); i >= 0 {
+			client = client[:i]
+		}
+		clients[p] = append(clients[p], client)
+	}
+	return clients, errors.Wrap(s.Err(), "error reading export table")
+}
+
+// exportFilePaths maps the paths exported by the gateway's volume exports
+// files, or by every other exports file, to the file exporting them
+func exportFilePaths(managed bool) (map[string]string, error) {
+	matches, err := filepath.Glob(filepath.Join(exportsDir, "*.exports"))
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing exports files")
+	}
+	var files []string
+	if !managed {
+		files = append(files, systemExportsFile)
+	}
+	for _, m := range matches {
+		if strings.HasPrefix(filepath.Base(m), exportsFilePrefix) == managed {
+			files = append(files, m)
+		}
+	}
+	paths := make(map[string]string)
+	for _, m := range files {
+		data, err := ioutil.ReadFile(m)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, errors.Wrap(err, "error reading exports file")
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			paths[exportLinePath(line)] = m
+		}
+	}
+	return paths, nil
+}
+
+// exportLinePath returns the path of an exports(5) line, which is quoted
+// when it has spaces
+func exportLinePath(line string) string {
+	if strings.HasPrefix(line, `"`) {
+		if i := strings.Index(line[1:], `"`); i >= 0 {
+			return line[1 : i+1]
+		}
+	}
+	return unescapeExportPath(strings.Fields(line)[0])
+}
+
+func (g *gateway) scanOrphans() (*OrphanReport, error) {
+	now := time.Now().UTC()
+	dirs, err := g.orphanDirs(now)
+	if err != nil {
+		return nil, err
+	}
+	exports, err := g.orphanExports()
+	if err != nil {
+		return nil, err
+	}
+	return &OrphanReport{Directories: dirs, Exports: exports, Scanned: now}, nil
+}
+
+func (g *gateway) runOrphanScan(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		report, err := g.scanOrphans()
+		if err != nil {
+			logrus.WithError(err).Error("error scanning for orphans")
+			continue
+		}
+		for _, d := range report.Directories {
+			logrus.WithField("path", d.Path).Warn("found directory without a volume, adopt or purge it through /admin/orphans")
+		}
+		for _, e := range report.Exports {
+			logrus.WithField("path", e.Path).WithField("clients", e.Clients).Warn("found export without a volume")
+		}
+	}
+}
+
+func (g *gateway) listOrphans(w http.ResponseWriter, r *http.Request) {
+	report, err := g.scanOrphans()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, err := json.Marshal(report)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+// findOrphanDir returns the orphaned directory at p, checked again so it
+// isn't a volume created in the meantime
+func (g *gateway) findOrphanDir(p string) (*OrphanDirectory, error) {
+	dirs, err := g.orphanDirs(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		if d.Path == filepath.Clean(p) {
+			return &d, nil
+		}
+	}
+	return nil, nil
+}
+
+// adoptOrphan makes an orphaned directory a volume again. Its sidecar's
+// record is restored when it has one, otherwise the volume gets the export
+// settings of the request.
+func (g *gateway) adoptOrphan(w http.ResponseWriter, r *http.Request) {
+	var req api.ImportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	d, err := g.findOrphanDir(req.Path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if d == nil {
+		writeError(w, errNotFound("no orphaned directory at "+req.Path))
+		return
+	}
+	v, err := g.adoptOrphanDir(r.Context(), d, req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	requestLog(r).WithField("volume", v.Name).WithField("path", d.Path).Info("adopted orphaned directory")
+
+	b, err := json.Marshal(api.CreateResponse{Name: displayName(v.Name), Path: v.Export.Path})
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
+
+func (g *gateway) adoptOrphanDir(ctx context.Context, d *OrphanDirectory, req api.ImportRequest) (*volume, error) {
+	name := volumeID(d.Tenant, d.Name)
+	if err := validateName(d.Name); err != nil {
+		return nil, err
+	}
+	v := readSidecar(name, d.Path)
+	if v == nil {
+		if err := validateSecurity(req.Security); err != nil {
+			return nil, err
+		}
+		if err := validateOptions(req.Options); err != nil {
+			return nil, err
+		}
+		if err := validateHosts(req.Hosts); err != nil {
+			return nil, err
+		}
+		if err := validateLabels(req.Labels); err != nil {
+			return nil, err
+		}
+		if err := validateDescription(req.Description); err != nil {
+			return nil, err
+		}
+		fsid, err := newFSID()
+		if err != nil {
+			return nil, err
+		}
+		v = &volume{
+			Name: name,
+			Pool: d.Pool,
+			Export: nfsExport{
+				Path:     d.Path,
+				Hosts:    req.Hosts,
+				Options:  g.createOptions(req.Options),
+				Security: req.Security,
+			},
+			Labels:      req.Labels,
+			ReadOnly:    req.ReadOnly,
+			FSID:        fsid,
+			Description: req.Description,
+		}
+		setCreated(ctx, v)
+	}
+	// a sidecar's pending job is long gone
+	v.Pending = ""
+	v.setStatus(api.VolumeAvailable, "")
+
+	defer g.locks.lock(name)()
+	err := g.updateUndo(ctx, name, func(tx *bolt.Tx, u *undoLog) error {
+		if getVolumeData(tx, name) != nil {
+			return errAlreadyExists("already exists")
+		}
+		if err := g.checkTenantConflict(tx, name); err != nil {
+			return err
+		}
+		if err := g.checkQuota(tx, volumeTenant(name), v.sizeLimit()); err != nil {
+			return err
+		}
+		if err := putVolume(tx, v); err != nil {
+			return err
+		}
+		if tenant := volumeTenant(name); tenant != "" {
+			if _, err := g.updateQuota(tx, tenant); err != nil {
+				return err
+			}
+		}
+		u.add("unexport", func() error { return g.unexport(context.Background(), v) })
+		return g.export(ctx, v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	volumeEvent(eventVolumeCreated, v.Name, nil)
+	return v, nil
+}
+
+// purgeOrphan deletes an orphaned directory or removes an orphaned export
+func (g *gateway) purgeOrphan(w http.ResponseWriter, r *http.Request) {
+	var req OrphanPurgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	if req.Path == "" {
+		writeError(w, errInvalid("must provide Path"))
+		return
+	}
+
+	d, err := g.findOrphanDir(req.Path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if d != nil {
+		if mounted, err := isMountpoint(d.Path); err != nil || mounted {
+			writeError(w, errInvalid(d.Path+" is a mountpoint, unmount it first"))
+			return
+		}
+		if err := os.RemoveAll(d.Path); err != nil {
+			writeError(w, errors.Wrap(err, "error removing orphaned directory"))
+			return
+		}
+		requestLog(r).WithField("path", d.Path).Warn("purged orphaned directory")
+		return
+	}
+
+	exports, err := g.orphanExports()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	for _, e := range exports {
+		if e.Path != filepath.Clean(req.Path) {
+			continue
+		}
+		if err := g.purgeOrphanExport(r.Context(), e); err != nil {
+			writeError(w, err)
+			return
+		}
+		requestLog(r).WithField("path", e.Path).Warn("purged orphaned export")
+		return
+	}
+	writeError(w, errNotFound("no orphaned directory or export at "+req.Path))
+}
+
+// purgeOrphanExport removes the gateway's exports file exporting e, or
+// unexports it directly when it isn't in any exports file. Exports from other
+// files are refused, every exportfs run would bring them back.
+func (g *gateway) purgeOrphanExport(ctx context.Context, e OrphanExport) error {
+	managed, err := exportFilePaths(true)
+	if err != nil {
+		return err
+	}
+	if f := managed[e.Path]; f != "" {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "error removing exports file")
+		}
+		return exportSync.sync(ctx)
+	}
+	other, err := exportFilePaths(false)
+	if err != nil {
+		return err
+	}
+	if f := other[e.Path]; f != "" {
+		return errInvalid(e.Path + " is exported by " + f + " which the gateway doesn't manage, remove it there")
+	}
+	for _, c := range e.Clients {
+		if err := runExportfs(ctx, "-u", c+":"+e.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
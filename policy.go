@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+var policiesBucket = []byte("policies")
+
+// Policy schedules snapshots and backups of a volume. Only snapshots and
+// backups taken by the policy are pruned by it.
+type Policy struct {
+	// SnapshotEvery and BackupEvery are durations such as "1h", empty disables
+	SnapshotEvery string `json:",omitempty"`
+	BackupEvery   string `json:",omitempty"`
+	// Keep is how many scheduled snapshots are kept, 0 keeps all of them
+	Keep int
+	// BackupKeep is how many scheduled backups are kept, defaults to Keep
+	BackupKeep        int    `json:",omitempty"`
+	BackupCompression string `json:",omitempty"`
+
+	LastSnapshot *time.Time `json:",omitempty"`
+	LastBackup   *time.Time `json:",omitempty"`
+}
+
+func (p *Policy) validate() error {
+	for field, every := range map[string]string{"SnapshotEvery": p.SnapshotEvery, "BackupEvery": p.BackupEvery} {
+		if every == "" {
+			continue
+		}
+		d, err := time.ParseDuration(every)
+		if err != nil || d < time.Minute {
+			return &validationError{Field: field, Value: every, Reason: "must be a duration of at least 1m"}
+		}
+	}
+	if p.Keep < 0 || p.BackupKeep < 0 {
+		return errInvalid("Keep and BackupKeep must not be negative")
+	}
+	if p.BackupCompression == "" {
+		p.BackupCompression = compressGzip
+	}
+	if _, ok := backupExtensions[p.BackupCompression]; !ok {
+		return &validationError{Field: "BackupCompression", Value: p.BackupCompression, Reason: "must be one of none, gzip, zstd"}
+	}
+	return nil
+}
+
+// due reports whether something scheduled every `every` last run at last
+// should run again.
+func due(every string, last *time.Time, now time.Time) bool {
+	if every == "" {
+		return false
+	}
+	d, err := time.ParseDuration(every)
+	if err != nil {
+		return false
+	}
+	return last == nil || now.Sub(*last) >= d
+}
+
+func getPolicy(tx *bolt.Tx, name string) (*Policy, error) {
+	data := tx.Bucket(policiesBucket).Get([]byte(name))
+	if data == nil {
+		return nil, nil
+	}
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, dbError(errors.Wrap(err, "error unmarshaling policy from database"))
+	}
+	return &p, nil
+}
+
+func putPolicy(tx *bolt.Tx, name string, p *Policy) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling policy")
+	}
+	return dbError(errors.Wrap(tx.Bucket(policiesBucket).Put([]byte(name), data), "error writing policy to database"))
+}
+
+func (g *gateway) getPolicy(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	name = scopedName(r, name)
+
+	var p *Policy
+	err := g.view(func(tx *bolt.Tx) (err error) {
+		p, err = getPolicy(tx, name)
+		return err
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if p == nil {
+		writeError(w, errNotFound("no policy set for volume"))
+		return
+	}
+	writePolicy(w, p)
+}
+
+func (g *gateway) setPolicy(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	name = scopedName(r, name)
+
+	var p Policy
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	if err := p.validate(); err != nil {
+		writeError(w, err)
+		return
+	}
+	if p.BackupEvery != "" && g.s3 == nil {
+		writeError(w, errInvalid("backups are not configured, set -s3-endpoint and -s3-bucket"))
+		return
+	}
+
+	err := g.update(func(tx *bolt.Tx) error {
+		if getVolumeData(tx, name) == nil {
+			return errNotFound("volume not found")
+		}
+		// the schedule carries on from the last run rather than restarting
+		existing, err := getPolicy(tx, name)
+		if err != nil {
+			return err
+		}
+		p.LastSnapshot, p.LastBackup = nil, nil
+		if existing != nil {
+			p.LastSnapshot, p.LastBackup = existing.LastSnapshot, existing.LastBackup
+		}
+		return putPolicy(tx, name, &p)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writePolicy(w, &p)
+}
+
+func (g *gateway) deletePolicy(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	name = scopedName(r, name)
+	err := g.update(func(tx *bolt.Tx) error {
+		return dbError(errors.Wrap(tx.Bucket(policiesBucket).Delete([]byte(name)), "error deleting policy from database"))
+	})
+	if err != nil {
+		writeError(w, err)
+	}
+}
+
+func writePolicy(w http.ResponseWriter, p *Policy) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+// runPolicies checks for due snapshots and backups every interval
+func (g *gateway) runPolicies(interval time.Duration) {
+	for {
+		if g.maintenance.active() {
+			time.Sleep(interval)
+			continue
+		}
+		if err := g.applyPolicies(time.Now().UTC()); err != nil {
+			logrus.WithError(err).Error("error applying volume policies")
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (g *gateway) applyPolicies(now time.Time) error {
+	policies := make(map[string]*Policy)
+	err := g.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(policiesBucket).ForEach(func(k, v []byte) error {
+			var p Policy
+			if err := json.Unmarshal(v, &p); err != nil {
+				return dbError(errors.Wrap(err, "error unmarshaling policy from database"))
+			}
+			policies[string(k)] = &p
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for name, p := range policies {
+		log := logrus.WithField("volume", name)
+		if due(p.SnapshotEvery, p.LastSnapshot, now) {
+			if _, err := g.snapshotVolume(name, true); err != nil {
+				log.WithError(err).Error("error taking scheduled snapshot")
+			} else {
+				p.LastSnapshot = &now
+			}
+			if err := g.pruneSnapshots(name, p.Keep); err != nil {
+				log.WithError(err).Error("error pruning scheduled snapshots")
+			}
+		}
+		if due(p.BackupEvery, p.LastBackup, now) && g.s3 != nil {
+			if err := g.scheduleBackup(name, p.BackupCompression); err != nil {
+				log.WithError(err).Error("error scheduling backup")
+			} else {
+				p.LastBackup = &now
+			}
+			keep := p.BackupKeep
+			if keep == 0 {
+				keep = p.Keep
+			}
+			if err := g.pruneBackups(name, keep); err != nil {
+				log.WithError(err).Error("error pruning scheduled backups")
+			}
+		}
+
+		err := g.update(func(tx *bolt.Tx) error {
+			// the policy may have been changed or removed in the meantime
+			current, err := getPolicy(tx, name)
+			if err != nil || current == nil {
+				return err
+			}
+			current.LastSnapshot, current.LastBackup = p.LastSnapshot, p.LastBackup
+			return putPolicy(tx, name, current)
+		})
+		if err != nil {
+			log.WithError(err).Error("error updating policy")
+		}
+	}
+	return nil
+}
+
+func (g *gateway) scheduleBackup(name, compression string) error {
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	_, err = g.jobs.submit("", jobBackupVolume, name, backupJobArgs{ID: id, Compression: compression, Scheduled: true})
+	return err
+}
+
+// pruneSnapshots removes the oldest scheduled snapshots beyond keep
+func (g *gateway) pruneSnapshots(name string, keep int) error {
+	if keep == 0 {
+		return nil
+	}
+	defer g.locks.lock(name)()
+	return g.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(snapshotsBucket).Bucket([]byte(name))
+		if b == nil {
+			return nil
+		}
+		var scheduled []snapshot
+		err := b.ForEach(func(k, v []byte) error {
+			var s snapshot
+			if err := json.Unmarshal(v, &s); err != nil {
+				return dbError(errors.Wrap(err, "error unmarshaling snapshot from database"))
+			}
+			if s.Scheduled {
+				scheduled = append(scheduled, s)
+			}
+			return nil
+		})
+		if err != nil || len(scheduled) <= keep {
+			return err
+		}
+
+		sort.Slice(scheduled, func(i, j int) bool { return scheduled[i].Created.Before(scheduled[j].Created) })
+		for _, s := range scheduled[:len(scheduled)-keep] {
+			if err := s.remove(); err != nil {
+				return err
+			}
+			if err := b.Delete([]byte(s.ID)); err != nil {
+				return dbError(errors.Wrap(err, "error deleting snapshot from database"))
+			}
+		}
+		return nil
+	})
+}
+
+// pruneBackups removes the oldest scheduled backups beyond keep, both the
+// objects and their records.
+func (g *gateway) pruneBackups(name string, keep int) error {
+	if keep == 0 {
+		return nil
+	}
+	return g.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(backupsBucket).Bucket([]byte(name))
+		if b == nil {
+			return nil
+		}
+		var scheduled []backup
+		err := b.ForEach(func(k, v []byte) error {
+			var bk backup
+			if err := json.Unmarshal(v, &bk); err != nil {
+				return dbError(errors.Wrap(err, "error unmarshaling backup from database"))
+			}
+			if bk.Scheduled {
+				scheduled = append(scheduled, bk)
+			}
+			return nil
+		})
+		if err != nil || len(scheduled) <= keep {
+			return err
+		}
+
+		sort.Slice(scheduled, func(i, j int) bool { return scheduled[i].Created.Before(scheduled[j].Created) })
+		for _, bk := range scheduled[:len(scheduled)-keep] {
+			if err := g.s3.delete(bk.Key); err != nil {
+				return err
+			}
+			if err := b.Delete([]byte(bk.ID)); err != nil {
+				return dbError(errors.Wrap(err, "error deleting backup from database"))
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Volume data can be spread over several pools, each a data root on its own
+// disk laid out like the main data root, which is always the default pool.
+// A volume's images, snapshots and trash are kept in its pool so they can be
+// moved there with a rename; the database stays in the main data root. New
+// volumes are placed in the pool they ask for or the one the placement policy
+// picks, clones and renamed volumes stay in their pool.
+//
+// Pools can also be added at runtime through /admin/pools and are kept in
+// the pools bucket. Draining a pool takes it out of placement and migrates
+// its volumes to the other pools with a job each; once it is empty it can be
+// removed. Snapshots and trash left in a removed pool are not migrated.
+
+var poolsBucket = []byte("pools")
+
+const defaultPool = "default"
+
+const (
+	// placeMostFree picks the pool with the most space available
+	placeMostFree = "most-free"
+	// placeRoundRobin cycles through the pools
+	placeRoundRobin = "round-robin"
+)
+
+var poolNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+type pool struct {
+	Name string
+	Path string
+	// Draining pools get no new volumes
+	Draining bool `json:",omitempty"`
+	// static pools are configured with -pools rather than the API
+	static bool
+}
+
+// PoolRequest adds a pool at runtime
+type PoolRequest struct {
+	Name string
+	// Path is the pool's data root, an existing directory
+	Path string
+}
+
+// PoolStatus is a pool's utilization
+type PoolStatus struct {
+	Name       string
+	Path       string
+	Draining   bool `json:",omitempty"`
+	TotalBytes uint64
+	FreeBytes  uint64
+	// Volumes is how many volumes are placed in the pool
+	Volumes int
+}
+
+// PoolDrainResponse lists the jobs migrating the volumes out of a pool
+type PoolDrainResponse struct {
+	Jobs []string
+}
+
+type poolSet struct {
+	mu sync.Mutex
+	// pools starts with the default pool
+	pools     []pool
+	placement string
+	// next is the pool round-robin placement picks next
+	next int
+}
+
+// parsePools parses comma separated name=path pools, adding the default pool
+// at root.
+func parsePools(root, s, placement string) (*poolSet, error) {
+	switch placement {
+	case placeMostFree, placeRoundRobin:
+	default:
+		return nil, errors.Errorf("unknown placement policy %q", placement)
+	}
+	set := &poolSet{pools: []pool{{Name: defaultPool, Path: root, static: true}}, placement: placement}
+	for _, p := range splitTokens(s) {
+		parts := strings.SplitN(p, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid pool %q, must be name=path", p)
+		}
+		if err := set.add(pool{Name: strings.TrimSpace(parts[0]), Path: strings.TrimSpace(parts[1]), static: true}); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// load adds the pools stored in the database, keeping the draining state of
+// the configured ones.
+func (s *poolSet) load(db *bolt.DB) error {
+	var stored []pool
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(poolsBucket).ForEach(func(k, v []byte) error {
+			var p pool
+			if err := json.Unmarshal(v, &p); err != nil {
+				return errors.Wrap(err, "error unmarshaling pool from database")
+			}
+			stored = append(stored, p)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range stored {
+		if cur, ok := s.get(p.Name); ok && cur.static {
+			if cur.Path != p.Path {
+				return errors.Errorf("pool %s is stored with path %s but configured with %s", p.Name, p.Path, cur.Path)
+			}
+			s.setDraining(p.Name, p.Draining)
+			continue
+		}
+		if err := s.add(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add validates and adds a pool
+func (s *poolSet) add(p pool) error {
+	if !poolNamePattern.MatchString(p.Name) {
+		return &validationError{Field: "Name", Value: p.Name, Reason: "must be letters, digits, '.', '_' or '-'"}
+	}
+	if !filepath.IsAbs(p.Path) {
+		return &validationError{Field: "Path", Value: p.Path, Reason: "must be absolute"}
+	}
+	p.Path = filepath.Clean(p.Path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.pools {
+		if existing.Name == p.Name {
+			return errAlreadyExists("pool " + p.Name + " already exists")
+		}
+		if pathWithin(p.Path, existing.Path) || pathWithin(existing.Path, p.Path) {
+			return &validationError{Field: "Path", Value: p.Path, Reason: "overlaps pool " + existing.Name}
+		}
+	}
+	s.pools = append(s.pools, p)
+	return nil
+}
+
+func (s *poolSet) remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, p := range s.pools {
+		if p.Name == name {
+			s.pools = append(s.pools[:i], s.pools[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *poolSet) setDraining(name string, draining bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.pools {
+		if s.pools[i].Name == name {
+			s.pools[i].Draining = draining
+		}
+	}
+}
+
+func (s *poolSet) get(name string) (pool, bool) {
+	if name == "" {
+		name = defaultPool
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.pools {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return pool{}, false
+}
+
+func (s *poolSet) list() []pool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]pool(nil), s.pools...)
+}
+
+// place picks the pool a new volume is created in
+func (s *poolSet) place(requested string) (string, error) {
+	if requested != "" {
+		p, ok := s.get(requested)
+		if !ok {
+			return "", &validationError{Field: "Pool", Value: requested, Reason: "no such pool"}
+		}
+		if p.Draining {
+			return "", &validationError{Field: "Pool", Value: requested, Reason: "pool is being drained"}
+		}
+		return requested, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the default pool can't be drained, there's always a candidate
+	var candidates []pool
+	for _, p := range s.pools {
+		if !p.Draining {
+			candidates = append(candidates, p)
+		}
+	}
+	if len(candidates) == 1 {
+		return candidates[0].Name, nil
+	}
+	if s.placement == placeRoundRobin {
+		p := candidates[s.next%len(candidates)]
+		s.next++
+		return p.Name, nil
+	}
+	best, bestFree := candidates[0].Name, uint64(0)
+	for _, p := range candidates {
+		_, free, err := diskSpace(p.Path)
+		if err != nil {
+			continue
+		}
+		if free > bestFree {
+			best, bestFree = p.Name, free
+		}
+	}
+	return best, nil
+}
+
+func diskSpace(p string) (total, free uint64, err error) {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(p, &fs); err != nil {
+		return 0, 0, errors.Wrapf(err, "error getting filesystem stats of %s", p)
+	}
+	return fs.Blocks * uint64(fs.Bsize), fs.Bavail * uint64(fs.Bsize), nil
+}
+
+// poolRoot is where the pool keeps its data, the main data root for pools
+// which are no longer configured.
+func (g *gateway) poolRoot(name string) string {
+	if g.pools != nil {
+		if p, ok := g.pools.get(name); ok {
+			return p.Path
+		}
+	}
+	return g.root
+}
+
+// poolVolumes returns the ids of the volumes in each pool
+func (g *gateway) poolVolumes() (map[string][]string, error) {
+	vols := make(map[string][]string)
+	err := g.view(func(tx *bolt.Tx) error {
+		return forEachVolume(tx, func(data []byte) error {
+			var v volume
+			if err := json.Unmarshal(data, &v); err != nil {
+				return dbError(errors.Wrap(err, "error unmarshaling volume from database"))
+			}
+			if v.Pool == "" {
+				v.Pool = defaultPool
+			}
+			vols[v.Pool] = append(vols[v.Pool], v.Name)
+			return nil
+		})
+	})
+	return vols, err
+}
+
+func putPool(tx *bolt.Tx, p pool) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling pool")
+	}
+	return dbError(errors.Wrap(tx.Bucket(poolsBucket).Put([]byte(p.Name), data), "error writing pool to database"))
+}
+
+func poolStatus(p pool, volumes int) PoolStatus {
+	s := PoolStatus{Name: p.Name, Path: p.Path, Draining: p.Draining, Volumes: volumes}
+	// a pool whose disk is missing is still listed, without its space
+	s.TotalBytes, s.FreeBytes, _ = diskSpace(p.Path)
+	return s
+}
+
+func (g *gateway) listPools(w http.ResponseWriter, r *http.Request) {
+	vols, err := g.poolVolumes()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := []PoolStatus{}
+	for _, p := range g.pools.list() {
+		resp = append(resp, poolStatus(p, len(vols[p.Name])))
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+func (g *gateway) createPool(w http.ResponseWriter, r *http.Request) {
+	var req PoolRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	if fi, err := os.Stat(req.Path); err != nil || !fi.IsDir() {
+		writeError(w, &validationError{Field: "Path", Value: req.Path, Reason: "must be an existing directory"})
+		return
+	}
+	p := pool{Name: req.Name, Path: filepath.Clean(req.Path)}
+	if err := g.pools.add(p); err != nil {
+		writeError(w, err)
+		return
+	}
+	err := os.MkdirAll(filepath.Join(p.Path, "nfs"), 0755)
+	if err == nil {
+		err = g.update(func(tx *bolt.Tx) error {
+			return putPool(tx, p)
+		})
+	}
+	if err != nil {
+		g.pools.remove(p.Name)
+		writeError(w, err)
+		return
+	}
+
+	b, err := json.Marshal(poolStatus(p, 0))
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+// drainPool stops placing volumes in the pool and starts migrating the ones
+// in it elsewhere. Draining again submits jobs for whatever is left.
+func (g *gateway) drainPool(w http.ResponseWriter, r *http.Request) {
+	p, ok := g.pools.get(mux.Vars(r)["name"])
+	if !ok {
+		writeError(w, errNotFound("pool not found"))
+		return
+	}
+	if p.Name == defaultPool {
+		writeError(w, errInvalid("the default pool can't be drained"))
+		return
+	}
+	p.Draining = true
+	err := g.update(func(tx *bolt.Tx) error {
+		return putPool(tx, p)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	g.pools.setDraining(p.Name, true)
+
+	vols, err := g.poolVolumes()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resp := PoolDrainResponse{Jobs: []string{}}
+	for _, name := range vols[p.Name] {
+		j, err := g.jobs.submit(requestID(r), jobMigrateVolume, name, migrateArgs{From: p.Name})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resp.Jobs = append(resp.Jobs, j.ID)
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(b)
+}
+
+// deletePool retires an empty pool, its data root is left in place
+func (g *gateway) deletePool(w http.ResponseWriter, r *http.Request) {
+	p, ok := g.pools.get(mux.Vars(r)["name"])
+	if !ok {
+		return
+	}
+	if p.static {
+		writeError(w, errInvalid("pool is configured with -pools, remove it there"))
+		return
+	}
+	vols, err := g.poolVolumes()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if n := len(vols[p.Name]); n > 0 {
+		writeError(w, newError(http.StatusConflict, api.ErrCodeInvalidRequest, "pool still has "+strconv.Itoa(n)+" volumes, drain it first"))
+		return
+	}
+	err = g.update(func(tx *bolt.Tx) error {
+		return dbError(errors.Wrap(tx.Bucket(poolsBucket).Delete([]byte(p.Name)), "error deleting pool from database"))
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	g.pools.remove(p.Name)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// NFSPorts are the ports the kernel NFS server and its auxiliary daemons
+// listen on. 0 leaves the choice to rpcbind, which makes NFSv3 hard to
+// firewall.
+type NFSPorts struct {
+	NFS    int
+	Mountd int
+	Statd  int
+	// StatdOutgoing is the source port of statd's reboot notifications
+	StatdOutgoing int
+	// Lockd is used for both TCP and UDP
+	Lockd int
+}
+
+// RPCService is a program registered with rpcbind
+type RPCService struct {
+	Program  int
+	Version  int
+	Protocol string
+	Port     int
+	Service  string `json:",omitempty"`
+}
+
+type PortMap struct {
+	Configured NFSPorts
+	// Registered is what rpcbind actually hands out to clients
+	Registered []RPCService
+}
+
+// nfsPorts are the ports the NFS daemons were started with
+var nfsPorts NFSPorts
+
+var nlmSysctlDir = "/proc/sys/fs/nfs"
+
+func checkPort(name string, port int) error {
+	if port < 0 || port > 65535 {
+		return errors.Errorf("invalid %s port %d", name, port)
+	}
+	return nil
+}
+
+func (p NFSPorts) validate() error {
+	for name, port := range map[string]int{"nfs": p.NFS, "mountd": p.Mountd, "statd": p.Statd, "statd outgoing": p.StatdOutgoing, "lockd": p.Lockd} {
+		if err := checkPort(name, port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setLockdPorts sets the ports the kernel's lock manager registers, which
+// only takes effect if set before nfsd starts lockd.
+func setLockdPorts(port int) error {
+	if port == 0 {
+		return nil
+	}
+	if _, err := os.Stat(nlmSysctlDir); err != nil {
+		// best effort, lockd may be a module which isn't loaded yet
+		cmd("modprobe", "-q", "lockd")
+	}
+	for _, name := range []string{"nlm_tcpport", "nlm_udpport"} {
+		err := ioutil.WriteFile(nlmSysctlDir+"/"+name, []byte(strconv.Itoa(port)+"\n"), 0644)
+		if err != nil {
+			return errors.Wrapf(err, "error setting lockd %s", name)
+		}
+	}
+	return nil
+}
+
+func portArgs(flag string, port int) []string {
+	if port == 0 {
+		return nil
+	}
+	return []string{flag, strconv.Itoa(port)}
+}
+
+// registeredServices lists the programs registered with the local rpcbind
+func registeredServices() ([]RPCService, error) {
+	out, err := runCommand("rpcinfo", "-p")
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing rpc services")
+	}
+	services := []RPCService{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		program, err := strconv.Atoi(fields[0])
+		if err != nil {
+			// the header
+			continue
+		}
+		s := RPCService{Program: program, Protocol: fields[2]}
+		if s.Version, err = strconv.Atoi(fields[1]); err != nil {
+			continue
+		}
+		if s.Port, err = strconv.Atoi(fields[3]); err != nil {
+			continue
+		}
+		if len(fields) > 4 {
+			s.Service = fields[4]
+		}
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+// kernelNFS fails unless volumes are exported by the kernel NFS server
+func (g *gateway) kernelNFS(what string) error {
+	switch g.exporter.(type) {
+	case kernelExporter, *v4Exporter:
+		return nil
+	}
+	return errInvalid(what + " only managed for the kernel NFS server")
+}
+
+func (g *gateway) getPorts(w http.ResponseWriter, r *http.Request) {
+	if err := g.kernelNFS("ports are"); err != nil {
+		writeError(w, err)
+		return
+	}
+	services, err := registeredServices()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, err := json.Marshal(PortMap{Configured: nfsPorts, Registered: services})
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
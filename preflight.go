@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// The preflight checks what the NFS backend needs before anything is set up,
+// loading the nfsd module and mounting its filesystem when they're missing.
+// With -preflight=strict (the default) a failed required check stops the
+// gateway with what to do about it, with -preflight=degraded the API is
+// served without setting up NFS and readyz fails until the gateway is
+// restarted with the problem fixed. The results are at GET /admin/preflight.
+
+// -preflight modes, a report's status is degraded when the gateway was
+// started in degraded mode with required checks failed
+const (
+	preflightStrict   = "strict"
+	preflightDegraded = "degraded"
+)
+
+// Preflight check and report statuses
+const (
+	preflightOK      = "ok"
+	preflightWarning = "warning"
+	preflightFailed  = "failed"
+)
+
+// minKernel is the oldest kernel nfsd is supported on, clientsKernel the
+// first one listing nfsd's clients in /proc/fs/nfsd/clients
+var (
+	minKernel     = kernelVersion{3, 10}
+	clientsKernel = kernelVersion{5, 3}
+)
+
+// PreflightCheck is the result of checking a single dependency
+type PreflightCheck struct {
+	Name   string
+	Status string
+	// Message says what was found, Remedy what to do about it
+	Message string `json:",omitempty"`
+	Remedy  string `json:",omitempty"`
+	// Required checks keep NFS from being set up when they fail, others
+	// only disable features
+	Required bool
+}
+
+type PreflightReport struct {
+	// Status is ok, degraded when required checks failed but the gateway
+	// was started anyway, or failed
+	Status    string
+	Backend   string
+	Checks    []PreflightCheck
+	CheckedAt time.Time
+}
+
+// failed returns the required checks which failed
+func (r *PreflightReport) failed() []PreflightCheck {
+	var failed []PreflightCheck
+	for _, c := range r.Checks {
+		if c.Required && c.Status == preflightFailed {
+			failed = append(failed, c)
+		}
+	}
+	return failed
+}
+
+// String lists the failed and warning checks with their remedies
+func (r *PreflightReport) String() string {
+	var buf bytes.Buffer
+	for _, c := range r.Checks {
+		if c.Status == preflightOK {
+			continue
+		}
+		fmt.Fprintf(&buf, "  %s %s: %s\n", c.Status, c.Name, c.Message)
+		if c.Remedy != "" {
+			fmt.Fprintf(&buf, "    fix: %s\n", c.Remedy)
+		}
+	}
+	return buf.String()
+}
+
+func runPreflight(backend string, v4Only bool) *PreflightReport {
+	r := &PreflightReport{Status: preflightOK, Backend: backend, CheckedAt: time.Now().UTC()}
+	switch backend {
+	case "kernel":
+		r.Checks = append(r.Checks, checkKernelVersion(), checkNFSDModule(), checkNFSDFilesystem())
+		bins := []string{"exportfs", "rpcinfo", "/sbin/rpcbind", "/usr/sbin/rpc.mountd", "/usr/sbin/rpc.nfsd"}
+		if !v4Only {
+			bins = append(bins, "/usr/sbin/rpc.statd", "/usr/bin/sm-notify")
+		}
+		r.Checks = append(r.Checks, checkBinaries("nfs-utils", bins, "install nfs-utils (nfs-kernel-server on Debian and Ubuntu) and rpcbind"), checkRPCBind())
+	case "ganesha":
+		r.Checks = append(r.Checks, checkBinaries("ganesha", []string{"ganesha.nfsd", "dbus-send"}, "install nfs-ganesha with its VFS FSAL and dbus"))
+	}
+	r.Checks = append(r.Checks, checkOptionalBinary("rsync", "copying clones, migrations and replication without zfs or btrfs fail", "install rsync"))
+	if len(r.failed()) > 0 {
+		r.Status = preflightFailed
+	}
+	return r
+}
+
+type kernelVersion [2]int
+
+func (v kernelVersion) String() string {
+	return strconv.Itoa(v[0]) + "." + strconv.Itoa(v[1])
+}
+
+func (v kernelVersion) less(o kernelVersion) bool {
+	return v[0] < o[0] || (v[0] == o[0] && v[1] < o[1])
+}
+
+// parseKernelRelease parses the major and minor version of a release like
+// 5.15.0-91-generic
+func parseKernelRelease(release string) (kernelVersion, error) {
+	var v kernelVersion
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return v, errors.Errorf("unrecognized kernel release %q", release)
+	}
+	for i := range v {
+		// 4.19-rc1
+		digits := parts[i]
+		if end := strings.IndexFunc(digits, func(r rune) bool { return r < '0' || r > '9' }); end >= 0 {
+			digits = digits[:end]
+		}
+		n, err := strconv.Atoi(digits)
+		if err != nil {
+			return v, errors.Errorf("unrecognized kernel release %q", release)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+func checkKernelVersion() PreflightCheck {
+	c := PreflightCheck{Name: "kernel-version", Status: preflightOK, Required: true}
+	data, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		c.Status, c.Message = preflightWarning, "error reading the kernel version: "+err.Error()
+		return c
+	}
+	release := strings.TrimSpace(string(data))
+	v, err := parseKernelRelease(release)
+	switch {
+	case err != nil:
+		c.Status, c.Message = preflightWarning, err.Error()
+	case v.less(minKernel):
+		c.Status, c.Message = preflightFailed, "kernel "+release+" is older than "+minKernel.String()
+		c.Remedy = "run the gateway on a host with kernel " + minKernel.String() + " or later"
+	case v.less(clientsKernel):
+		c.Status, c.Message = preflightWarning, "kernel "+release+" doesn't list nfsd clients, listing and revoking clients is unavailable"
+		c.Remedy = "upgrade to kernel " + clientsKernel.String() + " or later"
+	default:
+		c.Message = "kernel " + release
+	}
+	return c
+}
+
+func nfsdLoaded() (bool, error) {
+	data, err := ioutil.ReadFile("/proc/filesystems")
+	if err != nil {
+		return false, err
+	}
+	return bytes.Contains(data, []byte("\tnfsd\n")), nil
+}
+
+// checkNFSDModule loads the nfsd module unless it's loaded or built in
+func checkNFSDModule() PreflightCheck {
+	c := PreflightCheck{Name: "nfsd-module", Status: preflightOK, Required: true}
+	loaded, err := nfsdLoaded()
+	if err != nil {
+		c.Status, c.Message = preflightFailed, "error reading /proc/filesystems: "+err.Error()
+		return c
+	}
+	if loaded {
+		c.Message = "nfsd is available"
+		return c
+	}
+	modErr := cmd("modprobe", "nfsd")
+	if loaded, _ = nfsdLoaded(); loaded {
+		c.Message = "loaded the nfsd module"
+		return c
+	}
+	c.Status, c.Message = preflightFailed, "the nfsd module isn't loaded and couldn't be loaded"
+	if modErr != nil {
+		// without output the error starts with a colon
+		c.Message += ": " + strings.TrimPrefix(modErr.Error(), ": ")
+	}
+	c.Remedy = "run `modprobe nfsd` on the host or give the gateway CAP_SYS_MODULE and the host's /lib/modules, the module may need installing (e.g. linux-modules-extra)"
+	return c
+}
+
+// checkNFSDFilesystem mounts the nfsd filesystem unless it's mounted
+func checkNFSDFilesystem() PreflightCheck {
+	c := PreflightCheck{Name: "nfsd-filesystem", Status: preflightOK, Required: true}
+	if mounted, err := isMountpoint(nfsdProcDir); err == nil && mounted {
+		c.Message = "nfsd is mounted at " + nfsdProcDir
+		return c
+	}
+	// mount -t nfsd -o nodev,noexec,nosuid nfsd /proc/fs/nfsd
+	err := unix.Mount("nfsd", nfsdProcDir, "nfsd", unix.MS_NOEXEC|unix.MS_NODEV|unix.MS_NOSUID, "")
+	if err == nil || err == unix.EBUSY {
+		c.Message = "mounted nfsd at " + nfsdProcDir
+		return c
+	}
+	c.Status, c.Message = preflightFailed, "error mounting nfsd at "+nfsdProcDir+": "+err.Error()
+	if err == unix.EPERM {
+		c.Remedy = "give the gateway CAP_SYS_ADMIN (e.g. --privileged) or run `mount -t nfsd nfsd " + nfsdProcDir + "` on the host"
+	} else {
+		c.Remedy = "make sure the nfsd module is loaded and " + nfsdProcDir + " exists"
+	}
+	return c
+}
+
+// checkBinaries looks for binaries on the PATH, or at the given path for
+// those started by absolute path, leaving out disabled daemons
+func checkBinaries(name string, bins []string, remedy string) PreflightCheck {
+	c := PreflightCheck{Name: name, Status: preflightOK, Required: true}
+	var found, missing []string
+	for _, b := range bins {
+		if daemons.isDisabled(filepath.Base(b)) {
+			continue
+		}
+		if _, err := exec.LookPath(b); err != nil {
+			missing = append(missing, b)
+			continue
+		}
+		found = append(found, b)
+	}
+	if len(missing) > 0 {
+		c.Status, c.Message, c.Remedy = preflightFailed, "missing "+strings.Join(missing, ", "), remedy
+		return c
+	}
+	c.Message = "found " + strings.Join(found, ", ")
+	return c
+}
+
+func checkOptionalBinary(bin, without, remedy string) PreflightCheck {
+	c := PreflightCheck{Name: bin, Status: preflightOK}
+	if _, err := exec.LookPath(bin); err != nil {
+		c.Status, c.Message, c.Remedy = preflightWarning, bin+" is missing, "+without, remedy
+		return c
+	}
+	c.Message = "found " + bin
+	return c
+}
+
+// checkRPCBind makes sure the gateway's rpcbind can take port 111, an rpcbind
+// already running on the host serves just as well
+func checkRPCBind() PreflightCheck {
+	c := PreflightCheck{Name: "rpcbind", Status: preflightOK, Required: true}
+	if daemons.isDisabled("rpcbind") {
+		if cmd("rpcinfo", "-p", "127.0.0.1") == nil {
+			c.Message = "rpcbind is disabled, the host's rpcbind is running"
+			return c
+		}
+		c.Status, c.Message = preflightFailed, "rpcbind is disabled and none is running"
+		c.Remedy = "start rpcbind on the host or remove it from -disable-daemons"
+		return c
+	}
+	l, err := net.Listen("tcp", ":111")
+	if err == nil {
+		l.Close()
+		c.Message = "port 111 is free for rpcbind"
+		return c
+	}
+	if cmd("rpcinfo", "-p", "127.0.0.1") == nil {
+		c.Status, c.Message = preflightWarning, "an rpcbind is already running, the NFS daemons register with it"
+		return c
+	}
+	c.Status, c.Message = preflightFailed, "rpcbind can't listen on port 111: "+err.Error()
+	c.Remedy = "stop whatever else listens on port 111 and run the gateway as root, NFS clients find mountd and the other daemons through rpcbind there"
+	return c
+}
+
+// logPreflight logs the report, it reports whether NFS can be set up
+func logPreflight(r *PreflightReport, mode string) bool {
+	for _, c := range r.Checks {
+		log := logrus.WithField("check", c.Name).WithField("status", c.Status)
+		if c.Remedy != "" {
+			log = log.WithField("remedy", c.Remedy)
+		}
+		switch c.Status {
+		case preflightOK:
+			log.Debug(c.Message)
+		case preflightWarning:
+			log.Warn(c.Message)
+		default:
+			log.Error(c.Message)
+		}
+	}
+	if r.Status == preflightOK {
+		return true
+	}
+	if mode != preflightDegraded {
+		fmt.Fprintf(os.Stderr, "preflight failed:\n%s", r)
+		os.Exit(1)
+	}
+	r.Status = preflightDegraded
+	logrus.Error("preflight failed, serving the API without setting up NFS")
+	return false
+}
+
+// checkPreflight fails readiness while NFS isn't set up
+func (g *gateway) checkPreflight() error {
+	if g.preflight == nil || g.preflight.Status == preflightOK {
+		return nil
+	}
+	var names []string
+	for _, c := range g.preflight.failed() {
+		names = append(names, c.Name)
+	}
+	return errors.Errorf("preflight failed: %s, see /admin/preflight", strings.Join(names, ", "))
+}
+
+func (g *gateway) getPreflight(w http.ResponseWriter, r *http.Request) {
+	if g.preflight == nil {
+		writeError(w, errNotFound("no preflight was run"))
+		return
+	}
+	b, err := json.Marshal(g.preflight)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
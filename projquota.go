@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Project quotas limit a volume's directory tree on the data root's own
+// filesystem (xfs, or ext4 mounted with prjquota) instead of giving each
+// volume a loop mounted image. Every volume gets its own project id.
+
+const (
+	xfsSuperMagic  = 0x58465342
+	ext4SuperMagic = 0xef53
+)
+
+const (
+	quotaBackendLoop    = "loop"
+	quotaBackendProject = "project"
+)
+
+// projectIDBase keeps the gateway's ids clear of projects set up by hand
+const projectIDBase = 1 << 20
+
+var projectIDKey = []byte("project-id")
+
+type projectQuota struct {
+	ID        uint32
+	SizeBytes int64
+	// Mount is the mountpoint of the filesystem the volume lives on
+	Mount string
+}
+
+// checkProjectQuotas makes sure project quotas can be used for volumes under dir
+func checkProjectQuotas(dir string) error {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(dir, &fs); err != nil {
+		return errors.Wrap(err, "error getting filesystem stats")
+	}
+	if fs.Type != xfsSuperMagic && fs.Type != ext4SuperMagic {
+		return errors.Errorf("project quotas require xfs or ext4, %s is on another filesystem", dir)
+	}
+	if _, err := exec.LookPath("xfs_quota"); err != nil {
+		return errors.Wrap(err, "could not find required binary 'xfs_quota'")
+	}
+	return nil
+}
+
+// nextProjectID allocates a project id which has never been used before
+func nextProjectID(tx *bolt.Tx) (uint32, error) {
+	b := tx.Bucket(settingsBucket)
+	id := uint32(projectIDBase)
+	if data := b.Get(projectIDKey); len(data) == 4 {
+		id = binary.BigEndian.Uint32(data) + 1
+	}
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, id)
+	if err := b.Put(projectIDKey, data); err != nil {
+		return 0, dbError(errors.Wrap(err, "error writing project id to database"))
+	}
+	return id, nil
+}
+
+// setProjectQuota assigns the project to the directory tree at p and limits
+// it to size bytes.
+func setProjectQuota(p string, id uint32, size int64) (*projectQuota, error) {
+	mount, err := mountPoint(p)
+	if err != nil {
+		return nil, err
+	}
+	q := &projectQuota{ID: id, SizeBytes: size, Mount: mount}
+	if err := xfsQuota(mount, "project -s -p "+p+" "+q.id()); err != nil {
+		return nil, errors.Wrap(err, "error assigning project quota")
+	}
+	// limits are set in KiB, rounded up
+	if err := xfsQuota(mount, "limit -p bhard="+strconv.FormatInt((size+1023)/1024, 10)+"k "+q.id()); err != nil {
+		return nil, errors.Wrap(err, "error setting project quota limit")
+	}
+	return q, nil
+}
+
+// clear removes the project's limit. The project id stays on any remaining
+// files but is never handed out again.
+func (q *projectQuota) clear() error {
+	return errors.Wrap(xfsQuota(q.Mount, "limit -p bhard=0 "+q.id()), "error removing project quota limit")
+}
+
+// usage returns the bytes and inodes accounted to the project
+func (q *projectQuota) usage() (bytes, inodes int64, err error) {
+	kb, err := q.report("-b")
+	if err != nil {
+		return 0, 0, err
+	}
+	inodes, err = q.report("-i")
+	return kb * 1024, inodes, err
+}
+
+func (q *projectQuota) report(kind string) (int64, error) {
+	out, err := runCommand("xfs_quota", "-x", "-c", "quota -p -N -n "+kind+" "+q.id(), q.Mount)
+	if err != nil {
+		return 0, errors.Wrap(err, "error reading project quota")
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 {
+		// projects without any files have no quota record yet
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(fields[1], 10, 64)
+	return n, errors.Wrap(err, "error parsing project quota")
+}
+
+func (q *projectQuota) id() string {
+	return strconv.FormatUint(uint64(q.ID), 10)
+}
+
+func xfsQuota(mount, command string) error {
+	return cmd("xfs_quota", "-x", "-c", command, mount)
+}
+
+// mountPoint finds the mountpoint of the filesystem p lives on
+func mountPoint(p string) (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", errors.Wrap(err, "error reading mount table")
+	}
+	defer f.Close()
+
+	p = filepath.Clean(p)
+	var best string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		m := unescapeExportPath(fields[4])
+		if pathWithin(p, m) && len(m) > len(best) {
+			best = m
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", errors.Wrap(err, "error reading mount table")
+	}
+	if best == "" {
+		return "", errors.Errorf("no mountpoint found for %s", p)
+	}
+	return best, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+var quotasBucket = []byte("quotas")
+
+// maxSizeBytes is the largest size limit a volume can have, 1 EiB, which
+// leaves room to add up the sizes of a tenant's volumes without overflowing
+const maxSizeBytes = 1 << 60
+
+// TenantQuota is the storage a tenant consumes against its limit. Sized
+// volumes count their full size, other volumes count the bytes they use as of
+// the last usage collection.
+type TenantQuota struct {
+	Tenant           string
+	LimitBytes       int64
+	ProvisionedBytes int64
+	UsedBytes        int64
+	Updated          time.Time
+}
+
+func (q *TenantQuota) consumed() int64 {
+	return q.ProvisionedBytes + q.UsedBytes
+}
+
+// QuotaExceededDetails is returned as the error details when a create is
+// rejected by the tenant's quota.
+type QuotaExceededDetails struct {
+	Tenant         string
+	LimitBytes     int64
+	ConsumedBytes  int64
+	RequestedBytes int64
+}
+
+// parseQuotas parses `tenant=size` pairs, sizes may have a K, M, G or T suffix
+func parseQuotas(s string) (map[string]int64, error) {
+	quotas := make(map[string]int64)
+	for _, q := range splitTokens(s) {
+		parts := strings.SplitN(q, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid quota %q, must be tenant=size", q)
+		}
+		size, err := parseSize(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		quotas[strings.TrimSpace(parts[0])] = size
+	}
+	return quotas, nil
+}
+
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(s, suffix) {
+			s = strings.TrimSuffix(s, suffix)
+			mult = 1 << (10 * uint(i+1))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	// sizes which don't fit in an int64 once multiplied would wrap around
+	if err != nil || n < 0 || n > math.MaxInt64/mult {
+		return 0, errInvalid("invalid size " + strconv.Quote(s))
+	}
+	return n * mult, nil
+}
+
+func (g *gateway) quotaLimit(tenant string) int64 {
+	g.settingsMu.RLock()
+	defer g.settingsMu.RUnlock()
+	return g.quotas[tenant]
+}
+
+func (g *gateway) setQuotas(quotas map[string]int64) {
+	g.settingsMu.Lock()
+	g.quotas = quotas
+	g.settingsMu.Unlock()
+}
+
+// tenantQuota computes the tenant's current consumption from its volumes
+func (g *gateway) tenantQuota(tx *bolt.Tx, tenant string) (*TenantQuota, error) {
+	q := &TenantQuota{Tenant: tenant, LimitBytes: g.quotaLimit(tenant), Updated: time.Now().UTC()}
+	b := tx.Bucket(tenantsBucket).Bucket([]byte(tenant))
+	if b == nil {
+		return q, nil
+	}
+	err := b.ForEach(func(k, data []byte) error {
+		var v volume
+		if err := json.Unmarshal(data, &v); err != nil {
+			return dbError(errors.Wrap(err, "error unmarshaling volume from database"))
+		}
+		if v.AliasOf != "" {
+			// the aliased volume already counts the data
+			return nil
+		}
+		if size := v.sizeLimit(); size > 0 {
+			q.ProvisionedBytes += size
+		} else if u := g.usage.cached(v.Name); u != nil {
+			q.UsedBytes += u.BytesUsed
+		}
+		return nil
+	})
+	return q, err
+}
+
+// updateQuota recomputes and stores the tenant's consumption
+func (g *gateway) updateQuota(tx *bolt.Tx, tenant string) (*TenantQuota, error) {
+	q, err := g.tenantQuota(tx, tenant)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(q)
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshaling quota")
+	}
+	return q, dbError(errors.Wrap(tx.Bucket(quotasBucket).Put([]byte(tenant), data), "error writing quota to database"))
+}
+
+// checkQuota rejects adding size bytes to a tenant which would go over its limit
+func (g *gateway) checkQuota(tx *bolt.Tx, tenant string, size int64) error {
+	if tenant == "" || g.quotaLimit(tenant) == 0 {
+		return nil
+	}
+	q, err := g.tenantQuota(tx, tenant)
+	if err != nil {
+		return err
+	}
+	// compared by subtraction, adding size could overflow
+	if size <= q.LimitBytes-q.consumed() {
+		return nil
+	}
+	return &codedError{
+		code:   api.ErrCodeQuotaExceeded,
+		status: http.StatusForbidden,
+		err:    errors.Errorf("tenant quota of %d bytes exceeded", q.LimitBytes),
+		details: QuotaExceededDetails{
+			Tenant:         tenant,
+			LimitBytes:     q.LimitBytes,
+			ConsumedBytes:  q.consumed(),
+			RequestedBytes: size,
+		},
+	}
+}
+
+// checkResize rejects changing the volume's size limit to size when that
+// would take its tenant over its limit. Volumes without a limit count with
+// their usage, like in the tenant's consumption.
+func (g *gateway) checkResize(tx *bolt.Tx, v *volume, size int64) error {
+	var used int64
+	if u := g.usage.cached(v.Name); u != nil {
+		used = u.BytesUsed
+	}
+	cur := v.sizeLimit()
+	if cur == 0 {
+		cur = used
+	}
+	if size == 0 {
+		size = used
+	}
+	if size <= cur {
+		return nil
+	}
+	return g.checkQuota(tx, volumeTenant(v.Name), size-cur)
+}
+
+// updateQuotas refreshes the stored consumption of every tenant, called after
+// usage has been collected.
+func (g *gateway) updateQuotas() {
+	err := g.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(tenantsBucket).ForEach(func(tenant, _ []byte) error {
+			_, err := g.updateQuota(tx, string(tenant))
+			return err
+		})
+	})
+	if err != nil {
+		logrus.WithError(err).Error("error updating tenant quotas")
+	}
+}
+
+func (g *gateway) getQuota(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["id"]
+	// tenants can only see their own quota
+	if tenant == "" || tenant != requestTenant(r) {
+		writeError(w, errNotFound("tenant not found"))
+		return
+	}
+
+	var q *TenantQuota
+	err := g.view(func(tx *bolt.Tx) error {
+		data := tx.Bucket(quotasBucket).Get([]byte(tenant))
+		if data == nil {
+			var err error
+			q, err = g.tenantQuota(tx, tenant)
+			return err
+		}
+		q = &TenantQuota{}
+		if err := json.Unmarshal(data, q); err != nil {
+			return dbError(errors.Wrap(err, "error unmarshaling quota from database"))
+		}
+		// the limit may have been changed since the usage was recorded
+		q.LimitBytes = g.quotaLimit(tenant)
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	b, err := json.Marshal(q)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+)
+
+func TestParseSize(t *testing.T) {
+	cases := []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"1024", 1024, true},
+		{"10k", 10 << 10, true},
+		{" 2G ", 2 << 30, true},
+		{"8388607T", 8388607 << 40, true},
+		{"8388608T", 0, false},
+		{"99999999999T", 0, false},
+		{"-1", 0, false},
+		{"1P", 0, false},
+		{"", 0, false},
+	}
+	for _, tc := range cases {
+		got, err := parseSize(tc.s)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("%q: got %d, %v, want %d", tc.s, got, err, tc.want)
+		}
+		if err != nil && errorCode(err) != api.ErrCodeInvalidRequest {
+			t.Errorf("%q: got %v, want an invalid request error", tc.s, err)
+		}
+	}
+}
+
+// Sizes close to MaxInt64 must not wrap around when they're added to what the
+// tenant already uses and slip past its quota.
+func TestCheckQuotaOverflow(t *testing.T) {
+	g, cleanup := newTestGateway(t)
+	defer cleanup()
+	g.setQuotas(map[string]int64{"t": 10 << 30})
+	v := &volume{Name: volumeID("t", "a"), SizeBytes: 1 << 30}
+	if err := g.update(func(tx *bolt.Tx) error { return putVolume(tx, v) }); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int64{math.MaxInt64, math.MaxInt64 - 1<<30 + 1, 10<<30 + 1} {
+		err := g.view(func(tx *bolt.Tx) error { return g.checkQuota(tx, "t", size) })
+		if errorCode(err) != api.ErrCodeQuotaExceeded {
+			t.Errorf("adding %d: got %v, want the quota to be exceeded", size, err)
+		}
+		err = g.view(func(tx *bolt.Tx) error { return g.checkResize(tx, v, size) })
+		if errorCode(err) != api.ErrCodeQuotaExceeded {
+			t.Errorf("resizing to %d: got %v, want the quota to be exceeded", size, err)
+		}
+	}
+	if err := g.view(func(tx *bolt.Tx) error { return g.checkQuota(tx, "t", 9<<30) }); err != nil {
+		t.Errorf("adding up to the limit: %v", err)
+	}
+
+	req := api.CreateRequest{SizeBytes: math.MaxInt64}
+	if err := g.validateCreate(volumeID("t", "b"), &req); errorCode(err) != api.ErrCodeInvalidRequest {
+		t.Errorf("creating with SizeBytes %d: got %v, want an invalid request error", req.SizeBytes, err)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+)
+
+// limiter protects exportfs and the database from clients sending too much.
+// Every client, identified by its API token or its address when auth is
+// disabled, gets a token bucket of requests, and all of them share a global
+// one. Mutating requests are also capped in how many may run at once, in
+// total and per client. Rejected requests get a 429 with Retry-After.
+type limiter struct {
+	// rate and burst apply per client, globalRate and globalBurst to all
+	// requests together, a rate of 0 disables the bucket
+	rate        float64
+	burst       float64
+	globalRate  float64
+	globalBurst float64
+	// maxInflight and maxClientInflight cap concurrent mutating requests,
+	// 0 is unlimited
+	maxInflight       int
+	maxClientInflight int
+
+	mu       sync.Mutex
+	global   tokenBucket
+	clients  map[string]*clientLimit
+	inflight int
+	swept    time.Time
+}
+
+type clientLimit struct {
+	bucket   tokenBucket
+	inflight int
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket for the time since it was last used and takes a
+// token, or returns how long until one is available.
+func (b *tokenBucket) take(rate, burst float64, now time.Time) (bool, time.Duration) {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// full reports whether the bucket would be full by now
+func (b *tokenBucket) full(rate, burst float64, now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*rate >= burst
+}
+
+func newLimiter(rate float64, burst int, globalRate float64, globalBurst, maxInflight, maxClientInflight int) *limiter {
+	l := &limiter{
+		rate:              rate,
+		burst:             float64(burst),
+		globalRate:        globalRate,
+		globalBurst:       float64(globalBurst),
+		maxInflight:       maxInflight,
+		maxClientInflight: maxClientInflight,
+		clients:           make(map[string]*clientLimit),
+	}
+	// a burst smaller than one request would never let anything through
+	if l.burst < 1 {
+		l.burst = math.Max(1, math.Ceil(rate))
+	}
+	if l.globalBurst < 1 {
+		l.globalBurst = math.Max(1, math.Ceil(globalRate))
+	}
+	return l
+}
+
+func (l *limiter) enabled() bool {
+	return l.rate > 0 || l.globalRate > 0 || l.maxInflight > 0 || l.maxClientInflight > 0
+}
+
+// acquire admits a request, returning the function to call once it's done.
+// Rejected requests get the reason and how long to wait before retrying.
+func (l *limiter) acquire(client string, mutating bool) (func(), string, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	c, ok := l.clients[client]
+	if !ok {
+		c = &clientLimit{}
+		l.clients[client] = c
+	}
+	if mutating {
+		// a running request finishing is what frees a slot, which a client
+		// can't know, a second is as good a guess as any
+		if l.maxInflight > 0 && l.inflight >= l.maxInflight {
+			return nil, "concurrency", time.Second
+		}
+		if l.maxClientInflight > 0 && c.inflight >= l.maxClientInflight {
+			return nil, "client_concurrency", time.Second
+		}
+	}
+	if l.rate > 0 {
+		if ok, wait := c.bucket.take(l.rate, l.burst, now); !ok {
+			return nil, "client_rate", wait
+		}
+	}
+	if l.globalRate > 0 {
+		if ok, wait := l.global.take(l.globalRate, l.globalBurst, now); !ok {
+			return nil, "rate", wait
+		}
+	}
+	if !mutating {
+		return func() {}, "", 0
+	}
+	l.inflight++
+	c.inflight++
+	return func() {
+		l.mu.Lock()
+		l.inflight--
+		c.inflight--
+		l.mu.Unlock()
+	}, "", 0
+}
+
+// sweep forgets idle clients now and then so the map doesn't keep growing
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for k, c := range l.clients {
+		if c.inflight == 0 && (l.rate == 0 || c.bucket.full(l.rate, l.burst, now)) {
+			delete(l.clients, k)
+		}
+	}
+}
+
+// middleware runs after authentication, so only valid tokens get a bucket
+func (l *limiter) middleware(next http.Handler) http.Handler {
+	if !l.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unauthenticatedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client := bearerToken(r)
+		if client == "" {
+			client, _, _ = net.SplitHostPort(r.RemoteAddr)
+		}
+		mutating := r.Method != "GET" && r.Method != "HEAD" && r.Method != "OPTIONS"
+		done, reason, wait := l.acquire(client, mutating)
+		if done == nil {
+			throttledRequests.inc(reason)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, newError(http.StatusTooManyRequests, api.ErrCodeRateLimited, "too many requests, retry later"))
+			return
+		}
+		defer done()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Every API token has a role. Readers may only read, operators may also
+// manage volumes and admins may do anything, including everything under
+// /admin and changing netgroups. Tokens get their role from a binding, or
+// -default-role without one, which is admin so setups from before roles keep
+// working. JWTs get their role from their claims instead, see oidcVerifier.
+// Tokens of a tenant are never more than operators.
+//
+// A binding may also be scoped to some volumes, by name and/or by a label
+// selector such as project=ci, in which case the token may only see and
+// manage those volumes and create volumes matching the scope. Scoped tokens
+// can't use the Docker plugin or anything not about volumes.
+//
+// Bindings are configured with -rbac or added at runtime through /admin/rbac,
+// the latter are kept in the rbac bucket. Only the sha256 sum of a binding's
+// token is stored.
+
+var rbacBucket = []byte("rbac")
+
+const (
+	roleReader   = "reader"
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+)
+
+var roleLevels = map[string]int{roleReader: 1, roleOperator: 2, roleAdmin: 3}
+
+// routeRoles are the routes needing another role than their method and path
+// suggest: reader for GET, admin for /admin and operator for everything else
+var routeRoles = map[string]string{
+	"POST /netgroup":                            roleAdmin,
+	"DELETE /netgroup/{name}":                   roleAdmin,
+	"POST /netgroup/{name}/members":             roleAdmin,
+	"DELETE /netgroup/{name}/members/{host:.+}": roleAdmin,
+	"POST /Plugin.Activate":                     roleReader,
+	"POST /VolumeDriver.Capabilities":           roleReader,
+	"POST /VolumeDriver.Get":                    roleReader,
+	"POST /VolumeDriver.List":                   roleReader,
+	"POST /VolumeDriver.Path":                   roleReader,
+	"POST /VolumeDriver.Mount":                  roleReader,
+	"POST /VolumeDriver.Unmount":                roleReader,
+}
+
+// scopedRoutes are the routes without a volume in their path which scoped
+// tokens may use, their handlers limit them to the scope
+var scopedRoutes = map[string]bool{
+	"GET /volumes":           true,
+	"POST /volume":           true,
+	"POST /volumes/batch":    true,
+	"GET /jobs/{id}":         true,
+	"GET /tenant/{id}/quota": true,
+	"GET /whoami":            true,
+}
+
+// staticBindingPrefix names the bindings configured with -rbac
+const staticBindingPrefix = "rbac-"
+
+var bindingNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// RoleBindingRequest gives a token a role
+type RoleBindingRequest struct {
+	Name string
+	// Token must be one of the accepted API tokens
+	Token string
+	Role  string
+	// Volumes and Selector limit the token to the named volumes and to the
+	// volumes whose labels match the selector, e.g. project=ci
+	Volumes  []string `json:",omitempty"`
+	Selector string   `json:",omitempty"`
+}
+
+// RoleBinding is a token's role, identified by the sha256 sum of the token
+type RoleBinding struct {
+	Name        string
+	TokenSHA256 string
+	Role        string
+	Volumes     []string `json:",omitempty"`
+	Selector    string   `json:",omitempty"`
+	// Static bindings are configured with -rbac rather than the API
+	Static bool `json:",omitempty"`
+}
+
+// RBACResponse lists the role bindings
+type RBACResponse struct {
+	// DefaultRole is the role of tokens without a binding
+	DefaultRole string
+	Bindings    []RoleBinding
+}
+
+// WhoAmIResponse is the role of the calling token
+type WhoAmIResponse struct {
+	Role string
+	// Binding is the name of the token's binding, empty for the default role
+	Binding  string   `json:",omitempty"`
+	Volumes  []string `json:",omitempty"`
+	Selector string   `json:",omitempty"`
+}
+
+type roleBinding struct {
+	RoleBinding
+	sum      [sha256.Size]byte
+	volumes  map[string]bool
+	selector []labelRequirement
+}
+
+func validateRole(role string) error {
+	if roleLevels[role] == 0 {
+		return &validationError{Field: "Role", Value: role, Reason: "must be reader, operator or admin"}
+	}
+	return nil
+}
+
+func newRoleBinding(b RoleBinding) (*roleBinding, error) {
+	if !bindingNamePattern.MatchString(b.Name) {
+		return nil, &validationError{Field: "Name", Value: b.Name, Reason: "must be letters, digits, '.', '_' or '-'"}
+	}
+	if err := validateRole(b.Role); err != nil {
+		return nil, err
+	}
+	rb := &roleBinding{RoleBinding: b, volumes: make(map[string]bool)}
+	sum, err := hex.DecodeString(b.TokenSHA256)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, &validationError{Field: "TokenSHA256", Value: b.TokenSHA256, Reason: "must be a hex encoded sha256 sum"}
+	}
+	copy(rb.sum[:], sum)
+	for _, v := range b.Volumes {
+		if err := validateName(v); err != nil {
+			return nil, err
+		}
+		rb.volumes[v] = true
+	}
+	if b.Selector != "" {
+		if rb.selector, err = parseSelector([]string{b.Selector}); err != nil {
+			return nil, err
+		}
+	}
+	return rb, nil
+}
+
+func (b *roleBinding) scoped() bool {
+	return b != nil && (len(b.volumes) > 0 || len(b.selector) > 0)
+}
+
+// allows reports whether the named volume is within the binding's scope,
+// name being the volume's name as the client knows it
+func (b *roleBinding) allows(name string, labels map[string]string) bool {
+	if !b.scoped() {
+		return true
+	}
+	if len(b.volumes) > 0 && !b.volumes[name] {
+		return false
+	}
+	return matchLabels(labels, b.selector)
+}
+
+func tokenSum(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseRoleBindings parses comma separated "TOKEN=ROLE [volume:NAME]...
+// [label:SELECTOR]..." bindings, label terms being combined like those of
+// GET /volumes
+func parseRoleBindings(s string) ([]*roleBinding, error) {
+	var bindings []*roleBinding
+	for i, t := range splitTokens(s) {
+		fields := strings.Fields(t)
+		j := strings.LastIndex(fields[0], "=")
+		if j <= 0 {
+			return nil, errors.Errorf("invalid role binding %q, must be TOKEN=ROLE", t)
+		}
+		b := RoleBinding{
+			Name:        staticBindingPrefix + strconv.Itoa(i),
+			TokenSHA256: tokenSum(fields[0][:j]),
+			Role:        fields[0][j+1:],
+			Static:      true,
+		}
+		var selector []string
+		for _, f := range fields[1:] {
+			switch {
+			case strings.HasPrefix(f, "volume:"):
+				b.Volumes = append(b.Volumes, strings.TrimPrefix(f, "volume:"))
+			case strings.HasPrefix(f, "label:"):
+				selector = append(selector, strings.TrimPrefix(f, "label:"))
+			default:
+				return nil, errors.Errorf("invalid scope %q of role binding %s, must be volume:NAME or label:SELECTOR", f, b.Name)
+			}
+		}
+		b.Selector = strings.Join(selector, ",")
+		rb, err := newRoleBinding(b)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid role binding %s", b.Name)
+		}
+		bindings = append(bindings, rb)
+	}
+	return bindings, nil
+}
+
+type rbac struct {
+	mu          sync.RWMutex
+	defaultRole string
+	static      []*roleBinding
+	stored      []*roleBinding
+}
+
+// setStatic replaces the configured bindings and default role
+func (a *rbac) setStatic(bindings []*roleBinding, defaultRole string) error {
+	if err := validateRole(defaultRole); err != nil {
+		return errors.Wrap(err, "invalid -default-role")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, b := range bindings {
+		for _, other := range bindings[:i] {
+			if b.sum == other.sum {
+				return errors.Errorf("role bindings %s and %s are for the same token", other.Name, b.Name)
+			}
+		}
+	}
+	a.static = bindings
+	a.defaultRole = defaultRole
+	return nil
+}
+
+// load adds the bindings stored in the database
+func (a *rbac) load(db *bolt.DB) error {
+	return db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(rbacBucket).ForEach(func(k, v []byte) error {
+			var b RoleBinding
+			if err := json.Unmarshal(v, &b); err != nil {
+				return errors.Wrap(err, "error unmarshaling role binding from database")
+			}
+			rb, err := newRoleBinding(b)
+			if err != nil {
+				return errors.Wrapf(err, "invalid role binding %s in database", b.Name)
+			}
+			a.stored = append(a.stored, rb)
+			return nil
+		})
+	})
+}
+
+// add adds a binding unless its name or token is taken
+func (a *rbac) add(b *roleBinding) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, other := range append(append([]*roleBinding(nil), a.static...), a.stored...) {
+		if other.Name == b.Name {
+			return errAlreadyExists("role binding " + b.Name + " already exists")
+		}
+		if other.sum == b.sum {
+			return errAlreadyExists("the token already has role binding " + other.Name)
+		}
+	}
+	a.stored = append(a.stored, b)
+	return nil
+}
+
+func (a *rbac) remove(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, b := range a.stored {
+		if b.Name == name {
+			a.stored = append(a.stored[:i], a.stored[i+1:]...)
+			return
+		}
+	}
+}
+
+func (a *rbac) get(name string) (*roleBinding, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, bindings := range [][]*roleBinding{a.static, a.stored} {
+		for _, b := range bindings {
+			if b.Name == name {
+				return b, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func (a *rbac) list() RBACResponse {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	resp := RBACResponse{DefaultRole: a.defaultRole, Bindings: []RoleBinding{}}
+	for _, bindings := range [][]*roleBinding{a.static, a.stored} {
+		for _, b := range bindings {
+			resp.Bindings = append(resp.Bindings, b.RoleBinding)
+		}
+	}
+	sort.Slice(resp.Bindings, func(i, j int) bool { return resp.Bindings[i].Name < resp.Bindings[j].Name })
+	return resp
+}
+
+// find returns the token's binding, nil if it has none, and its role
+func (a *rbac) find(token string) (*roleBinding, string) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	sum := sha256.Sum256([]byte(token))
+	var found *roleBinding
+	// check every binding so timing doesn't leak which one matched, a
+	// configured binding wins over a stored one for the same token
+	for _, bindings := range [][]*roleBinding{a.static, a.stored} {
+		for _, b := range bindings {
+			if subtle.ConstantTimeCompare(sum[:], b.sum[:]) == 1 && found == nil {
+				found = b
+			}
+		}
+	}
+	if found == nil {
+		return nil, a.defaultRole
+	}
+	return found, found.Role
+}
+
+// tokenRole returns the binding and role of the request's token. JWTs have
+// no binding, they get the role of their claims, none if the claims give
+// them none. Tokens of a tenant are at most operators, whatever their
+// binding or claims say, as admin routes aren't limited to one tenant.
+func (g *gateway) tokenRole(r *http.Request) (*roleBinding, string) {
+	b, role := g.rbac.find(bearerToken(r))
+	if oidcRole, ok := requestOIDCRole(r); b == nil && ok {
+		role = oidcRole
+	}
+	if requestTenant(r) != "" && roleLevels[role] > roleLevels[roleOperator] {
+		role = roleOperator
+	}
+	return b, role
+}
+
+// requiredRole returns the role a route needs
+func requiredRole(method, tmpl string) string {
+	if role, ok := routeRoles[method+" "+tmpl]; ok {
+		return role
+	}
+	if strings.HasPrefix(tmpl, "/admin/") {
+		return roleAdmin
+	}
+	if method == "GET" || method == "HEAD" {
+		return roleReader
+	}
+	return roleOperator
+}
+
+func errForbidden(msg string) error {
+	return newError(http.StatusForbidden, api.ErrCodeForbidden, msg)
+}
+
+type bindingContextKey struct{}
+
+func withBinding(r *http.Request, b *roleBinding) *http.Request {
+	if b == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), bindingContextKey{}, b))
+}
+
+func requestBinding(r *http.Request) *roleBinding {
+	return contextBinding(r.Context())
+}
+
+// contextBinding returns the binding of the request ctx belongs to
+func contextBinding(ctx context.Context) *roleBinding {
+	b, _ := ctx.Value(bindingContextKey{}).(*roleBinding)
+	return b
+}
+
+// checkScope refuses volumes outside the scope of the request's token, for
+// handlers creating volumes or changing their name or labels
+func checkScope(r *http.Request, name string, labels map[string]string) error {
+	return checkContextScope(r.Context(), name, labels)
+}
+
+// checkContextScope is checkScope for the request ctx belongs to
+func checkContextScope(ctx context.Context, name string, labels map[string]string) error {
+	if !contextBinding(ctx).allows(name, labels) {
+		return errForbidden("the token may not manage volume " + name)
+	}
+	return nil
+}
+
+// authorize checks the role and scope of the token, it runs after
+// authentication so only accepted tokens get here
+func (g *gateway) authorize(router *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if !g.auth.enabled() || token == "" || unauthenticatedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var m mux.RouteMatch
+		if !router.Match(r, &m) {
+			// unknown routes get their 404 from the router
+			next.ServeHTTP(w, r)
+			return
+		}
+		tmpl, err := m.Route.GetPathTemplate()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		b, role := g.tokenRole(r)
+		if role == "" {
+			writeError(w, errForbidden("the token's claims give it no role"))
+			return
+		}
+		if need := requiredRole(r.Method, tmpl); roleLevels[role] < roleLevels[need] {
+			writeError(w, errForbidden("the "+role+" role may not "+r.Method+" "+tmpl+", it needs "+need))
+			return
+		}
+		if b.scoped() {
+			if err := g.checkRouteScope(r, b, tmpl, m.Vars["name"]); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, withBinding(r, b))
+	})
+}
+
+// checkRouteScope keeps scoped tokens to their volumes. Volumes which don't
+// exist yet are only checked by name, handlers creating them check their
+// labels.
+func (g *gateway) checkRouteScope(r *http.Request, b *roleBinding, tmpl, name string) error {
+	if tmpl != "/volume/{name}" && tmpl != "/volumes/{name}" && !strings.HasPrefix(tmpl, "/volume/{name}/") {
+		if scopedRoutes[r.Method+" "+tmpl] {
+			return nil
+		}
+		return errForbidden("the token is limited to some volumes")
+	}
+	if len(b.volumes) > 0 && !b.volumes[name] {
+		return errForbidden("the token may not manage volume " + name)
+	}
+	var v *volume
+	err := g.view(func(tx *bolt.Tx) error {
+		data := getVolumeData(tx, volumeID(requestTenant(r), name))
+		if data == nil {
+			return nil
+		}
+		v = &volume{}
+		return errors.Wrap(json.Unmarshal(data, v), "error unmarshaling volume data from database")
+	})
+	if err != nil {
+		return dbError(err)
+	}
+	if v != nil && !matchLabels(v.Labels, b.selector) {
+		return errForbidden("the token may not manage volume " + name)
+	}
+	return nil
+}
+
+func putRoleBinding(tx *bolt.Tx, b RoleBinding) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling role binding")
+	}
+	return dbError(errors.Wrap(tx.Bucket(rbacBucket).Put([]byte(b.Name), data), "error writing role binding to database"))
+}
+
+func (g *gateway) listRoleBindings(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(g.rbac.list())
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+func (g *gateway) createRoleBinding(w http.ResponseWriter, r *http.Request) {
+	var req RoleBindingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	if strings.HasPrefix(req.Name, staticBindingPrefix) {
+		writeError(w, &validationError{Field: "Name", Value: req.Name, Reason: "the " + staticBindingPrefix + " prefix is reserved for bindings configured with -rbac"})
+		return
+	}
+	if _, ok := g.auth.valid(req.Token); req.Token == "" || !ok {
+		writeError(w, &validationError{Field: "Token", Reason: "must be an accepted API token"})
+		return
+	}
+	rb, err := newRoleBinding(RoleBinding{
+		Name:        req.Name,
+		TokenSHA256: tokenSum(req.Token),
+		Role:        req.Role,
+		Volumes:     req.Volumes,
+		Selector:    req.Selector,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := g.rbac.add(rb); err != nil {
+		writeError(w, err)
+		return
+	}
+	err = g.update(func(tx *bolt.Tx) error {
+		return putRoleBinding(tx, rb.RoleBinding)
+	})
+	if err != nil {
+		g.rbac.remove(rb.Name)
+		writeError(w, err)
+		return
+	}
+
+	b, err := json.Marshal(rb.RoleBinding)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
+
+func (g *gateway) deleteRoleBinding(w http.ResponseWriter, r *http.Request) {
+	rb, ok := g.rbac.get(mux.Vars(r)["name"])
+	if !ok {
+		return
+	}
+	if rb.Static {
+		writeError(w, errInvalid("role binding is configured with -rbac, remove it there"))
+		return
+	}
+	err := g.update(func(tx *bolt.Tx) error {
+		return dbError(errors.Wrap(tx.Bucket(rbacBucket).Delete([]byte(rb.Name)), "error deleting role binding from database"))
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	g.rbac.remove(rb.Name)
+}
+
+func (g *gateway) whoAmI(w http.ResponseWriter, r *http.Request) {
+	resp := WhoAmIResponse{Role: roleAdmin}
+	if g.auth.enabled() {
+		var rb *roleBinding
+		rb, resp.Role = g.tokenRole(r)
+		if rb != nil {
+			resp.Binding, resp.Volumes, resp.Selector = rb.Name, rb.Volumes, rb.Selector
+		}
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Tenant tokens are kept off the admin routes even with the admin default
+// role, the database would give them every tenant's data.
+func TestTenantNotAdmin(t *testing.T) {
+	g, cleanup := newTestGateway(t)
+	defer cleanup()
+	var err error
+	if g.auth, err = newTokenAuth([]string{"admin", "other other"}); err != nil {
+		t.Fatal(err)
+	}
+	g.rbac = &rbac{}
+	if err := g.rbac.setStatic(nil, roleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	g.limits = newLimiter(0, 0, 0, 0, 0, 0)
+	g.timeouts = &requestTimeouts{}
+	h := makeRouter(g.gateway)
+
+	for token, want := range map[string]int{"admin": http.StatusOK, "other": http.StatusForbidden} {
+		req := httptest.NewRequest("GET", "/admin/db/backup", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s: got status %d, want %d: %s", token, rec.Code, want, rec.Body)
+		}
+	}
+}
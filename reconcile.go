@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/pkg/errors"
+)
+
+// etabPath is the table of active exports maintained by exportfs
+var etabPath = "/var/lib/nfs/etab"
+
+// exportLister is implemented by exporters that can report what the NFS
+// server is actually exporting.
+type exportLister interface {
+	exportedPaths() (map[string]bool, error)
+}
+
+type ReconcileReport struct {
+	// Missing are volumes which should be exported but were not
+	Missing []string
+	// Repaired are the missing volumes whose exports were re-applied
+	Repaired []string
+	// Unknown are exported paths the gateway does not manage
+	Unknown []string
+	// Relabeled are volumes whose SELinux context had drifted and was reset
+	Relabeled []string `json:",omitempty"`
+	Error     string   `json:",omitempty"`
+	Checked   time.Time
+}
+
+type reconciler struct {
+	mu   sync.Mutex
+	last *ReconcileReport
+}
+
+func (kernelExporter) exportedPaths() (map[string]bool, error) {
+	f, err := os.Open(etabPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading export table")
+	}
+	defer f.Close()
+
+	paths := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths[unescapeExportPath(strings.Fields(line)[0])] = true
+	}
+	return paths, errors.Wrap(s.Err(), "error reading export table")
+}
+
+// unescapeExportPath decodes the octal escapes (e.g. \040 for a space) used
+// for paths in the export tables.
+func unescapeExportPath(p string) string {
+	p = strings.Trim(p, `"`)
+	if !strings.Contains(p, `\`) {
+		return p
+	}
+	var out []byte
+	for i := 0; i < len(p); i++ {
+		if p[i] == '\\' && i+3 < len(p) {
+			if n, err := strconv.ParseUint(p[i+1:i+4], 8, 8); err == nil {
+				out = append(out, byte(n))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, p[i])
+	}
+	return string(out)
+}
+
+// reconcile compares the volumes in the database with the exports the NFS
+// server knows about, re-applying the exports of any missing volumes.
+func (g *gateway) reconcile() (*ReconcileReport, error) {
+	report := &ReconcileReport{Missing: []string{}, Repaired: []string{}, Unknown: []string{}, Checked: time.Now().UTC()}
+	lister, ok := g.exporter.(exportLister)
+	if !ok {
+		return report, errInvalid("reconciling is not supported by this backend")
+	}
+
+	exported, err := lister.exportedPaths()
+	if err != nil {
+		return report, err
+	}
+	vols, err := g.list()
+	if err != nil {
+		return report, err
+	}
+
+	managed := make(map[string]bool, len(vols))
+	for _, v := range vols {
+		managed[v.Export.Path] = true
+		if relabeled, err := relabel(v); err != nil {
+			logrus.WithError(err).WithField("volume", v.Name).Error("error checking SELinux context")
+		} else if relabeled {
+			report.Relabeled = append(report.Relabeled, v.Name)
+		}
+		if !v.Export.hasClients() || exported[v.Export.Path] {
+			if s, _ := v.status(); s == api.VolumeDegraded || (s == api.VolumeCreating && v.Pending == "") {
+				g.recordExport(v.Name, nil)
+			}
+			continue
+		}
+		report.Missing = append(report.Missing, v.Name)
+		err := g.reexport(v.Name)
+		g.recordExport(v.Name, err)
+		if err != nil {
+			logrus.WithError(err).WithField("volume", v.Name).Error("error re-applying missing export")
+			continue
+		}
+		report.Repaired = append(report.Repaired, v.Name)
+	}
+	for p := range exported {
+		if !managed[p] {
+			report.Unknown = append(report.Unknown, p)
+		}
+	}
+
+	if len(report.Missing) > 0 || len(report.Unknown) > 0 {
+		logrus.WithField("missing", report.Missing).WithField("repaired", report.Repaired).WithField("unknown", report.Unknown).Warn("exports have drifted from the database")
+	}
+	if len(report.Relabeled) > 0 {
+		logrus.WithField("volumes", report.Relabeled).Warn("reset drifted SELinux contexts")
+	}
+	return report, nil
+}
+
+// reexport applies the volume's current export. It may have been changed or
+// deleted since the exports were compared, so it's read again once nothing
+// else can change it.
+func (g *gateway) reexport(name string) error {
+	defer g.locks.lock(name)()
+	var v *volume
+	err := g.view(func(tx *bolt.Tx) error {
+		if getVolumeData(tx, name) == nil {
+			return nil
+		}
+		var err error
+		v, err = readVolume(tx, name)
+		return err
+	})
+	if err != nil || v == nil || !v.Export.hasClients() {
+		return err
+	}
+	return g.export(context.Background(), v)
+}
+
+// recordExport marks the volume degraded when its export couldn't be
+// applied, available once it is
+func (g *gateway) recordExport(name string, exportErr error) {
+	err := g.lockedStatus(name, func(v *volume) bool {
+		if exportErr != nil {
+			return v.markDegraded("error re-applying missing export: " + exportErr.Error())
+		}
+		return v.markExported()
+	})
+	if err != nil {
+		logrus.WithError(err).WithField("volume", name).Error("error recording volume status")
+	}
+}
+
+func (g *gateway) runReconcile(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if g.maintenance.active() {
+			continue
+		}
+		if _, err := g.reconcileAndRecord(); err != nil {
+			logrus.WithError(err).Error("error reconciling exports")
+		}
+	}
+}
+
+func (g *gateway) reconcileAndRecord() (*ReconcileReport, error) {
+	report, err := g.reconcile()
+	if err != nil {
+		report.Error = err.Error()
+	}
+	g.reconciler.mu.Lock()
+	g.reconciler.last = report
+	g.reconciler.mu.Unlock()
+	return report, err
+}
+
+// getReconcile returns the result of the last reconcile run
+func (g *gateway) getReconcile(w http.ResponseWriter, r *http.Request) {
+	g.reconciler.mu.Lock()
+	report := g.reconciler.last
+	g.reconciler.mu.Unlock()
+	if report == nil {
+		writeError(w, errNotFound("exports have not been reconciled yet"))
+		return
+	}
+	writeReconcileReport(w, report)
+}
+
+func (g *gateway) adminReconcile(w http.ResponseWriter, r *http.Request) {
+	report, err := g.reconcileAndRecord()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeReconcileReport(w, report)
+}
+
+func writeReconcileReport(w http.ResponseWriter, report *ReconcileReport) {
+	b, err := json.Marshal(report)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// RenameEvent is the data of volume.renamed events
+type RenameEvent struct {
+	From string
+}
+
+func (g *gateway) renameVolume(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var req api.RenameRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	if err := validateName(req.Name); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if requestBinding(r).scoped() {
+		// the middleware only checked the old name
+		v, err := g.lookup(scopedName(r, name))
+		if err == nil {
+			err = checkScope(r, req.Name, v.Labels)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	v, err := g.rename(r.Context(), scopedName(r, name), scopedName(r, req.Name))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeUpdateResponse(w, v)
+}
+
+// rename moves a volume to a new name within a single transaction. The old
+// export is removed before the data is moved and the new one applied after,
+// on failure the data is moved back and the old export restored.
+func (g *gateway) rename(ctx context.Context, from, to string) (*volume, error) {
+	if from == to {
+		return nil, errInvalid("volume already has this name")
+	}
+
+	defer g.locks.lock(from, to)()
+	var v *volume
+	err := g.updateUndo(ctx, from, func(tx *bolt.Tx, u *undoLog) error {
+		data := getVolumeData(tx, from)
+		if data == nil {
+			return errNotFound("volume not found")
+		}
+		v = &volume{}
+		if err := json.Unmarshal(data, v); err != nil {
+			return dbError(errors.Wrap(err, "error unmarshaling volume from database"))
+		}
+		if v.Pending != "" {
+			return errInvalid("volume is still being populated")
+		}
+		if v.Mirror {
+			return errMirror()
+		}
+		if getVolumeData(tx, to) != nil {
+			return errAlreadyExists("a volume with this name already exists")
+		}
+		if err := checkNoAliases(tx, from); err != nil {
+			return err
+		}
+		if err := g.checkTenantConflict(tx, to); err != nil {
+			return err
+		}
+
+		old := *v
+		u.add("restore export", func() error { return g.export(context.Background(), &old) })
+		if err := g.unexport(ctx, v); err != nil {
+			return err
+		}
+
+		// imported data stays where it is
+		if !v.Imported {
+			if err := g.storage.rename(v, to); err != nil {
+				return err
+			}
+			u.add("move data back", func() error {
+				moved := *v
+				return g.storage.rename(&moved, from)
+			})
+		}
+
+		v.Name = to
+		if err := deleteVolumeData(tx, from); err != nil {
+			return err
+		}
+		if err := putVolume(tx, v); err != nil {
+			return err
+		}
+		if err := renameSnapshots(tx, from, v); err != nil {
+			return err
+		}
+		if err := renameBackups(tx, from, to); err != nil {
+			return err
+		}
+		if p := tx.Bucket(policiesBucket).Get([]byte(from)); p != nil {
+			if err := tx.Bucket(policiesBucket).Put([]byte(to), p); err != nil {
+				return dbError(errors.Wrap(err, "error writing policy to database"))
+			}
+			if err := tx.Bucket(policiesBucket).Delete([]byte(from)); err != nil {
+				return dbError(errors.Wrap(err, "error deleting policy from database"))
+			}
+		}
+		if r := tx.Bucket(integrityBucket).Get([]byte(from)); r != nil {
+			if err := tx.Bucket(integrityBucket).Put([]byte(to), r); err != nil {
+				return dbError(errors.Wrap(err, "error writing integrity report to database"))
+			}
+			if err := tx.Bucket(integrityBucket).Delete([]byte(from)); err != nil {
+				return dbError(errors.Wrap(err, "error deleting integrity report from database"))
+			}
+		}
+		// a missing manifest only means the next scrub starts a new one
+		if os.Rename(g.manifestPath(from), g.manifestPath(to)) == nil {
+			u.add("move manifest back", func() error { return os.Rename(g.manifestPath(to), g.manifestPath(from)) })
+		}
+		u.add("unexport", func() error { return g.unexport(context.Background(), v) })
+		return g.export(ctx, v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	volumeEvent(eventVolumeRenamed, to, RenameEvent{From: displayName(from)})
+	return v, nil
+}
+
+// renameSnapshots moves the snapshot records of a renamed volume. zfs
+// snapshots moved along with the dataset, everything else stays in place.
+func renameSnapshots(tx *bolt.Tx, from string, v *volume) error {
+	b := tx.Bucket(snapshotsBucket)
+	old := b.Bucket([]byte(from))
+	if old == nil {
+		return nil
+	}
+	nb, err := b.CreateBucketIfNotExists([]byte(v.Name))
+	if err != nil {
+		return dbError(errors.Wrap(err, "error creating snapshot bucket"))
+	}
+	err = old.ForEach(func(k, data []byte) error {
+		var s snapshot
+		if err := json.Unmarshal(data, &s); err != nil {
+			return dbError(errors.Wrap(err, "error unmarshaling snapshot from database"))
+		}
+		s.Volume = v.Name
+		if s.Method == snapshotZFS {
+			s.Dataset = v.Dataset + "@" + s.ID
+			s.Path = filepath.Join(v.Export.Path, ".zfs", "snapshot", s.ID)
+		}
+		data, err := json.Marshal(s)
+		if err != nil {
+			return errors.Wrap(err, "error marshaling snapshot data")
+		}
+		return dbError(errors.Wrap(nb.Put(k, data), "error writing snapshot to database"))
+	})
+	if err != nil {
+		return err
+	}
+	return dbError(errors.Wrap(b.DeleteBucket([]byte(from)), "error deleting snapshots from database"))
+}
+
+// renameBackups moves the backup records of a renamed volume, the objects in
+// S3 keep their keys.
+func renameBackups(tx *bolt.Tx, from, to string) error {
+	b := tx.Bucket(backupsBucket)
+	old := b.Bucket([]byte(from))
+	if old == nil {
+		return nil
+	}
+	nb, err := b.CreateBucketIfNotExists([]byte(to))
+	if err != nil {
+		return dbError(errors.Wrap(err, "error creating backup bucket"))
+	}
+	err = old.ForEach(func(k, data []byte) error {
+		var bk backup
+		if err := json.Unmarshal(data, &bk); err != nil {
+			return dbError(errors.Wrap(err, "error unmarshaling backup from database"))
+		}
+		bk.Volume = to
+		data, err := json.Marshal(bk)
+		if err != nil {
+			return errors.Wrap(err, "error marshaling backup")
+		}
+		return dbError(errors.Wrap(nb.Put(k, data), "error writing backup to database"))
+	})
+	if err != nil {
+		return err
+	}
+	return dbError(errors.Wrap(b.DeleteBucket([]byte(from)), "error deleting backups from database"))
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// A repair fixes a volume forward instead of deleting and recreating it, e.g.
+// after a crash or a reboot left it without its directory, mount or export.
+// The steps of creating the volume are re-run against its stored record,
+// each checking first whether there is anything to do. Data which can't be
+// recreated, that of imported volumes, sources, volume images and zfs or
+// btrfs volumes, is only checked, and nothing is exported without it. A
+// missing image may just be on storage which isn't mounted yet, an empty one
+// in its place would hide the loss.
+
+type repairRun struct {
+	g    *gateway
+	v    *volume
+	resp *api.RepairResponse
+	// recreated is set when the volume's directory had to be created again
+	recreated bool
+	// changed is set when the record has to be stored again
+	changed bool
+}
+
+func (r *repairRun) report(step, status, msg string) {
+	r.resp.Steps = append(r.resp.Steps, api.RepairStep{Step: step, Status: status, Message: msg})
+	if status == api.RepairFailed {
+		r.resp.Repaired = false
+	}
+}
+
+func (r *repairRun) fail(step string, err error) {
+	r.report(step, api.RepairFailed, err.Error())
+}
+
+// failed lists the failed steps with their messages
+func (r *repairRun) failed() string {
+	var failed []string
+	for _, s := range r.resp.Steps {
+		if s.Status == api.RepairFailed {
+			failed = append(failed, s.Step+": "+s.Message)
+		}
+	}
+	return strings.Join(failed, "; ")
+}
+
+func (r *repairRun) run(ctx context.Context) {
+	r.resp.Repaired = true
+	if err := r.g.checkVolumePath(r.v); err != nil {
+		r.fail("path", err)
+		return
+	}
+	if !r.data() {
+		return
+	}
+	r.ownership()
+	r.quota()
+	if r.v.FSID == "" {
+		id, err := newFSID()
+		if err != nil {
+			r.fail("fsid", err)
+			return
+		}
+		r.v.FSID = id
+		r.changed = true
+		r.report("fsid", api.RepairFixed, "assigned an fsid")
+	}
+	r.export(ctx)
+	if sidecarDir != "" {
+		if _, err := os.Stat(sidecarPath(r.v.Name)); os.IsNotExist(err) {
+			r.changed = true
+			r.report("sidecar", api.RepairFixed, "rewrote the sidecar")
+		}
+	}
+}
+
+// data makes sure the volume's data is at its export path, it reports
+// whether it is
+func (r *repairRun) data() bool {
+	v := r.v
+	switch {
+	case v.Source != "":
+		if m, err := mountPoint(v.Export.Path); err == nil && m == v.Export.Path {
+			r.report("data", api.RepairOK, v.Source+" is mounted")
+			return true
+		}
+		if err := bindSource(v); err != nil {
+			r.fail("data", err)
+			return false
+		}
+		r.report("data", api.RepairFixed, "bind mounted "+v.Source)
+	case v.Loop != nil:
+		if _, err := os.Stat(v.Loop.Image); err != nil {
+			r.fail("data", errors.Wrap(err, "the volume image is missing and can't be recreated"))
+			return false
+		}
+		if _, err := os.Stat(v.Export.Path); os.IsNotExist(err) {
+			r.recreated = true
+		}
+		if err := os.MkdirAll(v.Export.Path, 0755); err != nil {
+			r.fail("data", errors.Wrap(err, "error creating volume dir"))
+			return false
+		}
+		attached, err := reattachLoop(v)
+		if err != nil {
+			r.fail("data", err)
+			return false
+		}
+		if !attached {
+			r.report("data", api.RepairOK, "the volume image is mounted")
+			return true
+		}
+		r.changed = true
+		r.report("data", api.RepairFixed, "mounted the volume image")
+	case v.Imported || v.Dataset != "" || v.Subvolume:
+		if _, err := os.Stat(v.Export.Path); err != nil {
+			r.fail("data", errors.Wrap(err, "the volume's data is missing and can't be recreated"))
+			return false
+		}
+		r.report("data", api.RepairOK, "the volume's data is in place")
+	default:
+		if _, err := os.Stat(v.Export.Path); err == nil {
+			r.report("data", api.RepairOK, "the volume directory exists")
+			return true
+		}
+		if err := os.MkdirAll(v.Export.Path, 0755); err != nil {
+			r.fail("data", errors.Wrap(err, "error creating volume dir"))
+			return false
+		}
+		r.recreated = true
+		r.report("data", api.RepairFixed, "created the volume directory")
+	}
+	return true
+}
+
+// ownership applies the volume's owner and SELinux context to a recreated
+// directory and restores a drifted context otherwise
+func (r *repairRun) ownership() {
+	v := r.v
+	if r.recreated {
+		if v.Uid != nil || v.Gid != nil || v.Mode != "" {
+			if err := setOwnership(v.Export.Path, api.CreateRequest{Uid: v.Uid, Gid: v.Gid, Mode: v.Mode}); err != nil {
+				r.fail("ownership", err)
+			} else {
+				r.report("ownership", api.RepairFixed, "applied the owner and mode the volume was created with")
+			}
+		}
+		if selinuxContext != "" {
+			if err := labelVolume(v.Export.Path); err != nil {
+				r.fail("selinux", err)
+			} else {
+				r.report("selinux", api.RepairFixed, "labeled the volume directory")
+			}
+		}
+		return
+	}
+	if selinuxContext == "" {
+		return
+	}
+	drifted, err := relabel(v)
+	switch {
+	case err != nil:
+		r.fail("selinux", err)
+	case drifted:
+		r.report("selinux", api.RepairFixed, "restored the SELinux context")
+	default:
+		r.report("selinux", api.RepairOK, "the SELinux context is set")
+	}
+}
+
+// quota applies the volume's project quota again, there's no telling
+// whether it was lost
+func (r *repairRun) quota() {
+	v := r.v
+	if v.Project == nil {
+		return
+	}
+	q, err := setProjectQuota(v.Export.Path, v.Project.ID, v.Project.SizeBytes)
+	if err != nil {
+		r.fail("quota", err)
+		return
+	}
+	if *q != *v.Project {
+		v.Project = q
+		r.changed = true
+	}
+	if r.recreated {
+		r.report("quota", api.RepairFixed, "applied the project quota")
+		return
+	}
+	r.report("quota", api.RepairOK, "applied the project quota again")
+}
+
+func (r *repairRun) export(ctx context.Context) {
+	v := r.v
+	if !v.Export.hasClients() {
+		r.report("export", api.RepairOK, "the volume isn't exported to any hosts")
+		return
+	}
+	exported := false
+	lister, canList := r.g.exporter.(exportLister)
+	if canList {
+		paths, err := lister.exportedPaths()
+		exported = err == nil && paths[v.Export.Path]
+	}
+	if err := r.g.export(ctx, v); err != nil {
+		r.fail("export", err)
+		return
+	}
+	switch {
+	case !canList:
+		r.report("export", api.RepairOK, "applied the export again")
+	case exported:
+		r.report("export", api.RepairOK, "the volume is exported")
+	default:
+		r.report("export", api.RepairFixed, "exported the volume")
+	}
+}
+
+// repair re-runs the steps of creating the volume, see repairRun
+func (g *gateway) repair(ctx context.Context, name string) (*api.RepairResponse, error) {
+	defer g.locks.lock(name)()
+	var r *repairRun
+	err := g.updateContext(ctx, func(tx *bolt.Tx) error {
+		v, err := readVolume(tx, name)
+		if err != nil {
+			return err
+		}
+		if v.Pending != "" {
+			return newError(http.StatusConflict, api.ErrCodeInvalidRequest, "volume is still being populated by job "+v.Pending)
+		}
+		r = &repairRun{g: g, v: v, resp: &api.RepairResponse{Name: displayName(v.Name)}}
+		r.run(ctx)
+		if r.resp.Repaired {
+			r.changed = v.setStatus(api.VolumeAvailable, "") || r.changed
+		} else {
+			r.changed = v.markDegraded("repair failed: "+r.failed()) || r.changed
+		}
+		if r.changed {
+			return putVolume(tx, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range r.resp.Steps {
+		if s.Status == api.RepairFixed {
+			volumeEvent(eventVolumeUpdated, r.v.Name, r.resp)
+			break
+		}
+	}
+	return r.resp, nil
+}
+
+func (g *gateway) repairVolume(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	resp, err := g.repair(r.Context(), scopedName(r, name))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
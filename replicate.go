@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Replicated volumes are pushed to a mirror volume on a peer gateway through
+// its PUT /volume/{name}/replica endpoint, other volumes refuse replicas. zfs datasets and btrfs subvolumes send
+// incremental streams between read-only snapshots; plain directories send a
+// tar stream which the receiver applies with rsync --delete. A receiver that
+// can't take a native stream makes the sender fall back to rsync.
+
+const (
+	replicateZFS   = "zfs"
+	replicateBtrfs = "btrfs"
+	replicateRsync = "rsync"
+
+	// replicationSnapshotPrefix names the snapshots incrementals are based on
+	replicationSnapshotPrefix = "nfsg-repl-"
+)
+
+// replication is the stored replication config and state of a volume
+type replication struct {
+	api.Replication
+	Token string `json:",omitempty"`
+	// Base is the snapshot last sent, which the next sync is incremental to
+	Base string `json:",omitempty"`
+}
+
+// replicationClient has no timeout, replicas are streamed for as long as
+// they take.
+var replicationClient = &http.Client{}
+
+func (g *gateway) replicateVolume(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	var req api.ReplicateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	if u, err := url.Parse(req.Peer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeError(w, &validationError{Field: "Peer", Value: req.Peer, Reason: "must be an http or https URL"})
+		return
+	}
+	if req.Every != "" {
+		if d, err := time.ParseDuration(req.Every); err != nil || d < time.Minute {
+			writeError(w, &validationError{Field: "Every", Value: req.Every, Reason: "must be a duration of at least 1m"})
+			return
+		}
+	}
+	if req.RemoteVolume == "" {
+		req.RemoteVolume = name
+	}
+	if err := validateName(req.RemoteVolume); err != nil {
+		writeError(w, err)
+		return
+	}
+	name = scopedName(r, name)
+
+	var rep *replication
+	err := g.update(func(tx *bolt.Tx) error {
+		v, err := readVolume(tx, name)
+		if err != nil {
+			return err
+		}
+		if v.Pending != "" {
+			return errInvalid("volume is still being populated")
+		}
+		// a new peer or volume can't continue from the old base
+		req.Peer = strings.TrimSuffix(req.Peer, "/")
+		if v.Replication != nil && (v.Replication.Peer != req.Peer || v.Replication.RemoteVolume != req.RemoteVolume) {
+			g.dropReplicationBase(v)
+			v.Replication = nil
+		}
+		if v.Replication == nil {
+			v.Replication = &replication{Replication: api.Replication{Status: api.ReplicationPending}}
+		}
+		v.Replication.Peer = req.Peer
+		v.Replication.RemoteVolume = req.RemoteVolume
+		v.Replication.Every = req.Every
+		v.Replication.Token = req.Token
+		rep = v.Replication
+		return putVolume(tx, v)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, err := json.Marshal(rep.Replication)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+func (g *gateway) stopReplication(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	name = scopedName(r, name)
+	err := g.update(func(tx *bolt.Tx) error {
+		v, err := readVolume(tx, name)
+		if err != nil {
+			return err
+		}
+		if v.Replication == nil {
+			return errNotFound("volume is not replicated")
+		}
+		g.dropReplicationBase(v)
+		v.Replication = nil
+		return putVolume(tx, v)
+	})
+	if err != nil {
+		writeError(w, err)
+	}
+}
+
+// readVolume reads the volume's record, or a not found error
+func readVolume(tx *bolt.Tx, id string) (*volume, error) {
+	data := getVolumeData(tx, id)
+	if data == nil {
+		return nil, errNotFound("volume not found")
+	}
+	var v volume
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, dbError(errors.Wrap(err, "error unmarshaling volume from database"))
+	}
+	return &v, nil
+}
+
+// runReplication syncs replicated volumes as they become due, one at a time.
+// Continuous replication syncs again every interval.
+func (g *gateway) runReplication(interval time.Duration) {
+	for {
+		now := time.Now().UTC()
+		var ready []string
+		err := g.view(func(tx *bolt.Tx) error {
+			return forEachVolume(tx, func(data []byte) error {
+				var v volume
+				if err := json.Unmarshal(data, &v); err != nil {
+					return dbError(errors.Wrap(err, "error unmarshaling volume from database"))
+				}
+				if r := v.Replication; r != nil && v.Pending == "" && (r.Every == "" || due(r.Every, r.LastSync, now)) {
+					ready = append(ready, v.Name)
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			logrus.WithError(err).Error("error listing replicated volumes")
+		}
+		for _, name := range ready {
+			if g.maintenance.active() {
+				break
+			}
+			g.syncReplica(name)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// syncReplica sends the volume to its peer and records the outcome
+func (g *gateway) syncReplica(name string) {
+	v, err := g.lookup(name)
+	if err != nil || v.Replication == nil {
+		return
+	}
+	g.setReplication(name, func(r *replication) {
+		r.Status = api.ReplicationRunning
+	})
+
+	rep := *v.Replication
+	method := replicationMethod(v)
+	base, err := g.sendReplica(v, &rep, method, rep.Base)
+	if isAPIError(err, api.ErrCodeReplicaBaseMissing) {
+		base, err = g.sendReplica(v, &rep, method, "")
+	}
+	if isAPIError(err, api.ErrCodeReplicaUnsupported) && method != replicateRsync {
+		method = replicateRsync
+		base, err = g.sendReplica(v, &rep, method, "")
+	}
+
+	// the new snapshot is the base from now on, drop the old one
+	if err == nil && rep.Base != "" && rep.Base != base {
+		g.dropReplicationBase(v)
+	}
+
+	log := logrus.WithField("volume", name).WithField("peer", rep.Peer)
+	now := time.Now().UTC()
+	g.setReplication(name, func(r *replication) {
+		r.LastSync = &now
+		if err != nil {
+			r.Status = api.ReplicationFailed
+			r.LastError = err.Error()
+			return
+		}
+		r.Status = api.ReplicationOK
+		r.LastError = ""
+		r.Method = method
+		r.Base = base
+	})
+	if err != nil {
+		log.WithError(err).Error("error replicating volume")
+		return
+	}
+	log.WithField("method", method).Debug("replicated volume")
+}
+
+// setReplication updates the stored replication state unless the volume or
+// its replication was removed in the meantime.
+func (g *gateway) setReplication(name string, fn func(*replication)) {
+	err := g.update(func(tx *bolt.Tx) error {
+		v, err := readVolume(tx, name)
+		if err != nil || v.Replication == nil {
+			return nil
+		}
+		fn(v.Replication)
+		return putVolume(tx, v)
+	})
+	if err != nil {
+		logrus.WithError(err).WithField("volume", name).Error("error recording replication status")
+	}
+}
+
+func replicationMethod(v *volume) string {
+	switch {
+	case v.Dataset != "":
+		return replicateZFS
+	case isBtrfsSubvolume(v.Export.Path):
+		return replicateBtrfs
+	default:
+		return replicateRsync
+	}
+}
+
+func isAPIError(err error, code string) bool {
+	e, ok := errors.Cause(err).(*api.ErrorResponse)
+	return ok && e.Code == code
+}
+
+// sendReplica sends the volume's data, incremental to base if it is set, and
+// returns the snapshot the next sync can be incremental to.
+func (g *gateway) sendReplica(v *volume, r *replication, method, base string) (string, error) {
+	query := url.Values{"method": {method}}
+	if base != "" {
+		query.Set("base", base)
+	}
+	switch method {
+	case replicateZFS:
+		snap := replicationSnapshotPrefix + strconv.FormatInt(time.Now().UnixNano(), 10)
+		if err := cmd("zfs", "snapshot", v.Dataset+"@"+snap); err != nil {
+			return "", errors.Wrap(err, "error creating zfs snapshot")
+		}
+		args := []string{"send"}
+		if base != "" {
+			args = append(args, "-i", "@"+base)
+		}
+		args = append(args, v.Dataset+"@"+snap)
+		query.Set("snapshot", snap)
+		if err := pushReplica(r, query, streamCommand("zfs", args...)); err != nil {
+			cmd("zfs", "destroy", v.Dataset+"@"+snap)
+			return "", err
+		}
+		return snap, nil
+	case replicateBtrfs:
+		dir := g.replicationDir(v.Name)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return "", errors.Wrap(err, "error creating replication snapshot dir")
+		}
+		snap := replicationSnapshotPrefix + strconv.FormatInt(time.Now().UnixNano(), 10)
+		if err := cmd("btrfs", "subvolume", "snapshot", "-r", v.Export.Path, filepath.Join(dir, snap)); err != nil {
+			return "", errors.Wrap(err, "error creating btrfs snapshot")
+		}
+		args := []string{"send"}
+		if base != "" {
+			args = append(args, "-p", filepath.Join(dir, base))
+		}
+		args = append(args, filepath.Join(dir, snap))
+		query.Set("snapshot", snap)
+		if err := pushReplica(r, query, streamCommand("btrfs", args...)); err != nil {
+			cmd("btrfs", "subvolume", "delete", filepath.Join(dir, snap))
+			return "", err
+		}
+		return snap, nil
+	default:
+		query.Set("method", replicateRsync)
+		query.Del("base")
+		err := pushReplica(r, query, func(w io.Writer) error {
+			return writeArchive(v.Export.Path, w, compressGzip, func(string) {})
+		})
+		return "", err
+	}
+}
+
+// streamCommand runs a command writing its output to the replica stream
+func streamCommand(bin string, args ...string) func(io.Writer) error {
+	return func(w io.Writer) error {
+		var stderr bytes.Buffer
+		c := exec.Command(bin, args...)
+		c.Stdout = w
+		c.Stderr = &stderr
+		if err := c.Run(); err != nil {
+			return errors.Wrapf(err, "error running %s %s: %s", bin, strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	}
+}
+
+// pushReplica streams what stream writes to the peer
+func pushReplica(r *replication, query url.Values, stream func(io.Writer) error) error {
+	pr, pw := io.Pipe()
+	streamErr := make(chan error, 1)
+	go func() {
+		err := stream(pw)
+		pw.CloseWithError(err)
+		streamErr <- err
+	}()
+	// unblocks the stream if the peer stops reading
+	defer pr.Close()
+
+	// unversioned so peers from before /v1 still receive replicas
+	u := r.Peer + "/volume/" + url.PathEscape(r.RemoteVolume) + "/replica?" + query.Encode()
+	req, err := http.NewRequest("PUT", u, pr)
+	if err != nil {
+		return errors.Wrap(err, "error creating replica request")
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if r.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.Token)
+	}
+	resp, err := replicationClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "error sending replica")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		apiErr := &api.ErrorResponse{}
+		if err := json.Unmarshal(data, apiErr); err != nil || apiErr.Code == "" {
+			return errors.Errorf("peer rejected replica: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+		}
+		return apiErr
+	}
+	pr.Close()
+	return <-streamErr
+}
+
+// replicationDir holds the btrfs snapshots a replicated volume sends from
+func (g *gateway) replicationDir(name string) string {
+	return filepath.Join(g.root, "replication", fileSafeName(name))
+}
+
+// replicaDir holds what a replica is received into before it is applied
+func (g *gateway) replicaDir(name string) string {
+	return filepath.Join(g.root, "replicas", fileSafeName(name))
+}
+
+// dropReplicationBase removes the snapshot the next sync would have been
+// incremental to, best effort.
+func (g *gateway) dropReplicationBase(v *volume) {
+	if v.Replication == nil || v.Replication.Base == "" {
+		return
+	}
+	switch v.Replication.Method {
+	case replicateZFS:
+		cmd("zfs", "destroy", v.Dataset+"@"+v.Replication.Base)
+	case replicateBtrfs:
+		cmd("btrfs", "subvolume", "delete", filepath.Join(g.replicationDir(v.Name), v.Replication.Base))
+	}
+}
+
+// removeReplicationData removes the snapshots kept for sending and receiving
+// replicas of a deleted volume.
+func (g *gateway) removeReplicationData(v *volume) {
+	g.dropReplicationBase(v)
+	for _, dir := range []string{g.replicationDir(v.Name), g.replicaDir(v.Name)} {
+		entries, _ := ioutil.ReadDir(dir)
+		for _, e := range entries {
+			p := filepath.Join(dir, e.Name())
+			if isBtrfsSubvolume(p) {
+				cmd("btrfs", "subvolume", "delete", p)
+			}
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			logrus.WithError(err).WithField("volume", v.Name).Warn("error removing replication data")
+		}
+	}
+}
+
+// receiveReplica replaces the data of a mirror with a replica streamed by a
+// peer gateway.
+func (g *gateway) receiveReplica(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	name = scopedName(r, name)
+	defer g.locks.lock(name)()
+	v, err := g.lookup(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !v.Mirror {
+		// the replica would overwrite what clients wrote
+		writeError(w, newError(http.StatusConflict, api.ErrCodeInvalidRequest, "volume is not a mirror, only mirrors receive replicas"))
+		return
+	}
+	if v.Replication != nil {
+		writeError(w, errInvalid("volume is replicated to another gateway itself"))
+		return
+	}
+	if v.Pending != "" {
+		writeError(w, errInvalid("volume is still being populated"))
+		return
+	}
+
+	q := r.URL.Query()
+	base, snap := q.Get("base"), q.Get("snapshot")
+	for _, s := range []string{base, snap} {
+		if s != "" && (!strings.HasPrefix(s, replicationSnapshotPrefix) || strings.ContainsAny(s, "/@")) {
+			writeError(w, &validationError{Field: "snapshot", Value: s, Reason: "not a replication snapshot"})
+			return
+		}
+	}
+
+	switch q.Get("method") {
+	case replicateZFS:
+		err = receiveZFS(v, r.Body, base)
+	case replicateBtrfs:
+		err = g.receiveBtrfs(v, r.Body, base, snap)
+	case replicateRsync:
+		err = g.receiveRsync(v, r.Body)
+	default:
+		err = &validationError{Field: "method", Value: q.Get("method"), Reason: "must be one of zfs, btrfs, rsync"}
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	logrus.WithField("volume", v.Name).WithField("method", q.Get("method")).WithField("request_id", requestID(r)).Debug("received replica")
+}
+
+func errReplicaUnsupported(msg string) error {
+	return newError(http.StatusUnsupportedMediaType, api.ErrCodeReplicaUnsupported, msg)
+}
+
+func errReplicaBaseMissing() error {
+	return newError(http.StatusConflict, api.ErrCodeReplicaBaseMissing, "the snapshot the replica is based on is missing")
+}
+
+func receiveZFS(v *volume, body io.Reader, base string) error {
+	if v.Dataset == "" {
+		return errReplicaUnsupported("volume is not a zfs dataset")
+	}
+	if base != "" {
+		if _, err := runCommand("zfs", "list", "-H", "-t", "snapshot", v.Dataset+"@"+base); err != nil {
+			return errReplicaBaseMissing()
+		}
+	}
+	var stderr bytes.Buffer
+	c := exec.Command("zfs", "receive", "-F", v.Dataset)
+	c.Stdin = body
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		return errors.Wrapf(err, "error receiving zfs replica: %s", strings.TrimSpace(stderr.String()))
+	}
+	if base != "" {
+		cmd("zfs", "destroy", v.Dataset+"@"+base)
+	}
+	return nil
+}
+
+func (g *gateway) receiveBtrfs(v *volume, body io.Reader, base, snap string) error {
+	if snap == "" {
+		return errInvalid("btrfs replicas must name their snapshot")
+	}
+	dir := g.replicaDir(v.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "error creating replica dir")
+	}
+	var fs unix.Statfs_t
+	if err := unix.Statfs(dir, &fs); err != nil || fs.Type != btrfsSuperMagic {
+		return errReplicaUnsupported("the data root is not on btrfs")
+	}
+	if base != "" {
+		if _, err := os.Stat(filepath.Join(dir, base)); err != nil {
+			return errReplicaBaseMissing()
+		}
+	}
+
+	var stderr bytes.Buffer
+	c := exec.Command("btrfs", "receive", dir)
+	c.Stdin = body
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		cmd("btrfs", "subvolume", "delete", filepath.Join(dir, snap))
+		return errors.Wrapf(err, "error receiving btrfs replica: %s", strings.TrimSpace(stderr.String()))
+	}
+	// the received snapshot is read-only, apply it to the volume in place
+	if err := cmd("rsync", "-a", "--delete", filepath.Join(dir, snap)+"/", v.Export.Path+"/"); err != nil {
+		return errors.Wrap(err, "error applying btrfs replica")
+	}
+	if base != "" {
+		cmd("btrfs", "subvolume", "delete", filepath.Join(dir, base))
+	}
+	return nil
+}
+
+func (g *gateway) receiveRsync(v *volume, body io.Reader) error {
+	staging := filepath.Join(g.replicaDir(v.Name), "staging")
+	if err := os.RemoveAll(staging); err != nil {
+		return errors.Wrap(err, "error clearing replica staging dir")
+	}
+	if err := os.MkdirAll(staging, 0700); err != nil {
+		return errors.Wrap(err, "error creating replica staging dir")
+	}
+	defer os.RemoveAll(staging)
+	if err := readArchive(body, staging, compressGzip, func(string) {}); err != nil {
+		return err
+	}
+	return errors.Wrap(cmd("rsync", "-a", "--delete", staging+"/", v.Export.Path+"/"), "error applying replica")
+}
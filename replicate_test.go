@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+)
+
+// Only mirrors receive replicas, others would have their clients' data
+// overwritten.
+func TestReceiveReplicaMirrorOnly(t *testing.T) {
+	g, cleanup := newTestGateway(t)
+	defer cleanup()
+	if _, err := g.addVolume(context.Background(), "v", api.CreateRequest{Hosts: []string{"h"}}, "", true); err != nil {
+		t.Fatal(err)
+	}
+	r := mux.NewRouter()
+	r.Methods("PUT").Path("/volume/{name}/replica").HandlerFunc(g.receiveReplica)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("PUT", "/volume/v/replica?method=rsync", strings.NewReader("")))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusConflict, rec.Body)
+	}
+}
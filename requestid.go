@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// client supplied request ids end up in logs, so only accept plain tokens
+var requestIDPattern = regexp.MustCompile(`^[a-zA-Z0-9._:-]{1,128}$`)
+
+type requestIDContextKey struct{}
+
+// withRequestID tags every request with an id, taken from the X-Request-ID
+// header when the client sent a valid one. The id is returned in the
+// response header of the same name and attached to the logs of the request.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			var err error
+			id, err = newID()
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+		w.Header().Set(requestIDHeader, id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id)))
+	})
+}
+
+func requestID(r *http.Request) string {
+	return contextRequestID(r.Context())
+}
+
+// contextRequestID returns the id of the request ctx belongs to
+func contextRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// requestLog returns a log entry tagged with the request's id
+func requestLog(r *http.Request) *logrus.Entry {
+	return logrus.WithField("request_id", requestID(r))
+}
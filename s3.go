@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	// s3PartSize is the size of the first parts of multipart uploads, S3
+	// needs at least 5 MiB for every part but the last
+	s3PartSize = 16 << 20
+	// s3PartsPerSize parts are uploaded before the part size doubles, up to
+	// s3MaxPartSize, so large uploads fit in S3's 10000 parts without
+	// buffering large parts for small ones
+	s3PartsPerSize = 1000
+	s3MaxPartSize  = 512 << 20
+	s3MaxParts     = 10000
+)
+
+// s3Client is just enough of an S3 client to put and get objects from an
+// S3 compatible endpoint using path style requests and SigV4 signing.
+type s3Client struct {
+	endpoint  string
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3Client(endpoint, region, bucket, accessKey, secretKey string) *s3Client {
+	if accessKey == "" {
+		accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if secretKey == "" {
+		secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	return &s3Client{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{},
+	}
+}
+
+// objectURL escapes the key the way it's signed, so the path sent is the
+// one in the signature
+func (c *s3Client) objectURL(key string) string {
+	return c.endpoint + "/" + c.bucket + "/" + uriEncode(key, false)
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// upload streams r to the object with a multipart upload, holding one part in
+// memory at a time, and returns the number of bytes uploaded. The upload is
+// aborted when reading r or uploading a part fails.
+func (c *s3Client) upload(key string, r io.Reader) (int64, error) {
+	resp, err := c.request("POST", key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return 0, err
+	}
+	var initiated initiateMultipartUploadResult
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil || initiated.UploadID == "" {
+		return 0, errors.Errorf("error starting s3 upload of %s: no upload id returned", key)
+	}
+	id := initiated.UploadID
+
+	size, err := c.uploadParts(key, id, r)
+	if err != nil {
+		if resp, aerr := c.request("DELETE", key, url.Values{"uploadId": {id}}, nil); aerr != nil {
+			logrus.WithError(aerr).WithField("key", key).Warn("error aborting s3 upload")
+		} else {
+			resp.Body.Close()
+		}
+		return 0, err
+	}
+	return size, nil
+}
+
+func (c *s3Client) uploadParts(key, id string, r io.Reader) (int64, error) {
+	var (
+		complete completeMultipartUpload
+		buf      []byte
+		total    int64
+	)
+	for n := 1; ; n++ {
+		if n > s3MaxParts {
+			return total, errors.Errorf("s3 upload of %s exceeds %d parts", key, s3MaxParts)
+		}
+		size := s3PartSize << uint((n-1)/s3PartsPerSize)
+		if size > s3MaxPartSize {
+			size = s3MaxPartSize
+		}
+		if len(buf) < size {
+			buf = make([]byte, size)
+		}
+		read, err := io.ReadFull(r, buf[:size])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return total, errors.Wrap(err, "error reading upload")
+		}
+		// the last part may be empty when the data ends on a part boundary,
+		// then it's left out unless it's the only one
+		if read > 0 || n == 1 {
+			query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {id}}
+			resp, perr := c.request("PUT", key, query, bytes.NewReader(buf[:read]))
+			if perr != nil {
+				return total, perr
+			}
+			resp.Body.Close()
+			complete.Parts = append(complete.Parts, completedPart{PartNumber: n, ETag: resp.Header.Get("ETag")})
+			total += int64(read)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return total, errors.Wrap(err, "error marshaling s3 upload parts")
+	}
+	resp, err := c.request("POST", key, url.Values{"uploadId": {id}}, bytes.NewReader(body))
+	if err != nil {
+		return total, err
+	}
+	defer resp.Body.Close()
+	// completing can fail after S3 sent a 200, the error is in the body then
+	msg, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return total, errors.Wrap(err, "error completing s3 upload")
+	}
+	if bytes.Contains(msg, []byte("<Error>")) {
+		return total, errors.Errorf("s3 upload of %s failed: %s", key, strings.TrimSpace(string(msg)))
+	}
+	return total, nil
+}
+
+// request makes a request for the object, body being nil or a bytes.Reader
+// so its length is known
+func (c *s3Client) request(method, key string, query url.Values, body *bytes.Reader) (*http.Response, error) {
+	u := c.objectURL(key)
+	if len(query) > 0 {
+		u += "?" + canonicalQuery(query)
+	}
+	var req *http.Request
+	var err error
+	if body != nil {
+		req, err = http.NewRequest(method, u, body)
+	} else {
+		req, err = http.NewRequest(method, u, nil)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating s3 request")
+	}
+	return c.do(req)
+}
+
+func (c *s3Client) get(key string) (io.ReadCloser, error) {
+	resp, err := c.request("GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *s3Client) delete(key string) error {
+	resp, err := c.request("DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *s3Client) do(req *http.Request) (*http.Response, error) {
+	c.sign(req, time.Now().UTC())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error making s3 %s request", req.Method)
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, errors.Errorf("s3 %s %s failed: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// sign adds an AWS SigV4 authorization header. Payloads are left unsigned,
+// unless the request already has an X-Amz-Content-Sha256 header, so backups
+// can be streamed without hashing them first.
+func (c *s3Client) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = "UNSIGNED-PAYLOAD"
+	}
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	var names []string
+	for k := range req.Header {
+		names = append(names, strings.ToLower(k))
+	}
+	sort.Strings(names)
+	var canonHeaders bytes.Buffer
+	for _, k := range names {
+		fmt.Fprintf(&canonHeaders, "%s:%s\n", k, strings.TrimSpace(req.Header.Get(k)))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonReq := strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	reqHash := sha256.Sum256([]byte(canonReq))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(reqHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), day)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.accessKey, scope, signedHeaders, sig))
+}
+
+func canonicalPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return uriEncode(p, false)
+}
+
+// canonicalQuery sorts the parameters by name, then value, and encodes them
+// like uriEncode, which url.Values.Encode doesn't, e.g. for spaces
+func canonicalQuery(q url.Values) string {
+	var names []string
+	for k := range q {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var params []string
+	for _, k := range names {
+		values := append([]string(nil), q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// uriEncode percent-encodes everything but the RFC 3986 unreserved
+// characters, and slashes unless encodeSlash is set, as SigV4 requires
+func uriEncode(s string, encodeSlash bool) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
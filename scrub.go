@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// The scrubber periodically verifies the data of every volume. zfs datasets
+// and btrfs subvolumes are checked by a native scrub of their pool or
+// filesystem, done once per run however many volumes share it. Other volumes
+// keep a manifest of per-file checksums in <root>/integrity: a file whose
+// checksum changed while its size and mtime didn't was corrupted rather than
+// written to. Its old checksum is kept so it's reported until it's restored.
+
+var integrityBucket = []byte("integrity")
+
+const (
+	scrubChecksum = "checksum"
+	scrubZFS      = "zfs"
+	scrubBtrfs    = "btrfs"
+)
+
+// IntegrityReport is the outcome of a volume's last scrub
+type IntegrityReport struct {
+	Volume    string
+	Method    string     `json:",omitempty"`
+	LastScrub *time.Time `json:",omitempty"`
+	// Files is how many files were verified by checksum
+	Files    int                `json:",omitempty"`
+	Findings []IntegrityFinding `json:",omitempty"`
+}
+
+type IntegrityFinding struct {
+	// Path is relative to the volume, empty for errors the filesystem
+	// doesn't attribute to a file
+	Path    string `json:",omitempty"`
+	Problem string
+}
+
+// fileChecksum is a manifest entry
+type fileChecksum struct {
+	Size    int64
+	ModTime time.Time
+	SHA256  string
+}
+
+// scrubRun caches the outcome of native scrubs for the volumes sharing them
+type scrubRun map[string]*nativeScrub
+
+type nativeScrub struct {
+	// lines is the output findings are picked from
+	lines []string
+	err   error
+}
+
+func (g *gateway) getIntegrity(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	name = scopedName(r, name)
+	if _, err := g.lookup(name); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	report := &IntegrityReport{}
+	err := g.view(func(tx *bolt.Tx) error {
+		data := tx.Bucket(integrityBucket).Get([]byte(name))
+		if data == nil {
+			return nil
+		}
+		return dbError(errors.Wrap(json.Unmarshal(data, report), "error unmarshaling integrity report"))
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	report.Volume = displayName(name)
+	b, err := json.Marshal(report)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+// runScrub scrubs every volume in turn, then waits interval for the next run
+func (g *gateway) runScrub(interval time.Duration) {
+	for {
+		vols, err := g.list()
+		if err != nil {
+			logrus.WithError(err).Error("error listing volumes to scrub")
+		}
+		run := make(scrubRun)
+		for _, v := range vols {
+			if v.Pending != "" {
+				continue
+			}
+			if err := g.scrubVolume(v, run); err != nil {
+				logrus.WithError(err).WithField("volume", v.Name).Error("error scrubbing volume")
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (g *gateway) scrubVolume(v *volume, run scrubRun) error {
+	report := &IntegrityReport{Volume: displayName(v.Name)}
+	var err error
+	switch {
+	case v.Dataset != "":
+		report.Method = scrubZFS
+		report.Findings, err = run.zfs(v)
+	case isBtrfsSubvolume(v.Export.Path):
+		report.Method = scrubBtrfs
+		report.Findings, err = run.btrfs(v)
+	default:
+		report.Method = scrubChecksum
+		report.Files, report.Findings, err = g.verifyChecksums(v)
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	report.LastScrub = &now
+	data, err := json.Marshal(report)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling integrity report")
+	}
+	err = g.update(func(tx *bolt.Tx) error {
+		// the volume may have been deleted while it was scrubbed
+		if getVolumeData(tx, v.Name) == nil {
+			return nil
+		}
+		return dbError(errors.Wrap(tx.Bucket(integrityBucket).Put([]byte(v.Name), data), "error writing integrity report"))
+	})
+	if err != nil {
+		return err
+	}
+	if len(report.Findings) > 0 {
+		logrus.WithField("volume", v.Name).WithField("findings", len(report.Findings)).Warn("volume failed its integrity check")
+		volumeEvent(eventIntegrityError, v.Name, report)
+	}
+	return nil
+}
+
+func (g *gateway) manifestPath(name string) string {
+	return filepath.Join(g.root, "integrity", fileSafeName(name)+".json")
+}
+
+// verifyChecksums checks the volume's files against its manifest and records
+// the checksums of new and changed files.
+func (g *gateway) verifyChecksums(v *volume) (int, []IntegrityFinding, error) {
+	manifest := make(map[string]fileChecksum)
+	p := g.manifestPath(v.Name)
+	data, err := ioutil.ReadFile(p)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			logrus.WithError(err).WithField("volume", v.Name).Warn("ignoring invalid checksum manifest")
+		}
+	case !os.IsNotExist(err):
+		return 0, nil, errors.Wrap(err, "error reading checksum manifest")
+	}
+
+	var findings []IntegrityFinding
+	seen := make(map[string]bool)
+	err = filepath.Walk(v.Export.Path, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(v.Export.Path, path)
+		if err != nil {
+			return err
+		}
+		seen[rel] = true
+		sum, err := sha256File(path)
+		if err != nil {
+			findings = append(findings, IntegrityFinding{Path: rel, Problem: err.Error()})
+			return nil
+		}
+		old, ok := manifest[rel]
+		if ok && old.Size == fi.Size() && old.ModTime.Equal(fi.ModTime()) && old.SHA256 != sum {
+			findings = append(findings, IntegrityFinding{Path: rel, Problem: "checksum mismatch, expected sha256 " + old.SHA256 + " but got " + sum})
+			return nil
+		}
+		manifest[rel] = fileChecksum{Size: fi.Size(), ModTime: fi.ModTime(), SHA256: sum}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "error checksumming volume data")
+	}
+	for rel := range manifest {
+		if !seen[rel] {
+			delete(manifest, rel)
+		}
+	}
+
+	data, err = json.Marshal(manifest)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "error marshaling checksum manifest")
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return 0, nil, errors.Wrap(err, "error creating integrity dir")
+	}
+	// written under a temporary name so a crash can't leave half a manifest
+	if err := ioutil.WriteFile(p+".tmp", data, 0600); err != nil {
+		return 0, nil, errors.Wrap(err, "error writing checksum manifest")
+	}
+	if err := os.Rename(p+".tmp", p); err != nil {
+		return 0, nil, errors.Wrap(err, "error writing checksum manifest")
+	}
+	return len(seen), findings, nil
+}
+
+func sha256File(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// zfs scrubs the volume's pool and reports the damaged files zpool lists in
+// the volume's dataset.
+func (run scrubRun) zfs(v *volume) ([]IntegrityFinding, error) {
+	zpool := strings.SplitN(v.Dataset, "/", 2)[0]
+	s, ok := run["zfs:"+zpool]
+	if !ok {
+		s = &nativeScrub{}
+		s.lines, s.err = zpoolScrub(zpool)
+		run["zfs:"+zpool] = s
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	var findings []IntegrityFinding
+	for _, l := range s.lines {
+		switch {
+		case strings.HasPrefix(l, v.Export.Path+"/"):
+			findings = append(findings, IntegrityFinding{Path: strings.TrimPrefix(l, v.Export.Path+"/"), Problem: "permanent zfs error"})
+		case strings.HasPrefix(l, v.Dataset+":"):
+			// files zfs can't map back to a path are listed by object
+			findings = append(findings, IntegrityFinding{Problem: "permanent zfs error in " + l})
+		}
+	}
+	return findings, nil
+}
+
+// zpoolScrub runs a scrub to completion and returns the files with permanent
+// errors zpool status lists afterwards.
+func zpoolScrub(zpool string) ([]string, error) {
+	if _, err := runCommand("zpool", "scrub", zpool); err != nil && !strings.Contains(err.Error(), "currently scrubbing") {
+		return nil, errors.Wrap(err, "error starting zfs scrub")
+	}
+	for {
+		out, err := runCommand("zpool", "status", zpool)
+		if err != nil {
+			return nil, errors.Wrap(err, "error getting zfs scrub status")
+		}
+		if !bytes.Contains(out, []byte("scrub in progress")) {
+			break
+		}
+		time.Sleep(10 * time.Second)
+	}
+
+	out, err := runCommand("zpool", "status", "-v", zpool)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting zfs scrub status")
+	}
+	var files []string
+	var inErrors bool
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(l, "errors:") {
+			inErrors = strings.Contains(l, "Permanent errors")
+			continue
+		}
+		if inErrors && l != "" {
+			files = append(files, l)
+		}
+	}
+	return files, nil
+}
+
+// btrfs scrubs the volume's filesystem. btrfs only logs which files were
+// damaged, so the finding is for the whole filesystem.
+func (run scrubRun) btrfs(v *volume) ([]IntegrityFinding, error) {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(v.Export.Path, &fs); err != nil {
+		return nil, errors.Wrap(err, "error getting filesystem stats")
+	}
+	key := fmt.Sprintf("btrfs:%v", fs.Fsid)
+	s, ok := run[key]
+	if !ok {
+		s = &nativeScrub{}
+		s.lines, s.err = btrfsScrub(v.Export.Path)
+		run[key] = s
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	var findings []IntegrityFinding
+	for _, l := range s.lines {
+		findings = append(findings, IntegrityFinding{Problem: l})
+	}
+	return findings, nil
+}
+
+// btrfsScrub runs a scrub to completion, returning the error counters which
+// aren't zero.
+func btrfsScrub(p string) ([]string, error) {
+	// the exit status is also non-zero when errors were found
+	out, err := runCommand("btrfs", "scrub", "start", "-B", "-R", p)
+	var problems []string
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(s.Text()), ":", 2)
+		if len(parts) != 2 || !strings.HasSuffix(parts[0], "_errors") {
+			continue
+		}
+		if n, _ := strconv.Atoi(strings.TrimSpace(parts[1])); n > 0 {
+			problems = append(problems, fmt.Sprintf("btrfs scrub found %d %s", n, strings.Replace(parts[0], "_", " ", -1)))
+		}
+	}
+	if err != nil && len(problems) == 0 {
+		return nil, errors.Wrap(err, "error running btrfs scrub")
+	}
+	return problems, nil
+}
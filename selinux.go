@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// With -selinux-context new volume directories get that context, so nfsd
+// and the clients of labeled NFS see the type the policy expects rather than
+// whatever the data root has. Reconciling relabels volumes which drifted.
+// Imported volumes and those with a Source keep their owner's labels.
+
+const selinuxXattr = "security.selinux"
+
+// selinuxContext is the context of new volume directories, empty leaves them
+// alone
+var selinuxContext string
+
+func selinuxEnabled() bool {
+	_, err := os.Stat("/sys/fs/selinux/enforce")
+	return err == nil
+}
+
+func validateSELinuxContext(ctx string) error {
+	if ctx == "" {
+		return nil
+	}
+	if parts := strings.SplitN(ctx, ":", 4); len(parts) < 3 || strings.ContainsAny(ctx, " \t\n") {
+		return errors.Errorf("invalid SELinux context %q, must be user:role:type[:level]", ctx)
+	}
+	return nil
+}
+
+func getSELinuxContext(p string) (string, error) {
+	b, err := getXattr(p, selinuxXattr)
+	if err == unix.ENODATA {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "error reading SELinux context")
+	}
+	return strings.TrimRight(string(b), "\x00"), nil
+}
+
+// labelVolume gives the volume directory the configured context
+func labelVolume(p string) error {
+	if selinuxContext == "" {
+		return nil
+	}
+	return errors.Wrap(unix.Setxattr(p, selinuxXattr, []byte(selinuxContext), 0), "error setting SELinux context")
+}
+
+// relabel restores the configured context of a volume's directory and
+// reports whether it had drifted
+func relabel(v *volume) (bool, error) {
+	if selinuxContext == "" || v.Imported || v.Source != "" {
+		return false, nil
+	}
+	ctx, err := getSELinuxContext(v.Export.Path)
+	if err != nil || ctx == selinuxContext {
+		return false, err
+	}
+	return true, labelVolume(v.Export.Path)
+}
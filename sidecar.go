@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// Every volume record is also written to a sidecar file next to where the
+// volume lives in the data root, <root>/nfs/[tenant/].<name>.nfsg-volume.json,
+// so the database can be rebuilt from the data root if it is lost, see
+// -recover-volumes. Sidecars sit outside the volume so clients never see them
+// and they are readable without mounting the volume's image or dataset.
+
+const sidecarSuffix = ".nfsg-volume.json"
+
+// sidecarDir is the directory sidecars are kept under, "" disables them
+var sidecarDir string
+
+func sidecarPath(id string) string {
+	tenant, name := splitVolumeID(id)
+	return filepath.Join(sidecarDir, tenant, "."+name+sidecarSuffix)
+}
+
+// writeSidecar is best effort, the database stays the source of truth
+func writeSidecar(id string, data []byte) {
+	if sidecarDir == "" {
+		return
+	}
+	p := sidecarPath(id)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		logrus.WithError(err).WithField("volume", id).Warn("error writing volume sidecar")
+		return
+	}
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		logrus.WithError(err).WithField("volume", id).Warn("error writing volume sidecar")
+		return
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		logrus.WithError(err).WithField("volume", id).Warn("error writing volume sidecar")
+	}
+}
+
+func removeSidecar(id string) {
+	if sidecarDir == "" {
+		return
+	}
+	if err := os.Remove(sidecarPath(id)); err != nil && !os.IsNotExist(err) {
+		logrus.WithError(err).WithField("volume", id).Warn("error removing volume sidecar")
+	}
+}
+
+// readSidecars reads the sidecars of the default tenant and every other
+// tenant's directory.
+func readSidecars() ([]*volume, error) {
+	var matches []string
+	for _, pattern := range []string{".*" + sidecarSuffix, filepath.Join("*", ".*"+sidecarSuffix)} {
+		m, err := filepath.Glob(filepath.Join(sidecarDir, pattern))
+		if err != nil {
+			return nil, errors.Wrap(err, "error listing volume sidecars")
+		}
+		matches = append(matches, m...)
+	}
+
+	var vols []*volume
+	for _, p := range matches {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading volume sidecar")
+		}
+		var v volume
+		if err := json.Unmarshal(data, &v); err != nil || v.Name == "" {
+			logrus.WithField("path", p).Warn("skipping invalid volume sidecar")
+			continue
+		}
+		// the name must match where the sidecar is, a copied sidecar
+		// must not clobber another volume
+		if sidecarPath(v.Name) != p {
+			logrus.WithField("path", p).WithField("volume", v.Name).Warn("skipping volume sidecar in the wrong place")
+			continue
+		}
+		vols = append(vols, &v)
+	}
+	return vols, nil
+}
+
+// recoverVolumes adds the volumes found in sidecars which the database
+// doesn't know about, existing records are left alone.
+func (g *gateway) recoverVolumes() (int, error) {
+	vols, err := readSidecars()
+	if err != nil {
+		return 0, err
+	}
+	var recovered int
+	err = g.update(func(tx *bolt.Tx) error {
+		for _, v := range vols {
+			if getVolumeData(tx, v.Name) != nil {
+				continue
+			}
+			if strings.TrimSpace(v.Export.Path) == "" {
+				logrus.WithField("volume", v.Name).Warn("not recovering volume without an export path")
+				continue
+			}
+			if err := putVolume(tx, v); err != nil {
+				return err
+			}
+			logrus.WithField("volume", v.Name).Info("recovered volume from sidecar")
+			recovered++
+		}
+		return nil
+	})
+	return recovered, err
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Volumes created with Protocols ["nfs", "smb"] are also shared with Samba.
+// The gateway writes every share section to a single file smb.conf includes
+// and has smbd reload it. Shares follow the volume's export: its hosts are
+// the share's allowed hosts and it's read-only when the export is. The state
+// of each share as last applied is kept in bolt.
+
+const (
+	protocolNFS = "nfs"
+	protocolSMB = "smb"
+)
+
+var smbSharesBucket = []byte("smb-shares")
+
+// validateProtocols checks the protocols a volume is shared with, NFS is
+// always one of them
+func (g *gateway) validateProtocols(protocols []string) error {
+	if protocols == nil {
+		return nil
+	}
+	nfs := false
+	for _, p := range protocols {
+		switch p {
+		case protocolNFS:
+			nfs = true
+		case protocolSMB:
+			if g.smb == nil {
+				return &validationError{Field: "Protocols", Value: p, Reason: "SMB is not enabled on this gateway"}
+			}
+		default:
+			return &validationError{Field: "Protocols", Value: p, Reason: "must be nfs or smb"}
+		}
+	}
+	if !nfs {
+		return &validationError{Field: "Protocols", Value: strings.Join(protocols, ","), Reason: "must include nfs"}
+	}
+	return nil
+}
+
+func (v *volume) hasProtocol(p string) bool {
+	if v.Protocols == nil {
+		return p == protocolNFS
+	}
+	for _, vp := range v.Protocols {
+		if vp == p {
+			return true
+		}
+	}
+	return false
+}
+
+// protocols returns the protocols the volume is shared with
+func (v *volume) protocols() []string {
+	if v.Protocols == nil {
+		return []string{protocolNFS}
+	}
+	return v.Protocols
+}
+
+// smbShareName is the share name of the volume, share names can't contain
+// slashes
+func smbShareName(id string) string {
+	return strings.Replace(id, "/", "-", -1)
+}
+
+// smbShare is a share as rendered into the shares file
+type smbShare struct {
+	volume   string
+	name     string
+	path     string
+	readOnly bool
+	hosts    []string
+	comment  string
+}
+
+// newSMBShare translates the volume's export into a share. Samba can't make
+// a share read-only for some hosts only, hosts of ro access rules are left
+// out of a writable share.
+func newSMBShare(v *volume) *smbShare {
+	s := &smbShare{
+		volume:   v.Name,
+		name:     smbShareName(v.Name),
+		path:     v.Export.Path,
+		readOnly: parseClientOptions(exportOptions(v)).readOnly,
+		comment:  v.Description,
+	}
+	s.hosts = append(s.hosts, v.Export.Hosts...)
+	for _, a := range v.Export.Access {
+		if s.readOnly || (!v.ReadOnly && !v.Mirror && a.Access == "rw") {
+			s.hosts = append(s.hosts, a.Host)
+		}
+	}
+	return s
+}
+
+func (s *smbShare) render(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# managed by nfs-rest-gateway, volume %q\n", s.volume)
+	fmt.Fprintf(buf, "[%s]\n", s.name)
+	fmt.Fprintf(buf, "\tpath = %s\n", s.path)
+	if s.comment != "" {
+		fmt.Fprintf(buf, "\tcomment = %s\n", strings.Join(strings.Fields(s.comment), " "))
+	}
+	if s.readOnly {
+		buf.WriteString("\tread only = yes\n")
+	} else {
+		buf.WriteString("\tread only = no\n")
+	}
+	var hosts []string
+	for _, h := range s.hosts {
+		if h == "*" {
+			hosts = nil
+			break
+		}
+		hosts = append(hosts, h)
+	}
+	if len(hosts) > 0 {
+		fmt.Fprintf(buf, "\thosts allow = %s\n", strings.Join(hosts, " "))
+		buf.WriteString("\thosts deny = ALL\n")
+	}
+	buf.WriteByte('\n')
+}
+
+// smbSharer keeps the shares file in line with the volumes shared over SMB.
+// Changes are applied in the background, each one rewrites the file and
+// reloads smbd once.
+type smbSharer struct {
+	g          *gateway
+	sharesFile string
+	kick       chan struct{}
+
+	mu     sync.Mutex
+	shares map[string]*smbShare
+}
+
+func newSMBSharer(g *gateway, sharesFile string) (*smbSharer, error) {
+	if _, err := exec.LookPath("smbcontrol"); err != nil {
+		return nil, errors.Wrap(err, "could not find required binary 'smbcontrol'")
+	}
+	if err := os.MkdirAll(filepath.Dir(sharesFile), 0755); err != nil {
+		return nil, errors.Wrap(err, "error creating samba config dir")
+	}
+	return &smbSharer{
+		g:          g,
+		sharesFile: sharesFile,
+		kick:       make(chan struct{}, 1),
+		shares:     make(map[string]*smbShare),
+	}, nil
+}
+
+// share shares the volume if it's exported over SMB, otherwise unshares it
+func (s *smbSharer) share(v *volume) {
+	if !v.hasProtocol(protocolSMB) || !v.Export.hasClients() {
+		s.unshare(v)
+		return
+	}
+	s.mu.Lock()
+	s.shares[v.Name] = newSMBShare(v)
+	s.mu.Unlock()
+	s.changed()
+}
+
+func (s *smbSharer) unshare(v *volume) {
+	s.mu.Lock()
+	_, ok := s.shares[v.Name]
+	delete(s.shares, v.Name)
+	s.mu.Unlock()
+	if ok {
+		s.changed()
+	}
+}
+
+func (s *smbSharer) reload(vols []*volume) {
+	s.mu.Lock()
+	s.shares = make(map[string]*smbShare)
+	s.mu.Unlock()
+	for _, v := range vols {
+		s.share(v)
+	}
+	s.changed()
+}
+
+func (s *smbSharer) changed() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (s *smbSharer) run() {
+	retry := time.NewTimer(time.Hour)
+	retry.Stop()
+	for {
+		select {
+		case <-s.kick:
+		case <-retry.C:
+		}
+		if err := s.apply(); err != nil {
+			logrus.WithError(err).Error("error applying samba shares")
+			retry.Reset(30 * time.Second)
+		}
+	}
+}
+
+// apply writes the shares file, reloads smbd and records the result
+func (s *smbSharer) apply() error {
+	s.mu.Lock()
+	shares := make([]*smbShare, 0, len(s.shares))
+	for _, sh := range s.shares {
+		shares = append(shares, sh)
+	}
+	s.mu.Unlock()
+	sort.Slice(shares, func(i, j int) bool { return shares[i].name < shares[j].name })
+
+	var buf bytes.Buffer
+	buf.WriteString("# generated by nfs-rest-gateway, changes are overwritten\n\n")
+	for _, sh := range shares {
+		sh.render(&buf)
+	}
+	applyErr := s.write(buf.Bytes())
+	if applyErr == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		applyErr = errors.Wrap(cmdContext(ctx, "smbcontrol", "smbd", "reload-config"), "error reloading smbd")
+		cancel()
+	}
+
+	now := time.Now().UTC()
+	err := s.g.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(smbSharesBucket)
+		current := make(map[string]bool, len(shares))
+		for _, sh := range shares {
+			current[sh.volume] = true
+			state := api.SMBShare{
+				Name:       sh.name,
+				Path:       sh.path,
+				ReadOnly:   sh.readOnly,
+				HostsAllow: sh.hosts,
+				State:      api.SMBShareActive,
+				UpdatedAt:  now,
+			}
+			if applyErr != nil {
+				state.State = api.SMBShareFailed
+				state.Error = applyErr.Error()
+			}
+			data, err := json.Marshal(state)
+			if err != nil {
+				return errors.Wrap(err, "error marshaling share state")
+			}
+			if err := b.Put([]byte(sh.volume), data); err != nil {
+				return dbError(errors.Wrap(err, "error writing share state to database"))
+			}
+		}
+		var stale [][]byte
+		b.ForEach(func(k, _ []byte) error {
+			if !current[string(k)] {
+				stale = append(stale, k)
+			}
+			return nil
+		})
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return dbError(errors.Wrap(err, "error removing share state from database"))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return applyErr
+}
+
+// shutdown removes every share right away
+func (s *smbSharer) shutdown() error {
+	s.mu.Lock()
+	s.shares = make(map[string]*smbShare)
+	s.mu.Unlock()
+	if err := s.write([]byte("# generated by nfs-rest-gateway, changes are overwritten\n")); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return errors.Wrap(cmdContext(ctx, "smbcontrol", "smbd", "reload-config"), "error reloading smbd")
+}
+
+// write replaces the shares file, smbd never reads a partly written one
+func (s *smbSharer) write(data []byte) error {
+	tmp := s.sharesFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrap(err, "error writing samba shares")
+	}
+	return errors.Wrap(os.Rename(tmp, s.sharesFile), "error writing samba shares")
+}
+
+func (g *gateway) getSMBShare(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	if g.smb == nil {
+		writeError(w, errInvalid("SMB is not enabled on this gateway"))
+		return
+	}
+	id := scopedName(r, name)
+	var share *api.SMBShare
+	err := g.view(func(tx *bolt.Tx) error {
+		v, err := readVolume(tx, id)
+		if err != nil {
+			return err
+		}
+		if !v.hasProtocol(protocolSMB) {
+			return errNotFound("the volume is not shared over SMB")
+		}
+		share = &api.SMBShare{Name: smbShareName(id), Path: v.Export.Path, State: api.SMBSharePending}
+		if data := tx.Bucket(smbSharesBucket).Get([]byte(id)); data != nil {
+			if err := json.Unmarshal(data, share); err != nil {
+				return dbError(errors.Wrap(err, "error unmarshaling share state from database"))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, err := json.Marshal(share)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
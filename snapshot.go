@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+var snapshotsBucket = []byte("snapshots")
+
+const (
+	snapshotBtrfs = "btrfs"
+	snapshotZFS   = "zfs"
+	snapshotCopy  = "copy"
+)
+
+const btrfsSuperMagic = 0x9123683e
+
+type snapshot struct {
+	ID      string
+	Volume  string
+	Created time.Time
+	Method  string
+	// Path is where the snapshot data can be read from
+	Path string
+	// Dataset is the full zfs snapshot name when Method is zfs
+	Dataset string `json:",omitempty"`
+	// Scheduled snapshots were taken by the volume's policy and are pruned by it
+	Scheduled bool `json:",omitempty"`
+}
+
+func (g *gateway) snapshotPath(pool, name, id string) string {
+	return filepath.Join(g.poolRoot(pool), "snapshots", name, id)
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "error generating id")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (g *gateway) takeSnapshot(v *volume, id string) (*snapshot, error) {
+	s := &snapshot{
+		ID:      id,
+		Volume:  v.Name,
+		Created: time.Now().UTC(),
+	}
+
+	src := v.Export.Path
+	if dataset, ok := zfsDataset(src); ok {
+		s.Method = snapshotZFS
+		s.Dataset = dataset + "@" + id
+		s.Path = filepath.Join(src, ".zfs", "snapshot", id)
+		return s, errors.Wrap(cmd("zfs", "snapshot", s.Dataset), "error creating zfs snapshot")
+	}
+
+	s.Path = g.snapshotPath(v.Pool, v.Name, id)
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0700); err != nil {
+		return nil, errors.Wrap(err, "error creating snapshot dir")
+	}
+
+	if isBtrfsSubvolume(src) {
+		s.Method = snapshotBtrfs
+		return s, errors.Wrap(cmd("btrfs", "subvolume", "snapshot", "-r", src, s.Path), "error creating btrfs snapshot")
+	}
+
+	s.Method = snapshotCopy
+	if err := os.Mkdir(s.Path, 0755); err != nil {
+		return nil, errors.Wrap(err, "error creating snapshot dir")
+	}
+	if err := cmd("cp", "-a", "--reflink=auto", src+"/.", s.Path); err != nil {
+		os.RemoveAll(s.Path)
+		return nil, errors.Wrap(err, "error copying volume data")
+	}
+	return s, nil
+}
+
+func (s *snapshot) remove() error {
+	switch s.Method {
+	case snapshotZFS:
+		return errors.Wrap(cmd("zfs", "destroy", s.Dataset), "error destroying zfs snapshot")
+	case snapshotBtrfs:
+		return errors.Wrap(cmd("btrfs", "subvolume", "delete", s.Path), "error deleting btrfs snapshot")
+	default:
+		if err := os.RemoveAll(s.Path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "error removing snapshot data")
+		}
+		return nil
+	}
+}
+
+// isBtrfsSubvolume reports whether p is the root of a btrfs subvolume, which
+// is required for native snapshots.
+func isBtrfsSubvolume(p string) bool {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(p, &fs); err != nil || fs.Type != btrfsSuperMagic {
+		return false
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(p, &st); err != nil {
+		return false
+	}
+	// subvolume roots always have inode 256
+	return st.Ino == 256
+}
+
+// zfsDataset returns the dataset mounted exactly at p, if any.
+func zfsDataset(p string) (string, bool) {
+	if _, err := exec.LookPath("zfs"); err != nil {
+		return "", false
+	}
+	out, err := runCommand("zfs", "list", "-H", "-o", "name,mountpoint", p)
+	if err != nil {
+		return "", false
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 || fields[1] != p {
+		return "", false
+	}
+	return fields[0], true
+}
+
+// deleteSnapshots removes all snapshots belonging to the named volume
+func deleteSnapshots(tx *bolt.Tx, name string) error {
+	b := tx.Bucket(snapshotsBucket).Bucket([]byte(name))
+	if b == nil {
+		return nil
+	}
+	err := b.ForEach(func(k, v []byte) error {
+		var s snapshot
+		if err := json.Unmarshal(v, &s); err != nil {
+			return dbError(errors.Wrap(err, "error unmarshaling snapshot from database"))
+		}
+		return s.remove()
+	})
+	if err != nil {
+		return err
+	}
+	return dbError(errors.Wrap(tx.Bucket(snapshotsBucket).DeleteBucket([]byte(name)), "error deleting snapshots from database"))
+}
+
+// snapshotVolume takes a snapshot of the named volume and records it.
+// Volumes still being populated or being deleted are refused.
+func (g *gateway) snapshotVolume(name string, scheduled bool) (*snapshot, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	defer g.locks.lock(name)()
+	var s *snapshot
+	err = g.updateUndo(context.Background(), name, func(tx *bolt.Tx, u *undoLog) error {
+		data := getVolumeData(tx, name)
+		if data == nil {
+			return errNotFound("volume not found")
+		}
+
+		var v volume
+		if err := json.Unmarshal(data, &v); err != nil {
+			return dbError(errors.Wrap(err, "error unmarshaling volume from database"))
+		}
+		if v.Pending != "" {
+			return errInvalid("volume is still being populated")
+		}
+		if status, _ := v.status(); status == api.VolumeDeleting {
+			return newError(http.StatusConflict, api.ErrCodeInvalidRequest, "volume is being deleted")
+		}
+
+		b, err := tx.Bucket(snapshotsBucket).CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return errors.Wrap(err, "error creating snapshot bucket")
+		}
+
+		s, err = g.takeSnapshot(&v, id)
+		if err != nil {
+			return err
+		}
+		u.add("remove snapshot", s.remove)
+		s.Scheduled = scheduled
+
+		sb, err := json.Marshal(s)
+		if err != nil {
+			return errors.Wrap(err, "error marshaling snapshot data")
+		}
+		return dbError(errors.Wrap(b.Put([]byte(id), sb), "error writing snapshot to database"))
+	})
+	if err != nil {
+		return nil, err
+	}
+	volumeEvent(eventSnapshotCreated, name, s)
+	return s, nil
+}
+
+func (g *gateway) createSnapshot(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if name == "" {
+		writeError(w, errInvalid("must provide name parameter"))
+		return
+	}
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	name = scopedName(r, name)
+
+	s, err := g.snapshotVolume(name, false)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
+
+func (g *gateway) listSnapshots(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if name == "" {
+		writeError(w, errInvalid("must provide name parameter"))
+		return
+	}
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	name = scopedName(r, name)
+
+	snapshots := []snapshot{}
+	var found bool
+	err := g.view(func(tx *bolt.Tx) error {
+		if getVolumeData(tx, name) == nil {
+			return nil
+		}
+		found = true
+
+		b := tx.Bucket(snapshotsBucket).Bucket([]byte(name))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var s snapshot
+			if err := json.Unmarshal(v, &s); err != nil {
+				return dbError(errors.Wrap(err, "error unmarshaling snapshot from database"))
+			}
+			snapshots = append(snapshots, s)
+			return nil
+		})
+	})
+	if err != nil {
+		writeError(w, dbError(errors.Wrap(err, "error reading from database")))
+		return
+	}
+	if !found {
+		writeError(w, errNotFound("volume not found"))
+		return
+	}
+
+	b, err := json.Marshal(snapshots)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+func (g *gateway) deleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, id := vars["name"], vars["id"]
+	if name == "" || id == "" {
+		writeError(w, errInvalid("must provide name and id parameters"))
+		return
+	}
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	name = scopedName(r, name)
+
+	defer g.locks.lock(name)()
+	var found bool
+	err := g.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(snapshotsBucket).Bucket([]byte(name))
+		if b == nil {
+			return nil
+		}
+		data := b.Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		found = true
+
+		var s snapshot
+		if err := json.Unmarshal(data, &s); err != nil {
+			return dbError(errors.Wrap(err, "error unmarshaling snapshot from database"))
+		}
+		if err := b.Delete([]byte(id)); err != nil {
+			return dbError(errors.Wrap(err, "error deleting snapshot from database"))
+		}
+		return s.remove()
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !found {
+		writeError(w, errNotFound("snapshot not found"))
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+)
+
+// Volumes being populated or deleted can't be snapshotted, the snapshot
+// would outlive them.
+func TestSnapshotRefused(t *testing.T) {
+	g, cleanup := newTestGateway(t)
+	defer cleanup()
+	if _, err := g.addVolume(context.Background(), "pending", api.CreateRequest{}, "job", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.addVolume(context.Background(), "deleting", api.CreateRequest{Hosts: []string{"h"}}, "", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.updateStatus("deleting", func(v *volume) bool { return v.setStatus(api.VolumeDeleting, "") }); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"pending", "deleting"} {
+		if _, err := g.snapshotVolume(name, false); err == nil {
+			t.Errorf("%s: snapshot taken", name)
+		}
+	}
+	if _, err := g.addVolume(context.Background(), "v", api.CreateRequest{Hosts: []string{"h"}}, "", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.snapshotVolume("v", false); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Volumes created with a Source bind mount an existing directory, from one
+// of the allowed import paths, at their managed export path. Like imported
+// volumes their data is never removed, deleting one only unmounts it.
+
+// sourceStorage handles volumes with a source and leaves everything else to
+// the configured backend.
+type sourceStorage struct {
+	storage
+	g *gateway
+}
+
+func (s sourceStorage) create(tx *bolt.Tx, v *volume, req api.CreateRequest) error {
+	if req.Source == "" {
+		return s.storage.create(tx, v, req)
+	}
+	v.Source = req.Source
+	return bindSource(v)
+}
+
+func (s sourceStorage) destroy(v *volume) error {
+	if v.Source == "" {
+		return s.storage.destroy(v)
+	}
+	return unbindSource(v)
+}
+
+func (s sourceStorage) rename(v *volume, name string) error {
+	if v.Source == "" {
+		return s.storage.rename(v, name)
+	}
+	if err := unbindSource(v); err != nil {
+		return err
+	}
+	old := v.Export.Path
+	v.Export.Path = s.g.nfsPath(v.Pool, name)
+	if err := bindSource(v); err != nil {
+		v.Export.Path = old
+		bindSource(v)
+		return err
+	}
+	return nil
+}
+
+func (s sourceStorage) clone(tx *bolt.Tx, src, dst *volume) error {
+	c, ok := s.storage.(cloner)
+	if !ok {
+		return errInvalid("cloning is not supported by this storage backend")
+	}
+	return c.clone(tx, src, dst)
+}
+
+// canClone is false for volumes with a source, their data is copied instead
+func (s sourceStorage) canClone(v *volume) bool {
+	c, ok := s.storage.(cloner)
+	return ok && v.Source == "" && c.canClone(v)
+}
+
+// bindSource mounts the volume's source at its export path unless it is
+// already mounted there.
+func bindSource(v *volume) error {
+	if err := os.MkdirAll(v.Export.Path, 0755); err != nil {
+		return errors.Wrap(err, "error creating volume dir")
+	}
+	if m, err := mountPoint(v.Export.Path); err == nil && m == v.Export.Path {
+		return nil
+	}
+	return errors.Wrap(unix.Mount(v.Source, v.Export.Path, "", unix.MS_BIND, ""), "error bind mounting volume source")
+}
+
+func unbindSource(v *volume) error {
+	if err := unix.Unmount(v.Export.Path, 0); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		return errors.Wrap(err, "error unmounting volume source")
+	}
+	// Remove, not RemoveAll, in case the source is somehow still mounted
+	if err := os.Remove(v.Export.Path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "error removing volume dir")
+	}
+	return nil
+}
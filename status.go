@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/pkg/errors"
+)
+
+// Volumes carry their lifecycle status so clients can tell a volume whose
+// export failed from a healthy one. Creates record creating or available,
+// delete jobs deleting and error when they fail. Reload and the reconciler
+// mark volumes they can't export degraded and available again once they
+// are, as do successful updates and repairs. Volumes stored before statuses
+// were recorded are available, or creating while pending.
+
+// status returns the volume's status and the reason for it
+func (v *volume) status() (string, string) {
+	switch {
+	case v.Status != "":
+		return v.Status, v.StatusReason
+	case v.Pending != "":
+		return api.VolumeCreating, ""
+	}
+	return api.VolumeAvailable, ""
+}
+
+// setStatus sets the volume's status, it reports whether it changed
+func (v *volume) setStatus(status, reason string) bool {
+	if s, r := v.status(); s == status && r == reason {
+		return false
+	}
+	v.Status, v.StatusReason = status, reason
+	return true
+}
+
+// markExported records that the volume's export was applied, making it
+// available unless it's still being populated, deleted or failed
+func (v *volume) markExported() bool {
+	switch s, _ := v.status(); {
+	case v.Pending != "":
+		return false
+	case s == api.VolumeCreating || s == api.VolumeDegraded:
+		return v.setStatus(api.VolumeAvailable, "")
+	}
+	return false
+}
+
+// markDegraded records why the volume can't be exported, unless it's being
+// created or deleted or has failed
+func (v *volume) markDegraded(reason string) bool {
+	if s, _ := v.status(); s != api.VolumeAvailable && s != api.VolumeDegraded {
+		return false
+	}
+	return v.setStatus(api.VolumeDegraded, reason)
+}
+
+// updateStatus applies fn to the stored volume and stores it when fn
+// reports a change. The caller must hold the volume's lock.
+func (g *gateway) updateStatus(name string, fn func(*volume) bool) error {
+	return g.update(func(tx *bolt.Tx) error {
+		data := getVolumeData(tx, name)
+		if data == nil {
+			return nil
+		}
+		var v volume
+		if err := json.Unmarshal(data, &v); err != nil {
+			return dbError(errors.Wrap(err, "error unmarshaling volume from database"))
+		}
+		if !fn(&v) {
+			return nil
+		}
+		return putVolumeState(tx, &v)
+	})
+}
+
+// lockedStatus is updateStatus for callers not holding the volume's lock
+func (g *gateway) lockedStatus(name string, fn func(*volume) bool) error {
+	defer g.locks.lock(name)()
+	return g.updateStatus(name, fn)
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// storage provisions the data behind a volume's export path. The export layer
+// only ever sees v.Export.Path, so backends are free to put a plain directory,
+// a mounted image or a dataset there.
+type storage interface {
+	// create provisions the volume's data at v.Export.Path, recording
+	// anything needed to tear it down again on v
+	create(tx *bolt.Tx, v *volume, req api.CreateRequest) error
+	// destroy permanently removes the volume's data
+	destroy(v *volume) error
+	// rename moves the volume's data to where the volume name would keep
+	// it, updating v to match
+	rename(v *volume, name string) error
+}
+
+// cloner is implemented by backends which can create copy-on-write clones
+type cloner interface {
+	// clone provisions dst's data as a writable copy of src
+	clone(tx *bolt.Tx, src, dst *volume) error
+	// canClone reports whether v's data can be cloned
+	canClone(v *volume) bool
+}
+
+// resizer is implemented by backends which can change the size limit of
+// existing volumes
+type resizer interface {
+	// resize sets v's size limit, 0 removes it, updating v to match
+	resize(tx *bolt.Tx, v *volume, size int64) error
+}
+
+// dirStorage keeps volumes as directories under the data root, enforcing
+// sizes with loop mounted images or project quotas.
+type dirStorage struct {
+	g *gateway
+	// quotaBackend is quotaBackendLoop or quotaBackendProject
+	quotaBackend string
+}
+
+func (s dirStorage) create(tx *bolt.Tx, v *volume, req api.CreateRequest) error {
+	if err := os.MkdirAll(v.Export.Path, 0755); err != nil {
+		return errors.Wrap(err, "error creating volume dir")
+	}
+	if req.SizeBytes == 0 {
+		return nil
+	}
+
+	if s.quotaBackend == quotaBackendProject {
+		id, err := nextProjectID(tx)
+		if err != nil {
+			return err
+		}
+		q, err := setProjectQuota(v.Export.Path, id, req.SizeBytes)
+		if err != nil {
+			return err
+		}
+		v.Project = q
+		return nil
+	}
+
+	l, err := createLoop(s.g.imagePath(v.Pool, v.Name), req.FSType, req.SizeBytes)
+	if err != nil {
+		return err
+	}
+	if err := l.mount(v.Export.Path); err != nil {
+		l.destroy(v.Export.Path)
+		return err
+	}
+	v.Loop = l
+	return nil
+}
+
+func (s dirStorage) resize(tx *bolt.Tx, v *volume, size int64) error {
+	switch {
+	case v.Loop != nil:
+		if size < v.Loop.SizeBytes {
+			return errInvalid("the size of a loop mounted volume can only grow")
+		}
+		if err := v.Loop.grow(v.Export.Path, size); err != nil {
+			return err
+		}
+	case v.Project != nil && size == 0:
+		if err := v.Project.clear(); err != nil {
+			return err
+		}
+		v.Project = nil
+	case v.Project != nil:
+		q, err := setProjectQuota(v.Export.Path, v.Project.ID, size)
+		if err != nil {
+			return err
+		}
+		v.Project = q
+	case size == 0:
+	case s.quotaBackend == quotaBackendProject:
+		id, err := nextProjectID(tx)
+		if err != nil {
+			return err
+		}
+		q, err := setProjectQuota(v.Export.Path, id, size)
+		if err != nil {
+			return err
+		}
+		v.Project = q
+	default:
+		// the data would have to be moved into an image
+		return errInvalid("a volume created without a size can't be limited with loop mounted images")
+	}
+	v.SizeBytes = size
+	return nil
+}
+
+// parseMode parses an octal mode of up to 07777
+func parseMode(mode string) (uint32, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 07777 {
+		return 0, &validationError{Field: "Mode", Value: mode, Reason: "must be an octal mode, e.g. 0770"}
+	}
+	return uint32(m), nil
+}
+
+// setOwnership applies the Uid, Gid and Mode of a create request to the
+// volume's root directory
+func setOwnership(p string, req api.CreateRequest) error {
+	uid, gid := -1, -1
+	if req.Uid != nil {
+		uid = int(*req.Uid)
+	}
+	if req.Gid != nil {
+		gid = int(*req.Gid)
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Lchown(p, uid, gid); err != nil {
+			return errors.Wrap(err, "error changing owner of volume dir")
+		}
+	}
+	if req.Mode != "" {
+		mode, err := parseMode(req.Mode)
+		if err != nil {
+			return err
+		}
+		// unix.Chmod keeps the setuid, setgid and sticky bits as given
+		if err := unix.Chmod(p, mode); err != nil {
+			return errors.Wrap(err, "error changing mode of volume dir")
+		}
+	}
+	return nil
+}
+
+func (s dirStorage) rename(v *volume, name string) error {
+	p := s.g.nfsPath(v.Pool, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return errors.Wrap(err, "error creating volume dir")
+	}
+	if v.Loop == nil {
+		if err := os.Rename(v.Export.Path, p); err != nil {
+			return errors.Wrap(err, "error moving volume data")
+		}
+		v.Export.Path = p
+		return nil
+	}
+
+	// mountpoints can't be renamed, so the image is moved while unmounted
+	image := s.g.imagePath(v.Pool, name)
+	if err := os.MkdirAll(filepath.Dir(image), 0700); err != nil {
+		return errors.Wrap(err, "error creating image dir")
+	}
+	if err := v.Loop.unmount(v.Export.Path); err != nil {
+		return err
+	}
+	if err := os.Rename(v.Loop.Image, image); err != nil {
+		v.Loop.mount(v.Export.Path)
+		return errors.Wrap(err, "error moving volume image")
+	}
+	if err := os.Rename(v.Export.Path, p); err != nil {
+		os.Rename(image, v.Loop.Image)
+		v.Loop.mount(v.Export.Path)
+		return errors.Wrap(err, "error moving volume dir")
+	}
+	v.Loop.Image = image
+	v.Export.Path = p
+	return v.Loop.mount(p)
+}
+
+func (dirStorage) destroy(v *volume) error {
+	if v.Loop != nil {
+		if err := v.Loop.destroy(v.Export.Path); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(v.Export.Path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "error removing volume data")
+	}
+	if v.Project != nil {
+		return v.Project.clear()
+	}
+	return nil
+}
+
+// zfsStorage creates a dataset per volume under a parent dataset, mounted at
+// the volume's export path. Sizes become the dataset's quota.
+type zfsStorage struct {
+	// dir handles volumes created before switching to zfs
+	dir    dirStorage
+	parent string
+	// compression is set on new datasets, empty inherits from the parent
+	compression string
+	// reserve also reserves the quota so the pool can't be overcommitted
+	reserve bool
+}
+
+func newZFSStorage(dir dirStorage, parent, compression string, reserve bool) (*zfsStorage, error) {
+	if parent == "" {
+		return nil, errors.New("a parent dataset is required")
+	}
+	if _, err := exec.LookPath("zfs"); err != nil {
+		return nil, errors.Wrap(err, "could not find required binary 'zfs'")
+	}
+	if err := cmd("zfs", "list", "-H", "-o", "name", parent); err != nil {
+		return nil, errors.Wrapf(err, "error looking up dataset %s", parent)
+	}
+	return &zfsStorage{dir: dir, parent: parent, compression: compression, reserve: reserve}, nil
+}
+
+// dataset maps a volume id to its dataset. "/" separates tenants in ids but
+// would nest datasets, ":" is valid in dataset names and never in tenants.
+func (s *zfsStorage) dataset(id string) string {
+	return s.parent + "/" + strings.Replace(id, "/", ":", -1)
+}
+
+func (s *zfsStorage) create(tx *bolt.Tx, v *volume, req api.CreateRequest) error {
+	if err := os.MkdirAll(filepath.Dir(v.Export.Path), 0755); err != nil {
+		return errors.Wrap(err, "error creating volume dir")
+	}
+
+	dataset := s.dataset(v.Name)
+	args := []string{"create", "-o", "mountpoint=" + v.Export.Path}
+	if req.SizeBytes > 0 {
+		size := strconv.FormatInt(req.SizeBytes, 10)
+		args = append(args, "-o", "quota="+size)
+		if s.reserve {
+			args = append(args, "-o", "reservation="+size)
+		}
+	}
+	if s.compression != "" {
+		args = append(args, "-o", "compression="+s.compression)
+	}
+	if err := cmd("zfs", append(args, dataset)...); err != nil {
+		return errors.Wrap(err, "error creating zfs dataset")
+	}
+	v.Dataset = dataset
+	return nil
+}
+
+func (s *zfsStorage) resize(tx *bolt.Tx, v *volume, size int64) error {
+	if v.Dataset == "" {
+		return s.dir.resize(tx, v, size)
+	}
+	value := "none"
+	if size > 0 {
+		value = strconv.FormatInt(size, 10)
+	}
+	args := []string{"set", "quota=" + value}
+	if s.reserve {
+		args = append(args, "reservation="+value)
+	}
+	if err := cmd("zfs", append(args, v.Dataset)...); err != nil {
+		return errors.Wrap(err, "error setting zfs quota")
+	}
+	v.SizeBytes = size
+	return nil
+}
+
+func (s *zfsStorage) destroy(v *volume) error {
+	if v.Dataset == "" {
+		return s.dir.destroy(v)
+	}
+	if err := destroyDataset(v.Dataset); err != nil {
+		return err
+	}
+	if err := os.Remove(v.Export.Path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "error removing volume dir")
+	}
+	return nil
+}
+
+func (s *zfsStorage) rename(v *volume, name string) error {
+	if v.Dataset == "" {
+		return s.dir.rename(v, name)
+	}
+	dataset, p := s.dataset(name), s.dir.g.nfsPath(v.Pool, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return errors.Wrap(err, "error creating volume dir")
+	}
+	if err := cmd("zfs", "rename", v.Dataset, dataset); err != nil {
+		return errors.Wrap(err, "error renaming zfs dataset")
+	}
+	if err := cmd("zfs", "set", "mountpoint="+p, dataset); err != nil {
+		cmd("zfs", "rename", dataset, v.Dataset)
+		return errors.Wrap(err, "error moving zfs dataset")
+	}
+	os.Remove(v.Export.Path)
+	v.Dataset = dataset
+	v.Export.Path = p
+	return nil
+}
+
+func (s *zfsStorage) canClone(v *volume) bool {
+	return v.Dataset != ""
+}
+
+// zfsCloneSnapshotPrefix names the snapshots clones are created from
+const zfsCloneSnapshotPrefix = "nfsg-clone-"
+
+func (s *zfsStorage) clone(tx *bolt.Tx, src, dst *volume) error {
+	if src.Dataset == "" {
+		return errInvalid("volume is not a zfs dataset")
+	}
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst.Export.Path), 0755); err != nil {
+		return errors.Wrap(err, "error creating volume dir")
+	}
+
+	origin := src.Dataset + "@" + zfsCloneSnapshotPrefix + id
+	if err := cmd("zfs", "snapshot", origin); err != nil {
+		return errors.Wrap(err, "error creating zfs snapshot")
+	}
+	dataset := s.dataset(dst.Name)
+	args := []string{"clone", "-o", "mountpoint=" + dst.Export.Path}
+	if dst.SizeBytes > 0 {
+		args = append(args, "-o", "quota="+strconv.FormatInt(dst.SizeBytes, 10))
+	}
+	if err := cmd("zfs", append(args, origin, dataset)...); err != nil {
+		cmd("zfs", "destroy", origin)
+		return errors.Wrap(err, "error cloning zfs dataset")
+	}
+	dst.Dataset = dataset
+	return nil
+}
+
+// destroyDataset destroys a dataset along with its snapshots, and the
+// snapshot it was cloned from if the gateway created it.
+func destroyDataset(dataset string) error {
+	out, err := runCommand("zfs", "get", "-H", "-o", "value", "origin", dataset)
+	if err != nil {
+		return errors.Wrap(err, "error getting zfs dataset origin")
+	}
+	if err := cmd("zfs", "destroy", "-r", dataset); err != nil {
+		return errors.Wrap(err, "error destroying zfs dataset")
+	}
+	if origin := strings.TrimSpace(string(out)); strings.Contains(origin, "@"+zfsCloneSnapshotPrefix) {
+		if err := cmd("zfs", "destroy", origin); err != nil {
+			return errors.Wrap(err, "error destroying zfs clone origin")
+		}
+	}
+	return nil
+}
+
+// btrfsStorage makes every volume a subvolume of the data root's btrfs
+// filesystem, with sizes enforced by qgroup limits.
+type btrfsStorage struct {
+	// dir handles volumes created before switching to btrfs
+	dir dirStorage
+}
+
+func newBtrfsStorage(dir dirStorage, p string) (btrfsStorage, error) {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(p, &fs); err != nil {
+		return btrfsStorage{}, errors.Wrap(err, "error getting filesystem stats")
+	}
+	if fs.Type != btrfsSuperMagic {
+		return btrfsStorage{}, errors.Errorf("%s is not on btrfs", p)
+	}
+	if _, err := exec.LookPath("btrfs"); err != nil {
+		return btrfsStorage{}, errors.Wrap(err, "could not find required binary 'btrfs'")
+	}
+	if err := cmd("btrfs", "quota", "enable", p); err != nil {
+		return btrfsStorage{}, errors.Wrap(err, "error enabling btrfs quotas")
+	}
+	return btrfsStorage{dir: dir}, nil
+}
+
+func (btrfsStorage) create(tx *bolt.Tx, v *volume, req api.CreateRequest) error {
+	if err := os.MkdirAll(filepath.Dir(v.Export.Path), 0755); err != nil {
+		return errors.Wrap(err, "error creating volume dir")
+	}
+	if err := cmd("btrfs", "subvolume", "create", v.Export.Path); err != nil {
+		return errors.Wrap(err, "error creating btrfs subvolume")
+	}
+	v.Subvolume = true
+	return limitSubvolume(v.Export.Path, req.SizeBytes)
+}
+
+func (s btrfsStorage) resize(tx *bolt.Tx, v *volume, size int64) error {
+	if !v.Subvolume {
+		return s.dir.resize(tx, v, size)
+	}
+	if size == 0 {
+		if err := cmd("btrfs", "qgroup", "limit", "none", v.Export.Path); err != nil {
+			return errors.Wrap(err, "error removing btrfs qgroup limit")
+		}
+	} else if err := limitSubvolume(v.Export.Path, size); err != nil {
+		return err
+	}
+	v.SizeBytes = size
+	return nil
+}
+
+func (s btrfsStorage) destroy(v *volume) error {
+	if !v.Subvolume {
+		return s.dir.destroy(v)
+	}
+	if _, err := os.Stat(v.Export.Path); os.IsNotExist(err) {
+		return nil
+	}
+	return errors.Wrap(cmd("btrfs", "subvolume", "delete", v.Export.Path), "error deleting btrfs subvolume")
+}
+
+func (btrfsStorage) clone(tx *bolt.Tx, src, dst *volume) error {
+	if !src.Subvolume {
+		return errInvalid("volume is not a btrfs subvolume")
+	}
+	if err := os.MkdirAll(filepath.Dir(dst.Export.Path), 0755); err != nil {
+		return errors.Wrap(err, "error creating volume dir")
+	}
+	if err := cmd("btrfs", "subvolume", "snapshot", src.Export.Path, dst.Export.Path); err != nil {
+		return errors.Wrap(err, "error cloning btrfs subvolume")
+	}
+	dst.Subvolume = true
+	return limitSubvolume(dst.Export.Path, dst.SizeBytes)
+}
+
+// rename moves subvolumes like any other directory
+func (s btrfsStorage) rename(v *volume, name string) error {
+	return s.dir.rename(v, name)
+}
+
+func (btrfsStorage) canClone(v *volume) bool {
+	return v.Subvolume
+}
+
+func limitSubvolume(p string, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	return errors.Wrap(cmd("btrfs", "qgroup", "limit", strconv.FormatInt(size, 10), p), "error setting btrfs qgroup limit")
+}
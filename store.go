@@ -0,0 +1,814 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// Volume metadata is kept in a Store, a key/value store whose keys are the
+// bucket path and key of the record, e.g. volumes/NAME or tenants/TENANT/NAME.
+// The local database is one, boltStore, Consul another. Gateways sharing a
+// store mirror their local store to it: committed changes are pushed to the
+// shared store and changes from other gateways are applied locally as the
+// store reports them. Every update of the local database holds the shared
+// store's lock, from applying the changes of other gateways until its own
+// are pushed, so two gateways can't create the same volume or write over
+// each other's changes.
+//
+// Volume records are stored without the state of the node holding them,
+// their status and loop device, which every gateway keeps for itself.
+// Changing only those stores nothing new, and records put to the local store
+// keep the local state, so gateways don't re-export in turn over each other's
+// status.
+
+// Store is a key/value store of volume metadata
+type Store interface {
+	// Get returns the value of key, nil if it doesn't exist
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+	Delete(key string) error
+	// List returns every key under prefix with its value
+	List(prefix string) (map[string][]byte, error)
+	// Lock blocks until the caller holds the store's write lock, which only
+	// one gateway holds at a time, and returns its release
+	Lock() (func(), error)
+	// Watch calls fn with every key under prefix, then again each time they
+	// change. It never returns.
+	Watch(prefix string, fn func(map[string][]byte))
+}
+
+type sharedBucket struct {
+	name []byte
+	// depth is how many levels of nested buckets the keys are under, tenant
+	// volumes are in a bucket per tenant
+	depth int
+	// volumes is set for buckets of volume records
+	volumes bool
+}
+
+// sharedBuckets hold what gateways sharing a store have in common, jobs,
+// trash and snapshots stay with the node that made them.
+var sharedBuckets = []sharedBucket{
+	{name: volumesBucket, volumes: true},
+	{name: tenantsBucket, depth: 1, volumes: true},
+	{name: settingsBucket},
+	{name: netgroupsBucket},
+	{name: policiesBucket},
+	{name: webhooksBucket},
+	{name: templatesBucket},
+}
+
+// sharedVolume returns a volume record without its node-local state
+func sharedVolume(data []byte) []byte {
+	var v volume
+	if err := json.Unmarshal(data, &v); err != nil {
+		return data
+	}
+	v.Status, v.StatusReason = "", ""
+	if v.Loop != nil {
+		l := *v.Loop
+		l.Device = ""
+		v.Loop = &l
+	}
+	shared, err := json.Marshal(&v)
+	if err != nil {
+		return data
+	}
+	return shared
+}
+
+// withLocalState returns a volume record from the store with the node-local
+// state of the local record, if there is one
+func withLocalState(data, local []byte) []byte {
+	var v, lv volume
+	if local == nil || json.Unmarshal(data, &v) != nil || json.Unmarshal(local, &lv) != nil {
+		return data
+	}
+	v.Status, v.StatusReason = lv.Status, lv.StatusReason
+	if v.Loop != nil && lv.Loop != nil && v.Loop.Image == lv.Loop.Image {
+		v.Loop.Device = lv.Loop.Device
+	}
+	merged, err := json.Marshal(&v)
+	if err != nil {
+		return data
+	}
+	return merged
+}
+
+func walkBucket(b *bolt.Bucket, p string, depth int, fn func(key string, v []byte)) error {
+	return b.ForEach(func(k, v []byte) error {
+		switch {
+		case depth > 0 && v == nil:
+			return walkBucket(b.Bucket(k), p+"/"+string(k), depth-1, fn)
+		case depth == 0 && v != nil:
+			fn(p+"/"+string(k), v)
+		}
+		return nil
+	})
+}
+
+// volumeRecords reports whether the bucket at path holds volume records
+func volumeRecords(path [][]byte) bool {
+	for _, sb := range sharedBuckets {
+		if bytes.Equal(sb.name, path[0]) {
+			return sb.volumes
+		}
+	}
+	return false
+}
+
+// splitStoreKey returns the bucket path and bolt key of a store key, nil if
+// the key isn't in a shared bucket.
+func splitStoreKey(key string) ([][]byte, []byte) {
+	for _, sb := range sharedBuckets {
+		if !strings.HasPrefix(key, string(sb.name)+"/") {
+			continue
+		}
+		// keys themselves may have slashes, e.g. tenant scoped netgroups
+		parts := strings.SplitN(strings.TrimPrefix(key, string(sb.name)+"/"), "/", sb.depth+1)
+		if len(parts) != sb.depth+1 || parts[sb.depth] == "" {
+			return nil, nil
+		}
+		path := [][]byte{sb.name}
+		for _, p := range parts[:sb.depth] {
+			path = append(path, []byte(p))
+		}
+		return path, []byte(parts[sb.depth])
+	}
+	return nil, nil
+}
+
+// bucketAt returns the bucket at path, nil if it doesn't exist unless create
+// is set.
+func bucketAt(tx *bolt.Tx, path [][]byte, create bool) (*bolt.Bucket, error) {
+	b := tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		if !create {
+			if b = b.Bucket(name); b == nil {
+				return nil, nil
+			}
+			continue
+		}
+		nb, err := b.CreateBucketIfNotExists(name)
+		if err != nil {
+			return nil, err
+		}
+		b = nb
+	}
+	return b, nil
+}
+
+// boltStore is the Store of the shared buckets of the local database
+type boltStore struct {
+	db *bolt.DB
+
+	mu       sync.Mutex
+	watchers []chan struct{}
+}
+
+func newBoltStore(db *bolt.DB) *boltStore {
+	return &boltStore{db: db}
+}
+
+func (s *boltStore) Get(key string) ([]byte, error) {
+	path, k := splitStoreKey(key)
+	if path == nil {
+		return nil, nil
+	}
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := bucketAt(tx, path, false)
+		if err != nil || b == nil {
+			return err
+		}
+		if v := b.Get(k); v != nil {
+			value = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if value != nil && volumeRecords(path) {
+		value = sharedVolume(value)
+	}
+	return value, dbError(errors.Wrap(err, "error reading metadata"))
+}
+
+// Put keeps the node-local state of volume records
+func (s *boltStore) Put(key string, value []byte) error {
+	path, k := splitStoreKey(key)
+	if path == nil {
+		return errors.Errorf("%s is not a metadata key", key)
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := bucketAt(tx, path, true)
+		if err != nil {
+			return err
+		}
+		if volumeRecords(path) {
+			value = withLocalState(value, b.Get(k))
+		}
+		return b.Put(k, value)
+	})
+	if err != nil {
+		return dbError(errors.Wrap(err, "error writing metadata"))
+	}
+	s.changed()
+	return nil
+}
+
+func (s *boltStore) Delete(key string) error {
+	path, k := splitStoreKey(key)
+	if path == nil {
+		return nil
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := bucketAt(tx, path, false)
+		if err != nil || b == nil {
+			return err
+		}
+		return b.Delete(k)
+	})
+	if err != nil {
+		return dbError(errors.Wrap(err, "error deleting metadata"))
+	}
+	s.changed()
+	return nil
+}
+
+// Lock is a no-op, the database's own write lock serializes updates
+func (s *boltStore) Lock() (func(), error) {
+	return func() {}, nil
+}
+
+func (s *boltStore) List(prefix string) (map[string][]byte, error) {
+	out := make(map[string][]byte)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, sb := range sharedBuckets {
+			sb := sb
+			err := walkBucket(tx.Bucket(sb.name), string(sb.name), sb.depth, func(k string, v []byte) {
+				if !strings.HasPrefix(k, prefix) {
+					return
+				}
+				if sb.volumes {
+					v = sharedVolume(v)
+				} else {
+					v = append([]byte(nil), v...)
+				}
+				out[k] = v
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return out, dbError(errors.Wrap(err, "error reading metadata"))
+}
+
+// Watch lists the keys after every committed update, fn is only called when
+// they changed since the last call
+func (s *boltStore) Watch(prefix string, fn func(map[string][]byte)) {
+	// the first list comes with the registration so no update is missed
+	ch := make(chan struct{}, 1)
+	ch <- struct{}{}
+	s.mu.Lock()
+	s.watchers = append(s.watchers, ch)
+	s.mu.Unlock()
+
+	var last map[string][]byte
+	for range ch {
+		kvs, err := s.List(prefix)
+		if err != nil {
+			logrus.WithError(err).Warn("error watching metadata")
+			continue
+		}
+		if last == nil || !reflect.DeepEqual(kvs, last) {
+			fn(kvs)
+		}
+		last = kvs
+	}
+}
+
+// changed is called after every committed update of the database
+func (s *boltStore) changed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ch := range s.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// storeMirror keeps the local store and a shared one in sync
+type storeMirror struct {
+	g      *gateway
+	local  *boltStore
+	shared Store
+
+	mu sync.Mutex
+	// synced is what the shared store is known to hold
+	synced map[string]string
+}
+
+func newStoreMirror(g *gateway, shared Store) *storeMirror {
+	return &storeMirror{
+		g:      g,
+		local:  newBoltStore(g.db),
+		shared: shared,
+		synced: make(map[string]string),
+	}
+}
+
+// start brings the local database in line with the shared store, or seeds an
+// empty store from it, and then keeps both in sync.
+func (m *storeMirror) start() error {
+	unlock, err := m.shared.Lock()
+	if err != nil {
+		return errors.Wrap(err, "error locking metadata store")
+	}
+	defer unlock()
+	remote, err := m.shared.List("")
+	if err != nil {
+		return err
+	}
+	if len(remote) == 0 {
+		logrus.Info("metadata store is empty, seeding it from the local database")
+		if err := m.push(nil); err != nil {
+			return err
+		}
+	} else if _, err := m.apply(remote, true); err != nil {
+		return err
+	}
+	go m.run()
+	go m.shared.Watch("", m.watched)
+	return nil
+}
+
+// write runs update, an update of the local database, holding the shared
+// store's lock. Changes of other gateways are applied first, so update sees
+// them, and its own are pushed before the lock is released.
+func (m *storeMirror) write(update func() error) error {
+	unlock, err := m.shared.Lock()
+	if err != nil {
+		return errors.Wrap(err, "error locking metadata store")
+	}
+	defer unlock()
+	if err := m.sync(); err != nil {
+		return err
+	}
+	if err := update(); err != nil {
+		return err
+	}
+	// the update is committed, run retries the push
+	if err := m.push(nil); err != nil {
+		logrus.WithError(err).Error("error pushing metadata to store")
+	}
+	return nil
+}
+
+// sync applies the changes of other gateways, re-exporting in the background
+// when there are any. The caller must hold the shared store's lock, so an
+// older list can't be applied over a newer one.
+func (m *storeMirror) sync() error {
+	remote, err := m.shared.List("")
+	if err != nil {
+		return err
+	}
+	changed, err := m.apply(remote, false)
+	if err != nil {
+		return errors.Wrap(err, "error syncing metadata from store")
+	}
+	if changed {
+		go m.reload()
+	}
+	return nil
+}
+
+// changed is called after every committed update
+func (m *storeMirror) changed() {
+	m.local.changed()
+}
+
+func (m *storeMirror) run() {
+	changes := make(chan map[string][]byte, 1)
+	go m.local.Watch("", func(kvs map[string][]byte) {
+		// only the latest state needs to be pushed
+		select {
+		case <-changes:
+		default:
+		}
+		changes <- kvs
+	})
+	retry := time.NewTimer(time.Hour)
+	retry.Stop()
+	for {
+		var local map[string][]byte
+		select {
+		case local = <-changes:
+		case <-retry.C:
+		}
+		if err := m.push(local); err != nil {
+			logrus.WithError(err).Error("error pushing metadata to store")
+			retry.Reset(10 * time.Second)
+		}
+	}
+}
+
+// push writes local changes since the last sync to the shared store, local
+// is read from the local store when it's nil
+func (m *storeMirror) push(local map[string][]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if local == nil {
+		var err error
+		if local, err = m.local.List(""); err != nil {
+			return err
+		}
+	}
+	for k, v := range local {
+		if cur, ok := m.synced[k]; ok && cur == string(v) {
+			continue
+		}
+		if err := m.shared.Put(k, v); err != nil {
+			return err
+		}
+		m.synced[k] = string(v)
+	}
+	for k := range m.synced {
+		if _, ok := local[k]; ok {
+			continue
+		}
+		if err := m.shared.Delete(k); err != nil {
+			return err
+		}
+		delete(m.synced, k)
+	}
+	return nil
+}
+
+// apply writes keys which changed in the shared store since the last sync to
+// the local store, all of them when full is set. It reports whether anything
+// changed.
+func (m *storeMirror) apply(remote map[string][]byte, full bool) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	local, err := m.local.List("")
+	if err != nil {
+		return false, err
+	}
+	var changed bool
+	for k, v := range remote {
+		if path, _ := splitStoreKey(k); path == nil {
+			continue
+		}
+		if cur, ok := m.synced[k]; ok && cur == string(v) && !full {
+			continue
+		}
+		if cur, ok := local[k]; ok && bytes.Equal(cur, v) {
+			continue
+		}
+		if err := m.local.Put(k, v); err != nil {
+			return changed, errors.Wrap(err, "error applying metadata from store")
+		}
+		changed = true
+	}
+	deleted := make(map[string]bool)
+	for k := range m.synced {
+		deleted[k] = true
+	}
+	if full {
+		for k := range local {
+			deleted[k] = true
+		}
+	}
+	for k := range deleted {
+		if _, ok := remote[k]; ok {
+			continue
+		}
+		if _, ok := local[k]; !ok {
+			continue
+		}
+		if err := m.local.Delete(k); err != nil {
+			return changed, errors.Wrap(err, "error applying metadata from store")
+		}
+		changed = true
+	}
+
+	m.synced = make(map[string]string, len(remote))
+	for k, v := range remote {
+		if path, _ := splitStoreKey(k); path != nil {
+			m.synced[k] = string(v)
+		}
+	}
+	return changed, nil
+}
+
+// watched applies changes made by other gateways. The keys are listed again
+// holding the lock, the ones watched may already be outdated.
+func (m *storeMirror) watched(map[string][]byte) {
+	unlock, err := m.shared.Lock()
+	if err != nil {
+		logrus.WithError(err).Error("error locking metadata store")
+		return
+	}
+	defer unlock()
+	if err := m.sync(); err != nil {
+		logrus.WithError(err).Error("error syncing metadata from store")
+	}
+}
+
+// reload re-exports volumes after changes from other gateways were applied
+func (m *storeMirror) reload() {
+	logrus.Debug("applying metadata changes from store")
+	m.g.refreshSettings()
+	if err := m.g.Reload(); err != nil {
+		logrus.WithError(err).Error("error re-exporting volumes after metadata change")
+	}
+}
+
+// consulStore keeps metadata in Consul's KV store, under prefix
+type consulStore struct {
+	addr   string
+	token  string
+	prefix string
+	client *http.Client
+
+	// lock is held with the store's lock, a session can acquire the lock
+	// key again while it holds it
+	lock sync.Mutex
+	// session holds the lock key, it's renewed until consul forgets it
+	sessionMu sync.Mutex
+	session   string
+}
+
+func newConsulStore(addr, token, prefix string) *consulStore {
+	if token == "" {
+		token = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &consulStore{addr: strings.TrimSuffix(addr, "/"), token: token, prefix: strings.Trim(prefix, "/") + "/", client: &http.Client{}}
+}
+
+type consulKV struct {
+	Key string
+	// Value is base64 encoded, which encoding/json decodes for []byte
+	Value []byte
+}
+
+func (c *consulStore) keyURL(key string, query url.Values) string {
+	u := c.addr + "/v1/kv/" + (&url.URL{Path: c.prefix + key}).EscapedPath()
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+func (c *consulStore) do(method, u string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating consul request")
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error making consul %s request", method)
+	}
+	// a missing prefix is an empty list
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, errors.Errorf("consul %s %s failed: %s: %s", method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func (c *consulStore) Get(key string) ([]byte, error) {
+	resp, err := c.do("GET", c.keyURL(key, url.Values{"raw": {"true"}}), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	value, err := ioutil.ReadAll(resp.Body)
+	return value, errors.Wrap(err, "error reading consul response")
+}
+
+func (c *consulStore) Put(key string, value []byte) error {
+	resp, err := c.do("PUT", c.keyURL(key, nil), value)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *consulStore) Delete(key string) error {
+	resp, err := c.do("DELETE", c.keyURL(key, nil), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *consulStore) List(prefix string) (map[string][]byte, error) {
+	kvs, _, err := c.listAt(prefix, 0)
+	return kvs, err
+}
+
+// listAt is a blocking query returning once the prefix changes after index
+func (c *consulStore) listAt(prefix string, index uint64) (map[string][]byte, uint64, error) {
+	query := url.Values{"recurse": {"true"}}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", "5m")
+	}
+	resp, err := c.do("GET", c.keyURL(prefix, query), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	out := make(map[string][]byte)
+	if resp.StatusCode == http.StatusNotFound {
+		return out, next, nil
+	}
+	var kvs []consulKV
+	if err := json.NewDecoder(resp.Body).Decode(&kvs); err != nil {
+		return nil, 0, errors.Wrap(err, "error decoding consul response")
+	}
+	for _, kv := range kvs {
+		out[strings.TrimPrefix(kv.Key, c.prefix)] = kv.Value
+	}
+	return out, next, nil
+}
+
+func (c *consulStore) Watch(prefix string, fn func(map[string][]byte)) {
+	var index uint64
+	for {
+		kvs, next, err := c.listAt(prefix, index)
+		if err != nil {
+			logrus.WithError(err).Warn("error watching consul")
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		// the index going backwards means consul's state was reset
+		if next < index {
+			next = 0
+		}
+		if next != index {
+			fn(kvs)
+		}
+		index = next
+	}
+}
+
+// consulSessionTTL is how long the lock outlives a gateway which stopped
+// renewing its session, e.g. because it died holding it
+const consulSessionTTL = 15 * time.Second
+
+// lockURL is the URL of the lock key, next to prefix rather than under it so
+// taking the lock doesn't wake the watches of the metadata
+func (c *consulStore) lockURL(query url.Values) string {
+	u := c.addr + "/v1/kv/" + (&url.URL{Path: strings.TrimSuffix(c.prefix, "/") + ".lock"}).EscapedPath()
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// Lock acquires the lock key with the gateway's session, waiting for the
+// gateway holding it to release it
+func (c *consulStore) Lock() (func(), error) {
+	c.lock.Lock()
+	session, err := c.sessionID()
+	if err != nil {
+		c.lock.Unlock()
+		return nil, err
+	}
+	var index uint64
+	for {
+		acquired, err := c.acquire(url.Values{"acquire": {session}})
+		if err != nil {
+			c.lock.Unlock()
+			return nil, err
+		}
+		if acquired {
+			break
+		}
+		if index, err = c.waitLock(index); err != nil {
+			c.lock.Unlock()
+			return nil, err
+		}
+	}
+	return func() {
+		// a lock left held is acquired again by the next Lock
+		if _, err := c.acquire(url.Values{"release": {session}}); err != nil {
+			logrus.WithError(err).Warn("error releasing consul lock")
+		}
+		c.lock.Unlock()
+	}, nil
+}
+
+// acquire acquires or releases the lock key, reporting whether consul did
+func (c *consulStore) acquire(query url.Values) (bool, error) {
+	resp, err := c.do("PUT", c.lockURL(query), nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	var ok bool
+	if err := json.NewDecoder(resp.Body).Decode(&ok); err != nil {
+		return false, errors.Wrap(err, "error decoding consul response")
+	}
+	return ok, nil
+}
+
+// waitLock is a blocking query returning once the lock key changes after
+// index
+func (c *consulStore) waitLock(index uint64) (uint64, error) {
+	query := url.Values{}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", consulSessionTTL.String())
+	}
+	resp, err := c.do("GET", c.lockURL(query), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	return next, nil
+}
+
+// sessionID returns the gateway's session, creating one the first time and
+// again once consul has forgotten the last one
+func (c *consulStore) sessionID() (string, error) {
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+	if c.session != "" {
+		return c.session, nil
+	}
+	body, err := json.Marshal(map[string]string{
+		"Name":      "nfs-rest-gateway",
+		"TTL":       consulSessionTTL.String(),
+		"Behavior":  "release",
+		"LockDelay": "1s",
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "error marshaling consul session")
+	}
+	resp, err := c.do("PUT", c.addr+"/v1/session/create", body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var created struct{ ID string }
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || created.ID == "" {
+		return "", errors.Errorf("error decoding consul session: %v", err)
+	}
+	c.session = created.ID
+	go c.renew(created.ID)
+	return c.session, nil
+}
+
+// renew keeps the session alive until consul no longer knows it
+func (c *consulStore) renew(session string) {
+	for {
+		time.Sleep(consulSessionTTL / 3)
+		resp, err := c.do("PUT", c.addr+"/v1/session/renew/"+session, nil)
+		if err != nil {
+			logrus.WithError(err).Warn("error renewing consul session")
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			logrus.Warn("consul session expired, creating a new one")
+			c.sessionMu.Lock()
+			c.session = ""
+			c.sessionMu.Unlock()
+			return
+		}
+	}
+}
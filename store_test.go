@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+)
+
+// memStore is a Store kept in memory, like a consul agent several gateways
+// talk to
+type memStore struct {
+	mu       sync.Mutex
+	kvs      map[string][]byte
+	watchers []chan struct{}
+	// lock is the store's write lock
+	lock sync.Mutex
+}
+
+func newMemStore() *memStore {
+	return &memStore{kvs: make(map[string][]byte)}
+}
+
+func (s *memStore) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kvs[key], nil
+}
+
+func (s *memStore) Put(key string, value []byte) error {
+	s.mu.Lock()
+	s.kvs[key] = append([]byte(nil), value...)
+	s.mu.Unlock()
+	s.notify()
+	return nil
+}
+
+func (s *memStore) Delete(key string) error {
+	s.mu.Lock()
+	delete(s.kvs, key)
+	s.mu.Unlock()
+	s.notify()
+	return nil
+}
+
+func (s *memStore) List(prefix string) (map[string][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string][]byte)
+	for k, v := range s.kvs {
+		if strings.HasPrefix(k, prefix) {
+			out[k] = v
+		}
+	}
+	return out, nil
+}
+
+func (s *memStore) Lock() (func(), error) {
+	s.lock.Lock()
+	return s.lock.Unlock, nil
+}
+
+func (s *memStore) Watch(prefix string, fn func(map[string][]byte)) {
+	ch := make(chan struct{}, 1)
+	ch <- struct{}{}
+	s.mu.Lock()
+	s.watchers = append(s.watchers, ch)
+	s.mu.Unlock()
+	for range ch {
+		kvs, _ := s.List(prefix)
+		fn(kvs)
+	}
+}
+
+func (s *memStore) notify() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ch := range s.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Volume records are read from the local store without the node's state of
+// the volume, and keep it when they're written.
+func TestBoltStoreLocalState(t *testing.T) {
+	g, cleanup := newTestGateway(t)
+	defer cleanup()
+	s := newBoltStore(g.db)
+	v := &volume{Name: volumeID("t", "v"), Description: "before", Status: api.VolumeAvailable}
+	if err := g.update(func(tx *bolt.Tx) error { return putVolume(tx, v) }); err != nil {
+		t.Fatal(err)
+	}
+
+	kvs, err := s.List("tenants/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, ok := kvs["tenants/t/v"]
+	if !ok || len(kvs) != 1 {
+		t.Fatalf("listed %v", kvs)
+	}
+	if got, err := s.Get("tenants/t/v"); err != nil || !reflect.DeepEqual(got, data) {
+		t.Fatalf("got %s, %v, want %s", got, err, data)
+	}
+	if strings.Contains(string(data), api.VolumeAvailable) {
+		t.Fatalf("stored with the local status: %s", data)
+	}
+
+	shared := strings.Replace(string(data), "before", "after", 1)
+	if err := s.Put("tenants/t/v", []byte(shared)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := g.lookup(v.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Description != "after" || got.Status != api.VolumeAvailable {
+		t.Fatalf("put changed the volume to %+v", got)
+	}
+
+	if err := s.Delete("tenants/t/v"); err != nil {
+		t.Fatal(err)
+	}
+	if g.stored(t, v.Name) {
+		t.Fatal("volume left after delete")
+	}
+	if got, err := s.Get("tenants/t/v"); got != nil || err != nil {
+		t.Fatalf("got %s, %v after delete", got, err)
+	}
+}
+
+// Gateways mirroring their metadata to the same store see each other's
+// volumes.
+func TestStoreMirror(t *testing.T) {
+	shared := newMemStore()
+	a, cleanupA := newTestGateway(t)
+	defer cleanupA()
+	b, cleanupB := newTestGateway(t)
+	defer cleanupB()
+	for _, g := range []*testGateway{a, b} {
+		g.mirror = newStoreMirror(g.gateway, shared)
+		if err := g.mirror.start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := a.update(func(tx *bolt.Tx) error { return putVolume(tx, &volume{Name: "v"}) }); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "volume to be shared", func() bool { return b.stored(t, "v") })
+
+	if err := b.update(func(tx *bolt.Tx) error { return deleteVolumeData(tx, "v") }); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "volume deletion to be shared", func() bool { return !a.stored(t, "v") })
+}
+
+// Gateways sharing a store can't both create the same volume.
+func TestStoreMirrorCreateRace(t *testing.T) {
+	shared := newMemStore()
+	var gateways []*testGateway
+	for i := 0; i < 2; i++ {
+		g, cleanup := newTestGateway(t)
+		defer cleanup()
+		g.mirror = newStoreMirror(g.gateway, shared)
+		if err := g.mirror.start(); err != nil {
+			t.Fatal(err)
+		}
+		// so both creates are under way at once
+		g.storage.delay = 50 * time.Millisecond
+		gateways = append(gateways, g)
+	}
+
+	errs := make(chan error, len(gateways))
+	for _, g := range gateways {
+		go func(g *testGateway) {
+			_, err := g.addVolume(context.Background(), "v", api.CreateRequest{Hosts: []string{"h"}}, "", true)
+			errs <- err
+		}(g)
+	}
+	var created int
+	for range gateways {
+		err := <-errs
+		if err == nil {
+			created++
+		} else if errorCode(err) != api.ErrCodeAlreadyExists {
+			t.Fatal(err)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("volume created by %d gateways", created)
+	}
+}
+
+// fakeConsul serves the session and lock key endpoints of consul, blocking
+// queries return right away
+type fakeConsul struct {
+	mu       sync.Mutex
+	sessions int
+	holder   string
+	index    uint64
+}
+
+func (c *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case r.URL.Path == "/v1/session/create":
+		c.sessions++
+		json.NewEncoder(w).Encode(map[string]string{"ID": strconv.Itoa(c.sessions)})
+	case strings.HasPrefix(r.URL.Path, "/v1/session/renew/"):
+	case r.URL.Path == "/v1/kv/nfsg.lock" && r.Method == "PUT":
+		q := r.URL.Query()
+		ok := true
+		switch {
+		case q.Get("acquire") != "":
+			ok = c.holder == "" || c.holder == q.Get("acquire")
+			if ok {
+				c.holder = q.Get("acquire")
+			}
+		case q.Get("release") != "":
+			ok = c.holder == q.Get("release")
+			if ok {
+				c.holder = ""
+			}
+		}
+		c.index++
+		json.NewEncoder(w).Encode(ok)
+	case r.URL.Path == "/v1/kv/nfsg.lock":
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+		w.Write([]byte("[]"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Only one gateway at a time holds the consul lock.
+func TestConsulLock(t *testing.T) {
+	srv := httptest.NewServer(&fakeConsul{})
+	defer srv.Close()
+	a, b := newConsulStore(srv.URL, "", "nfsg"), newConsulStore(srv.URL, "", "nfsg")
+
+	unlock, err := a.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan func())
+	go func() {
+		unlock, err := b.Lock()
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- unlock
+	}()
+	select {
+	case <-locked:
+		t.Fatal("lock taken while held by another gateway")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case unlock := <-locked:
+		unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock not taken once released")
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Subexports export a subdirectory of a volume to their own hosts with their
+// own options, so one dataset can be partitioned among clients. Exporters see
+// each one as a volume of its own named "<volume>:<id>", so it gets its own
+// exports file, ganesha export or pseudo-root mount.
+//
+// A subexport gets its own fsid, clients of the volume and of the subexport
+// must not mix up their file handles, and subtree_check unless its options
+// say otherwise, so its clients can't use handles of files outside of it. Its
+// directory has to be on the volume's filesystem, there is nothing for
+// crossmnt to cross, and is checked again without following symlinks each
+// time it's exported, so clients writing to the volume can't point it
+// elsewhere.
+
+func subexportName(volume, id string) string {
+	return volume + ":" + id
+}
+
+// subexportView returns the subexport as the exporters see it
+func subexportView(v *volume, s api.Subexport) *volume {
+	return &volume{
+		Name: subexportName(v.Name, s.ID),
+		Export: nfsExport{
+			Path:     filepath.Join(v.Export.Path, s.Path),
+			Hosts:    s.Hosts,
+			Options:  s.Options,
+			Security: s.Security,
+		},
+		FSID:     s.FSID,
+		ReadOnly: v.ReadOnly,
+		Mirror:   v.Mirror,
+	}
+}
+
+func validateSubexport(req *api.SubexportRequest) error {
+	p := path.Clean(req.Path)
+	if req.Path == "" || path.IsAbs(req.Path) || p == "." || p == ".." || strings.HasPrefix(p, "../") || strings.ContainsRune(p, 0) {
+		return &validationError{Field: "Path", Value: req.Path, Reason: "must be a subdirectory relative to the volume's root"}
+	}
+	req.Path = p
+	if len(req.Hosts) == 0 {
+		return &validationError{Field: "Hosts", Reason: "must provide at least one host"}
+	}
+	if err := validateHosts(req.Hosts); err != nil {
+		return err
+	}
+	if err := validateSecurity(req.Security); err != nil {
+		return err
+	}
+	if hasOption(req.Options, "fsid") {
+		return &validationError{Field: "Options", Value: req.Options, Reason: "subexports get their own fsid"}
+	}
+	return validateOptions(req.Options)
+}
+
+// checkSubdir makes sure rel is a directory below root on root's filesystem,
+// without following symlinks
+func checkSubdir(root, rel string) error {
+	dir, err := unix.Open(root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return errors.Wrap(err, "error opening volume dir")
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(dir, &st); err != nil {
+		unix.Close(dir)
+		return errors.Wrap(err, "error reading volume dir")
+	}
+	dev := st.Dev
+	for _, elem := range strings.Split(rel, "/") {
+		fd, err := unix.Openat(dir, elem, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		unix.Close(dir)
+		switch err {
+		case nil:
+		case unix.ENOENT, unix.ENOTDIR, unix.ELOOP:
+			return &validationError{Field: "Path", Value: rel, Reason: "must be an existing directory, not a symlink"}
+		default:
+			return errors.Wrap(err, "error opening subexport dir")
+		}
+		dir = fd
+	}
+	defer unix.Close(dir)
+	if err := unix.Fstat(dir, &st); err != nil {
+		return errors.Wrap(err, "error reading subexport dir")
+	}
+	if st.Dev != dev {
+		return &validationError{Field: "Path", Value: rel, Reason: "is on another filesystem than the volume"}
+	}
+	return nil
+}
+
+// exportSubexports applies the exports of the volume's subexports
+func (g *gateway) exportSubexports(ctx context.Context, v *volume) error {
+	for _, s := range v.Subexports {
+		if err := checkSubdir(v.Export.Path, s.Path); err != nil {
+			return errors.Wrap(err, "subexport "+s.ID)
+		}
+		if err := g.exporter.export(ctx, g.exportView(subexportView(v, s))); err != nil {
+			return errors.Wrap(err, "subexport "+s.ID)
+		}
+	}
+	return nil
+}
+
+// subexportViews returns the subexports of the volume to apply on reload,
+// leaving out those whose directory is gone
+func (g *gateway) subexportViews(v *volume) []*volume {
+	var views []*volume
+	for _, s := range v.Subexports {
+		if err := checkSubdir(v.Export.Path, s.Path); err != nil {
+			logrus.WithError(err).WithField("volume", v.Name).WithField("subexport", s.ID).Error("not exporting subexport")
+			continue
+		}
+		views = append(views, g.exportView(subexportView(v, s)))
+	}
+	return views
+}
+
+func findSubexport(v *volume, id string) (api.Subexport, bool) {
+	for _, s := range v.Subexports {
+		if s.ID == id {
+			return s, true
+		}
+	}
+	return api.Subexport{}, false
+}
+
+func (g *gateway) listSubexports(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	var v *volume
+	err := g.view(func(tx *bolt.Tx) error {
+		var err error
+		v, err = readVolume(tx, scopedName(r, name))
+		return err
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	subexports := v.Subexports
+	if subexports == nil {
+		subexports = []api.Subexport{}
+	}
+	writeAccessResponse(w, v, subexports, http.StatusOK)
+}
+
+func (g *gateway) getSubexport(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, id := vars["name"], vars["id"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	var v *volume
+	err := g.view(func(tx *bolt.Tx) error {
+		var err error
+		v, err = readVolume(tx, scopedName(r, name))
+		return err
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s, ok := findSubexport(v, id)
+	if !ok {
+		writeError(w, errNotFound("subexport not found"))
+		return
+	}
+	writeAccessResponse(w, v, s, http.StatusOK)
+}
+
+func (g *gateway) createSubexport(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	var req api.SubexportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	if err := validateSubexport(&req); err != nil {
+		writeError(w, err)
+		return
+	}
+	id, err := newID()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fsid, err := newFSID()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	s := api.Subexport{ID: id, Path: req.Path, Hosts: req.Hosts, Options: req.Options, Security: req.Security, FSID: fsid, CreatedAt: &now}
+	v, err := g.modifyVolume(r.Context(), scopedName(r, name), func(v *volume) error {
+		if err := checkIfMatch(r, v); err != nil {
+			return err
+		}
+		if v.Mirror {
+			return errMirror()
+		}
+		for _, existing := range v.Subexports {
+			if existing.Path == s.Path {
+				return errAlreadyExists("subexport " + existing.ID + " exports the same path")
+			}
+		}
+		if err := checkSubdir(v.Export.Path, s.Path); err != nil {
+			return err
+		}
+		s.Options = g.createOptions(s.Options)
+		if !hasOption(req.Options, "subtree_check") {
+			s.Options = mergeOptions(s.Options, "subtree_check")
+		}
+		v.Subexports = append(v.Subexports, s)
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s, _ = findSubexport(v, id)
+	writeAccessResponse(w, v, s, http.StatusCreated)
+}
+
+func (g *gateway) deleteSubexport(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name, id := vars["name"], vars["id"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	v, err := g.modifyVolume(r.Context(), scopedName(r, name), func(v *volume) error {
+		if err := checkIfMatch(r, v); err != nil {
+			return err
+		}
+		for i, s := range v.Subexports {
+			if s.ID == id {
+				if err := g.exporter.unexport(r.Context(), subexportView(v, s)); err != nil {
+					return err
+				}
+				v.Subexports = append(v.Subexports[:i], v.Subexports[i+1:]...)
+				return nil
+			}
+		}
+		return errNotFound("subexport not found")
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := setETag(w, v); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
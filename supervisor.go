@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// The output of the daemons is logged line by line with the daemon's name,
+// and the most recent lines of each are kept for /admin/daemons/{name}/logs.
+// Daemons listed in -disable-daemons, e.g. because the host already runs
+// them, aren't started and count as healthy.
+
+const (
+	daemonStarting  = "starting"
+	daemonRunning   = "running"
+	daemonBackoff   = "backoff"
+	daemonCompleted = "completed"
+	daemonDisabled  = "disabled"
+
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+	// a daemon that stayed up this long has its backoff reset
+	stableRuntime = time.Minute
+
+	// daemonLogSize is the number of output lines kept per daemon
+	daemonLogSize = 500
+	// maxDaemonLine limits the length of a logged output line
+	maxDaemonLine = 4096
+)
+
+// knownDaemons are the names -disable-daemons accepts
+var knownDaemons = []string{
+	"rpcbind", "rpc.mountd", "rpc.statd", "rpc.nfsd", "sm-notify",
+	"rpc.idmapd", "rpc.svcgssd", "rpc.gssd", "ganesha.nfsd",
+}
+
+// daemons supervises the helper processes the gateway depends on
+var daemons = &supervisor{}
+
+type DaemonStatus struct {
+	Name     string
+	State    string
+	PID      int    `json:",omitempty"`
+	Restarts int    `json:",omitempty"`
+	LastExit string `json:",omitempty"`
+	Since    time.Time
+}
+
+// DaemonLogLine is a line a daemon wrote to its stdout or stderr
+type DaemonLogLine struct {
+	Time   time.Time
+	Stream string
+	Line   string
+}
+
+type daemon struct {
+	bin  string
+	args []string
+	// oneshot daemons are expected to exit, they are only re-run on failure
+	oneshot bool
+
+	mu     sync.Mutex
+	status DaemonStatus
+	cmd    *exec.Cmd
+	// restarting is set when the daemon was stopped to be restarted
+	restarting bool
+
+	// logs keeps the most recent output lines across restarts
+	logs    []DaemonLogLine
+	logNext int
+}
+
+type supervisor struct {
+	mu       sync.Mutex
+	daemons  []*daemon
+	disabled map[string]bool
+}
+
+// disable keeps the named daemons from being started
+func (s *supervisor) disable(names []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range names {
+		known := false
+		for _, k := range knownDaemons {
+			known = known || k == name
+		}
+		if !known {
+			return errors.Errorf("unknown daemon %q, must be one of %s", name, strings.Join(knownDaemons, ", "))
+		}
+		if s.disabled == nil {
+			s.disabled = make(map[string]bool)
+		}
+		s.disabled[name] = true
+	}
+	return nil
+}
+
+func (s *supervisor) isDisabled(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.disabled[name]
+}
+
+// start runs a long running daemon, restarting it with backoff whenever it exits
+func (s *supervisor) start(name, bin string, args ...string) {
+	s.add(&daemon{bin: bin, args: args}, name)
+}
+
+// once runs a command which is expected to exit, retrying until it succeeds
+func (s *supervisor) once(name, bin string, args ...string) {
+	s.add(&daemon{bin: bin, args: args, oneshot: true}, name)
+}
+
+func (s *supervisor) add(d *daemon, name string) {
+	d.status = DaemonStatus{Name: name, State: daemonStarting, Since: time.Now().UTC()}
+	s.mu.Lock()
+	disabled := s.disabled[name]
+	if disabled {
+		d.status.State = daemonDisabled
+	}
+	s.daemons = append(s.daemons, d)
+	s.mu.Unlock()
+	if disabled {
+		logrus.WithField("daemon", name).Info("daemon is disabled, not starting it")
+		return
+	}
+	go d.run()
+}
+
+func (s *supervisor) get(name string) *daemon {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.daemons {
+		if d.status.Name == name {
+			return d
+		}
+	}
+	return nil
+}
+
+func (s *supervisor) status() []DaemonStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]DaemonStatus, 0, len(s.daemons))
+	for _, d := range s.daemons {
+		d.mu.Lock()
+		out = append(out, d.status)
+		d.mu.Unlock()
+	}
+	return out
+}
+
+// restart stops the named daemon so it's started again right away, e.g. to
+// pick up a changed config. Daemons not running pick it up when they start.
+func (s *supervisor) restart(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.daemons {
+		d.mu.Lock()
+		if d.status.Name == name && d.status.State == daemonRunning && !d.oneshot {
+			d.restarting = true
+			d.cmd.Process.Signal(syscall.SIGTERM)
+		}
+		d.mu.Unlock()
+	}
+}
+
+// healthy reports whether every daemon is running, has completed or is
+// disabled
+func (s *supervisor) healthy() bool {
+	for _, st := range s.status() {
+		if st.State != daemonRunning && st.State != daemonCompleted && st.State != daemonDisabled {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *daemon) setState(state string, pid int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.status.State != state {
+		logrus.WithField("daemon", d.status.Name).WithField("from", d.status.State).WithField("to", state).Info("daemon state changed")
+	}
+	d.status.State = state
+	d.status.PID = pid
+	d.status.Since = time.Now().UTC()
+}
+
+func (d *daemon) addLog(l DaemonLogLine) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.logs) < daemonLogSize {
+		d.logs = append(d.logs, l)
+		return
+	}
+	d.logs[d.logNext] = l
+	d.logNext = (d.logNext + 1) % daemonLogSize
+}
+
+// recentLogs returns up to n of the most recent output lines, oldest first
+func (d *daemon) recentLogs(n int) []DaemonLogLine {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]DaemonLogLine, 0, len(d.logs))
+	out = append(out, d.logs[d.logNext:]...)
+	out = append(out, d.logs[:d.logNext]...)
+	if len(out) > n {
+		out = out[len(out)-n:]
+	}
+	return out
+}
+
+// daemonOutput logs what a daemon writes to one of its streams a line at a
+// time
+type daemonOutput struct {
+	d      *daemon
+	stream string
+	buf    []byte
+}
+
+func (o *daemonOutput) Write(p []byte) (int, error) {
+	o.buf = append(o.buf, p...)
+	for {
+		i := bytes.IndexByte(o.buf, '\n')
+		if i < 0 {
+			break
+		}
+		o.log(o.buf[:i])
+		o.buf = o.buf[i+1:]
+	}
+	if len(o.buf) > maxDaemonLine {
+		o.log(o.buf)
+		o.buf = nil
+	}
+	return len(p), nil
+}
+
+// flush logs a last line without a newline
+func (o *daemonOutput) flush() {
+	if len(o.buf) > 0 {
+		o.log(o.buf)
+		o.buf = nil
+	}
+}
+
+func (o *daemonOutput) log(line []byte) {
+	if len(line) > maxDaemonLine {
+		line = line[:maxDaemonLine]
+	}
+	s := strings.TrimRight(string(line), "\r")
+	if strings.TrimSpace(s) == "" {
+		return
+	}
+	o.d.addLog(DaemonLogLine{Time: time.Now().UTC(), Stream: o.stream, Line: s})
+	logrus.WithField("daemon", o.d.status.Name).WithField("stream", o.stream).Info(s)
+}
+
+func (d *daemon) run() {
+	backoff := minBackoff
+	for {
+		cmd := exec.Command(d.bin, d.args...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Pdeathsig: syscall.SIGTERM,
+		}
+		stdout := &daemonOutput{d: d, stream: "stdout"}
+		stderr := &daemonOutput{d: d, stream: "stderr"}
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+
+		started := time.Now()
+		err := cmd.Start()
+		if err == nil {
+			d.mu.Lock()
+			d.cmd = cmd
+			d.mu.Unlock()
+			d.setState(daemonRunning, cmd.Process.Pid)
+			err = cmd.Wait()
+		}
+		stdout.flush()
+		stderr.flush()
+
+		d.mu.Lock()
+		restarting := d.restarting
+		d.restarting = false
+		d.mu.Unlock()
+		if restarting {
+			logrus.WithField("daemon", d.status.Name).Info("restarting daemon")
+			d.setState(daemonStarting, 0)
+			continue
+		}
+
+		if err == nil && d.oneshot {
+			d.setState(daemonCompleted, 0)
+			return
+		}
+		if err == nil {
+			err = errors.New("exited")
+		}
+
+		d.mu.Lock()
+		d.status.LastExit = err.Error()
+		d.status.Restarts++
+		d.mu.Unlock()
+
+		if time.Since(started) > stableRuntime {
+			backoff = minBackoff
+		}
+		logrus.WithField("daemon", d.status.Name).WithError(err).WithField("backoff", backoff).Warn("daemon exited, restarting")
+		d.setState(daemonBackoff, 0)
+		events.publish(&Event{Type: eventDaemonRestarted, Message: d.status.Name + ": " + err.Error()})
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (g *gateway) listDaemons(w http.ResponseWriter, r *http.Request) {
+	st := daemons.status()
+	sort.Slice(st, func(i, j int) bool { return st[i].Name < st[j].Name })
+	b, err := json.Marshal(st)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+func (g *gateway) getDaemonLogs(w http.ResponseWriter, r *http.Request) {
+	d := daemons.get(mux.Vars(r)["name"])
+	if d == nil {
+		writeError(w, errNotFound("daemon not found"))
+		return
+	}
+	n := daemonLogSize
+	if s := r.URL.Query().Get("lines"); s != "" {
+		l, err := strconv.Atoi(s)
+		if err != nil || l < 1 || l > daemonLogSize {
+			writeError(w, &validationError{Field: "lines", Value: s, Reason: fmt.Sprintf("must be between 1 and %d", daemonLogSize)})
+			return
+		}
+		n = l
+	}
+	b, err := json.Marshal(d.recentLogs(n))
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Templates are named defaults for new volumes. A create request naming a
+// template gets the template's hosts, security flavors, size and filesystem
+// type unless it sets them itself, and its options merged under the
+// template's. Templates only apply when a volume is created (or converged
+// with PUT /volumes/{name}), changing one leaves existing volumes alone.
+
+var templatesBucket = []byte("templates")
+
+var templateNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,63}$`)
+
+type Template struct {
+	Name     string
+	Hosts    []string `json:",omitempty"`
+	Options  string   `json:",omitempty"`
+	Security []string `json:",omitempty"`
+	// SizeBytes and FSType are the size limit and loop image filesystem of
+	// volumes created from the template
+	SizeBytes int64  `json:",omitempty"`
+	FSType    string `json:",omitempty"`
+}
+
+func validateTemplate(t *Template) error {
+	if !templateNameRe.MatchString(t.Name) {
+		return &validationError{Field: "Name", Value: t.Name, Reason: "must be 1-64 letters, digits, '_', '.' or '-'"}
+	}
+	if t.SizeBytes < 0 {
+		return errInvalid("SizeBytes must not be negative")
+	}
+	if _, ok := mkfsArgs[t.FSType]; t.FSType != "" && !ok {
+		return errInvalid("unsupported FSType: " + t.FSType)
+	}
+	if err := validateSecurity(t.Security); err != nil {
+		return err
+	}
+	if err := validateOptions(t.Options); err != nil {
+		return err
+	}
+	return validateHosts(t.Hosts)
+}
+
+func getTemplate(tx *bolt.Tx, name string) (*Template, error) {
+	data := tx.Bucket(templatesBucket).Get([]byte(name))
+	if data == nil {
+		return nil, errNotFound("template not found")
+	}
+	var t Template
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, dbError(errors.Wrap(err, "error unmarshaling template from database"))
+	}
+	return &t, nil
+}
+
+// applyTemplate fills in the settings the request leaves to its template
+func (g *gateway) applyTemplate(req *api.CreateRequest) error {
+	if req.Template == "" {
+		return nil
+	}
+	var t *Template
+	err := g.view(func(tx *bolt.Tx) (err error) {
+		t, err = getTemplate(tx, req.Template)
+		return err
+	})
+	if errorCode(err) == api.ErrCodeNotFound {
+		return &validationError{Field: "Template", Value: req.Template, Reason: "no such template"}
+	}
+	if err != nil {
+		return err
+	}
+	if req.Hosts == nil {
+		req.Hosts = t.Hosts
+	}
+	if req.Security == nil {
+		req.Security = t.Security
+	}
+	if req.SizeBytes == 0 {
+		req.SizeBytes = t.SizeBytes
+	}
+	if req.FSType == "" {
+		req.FSType = t.FSType
+	}
+	req.Options = mergeOptions(t.Options, req.Options)
+	return nil
+}
+
+func (g *gateway) listTemplates(w http.ResponseWriter, r *http.Request) {
+	templates := []Template{}
+	err := g.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(templatesBucket).ForEach(func(k, v []byte) error {
+			var t Template
+			if err := json.Unmarshal(v, &t); err != nil {
+				return dbError(errors.Wrap(err, "error unmarshaling template from database"))
+			}
+			templates = append(templates, t)
+			return nil
+		})
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeTemplate(w, templates, http.StatusOK)
+}
+
+func (g *gateway) getTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	var t *Template
+	err := g.view(func(tx *bolt.Tx) (err error) {
+		t, err = getTemplate(tx, mux.Vars(r)["name"])
+		return err
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeTemplate(w, t, http.StatusOK)
+}
+
+// putTemplate creates or replaces the template
+func (g *gateway) putTemplate(w http.ResponseWriter, r *http.Request) {
+	var t Template
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	t.Name = mux.Vars(r)["name"]
+	if err := validateTemplate(&t); err != nil {
+		writeError(w, err)
+		return
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling template"))
+		return
+	}
+	status := http.StatusOK
+	err = g.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(templatesBucket)
+		if b.Get([]byte(t.Name)) == nil {
+			status = http.StatusCreated
+		}
+		return dbError(errors.Wrap(b.Put([]byte(t.Name), data), "error writing template to database"))
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeTemplate(w, t, status)
+}
+
+func (g *gateway) deleteTemplate(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	err := g.update(func(tx *bolt.Tx) error {
+		if _, err := getTemplate(tx, name); err != nil {
+			return err
+		}
+		return dbError(errors.Wrap(tx.Bucket(templatesBucket).Delete([]byte(name)), "error deleting template from database"))
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeTemplate(w http.ResponseWriter, resp interface{}, status int) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(b)
+}
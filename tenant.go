@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// Volumes belonging to a tenant are stored in a bucket per tenant under
+// tenantsBucket, and their data lives under <root>/nfs/<tenant>/. Internally
+// such volumes are identified as <tenant>/<name>, volumes of the default
+// tenant (tokens without a tenant, or auth disabled) keep their plain name.
+var tenantsBucket = []byte("tenants")
+
+type tenantContextKey struct{}
+
+func withTenant(r *http.Request, tenant string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, tenant))
+}
+
+func requestTenant(r *http.Request) string {
+	return contextTenant(r.Context())
+}
+
+// contextTenant returns the tenant of the request ctx belongs to
+func contextTenant(ctx context.Context) string {
+	t, _ := ctx.Value(tenantContextKey{}).(string)
+	return t
+}
+
+func validateTenant(tenant string) error {
+	if tenant == "" {
+		return nil
+	}
+	if !volumeNamePolicy.pattern.MatchString(tenant) || strings.Contains(tenant, "/") {
+		return &validationError{Field: "tenant", Value: tenant, Reason: "must match " + volumeNamePolicy.pattern.String()}
+	}
+	return nil
+}
+
+func volumeID(tenant, name string) string {
+	if tenant == "" {
+		return name
+	}
+	return tenant + "/" + name
+}
+
+func splitVolumeID(id string) (tenant, name string) {
+	if i := strings.Index(id, "/"); i >= 0 {
+		return id[:i], id[i+1:]
+	}
+	return "", id
+}
+
+// scopedName maps a volume name given by the client to its internal id
+func scopedName(r *http.Request, name string) string {
+	return volumeID(requestTenant(r), name)
+}
+
+// displayName is the volume name as seen by its tenant
+func displayName(id string) string {
+	_, name := splitVolumeID(id)
+	return name
+}
+
+func volumeTenant(id string) string {
+	tenant, _ := splitVolumeID(id)
+	return tenant
+}
+
+// fileSafeName maps a volume id to something usable as a file name
+func fileSafeName(id string) string {
+	return strings.Replace(id, "/", "@", -1)
+}
+
+// volumeBucket returns the bucket the volume is stored in and its key there.
+// The tenant's bucket is created when tx is writable, otherwise the returned
+// bucket is nil if the tenant has no volumes.
+func volumeBucket(tx *bolt.Tx, id string) (*bolt.Bucket, []byte, error) {
+	tenant, name := splitVolumeID(id)
+	if tenant == "" {
+		return tx.Bucket(volumesBucket), []byte(name), nil
+	}
+	tb := tx.Bucket(tenantsBucket)
+	if !tx.Writable() {
+		return tb.Bucket([]byte(tenant)), []byte(name), nil
+	}
+	b, err := tb.CreateBucketIfNotExists([]byte(tenant))
+	if err != nil {
+		return nil, nil, dbError(errors.Wrap(err, "error creating tenant bucket"))
+	}
+	return b, []byte(name), nil
+}
+
+// getVolumeData returns the stored record for the volume, nil if it does not exist
+func getVolumeData(tx *bolt.Tx, id string) []byte {
+	b, key, err := volumeBucket(tx, id)
+	if err != nil || b == nil {
+		return nil
+	}
+	return b.Get(key)
+}
+
+func putVolume(tx *bolt.Tx, v *volume) error {
+	stampVolume(v)
+	return putVolumeState(tx, v)
+}
+
+// putVolumeState stores a change to the volume's node-local state, its
+// status or loop device, which isn't a change to the volume itself so it
+// keeps its modification time
+func putVolumeState(tx *bolt.Tx, v *volume) error {
+	b, key, err := volumeBucket(tx, v.Name)
+	if err != nil {
+		return err
+	}
+	vb, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling volume data")
+	}
+	id := v.Name
+	tx.OnCommit(func() { writeSidecar(id, vb) })
+	return dbError(errors.Wrap(b.Put(key, vb), "error writing volume to database"))
+}
+
+func deleteVolumeData(tx *bolt.Tx, id string) error {
+	b, key, err := volumeBucket(tx, id)
+	if err != nil {
+		return err
+	}
+	tx.OnCommit(func() { removeSidecar(id) })
+	return dbError(errors.Wrap(b.Delete(key), "error deleting entry from the database"))
+}
+
+// forEachVolume calls fn with every stored volume record of every tenant
+func forEachVolume(tx *bolt.Tx, fn func(data []byte) error) error {
+	err := tx.Bucket(volumesBucket).ForEach(func(k, v []byte) error {
+		return fn(v)
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(tenantsBucket).ForEach(func(tenant, _ []byte) error {
+		return tx.Bucket(tenantsBucket).Bucket(tenant).ForEach(func(k, v []byte) error {
+			return fn(v)
+		})
+	})
+}
+
+// checkTenantConflict makes sure tenant directories and default tenant
+// volumes never overlap, since both live directly under <root>/nfs.
+func (g *gateway) checkTenantConflict(tx *bolt.Tx, id string) error {
+	tenant, name := splitVolumeID(id)
+	if tenant != "" {
+		if tx.Bucket(volumesBucket).Get([]byte(tenant)) != nil {
+			return errAlreadyExists("tenant name conflicts with an existing volume")
+		}
+		return nil
+	}
+	if tx.Bucket(tenantsBucket).Bucket([]byte(name)) != nil || g.auth.hasTenant(name) {
+		return errAlreadyExists("volume name is reserved for a tenant")
+	}
+	return nil
+}
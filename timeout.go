@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Requests get a deadline on their context, which stops the commands and
+// database transactions run for them once it passes. Work which doesn't
+// watch the context can't be stopped, so the client gets a 504 at the
+// deadline regardless and whatever the handler writes afterwards is dropped.
+
+// streamingRoutes run for as long as the client wants, they only get a
+// timeout when one is set for them explicitly
+var streamingRoutes = map[string]bool{
+	"GET /events":                true,
+	"PUT /volume/{name}/replica": true,
+	"GET /admin/db/backup":       true,
+	"POST /admin/db/restore":     true,
+	"GET /volume/{name}/data":    true,
+	"PUT /volume/{name}/data":    true,
+}
+
+func errTimeout(err error) error {
+	return &codedError{code: api.ErrCodeTimeout, status: http.StatusGatewayTimeout, err: err}
+}
+
+type requestTimeouts struct {
+	router *mux.Router
+	// def applies to routes without their own timeout, 0 disables it
+	def time.Duration
+	// routes are keyed by method and path template, e.g. POST /volume
+	routes map[string]time.Duration
+}
+
+// parseRouteTimeouts parses comma separated "METHOD /path=duration" pairs,
+// the path being the route's template as listed in /openapi.json
+func parseRouteTimeouts(s string) (map[string]time.Duration, error) {
+	routes := make(map[string]time.Duration)
+	for _, t := range splitTokens(s) {
+		var fields []string
+		i := strings.LastIndex(t, "=")
+		if i >= 0 {
+			fields = strings.Fields(t[:i])
+		}
+		if len(fields) != 2 {
+			return nil, errors.Errorf("invalid route timeout %q, must be METHOD /path=duration", t)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(t[i+1:]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid route timeout %q", t)
+		}
+		routes[strings.ToUpper(fields[0])+" "+fields[1]] = d
+	}
+	return routes, nil
+}
+
+func (t *requestTimeouts) timeout(r *http.Request) time.Duration {
+	var m mux.RouteMatch
+	if !t.router.Match(r, &m) {
+		return t.def
+	}
+	tmpl, err := m.Route.GetPathTemplate()
+	if err != nil {
+		return t.def
+	}
+	key := r.Method + " " + tmpl
+	if d, ok := t.routes[key]; ok {
+		return d
+	}
+	if streamingRoutes[key] {
+		return 0
+	}
+	return t.def
+}
+
+func (t *requestTimeouts) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := t.timeout(r)
+		if d <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+
+		tw := &timeoutWriter{header: cloneHeader(w.Header())}
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+					return
+				}
+				close(done)
+			}()
+			next.ServeHTTP(tw, r.WithContext(ctx))
+		}()
+
+		select {
+		case p := <-panicked:
+			panic(p)
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			for k, v := range tw.header {
+				w.Header()[k] = v
+			}
+			if tw.code == 0 {
+				tw.code = http.StatusOK
+			}
+			w.WriteHeader(tw.code)
+			w.Write(tw.buf.Bytes())
+		case <-ctx.Done():
+			tw.mu.Lock()
+			tw.timedOut = true
+			tw.mu.Unlock()
+			if ctx.Err() == context.DeadlineExceeded {
+				writeError(w, errTimeout(errors.Errorf("request did not finish within %v", d)))
+			}
+		}
+	})
+}
+
+func cloneHeader(h http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for k, v := range h {
+		out[k] = append([]string(nil), v...)
+	}
+	return out
+}
+
+// timeoutWriter holds the response until the handler is done, so it can be
+// replaced by a 504 if the handler isn't done in time
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	buf      bytes.Buffer
+	code     int
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.code == 0 {
+		tw.code = http.StatusOK
+	}
+	return tw.buf.Write(p)
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.code != 0 {
+		return
+	}
+	tw.code = code
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Spans of requests, bolt transactions and commands are exported to an
+// OTLP/HTTP collector as JSON, the trace of the calling orchestrator is
+// continued from the W3C traceparent header.
+
+const (
+	traceparentHeader = "traceparent"
+
+	spanKindInternal = 1
+	spanKindServer   = 2
+
+	// spans are sent in batches of up to maxSpanBatch, at least every
+	// spanFlushInterval
+	maxSpanBatch      = 512
+	spanFlushInterval = 5 * time.Second
+)
+
+// tracing exports the spans, nil unless -otlp-endpoint is set
+var tracing *tracer
+
+type tracer struct {
+	url    string
+	client *http.Client
+	spans  chan *span
+	done   chan struct{}
+
+	mu      sync.RWMutex
+	stopped bool
+}
+
+// newTracer exports spans to the collector at endpoint, e.g.
+// http://localhost:4318
+func newTracer(endpoint string) *tracer {
+	return &tracer{
+		url:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client: &http.Client{Timeout: 10 * time.Second},
+		spans:  make(chan *span, 4*maxSpanBatch),
+		done:   make(chan struct{}),
+	}
+}
+
+// spanContext identifies a span in a trace
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	// sampled is unset when the caller doesn't record its trace
+	sampled bool
+}
+
+type spanContextKey struct{}
+
+func withSpanContext(ctx context.Context, sc spanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// parseTraceparent parses a version 00 traceparent header
+func parseTraceparent(h string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return sc, false
+	}
+	// all zero ids are invalid
+	if sc.traceID == [16]byte{} || sc.spanID == [8]byte{} {
+		return sc, false
+	}
+	sc.sampled = flags&1 == 1
+	return sc, true
+}
+
+type span struct {
+	spanContext
+	parent [8]byte
+	name   string
+	kind   int
+	start  time.Time
+	end    time.Time
+	attrs  map[string]interface{}
+	err    string
+}
+
+// startSpan starts a span in the trace of ctx, or a new trace. The span is
+// nil when tracing is disabled or the caller doesn't record the trace, its
+// methods do nothing then.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if tracing == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: make(map[string]interface{})}
+	if parent, ok := ctx.Value(spanContextKey{}).(spanContext); ok {
+		if !parent.sampled {
+			return ctx, nil
+		}
+		s.traceID, s.parent = parent.traceID, parent.spanID
+	} else if _, err := rand.Read(s.traceID[:]); err != nil {
+		return ctx, nil
+	}
+	if _, err := rand.Read(s.spanID[:]); err != nil {
+		return ctx, nil
+	}
+	s.sampled = true
+	return withSpanContext(ctx, s.spanContext), s
+}
+
+func (s *span) set(key string, value interface{}) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+// finish records the span, failed with err if it's set
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	tracing.mu.RLock()
+	defer tracing.mu.RUnlock()
+	if tracing.stopped {
+		return
+	}
+	select {
+	case tracing.spans <- s:
+	default:
+		// never let a slow collector block the gateway
+		logrus.WithField("span", s.name).Debug("span exporter is not keeping up, dropping span")
+	}
+}
+
+// run exports the spans in batches until stop is called
+func (t *tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(spanFlushInterval)
+	defer ticker.Stop()
+	var batch []*span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			logrus.WithError(err).WithField("spans", len(batch)).Warn("error exporting spans")
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= maxSpanBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// stop exports the spans left, spans ended afterwards are lost
+func (t *tracer) stop() {
+	t.mu.Lock()
+	t.stopped = true
+	close(t.spans)
+	t.mu.Unlock()
+	<-t.done
+}
+
+// The OTLP/HTTP JSON encoding of the spans, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func otlpValue(v interface{}) map[string]string {
+	switch v := v.(type) {
+	case int:
+		return map[string]string{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]string{"intValue": strconv.FormatInt(v, 10)}
+	default:
+		return map[string]string{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+func (s *span) otlp() otlpSpan {
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parent != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	keys := make([]string, 0, len(s.attrs))
+	for k := range s.attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		o.Attributes = append(o.Attributes, otlpAttribute{Key: k, Value: otlpValue(s.attrs[k])})
+	}
+	if s.err != "" {
+		// STATUS_CODE_ERROR
+		o.Status = &otlpStatus{Code: 2, Message: s.err}
+	}
+	return o
+}
+
+func (t *tracer) export(spans []*span) error {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		out = append(out, s.otlp())
+	}
+	scope := map[string]interface{}{
+		"scope": map[string]string{"name": "nfs-rest-gateway"},
+		"spans": out,
+	}
+	resource := map[string]interface{}{
+		"resource": map[string]interface{}{
+			"attributes": []otlpAttribute{{Key: "service.name", Value: otlpValue("nfs-rest-gateway")}},
+		},
+		"scopeSpans": []interface{}{scope},
+	}
+	b, err := json.Marshal(map[string]interface{}{"resourceSpans": []interface{}{resource}})
+	if err != nil {
+		return errors.Wrap(err, "error marshaling spans")
+	}
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "error sending spans")
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// traceRequests records a server span per request named after its route,
+// continuing the caller's trace
+func traceRequests(router *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tracing == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		if sc, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+			ctx = withSpanContext(ctx, sc)
+		}
+		name := r.Method
+		var m mux.RouteMatch
+		if router.Match(r, &m) {
+			if tmpl, err := m.Route.GetPathTemplate(); err == nil {
+				name += " " + tmpl
+			}
+		}
+		ctx, s := startSpan(ctx, name, spanKindServer)
+		s.set("http.method", r.Method)
+		s.set("http.target", r.URL.Path)
+		s.set("request_id", requestID(r))
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		s.set("http.status_code", rec.code)
+		var err error
+		if rec.code >= http.StatusInternalServerError {
+			err = errors.New(http.StatusText(rec.code))
+		}
+		s.finish(err)
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	cases := []struct {
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"", false, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902bx-01", false, false},
+	}
+	for _, tc := range cases {
+		sc, ok := parseTraceparent(tc.header)
+		if ok != tc.ok || sc.sampled != tc.sampled {
+			t.Errorf("%q: got %v sampled %v, want %v sampled %v", tc.header, ok, sc.sampled, tc.ok, tc.sampled)
+		}
+	}
+}
+
+type testTraces struct {
+	ResourceSpans []struct {
+		ScopeSpans []struct {
+			Spans []otlpSpan
+		}
+	}
+}
+
+func TestTraceRequests(t *testing.T) {
+	var traces []testTraces
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("spans sent to %s", r.URL.Path)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		var tr testTraces
+		if err := json.Unmarshal(b, &tr); err != nil {
+			t.Error(err)
+		}
+		traces = append(traces, tr)
+	}))
+	defer collector.Close()
+	tracing = newTracer(collector.URL)
+	go tracing.run()
+	defer func() { tracing = nil }()
+
+	r := mux.NewRouter()
+	r.Methods("GET").Path("/volume/{name}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, s := startSpan(r.Context(), "exec exportfs", spanKindInternal)
+		s.finish(errors.New("exportfs failed"))
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	h := traceRequests(r, r)
+	for _, flags := range []string{"01", "00"} {
+		req := httptest.NewRequest("GET", "/volume/v1", nil)
+		req.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-"+flags)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	tracing.stop()
+
+	var spans []otlpSpan
+	for _, tr := range traces {
+		for _, rs := range tr.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+	// the unsampled request isn't recorded
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2: %+v", len(spans), spans)
+	}
+	child, server := spans[0], spans[1]
+	if server.Name != "GET /volume/{name}" || server.Kind != spanKindServer || server.ParentSpanID != "00f067aa0ba902b7" {
+		t.Fatalf("server span %+v", server)
+	}
+	if child.Name != "exec exportfs" || child.ParentSpanID != server.SpanID {
+		t.Fatalf("child span %+v", child)
+	}
+	for _, s := range spans {
+		if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Fatalf("span %s continued trace %s", s.Name, s.TraceID)
+		}
+		if s.Status == nil || s.Status.Code != 2 {
+			t.Fatalf("span %s has status %+v, want an error", s.Name, s.Status)
+		}
+	}
+}
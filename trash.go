@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+var trashBucket = []byte("trash")
+
+// trashEntry records a deleted volume whose data can still be restored.
+// Keys are <volume id>/<unix nanos>, see volumeID.
+type trashEntry struct {
+	Volume volume
+	Path   string
+	// Dataset is what the volume's dataset is renamed to while trashed, so
+	// the name can be used again
+	Dataset string `json:",omitempty"`
+	Deleted time.Time
+}
+
+func (e *trashEntry) key() []byte {
+	return []byte(e.Volume.Name + "/" + strconv.FormatInt(e.Deleted.UnixNano(), 10))
+}
+
+// dataset returns the name of the trashed dataset, entries from before
+// datasets were renamed kept the volume's
+func (e *trashEntry) dataset() string {
+	if e.Dataset != "" {
+		return e.Dataset
+	}
+	return e.Volume.Dataset
+}
+
+// trashPath is where the data deleted at t is kept, id tells apart the copies
+// of a name deleted within the same second
+func (g *gateway) trashPath(pool, name string, t time.Time, id string) string {
+	return filepath.Join(g.poolRoot(pool), "trash", name+"-"+strconv.FormatInt(t.Unix(), 10)+"-"+id)
+}
+
+// moveToTrash moves the volume's data out of the export tree. For loop backed
+// volumes only the image is kept, datasets are renamed and mounted in the
+// trash instead.
+func (g *gateway) moveToTrash(v *volume) (*trashEntry, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	e := &trashEntry{Volume: *v, Deleted: time.Now().UTC()}
+	e.Path = g.trashPath(v.Pool, v.Name, e.Deleted, id)
+	if err := os.MkdirAll(filepath.Dir(e.Path), 0700); err != nil {
+		return nil, errors.Wrap(err, "error creating trash dir")
+	}
+
+	if v.Dataset != "" {
+		// volume names never contain ":", only the one separating the
+		// tenant, so no volume's dataset can have the trash name
+		e.Dataset = v.Dataset + ":trash:" + strconv.FormatInt(e.Deleted.Unix(), 10) + "-" + id
+		if err := cmd("zfs", "rename", v.Dataset, e.Dataset); err != nil {
+			return nil, errors.Wrap(err, "error renaming dataset into the trash")
+		}
+		if err := cmd("zfs", "set", "mountpoint="+e.Path, e.Dataset); err != nil {
+			cmd("zfs", "rename", e.Dataset, v.Dataset)
+			return nil, errors.Wrap(err, "error moving dataset to trash")
+		}
+		if err := os.Remove(v.Export.Path); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "error removing volume dir")
+		}
+		return e, nil
+	}
+
+	if v.Loop != nil {
+		if err := v.Loop.unmount(v.Export.Path); err != nil {
+			return nil, err
+		}
+		e.Path += ".img"
+		if err := os.Rename(v.Loop.Image, e.Path); err != nil {
+			return nil, errors.Wrap(err, "error moving volume image to trash")
+		}
+		if err := os.RemoveAll(v.Export.Path); err != nil {
+			return nil, errors.Wrap(err, "error removing volume dir")
+		}
+		return e, nil
+	}
+
+	if err := os.Rename(v.Export.Path, e.Path); err != nil {
+		return nil, errors.Wrap(err, "error moving volume data to trash")
+	}
+	return e, nil
+}
+
+func putTrashEntry(tx *bolt.Tx, e *trashEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling trash entry")
+	}
+	return dbError(errors.Wrap(tx.Bucket(trashBucket).Put(e.key(), data), "error writing trash entry to database"))
+}
+
+// latestTrashEntry finds the most recently deleted copy of the named volume
+func latestTrashEntry(tx *bolt.Tx, name string) (*trashEntry, error) {
+	prefix := []byte(name + "/")
+	var latest *trashEntry
+	c := tx.Bucket(trashBucket).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		var e trashEntry
+		if err := json.Unmarshal(v, &e); err != nil {
+			return nil, dbError(errors.Wrap(err, "error unmarshaling trash entry"))
+		}
+		// keys of a tenant with the same name as the volume share the prefix
+		if e.Volume.Name != name {
+			continue
+		}
+		if latest == nil || e.Deleted.After(latest.Deleted) {
+			latest = &e
+		}
+	}
+	return latest, nil
+}
+
+func (g *gateway) restoreTrash(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	name = scopedName(r, name)
+
+	defer g.locks.lock(name)()
+	var v *volume
+	err := g.updateUndo(r.Context(), name, func(tx *bolt.Tx, u *undoLog) error {
+		if getVolumeData(tx, name) != nil {
+			return errAlreadyExists("a volume with this name already exists")
+		}
+		if err := g.checkTenantConflict(tx, name); err != nil {
+			return err
+		}
+
+		e, err := latestTrashEntry(tx, name)
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			return errNotFound("no deleted volume found")
+		}
+		if err := checkScope(r, displayName(name), e.Volume.Labels); err != nil {
+			return err
+		}
+		v = &e.Volume
+		if err := g.checkQuota(tx, volumeTenant(name), v.sizeLimit()); err != nil {
+			return err
+		}
+		// it was trashed while deleting
+		v.setStatus(api.VolumeAvailable, "")
+
+		u.add("return data to trash", func() error { return g.returnToTrash(e) })
+		if err := g.restoreData(e); err != nil {
+			return err
+		}
+
+		if err := putVolume(tx, v); err != nil {
+			return err
+		}
+		if tenant := volumeTenant(name); tenant != "" {
+			if _, err := g.updateQuota(tx, tenant); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket(trashBucket).Delete(e.key()); err != nil {
+			return dbError(errors.Wrap(err, "error removing trash entry"))
+		}
+		u.add("unexport", func() error { return g.unexport(context.Background(), v) })
+		return g.export(r.Context(), v)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	volumeEvent(eventVolumeCreated, v.Name, nil)
+
+	b, err := json.Marshal(api.GetResponse{Name: displayName(v.Name), Path: v.Export.Path})
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+func (g *gateway) restoreData(e *trashEntry) error {
+	v := &e.Volume
+	if v.Dataset != "" {
+		if e.dataset() != v.Dataset {
+			if err := cmd("zfs", "rename", e.dataset(), v.Dataset); err != nil {
+				return errors.Wrap(err, "error renaming dataset out of the trash")
+			}
+		}
+		return errors.Wrap(cmd("zfs", "set", "mountpoint="+v.Export.Path, v.Dataset), "error restoring dataset")
+	}
+	if v.Loop == nil {
+		return errors.Wrap(os.Rename(e.Path, v.Export.Path), "error restoring volume data")
+	}
+
+	if err := os.MkdirAll(v.Export.Path, 0755); err != nil {
+		return errors.Wrap(err, "error creating volume dir")
+	}
+	if err := os.Rename(e.Path, v.Loop.Image); err != nil {
+		return errors.Wrap(err, "error restoring volume image")
+	}
+	return v.Loop.mount(v.Export.Path)
+}
+
+// returnToTrash undoes restoreData, which may have stopped part way
+func (g *gateway) returnToTrash(e *trashEntry) error {
+	v := &e.Volume
+	if v.Dataset != "" {
+		// unless the rename out of the trash failed
+		if _, err := runCommand("zfs", "list", "-H", "-o", "name", e.dataset()); err != nil {
+			if err := cmd("zfs", "rename", v.Dataset, e.dataset()); err != nil {
+				return errors.Wrap(err, "error renaming dataset back into the trash")
+			}
+		}
+		if err := cmd("zfs", "set", "mountpoint="+e.Path, e.dataset()); err != nil {
+			return errors.Wrap(err, "error moving dataset back to trash")
+		}
+		if err := os.Remove(v.Export.Path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "error removing volume dir")
+		}
+		return nil
+	}
+	if v.Loop == nil {
+		return moveBack(v.Export.Path, e.Path)
+	}
+	if err := v.Loop.unmount(v.Export.Path); err != nil {
+		return err
+	}
+	if err := moveBack(v.Loop.Image, e.Path); err != nil {
+		return err
+	}
+	if err := os.Remove(v.Export.Path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "error removing volume dir")
+	}
+	return nil
+}
+
+// moveBack renames restored data back to its trash path unless it never left
+func moveBack(p, trashPath string) error {
+	if _, err := os.Lstat(trashPath); err == nil {
+		return nil
+	}
+	return errors.Wrap(os.Rename(p, trashPath), "error moving volume data back to trash")
+}
+
+// reapTrash permanently removes trashed volumes older than the retention
+func (g *gateway) reapTrash() {
+	interval := g.trashRetention / 10
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	for {
+		if g.maintenance.active() {
+			time.Sleep(interval)
+			continue
+		}
+		if err := g.purgeTrash(time.Now().Add(-g.trashRetention)); err != nil {
+			logrus.WithError(err).Error("error purging trash")
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (g *gateway) purgeTrash(before time.Time) error {
+	return g.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(trashBucket)
+		var expired []*trashEntry
+		err := b.ForEach(func(k, v []byte) error {
+			var e trashEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return dbError(errors.Wrap(err, "error unmarshaling trash entry"))
+			}
+			if e.Deleted.Before(before) {
+				expired = append(expired, &e)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, e := range expired {
+			if err := purgeTrashData(e); err != nil {
+				logrus.WithError(err).WithField("path", e.Path).Error("error removing trashed volume data")
+				continue
+			}
+			if q := e.Volume.Project; q != nil {
+				if err := q.clear(); err != nil {
+					logrus.WithError(err).WithField("volume", e.Volume.Name).Warn("error removing project quota of trashed volume")
+				}
+			}
+			if err := b.Delete(e.key()); err != nil {
+				return dbError(errors.Wrap(err, "error removing trash entry"))
+			}
+			logrus.WithField("volume", e.Volume.Name).Info("purged deleted volume from trash")
+		}
+		return nil
+	})
+}
+
+func purgeTrashData(e *trashEntry) error {
+	if e.Volume.Dataset != "" {
+		return destroyDataset(e.dataset())
+	}
+	if e.Volume.Subvolume {
+		return errors.Wrap(cmd("btrfs", "subvolume", "delete", e.Path), "error deleting btrfs subvolume")
+	}
+	return os.RemoveAll(e.Path)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+)
+
+// A name deleted twice within a second keeps both copies in the trash.
+func TestTrashSameSecond(t *testing.T) {
+	g, cleanup := newTestGateway(t)
+	defer cleanup()
+	g.trashRetention = time.Hour
+	const name = "v"
+	for _, data := range []string{"first", "second"} {
+		if _, err := g.addVolume(context.Background(), name, api.CreateRequest{Hosts: []string{"h"}}, "", true); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(g.nfsPath("", name), "data"), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := g.removeVolume(name, false, func(string) {}); err != nil {
+			t.Fatalf("%s delete: %v", data, err)
+		}
+	}
+
+	var kept []string
+	err := g.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(trashBucket).ForEach(func(k, v []byte) error {
+			var e trashEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			data, err := ioutil.ReadFile(filepath.Join(e.Path, "data"))
+			if err != nil {
+				return err
+			}
+			kept = append(kept, string(data))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 2 || kept[0] == kept[1] {
+		t.Fatalf("trash kept %v, want both copies", kept)
+	}
+}
+
+// fakeZFS keeps each dataset as a file in $FAKE_ZFS_STATE holding its
+// mountpoint, changing the mountpoint moves the data
+const fakeZFS = `#!/bin/sh
+ds() { echo "$FAKE_ZFS_STATE/$(echo "$1" | tr / %)"; }
+op=$1
+shift
+for last; do :; done
+case $op in
+create)
+	mp=
+	while [ "$1" = -o ]; do
+		case $2 in mountpoint=*) mp=${2#mountpoint=} ;; esac
+		shift 2
+	done
+	if [ -e "$(ds "$1")" ]; then echo "cannot create '$1': dataset already exists" >&2; exit 1; fi
+	mkdir -p "$mp" && echo "$mp" >"$(ds "$1")" ;;
+rename)
+	if [ ! -e "$(ds "$1")" ] || [ -e "$(ds "$2")" ]; then echo "cannot rename '$1' to '$2'" >&2; exit 1; fi
+	mv "$(ds "$1")" "$(ds "$2")" ;;
+set)
+	f=$(ds "$2")
+	[ -e "$f" ] || exit 1
+	mp=${1#mountpoint=}
+	mkdir -p "$(dirname "$mp")" && mv "$(cat "$f")" "$mp" && echo "$mp" >"$f" ;;
+list)
+	[ -e "$(ds "$last")" ] ;;
+get)
+	echo - ;;
+destroy)
+	f=$(ds "$last")
+	[ -e "$f" ] || exit 1
+	rm -rf "$(cat "$f")" "$f" ;;
+*)
+	exit 1 ;;
+esac
+`
+
+// useFakeZFS puts fakeZFS first in $PATH until the returned function is
+// called
+func useFakeZFS(t *testing.T, dir string) func() {
+	bin := filepath.Join(dir, "bin")
+	state := filepath.Join(dir, "zfs")
+	for _, d := range []string{bin, state} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(bin, "zfs"), []byte(fakeZFS), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	os.Setenv("FAKE_ZFS_STATE", state)
+	return func() {
+		os.Setenv("PATH", path)
+		os.Unsetenv("FAKE_ZFS_STATE")
+	}
+}
+
+// A trashed dataset is renamed, so a volume of the same name can be created
+// before the trash is purged, and renamed back when restored.
+func TestTrashDatasetName(t *testing.T) {
+	g, cleanup := newTestGateway(t)
+	defer cleanup()
+	defer useFakeZFS(t, g.root)()
+	g.trashRetention = time.Hour
+	g.gateway.storage = sourceStorage{storage: &zfsStorage{dir: g.storage.dirStorage, parent: "tank/nfs"}, g: g.gateway}
+	const name = "v"
+	path := g.nfsPath("", name)
+
+	for _, data := range []string{"first", "second"} {
+		v, err := g.addVolume(context.Background(), name, api.CreateRequest{Hosts: []string{"h"}}, "", true)
+		if err != nil {
+			t.Fatalf("%s create: %v", data, err)
+		}
+		if v.Dataset != "tank/nfs/v" {
+			t.Fatalf("volume created as dataset %q", v.Dataset)
+		}
+		if err := ioutil.WriteFile(filepath.Join(path, "data"), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := g.removeVolume(name, false, func(string) {}); err != nil {
+			t.Fatalf("%s delete: %v", data, err)
+		}
+	}
+
+	r := mux.NewRouter()
+	r.Methods("POST").Path("/volume/{name}/restore-trash").HandlerFunc(g.restoreTrash)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("POST", "/volume/"+name+"/restore-trash", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("restore failed with %d: %s", rec.Code, rec.Body)
+	}
+	v, err := g.lookup(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Dataset != "tank/nfs/v" || !exists(filepath.Join(g.root, "zfs", "tank%nfs%v")) {
+		t.Fatalf("dataset %q not renamed back", v.Dataset)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(path, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "second" {
+		t.Fatalf("restored %q, want the latest copy", data)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+)
+
+// Mutations touching more than the database, e.g. creating a volume's data
+// and exporting it, record how to undo each step as they go. When a later
+// step or the commit fails the steps are undone, the last first, so no data
+// or export is left behind that the database doesn't know about.
+
+type undoStep struct {
+	desc string
+	fn   func() error
+}
+
+// undoLog holds the undo steps of a mutation
+type undoLog struct {
+	steps []undoStep
+}
+
+// add records how to undo a step. Steps which may fail part way are added
+// before they're run, their undo has to cope with them not having happened.
+func (u *undoLog) add(desc string, fn func() error) {
+	u.steps = append(u.steps, undoStep{desc: desc, fn: fn})
+}
+
+// rollback undoes the steps in reverse, logging those which fail
+func (u *undoLog) rollback(name string, cause error) {
+	for i := len(u.steps) - 1; i >= 0; i-- {
+		s := u.steps[i]
+		if err := s.fn(); err != nil {
+			logrus.WithError(err).WithField("volume", name).WithField("step", s.desc).WithField("cause", cause.Error()).Error("error rolling back")
+		}
+	}
+	u.steps = nil
+}
+
+// updateUndo is updateContext for mutations of the named volume with side
+// effects outside of the database, which are rolled back when fn or the
+// commit fails. Undo steps run after the transaction, without ctx.
+func (g *gateway) updateUndo(ctx context.Context, name string, fn func(*bolt.Tx, *undoLog) error) error {
+	u := &undoLog{}
+	err := g.updateContext(ctx, func(tx *bolt.Tx) error {
+		return fn(tx, u)
+	})
+	if err != nil {
+		u.rollback(name, err)
+	}
+	return err
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/cpuguy83/nfs-rest-gateway/api"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+func TestUndoLogRollback(t *testing.T) {
+	var undone []string
+	u := &undoLog{}
+	for _, step := range []string{"first", "second", "third"} {
+		step := step
+		u.add(step, func() error {
+			undone = append(undone, step)
+			if step == "second" {
+				return errors.New("undo failed")
+			}
+			return nil
+		})
+	}
+	u.rollback("v", errors.New("cause"))
+	if want := []string{"third", "second", "first"}; !reflect.DeepEqual(undone, want) {
+		t.Fatalf("undid %v, want %v", undone, want)
+	}
+	// a second rollback has nothing left to undo
+	u.rollback("v", errors.New("cause"))
+	if len(undone) != 3 {
+		t.Fatalf("steps undone twice: %v", undone)
+	}
+}
+
+// failCommits makes every following write to the database fail like a full
+// disk would, by putting /dev/full in place of its file
+func failCommits(t *testing.T, db *bolt.DB) {
+	full, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip("no /dev/full: ", err)
+	}
+	defer full.Close()
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("no /proc/self/fd: ", err)
+	}
+	for _, fd := range fds {
+		p, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name()))
+		if err != nil || p != db.Path() {
+			continue
+		}
+		n, err := strconv.Atoi(fd.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := unix.Dup2(int(full.Fd()), n); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	t.Fatal("database file not open")
+}
+
+// A create failing at any step must undo the steps before it, the last
+// first, and leave nothing stored, on disk or exported.
+func TestAddVolumeRollback(t *testing.T) {
+	cases := []struct {
+		name string
+		// fail sets up the failure
+		fail func(t *testing.T, g *testGateway)
+		req  api.CreateRequest
+		// ops are the storage and export operations expected, the undone
+		// ones last
+		ops []string
+	}{
+		{
+			name: "storage",
+			fail: func(t *testing.T, g *testGateway) { g.storage.failCreate = errors.New("no space") },
+			req:  api.CreateRequest{Hosts: []string{"h"}},
+			ops:  []string{"create", "destroy"},
+		},
+		{
+			// the volume dir is made before the image fails
+			name: "loop",
+			fail: func(t *testing.T, g *testGateway) {},
+			req:  api.CreateRequest{Hosts: []string{"h"}, SizeBytes: 1 << 20, FSType: "nofs"},
+			ops:  []string{"create", "destroy"},
+		},
+		{
+			name: "ownership",
+			fail: func(t *testing.T, g *testGateway) {},
+			req:  api.CreateRequest{Hosts: []string{"h"}, Mode: "not a mode"},
+			ops:  []string{"create", "destroy"},
+		},
+		{
+			name: "export",
+			fail: func(t *testing.T, g *testGateway) { g.exporter.failNext = errors.New("exportfs failed") },
+			req:  api.CreateRequest{Hosts: []string{"h"}},
+			ops:  []string{"create", "export", "unexport", "destroy"},
+		},
+		{
+			name: "commit",
+			fail: func(t *testing.T, g *testGateway) {
+				g.exporter.onExport = func() { failCommits(t, g.db) }
+			},
+			req: api.CreateRequest{Hosts: []string{"h"}},
+			ops: []string{"create", "export", "unexport", "destroy"},
+		},
+	}
+	for _, c := range cases {
+		func() {
+			g, cleanup := newTestGateway(t)
+			defer cleanup()
+			c.fail(t, g)
+			const name = "v"
+			path := g.nfsPath("", name)
+
+			if _, err := g.addVolume(context.Background(), name, c.req, "", true); err == nil {
+				t.Errorf("%s: create didn't fail", c.name)
+				return
+			}
+			if got := g.ops.list(); !reflect.DeepEqual(got, c.ops) {
+				t.Errorf("%s: got operations %v, want %v", c.name, got, c.ops)
+			}
+			if g.stored(t, name) {
+				t.Errorf("%s: volume stored", c.name)
+			}
+			if exists(path) {
+				t.Errorf("%s: volume data left behind", c.name)
+			}
+			if g.exporter.isExported(path) {
+				t.Errorf("%s: volume left exported", c.name)
+			}
+		}()
+	}
+}
+
+// A modification failing to export or commit must leave the volume as it
+// was, exported with its old settings.
+func TestModifyVolumeRollback(t *testing.T) {
+	for _, failure := range []string{"export", "commit"} {
+		func() {
+			g, cleanup := newTestGateway(t)
+			defer cleanup()
+			const name = "v"
+			if _, err := g.addVolume(context.Background(), name, api.CreateRequest{Hosts: []string{"old"}}, "", true); err != nil {
+				t.Fatal(err)
+			}
+			path := g.nfsPath("", name)
+			g.ops.reset()
+			if failure == "export" {
+				g.exporter.failNext = errors.New("exportfs failed")
+			} else {
+				g.exporter.onExport = func() {
+					g.exporter.onExport = nil
+					failCommits(t, g.db)
+				}
+			}
+
+			_, err := g.modifyVolume(context.Background(), name, func(v *volume) error {
+				v.Export.Hosts = []string{"new"}
+				return nil
+			})
+			if err == nil {
+				t.Errorf("%s: modify didn't fail", failure)
+				return
+			}
+			// the new export, then the old one again
+			if got, want := g.ops.list(), []string{"export", "export"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: got operations %v, want %v", failure, got, want)
+			}
+			if got := g.exporter.hosts(path); !reflect.DeepEqual(got, []string{"old"}) {
+				t.Errorf("%s: exported to %v after the rollback", failure, got)
+			}
+			var v *volume
+			err = g.view(func(tx *bolt.Tx) error {
+				var err error
+				v, err = readVolume(tx, name)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(v.Export.Hosts, []string{"old"}) {
+				t.Errorf("%s: stored hosts changed to %v", failure, v.Export.Hosts)
+			}
+		}()
+	}
+}
+
+// A snapshot whose record can't be committed is removed again.
+func TestSnapshotRollback(t *testing.T) {
+	g, cleanup := newTestGateway(t)
+	defer cleanup()
+	const name = "v"
+	if _, err := g.addVolume(context.Background(), name, api.CreateRequest{Hosts: []string{"h"}}, "", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(g.nfsPath("", name), "data"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	failCommits(t, g.db)
+
+	if _, err := g.snapshotVolume(name, false); err == nil {
+		t.Fatal("snapshot didn't fail")
+	}
+	snapshots, err := ioutil.ReadDir(filepath.Dir(g.snapshotPath("", name, "id")))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 0 {
+		t.Fatalf("snapshot %s left behind", snapshots[0].Name())
+	}
+}
+
+// failures are the ways the export step of an operation is made to fail: the
+// export itself, or committing the record once the volume is exported
+var failures = map[string]func(t *testing.T, g *testGateway){
+	"export": func(t *testing.T, g *testGateway) { g.exporter.failNext = errors.New("exportfs failed") },
+	"commit": func(t *testing.T, g *testGateway) {
+		g.exporter.onExport = func() {
+			g.exporter.onExport = nil
+			failCommits(t, g.db)
+		}
+	},
+}
+
+// A trash restore failing to export or commit puts the data back in the
+// trash and keeps its entry, so it can be restored again.
+func TestRestoreTrashRollback(t *testing.T) {
+	for failure, fail := range failures {
+		func() {
+			g, cleanup := newTestGateway(t)
+			defer cleanup()
+			g.trashRetention = time.Hour
+			const name = "v"
+			if _, err := g.addVolume(context.Background(), name, api.CreateRequest{Hosts: []string{"h"}}, "", true); err != nil {
+				t.Fatal(err)
+			}
+			path := g.nfsPath("", name)
+			if err := ioutil.WriteFile(filepath.Join(path, "data"), []byte("data"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := g.removeVolume(name, false, func(string) {}); err != nil {
+				t.Fatal(err)
+			}
+			var e *trashEntry
+			err := g.view(func(tx *bolt.Tx) error {
+				var err error
+				e, err = latestTrashEntry(tx, name)
+				return err
+			})
+			if err != nil || e == nil {
+				t.Fatalf("volume not trashed: %v", err)
+			}
+			fail(t, g)
+
+			r := mux.NewRouter()
+			r.Methods("POST").Path("/volume/{name}/restore-trash").HandlerFunc(g.restoreTrash)
+			restore := func() int {
+				rec := httptest.NewRecorder()
+				r.ServeHTTP(rec, httptest.NewRequest("POST", "/volume/"+name+"/restore-trash", nil))
+				return rec.Code
+			}
+			if code := restore(); code < http.StatusBadRequest {
+				t.Errorf("%s: restore didn't fail, got %d", failure, code)
+				return
+			}
+			if g.stored(t, name) {
+				t.Errorf("%s: volume stored", failure)
+			}
+			if exists(path) {
+				t.Errorf("%s: volume data left in place", failure)
+			}
+			if g.exporter.isExported(path) {
+				t.Errorf("%s: volume left exported", failure)
+			}
+			if !exists(filepath.Join(e.Path, "data")) {
+				t.Errorf("%s: volume data not returned to the trash", failure)
+			}
+			if failure == "commit" {
+				// nothing can be written anymore
+				return
+			}
+			if code := restore(); code != http.StatusOK {
+				t.Errorf("%s: restoring again failed with %d", failure, code)
+			}
+			if !exists(filepath.Join(path, "data")) {
+				t.Errorf("%s: volume data not restored", failure)
+			}
+		}()
+	}
+}
+
+// A batch item failing to export is discarded, the others are created.
+func TestCreateVolumesRollback(t *testing.T) {
+	g, cleanup := newTestGateway(t)
+	defer cleanup()
+	g.exporter.failNext = errors.New("exportfs failed")
+
+	r := mux.NewRouter()
+	r.Methods("POST").Path("/volumes/batch").HandlerFunc(g.createVolumes)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("POST", "/volumes/batch", strings.NewReader(`[{"Name":"a","Hosts":["h"]},{"Name":"b","Hosts":["h"]}]`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	var resp api.BatchCreateResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	var failed int
+	for _, res := range resp.Results {
+		path := g.nfsPath("", res.Name)
+		if res.Error == nil {
+			if !g.stored(t, res.Name) || !g.exporter.isExported(path) {
+				t.Errorf("%s: created volume not stored and exported", res.Name)
+			}
+			continue
+		}
+		failed++
+		if g.stored(t, res.Name) {
+			t.Errorf("%s: volume stored", res.Name)
+		}
+		if exists(path) {
+			t.Errorf("%s: volume data left behind", res.Name)
+		}
+		if g.exporter.isExported(path) {
+			t.Errorf("%s: volume left exported", res.Name)
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("%d items failed, want 1: %+v", failed, resp.Results)
+	}
+}
+
+// cloningStorage clones volumes by creating an empty directory
+type cloningStorage struct {
+	*testStorage
+}
+
+func (s cloningStorage) clone(tx *bolt.Tx, src, dst *volume) error {
+	s.ops.add("clone")
+	return os.MkdirAll(dst.Export.Path, 0755)
+}
+
+func (cloningStorage) canClone(v *volume) bool { return true }
+
+// A native clone failing to export or commit destroys the clone again.
+func TestCloneRollback(t *testing.T) {
+	for failure, fail := range failures {
+		func() {
+			g, cleanup := newTestGateway(t)
+			defer cleanup()
+			g.gateway.storage = sourceStorage{storage: cloningStorage{g.storage}, g: g.gateway}
+			if _, err := g.addVolume(context.Background(), "v", api.CreateRequest{Hosts: []string{"h"}}, "", true); err != nil {
+				t.Fatal(err)
+			}
+			const name = "c"
+			path := g.nfsPath("", name)
+			g.ops.reset()
+			fail(t, g)
+
+			if _, err := g.clone(context.Background(), "v", name, api.CloneRequest{Name: name}); err == nil {
+				t.Errorf("%s: clone didn't fail", failure)
+				return
+			}
+			if got, want := g.ops.list(), []string{"clone", "export", "unexport", "destroy"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: got operations %v, want %v", failure, got, want)
+			}
+			if g.stored(t, name) {
+				t.Errorf("%s: volume stored", failure)
+			}
+			if exists(path) {
+				t.Errorf("%s: volume data left behind", failure)
+			}
+			if g.exporter.isExported(path) {
+				t.Errorf("%s: volume left exported", failure)
+			}
+		}()
+	}
+}
+
+// A copied clone whose data can't be copied is discarded.
+func TestCopyCloneRollback(t *testing.T) {
+	g, cleanup := newTestGateway(t)
+	defer cleanup()
+	src, err := g.addVolume(context.Background(), "v", api.CreateRequest{Hosts: []string{"h"}}, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing to copy from
+	if err := os.RemoveAll(src.Export.Path); err != nil {
+		t.Fatal(err)
+	}
+	const name = "c"
+	path := g.nfsPath("", name)
+
+	if _, err := g.copyClone(context.Background(), &job{ID: "j"}, src, name, api.CloneRequest{Name: name}, func(string) {}); err == nil {
+		t.Fatal("clone didn't fail")
+	}
+	if g.stored(t, name) {
+		t.Error("volume stored")
+	}
+	if exists(path) {
+		t.Error("volume data left behind")
+	}
+	if g.exporter.isExported(path) {
+		t.Error("volume left exported")
+	}
+}
+
+// Imports and adoptions failing to export or commit are unexported again
+// and leave the directory alone.
+func TestAdoptRollback(t *testing.T) {
+	adopters := map[string]func(g *testGateway, dir string) error{
+		"import": func(g *testGateway, dir string) error {
+			_, err := g.adopt(context.Background(), "v", api.ImportRequest{Path: dir, Hosts: []string{"h"}})
+			return err
+		},
+		"orphan": func(g *testGateway, dir string) error {
+			_, err := g.adoptOrphanDir(context.Background(), &OrphanDirectory{Path: dir, Name: "v"}, api.ImportRequest{Hosts: []string{"h"}})
+			return err
+		},
+	}
+	for adopter, adopt := range adopters {
+		for failure, fail := range failures {
+			func() {
+				g, cleanup := newTestGateway(t)
+				defer cleanup()
+				dir := filepath.Join(g.root, "import", "v")
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				g.importPaths = []string{filepath.Dir(dir)}
+				fail(t, g)
+
+				if err := adopt(g, dir); err == nil {
+					t.Errorf("%s %s: adoption didn't fail", adopter, failure)
+					return
+				}
+				if got, want := g.ops.list(), []string{"export", "unexport"}; !reflect.DeepEqual(got, want) {
+					t.Errorf("%s %s: got operations %v, want %v", adopter, failure, got, want)
+				}
+				if g.stored(t, "v") {
+					t.Errorf("%s %s: volume stored", adopter, failure)
+				}
+				if g.exporter.isExported(dir) {
+					t.Errorf("%s %s: directory left exported", adopter, failure)
+				}
+				if !exists(dir) {
+					t.Errorf("%s %s: directory removed", adopter, failure)
+				}
+			}()
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+type UsageResponse struct {
+	Name          string
+	BytesUsed     int64
+	Inodes        int64
+	CapacityBytes int64
+	Collected     time.Time
+}
+
+// usageCollector caches volume usage since walking large volumes is expensive.
+// Values are refreshed in the background every interval, and on demand when
+// a requested value is older than that.
+type usageCollector struct {
+	g        *gateway
+	interval time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*UsageResponse
+}
+
+func newUsageCollector(g *gateway, interval time.Duration) *usageCollector {
+	return &usageCollector{g: g, interval: interval, cache: make(map[string]*UsageResponse)}
+}
+
+func (c *usageCollector) cached(name string) *UsageResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cache[name]
+}
+
+func (c *usageCollector) get(v *volume) (*UsageResponse, error) {
+	if u := c.cached(v.Name); u != nil && time.Since(u.Collected) < c.interval {
+		return u, nil
+	}
+	return c.refresh(v)
+}
+
+func (c *usageCollector) refresh(v *volume) (*UsageResponse, error) {
+	u, err := collectUsage(v)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.cache[v.Name] = u
+	c.mu.Unlock()
+	return u, nil
+}
+
+func (c *usageCollector) run() {
+	for {
+		vols, err := c.g.list()
+		if err != nil {
+			logrus.WithError(err).Error("error listing volumes for usage collection")
+		}
+
+		known := make(map[string]bool, len(vols))
+		for _, v := range vols {
+			known[v.Name] = true
+			if _, err := c.refresh(v); err != nil {
+				logrus.WithError(err).WithField("volume", v.Name).Debug("error collecting volume usage")
+			}
+		}
+
+		c.mu.Lock()
+		for name := range c.cache {
+			if !known[name] {
+				delete(c.cache, name)
+			}
+		}
+		c.mu.Unlock()
+		c.g.updateQuotas()
+
+		time.Sleep(c.interval)
+	}
+}
+
+// collectUsage computes usage for a volume. Loop backed volumes and datasets
+// have their own filesystem so statfs is exact and project quotas are read from the quota
+// accounting, everything else is walked and reports the capacity of the
+// shared filesystem.
+func collectUsage(v *volume) (*UsageResponse, error) {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(v.Export.Path, &fs); err != nil {
+		return nil, errors.Wrap(err, "error getting filesystem stats")
+	}
+	u := &UsageResponse{
+		Name:          displayName(v.Name),
+		CapacityBytes: int64(fs.Blocks) * int64(fs.Bsize),
+		Collected:     time.Now().UTC(),
+	}
+
+	if v.Loop != nil || v.Dataset != "" {
+		u.BytesUsed = int64(fs.Blocks-fs.Bfree) * int64(fs.Bsize)
+		u.Inodes = int64(fs.Files - fs.Ffree)
+		return u, nil
+	}
+
+	if v.Project != nil {
+		used, inodes, err := v.Project.usage()
+		if err != nil {
+			return nil, err
+		}
+		u.CapacityBytes = v.Project.SizeBytes
+		u.BytesUsed = used
+		u.Inodes = inodes
+		return u, nil
+	}
+
+	err := filepath.Walk(v.Export.Path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		u.Inodes++
+		if st, ok := info.Sys().(*unix.Stat_t); ok {
+			u.BytesUsed += st.Blocks * 512
+		} else {
+			u.BytesUsed += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error walking volume")
+	}
+	return u, nil
+}
+
+func (g *gateway) getUsage(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if err := validateName(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	name = scopedName(r, name)
+
+	v, err := g.lookup(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	u, err := g.usage.get(v)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	b, err := json.Marshal(u)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
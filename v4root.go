@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// In NFSv4-only mode volumes are bind mounted into a pseudo-root tree which
+// is exported with fsid=0, so clients mount server:/volumes/<name> instead of
+// the path on the server.
+
+// nfsv4Only is set when v2 and v3 are disabled, see -nfsv4-only
+var nfsv4Only bool
+
+// v4RootExportsFile is named so pruneExports leaves it alone
+const v4RootExportsFile = "nfsg.v4root.exports"
+
+// v4Only returns the settings with v2 and v3 disabled
+func (s *NFSDSettings) v4Only() *NFSDSettings {
+	out := &NFSDSettings{Versions: map[string]bool{"2": false, "3": false}}
+	if s == nil {
+		return out
+	}
+	out.Threads = s.Threads
+	for v, enabled := range s.Versions {
+		if v != "2" && v != "3" {
+			out.Versions[v] = enabled
+		}
+	}
+	return out
+}
+
+// v4Exporter exports volumes through their bind mounts in the pseudo-root
+type v4Exporter struct {
+	kernelExporter
+	root string
+
+	mu sync.Mutex
+	// paths maps the pseudo-root paths of exported volumes to their data
+	paths map[string]string
+}
+
+func newV4Exporter(root string) (*v4Exporter, error) {
+	if err := os.MkdirAll(filepath.Join(root, "volumes"), 0755); err != nil {
+		return nil, errors.Wrap(err, "error making nfsv4 root")
+	}
+	// no crossmnt, volumes are only reachable through their own exports
+	data := []byte("# managed by nfs-rest-gateway, nfsv4 pseudo-root\n" + quoteExportPath(root) + " *(ro,fsid=0,no_subtree_check)\n")
+	if err := ioutil.WriteFile(filepath.Join(exportsDir, v4RootExportsFile), data, 0644); err != nil {
+		return nil, errors.Wrap(err, "error writing nfsv4 root exports file")
+	}
+	return &v4Exporter{root: root, paths: make(map[string]string)}, nil
+}
+
+func (e *v4Exporter) pseudoPath(name string) string {
+	return filepath.Join(e.root, "volumes", name)
+}
+
+// view returns v as exported, from its place in the pseudo-root
+func (e *v4Exporter) view(v *volume) *volume {
+	p := *v
+	p.Export.Path = e.pseudoPath(v.Name)
+	return &p
+}
+
+func (e *v4Exporter) bind(v *volume) error {
+	p := e.pseudoPath(v.Name)
+	if err := os.MkdirAll(p, 0755); err != nil {
+		return errors.Wrap(err, "error making nfsv4 root mountpoint")
+	}
+	// isMountpoint can't tell bind mounts on the same filesystem apart
+	if m, err := mountPoint(p); err == nil && m == p {
+		e.record(p, v.Export.Path)
+		return nil
+	}
+	if err := unix.Mount(v.Export.Path, p, "", unix.MS_BIND, ""); err != nil {
+		return errors.Wrap(err, "error bind mounting volume into nfsv4 root")
+	}
+	e.record(p, v.Export.Path)
+	return nil
+}
+
+func (e *v4Exporter) unbind(v *volume) error {
+	p := e.pseudoPath(v.Name)
+	if err := unix.Unmount(p, 0); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		return errors.Wrap(err, "error unmounting volume from nfsv4 root")
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "error removing nfsv4 root mountpoint")
+	}
+	e.mu.Lock()
+	delete(e.paths, p)
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *v4Exporter) record(pseudo, data string) {
+	e.mu.Lock()
+	e.paths[pseudo] = data
+	e.mu.Unlock()
+}
+
+func (e *v4Exporter) export(ctx context.Context, v *volume) error {
+	if !v.Export.hasClients() {
+		return e.unexport(ctx, v)
+	}
+	if err := e.bind(v); err != nil {
+		return err
+	}
+	return e.kernelExporter.export(ctx, e.view(v))
+}
+
+func (e *v4Exporter) unexport(ctx context.Context, v *volume) error {
+	if err := e.kernelExporter.unexport(ctx, e.view(v)); err != nil {
+		return err
+	}
+	return e.unbind(v)
+}
+
+func (e *v4Exporter) reload(vols []*volume) error {
+	views := make([]*volume, 0, len(vols))
+	for _, v := range vols {
+		if v.Export.hasClients() {
+			if err := e.bind(v); err != nil {
+				logrus.WithError(err).WithField("volume", v.Name).Error("error binding volume into nfsv4 root on reload")
+				continue
+			}
+		}
+		views = append(views, e.view(v))
+	}
+	return e.kernelExporter.reload(views)
+}
+
+// exportedPaths reports the data paths of the volumes exported through the
+// pseudo-root, and any other exports as they are.
+func (e *v4Exporter) exportedPaths() (map[string]bool, error) {
+	exported, err := e.kernelExporter.exportedPaths()
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := make(map[string]bool, len(exported))
+	for p := range exported {
+		switch {
+		case p == e.root:
+		case e.paths[p] != "":
+			out[e.paths[p]] = true
+		default:
+			out[p] = true
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// namePolicy describes what volume names are accepted. Names end up in
+// filesystem paths and export file names so the defaults are conservative,
+// and names which would leave the volume's directory, those with a slash or
+// a NUL and . and .., are refused whatever pattern is configured.
+type namePolicy struct {
+	pattern  *regexp.Regexp
+	maxLen   int
+	reserved map[string]bool
+}
+
+var volumeNamePolicy = namePolicy{
+	pattern:  regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`),
+	maxLen:   128,
+	reserved: map[string]bool{"lost+found": true},
+}
+
+type validationError struct {
+	Field  string
+	Value  string
+	Reason string
+}
+
+func (e *validationError) Error() string {
+	return fmt.Sprintf("invalid %s %q: %s", e.Field, e.Value, e.Reason)
+}
+
+func (p namePolicy) validate(name string) error {
+	switch {
+	case name == "":
+		return &validationError{Field: "name", Value: name, Reason: "must not be empty"}
+	case len(name) > p.maxLen:
+		return &validationError{Field: "name", Value: name, Reason: fmt.Sprintf("must be at most %d characters", p.maxLen)}
+	case name == "." || name == "..":
+		return &validationError{Field: "name", Value: name, Reason: "must not be . or .."}
+	case strings.ContainsAny(name, "/\x00"):
+		return &validationError{Field: "name", Value: name, Reason: "must not contain / or NUL"}
+	case !p.pattern.MatchString(name):
+		return &validationError{Field: "name", Value: name, Reason: "must match " + p.pattern.String()}
+	case p.reserved[strings.ToLower(name)]:
+		return &validationError{Field: "name", Value: name, Reason: "name is reserved"}
+	}
+	return nil
+}
+
+func validateName(name string) error {
+	return volumeNamePolicy.validate(name)
+}
+
+// setNamePolicy overrides the default policy from command line settings
+func setNamePolicy(pattern string, maxLen int, reserved string) error {
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		volumeNamePolicy.pattern = re
+	}
+	if maxLen > 0 {
+		volumeNamePolicy.maxLen = maxLen
+	}
+	for _, n := range splitTokens(reserved) {
+		volumeNamePolicy.reserved[strings.ToLower(n)] = true
+	}
+	return nil
+}
+
+// checkVolumeNames reports stored volumes whose names do not satisfy the
+// current policy, such as ones created before names were validated.
+func checkVolumeNames(db *bolt.DB) ([]string, error) {
+	var bad []string
+	err := db.View(func(tx *bolt.Tx) error {
+		return forEachVolume(tx, func(data []byte) error {
+			var v volume
+			if err := json.Unmarshal(data, &v); err != nil {
+				return errors.Wrap(err, "error unmarshaling volume from database")
+			}
+			if err := validateName(displayName(v.Name)); err != nil {
+				logrus.WithField("volume", v.Name).WithError(err).Warn("existing volume does not satisfy the naming policy")
+				bad = append(bad, v.Name)
+			}
+			return nil
+		})
+	})
+	return bad, err
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+var webhooksBucket = []byte("webhooks")
+
+const (
+	webhookAttempts   = 5
+	webhookTimeout    = 10 * time.Second
+	webhookSignatureH = "X-NFSG-Signature"
+)
+
+type Webhook struct {
+	ID  string
+	URL string
+	// Secret signs each payload, the signature is sent as
+	// X-NFSG-Signature: sha256=<hex hmac of the body>. It is never returned.
+	Secret string `json:",omitempty"`
+	// Events limits the event types delivered, empty means all of them
+	Events []string `json:",omitempty"`
+	Tenant string   `json:"-"`
+}
+
+// webhookRecord is how webhooks are stored, unlike the API type it keeps
+// the tenant.
+type webhookRecord struct {
+	Webhook
+	Tenant string `json:",omitempty"`
+}
+
+func (h *Webhook) wants(e *Event) bool {
+	if e.tenant != h.Tenant {
+		return false
+	}
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, t := range h.Events {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *gateway) createWebhook(w http.ResponseWriter, r *http.Request) {
+	var h Webhook
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+		writeError(w, errInvalid(errors.Wrap(err, "error decoding request").Error()))
+		return
+	}
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeError(w, &validationError{Field: "URL", Value: h.URL, Reason: "must be an absolute http or https URL"})
+		return
+	}
+	h.ID, err = newID()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	h.Tenant = requestTenant(r)
+
+	data, err := json.Marshal(webhookRecord{Webhook: h, Tenant: h.Tenant})
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling webhook"))
+		return
+	}
+	err = g.update(func(tx *bolt.Tx) error {
+		return dbError(errors.Wrap(tx.Bucket(webhooksBucket).Put([]byte(h.ID), data), "error writing webhook to database"))
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	h.Secret = ""
+	b, err := json.Marshal(h)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
+
+func (g *gateway) webhooks() ([]*Webhook, error) {
+	var hooks []*Webhook
+	err := g.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhooksBucket).ForEach(func(k, v []byte) error {
+			var rec webhookRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return dbError(errors.Wrap(err, "error unmarshaling webhook from database"))
+			}
+			rec.Webhook.Tenant = rec.Tenant
+			hooks = append(hooks, &rec.Webhook)
+			return nil
+		})
+	})
+	return hooks, dbError(err)
+}
+
+func (g *gateway) listWebhooks(w http.ResponseWriter, r *http.Request) {
+	hooks, err := g.webhooks()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	tenant := requestTenant(r)
+	resp := []Webhook{}
+	for _, h := range hooks {
+		if h.Tenant != tenant {
+			continue
+		}
+		h.Secret = ""
+		resp = append(resp, *h)
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, errors.Wrap(err, "error marshaling response"))
+		return
+	}
+	w.Write(b)
+}
+
+func (g *gateway) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	tenant := requestTenant(r)
+	err := g.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(webhooksBucket)
+		data := b.Get([]byte(id))
+		if data == nil {
+			return errNotFound("webhook not found")
+		}
+		var rec webhookRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return dbError(errors.Wrap(err, "error unmarshaling webhook from database"))
+		}
+		if rec.Tenant != tenant {
+			return errNotFound("webhook not found")
+		}
+		return dbError(errors.Wrap(b.Delete([]byte(id)), "error deleting webhook from database"))
+	})
+	if err != nil {
+		writeError(w, err)
+	}
+}
+
+// runWebhooks delivers every published event to the matching webhooks
+func (g *gateway) runWebhooks() {
+	ch := events.subscribe()
+	client := &http.Client{Timeout: webhookTimeout}
+	for e := range ch {
+		hooks, err := g.webhooks()
+		if err != nil {
+			logrus.WithError(err).Error("error loading webhooks")
+			continue
+		}
+		for _, h := range hooks {
+			if h.wants(e) {
+				go deliverWebhook(client, h, e)
+			}
+		}
+	}
+}
+
+func deliverWebhook(client *http.Client, h *Webhook, e *Event) {
+	log := logrus.WithField("webhook", h.ID).WithField("event", e.Type)
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.WithError(err).Error("error marshaling event")
+		return
+	}
+
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := postWebhook(client, h, body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			log.WithError(err).Error("giving up delivering webhook")
+			return
+		}
+		log.WithError(err).WithField("attempt", attempt).Warn("error delivering webhook, retrying")
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func postWebhook(client *http.Client, h *Webhook, body []byte) error {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.Secret))
+		mac.Write(body)
+		req.Header.Set(webhookSignatureH, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}